@@ -10,6 +10,7 @@ import (
 	"github.com/libp2p/go-libp2p-core/crypto"
 	"github.com/libp2p/go-libp2p-core/host"
 	"github.com/libp2p/go-libp2p-core/metrics"
+	"github.com/libp2p/go-libp2p-core/mux"
 	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/libp2p/go-libp2p-core/peerstore"
@@ -18,9 +19,21 @@ import (
 	"github.com/libp2p/go-libp2p-core/transport"
 	"github.com/libp2p/go-libp2p-peerstore/pstoremem"
 
+	"github.com/libp2p/go-libp2p/p2p/host/addrmap"
+	"github.com/libp2p/go-libp2p/p2p/host/audit"
 	bhost "github.com/libp2p/go-libp2p/p2p/host/basic"
+	"github.com/libp2p/go-libp2p/p2p/host/extaddr"
+	"github.com/libp2p/go-libp2p/p2p/host/handlermetrics"
+	"github.com/libp2p/go-libp2p/p2p/host/lowmem"
+	"github.com/libp2p/go-libp2p/p2p/host/quota"
 	"github.com/libp2p/go-libp2p/p2p/host/relay"
 	routed "github.com/libp2p/go-libp2p/p2p/host/routed"
+	"github.com/libp2p/go-libp2p/p2p/net/addrfamily"
+	"github.com/libp2p/go-libp2p/p2p/net/authtoken"
+	"github.com/libp2p/go-libp2p/p2p/net/bwcap"
+	"github.com/libp2p/go-libp2p/p2p/net/nat64"
+	"github.com/libp2p/go-libp2p/p2p/net/upgradeq"
+	"github.com/libp2p/go-libp2p/p2p/protocol/identify"
 
 	autonat "github.com/libp2p/go-libp2p-autonat"
 	blankhost "github.com/libp2p/go-libp2p-blankhost"
@@ -28,6 +41,7 @@ import (
 	discovery "github.com/libp2p/go-libp2p-discovery"
 	swarm "github.com/libp2p/go-libp2p-swarm"
 	tptu "github.com/libp2p/go-libp2p-transport-upgrader"
+	yamux "github.com/libp2p/go-libp2p-yamux"
 
 	logging "github.com/ipfs/go-log/v2"
 	ma "github.com/multiformats/go-multiaddr"
@@ -88,6 +102,31 @@ type Config struct {
 
 	MultiaddrResolver *madns.Resolver
 
+	Auditor    *audit.Auditor
+	StreamGate bhost.StreamGate
+	AddrFamily addrfamily.Policy
+	Quotas     *quota.Manager
+
+	HandlerMetrics *handlermetrics.Tracker
+
+	ExternalAddrs  *extaddr.Book
+	AddrTranslator addrmap.Translator
+
+	AuthToken          authtoken.TokenFunc
+	AuthTokenValidator authtoken.Validator
+
+	BandwidthCaps *bwcap.Limiter
+
+	UpgradeQueue *upgradeq.Queue
+
+	NAT64 *nat64.Detector
+
+	MemoryBudget int64
+
+	KeyMismatchBan time.Duration
+
+	LazyIdentify bool
+
 	DisablePing bool
 
 	Routing RoutingC
@@ -152,16 +191,29 @@ func (cfg *Config) addTransports(ctx context.Context, h host.Host) (err error) {
 		}
 	}
 
+	if cfg.AuthToken != nil || cfg.AuthTokenValidator != nil {
+		upgrader.Secure = authtoken.Wrap(upgrader.Secure, cfg.AuthToken, cfg.AuthTokenValidator)
+	}
+	if cfg.UpgradeQueue != nil {
+		upgrader.Secure = cfg.UpgradeQueue.Wrap(upgrader.Secure)
+	}
+
 	upgrader.Muxer, err = makeMuxer(h, cfg.Muxers)
 	if err != nil {
 		return err
 	}
+	if cfg.BandwidthCaps != nil {
+		upgrader.Muxer = cfg.BandwidthCaps.Wrap(upgrader.Muxer)
+	}
 
 	tpts, err := makeTransports(h, upgrader, cfg.ConnectionGater, cfg.Transports)
 	if err != nil {
 		return err
 	}
 	for _, t := range tpts {
+		if cfg.NAT64 != nil {
+			t = nat64.WrapTransport(t, cfg.NAT64)
+		}
 		err = swrm.AddTransport(t)
 		if err != nil {
 			return err
@@ -183,6 +235,51 @@ func (cfg *Config) addTransports(ctx context.Context, h host.Host) (err error) {
 //
 // This function consumes the config. Do not reuse it (really!).
 func (cfg *Config) NewNode(ctx context.Context) (host.Host, error) {
+	// Install the host's ban list as the connection gater, so that banned
+	// peers are refused by the network. The AutoNAT dialer uses the gater
+	// wrapped below, without the ban list.
+	gater := cfg.ConnectionGater
+	if cfg.AddrFamily != addrfamily.Any {
+		gater = addrfamily.NewGater(cfg.AddrFamily, gater)
+		// dial addresses of the preferred family first.
+		cfg.Peerstore = cfg.AddrFamily.Peerstore(cfg.Peerstore)
+	}
+	// Bound the host to its memory budget, if any.
+	budget := cfg.MemoryBudget
+	if budget == 0 {
+		budget = lowmem.DefaultBudget
+	}
+	var (
+		connLimiter *lowmem.ConnLimiter
+		idOpts      []identify.Option
+	)
+	if budget > 0 {
+		limits := lowmem.ForBudget(budget)
+		connLimiter = lowmem.NewConnLimiter(limits.MaxConns, gater)
+		gater = connLimiter
+		idOpts = limits.IdentifyOptions()
+		for i := range cfg.Muxers {
+			muxC := cfg.Muxers[i].MuxC
+			cfg.Muxers[i].MuxC = func(h host.Host) (mux.Multiplexer, error) {
+				m, err := muxC(h)
+				if y, ok := m.(*yamux.Transport); ok && err == nil {
+					return limits.BoundYamux(y), nil
+				}
+				return m, err
+			}
+		}
+	}
+	bans := bhost.NewBanList(gater)
+	cfg.ConnectionGater = bans
+
+	addrsFactory := cfg.AddrsFactory
+	if cfg.AddrFamily != addrfamily.Any {
+		if addrsFactory == nil {
+			addrsFactory = bhost.DefaultAddrsFactory
+		}
+		addrsFactory = cfg.AddrFamily.AddrsFactory(addrsFactory)
+	}
+
 	swrm, err := cfg.makeSwarm(ctx)
 	if err != nil {
 		return nil, err
@@ -190,17 +287,31 @@ func (cfg *Config) NewNode(ctx context.Context) (host.Host, error) {
 
 	h, err := bhost.NewHost(ctx, swrm, &bhost.HostOpts{
 		ConnManager:       cfg.ConnManager,
-		AddrsFactory:      cfg.AddrsFactory,
+		AddrsFactory:      addrsFactory,
 		NATManager:        cfg.NATManager,
 		EnablePing:        !cfg.DisablePing,
 		UserAgent:         cfg.UserAgent,
 		MultiaddrResolver: cfg.MultiaddrResolver,
+		BanList:           bans,
+		Auditor:           cfg.Auditor,
+		StreamGate:        cfg.StreamGate,
+		Insecure:          cfg.Insecure,
+		Quotas:            cfg.Quotas,
+		HandlerMetrics:    cfg.HandlerMetrics,
+		KeyMismatchBan:    cfg.KeyMismatchBan,
+		ExternalAddrs:     cfg.ExternalAddrs,
+		AddrTranslator:    cfg.AddrTranslator,
+		LazyIdentify:      cfg.LazyIdentify,
+		IdentifyOpts:      idOpts,
 	})
 
 	if err != nil {
 		swrm.Close()
 		return nil, err
 	}
+	if connLimiter != nil {
+		swrm.Notify(connLimiter)
+	}
 
 	// XXX: This is the only sane way to get a context out that's guaranteed
 	// to be canceled when we shut down.
@@ -311,7 +422,7 @@ func (cfg *Config) NewNode(ctx context.Context) (host.Host, error) {
 			SecurityTransports: cfg.SecurityTransports,
 			Insecure:           cfg.Insecure,
 			PSK:                cfg.PSK,
-			ConnectionGater:    cfg.ConnectionGater,
+			ConnectionGater:    gater,
 			Reporter:           cfg.Reporter,
 			PeerKey:            autonatPrivKey,
 
@@ -3,6 +3,7 @@ package libp2p
 import (
 	"context"
 	"fmt"
+	"io/ioutil"
 	"regexp"
 	"strings"
 	"sync"
@@ -11,6 +12,7 @@ import (
 	"github.com/libp2p/go-libp2p-core/connmgr"
 	"github.com/libp2p/go-libp2p-core/crypto"
 	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/libp2p/go-libp2p-core/transport"
 	noise "github.com/libp2p/go-libp2p-noise"
@@ -19,6 +21,8 @@ import (
 	"github.com/stretchr/testify/require"
 
 	tptu "github.com/libp2p/go-libp2p-transport-upgrader"
+	"github.com/libp2p/go-libp2p/p2p/net/authtoken"
+	"github.com/libp2p/go-libp2p/p2p/net/bwcap"
 )
 
 func TestNewHost(t *testing.T) {
@@ -245,3 +249,51 @@ func TestTcpSimultaneousConnect(t *testing.T) {
 
 	wg.Wait()
 }
+
+func TestConnAuthToken(t *testing.T) {
+	ctx := context.Background()
+	listen := ListenAddrStrings("/ip4/127.0.0.1/tcp/0")
+
+	server, err := New(ctx, listen, ConnAuthToken(nil, authtoken.AllowTokens([]byte("secret"))))
+	require.NoError(t, err)
+	defer server.Close()
+
+	good, err := New(ctx, listen, ConnAuthToken(authtoken.StaticToken([]byte("secret")), nil))
+	require.NoError(t, err)
+	defer good.Close()
+	require.NoError(t, good.Connect(ctx, peer.AddrInfo{ID: server.ID(), Addrs: server.Addrs()}))
+
+	bad, err := New(ctx, listen, ConnAuthToken(authtoken.StaticToken([]byte("guess")), nil))
+	require.NoError(t, err)
+	defer bad.Close()
+	require.Error(t, bad.Connect(ctx, peer.AddrInfo{ID: server.ID(), Addrs: server.Addrs()}))
+
+	_, err = New(ctx, ConnAuthToken(nil, nil))
+	require.Error(t, err)
+}
+
+func TestBandwidthCaps(t *testing.T) {
+	ctx := context.Background()
+	listen := ListenAddrStrings("/ip4/127.0.0.1/tcp/0")
+
+	caps := bwcap.NewLimiter(nil)
+	caps.SetConnLimit(32 << 10)
+	h1, err := New(ctx, listen, BandwidthCaps(caps))
+	require.NoError(t, err)
+	defer h1.Close()
+	h2, err := New(ctx, listen)
+	require.NoError(t, err)
+	defer h2.Close()
+
+	h2.SetStreamHandler("/test", func(s network.Stream) {
+		ioutil.ReadAll(s)
+		s.Close()
+	})
+	require.NoError(t, h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+	s, err := h1.NewStream(ctx, h2.ID(), "/test")
+	require.NoError(t, err)
+	_, err = s.Write(make([]byte, 64<<10))
+	require.NoError(t, err)
+	s.Close()
+	require.NotZero(t, caps.PeerStats(h2.ID()).ThrottledBytes)
+}
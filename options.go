@@ -19,8 +19,19 @@ import (
 	"github.com/libp2p/go-libp2p-core/pnet"
 
 	"github.com/libp2p/go-libp2p/config"
+	"github.com/libp2p/go-libp2p/p2p/host/addrmap"
+	"github.com/libp2p/go-libp2p/p2p/host/audit"
 	bhost "github.com/libp2p/go-libp2p/p2p/host/basic"
+	"github.com/libp2p/go-libp2p/p2p/host/extaddr"
+	"github.com/libp2p/go-libp2p/p2p/host/handlermetrics"
+	"github.com/libp2p/go-libp2p/p2p/host/lowmem"
+	"github.com/libp2p/go-libp2p/p2p/host/quota"
 	autorelay "github.com/libp2p/go-libp2p/p2p/host/relay"
+	"github.com/libp2p/go-libp2p/p2p/net/addrfamily"
+	"github.com/libp2p/go-libp2p/p2p/net/authtoken"
+	"github.com/libp2p/go-libp2p/p2p/net/bwcap"
+	"github.com/libp2p/go-libp2p/p2p/net/nat64"
+	"github.com/libp2p/go-libp2p/p2p/net/upgradeq"
 
 	ma "github.com/multiformats/go-multiaddr"
 	madns "github.com/multiformats/go-multiaddr-dns"
@@ -472,3 +483,198 @@ func MultiaddrResolver(rslv *madns.Resolver) Option {
 		return nil
 	}
 }
+
+// Audit configures libp2p to record the streams of all protocols with the
+// given auditor.
+func Audit(a *audit.Auditor) Option {
+	return func(cfg *Config) error {
+		if cfg.Auditor != nil {
+			return errors.New("cannot specify multiple auditors")
+		}
+		cfg.Auditor = a
+		return nil
+	}
+}
+
+// StreamGate configures whether inbound application streams are held, or
+// rejected, until the connection they were opened on is identified, so that
+// handlers can rely on the peerstore knowing the remote peer's protocols and
+// agent version. By default, streams are handled right away.
+func StreamGate(g bhost.StreamGate) Option {
+	return func(cfg *Config) error {
+		cfg.StreamGate = g
+		return nil
+	}
+}
+
+// AddrFamily configures the host-wide address family policy: preferring IPv6
+// or IPv4 addresses, or excluding one of the families. We only advertise our
+// addresses of the allowed families, preferred family first, refuse to dial
+// addresses of excluded families, and dial addresses of the preferred family
+// first. Pass the same policy to the mDNS service with discovery.AddrFamily.
+//
+// The swarm still ranks the addresses it dials by transport first, e.g. QUIC
+// before TCP: the preference orders addresses within each rank, see
+// addrfamily.Policy.Peerstore.
+func AddrFamily(p addrfamily.Policy) Option {
+	return func(cfg *Config) error {
+		cfg.AddrFamily = p
+		return nil
+	}
+}
+
+// StreamQuotas limits the streams opened under quota tokens with the given
+// manager, see the quota package.
+func StreamQuotas(m *quota.Manager) Option {
+	return func(cfg *Config) error {
+		if cfg.Quotas != nil {
+			return errors.New("cannot specify multiple quota managers")
+		}
+		cfg.Quotas = m
+		return nil
+	}
+}
+
+// HandlerMetrics measures the execution time, concurrency and results of the
+// handlers of inbound streams per protocol with the given tracker, see the
+// handlermetrics package.
+func HandlerMetrics(t *handlermetrics.Tracker) Option {
+	return func(cfg *Config) error {
+		if cfg.HandlerMetrics != nil {
+			return errors.New("cannot specify multiple handler metrics trackers")
+		}
+		cfg.HandlerMetrics = t
+		return nil
+	}
+}
+
+// BanOnKeyMismatch bans peers that send us a public key not matching their
+// peer ID, or the key we have for them, for the given duration: we close our
+// connections to them and refuse new ones. See identify.EvtPeerKeyMismatch.
+func BanOnKeyMismatch(d time.Duration) Option {
+	return func(cfg *Config) error {
+		if d <= 0 {
+			return errors.New("ban duration must be positive")
+		}
+		cfg.KeyMismatchBan = d
+		return nil
+	}
+}
+
+// ExternalAddrs makes the host advertise the external addresses confirmed in
+// the given book, along with its observed addresses. Submit the addresses
+// confirmed by external sources, like cloud metadata services, to the book.
+// Hosts have a book of their own otherwise, see BasicHost.ExternalAddrs.
+func ExternalAddrs(b *extaddr.Book) Option {
+	return func(cfg *Config) error {
+		if cfg.ExternalAddrs != nil {
+			return errors.New("cannot specify multiple external address books")
+		}
+		cfg.ExternalAddrs = b
+		return nil
+	}
+}
+
+// AddrTranslator makes the host advertise the external addresses its listen
+// addresses translate to with the given translator, along with them, e.g. for
+// hosts running in containers with static port mappings, or on cloud
+// instances whose public IP isn't assigned to any interface. See the addrmap
+// package.
+func AddrTranslator(t addrmap.Translator) Option {
+	return func(cfg *Config) error {
+		if cfg.AddrTranslator != nil {
+			return errors.New("cannot specify multiple address translators")
+		}
+		cfg.AddrTranslator = t
+		return nil
+	}
+}
+
+// ConnAuthToken sends the token returned by the given function when dialing
+// peers, right after the security handshake, and validates the tokens of the
+// peers dialing us with the given validator, closing their connections if it
+// rejects them. Either may be nil, see authtoken.Wrap. All the peers of the
+// network must use this option.
+func ConnAuthToken(token authtoken.TokenFunc, validate authtoken.Validator) Option {
+	return func(cfg *Config) error {
+		if cfg.AuthToken != nil || cfg.AuthTokenValidator != nil {
+			return errors.New("cannot specify multiple auth token options")
+		}
+		if token == nil && validate == nil {
+			return errors.New("either a token function or a validator is required")
+		}
+		cfg.AuthToken = token
+		cfg.AuthTokenValidator = validate
+		return nil
+	}
+}
+
+// LazyIdentify only identifies connections when the host needs to know the
+// remote peer's protocols, to open a stream for protocols the peer isn't known
+// to support, instead of identifying every connection. It's meant for hosts
+// with many connections, like relays and bootstrappers. See identify.Lazy.
+func LazyIdentify() Option {
+	return func(cfg *Config) error {
+		cfg.LazyIdentify = true
+		return nil
+	}
+}
+
+// BandwidthCaps caps the bandwidth we send to peers with the caps of the given
+// limiter, enforced by the stream muxer of our connections. Transports
+// multiplexing streams on their own, like QUIC, aren't capped.
+func BandwidthCaps(l *bwcap.Limiter) Option {
+	return func(cfg *Config) error {
+		if cfg.BandwidthCaps != nil {
+			return errors.New("cannot specify multiple bandwidth limiters")
+		}
+		cfg.BandwidthCaps = l
+		return nil
+	}
+}
+
+// InboundUpgradeQueue runs the security handshakes of inbound connections
+// through the given queue, serving sources with good history first and
+// shedding unknown ones when the queue is full. Use upgradeq.ConnManagerScore
+// to prioritize the sources of peers tagged in the connection manager.
+func InboundUpgradeQueue(q *upgradeq.Queue) Option {
+	return func(cfg *Config) error {
+		if cfg.UpgradeQueue != nil {
+			return errors.New("cannot specify multiple inbound upgrade queues")
+		}
+		cfg.UpgradeQueue = q
+		return nil
+	}
+}
+
+// NAT64 dials IPv4 addresses through the NAT64 gateway of IPv6-only networks,
+// discovered by the given detector, when we have no IPv4 address of our own.
+// Use the detector to tell apart the connections going through a translator,
+// see nat64.Detector.Label.
+func NAT64(d *nat64.Detector) Option {
+	return func(cfg *Config) error {
+		if cfg.NAT64 != nil {
+			return errors.New("cannot specify multiple NAT64 detectors")
+		}
+		cfg.NAT64 = d
+		return nil
+	}
+}
+
+// MemoryBudget bounds the memory used by the host to fit the given budget, in
+// bytes, for devices with little RAM: connections, stream muxer buffers,
+// identify state and observed address tracking are bounded, see
+// lowmem.ForBudget. Hosts built with the lowmem build tag are bounded to
+// lowmem.DefaultBudget by default; pass a negative budget to lift the bound.
+func MemoryBudget(budget int64) Option {
+	return func(cfg *Config) error {
+		if cfg.MemoryBudget != 0 {
+			return errors.New("cannot specify multiple memory budgets")
+		}
+		if budget > 0 && budget < lowmem.MinBudget {
+			return fmt.Errorf("memory budget must be at least %d bytes", lowmem.MinBudget)
+		}
+		cfg.MemoryBudget = budget
+		return nil
+	}
+}
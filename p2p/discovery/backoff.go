@@ -0,0 +1,316 @@
+package discovery
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	coredisc "github.com/libp2p/go-libp2p-core/discovery"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	disc "github.com/libp2p/go-libp2p-discovery"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// DefaultBackoffCacheTTL is how long BackoffDiscovery caches the peers it
+// found by default, see BackoffCacheTTL.
+const DefaultBackoffCacheTTL = 10 * time.Minute
+
+// BackoffOption is an option for NewBackoff.
+type BackoffOption func(*BackoffDiscovery)
+
+// BackoffCacheTTL sets how long the peers found are cached, and deduplicated,
+// after they were last found. Defaults to DefaultBackoffCacheTTL.
+func BackoffCacheTTL(ttl time.Duration) BackoffOption {
+	return func(b *BackoffDiscovery) {
+		b.cacheTTL = ttl
+	}
+}
+
+// BackoffDiscovery wraps a discovery.Discovery, so that applications don't
+// have to implement backoff around it:
+//
+// - Advertise only advertises again once the backoff strategy allows,
+// returning the remaining TTL of the previous advertisement, or its error,
+// until then.
+// - FindPeers only queries the wrapped discovery once the backoff strategy
+// allows. Until then, it returns the peers found before. Concurrent calls
+// share the running query.
+//
+// The backoff strategy is reset whenever a call succeeds, advertising or
+// finding peers, and applied per namespace, separately for advertising and
+// finding peers. The peers found are cached, and merged by ID: FindPeers never
+// returns a peer twice.
+type BackoffDiscovery struct {
+	d        coredisc.Discovery
+	strategy disc.BackoffFactory
+	cacheTTL time.Duration
+	now      func() time.Time
+
+	mu  sync.Mutex
+	nss map[string]*backoffNs
+}
+
+var _ coredisc.Discovery = (*BackoffDiscovery)(nil)
+
+// backoffNs is the state of a namespace.
+type backoffNs struct {
+	advertiseStrategy disc.BackoffStrategy
+	nextAdvertise     time.Time
+	advertiseExpiry   time.Time
+	advertiseErr      error
+
+	findStrategy disc.BackoffStrategy
+	nextFind     time.Time
+	// query is the running query, if any.
+	query *backoffQuery
+	found map[peer.ID]*backoffPeer
+	// order are the peers found, in the order we found them.
+	order []peer.ID
+}
+
+type backoffPeer struct {
+	info     peer.AddrInfo
+	lastSeen time.Time
+}
+
+// backoffQuery is a query of the wrapped discovery that FindPeers calls wait
+// on.
+type backoffQuery struct {
+	cancel context.CancelFunc
+	// updated is closed, and replaced, whenever we find a peer, and done when
+	// the query ends.
+	updated chan struct{}
+	done    chan struct{}
+	// waiters is the number of FindPeers calls waiting on the query. It's
+	// canceled when none are left.
+	waiters int
+	found   int
+}
+
+// NewBackoff wraps the discovery, applying the backoff strategy to its calls,
+// see BackoffDiscovery.
+func NewBackoff(d coredisc.Discovery, strategy disc.BackoffFactory, opts ...BackoffOption) *BackoffDiscovery {
+	b := &BackoffDiscovery{
+		d:        d,
+		strategy: strategy,
+		cacheTTL: DefaultBackoffCacheTTL,
+		now:      time.Now,
+		nss:      make(map[string]*backoffNs),
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	return b
+}
+
+// namespace returns the state of the namespace. b.mu must be held.
+func (b *BackoffDiscovery) namespace(ns string) *backoffNs {
+	s, ok := b.nss[ns]
+	if !ok {
+		s = &backoffNs{
+			advertiseStrategy: b.strategy(),
+			findStrategy:      b.strategy(),
+			found:             make(map[peer.ID]*backoffPeer),
+		}
+		b.nss[ns] = s
+	}
+	return s
+}
+
+// Advertise implements discovery.Advertiser.
+func (b *BackoffDiscovery) Advertise(ctx context.Context, ns string, opts ...coredisc.Option) (time.Duration, error) {
+	b.mu.Lock()
+	s := b.namespace(ns)
+	if now := b.now(); now.Before(s.nextAdvertise) {
+		ttl, err := s.advertiseExpiry.Sub(now), s.advertiseErr
+		b.mu.Unlock()
+		if err != nil {
+			return 0, err
+		}
+		return ttl, nil
+	}
+	b.mu.Unlock()
+
+	ttl, err := b.d.Advertise(ctx, ns, opts...)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	if err == nil {
+		s.advertiseStrategy.Reset()
+	}
+	s.nextAdvertise = now.Add(s.advertiseStrategy.Delay())
+	s.advertiseExpiry = now.Add(ttl)
+	s.advertiseErr = err
+	if err == nil && s.nextAdvertise.After(s.advertiseExpiry) {
+		// let the advertisement be renewed before it expires.
+		s.nextAdvertise = s.advertiseExpiry
+	}
+	return ttl, err
+}
+
+// FindPeers implements discovery.Discoverer. The options only apply to the
+// queries of the wrapped discovery, but the discovery.Limit option, which
+// applies to every call.
+func (b *BackoffDiscovery) FindPeers(ctx context.Context, ns string, opts ...coredisc.Option) (<-chan peer.AddrInfo, error) {
+	var options coredisc.Options
+	if err := options.Apply(opts...); err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	s := b.namespace(ns)
+	b.expire(s)
+	q := s.query
+	if q == nil && !b.now().Before(s.nextFind) {
+		qctx, cancel := context.WithCancel(context.Background())
+		found, err := b.d.FindPeers(qctx, ns, opts...)
+		if err != nil {
+			cancel()
+			s.nextFind = b.now().Add(s.findStrategy.Delay())
+			b.mu.Unlock()
+			return nil, err
+		}
+		q = &backoffQuery{
+			cancel:  cancel,
+			updated: make(chan struct{}),
+			done:    make(chan struct{}),
+		}
+		s.query = q
+		go b.runQuery(s, q, found)
+	}
+	if q != nil {
+		q.waiters++
+	}
+	b.mu.Unlock()
+
+	out := make(chan peer.AddrInfo)
+	go b.serve(ctx, s, q, options.Limit, out)
+	return out, nil
+}
+
+// runQuery caches the peers the query finds.
+func (b *BackoffDiscovery) runQuery(s *backoffNs, q *backoffQuery, found <-chan peer.AddrInfo) {
+	for pi := range found {
+		b.mu.Lock()
+		b.add(s, pi)
+		q.found++
+		close(q.updated)
+		q.updated = make(chan struct{})
+		b.mu.Unlock()
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if q.found > 0 {
+		s.findStrategy.Reset()
+	}
+	s.nextFind = b.now().Add(s.findStrategy.Delay())
+	s.query = nil
+	q.cancel()
+	close(q.done)
+}
+
+// serve sends the cached peers of the namespace, then, if a query is running,
+// the peers it finds, until the limit is reached.
+func (b *BackoffDiscovery) serve(ctx context.Context, s *backoffNs, q *backoffQuery, limit int, out chan<- peer.AddrInfo) {
+	defer close(out)
+	if q != nil {
+		defer func() {
+			b.mu.Lock()
+			if q.waiters--; q.waiters == 0 {
+				q.cancel()
+			}
+			b.mu.Unlock()
+		}()
+	}
+
+	sent := make(map[peer.ID]struct{})
+	for {
+		var (
+			pending []peer.AddrInfo
+			updated <-chan struct{}
+			done    bool
+		)
+		b.mu.Lock()
+		for _, p := range s.order {
+			if _, ok := sent[p]; !ok {
+				pending = append(pending, copyAddrInfo(s.found[p].info))
+			}
+		}
+		if q != nil {
+			updated = q.updated
+			select {
+			case <-q.done:
+				done = true
+			default:
+			}
+		}
+		b.mu.Unlock()
+
+		for _, pi := range pending {
+			select {
+			case out <- pi:
+			case <-ctx.Done():
+				return
+			}
+			sent[pi.ID] = struct{}{}
+			if limit > 0 && len(sent) >= limit {
+				return
+			}
+		}
+		if q == nil || done {
+			return
+		}
+		select {
+		case <-updated:
+		case <-q.done:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// add caches the peer, merging its addresses with the cached ones. b.mu must
+// be held.
+func (b *BackoffDiscovery) add(s *backoffNs, pi peer.AddrInfo) {
+	cached, ok := s.found[pi.ID]
+	if !ok {
+		cached = &backoffPeer{info: peer.AddrInfo{ID: pi.ID}}
+		s.found[pi.ID] = cached
+		s.order = append(s.order, pi.ID)
+	}
+	cached.lastSeen = b.now()
+	for _, a := range pi.Addrs {
+		known := false
+		for _, c := range cached.info.Addrs {
+			if c.Equal(a) {
+				known = true
+				break
+			}
+		}
+		if !known {
+			cached.info.Addrs = append(cached.info.Addrs, a)
+		}
+	}
+}
+
+// expire drops the peers we didn't find again within the cache TTL. b.mu must
+// be held.
+func (b *BackoffDiscovery) expire(s *backoffNs) {
+	now := b.now()
+	order := s.order[:0]
+	for _, p := range s.order {
+		if now.Sub(s.found[p].lastSeen) > b.cacheTTL {
+			delete(s.found, p)
+			continue
+		}
+		order = append(order, p)
+	}
+	s.order = order
+}
+
+func copyAddrInfo(pi peer.AddrInfo) peer.AddrInfo {
+	return peer.AddrInfo{ID: pi.ID, Addrs: append([]ma.Multiaddr(nil), pi.Addrs...)}
+}
@@ -0,0 +1,172 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	coredisc "github.com/libp2p/go-libp2p-core/discovery"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/test"
+
+	disc "github.com/libp2p/go-libp2p-discovery"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+// countingDiscovery counts its calls. FindPeers returns the peers sent on
+// found, until it's closed.
+type countingDiscovery struct {
+	mu         sync.Mutex
+	advertises int
+	finds      int
+	advertErr  error
+	found      chan peer.AddrInfo
+}
+
+func (d *countingDiscovery) Advertise(context.Context, string, ...coredisc.Option) (time.Duration, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.advertises++
+	if d.advertErr != nil {
+		return 0, d.advertErr
+	}
+	return time.Hour, nil
+}
+
+func (d *countingDiscovery) FindPeers(ctx context.Context, _ string, _ ...coredisc.Option) (<-chan peer.AddrInfo, error) {
+	d.mu.Lock()
+	d.finds++
+	found := d.found
+	d.mu.Unlock()
+	out := make(chan peer.AddrInfo)
+	go func() {
+		defer close(out)
+		for {
+			select {
+			case pi, ok := <-found:
+				if !ok {
+					return
+				}
+				select {
+				case out <- pi:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+func (d *countingDiscovery) calls() (advertises, finds int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.advertises, d.finds
+}
+
+func TestBackoffAdvertise(t *testing.T) {
+	d := &countingDiscovery{}
+	now := time.Now()
+	b := NewBackoff(d, disc.NewFixedBackoff(time.Minute))
+	b.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	ttl, err := b.Advertise(ctx, "ns")
+	require.NoError(t, err)
+	require.Equal(t, time.Hour, ttl)
+	now = now.Add(10 * time.Second)
+	ttl, err = b.Advertise(ctx, "ns")
+	require.NoError(t, err)
+	require.Equal(t, time.Hour-10*time.Second, ttl)
+	advertises, _ := d.calls()
+	require.Equal(t, 1, advertises)
+
+	// namespaces back off separately.
+	_, err = b.Advertise(ctx, "other")
+	require.NoError(t, err)
+	advertises, _ = d.calls()
+	require.Equal(t, 2, advertises)
+
+	// errors are returned until the backoff elapsed.
+	d.advertErr = errors.New("failed")
+	now = now.Add(time.Minute)
+	_, err = b.Advertise(ctx, "ns")
+	require.Equal(t, d.advertErr, err)
+	_, err = b.Advertise(ctx, "ns")
+	require.Equal(t, d.advertErr, err)
+	advertises, _ = d.calls()
+	require.Equal(t, 3, advertises)
+}
+
+func TestBackoffFindPeers(t *testing.T) {
+	d := &countingDiscovery{found: make(chan peer.AddrInfo)}
+	now := time.Now()
+	b := NewBackoff(d, disc.NewFixedBackoff(time.Minute), BackoffCacheTTL(5*time.Minute))
+	var nowMu sync.Mutex
+	b.now = func() time.Time {
+		nowMu.Lock()
+		defer nowMu.Unlock()
+		return now
+	}
+	ctx := context.Background()
+
+	var ids []peer.ID
+	for i := 0; i < 2; i++ {
+		id, err := test.RandPeerID()
+		require.NoError(t, err)
+		ids = append(ids, id)
+	}
+	addr1, addr2 := ma.StringCast("/ip4/1.2.3.4/tcp/1"), ma.StringCast("/ip4/1.2.3.4/tcp/2")
+
+	first, err := b.FindPeers(ctx, "ns")
+	require.NoError(t, err)
+	// a concurrent call shares the query.
+	second, err := b.FindPeers(ctx, "ns")
+	require.NoError(t, err)
+
+	d.found <- peer.AddrInfo{ID: ids[0], Addrs: []ma.Multiaddr{addr1}}
+	// duplicates are merged.
+	d.found <- peer.AddrInfo{ID: ids[0], Addrs: []ma.Multiaddr{addr2}}
+	d.found <- peer.AddrInfo{ID: ids[1], Addrs: []ma.Multiaddr{addr1}}
+	close(d.found)
+
+	collect := func(ch <-chan peer.AddrInfo) []peer.ID {
+		var found []peer.ID
+		for pi := range ch {
+			found = append(found, pi.ID)
+		}
+		return found
+	}
+	require.Equal(t, ids, collect(first))
+	require.Equal(t, ids, collect(second))
+
+	// served from the cache while backing off.
+	ch, err := b.FindPeers(ctx, "ns", coredisc.Limit(1))
+	require.NoError(t, err)
+	pi := <-ch
+	require.Equal(t, ids[0], pi.ID)
+	require.ElementsMatch(t, []ma.Multiaddr{addr1, addr2}, pi.Addrs)
+	_, ok := <-ch
+	require.False(t, ok)
+	_, finds := d.calls()
+	require.Equal(t, 1, finds)
+
+	// the cache expires, the backoff elapses.
+	nowMu.Lock()
+	now = now.Add(10 * time.Minute)
+	nowMu.Unlock()
+	d.mu.Lock()
+	d.found = make(chan peer.AddrInfo)
+	close(d.found)
+	d.mu.Unlock()
+	ch, err = b.FindPeers(ctx, "ns")
+	require.NoError(t, err)
+	require.Empty(t, collect(ch))
+	_, finds = d.calls()
+	require.Equal(t, 2, finds)
+}
@@ -0,0 +1,393 @@
+package bootstrap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// bootstrapDialTimeout is the timeout of the Bootstrapper's dials.
+const bootstrapDialTimeout = 15 * time.Second
+
+// maxCachedAddrs is the maximum number of addresses we cache per peer.
+const maxCachedAddrs = 8
+
+type bootstrapperConfig struct {
+	minPeers      int
+	checkInterval time.Duration
+	cacheSize     int
+	maxCacheAge   time.Duration
+	baseBackoff   time.Duration
+	maxBackoff    time.Duration
+}
+
+// BootstrapperOption is an option function for the Bootstrapper.
+type BootstrapperOption func(*bootstrapperConfig)
+
+// MinPeers sets the number of connected peers below which the Bootstrapper
+// dials peers. Defaults to 4.
+func MinPeers(n int) BootstrapperOption {
+	return func(cfg *bootstrapperConfig) {
+		cfg.minPeers = n
+	}
+}
+
+// CheckInterval sets how often the Bootstrapper checks the number of
+// connected peers while above the minimum. It also checks whenever we lose a
+// peer. Defaults to one minute.
+func CheckInterval(d time.Duration) BootstrapperOption {
+	return func(cfg *bootstrapperConfig) {
+		cfg.checkInterval = d
+	}
+}
+
+// CacheSize sets the maximum number of peers the Bootstrapper caches, the
+// most recently seen ones. Defaults to 64.
+func CacheSize(n int) BootstrapperOption {
+	return func(cfg *bootstrapperConfig) {
+		cfg.cacheSize = n
+	}
+}
+
+// MaxCacheAge sets how long after we last connected to them cached peers are
+// dropped. Defaults to a week.
+func MaxCacheAge(d time.Duration) BootstrapperOption {
+	return func(cfg *bootstrapperConfig) {
+		cfg.maxCacheAge = d
+	}
+}
+
+// DialBackoff sets the backoff after failing to dial a peer, and after failing
+// to get above the minimum number of peers: it starts at base, doubles with
+// every failure up to max, and is jittered. Defaults to 5s and 10 minutes.
+func DialBackoff(base, max time.Duration) BootstrapperOption {
+	return func(cfg *bootstrapperConfig) {
+		cfg.baseBackoff = base
+		cfg.maxBackoff = max
+	}
+}
+
+// Bootstrapper keeps the host connected to a minimum number of peers. When
+// below, it dials the peers we recently connected to first, most recent first,
+// then the static bootstrap peers, backing off from peers it fails to dial.
+// The peers we connect to are cached in a PeerCache, so that we don't depend
+// on the bootstrap peers after a restart.
+type Bootstrapper struct {
+	host      host.Host
+	bootstrap []peer.AddrInfo
+	cache     PeerCache
+	cfg       bootstrapperConfig
+
+	ctx       context.Context
+	ctxCancel context.CancelFunc
+	refCount  sync.WaitGroup
+	notifee   *network.NotifyBundle
+	// trigger triggers a check when we lose a peer.
+	trigger chan struct{}
+
+	mu sync.Mutex
+	// good are the peers we recently connected to, and dirty is whether they
+	// changed since we stored them.
+	good    map[peer.ID]*CachedPeer
+	dirty   bool
+	backoff map[peer.ID]*dialBackoff
+}
+
+type dialBackoff struct {
+	failures int
+	next     time.Time
+}
+
+// NewBootstrapper constructs a new Bootstrapper and starts keeping the host
+// above the minimum number of peers in the background. The cache may be nil.
+func NewBootstrapper(h host.Host, bootstrap []peer.AddrInfo, cache PeerCache, opts ...BootstrapperOption) (*Bootstrapper, error) {
+	cfg := bootstrapperConfig{
+		minPeers:      4,
+		checkInterval: time.Minute,
+		cacheSize:     64,
+		maxCacheAge:   7 * 24 * time.Hour,
+		baseBackoff:   5 * time.Second,
+		maxBackoff:    10 * time.Minute,
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.checkInterval <= 0 || cfg.baseBackoff <= 0 || cfg.maxBackoff < cfg.baseBackoff {
+		return nil, errors.New("invalid bootstrapper intervals")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	b := &Bootstrapper{
+		host:      h,
+		bootstrap: bootstrap,
+		cache:     cache,
+		cfg:       cfg,
+		ctx:       ctx,
+		ctxCancel: cancel,
+		trigger:   make(chan struct{}, 1),
+		good:      make(map[peer.ID]*CachedPeer),
+		backoff:   make(map[peer.ID]*dialBackoff),
+	}
+	if cache != nil {
+		cached, err := cache.Load()
+		if err != nil {
+			log.Warnw("failed to load the bootstrap peer cache", "error", err)
+		}
+		for i := range cached {
+			cp := cached[i]
+			if cp.Peer.ID != "" && cp.Peer.ID != h.ID() {
+				b.good[cp.Peer.ID] = &cp
+			}
+		}
+	}
+
+	b.notifee = &network.NotifyBundle{
+		ConnectedF:    b.connected,
+		DisconnectedF: b.disconnected,
+	}
+	h.Network().Notify(b.notifee)
+
+	b.refCount.Add(1)
+	go b.background()
+	return b, nil
+}
+
+func (b *Bootstrapper) background() {
+	defer b.refCount.Done()
+
+	failures := 0
+	for {
+		wait := b.cfg.checkInterval
+		if err := b.Bootstrap(b.ctx); err != nil {
+			wait = backoffFor(failures, b.cfg.baseBackoff, b.cfg.maxBackoff)
+			failures++
+			log.Debugw("failed to bootstrap", "error", err, "retry", wait)
+		} else {
+			failures = 0
+		}
+
+		timer := time.NewTimer(jitter(wait))
+		select {
+		case <-timer.C:
+		case <-b.trigger:
+			timer.Stop()
+		case <-b.ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// Bootstrap synchronously dials peers until we're connected to the minimum
+// number of peers. It returns an error if we're still below.
+func (b *Bootstrapper) Bootstrap(ctx context.Context) error {
+	defer b.storeCache(false)
+
+	candidates := b.candidates()
+	for {
+		need := b.cfg.minPeers - len(b.host.Network().Peers())
+		if need <= 0 {
+			return nil
+		}
+		if len(candidates) == 0 {
+			return fmt.Errorf("connected to %d peers, below the minimum of %d", b.cfg.minPeers-need, b.cfg.minPeers)
+		}
+		if need > len(candidates) {
+			need = len(candidates)
+		}
+		var wg sync.WaitGroup
+		for _, pi := range candidates[:need] {
+			wg.Add(1)
+			go func(pi peer.AddrInfo) {
+				defer wg.Done()
+				b.dial(ctx, pi)
+			}(pi)
+		}
+		wg.Wait()
+		candidates = candidates[need:]
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+}
+
+// candidates returns the peers to dial: the cached peers, most recently seen
+// first, then the bootstrap peers in random order, without the peers we're
+// connected to or backing off from.
+func (b *Bootstrapper) candidates() []peer.AddrInfo {
+	b.mu.Lock()
+	now := time.Now()
+	cached := make([]*CachedPeer, 0, len(b.good))
+	for _, cp := range b.good {
+		cached = append(cached, cp)
+	}
+	sort.Slice(cached, func(i, j int) bool { return cached[i].LastSeen.After(cached[j].LastSeen) })
+	candidates := make([]peer.AddrInfo, 0, len(cached)+len(b.bootstrap))
+	for _, cp := range cached {
+		candidates = append(candidates, cp.Peer)
+	}
+	bootstrap := append([]peer.AddrInfo(nil), b.bootstrap...)
+	rand.Shuffle(len(bootstrap), func(i, j int) { bootstrap[i], bootstrap[j] = bootstrap[j], bootstrap[i] })
+	candidates = append(candidates, bootstrap...)
+
+	seen := make(map[peer.ID]struct{}, len(candidates))
+	out := candidates[:0]
+	for _, pi := range candidates {
+		if _, ok := seen[pi.ID]; ok || pi.ID == b.host.ID() {
+			continue
+		}
+		seen[pi.ID] = struct{}{}
+		if bo, ok := b.backoff[pi.ID]; ok && now.Before(bo.next) {
+			continue
+		}
+		if b.host.Network().Connectedness(pi.ID) == network.Connected {
+			continue
+		}
+		out = append(out, pi)
+	}
+	b.mu.Unlock()
+	return out
+}
+
+// dial dials the peer, backing off from it if we fail.
+func (b *Bootstrapper) dial(ctx context.Context, pi peer.AddrInfo) {
+	ctx, cancel := context.WithTimeout(ctx, bootstrapDialTimeout)
+	defer cancel()
+	err := b.host.Connect(ctx, pi)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		delete(b.backoff, pi.ID)
+		return
+	}
+	log.Debugw("failed to dial bootstrap candidate", "peer", pi.ID, "error", err)
+	bo, ok := b.backoff[pi.ID]
+	if !ok {
+		bo = new(dialBackoff)
+		b.backoff[pi.ID] = bo
+	}
+	bo.next = time.Now().Add(jitter(backoffFor(bo.failures, b.cfg.baseBackoff, b.cfg.maxBackoff)))
+	bo.failures++
+}
+
+// connected caches the peers we dial.
+func (b *Bootstrapper) connected(_ network.Network, c network.Conn) {
+	if c.Stat().Direction != network.DirOutbound {
+		// the addresses of inbound connections usually aren't dialable.
+		return
+	}
+	p := c.RemotePeer()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	cp, ok := b.good[p]
+	if !ok {
+		cp = &CachedPeer{Peer: peer.AddrInfo{ID: p}}
+		b.good[p] = cp
+	}
+	cp.LastSeen = time.Now()
+	cp.Peer.Addrs = prependAddr(cp.Peer.Addrs, c.RemoteMultiaddr())
+	b.dirty = true
+}
+
+// disconnected triggers a check when we lose a peer while below the minimum.
+func (b *Bootstrapper) disconnected(n network.Network, c network.Conn) {
+	if n.Connectedness(c.RemotePeer()) == network.Connected || len(n.Peers()) >= b.cfg.minPeers {
+		return
+	}
+	select {
+	case b.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// storeCache drops the cached peers we didn't see for too long, or in excess
+// of the cache size, and stores the others if they changed or if forced.
+func (b *Bootstrapper) storeCache(force bool) {
+	if b.cache == nil {
+		return
+	}
+	b.mu.Lock()
+	now := time.Now()
+	peers := make([]CachedPeer, 0, len(b.good))
+	for p, cp := range b.good {
+		if now.Sub(cp.LastSeen) > b.cfg.maxCacheAge {
+			delete(b.good, p)
+			b.dirty = true
+			continue
+		}
+		peers = append(peers, CachedPeer{
+			Peer:     peer.AddrInfo{ID: cp.Peer.ID, Addrs: append([]ma.Multiaddr(nil), cp.Peer.Addrs...)},
+			LastSeen: cp.LastSeen,
+		})
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].LastSeen.After(peers[j].LastSeen) })
+	if len(peers) > b.cfg.cacheSize {
+		for _, cp := range peers[b.cfg.cacheSize:] {
+			delete(b.good, cp.Peer.ID)
+		}
+		peers = peers[:b.cfg.cacheSize]
+		b.dirty = true
+	}
+	if !b.dirty && !force {
+		b.mu.Unlock()
+		return
+	}
+	b.dirty = false
+	b.mu.Unlock()
+
+	if err := b.cache.Store(peers); err != nil {
+		log.Warnw("failed to store the bootstrap peer cache", "error", err)
+	}
+}
+
+// Close stops the Bootstrapper, and stores the peer cache.
+func (b *Bootstrapper) Close() error {
+	b.ctxCancel()
+	b.refCount.Wait()
+	b.host.Network().StopNotify(b.notifee)
+	b.storeCache(true)
+	return nil
+}
+
+// prependAddr puts the address first, keeping at most maxCachedAddrs.
+func prependAddr(addrs []ma.Multiaddr, a ma.Multiaddr) []ma.Multiaddr {
+	out := make([]ma.Multiaddr, 1, len(addrs)+1)
+	out[0] = a
+	for _, old := range addrs {
+		if len(out) == maxCachedAddrs {
+			break
+		}
+		if !old.Equal(a) {
+			out = append(out, old)
+		}
+	}
+	return out
+}
+
+// backoffFor returns the backoff after the given number of previous failures.
+func backoffFor(failures int, base, max time.Duration) time.Duration {
+	d := base
+	for i := 0; i < failures && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+// jitter returns a random duration within 25% of d.
+func jitter(d time.Duration) time.Duration {
+	return d*3/4 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
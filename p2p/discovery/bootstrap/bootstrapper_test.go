@@ -0,0 +1,103 @@
+package bootstrap
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/test"
+
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+func cachedIDs(t *testing.T, c PeerCache) []peer.ID {
+	t.Helper()
+	peers, err := c.Load()
+	require.NoError(t, err)
+	ids := make([]peer.ID, len(peers))
+	for i, cp := range peers {
+		ids[i] = cp.Peer.ID
+	}
+	return ids
+}
+
+func TestBootstrapper(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn, err := mocknet.FullMeshLinked(ctx, 3)
+	require.NoError(t, err)
+	hosts := mn.Hosts()
+	h := hosts[0]
+	unreachable, err := test.RandPeerID()
+	require.NoError(t, err)
+
+	cache := &FileCache{Path: filepath.Join(t.TempDir(), "peers.json")}
+	b, err := NewBootstrapper(h, []peer.AddrInfo{
+		{ID: hosts[1].ID(), Addrs: hosts[1].Addrs()},
+		{ID: hosts[2].ID(), Addrs: hosts[2].Addrs()},
+		{ID: unreachable, Addrs: []ma.Multiaddr{ma.StringCast("/ip4/1.2.3.4/tcp/4001")}},
+	}, cache, MinPeers(3), CheckInterval(time.Hour), DialBackoff(time.Hour, 2*time.Hour))
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		_, ok := b.backoff[unreachable]
+		return ok && len(h.Network().Peers()) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	// we're still below the minimum, but backing off from the only
+	// candidate left.
+	require.Error(t, b.Bootstrap(ctx))
+	require.Empty(t, b.candidates())
+
+	require.NoError(t, b.Close())
+	require.ElementsMatch(t, []peer.ID{hosts[1].ID(), hosts[2].ID()}, cachedIDs(t, cache))
+}
+
+func TestBootstrapperCache(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn, err := mocknet.FullMeshLinked(ctx, 4)
+	require.NoError(t, err)
+	hosts := mn.Hosts()
+	h := hosts[0]
+	info := func(i int) peer.AddrInfo {
+		return peer.AddrInfo{ID: hosts[i].ID(), Addrs: hosts[i].Addrs()}
+	}
+
+	cache := &FileCache{Path: filepath.Join(t.TempDir(), "peers.json")}
+	require.NoError(t, cache.Store([]CachedPeer{
+		{Peer: info(2), LastSeen: time.Now().Add(-time.Hour)},
+		{Peer: info(3), LastSeen: time.Now().Add(-48 * time.Hour)},
+	}))
+
+	b, err := NewBootstrapper(h, []peer.AddrInfo{info(1)}, cache, MinPeers(1), MaxCacheAge(24*time.Hour))
+	require.NoError(t, err)
+	// cached peers are dialed first.
+	require.Eventually(t, func() bool {
+		return h.Network().Connectedness(hosts[2].ID()) == network.Connected
+	}, 5*time.Second, 10*time.Millisecond)
+	require.NotEqual(t, network.Connected, h.Network().Connectedness(hosts[1].ID()))
+
+	// peers not seen for too long are dropped.
+	require.NoError(t, b.Close())
+	require.Equal(t, []peer.ID{hosts[2].ID()}, cachedIDs(t, cache))
+}
+
+func TestBackoffFor(t *testing.T) {
+	require.Equal(t, time.Second, backoffFor(0, time.Second, time.Minute))
+	require.Equal(t, 4*time.Second, backoffFor(2, time.Second, time.Minute))
+	require.Equal(t, time.Minute, backoffFor(10, time.Second, time.Minute))
+	for i := 0; i < 100; i++ {
+		j := jitter(time.Minute)
+		require.True(t, j >= 45*time.Second && j <= 75*time.Second, j)
+	}
+}
@@ -0,0 +1,73 @@
+package bootstrap
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// CachedPeer is a peer we recently connected to, see Bootstrapper.
+type CachedPeer struct {
+	Peer peer.AddrInfo
+	// LastSeen is when we last connected to the peer.
+	LastSeen time.Time
+}
+
+// PeerCache persists the peers a Bootstrapper recently connected to, so that
+// it can reconnect to them after a restart instead of relying on the bootstrap
+// peers only.
+type PeerCache interface {
+	// Load returns the cached peers, none if nothing was stored yet.
+	Load() ([]CachedPeer, error)
+	// Store replaces the cached peers.
+	Store(peers []CachedPeer) error
+}
+
+// FileCache is a PeerCache storing the peers as JSON in a file.
+type FileCache struct {
+	Path string
+}
+
+var _ PeerCache = (*FileCache)(nil)
+
+// Load implements PeerCache.
+func (c *FileCache) Load() ([]CachedPeer, error) {
+	b, err := ioutil.ReadFile(c.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var peers []CachedPeer
+	if err := json.Unmarshal(b, &peers); err != nil {
+		return nil, err
+	}
+	return peers, nil
+}
+
+// Store implements PeerCache. It replaces the file atomically, so that a
+// crash doesn't leave a truncated cache behind.
+func (c *FileCache) Store(peers []CachedPeer) error {
+	b, err := json.Marshal(peers)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(c.Path), filepath.Base(c.Path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), c.Path)
+}
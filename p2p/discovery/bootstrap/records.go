@@ -0,0 +1,313 @@
+// Package bootstrap implements helpers for finding the peers a node
+// bootstraps from, and the Bootstrapper, keeping a node connected to enough
+// peers.
+package bootstrap
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/libp2p/go-libp2p-core/record"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+var log = logging.Logger("bootstrap")
+
+// TXTRecordPrefix prefixes the DNS TXT records containing signed peer records.
+// The rest of the TXT record is the base64 encoded signed envelope.
+const TXTRecordPrefix = "libp2p-record="
+
+// maxHTTPResponseSize is the maximum size of the response fetched by an
+// HTTPSource.
+const maxHTTPResponseSize = 1 << 20
+
+// Source is a location operators publish signed peer records at.
+type Source interface {
+	// Fetch returns the serialized, signed peer record envelopes currently
+	// published at the source.
+	Fetch(ctx context.Context) ([][]byte, error)
+}
+
+// DNSSource fetches signed peer records from the TXT records of a domain.
+// Every TXT record starting with TXTRecordPrefix is expected to contain one
+// base64 encoded envelope.
+type DNSSource struct {
+	Domain string
+	// Resolver is used to look up the TXT records. If nil,
+	// net.DefaultResolver is used.
+	Resolver *net.Resolver
+}
+
+// Fetch implements Source.
+func (s *DNSSource) Fetch(ctx context.Context) ([][]byte, error) {
+	resolver := s.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	txts, err := resolver.LookupTXT(ctx, s.Domain)
+	if err != nil {
+		return nil, err
+	}
+	return decodeRecords(txts, TXTRecordPrefix), nil
+}
+
+// HTTPSource fetches signed peer records from a URL, typically on a
+// well-known path. The response contains one base64 encoded envelope per line.
+type HTTPSource struct {
+	URL string
+	// Client is used to perform the request. If nil, http.DefaultClient is
+	// used.
+	Client *http.Client
+}
+
+// Fetch implements Source.
+func (s *HTTPSource) Fetch(ctx context.Context) ([][]byte, error) {
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequest(http.MethodGet, s.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status fetching %s: %s", s.URL, resp.Status)
+	}
+
+	var lines []string
+	scanner := bufio.NewScanner(io.LimitReader(resp.Body, maxHTTPResponseSize))
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return decodeRecords(lines, ""), nil
+}
+
+// decodeRecords base64 decodes all entries starting with prefix, skipping
+// anything it can't decode.
+func decodeRecords(entries []string, prefix string) [][]byte {
+	var out [][]byte
+	for _, e := range entries {
+		e = strings.TrimSpace(e)
+		if e == "" || !strings.HasPrefix(e, prefix) {
+			continue
+		}
+		e = strings.TrimPrefix(e, prefix)
+		b, err := base64.StdEncoding.DecodeString(e)
+		if err != nil {
+			b, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(e, "="))
+		}
+		if err != nil {
+			log.Debugw("failed to decode published peer record", "error", err)
+			continue
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+// EncodeTXTRecord returns the DNS TXT record publishing the given signed peer
+// record envelope.
+func EncodeTXTRecord(env *record.Envelope) (string, error) {
+	b, err := env.Marshal()
+	if err != nil {
+		return "", err
+	}
+	return TXTRecordPrefix + base64.StdEncoding.EncodeToString(b), nil
+}
+
+// ConsumeRecord verifies a serialized signed peer record envelope, making sure
+// it was signed by the peer it describes.
+func ConsumeRecord(data []byte) (*record.Envelope, *peer.PeerRecord, error) {
+	env, rec, err := record.ConsumeEnvelope(data, peer.PeerRecordEnvelopeDomain)
+	if err != nil {
+		return nil, nil, err
+	}
+	prec, ok := rec.(*peer.PeerRecord)
+	if !ok {
+		return nil, nil, errors.New("envelope doesn't contain a peer record")
+	}
+	signer, err := peer.IDFromPublicKey(env.PublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	if signer != prec.PeerID {
+		return nil, nil, fmt.Errorf("peer record for %s was signed by %s", prec.PeerID, signer)
+	}
+	return env, prec, nil
+}
+
+type config struct {
+	refreshInterval time.Duration
+	ttl             time.Duration
+}
+
+// Option is an option function for the RecordFetcher.
+type Option func(*config)
+
+// RefreshInterval sets how often the sources are re-fetched. Defaults to one
+// hour.
+func RefreshInterval(d time.Duration) Option {
+	return func(cfg *config) {
+		cfg.refreshInterval = d
+	}
+}
+
+// RecordTTL sets the TTL of the addresses learned from the fetched records.
+// Defaults to twice the refresh interval.
+func RecordTTL(ttl time.Duration) Option {
+	return func(cfg *config) {
+		cfg.ttl = ttl
+	}
+}
+
+// RecordFetcher periodically fetches signed peer records from a set of
+// sources, verifies them and adds the certified addresses to the peerstore,
+// allowing operators to rotate their bootstrap nodes by updating the published
+// records.
+type RecordFetcher struct {
+	host    host.Host
+	sources []Source
+	cfg     config
+
+	ctx       context.Context
+	ctxCancel context.CancelFunc
+	refCount  sync.WaitGroup
+
+	mu    sync.RWMutex
+	peers []peer.AddrInfo
+}
+
+// NewRecordFetcher constructs a new RecordFetcher and starts periodically
+// fetching the given sources in the background.
+func NewRecordFetcher(h host.Host, sources []Source, opts ...Option) (*RecordFetcher, error) {
+	cfg := config{refreshInterval: time.Hour}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.refreshInterval <= 0 {
+		return nil, errors.New("refresh interval must be positive")
+	}
+	if cfg.ttl == 0 {
+		cfg.ttl = 2 * cfg.refreshInterval
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	rf := &RecordFetcher{
+		host:      h,
+		sources:   sources,
+		cfg:       cfg,
+		ctx:       ctx,
+		ctxCancel: cancel,
+	}
+
+	rf.refCount.Add(1)
+	go rf.background()
+	return rf, nil
+}
+
+func (rf *RecordFetcher) background() {
+	defer rf.refCount.Done()
+
+	ticker := time.NewTicker(rf.cfg.refreshInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := rf.Refresh(rf.ctx); err != nil {
+			log.Warnw("failed to refresh bootstrap peer records", "error", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-rf.ctx.Done():
+			return
+		}
+	}
+}
+
+// Refresh synchronously fetches all sources. It only returns an error if no
+// source could be fetched.
+func (rf *RecordFetcher) Refresh(ctx context.Context) error {
+	cab, hasCAB := peerstore.GetCertifiedAddrBook(rf.host.Peerstore())
+
+	var (
+		peers   []peer.AddrInfo
+		seen    = make(map[peer.ID]struct{})
+		lastErr error
+		fetched int
+	)
+	for _, src := range rf.sources {
+		envs, err := src.Fetch(ctx)
+		if err != nil {
+			log.Debugw("failed to fetch peer records", "source", src, "error", err)
+			lastErr = err
+			continue
+		}
+		fetched++
+
+		for _, data := range envs {
+			env, rec, err := ConsumeRecord(data)
+			if err != nil {
+				log.Debugw("ignoring invalid peer record", "source", src, "error", err)
+				continue
+			}
+			if rec.PeerID == rf.host.ID() {
+				continue
+			}
+			if hasCAB {
+				if _, err := cab.ConsumePeerRecord(env, rf.cfg.ttl); err != nil {
+					log.Debugw("failed to store peer record", "peer", rec.PeerID, "error", err)
+				}
+			} else {
+				rf.host.Peerstore().AddAddrs(rec.PeerID, rec.Addrs, rf.cfg.ttl)
+			}
+			if _, ok := seen[rec.PeerID]; ok {
+				continue
+			}
+			seen[rec.PeerID] = struct{}{}
+			peers = append(peers, peer.AddrInfo{ID: rec.PeerID, Addrs: rec.Addrs})
+		}
+	}
+	if fetched == 0 && lastErr != nil {
+		return lastErr
+	}
+
+	rf.mu.Lock()
+	rf.peers = peers
+	rf.mu.Unlock()
+	return nil
+}
+
+// Peers returns the peers described by the records fetched in the last
+// successful refresh.
+func (rf *RecordFetcher) Peers() []peer.AddrInfo {
+	rf.mu.RLock()
+	defer rf.mu.RUnlock()
+	return append([]peer.AddrInfo(nil), rf.peers...)
+}
+
+// Close stops the RecordFetcher.
+func (rf *RecordFetcher) Close() error {
+	rf.ctxCancel()
+	rf.refCount.Wait()
+	return nil
+}
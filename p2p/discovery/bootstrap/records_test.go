@@ -0,0 +1,119 @@
+package bootstrap
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/libp2p/go-libp2p-core/record"
+	"github.com/libp2p/go-libp2p-core/test"
+
+	blhost "github.com/libp2p/go-libp2p-blankhost"
+	swarmt "github.com/libp2p/go-libp2p-swarm/testing"
+
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+func makeRecord(t *testing.T, addr string) (peer.ID, *record.Envelope) {
+	t.Helper()
+	sk, _, err := test.RandTestKeyPair(crypto.Ed25519, 256)
+	require.NoError(t, err)
+	id, err := peer.IDFromPrivateKey(sk)
+	require.NoError(t, err)
+	rec := peer.PeerRecordFromAddrInfo(peer.AddrInfo{ID: id, Addrs: []ma.Multiaddr{ma.StringCast(addr)}})
+	env, err := record.Seal(rec, sk)
+	require.NoError(t, err)
+	return id, env
+}
+
+func TestDecodeTXTRecords(t *testing.T) {
+	_, env := makeRecord(t, "/ip4/1.2.3.4/tcp/4001")
+	txt, err := EncodeTXTRecord(env)
+	require.NoError(t, err)
+
+	recs := decodeRecords([]string{"v=spf1 -all", txt, TXTRecordPrefix + "!!invalid!!"}, TXTRecordPrefix)
+	require.Len(t, recs, 1)
+	_, _, err = ConsumeRecord(recs[0])
+	require.NoError(t, err)
+}
+
+func TestConsumeRecordRejectsForeignSigner(t *testing.T) {
+	id, _ := makeRecord(t, "/ip4/1.2.3.4/tcp/4001")
+	sk, _, err := test.RandTestKeyPair(crypto.Ed25519, 256)
+	require.NoError(t, err)
+
+	// a record describing one peer, signed by another.
+	rec := peer.PeerRecordFromAddrInfo(peer.AddrInfo{ID: id, Addrs: []ma.Multiaddr{ma.StringCast("/ip4/1.2.3.4/tcp/4001")}})
+	env, err := record.Seal(rec, sk)
+	require.NoError(t, err)
+	b, err := env.Marshal()
+	require.NoError(t, err)
+
+	_, _, err = ConsumeRecord(b)
+	require.Error(t, err)
+}
+
+func TestRecordFetcherHTTP(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	id1, env1 := makeRecord(t, "/ip4/1.2.3.4/tcp/4001")
+	id2, env2 := makeRecord(t, "/ip4/5.6.7.8/udp/4001/quic")
+
+	var lines []string
+	for _, env := range []*record.Envelope{env1, env2} {
+		b, err := env.Marshal()
+		require.NoError(t, err)
+		lines = append(lines, base64.StdEncoding.EncodeToString(b))
+	}
+	lines = append(lines, "garbage")
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, strings.Join(lines, "\n"))
+	}))
+	defer srv.Close()
+
+	h := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	defer h.Close()
+
+	rf, err := NewRecordFetcher(h, []Source{&HTTPSource{URL: srv.URL}}, RefreshInterval(time.Hour))
+	require.NoError(t, err)
+	defer rf.Close()
+
+	require.NoError(t, rf.Refresh(ctx))
+
+	peers := rf.Peers()
+	require.Len(t, peers, 2)
+	require.ElementsMatch(t, []peer.ID{id1, id2}, []peer.ID{peers[0].ID, peers[1].ID})
+
+	cab, ok := peerstore.GetCertifiedAddrBook(h.Peerstore())
+	require.True(t, ok)
+	require.NotNil(t, cab.GetPeerRecord(id1))
+	require.NotNil(t, cab.GetPeerRecord(id2))
+}
+
+func TestRecordFetcherAllSourcesFail(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	h := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	defer h.Close()
+
+	rf, err := NewRecordFetcher(h, []Source{&HTTPSource{URL: srv.URL}})
+	require.NoError(t, err)
+	defer rf.Close()
+
+	require.Error(t, rf.Refresh(ctx))
+}
@@ -0,0 +1,332 @@
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/record"
+
+	reuseport "github.com/libp2p/go-reuseport"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// DefaultBroadcastPort is the UDP port broadcast discovery announces peers on
+// by default.
+const DefaultBroadcastPort = 4042
+
+// broadcastMagic starts every announcement, followed by the service tag and
+// a newline, then by our signed peer record.
+const broadcastMagic = "libp2p-broadcast/1.0.0\n"
+
+// maxBroadcastSize is the maximum size of the announcements we send and
+// receive. Broadcasts don't leave the LAN, we can afford fragmentation.
+const maxBroadcastSize = 8 << 10
+
+// maxBroadcastAddrs is the maximum number of addresses we announce.
+const maxBroadcastAddrs = 16
+
+type broadcastConfig struct {
+	port    int
+	tag     string
+	targets []*net.UDPAddr
+}
+
+// BroadcastOption is an option for NewBroadcastService.
+type BroadcastOption func(*broadcastConfig)
+
+// BroadcastPort sets the UDP port we announce ourselves on, and listen for
+// announcements on. Defaults to DefaultBroadcastPort.
+func BroadcastPort(port int) BroadcastOption {
+	return func(cfg *broadcastConfig) {
+		cfg.port = port
+	}
+}
+
+// BroadcastTag sets the service tag of our announcements. We ignore the
+// announcements of other tags. Defaults to ServiceTag.
+func BroadcastTag(tag string) BroadcastOption {
+	return func(cfg *broadcastConfig) {
+		cfg.tag = tag
+	}
+}
+
+// BroadcastTargets adds unicast addresses to send our announcements to, on
+// top of broadcasting them, e.g. a proxy forwarding them to other network
+// segments where broadcasts don't reach.
+func BroadcastTargets(addrs ...*net.UDPAddr) BroadcastOption {
+	return func(cfg *broadcastConfig) {
+		cfg.targets = append(cfg.targets, addrs...)
+	}
+}
+
+// broadcastService discovers peers on the LAN with UDP broadcasts, for
+// networks blocking multicast, and so mDNS. Every interval, we broadcast a
+// signed peer record of our addresses on every IPv4 interface.
+type broadcastService struct {
+	host     host.Host
+	interval time.Duration
+	cfg      broadcastConfig
+	conn     net.PacketConn
+	cancel   context.CancelFunc
+
+	lk       sync.Mutex
+	notifees []Notifee
+	peers    map[peer.ID]*broadcastPeer
+}
+
+type broadcastPeer struct {
+	seq      uint64
+	addrs    []ma.Multiaddr
+	lastSeen time.Time
+}
+
+// NewBroadcastService returns a Service discovering peers with UDP broadcasts,
+// announcing ourselves every interval. It's a lightweight alternative to mDNS
+// where multicast is blocked, see BroadcastFallback.
+func NewBroadcastService(ctx context.Context, h host.Host, interval time.Duration, opts ...BroadcastOption) (Service, error) {
+	cfg := broadcastConfig{port: DefaultBroadcastPort, tag: ServiceTag}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if interval <= 0 {
+		return nil, errors.New("broadcast interval must be positive")
+	}
+
+	// other nodes on this machine listen on the same port.
+	listen := net.ListenPacket
+	if reuseport.Available() {
+		listen = reuseport.ListenPacket
+	}
+	conn, err := listen("udp4", fmt.Sprintf(":%d", cfg.port))
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	s := &broadcastService{
+		host:     h,
+		interval: interval,
+		cfg:      cfg,
+		conn:     conn,
+		cancel:   cancel,
+		peers:    make(map[peer.ID]*broadcastPeer),
+	}
+	go s.receive()
+	go s.announce(ctx)
+	return s, nil
+}
+
+func (s *broadcastService) Close() error {
+	s.cancel()
+	return s.conn.Close()
+}
+
+func (s *broadcastService) RegisterNotifee(n Notifee) {
+	s.lk.Lock()
+	s.notifees = append(s.notifees, n)
+	s.lk.Unlock()
+}
+
+func (s *broadcastService) UnregisterNotifee(n Notifee) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	for i, notif := range s.notifees {
+		if notif == n {
+			s.notifees = append(s.notifees[:i], s.notifees[i+1:]...)
+			return
+		}
+	}
+}
+
+func (s *broadcastService) announce(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		pkt, err := s.announcement()
+		if err != nil {
+			log.Warnw("failed to build broadcast announcement", "error", err)
+		} else {
+			for _, addr := range s.destinations() {
+				if _, err := s.conn.WriteTo(pkt, addr); err != nil {
+					log.Debugw("failed to send broadcast announcement", "addr", addr, "error", err)
+				}
+			}
+		}
+		s.forgetPeers(time.Now())
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// announcement returns an announcement of our current addresses.
+func (s *broadcastService) announcement() ([]byte, error) {
+	sk := s.host.Peerstore().PrivKey(s.host.ID())
+	if sk == nil {
+		return nil, errors.New("missing our private key")
+	}
+	addrs := s.host.Addrs()
+	if len(addrs) > maxBroadcastAddrs {
+		addrs = addrs[:maxBroadcastAddrs]
+	}
+	env, err := record.Seal(peer.PeerRecordFromAddrInfo(peer.AddrInfo{ID: s.host.ID(), Addrs: addrs}), sk)
+	if err != nil {
+		return nil, err
+	}
+	rec, err := env.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	pkt := make([]byte, 0, len(broadcastMagic)+len(s.cfg.tag)+1+len(rec))
+	pkt = append(pkt, broadcastMagic...)
+	pkt = append(pkt, s.cfg.tag...)
+	pkt = append(pkt, '\n')
+	pkt = append(pkt, rec...)
+	if len(pkt) > maxBroadcastSize {
+		return nil, fmt.Errorf("announcement too large: %d bytes", len(pkt))
+	}
+	return pkt, nil
+}
+
+// destinations returns the addresses to send our announcements to: the
+// broadcast address of every IPv4 interface that supports broadcasts, the
+// limited broadcast address, and the configured targets.
+func (s *broadcastService) destinations() []net.Addr {
+	dests := []net.Addr{&net.UDPAddr{IP: net.IPv4bcast, Port: s.cfg.port}}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		log.Debugw("failed to list interfaces", "error", err)
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagBroadcast == 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			ipnet, ok := a.(*net.IPNet)
+			if !ok || ipnet.IP.To4() == nil || len(ipnet.Mask) != net.IPv4len {
+				continue
+			}
+			bcast := make(net.IP, net.IPv4len)
+			for i := range bcast {
+				bcast[i] = ipnet.IP.To4()[i] | ^ipnet.Mask[i]
+			}
+			dests = append(dests, &net.UDPAddr{IP: bcast, Port: s.cfg.port})
+		}
+	}
+	for _, t := range s.cfg.targets {
+		dests = append(dests, t)
+	}
+	return dests
+}
+
+func (s *broadcastService) receive() {
+	buf := make([]byte, maxBroadcastSize+1)
+	for {
+		n, from, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			// closed.
+			return
+		}
+		if n > maxBroadcastSize {
+			continue
+		}
+		s.handleAnnouncement(buf[:n], from, time.Now())
+	}
+}
+
+// handleAnnouncement notifies the notifees of the announced peer if it's new,
+// or if its addresses changed. Replayed announcements are ignored.
+func (s *broadcastService) handleAnnouncement(pkt []byte, from net.Addr, now time.Time) {
+	if !bytes.HasPrefix(pkt, []byte(broadcastMagic)) {
+		return
+	}
+	pkt = pkt[len(broadcastMagic):]
+	i := bytes.IndexByte(pkt, '\n')
+	if i < 0 || string(pkt[:i]) != s.cfg.tag {
+		return
+	}
+	env, rec, err := record.ConsumeEnvelope(pkt[i+1:], peer.PeerRecordEnvelopeDomain)
+	if err != nil {
+		log.Debugw("ignoring invalid broadcast announcement", "from", from, "error", err)
+		return
+	}
+	prec, ok := rec.(*peer.PeerRecord)
+	if !ok {
+		return
+	}
+	signer, err := peer.IDFromPublicKey(env.PublicKey)
+	if err != nil || signer != prec.PeerID {
+		log.Debugw("ignoring broadcast announcement signed by another peer", "from", from)
+		return
+	}
+	if prec.PeerID == s.host.ID() || len(prec.Addrs) == 0 {
+		return
+	}
+
+	s.lk.Lock()
+	bp, known := s.peers[prec.PeerID]
+	if known && prec.Seq <= bp.seq {
+		if prec.Seq == bp.seq {
+			bp.lastSeen = now
+		}
+		s.lk.Unlock()
+		return
+	}
+	changed := !known || !sameAddrSet(bp.addrs, prec.Addrs)
+	s.peers[prec.PeerID] = &broadcastPeer{seq: prec.Seq, addrs: prec.Addrs, lastSeen: now}
+	notifees := append([]Notifee(nil), s.notifees...)
+	s.lk.Unlock()
+
+	if !changed {
+		return
+	}
+	pi := peer.AddrInfo{ID: prec.PeerID, Addrs: prec.Addrs}
+	for _, n := range notifees {
+		go n.HandlePeerFound(pi)
+	}
+}
+
+// forgetPeers forgets the peers we didn't hear from in three intervals, so
+// that we notify about them again when they're back.
+func (s *broadcastService) forgetPeers(now time.Time) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	for p, bp := range s.peers {
+		if now.Sub(bp.lastSeen) > 3*s.interval {
+			delete(s.peers, p)
+		}
+	}
+}
+
+func sameAddrSet(a, b []ma.Multiaddr) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, x := range a {
+		found := false
+		for _, y := range b {
+			if x.Equal(y) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
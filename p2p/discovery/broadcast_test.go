@@ -0,0 +1,158 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	ic "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/record"
+	"github.com/libp2p/go-libp2p-core/test"
+
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+// newBroadcastHosts returns n mock hosts. Mock hosts' default keys can't sign
+// peer records.
+func newBroadcastHosts(ctx context.Context, t *testing.T, n int) []host.Host {
+	mn := mocknet.New(ctx)
+	for i := 0; i < n; i++ {
+		sk, _, err := test.RandTestKeyPair(ic.Ed25519, 0)
+		require.NoError(t, err)
+		_, err = mn.AddPeer(sk, ma.StringCast(fmt.Sprintf("/ip4/192.168.1.%d/tcp/4001", i+1)))
+		require.NoError(t, err)
+	}
+	return mn.Hosts()
+}
+
+// sealAnnouncement returns an announcement of the record, signed with sk.
+func sealAnnouncement(t *testing.T, tag string, rec *peer.PeerRecord, sk ic.PrivKey) []byte {
+	env, err := record.Seal(rec, sk)
+	require.NoError(t, err)
+	b, err := env.Marshal()
+	require.NoError(t, err)
+	return append([]byte(broadcastMagic+tag+"\n"), b...)
+}
+
+func TestBroadcastHandleAnnouncement(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := newBroadcastHosts(ctx, t, 3)
+	from := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 2), Port: DefaultBroadcastPort}
+	s := &broadcastService{
+		host:     hosts[0],
+		interval: time.Second,
+		cfg:      broadcastConfig{port: DefaultBroadcastPort, tag: ServiceTag},
+		peers:    make(map[peer.ID]*broadcastPeer),
+	}
+	found := make(chanNotifee, 10)
+	s.RegisterNotifee(found)
+	expectFound := func(id peer.ID, addrs ...ma.Multiaddr) {
+		t.Helper()
+		select {
+		case pi := <-found:
+			require.Equal(t, id, pi.ID)
+			require.Equal(t, addrs, pi.Addrs)
+		case <-time.After(time.Second):
+			t.Fatal("peer not found")
+		}
+	}
+	expectNone := func() {
+		t.Helper()
+		select {
+		case pi := <-found:
+			t.Fatalf("unexpectedly found %s", pi.ID)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	other := &broadcastService{host: hosts[1], cfg: broadcastConfig{tag: ServiceTag}}
+	pkt, err := other.announcement()
+	require.NoError(t, err)
+	now := time.Now()
+	s.handleAnnouncement(pkt, from, now)
+	expectFound(hosts[1].ID(), hosts[1].Addrs()...)
+
+	// replayed, or unchanged.
+	s.handleAnnouncement(pkt, from, now)
+	expectNone()
+
+	// changed addresses.
+	sk := hosts[1].Peerstore().PrivKey(hosts[1].ID())
+	addr := ma.StringCast("/ip4/192.168.1.20/tcp/4001")
+	newer := peer.PeerRecordFromAddrInfo(peer.AddrInfo{ID: hosts[1].ID(), Addrs: []ma.Multiaddr{addr}})
+	s.handleAnnouncement(sealAnnouncement(t, ServiceTag, newer, sk), from, now)
+	expectFound(hosts[1].ID(), addr)
+	// older records are ignored.
+	s.handleAnnouncement(pkt, from, now)
+	expectNone()
+
+	// other tags.
+	s.handleAnnouncement(sealAnnouncement(t, "_other._udp", peer.PeerRecordFromAddrInfo(peer.AddrInfo{ID: hosts[2].ID(), Addrs: hosts[2].Addrs()}), hosts[2].Peerstore().PrivKey(hosts[2].ID())), from, now)
+	expectNone()
+
+	// records signed by another peer.
+	forged := peer.PeerRecordFromAddrInfo(peer.AddrInfo{ID: hosts[2].ID(), Addrs: hosts[2].Addrs()})
+	s.handleAnnouncement(sealAnnouncement(t, ServiceTag, forged, sk), from, now)
+	expectNone()
+
+	// ourselves.
+	self := &broadcastService{host: hosts[0], cfg: broadcastConfig{tag: ServiceTag}}
+	pkt, err = self.announcement()
+	require.NoError(t, err)
+	s.handleAnnouncement(pkt, from, now)
+	expectNone()
+
+	// garbage.
+	s.handleAnnouncement([]byte(broadcastMagic+ServiceTag+"\nfoo"), from, now)
+	s.handleAnnouncement([]byte("foo"), from, now)
+	expectNone()
+
+	// forgotten peers are found again.
+	s.forgetPeers(now.Add(4 * time.Second))
+	s.handleAnnouncement(sealAnnouncement(t, ServiceTag, newer, sk), from, now)
+	expectFound(hosts[1].ID(), addr)
+}
+
+func freeUDPPort(t *testing.T) int {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+func TestBroadcastService(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := newBroadcastHosts(ctx, t, 2)
+	port := freeUDPPort(t)
+	listener, err := NewBroadcastService(ctx, hosts[0], time.Hour, BroadcastPort(port))
+	require.NoError(t, err)
+	defer listener.Close()
+	found := make(chanNotifee, 1)
+	listener.RegisterNotifee(found)
+
+	// broadcasts may not be allowed in the test environment, target the
+	// listener directly.
+	target := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+	announcer, err := NewBroadcastService(ctx, hosts[1], 100*time.Millisecond, BroadcastPort(freeUDPPort(t)), BroadcastTargets(target))
+	require.NoError(t, err)
+	defer announcer.Close()
+
+	select {
+	case pi := <-found:
+		require.Equal(t, hosts[1].ID(), pi.ID)
+		require.Equal(t, hosts[1].Addrs(), pi.Addrs)
+	case <-time.After(5 * time.Second):
+		t.Fatal("peer not found")
+	}
+}
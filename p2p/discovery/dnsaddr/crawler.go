@@ -0,0 +1,207 @@
+package dnsaddr
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	coredisc "github.com/libp2p/go-libp2p-core/discovery"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/libp2p/go-libp2p/p2p/discovery"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// Crawler periodically resolves a set of dnsaddr seeds, re-resolving them as
+// their records expire, and notifies its notifees of the peers it finds: the
+// new ones, and the ones whose addresses changed.
+type Crawler struct {
+	r     *Resolver
+	seeds []ma.Multiaddr
+
+	ctx       context.Context
+	ctxCancel context.CancelFunc
+	refCount  sync.WaitGroup
+
+	mu       sync.Mutex
+	notifees []discovery.Notifee
+	// peers are the peers we found in the last crawl.
+	peers map[peer.ID]peer.AddrInfo
+}
+
+var _ coredisc.Discoverer = (*Crawler)(nil)
+
+// NewCrawler constructs a new Crawler and starts crawling the seeds in the
+// background.
+func NewCrawler(seeds []ma.Multiaddr, opts ...Option) (*Crawler, error) {
+	if len(seeds) == 0 {
+		return nil, errors.New("no dnsaddr seeds")
+	}
+	r, err := NewResolver(opts...)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &Crawler{
+		r:         r,
+		seeds:     seeds,
+		ctx:       ctx,
+		ctxCancel: cancel,
+		peers:     make(map[peer.ID]peer.AddrInfo),
+	}
+	c.refCount.Add(1)
+	go c.background()
+	return c, nil
+}
+
+func (c *Crawler) background() {
+	defer c.refCount.Done()
+
+	for {
+		expiry := c.crawl(c.ctx)
+		wait := time.Until(expiry)
+		if wait < c.r.cfg.minTTL {
+			wait = c.r.cfg.minTTL
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-c.ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// crawl resolves all seeds, notifying the notifees, and returns when the first
+// of the records expires.
+func (c *Crawler) crawl(ctx context.Context) time.Time {
+	peers, expiry := c.resolveAll(ctx)
+
+	c.mu.Lock()
+	var found []peer.AddrInfo
+	for _, pi := range peers {
+		if old, ok := c.peers[pi.ID]; !ok || !sameAddrs(old.Addrs, pi.Addrs) {
+			found = append(found, pi)
+		}
+	}
+	current := make(map[peer.ID]peer.AddrInfo, len(peers))
+	for _, pi := range peers {
+		current[pi.ID] = pi
+	}
+	c.peers = current
+	notifees := append([]discovery.Notifee(nil), c.notifees...)
+	c.mu.Unlock()
+
+	for _, pi := range found {
+		for _, n := range notifees {
+			n.HandlePeerFound(pi)
+		}
+	}
+	return expiry
+}
+
+// resolveAll resolves all seeds, and returns the peers they point to, and when
+// the first of the records expires. Seeds that fail to resolve are skipped.
+func (c *Crawler) resolveAll(ctx context.Context) ([]peer.AddrInfo, time.Time) {
+	var (
+		peers  []peer.AddrInfo
+		index  = make(map[peer.ID]int)
+		expiry time.Time
+	)
+	for _, seed := range c.seeds {
+		found, exp, err := c.r.Resolve(ctx, seed)
+		if expiry.IsZero() || (!exp.IsZero() && exp.Before(expiry)) {
+			expiry = exp
+		}
+		if err != nil {
+			log.Debugw("failed to resolve dnsaddr seed", "seed", seed, "error", err)
+			continue
+		}
+		for _, pi := range found {
+			i, ok := index[pi.ID]
+			if !ok {
+				index[pi.ID] = len(peers)
+				peers = append(peers, pi)
+				continue
+			}
+			for _, a := range pi.Addrs {
+				if !containsAddr(peers[i].Addrs, a) {
+					peers[i].Addrs = append(peers[i].Addrs, a)
+				}
+			}
+		}
+	}
+	return peers, expiry
+}
+
+// FindPeers resolves the seeds, using the records we cached, and returns the
+// peers they point to, up to the number given by the discovery.Limit option.
+// DNS seeds aren't namespaced, so that the namespace is ignored.
+func (c *Crawler) FindPeers(ctx context.Context, _ string, opts ...coredisc.Option) (<-chan peer.AddrInfo, error) {
+	var options coredisc.Options
+	if err := options.Apply(opts...); err != nil {
+		return nil, err
+	}
+	peers, _ := c.resolveAll(ctx)
+	if options.Limit > 0 && len(peers) > options.Limit {
+		peers = peers[:options.Limit]
+	}
+	out := make(chan peer.AddrInfo, len(peers))
+	for _, pi := range peers {
+		out <- pi
+	}
+	close(out)
+	return out, nil
+}
+
+// Peers returns the peers found in the last crawl.
+func (c *Crawler) Peers() []peer.AddrInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	peers := make([]peer.AddrInfo, 0, len(c.peers))
+	for _, pi := range c.peers {
+		peers = append(peers, pi)
+	}
+	return peers
+}
+
+// RegisterNotifee registers a notifee to notify of the peers we find.
+func (c *Crawler) RegisterNotifee(n discovery.Notifee) {
+	c.mu.Lock()
+	c.notifees = append(c.notifees, n)
+	c.mu.Unlock()
+}
+
+// UnregisterNotifee unregisters a notifee.
+func (c *Crawler) UnregisterNotifee(n discovery.Notifee) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, notif := range c.notifees {
+		if notif == n {
+			c.notifees = append(c.notifees[:i], c.notifees[i+1:]...)
+			return
+		}
+	}
+}
+
+// Close stops crawling.
+func (c *Crawler) Close() error {
+	c.ctxCancel()
+	c.refCount.Wait()
+	return nil
+}
+
+func sameAddrs(a, b []ma.Multiaddr) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, addr := range a {
+		if !containsAddr(b, addr) {
+			return false
+		}
+	}
+	return true
+}
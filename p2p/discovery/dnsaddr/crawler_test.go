@@ -0,0 +1,65 @@
+package dnsaddr
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	coredisc "github.com/libp2p/go-libp2p-core/discovery"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+type chanNotifee chan peer.AddrInfo
+
+func (n chanNotifee) HandlePeerFound(pi peer.AddrInfo) { n <- pi }
+
+func TestCrawler(t *testing.T) {
+	ids := randIDs(t, 2)
+	dns := newFakeDNS()
+	dns.set("_dnsaddr.a.example", time.Hour, "dnsaddr=/ip4/1.2.3.4/tcp/4001/p2p/"+ids[0].Pretty())
+	dns.set("_dnsaddr.b.example", time.Hour,
+		"dnsaddr=/ip4/1.2.3.4/tcp/4001/p2p/"+ids[0].Pretty(),
+		"dnsaddr=/ip4/1.2.3.5/tcp/4001/p2p/"+ids[1].Pretty(),
+	)
+
+	c, err := NewCrawler([]ma.Multiaddr{
+		ma.StringCast("/dnsaddr/a.example"),
+		ma.StringCast("/dnsaddr/b.example"),
+		ma.StringCast("/dnsaddr/missing.example"),
+	}, WithLookup(dns.lookup))
+	require.NoError(t, err)
+	defer c.Close()
+
+	found := make(chanNotifee, 4)
+	c.RegisterNotifee(found)
+	// the first crawl may have happened before registering.
+	c.crawl(context.Background())
+	require.Eventually(t, func() bool { return len(c.Peers()) == 2 }, time.Second, 10*time.Millisecond)
+
+	ch, err := c.FindPeers(context.Background(), "", coredisc.Limit(1))
+	require.NoError(t, err)
+	var peers []peer.AddrInfo
+	for pi := range ch {
+		peers = append(peers, pi)
+	}
+	require.Equal(t, []peer.AddrInfo{{ID: ids[0], Addrs: []ma.Multiaddr{ma.StringCast("/ip4/1.2.3.4/tcp/4001")}}}, peers)
+
+	// peers are only notified again if their addresses change.
+	for len(found) > 0 {
+		<-found
+	}
+	c.crawl(context.Background())
+	require.Empty(t, found)
+	c.r.mu.Lock()
+	c.r.cache = make(map[string]*cachedRecords)
+	c.r.mu.Unlock()
+	dns.set("_dnsaddr.a.example", time.Hour, "dnsaddr=/ip4/1.2.3.6/tcp/4001/p2p/"+ids[0].Pretty())
+	c.crawl(context.Background())
+	require.Len(t, found, 1)
+	pi := <-found
+	require.Equal(t, ids[0], pi.ID)
+	require.Len(t, pi.Addrs, 2)
+}
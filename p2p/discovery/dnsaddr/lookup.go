@@ -0,0 +1,111 @@
+package dnsaddr
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// resolvConf is the configuration of the system's name servers.
+const resolvConf = "/etc/resolv.conf"
+
+// fallbackTTL is the TTL of the records looked up without knowing their TTL,
+// see SystemLookup.
+const fallbackTTL = 10 * time.Minute
+
+// SystemLookup returns a LookupTXT querying the name servers of the system
+// directly, to know the TTL of the records. Where the name servers aren't
+// known, e.g. on Windows, it falls back to net.DefaultResolver, caching the
+// records for 10 minutes.
+func SystemLookup() LookupTXT {
+	conf, err := dns.ClientConfigFromFile(resolvConf)
+	if err != nil || len(conf.Servers) == 0 {
+		return netLookup
+	}
+	servers := make([]string, len(conf.Servers))
+	for i, s := range conf.Servers {
+		servers[i] = net.JoinHostPort(s, conf.Port)
+	}
+	return func(ctx context.Context, name string) ([]string, time.Duration, error) {
+		return lookupTXT(ctx, servers, name)
+	}
+}
+
+func netLookup(ctx context.Context, name string) ([]string, time.Duration, error) {
+	txts, err := net.DefaultResolver.LookupTXT(ctx, name)
+	if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+		return nil, fallbackTTL, nil
+	}
+	return txts, fallbackTTL, err
+}
+
+// lookupTXT queries the servers in turn for the TXT records of the name, until
+// one answers.
+func lookupTXT(ctx context.Context, servers []string, name string) ([]string, time.Duration, error) {
+	q := new(dns.Msg)
+	q.SetQuestion(dns.Fqdn(name), dns.TypeTXT)
+
+	var lastErr error
+	for _, server := range servers {
+		resp, _, err := new(dns.Client).ExchangeContext(ctx, q, server)
+		if err == nil && resp.Truncated {
+			resp, _, err = (&dns.Client{Net: "tcp"}).ExchangeContext(ctx, q, server)
+		}
+		if err != nil {
+			lastErr = err
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+
+		switch resp.Rcode {
+		case dns.RcodeSuccess:
+		case dns.RcodeNameError:
+			// the name doesn't exist, cache that as long as the zone says.
+			return nil, negativeTTL(resp), nil
+		default:
+			lastErr = fmt.Errorf("looking up %s: %s", name, dns.RcodeToString[resp.Rcode])
+			continue
+		}
+
+		var (
+			txts []string
+			ttl  time.Duration
+		)
+		for _, rr := range resp.Answer {
+			txt, ok := rr.(*dns.TXT)
+			if !ok {
+				continue
+			}
+			txts = append(txts, strings.Join(txt.Txt, ""))
+			if rrTTL := time.Duration(txt.Hdr.Ttl) * time.Second; len(txts) == 1 || rrTTL < ttl {
+				ttl = rrTTL
+			}
+		}
+		if len(txts) == 0 {
+			ttl = negativeTTL(resp)
+		}
+		return txts, ttl, nil
+	}
+	return nil, 0, lastErr
+}
+
+// negativeTTL returns how long the absence of records can be cached, as given
+// by the SOA record of the response, zero if none.
+func negativeTTL(resp *dns.Msg) time.Duration {
+	for _, rr := range resp.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			ttl := soa.Minttl
+			if soa.Hdr.Ttl < ttl {
+				ttl = soa.Hdr.Ttl
+			}
+			return time.Duration(ttl) * time.Second
+		}
+	}
+	return 0
+}
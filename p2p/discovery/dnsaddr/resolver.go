@@ -0,0 +1,273 @@
+// Package dnsaddr discovers peers from dnsaddr DNS seeds, such as
+// /dnsaddr/bootstrap.libp2p.io: the TXT records of _dnsaddr.<domain> list the
+// multiaddrs of the peers, dnsaddr=<multiaddr> each, possibly pointing to
+// other dnsaddr domains, forming a tree. Bootstrap lists can then be updated in
+// DNS instead of in every node.
+//
+// Resolver resolves dnsaddr trees, caching the records as long as their TTL
+// says, and Crawler periodically resolves a set of seeds and reports the peers
+// it finds.
+package dnsaddr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	logging "github.com/ipfs/go-log/v2"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+var log = logging.Logger("dnsaddr")
+
+// txtPrefix prefixes the multiaddrs in dnsaddr TXT records.
+const txtPrefix = "dnsaddr="
+
+// maxEntries is the maximum number of entries of a tree we resolve, so that a
+// malicious tree can't make us resolve forever.
+const maxEntries = 1000
+
+// LookupTXT looks up the TXT records of a name, and returns them with the
+// lowest TTL among them.
+type LookupTXT func(ctx context.Context, name string) (txts []string, ttl time.Duration, err error)
+
+type config struct {
+	lookup   LookupTXT
+	minTTL   time.Duration
+	maxTTL   time.Duration
+	maxDepth int
+}
+
+// Option is an option for the Resolver and the Crawler.
+type Option func(*config)
+
+// WithLookup sets the function looking up TXT records. Defaults to querying
+// the name servers of the system, see SystemLookup.
+func WithLookup(lookup LookupTXT) Option {
+	return func(cfg *config) {
+		cfg.lookup = lookup
+	}
+}
+
+// TTLBounds bounds the TTL records are cached for, whatever their TTL, so
+// that we neither query too often nor keep stale records too long. Failed
+// lookups are cached for the minimum TTL. Defaults to one minute and one day.
+func TTLBounds(min, max time.Duration) Option {
+	return func(cfg *config) {
+		cfg.minTTL = min
+		cfg.maxTTL = max
+	}
+}
+
+// MaxDepth sets how many dnsaddr domains deep we resolve trees. Defaults to
+// 8.
+func MaxDepth(n int) Option {
+	return func(cfg *config) {
+		cfg.maxDepth = n
+	}
+}
+
+func newConfig(opts []Option) (config, error) {
+	cfg := config{
+		minTTL:   time.Minute,
+		maxTTL:   24 * time.Hour,
+		maxDepth: 8,
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.lookup == nil {
+		cfg.lookup = SystemLookup()
+	}
+	if cfg.minTTL <= 0 || cfg.maxTTL < cfg.minTTL {
+		return cfg, errors.New("invalid ttl bounds")
+	}
+	return cfg, nil
+}
+
+// Resolver resolves dnsaddr trees, caching the records of every domain.
+type Resolver struct {
+	cfg config
+	now func() time.Time
+
+	mu    sync.Mutex
+	cache map[string]*cachedRecords
+}
+
+type cachedRecords struct {
+	addrs  []ma.Multiaddr
+	err    error
+	expiry time.Time
+}
+
+// NewResolver constructs a new Resolver.
+func NewResolver(opts ...Option) (*Resolver, error) {
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Resolver{
+		cfg:   cfg,
+		now:   time.Now,
+		cache: make(map[string]*cachedRecords),
+	}, nil
+}
+
+// Resolve resolves the dnsaddr multiaddr recursively, and returns the peers
+// it points to, and when the first of the records it resolved expires. If the
+// multiaddr ends with /p2p/<id>, e.g. /dnsaddr/example.com/p2p/<id>, only the
+// entries of that peer are kept. Entries without a peer ID are skipped, as we
+// couldn't dial them.
+func (r *Resolver) Resolve(ctx context.Context, maddr ma.Multiaddr) ([]peer.AddrInfo, time.Time, error) {
+	first, rest := ma.SplitFirst(maddr)
+	if first == nil || first.Protocol().Code != ma.P_DNSADDR {
+		return nil, time.Time{}, fmt.Errorf("not a dnsaddr multiaddr: %s", maddr)
+	}
+
+	res := &resolution{
+		visiting: make(map[string]bool),
+		peers:    make(map[peer.ID]*peer.AddrInfo),
+	}
+	if err := r.resolve(ctx, first.Value(), rest, 0, res); err != nil {
+		return nil, time.Time{}, err
+	}
+	peers := make([]peer.AddrInfo, 0, len(res.order))
+	for _, p := range res.order {
+		peers = append(peers, *res.peers[p])
+	}
+	return peers, res.expiry, nil
+}
+
+// resolution is the state of a Resolve.
+type resolution struct {
+	// visiting are the domains on the path to the current one, to detect
+	// cycles.
+	visiting map[string]bool
+	entries  int
+	expiry   time.Time
+	peers    map[peer.ID]*peer.AddrInfo
+	order    []peer.ID
+}
+
+func (r *Resolver) resolve(ctx context.Context, domain string, suffix ma.Multiaddr, depth int, res *resolution) error {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if res.visiting[domain] {
+		log.Debugw("ignoring dnsaddr cycle", "domain", domain)
+		return nil
+	}
+	res.visiting[domain] = true
+	defer delete(res.visiting, domain)
+
+	addrs, expiry, err := r.records(ctx, domain)
+	if res.expiry.IsZero() || expiry.Before(res.expiry) {
+		res.expiry = expiry
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, addr := range addrs {
+		if suffix != nil && !hasSuffix(addr, suffix) {
+			continue
+		}
+		if res.entries++; res.entries > maxEntries {
+			return fmt.Errorf("dnsaddr tree of %s has too many entries", domain)
+		}
+		first, rest := ma.SplitFirst(addr)
+		if first.Protocol().Code == ma.P_DNSADDR {
+			if depth+1 >= r.cfg.maxDepth {
+				log.Debugw("ignoring too deep dnsaddr entry", "domain", domain, "addr", addr)
+				continue
+			}
+			// resolving the subtree may fail without failing the tree.
+			if err := r.resolve(ctx, first.Value(), rest, depth+1, res); err != nil {
+				log.Debugw("failed to resolve dnsaddr entry", "domain", domain, "addr", addr, "error", err)
+			}
+			continue
+		}
+		transport, id := peer.SplitAddr(addr)
+		if id == "" || transport == nil {
+			continue
+		}
+		pi, ok := res.peers[id]
+		if !ok {
+			pi = &peer.AddrInfo{ID: id}
+			res.peers[id] = pi
+			res.order = append(res.order, id)
+		}
+		if !containsAddr(pi.Addrs, transport) {
+			// domains may appear in several branches of the tree.
+			pi.Addrs = append(pi.Addrs, transport)
+		}
+	}
+	return nil
+}
+
+// records returns the multiaddrs in the TXT records of the domain, looking
+// them up if not cached, and when they expire.
+func (r *Resolver) records(ctx context.Context, domain string) ([]ma.Multiaddr, time.Time, error) {
+	r.mu.Lock()
+	c, ok := r.cache[domain]
+	r.mu.Unlock()
+	now := r.now()
+	if ok && now.Before(c.expiry) {
+		return c.addrs, c.expiry, c.err
+	}
+
+	txts, ttl, err := r.cfg.lookup(ctx, "_dnsaddr."+domain)
+	if err != nil && ctx.Err() != nil {
+		// don't cache our own cancellation.
+		return nil, now, err
+	}
+	if err != nil || ttl < r.cfg.minTTL {
+		ttl = r.cfg.minTTL
+	} else if ttl > r.cfg.maxTTL {
+		ttl = r.cfg.maxTTL
+	}
+	c = &cachedRecords{err: err, expiry: now.Add(ttl)}
+	for _, txt := range txts {
+		if !strings.HasPrefix(txt, txtPrefix) {
+			continue
+		}
+		addr, err := ma.NewMultiaddr(strings.TrimPrefix(txt, txtPrefix))
+		if err != nil {
+			log.Debugw("ignoring invalid dnsaddr record", "domain", domain, "record", txt, "error", err)
+			continue
+		}
+		c.addrs = append(c.addrs, addr)
+	}
+
+	r.mu.Lock()
+	r.cache[domain] = c
+	r.mu.Unlock()
+	return c.addrs, c.expiry, c.err
+}
+
+// hasSuffix returns true if the multiaddr ends with the suffix.
+func hasSuffix(addr, suffix ma.Multiaddr) bool {
+	a, s := ma.Split(addr), ma.Split(suffix)
+	if len(a) < len(s) {
+		return false
+	}
+	a = a[len(a)-len(s):]
+	for i := range s {
+		if !a[i].Equal(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsAddr(addrs []ma.Multiaddr, addr ma.Multiaddr) bool {
+	for _, a := range addrs {
+		if a.Equal(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,145 @@
+package dnsaddr
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/test"
+
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeRecords struct {
+	txts []string
+	ttl  time.Duration
+	err  error
+}
+
+// fakeDNS serves TXT records, counting the lookups of every name.
+type fakeDNS struct {
+	mu      sync.Mutex
+	records map[string]fakeRecords
+	lookups map[string]int
+}
+
+func newFakeDNS() *fakeDNS {
+	return &fakeDNS{records: make(map[string]fakeRecords), lookups: make(map[string]int)}
+}
+
+func (d *fakeDNS) set(name string, ttl time.Duration, txts ...string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.records[name] = fakeRecords{txts: txts, ttl: ttl}
+}
+
+func (d *fakeDNS) count(name string) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.lookups[name]
+}
+
+func (d *fakeDNS) lookup(_ context.Context, name string) ([]string, time.Duration, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.lookups[name]++
+	r, ok := d.records[name]
+	if !ok {
+		return nil, 0, errors.New("no such name")
+	}
+	return r.txts, r.ttl, r.err
+}
+
+func randIDs(t *testing.T, n int) []peer.ID {
+	ids := make([]peer.ID, n)
+	for i := range ids {
+		id, err := test.RandPeerID()
+		require.NoError(t, err)
+		ids[i] = id
+	}
+	return ids
+}
+
+func TestResolveTree(t *testing.T) {
+	ids := randIDs(t, 3)
+	dns := newFakeDNS()
+	dns.set("_dnsaddr.seed.example", time.Hour,
+		"dnsaddr=/dnsaddr/a.example",
+		"dnsaddr=/dnsaddr/b.example",
+		"dnsaddr=/ip4/1.2.3.4/tcp/4001", // no peer ID
+		"not a dnsaddr record",
+		"dnsaddr=/invalid",
+	)
+	dns.set("_dnsaddr.a.example", time.Hour,
+		"dnsaddr=/ip4/1.2.3.4/tcp/4001/p2p/"+ids[0].Pretty(),
+		"dnsaddr=/ip6/::1/tcp/4001/p2p/"+ids[0].Pretty(),
+		"dnsaddr=/dnsaddr/seed.example", // cycle
+	)
+	dns.set("_dnsaddr.b.example", time.Hour,
+		"dnsaddr=/dns4/b.example/tcp/4001/p2p/"+ids[1].Pretty(),
+		"dnsaddr=/dnsaddr/c.example/p2p/"+ids[2].Pretty(),
+		"dnsaddr=/dnsaddr/missing.example",
+	)
+	dns.set("_dnsaddr.c.example", time.Hour,
+		"dnsaddr=/ip4/1.2.3.5/tcp/4001/p2p/"+ids[2].Pretty(),
+		"dnsaddr=/ip4/1.2.3.6/tcp/4001/p2p/"+ids[0].Pretty(),
+	)
+
+	r, err := NewResolver(WithLookup(dns.lookup))
+	require.NoError(t, err)
+	peers, _, err := r.Resolve(context.Background(), ma.StringCast("/dnsaddr/seed.example"))
+	require.NoError(t, err)
+	require.Equal(t, []peer.AddrInfo{
+		{ID: ids[0], Addrs: []ma.Multiaddr{ma.StringCast("/ip4/1.2.3.4/tcp/4001"), ma.StringCast("/ip6/::1/tcp/4001")}},
+		{ID: ids[1], Addrs: []ma.Multiaddr{ma.StringCast("/dns4/b.example/tcp/4001")}},
+		// only the entries of the requested peer.
+		{ID: ids[2], Addrs: []ma.Multiaddr{ma.StringCast("/ip4/1.2.3.5/tcp/4001")}},
+	}, peers)
+
+	// the root must resolve.
+	_, _, err = r.Resolve(context.Background(), ma.StringCast("/dnsaddr/missing.example"))
+	require.Error(t, err)
+	_, _, err = r.Resolve(context.Background(), ma.StringCast("/ip4/1.2.3.4/tcp/4001"))
+	require.Error(t, err)
+}
+
+func TestResolveTTL(t *testing.T) {
+	id := randIDs(t, 1)[0]
+	dns := newFakeDNS()
+	dns.set("_dnsaddr.seed.example", time.Hour, "dnsaddr=/dnsaddr/short.example", "dnsaddr=/dnsaddr/long.example")
+	dns.set("_dnsaddr.short.example", time.Second, "dnsaddr=/ip4/1.2.3.4/tcp/4001/p2p/"+id.Pretty())
+	dns.set("_dnsaddr.long.example", 1000*time.Hour)
+
+	now := time.Now()
+	r, err := NewResolver(WithLookup(dns.lookup), TTLBounds(time.Minute, 24*time.Hour))
+	require.NoError(t, err)
+	r.now = func() time.Time { return now }
+
+	resolve := func() time.Time {
+		_, expiry, err := r.Resolve(context.Background(), ma.StringCast("/dnsaddr/seed.example"))
+		require.NoError(t, err)
+		return expiry
+	}
+	// the TTL is bounded.
+	require.Equal(t, now.Add(time.Minute), resolve())
+	require.Equal(t, 1, dns.count("_dnsaddr.short.example"))
+
+	// cached.
+	now = now.Add(30 * time.Second)
+	resolve()
+	require.Equal(t, 1, dns.count("_dnsaddr.short.example"))
+	require.Equal(t, 1, dns.count("_dnsaddr.seed.example"))
+
+	// only expired records are looked up again.
+	now = now.Add(time.Minute)
+	resolve()
+	require.Equal(t, 2, dns.count("_dnsaddr.short.example"))
+	require.Equal(t, 1, dns.count("_dnsaddr.seed.example"))
+	now = now.Add(25 * time.Hour)
+	resolve()
+	require.Equal(t, 2, dns.count("_dnsaddr.long.example"))
+}
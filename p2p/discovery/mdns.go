@@ -2,15 +2,23 @@ package discovery
 
 import (
 	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
 	"net"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/libp2p/go-libp2p-core/event"
 	"github.com/libp2p/go-libp2p-core/host"
 	"github.com/libp2p/go-libp2p-core/peer"
 
+	"github.com/libp2p/go-libp2p/p2p/net/addrfamily"
+
 	logging "github.com/ipfs/go-log/v2"
 	ma "github.com/multiformats/go-multiaddr"
 	manet "github.com/multiformats/go-multiaddr/net"
@@ -26,6 +34,9 @@ var log = logging.Logger("mdns")
 
 const ServiceTag = "_ipfs-discovery._udp"
 
+// mdnsDomain is the domain we advertise and browse services in.
+const mdnsDomain = "local"
+
 type Service interface {
 	io.Closer
 	RegisterNotifee(Notifee)
@@ -36,15 +47,240 @@ type Notifee interface {
 	HandlePeerFound(peer.AddrInfo)
 }
 
+// LostNotifee is a Notifee that is also notified when a peer it was notified
+// about disappeared: once its records expired without being seen again.
+type LostNotifee interface {
+	Notifee
+	HandlePeerLost(peer.ID)
+}
+
+type mdnsConfig struct {
+	privacyKey      []byte
+	privacyRotation time.Duration
+	family          addrfamily.Policy
+	namespace       string
+	ifaceFilter     func(net.Interface) bool
+	autoConnect     *AutoConnectPolicy
+	skipLinkLocal   bool
+	rediscovery     time.Duration
+	maxInterval     time.Duration
+	metadata        map[string]string
+	metadataFilter  func(map[string]string) bool
+	browseOnly      bool
+	// broadcast are the options of the broadcast discovery we fall back to,
+	// if any, see BroadcastFallback.
+	broadcast []BroadcastOption
+	formats   MdnsFormat
+	metrics   MdnsMetricsTracer
+}
+
+// MdnsOption is an option for NewMdnsService.
+type MdnsOption func(*mdnsConfig)
+
+// PrivacyMode hides our peer ID from passive observers on the LAN. Instead of
+// our peer ID, we advertise our peer ID encrypted with the given shared key,
+// along with a fresh random instance name, both rotated every rotation
+// interval. Only peers
+// configured with the same key, i.e. peers that consented to discover each
+// other, can find us, and only entries encrypted with that key are accepted.
+func PrivacyMode(key []byte, rotation time.Duration) MdnsOption {
+	return func(cfg *mdnsConfig) {
+		cfg.privacyKey = key
+		cfg.privacyRotation = rotation
+	}
+}
+
+// AddrFamily applies the given address family policy: we only advertise, and
+// only report peers with, addresses of the allowed families, and we report
+// the address of the preferred family when a peer advertises both.
+func AddrFamily(p addrfamily.Policy) MdnsOption {
+	return func(cfg *mdnsConfig) {
+		cfg.family = p
+	}
+}
+
+// Namespace isolates our discovery from other libp2p applications on the same
+// LAN using the same service tag: we advertise, and browse, the service tag
+// prefixed with the namespace, e.g. _myapp._ipfs-discovery._udp, and only
+// accept entries of that service.
+func Namespace(ns string) MdnsOption {
+	return func(cfg *mdnsConfig) {
+		cfg.namespace = ns
+	}
+}
+
+// browseOnly makes us browse without advertising our identity until
+// advertising is turned on, see MdnsDiscovery.
+func browseOnly() MdnsOption {
+	return func(cfg *mdnsConfig) {
+		cfg.browseOnly = true
+	}
+}
+
+// InterfaceFilter restricts us to advertise and browse only on the network
+// interfaces the filter returns true for, instead of on all interfaces. We
+// only advertise our addresses on these interfaces, and only report peers with
+// addresses on their networks. Interfaces are selected when starting the
+// service, and again whenever our addresses change.
+func InterfaceFilter(filter func(net.Interface) bool) MdnsOption {
+	return func(cfg *mdnsConfig) {
+		cfg.ifaceFilter = filter
+	}
+}
+
+// Interfaces restricts us to advertise and browse only on the network
+// interfaces of the given names, see InterfaceFilter.
+func Interfaces(names ...string) MdnsOption {
+	return InterfaceFilter(func(iface net.Interface) bool {
+		for _, name := range names {
+			if iface.Name == name {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// SkipLinkLocal doesn't advertise our link-local addresses, which peers can
+// only dial knowing the interface they received them on. Link-local addresses
+// peers advertise are still reported, with the zone of the interface we
+// received them on.
+func SkipLinkLocal() MdnsOption {
+	return func(cfg *mdnsConfig) {
+		cfg.skipLinkLocal = true
+	}
+}
+
+// RediscoveryInterval notifies again about a peer we keep finding, with the
+// same address, once the interval elapsed since we last notified about it. By
+// default, we only notify about new peers, peers whose address changed, and
+// peers that reappeared after we lost them.
+func RediscoveryInterval(d time.Duration) MdnsOption {
+	return func(cfg *mdnsConfig) {
+		cfg.rediscovery = d
+	}
+}
+
+// QueryBackoff backs off querying while the LAN doesn't change: every query
+// that finds no new peer, no peer at a new address and loses no peer doubles
+// the query interval, up to the given maximum. A query finding a change
+// resets it to the interval passed to NewMdnsService.
+func QueryBackoff(max time.Duration) MdnsOption {
+	return func(cfg *mdnsConfig) {
+		cfg.maxInterval = max
+	}
+}
+
+// Metadata advertises application metadata along with our identity, as extra
+// key=value strings of our TXT record, e.g. room=xyz to group peers on the LAN.
+// Keys must not contain "=", and every pair must fit in 255 bytes. Peers
+// running versions without metadata support can't parse our records. The
+// metadata isn't encrypted in privacy mode.
+func Metadata(md map[string]string) MdnsOption {
+	return func(cfg *mdnsConfig) {
+		cfg.metadata = md
+	}
+}
+
+// MetadataFilter only reports peers whose metadata, see Metadata, the filter
+// returns true for. Peers advertising no metadata have an empty one.
+func MetadataFilter(filter func(md map[string]string) bool) MdnsOption {
+	return func(cfg *mdnsConfig) {
+		cfg.metadataFilter = filter
+	}
+}
+
+// BroadcastFallback makes NewMdnsService fall back to discovering peers with
+// UDP broadcasts, with the given options, if it fails to register our mDNS
+// service, e.g. on networks blocking multicast. See NewBroadcastService.
+func BroadcastFallback(opts ...BroadcastOption) MdnsOption {
+	return func(cfg *mdnsConfig) {
+		cfg.broadcast = append([]BroadcastOption{}, opts...)
+	}
+}
+
+// registrationError is returned by newMdnsService if it fails to register our
+// mDNS service.
+type registrationError struct {
+	err error
+}
+
+func (e *registrationError) Error() string {
+	return fmt.Sprintf("failed to register mdns service: %s", e.err)
+}
+
+func (e *registrationError) Unwrap() error { return e.err }
+
+// randomInstanceName returns a random mDNS instance name, unlinkable to our
+// peer ID. Peer IDs don't fit in instance names: DNS labels are at most 63
+// characters long, and some peer IDs are longer.
+func randomInstanceName() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// serviceName returns the name of the service we advertise and browse for the
+// given service tag and namespace.
+func serviceName(tag, namespace string) string {
+	if namespace == "" {
+		return tag
+	}
+	return "_" + strings.TrimPrefix(namespace, "_") + "." + tag
+}
+
 type mdnsService struct {
-	server  *mdns.Server
-	service *mdns.MDNSService
-	host    host.Host
-	tag     string
+	host   host.Host
+	tag    string
+	family addrfamily.Policy
+	// formats are the formats we advertise and browse, legacy only if zero,
+	// and specTag the service of the specification format, see FormatSpec.
+	formats MdnsFormat
+	specTag string
+	// metrics is nil unless set with MdnsMetrics.
+	metrics MdnsMetricsTracer
+	// instance is the name of the service instance we advertise, see
+	// randomInstanceName, and txt the metadata fields of our TXT record.
+	instance string
+	txt      []string
+	// metadataFilter filters the peers we report on their metadata, if set.
+	metadataFilter func(map[string]string) bool
+
+	serverLk sync.Mutex
+	// ifaces, port and ips are updated when our addresses change, see
+	// watchAddrs. ifaces is nil unless restricted to some interfaces.
+	ifaces *mdnsInterfaces
+	port   int
+	ips    []net.IP
+	// advertise is false if we only browse, see setAdvertise.
+	advertise bool
+	// servers has a server per interface we advertise on.
+	servers []*mdns.Server
+	service mdns.Zone
+	closed  bool
+
+	ifaceFilter   func(net.Interface) bool
+	skipLinkLocal bool
+	addrSub       event.Subscription
+	// nil if not created by NewMdnsService.
+	emitters *mdnsEmitters
+
+	// nil unless running in privacy mode.
+	privacy cipher.AEAD
 
 	lk       sync.Mutex
 	notifees []Notifee
 	interval time.Duration
+	// peers are the peers we found, see peerSeen and expirePeers, and
+	// foundNew whether we found new ones since the last query.
+	peers    map[peer.ID]*foundPeer
+	foundNew bool
+	// rediscovery is how often we notify about peers we keep finding, and
+	// maxInterval the interval we back off querying to.
+	rediscovery time.Duration
+	maxInterval time.Duration
 }
 
 func getDialableListenAddrs(ph host.Host) ([]*net.TCPAddr, error) {
@@ -69,85 +305,322 @@ func getDialableListenAddrs(ph host.Host) ([]*net.TCPAddr, error) {
 	return out, nil
 }
 
-func NewMdnsService(ctx context.Context, peerhost host.Host, interval time.Duration, serviceTag string) (Service, error) {
+func NewMdnsService(ctx context.Context, peerhost host.Host, interval time.Duration, serviceTag string, opts ...MdnsOption) (Service, error) {
+	s, err := newMdnsService(ctx, peerhost, interval, serviceTag, opts...)
+	var regErr *registrationError
+	if errors.As(err, &regErr) {
+		var cfg mdnsConfig
+		for _, opt := range opts {
+			opt(&cfg)
+		}
+		if cfg.broadcast != nil {
+			log.Warnw("falling back to broadcast discovery", "error", err)
+			bopts := append([]BroadcastOption{BroadcastTag(serviceName(tagOrDefault(serviceTag), cfg.namespace))}, cfg.broadcast...)
+			return NewBroadcastService(ctx, peerhost, interval, bopts...)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func tagOrDefault(tag string) string {
+	if tag == "" {
+		return ServiceTag
+	}
+	return tag
+}
 
-	var ipaddrs []net.IP
-	port := 4001
+func newMdnsService(ctx context.Context, peerhost host.Host, interval time.Duration, serviceTag string, opts ...MdnsOption) (*mdnsService, error) {
+	var cfg mdnsConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
 
-	addrs, err := getDialableListenAddrs(peerhost)
+	ifaces, err := selectInterfaces(cfg.ifaceFilter)
 	if err != nil {
-		log.Warn(err)
-	} else {
-		port = addrs[0].Port
-		for _, a := range addrs {
-			ipaddrs = append(ipaddrs, a.IP)
-		}
+		return nil, err
 	}
+	ipaddrs, port := advertisedAddrs(peerhost, ifaces, cfg.family, cfg.skipLinkLocal)
 
-	myid := peerhost.ID().Pretty()
+	serviceTag = serviceName(tagOrDefault(serviceTag), cfg.namespace)
 
-	info := []string{myid}
-	if serviceTag == "" {
-		serviceTag = ServiceTag
+	if cfg.formats == 0 {
+		cfg.formats = FormatLegacy
 	}
-	service, err := mdns.NewMDNSService(myid, serviceTag, "", "", port, ipaddrs, info)
+	if cfg.formats&^(FormatLegacy|FormatSpec) != 0 {
+		return nil, fmt.Errorf("unknown mdns formats: %d", cfg.formats)
+	}
+	if cfg.privacyKey != nil && cfg.formats&FormatSpec != 0 {
+		return nil, errors.New("privacy mode doesn't support the mdns specification format")
+	}
+
+	instance, err := randomInstanceName()
 	if err != nil {
 		return nil, err
 	}
-
-	// Create the mDNS server, defer shutdown
-	server, err := mdns.NewServer(&mdns.Config{Zone: service})
+	txt, err := metadataFields(cfg.metadata)
 	if err != nil {
 		return nil, err
 	}
 
 	s := &mdnsService{
-		server:   server,
-		service:  service,
 		host:     peerhost,
 		interval: interval,
 		tag:      serviceTag,
+		formats:  cfg.formats,
+		specTag:  serviceName(SpecServiceTag, cfg.namespace),
+		metrics:  cfg.metrics,
+		instance: instance,
+		port:     port,
+		ips:      ipaddrs,
+		family:   cfg.family,
+		ifaces:   ifaces,
+
+		ifaceFilter:   cfg.ifaceFilter,
+		skipLinkLocal: cfg.skipLinkLocal,
+		rediscovery:   cfg.rediscovery,
+		maxInterval:   cfg.maxInterval,
+
+		txt:            txt,
+		metadataFilter: cfg.metadataFilter,
+		advertise:      !cfg.browseOnly,
+	}
+
+	if cfg.privacyKey != nil {
+		if cfg.privacyRotation <= 0 {
+			return nil, errors.New("privacy mode rotation interval must be positive")
+		}
+		s.privacy, err = newPrivacyCipher(cfg.privacyKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s.emitters, err = newMdnsEmitters(peerhost)
+	if err != nil {
+		return nil, err
+	}
+
+	// subscribe before starting to advertise, so we don't miss changes.
+	s.addrSub, err = peerhost.EventBus().Subscribe(new(event.EvtLocalAddressesUpdated))
+	if err != nil {
+		s.emitters.Close()
+		return nil, err
+	}
+
+	if err := s.startServer(); err != nil {
+		s.addrSub.Close()
+		s.emitters.Close()
+		return nil, &registrationError{err}
+	}
+
+	if cfg.autoConnect != nil {
+		s.RegisterNotifee(newAutoConnector(ctx, peerhost, *cfg.autoConnect))
 	}
 
+	go s.watchAddrs(ctx)
 	go s.pollForEntries(ctx)
+	if s.privacy != nil {
+		go s.rotate(ctx, cfg.privacyRotation)
+	}
 
 	return s, nil
 }
 
+// startServer starts advertising our current identity, replacing the running
+// mDNS server if any.
+func (m *mdnsService) startServer() error {
+	m.serverLk.Lock()
+	defer m.serverLk.Unlock()
+	if m.closed {
+		return nil
+	}
+	if !m.advertise {
+		m.shutdownServers()
+		return nil
+	}
+
+	// our identity is entirely in the TXT record.
+	instance := m.instance
+	info := []string{m.host.ID().Pretty()}
+	if m.privacy != nil {
+		var err error
+		instance, err = randomInstanceName()
+		if err != nil {
+			return err
+		}
+		sealed, err := sealPeerID(m.privacy, m.host.ID())
+		if err != nil {
+			return err
+		}
+		info = []string{sealed}
+	}
+	info = append(info, m.txt...)
+
+	var service mdnsZones
+	if m.hasFormat(FormatLegacy) {
+		legacy, err := mdns.NewMDNSService(instance, m.tag, mdnsDomain+".", "", m.port, m.ips, info)
+		if err != nil {
+			return err
+		}
+		service = append(service, legacy)
+	}
+	if m.hasFormat(FormatSpec) {
+		// spec peers only read the dnsaddr strings, but the mdns package
+		// also needs SRV and A/AAAA records to report an entry.
+		txt := append(specFields(m.host.ID(), m.ips, m.port), m.txt...)
+		spec, err := mdns.NewMDNSService(instance, m.specTag, mdnsDomain+".", "", m.port, m.ips, txt)
+		if err != nil {
+			return err
+		}
+		service = append(service, spec)
+	}
+
+	m.shutdownServers()
+
+	// Create the mDNS servers, defer shutdown
+	for _, iface := range m.ifaces.list() {
+		server, err := mdns.NewServer(&mdns.Config{Zone: service, Iface: iface})
+		if err != nil {
+			m.shutdownServers()
+			return err
+		}
+		m.servers = append(m.servers, server)
+	}
+	m.service = service
+	return nil
+}
+
+// shutdownServers shuts down the running mDNS servers, returning the first
+// error. m.serverLk must be held.
+func (m *mdnsService) shutdownServers() error {
+	var firstErr error
+	for _, server := range m.servers {
+		if err := server.Shutdown(); err != nil {
+			log.Debugw("failed to shut down mdns server", "error", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	m.servers = nil
+	return firstErr
+}
+
+// setAdvertise starts or stops advertising our identity. We keep browsing
+// either way.
+func (m *mdnsService) setAdvertise(advertise bool) error {
+	m.serverLk.Lock()
+	changed := m.advertise != advertise
+	m.advertise = advertise
+	m.serverLk.Unlock()
+	if !changed {
+		return nil
+	}
+	return m.startServer()
+}
+
+// rotate periodically changes the identity we advertise in privacy mode.
+func (m *mdnsService) rotate(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := m.startServer(); err != nil {
+				log.Warnw("failed to rotate mdns identity", "error", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
 func (m *mdnsService) Close() error {
-	return m.server.Shutdown()
+	m.serverLk.Lock()
+	defer m.serverLk.Unlock()
+	m.closed = true
+	if m.addrSub != nil {
+		m.addrSub.Close()
+	}
+	m.emitters.Close()
+	return m.shutdownServers()
 }
 
 func (m *mdnsService) pollForEntries(ctx context.Context) {
-	ticker := time.NewTicker(m.interval)
-	defer ticker.Stop()
+	interval := m.interval
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
 
 	for {
 		//execute mdns query right away at method call and then with every tick
-		entriesCh := make(chan *mdns.ServiceEntry, 16)
+		entriesCh := make(chan foundEntry, 16)
+		handled := make(chan struct{})
 		go func() {
-			for entry := range entriesCh {
-				m.handleEntry(entry)
+			defer close(handled)
+			for found := range entriesCh {
+				m.handleEntry(found.entry, found.iface)
 			}
 		}()
 
 		log.Debug("starting mdns query")
-		qp := &mdns.QueryParam{
-			Domain:  "local",
-			Entries: entriesCh,
-			Service: m.tag,
-			Timeout: time.Second * 5,
-		}
-
-		err := mdns.Query(qp)
-		if err != nil {
-			log.Warnw("mdns lookup error", "error", err)
+		var wg sync.WaitGroup
+		m.serverLk.Lock()
+		ifaces := m.ifaces.list()
+		m.serverLk.Unlock()
+		for _, iface := range ifaces {
+			wg.Add(1)
+			go func(iface *net.Interface) {
+				defer wg.Done()
+				// tag the entries with the interface we received them
+				// on, the zone of their link-local addresses.
+				ch := make(chan *mdns.ServiceEntry, 16)
+				forwarded := make(chan struct{})
+				go func() {
+					defer close(forwarded)
+					for entry := range ch {
+						entriesCh <- foundEntry{entry: entry, iface: iface}
+					}
+				}()
+				for _, service := range m.services() {
+					qp := &mdns.QueryParam{
+						Domain:    mdnsDomain,
+						Entries:   ch,
+						Service:   service,
+						Timeout:   mdnsQueryTimeout,
+						Interface: iface,
+					}
+
+					err := mdns.Query(qp)
+					if err != nil {
+						log.Warnw("mdns lookup error", "service", service, "error", err)
+					}
+				}
+				close(ch)
+				<-forwarded
+			}(iface)
 		}
+		wg.Wait()
 		close(entriesCh)
+		<-handled
 		log.Debug("mdns query complete")
-
+		m.expirePeers(time.Now())
+		m.reportKnownPeers()
+
+		// the timer fired if the query took longer than the interval.
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		interval = m.nextQueryInterval(interval)
+		timer.Reset(interval)
 		select {
-		case <-ticker.C:
+		case <-timer.C:
 			continue
 		case <-ctx.Done():
 			log.Debug("mdns service halting")
@@ -156,35 +629,98 @@ func (m *mdnsService) pollForEntries(ctx context.Context) {
 	}
 }
 
-func (m *mdnsService) handleEntry(e *mdns.ServiceEntry) {
+// foundEntry is an entry received on the given interface, nil if unknown.
+type foundEntry struct {
+	entry *mdns.ServiceEntry
+	iface *net.Interface
+}
+
+// handleEntry notifies about the peer of an entry received on the given
+// interface, nil if unknown.
+func (m *mdnsService) handleEntry(e *mdns.ServiceEntry, iface *net.Interface) {
 	log.Debugf("Handling MDNS entry: [IPv4 %s][IPv6 %s]:%d %s", e.AddrV4, e.AddrV6, e.Port, e.Info)
-	mpeer, err := peer.Decode(e.Info)
-	if err != nil {
-		log.Warn("Error parsing peer ID from mdns entry: ", err)
+	var format MdnsFormat
+	switch {
+	case m.hasFormat(FormatLegacy) && inService(e, m.tag):
+		format = FormatLegacy
+	case m.hasFormat(FormatSpec) && inService(e, m.specTag):
+		format = FormatSpec
+	default:
+		// the resolver passes on every response it hears on the LAN, not
+		// only the ones to our query.
+		log.Debugf("ignoring mdns entry of another service: %s", e.Name)
 		return
 	}
 
+	var (
+		mpeer     peer.ID
+		md        map[string]string
+		specAddrs []ma.Multiaddr
+		err       error
+	)
+	if format == FormatSpec {
+		mpeer, specAddrs, md, err = specEntryFields(e)
+		if err != nil {
+			log.Debugw("Error parsing peer from mdns entry", "entry", e.Name, "error", err)
+			return
+		}
+	} else {
+		var identity string
+		identity, md = entryFields(e)
+		mpeer, err = m.entryPeerID(identity)
+		if err != nil {
+			if m.privacy != nil {
+				// most likely the entry of a peer we don't share a key with.
+				log.Debug("Error opening peer ID from mdns entry: ", err)
+			} else {
+				log.Warn("Error parsing peer ID from mdns entry: ", err)
+			}
+			return
+		}
+	}
+
 	if mpeer == m.host.ID() {
 		log.Debug("got our own mdns entry, skipping")
 		return
 	}
 
-	var addr net.IP
-	if e.AddrV4 != nil {
-		addr = e.AddrV4
-	} else if e.AddrV6 != nil {
-		addr = e.AddrV6
-	} else {
-		log.Warn("Error parsing multiaddr from mdns entry: no IP address found")
+	if m.metadataFilter != nil && !m.metadataFilter(md) {
+		log.Debugw("mdns entry filtered out on its metadata", "peer", mpeer, "metadata", md)
 		return
 	}
 
-	maddr, err := manet.FromNetAddr(&net.TCPAddr{
-		IP:   addr,
-		Port: e.Port,
-	})
-	if err != nil {
-		log.Warn("Error parsing multiaddr from mdns entry: ", err)
+	var ips []net.IP
+	if e.AddrV4 != nil {
+		ips = append(ips, e.AddrV4)
+	}
+	if e.AddrV6 != nil {
+		ips = append(ips, e.AddrV6)
+	}
+	m.serverLk.Lock()
+	ifaces := m.ifaces
+	m.serverLk.Unlock()
+	ips = m.family.FilterIPs(ifaces.reachableIPs(ips))
+
+	// take the first address we can dial, link-local IPv6 addresses being
+	// only dialable with the zone of the interface we received them on.
+	var maddr ma.Multiaddr
+	for _, ip := range ips {
+		addr := &net.TCPAddr{IP: ip, Port: e.Port}
+		if ip.To4() == nil && ip.IsLinkLocalUnicast() {
+			if addr.Zone = linkLocalZone(iface); addr.Zone == "" {
+				log.Debugw("skipping link-local address of unknown zone from mdns entry", "addr", ip)
+				continue
+			}
+		}
+		maddr, err = manet.FromNetAddr(addr)
+		if err != nil {
+			log.Warn("Error parsing multiaddr from mdns entry: ", err)
+			return
+		}
+		break
+	}
+	if maddr == nil {
+		log.Warn("Error parsing multiaddr from mdns entry: no usable IP address found")
 		return
 	}
 
@@ -192,12 +728,93 @@ func (m *mdnsService) handleEntry(e *mdns.ServiceEntry) {
 		ID:    mpeer,
 		Addrs: []ma.Multiaddr{maddr},
 	}
+	// the address of the SRV and A/AAAA records comes first, so that peers
+	// advertising both formats are reported once, see peerSeen.
+	for _, a := range m.family.Filter(specAddrs) {
+		if !a.Equal(maddr) {
+			pi.Addrs = append(pi.Addrs, a)
+		}
+	}
 
+	now := time.Now()
 	m.lk.Lock()
+	notify := m.peerSeen(pi, now)
+	m.peers[pi.ID].seenAs(format, now)
+	if !notify {
+		m.lk.Unlock()
+		log.Debugw("already notified about mdns peer", "peer", pi.ID)
+		return
+	}
 	for _, n := range m.notifees {
 		go n.HandlePeerFound(pi)
 	}
 	m.lk.Unlock()
+	if m.metrics != nil {
+		m.metrics.PeerFound(format)
+	}
+	m.emitters.peerDiscovered(pi, md, format)
+}
+
+// hasFormat returns true if we advertise and browse the format.
+func (m *mdnsService) hasFormat(f MdnsFormat) bool {
+	if m.formats == 0 {
+		return f == FormatLegacy
+	}
+	return m.formats&f != 0
+}
+
+// services returns the services we browse.
+func (m *mdnsService) services() []string {
+	var services []string
+	if m.hasFormat(FormatLegacy) {
+		services = append(services, m.tag)
+	}
+	if m.hasFormat(FormatSpec) {
+		services = append(services, m.specTag)
+	}
+	return services
+}
+
+// nextQueryInterval returns how long to wait before querying again, given
+// the last interval: the query interval, doubled after every query that found
+// nothing new up to the maximum interval, see QueryBackoff.
+func (m *mdnsService) nextQueryInterval(last time.Duration) time.Duration {
+	m.lk.Lock()
+	changed := m.foundNew
+	m.foundNew = false
+	m.lk.Unlock()
+
+	if changed || m.maxInterval <= m.interval {
+		return m.interval
+	}
+	next := 2 * last
+	if next > m.maxInterval {
+		next = m.maxInterval
+	}
+	return next
+}
+
+// inService returns true if the entry is an instance of the given service,
+// i.e. of a service tag and namespace we browse. Instances of namespaced
+// services end with our service tag too, but their instance name is followed
+// by the namespace.
+func inService(e *mdns.ServiceEntry, tag string) bool {
+	suffix := strings.ToLower("." + strings.Trim(tag, ".") + "." + mdnsDomain + ".")
+	name := strings.ToLower(e.Name)
+	if !strings.HasSuffix(name, suffix) {
+		return false
+	}
+	instance := strings.TrimSuffix(name, suffix)
+	return instance != "" && !strings.Contains(instance, ".")
+}
+
+// entryPeerID returns the ID of the peer advertised by an entry, given the
+// TXT record string carrying its identity, see entryFields.
+func (m *mdnsService) entryPeerID(identity string) (peer.ID, error) {
+	if m.privacy != nil {
+		return openPeerID(m.privacy, identity)
+	}
+	return peer.Decode(identity)
 }
 
 func (m *mdnsService) RegisterNotifee(n Notifee) {
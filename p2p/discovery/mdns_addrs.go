@@ -0,0 +1,100 @@
+package discovery
+
+import (
+	"context"
+	"net"
+
+	"github.com/libp2p/go-libp2p-core/host"
+
+	"github.com/libp2p/go-libp2p/p2p/net/addrfamily"
+)
+
+// advertisedAddrs returns the IPs and the port we advertise: our dialable
+// listen addresses on the given interfaces, allowed by the address family
+// policy, and not link-local if skipped.
+func advertisedAddrs(h host.Host, ifaces *mdnsInterfaces, family addrfamily.Policy, skipLinkLocal bool) ([]net.IP, int) {
+	var ipaddrs []net.IP
+	port := 4001
+
+	addrs, err := getDialableListenAddrs(h)
+	if err != nil {
+		log.Warn(err)
+		return nil, port
+	}
+	for _, a := range addrs {
+		if skipLinkLocal && a.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		ipaddrs = append(ipaddrs, a.IP)
+	}
+	onIfaces := ifaces.ownIPs(ipaddrs)
+	ipaddrs = family.FilterIPs(onIfaces)
+	port = addrs[0].Port
+	switch {
+	case len(onIfaces) == 0:
+		log.Warn("no listen address on the selected network interfaces")
+	case len(ipaddrs) == 0:
+		log.Warnf("no listen address allowed by the %s address family policy", family)
+	default:
+		// advertise the port of the first address we advertise.
+		for _, a := range addrs {
+			if a.IP.Equal(ipaddrs[0]) {
+				port = a.Port
+				break
+			}
+		}
+	}
+	return ipaddrs, port
+}
+
+// watchAddrs re-registers our service with fresh records whenever our listen
+// addresses change, e.g. on DHCP renewal or when an interface comes up.
+func (m *mdnsService) watchAddrs(ctx context.Context) {
+	for {
+		select {
+		case _, ok := <-m.addrSub.Out():
+			if !ok {
+				return
+			}
+			if m.updateAddrs() {
+				log.Debug("listen addresses changed, restarting mdns server")
+				if err := m.startServer(); err != nil {
+					log.Warnw("failed to restart mdns server", "error", err)
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// updateAddrs updates the interfaces we run on, and the addresses we
+// advertise, returning true if they changed.
+func (m *mdnsService) updateAddrs() bool {
+	ifaces, err := selectInterfaces(m.ifaceFilter)
+	if err != nil {
+		log.Warnw("failed to select mdns network interfaces", "error", err)
+		return false
+	}
+	ips, port := advertisedAddrs(m.host, ifaces, m.family, m.skipLinkLocal)
+
+	m.serverLk.Lock()
+	defer m.serverLk.Unlock()
+	if port == m.port && sameIPs(ips, m.ips) && ifaces.equal(m.ifaces) {
+		return false
+	}
+	m.ifaces, m.ips, m.port = ifaces, ips, port
+	return true
+}
+
+func sameIPs(a, b []net.IP) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,61 @@
+package discovery
+
+import (
+	"net"
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+
+	"github.com/libp2p/go-libp2p/p2p/net/addrfamily"
+
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+// addrsHost is a host listening on the given addresses.
+type addrsHost struct {
+	host.Host
+	addrs []ma.Multiaddr
+}
+
+func (h *addrsHost) Network() network.Network { return addrsNetwork{h: h} }
+
+type addrsNetwork struct {
+	network.Network
+	h *addrsHost
+}
+
+func (n addrsNetwork) InterfaceListenAddresses() ([]ma.Multiaddr, error) { return n.h.addrs, nil }
+
+func TestUpdateAddrs(t *testing.T) {
+	h := &addrsHost{addrs: []ma.Multiaddr{ma.StringCast("/ip4/192.168.1.2/tcp/4001")}}
+	m := &mdnsService{host: h}
+
+	require.True(t, m.updateAddrs())
+	require.Equal(t, 4001, m.port)
+	require.Len(t, m.ips, 1)
+	require.True(t, m.ips[0].Equal(net.IPv4(192, 168, 1, 2)))
+	require.False(t, m.updateAddrs())
+
+	// renewed DHCP lease.
+	h.addrs = []ma.Multiaddr{ma.StringCast("/ip4/192.168.1.3/tcp/4001")}
+	require.True(t, m.updateAddrs())
+	require.True(t, m.ips[0].Equal(net.IPv4(192, 168, 1, 3)))
+
+	h.addrs = []ma.Multiaddr{ma.StringCast("/ip4/192.168.1.3/tcp/4002")}
+	require.True(t, m.updateAddrs())
+	require.Equal(t, 4002, m.port)
+}
+
+func TestSkipLinkLocal(t *testing.T) {
+	h := &addrsHost{addrs: []ma.Multiaddr{
+		ma.StringCast("/ip6/fe80::1/tcp/4001"),
+		ma.StringCast("/ip6/2001:db8::1/tcp/4001"),
+	}}
+	ips, _ := advertisedAddrs(h, nil, addrfamily.Any, false)
+	require.Len(t, ips, 2)
+	ips, _ = advertisedAddrs(h, nil, addrfamily.Any, true)
+	require.Len(t, ips, 1)
+	require.True(t, ips[0].Equal(net.ParseIP("2001:db8::1")))
+}
@@ -0,0 +1,128 @@
+package discovery
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// DefaultAutoConnectTimeout is the default timeout of the dials of
+// AutoConnect.
+const DefaultAutoConnectTimeout = 10 * time.Second
+
+// AutoConnectPolicy restricts which peers AutoConnect dials. Zero fields
+// don't restrict.
+type AutoConnectPolicy struct {
+	// MaxPeers stops dialing discovered peers once we're connected to that
+	// many peers.
+	MaxPeers int
+	// AllowPeers only dials these peers, if not empty.
+	AllowPeers []peer.ID
+	// AddrFilter only dials the addresses it returns true for, and skips
+	// peers without any.
+	AddrFilter func(ma.Multiaddr) bool
+	// DialTimeout bounds each dial. Defaults to DefaultAutoConnectTimeout.
+	DialTimeout time.Duration
+}
+
+// AutoConnect dials the peers we discover that the policy allows, unless
+// we're already connected to them, sparing embedders a Notifee doing just
+// that.
+func AutoConnect(policy AutoConnectPolicy) MdnsOption {
+	return func(cfg *mdnsConfig) {
+		cfg.autoConnect = &policy
+	}
+}
+
+// autoConnector is the Notifee dialing discovered peers, see AutoConnect.
+type autoConnector struct {
+	ctx    context.Context
+	host   host.Host
+	policy AutoConnectPolicy
+	allow  map[peer.ID]struct{}
+
+	mu sync.Mutex
+	// dialing are the peers we're dialing.
+	dialing map[peer.ID]struct{}
+}
+
+func newAutoConnector(ctx context.Context, h host.Host, policy AutoConnectPolicy) *autoConnector {
+	if policy.DialTimeout <= 0 {
+		policy.DialTimeout = DefaultAutoConnectTimeout
+	}
+	ac := &autoConnector{
+		ctx:     ctx,
+		host:    h,
+		policy:  policy,
+		dialing: make(map[peer.ID]struct{}),
+	}
+	if len(policy.AllowPeers) > 0 {
+		ac.allow = make(map[peer.ID]struct{}, len(policy.AllowPeers))
+		for _, p := range policy.AllowPeers {
+			ac.allow[p] = struct{}{}
+		}
+	}
+	return ac
+}
+
+func (ac *autoConnector) HandlePeerFound(pi peer.AddrInfo) {
+	pi, ok := ac.filter(pi)
+	if !ok {
+		return
+	}
+
+	ac.mu.Lock()
+	if _, ok := ac.dialing[pi.ID]; ok {
+		ac.mu.Unlock()
+		return
+	}
+	ac.dialing[pi.ID] = struct{}{}
+	ac.mu.Unlock()
+	defer func() {
+		ac.mu.Lock()
+		delete(ac.dialing, pi.ID)
+		ac.mu.Unlock()
+	}()
+
+	ctx, cancel := context.WithTimeout(ac.ctx, ac.policy.DialTimeout)
+	defer cancel()
+	if err := ac.host.Connect(ctx, pi); err != nil {
+		log.Debugw("failed to connect to discovered peer", "peer", pi.ID, "error", err)
+	}
+}
+
+// filter returns the peer with the addresses we may dial, and false if we
+// shouldn't dial it.
+func (ac *autoConnector) filter(pi peer.AddrInfo) (peer.AddrInfo, bool) {
+	if ac.allow != nil {
+		if _, ok := ac.allow[pi.ID]; !ok {
+			return pi, false
+		}
+	}
+	if ac.host.Network().Connectedness(pi.ID) == network.Connected {
+		return pi, false
+	}
+	if ac.policy.MaxPeers > 0 && len(ac.host.Network().Peers()) >= ac.policy.MaxPeers {
+		log.Debugw("not connecting to discovered peer, too many peers", "peer", pi.ID)
+		return pi, false
+	}
+	if ac.policy.AddrFilter != nil {
+		addrs := make([]ma.Multiaddr, 0, len(pi.Addrs))
+		for _, a := range pi.Addrs {
+			if ac.policy.AddrFilter(a) {
+				addrs = append(addrs, a)
+			}
+		}
+		if len(addrs) == 0 {
+			return pi, false
+		}
+		pi.Addrs = addrs
+	}
+	return pi, true
+}
@@ -0,0 +1,52 @@
+package discovery
+
+import (
+	"context"
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAutoConnect(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn, err := mocknet.FullMeshLinked(ctx, 4)
+	require.NoError(t, err)
+	hosts := mn.Hosts()
+	h := hosts[0]
+	info := func(i int) peer.AddrInfo {
+		return peer.AddrInfo{ID: hosts[i].ID(), Addrs: hosts[i].Addrs()}
+	}
+
+	ac := newAutoConnector(ctx, h, AutoConnectPolicy{
+		MaxPeers:   2,
+		AllowPeers: []peer.ID{hosts[1].ID(), hosts[2].ID(), hosts[3].ID()},
+		AddrFilter: func(ma.Multiaddr) bool { return true },
+	})
+	ac.HandlePeerFound(info(1))
+	require.Equal(t, network.Connected, h.Network().Connectedness(hosts[1].ID()))
+
+	// not allowed.
+	ac = newAutoConnector(ctx, h, AutoConnectPolicy{AllowPeers: []peer.ID{hosts[1].ID()}})
+	ac.HandlePeerFound(info(2))
+	require.NotEqual(t, network.Connected, h.Network().Connectedness(hosts[2].ID()))
+
+	// no address left.
+	ac = newAutoConnector(ctx, h, AutoConnectPolicy{AddrFilter: func(ma.Multiaddr) bool { return false }})
+	ac.HandlePeerFound(info(2))
+	require.NotEqual(t, network.Connected, h.Network().Connectedness(hosts[2].ID()))
+
+	ac = newAutoConnector(ctx, h, AutoConnectPolicy{MaxPeers: 2})
+	ac.HandlePeerFound(info(2))
+	require.Equal(t, network.Connected, h.Network().Connectedness(hosts[2].ID()))
+	// too many peers.
+	ac.HandlePeerFound(info(3))
+	require.NotEqual(t, network.Connected, h.Network().Connectedness(hosts[3].ID()))
+}
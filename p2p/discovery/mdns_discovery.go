@@ -0,0 +1,269 @@
+package discovery
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	coredisc "github.com/libp2p/go-libp2p-core/discovery"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// DefaultMdnsAdvertiseTTL is how long MdnsDiscovery advertises a namespace if
+// Advertise isn't given a TTL.
+const DefaultMdnsAdvertiseTTL = time.Hour
+
+// maxNamespaceLabel is the maximum length of a namespace used as is in our
+// service name, see namespaceLabel.
+const maxNamespaceLabel = 62
+
+var errMdnsDiscoveryClosed = errors.New("mdns discovery closed")
+
+// MdnsDiscovery implements the discovery.Discovery interface over mDNS, so that
+// it can be used interchangeably with other discovery mechanisms, e.g. the
+// DHT. Every namespace is a separate mDNS service, see Namespace, advertised
+// while Advertise's TTL lasts, and browsed while advertised or while peers
+// are being found.
+type MdnsDiscovery struct {
+	ctx      context.Context
+	cancel   context.CancelFunc
+	host     host.Host
+	interval time.Duration
+	opts     []MdnsOption
+
+	mu       sync.Mutex
+	closed   bool
+	services map[string]*nsService
+}
+
+var _ coredisc.Discovery = (*MdnsDiscovery)(nil)
+
+// nsService is the mDNS service of a namespace.
+type nsService struct {
+	svc    *mdnsService
+	cancel context.CancelFunc
+	// advertised is when the advertisement of the namespace expires, and
+	// expiry the timer stopping it then.
+	advertised time.Time
+	expiry     *time.Timer
+	// finders is the number of running FindPeers of the namespace.
+	finders int
+}
+
+// NewMdnsDiscovery returns a discovery.Discovery over mDNS, querying every
+// interval for the peers of each namespace. The options apply to the mDNS
+// services of all namespaces.
+func NewMdnsDiscovery(ctx context.Context, h host.Host, interval time.Duration, opts ...MdnsOption) *MdnsDiscovery {
+	ctx, cancel := context.WithCancel(ctx)
+	return &MdnsDiscovery{
+		ctx:      ctx,
+		cancel:   cancel,
+		host:     h,
+		interval: interval,
+		opts:     opts,
+		services: make(map[string]*nsService),
+	}
+}
+
+// Advertise advertises the namespace on the LAN for the TTL given by the
+// discovery.TTL option, DefaultMdnsAdvertiseTTL by default. Advertising again
+// extends the advertisement.
+func (d *MdnsDiscovery) Advertise(_ context.Context, ns string, opts ...coredisc.Option) (time.Duration, error) {
+	var options coredisc.Options
+	if err := options.Apply(opts...); err != nil {
+		return 0, err
+	}
+	ttl := options.Ttl
+	if ttl <= 0 {
+		ttl = DefaultMdnsAdvertiseTTL
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s, err := d.service(ns)
+	if err != nil {
+		return 0, err
+	}
+	if err := s.svc.setAdvertise(true); err != nil {
+		d.gc(ns)
+		return 0, err
+	}
+	s.advertised = time.Now().Add(ttl)
+	if s.expiry != nil {
+		s.expiry.Stop()
+	}
+	s.expiry = time.AfterFunc(ttl, func() { d.expire(ns) })
+	return ttl, nil
+}
+
+// FindPeers returns the peers of the namespace on the LAN: the ones we
+// already know, then the ones we find until the context is done, or until we
+// found as many as given by the discovery.Limit option.
+func (d *MdnsDiscovery) FindPeers(ctx context.Context, ns string, opts ...coredisc.Option) (<-chan peer.AddrInfo, error) {
+	var options coredisc.Options
+	if err := options.Apply(opts...); err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	s, err := d.service(ns)
+	if err != nil {
+		d.mu.Unlock()
+		return nil, err
+	}
+	s.finders++
+	d.mu.Unlock()
+
+	// register before listing the known peers, so we don't miss any.
+	found := &finder{found: make(chan peer.AddrInfo), done: make(chan struct{})}
+	s.svc.RegisterNotifee(found)
+	known := s.svc.knownPeers()
+
+	out := make(chan peer.AddrInfo)
+	go func() {
+		defer close(out)
+		defer func() {
+			close(found.done)
+			s.svc.UnregisterNotifee(found)
+			d.mu.Lock()
+			s.finders--
+			d.gc(ns)
+			d.mu.Unlock()
+		}()
+
+		sent := make(map[peer.ID]struct{})
+		send := func(pi peer.AddrInfo) bool {
+			if _, ok := sent[pi.ID]; ok {
+				return true
+			}
+			select {
+			case out <- pi:
+			case <-ctx.Done():
+				return false
+			}
+			sent[pi.ID] = struct{}{}
+			return options.Limit <= 0 || len(sent) < options.Limit
+		}
+		for _, pi := range known {
+			if !send(pi) {
+				return
+			}
+		}
+		for {
+			select {
+			case pi := <-found.found:
+				if !send(pi) {
+					return
+				}
+			case <-ctx.Done():
+				return
+			case <-d.ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+// finder forwards the peers found to a running FindPeers, until it's done.
+type finder struct {
+	found chan peer.AddrInfo
+	done  chan struct{}
+}
+
+func (f *finder) HandlePeerFound(pi peer.AddrInfo) {
+	select {
+	case f.found <- pi:
+	case <-f.done:
+	}
+}
+
+// Close stops advertising and browsing all namespaces.
+func (d *MdnsDiscovery) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.closed = true
+	d.cancel()
+	for ns, s := range d.services {
+		d.closeService(ns, s)
+	}
+	return nil
+}
+
+// service returns the service of the namespace, starting it browsing only
+// if needed. d.mu must be held.
+func (d *MdnsDiscovery) service(ns string) (*nsService, error) {
+	if d.closed {
+		return nil, errMdnsDiscoveryClosed
+	}
+	if s, ok := d.services[ns]; ok {
+		return s, nil
+	}
+	ctx, cancel := context.WithCancel(d.ctx)
+	opts := append(append([]MdnsOption{}, d.opts...), Namespace(namespaceLabel(ns)), browseOnly())
+	svc, err := newMdnsService(ctx, d.host, d.interval, "", opts...)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	s := &nsService{svc: svc, cancel: cancel}
+	d.services[ns] = s
+	return s, nil
+}
+
+// expire stops advertising the namespace if its advertisement expired.
+func (d *MdnsDiscovery) expire(ns string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s, ok := d.services[ns]
+	if !ok || time.Now().Before(s.advertised) {
+		return
+	}
+	s.advertised = time.Time{}
+	if err := s.svc.setAdvertise(false); err != nil {
+		log.Debugw("failed to stop advertising mdns namespace", "namespace", ns, "error", err)
+	}
+	d.gc(ns)
+}
+
+// gc stops the service of the namespace if it's neither advertised nor
+// browsed anymore. d.mu must be held.
+func (d *MdnsDiscovery) gc(ns string) {
+	s, ok := d.services[ns]
+	if !ok || s.finders > 0 || !s.advertised.IsZero() {
+		return
+	}
+	d.closeService(ns, s)
+}
+
+// closeService stops the service of the namespace. d.mu must be held.
+func (d *MdnsDiscovery) closeService(ns string, s *nsService) {
+	if s.expiry != nil {
+		s.expiry.Stop()
+	}
+	if err := s.svc.Close(); err != nil {
+		log.Debugw("failed to close mdns service", "namespace", ns, "error", err)
+	}
+	s.cancel()
+	delete(d.services, ns)
+}
+
+// namespaceLabel returns the namespace to use in our service name, see
+// Namespace: the namespace itself if it's a valid DNS label, a hash of it
+// otherwise.
+func namespaceLabel(ns string) string {
+	valid := ns != "" && len(ns) <= maxNamespaceLabel
+	for i := 0; valid && i < len(ns); i++ {
+		c := ns[i]
+		valid = c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-'
+	}
+	if valid {
+		return ns
+	}
+	h := sha256.Sum256([]byte(ns))
+	return hex.EncodeToString(h[:16])
+}
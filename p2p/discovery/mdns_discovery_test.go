@@ -0,0 +1,119 @@
+package discovery
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	coredisc "github.com/libp2p/go-libp2p-core/discovery"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/test"
+
+	blhost "github.com/libp2p/go-libp2p-blankhost"
+	swarmt "github.com/libp2p/go-libp2p-swarm/testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/whyrusleeping/mdns"
+)
+
+func TestNamespaceLabel(t *testing.T) {
+	require.Equal(t, "my-app", namespaceLabel("my-app"))
+	for _, ns := range []string{"", "/my/app", "my_app", strings.Repeat("x", maxNamespaceLabel+1)} {
+		label := namespaceLabel(ns)
+		require.Len(t, label, 32, ns)
+		require.Equal(t, label, namespaceLabel(ns))
+	}
+	require.NotEqual(t, namespaceLabel("/a"), namespaceLabel("/b"))
+}
+
+func TestMdnsDiscoveryFindPeers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	defer h.Close()
+
+	d := NewMdnsDiscovery(ctx, h, time.Second)
+	defer d.Close()
+	svc := &mdnsService{host: h, tag: ServiceTag, interval: time.Second}
+	d.services["ns"] = &nsService{svc: svc, cancel: func() {}}
+
+	entry := func() (peer.ID, *mdns.ServiceEntry) {
+		id, err := test.RandPeerID()
+		require.NoError(t, err)
+		return id, &mdns.ServiceEntry{Name: testEntryName, Info: id.Pretty(), AddrV4: net.IPv4(192, 168, 1, 2), Port: 4001}
+	}
+	known, e := entry()
+	svc.handleEntry(e, nil)
+
+	peers, err := d.FindPeers(ctx, "ns", coredisc.Limit(2))
+	require.NoError(t, err)
+	select {
+	case pi := <-peers:
+		require.Equal(t, known, pi.ID)
+	case <-time.After(time.Second):
+		t.Fatal("expected the known peer")
+	}
+
+	found, e := entry()
+	svc.handleEntry(e, nil)
+	select {
+	case pi := <-peers:
+		require.Equal(t, found, pi.ID)
+	case <-time.After(time.Second):
+		t.Fatal("expected the found peer")
+	}
+
+	// the limit is reached.
+	select {
+	case _, ok := <-peers:
+		require.False(t, ok)
+	case <-time.After(time.Second):
+		t.Fatal("expected FindPeers to end")
+	}
+	require.Eventually(t, func() bool {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return len(d.services) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestMdnsDiscoveryAdvertiseTTL(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	defer h.Close()
+
+	d := NewMdnsDiscovery(ctx, h, time.Second)
+	defer d.Close()
+	// closed, so that we don't actually start servers.
+	svc := &mdnsService{host: h, tag: ServiceTag, interval: time.Second, closed: true}
+	d.services["ns"] = &nsService{svc: svc, cancel: func() {}}
+
+	ttl, err := d.Advertise(ctx, "ns")
+	require.NoError(t, err)
+	require.Equal(t, DefaultMdnsAdvertiseTTL, ttl)
+
+	ttl, err = d.Advertise(ctx, "ns", coredisc.TTL(50*time.Millisecond))
+	require.NoError(t, err)
+	require.Equal(t, 50*time.Millisecond, ttl)
+	svc.serverLk.Lock()
+	require.True(t, svc.advertise)
+	svc.serverLk.Unlock()
+
+	require.Eventually(t, func() bool {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return len(d.services) == 0
+	}, time.Second, 10*time.Millisecond)
+	svc.serverLk.Lock()
+	require.False(t, svc.advertise)
+	svc.serverLk.Unlock()
+
+	require.NoError(t, d.Close())
+	_, err = d.Advertise(ctx, "ns")
+	require.Equal(t, errMdnsDiscoveryClosed, err)
+}
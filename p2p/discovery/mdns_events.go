@@ -0,0 +1,72 @@
+package discovery
+
+import (
+	"github.com/libp2p/go-libp2p-core/event"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// EvtPeerDiscovered is emitted on the host's event bus whenever mDNS finds a
+// peer, along with notifying the Notifees.
+type EvtPeerDiscovered struct {
+	// Peer is the peer found, with the address it advertised, and Metadata
+	// the application metadata it advertised, see Metadata.
+	Peer     peer.AddrInfo
+	Metadata map[string]string
+	// Format is the format of the entry we found the peer in.
+	Format MdnsFormat
+}
+
+// EvtPeerLost is emitted on the host's event bus when a peer found over mDNS
+// disappeared, along with notifying the LostNotifees.
+type EvtPeerLost struct {
+	Peer peer.ID
+}
+
+type mdnsEmitters struct {
+	evtPeerDiscovered event.Emitter
+	evtPeerLost       event.Emitter
+}
+
+// newMdnsEmitters creates the emitters of our events on the host's event bus.
+func newMdnsEmitters(h host.Host) (*mdnsEmitters, error) {
+	discovered, err := h.EventBus().Emitter(new(EvtPeerDiscovered))
+	if err != nil {
+		return nil, err
+	}
+	lost, err := h.EventBus().Emitter(new(EvtPeerLost))
+	if err != nil {
+		discovered.Close()
+		return nil, err
+	}
+	return &mdnsEmitters{evtPeerDiscovered: discovered, evtPeerLost: lost}, nil
+}
+
+// peerDiscovered emits an EvtPeerDiscovered. It does nothing on a nil
+// *mdnsEmitters.
+func (e *mdnsEmitters) peerDiscovered(pi peer.AddrInfo, md map[string]string, format MdnsFormat) {
+	if e == nil {
+		return
+	}
+	if err := e.evtPeerDiscovered.Emit(EvtPeerDiscovered{Peer: pi, Metadata: md, Format: format}); err != nil {
+		log.Debugw("failed to emit peer discovered event", "peer", pi.ID, "error", err)
+	}
+}
+
+// peerLost emits an EvtPeerLost. It does nothing on a nil *mdnsEmitters.
+func (e *mdnsEmitters) peerLost(p peer.ID) {
+	if e == nil {
+		return
+	}
+	if err := e.evtPeerLost.Emit(EvtPeerLost{Peer: p}); err != nil {
+		log.Debugw("failed to emit peer lost event", "peer", p, "error", err)
+	}
+}
+
+func (e *mdnsEmitters) Close() {
+	if e == nil {
+		return
+	}
+	e.evtPeerDiscovered.Close()
+	e.evtPeerLost.Close()
+}
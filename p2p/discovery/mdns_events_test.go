@@ -0,0 +1,54 @@
+package discovery
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/test"
+
+	blhost "github.com/libp2p/go-libp2p-blankhost"
+	swarmt "github.com/libp2p/go-libp2p-swarm/testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/whyrusleeping/mdns"
+)
+
+func TestDiscoveryEvents(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	defer h.Close()
+
+	sub, err := h.EventBus().Subscribe([]interface{}{new(EvtPeerDiscovered), new(EvtPeerLost)})
+	require.NoError(t, err)
+	defer sub.Close()
+
+	emitters, err := newMdnsEmitters(h)
+	require.NoError(t, err)
+	m := &mdnsService{host: h, tag: ServiceTag, interval: time.Second, emitters: emitters}
+	defer m.Close()
+
+	id, err := test.RandPeerID()
+	require.NoError(t, err)
+	start := time.Now()
+	m.handleEntry(&mdns.ServiceEntry{Name: testEntryName, Info: id.Pretty(), AddrV4: net.IPv4(192, 168, 1, 2), Port: 4001}, nil)
+	select {
+	case evt := <-sub.Out():
+		discovered := evt.(EvtPeerDiscovered)
+		require.Equal(t, id, discovered.Peer.ID)
+		require.Equal(t, []string{"/ip4/192.168.1.2/tcp/4001"}, addrStrings(discovered.Peer.Addrs))
+	case <-time.After(time.Second):
+		t.Fatal("expected a peer discovered event")
+	}
+
+	m.expirePeers(start.Add(2 * m.peerTTL()))
+	select {
+	case evt := <-sub.Out():
+		require.Equal(t, EvtPeerLost{Peer: id}, evt)
+	case <-time.After(time.Second):
+		t.Fatal("expected a peer lost event")
+	}
+}
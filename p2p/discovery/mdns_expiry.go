@@ -0,0 +1,151 @@
+package discovery
+
+import (
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// mdnsRecordTTL is the TTL of the records of the services we find, the
+// default of the mdns package, which doesn't report the TTLs it receives.
+const mdnsRecordTTL = 120 * time.Second
+
+// mdnsQueryTimeout is how long a query waits for entries.
+const mdnsQueryTimeout = 5 * time.Second
+
+// foundPeer is a peer we found, see peerSeen.
+type foundPeer struct {
+	// lastSeen is when we last saw it, and notified when we last notified
+	// about it, with addr.
+	lastSeen time.Time
+	notified time.Time
+	addr     ma.Multiaddr
+	// legacySeen and specSeen are when we last saw it in each format.
+	legacySeen time.Time
+	specSeen   time.Time
+}
+
+// seenAs records that we saw the peer in the given format at the given time.
+func (fp *foundPeer) seenAs(f MdnsFormat, now time.Time) {
+	switch f {
+	case FormatLegacy:
+		fp.legacySeen = now
+	case FormatSpec:
+		fp.specSeen = now
+	}
+}
+
+// formats returns the formats we saw the peer in within the TTL.
+func (fp *foundPeer) formats(now time.Time, ttl time.Duration) MdnsFormat {
+	var f MdnsFormat
+	if !fp.legacySeen.IsZero() && now.Sub(fp.legacySeen) <= ttl {
+		f |= FormatLegacy
+	}
+	if !fp.specSeen.IsZero() && now.Sub(fp.specSeen) <= ttl {
+		f |= FormatSpec
+	}
+	return f
+}
+
+// peerTTL returns how long a peer is remembered without being seen again:
+// the TTL of its records, but at least two query intervals, so that a single
+// missed response doesn't make us lose it.
+func (m *mdnsService) peerTTL() time.Duration {
+	interval := m.interval
+	if m.maxInterval > interval {
+		interval = m.maxInterval
+	}
+	ttl := 2*interval + mdnsQueryTimeout
+	if ttl < mdnsRecordTTL {
+		ttl = mdnsRecordTTL
+	}
+	return ttl
+}
+
+// peerSeen records that we saw the peer at the given time, and returns
+// whether to notify about it: if it's new, if its address changed, or if we
+// last notified about it longer than the rediscovery interval ago. m.lk must
+// be held.
+func (m *mdnsService) peerSeen(pi peer.AddrInfo, now time.Time) bool {
+	if m.peers == nil {
+		m.peers = make(map[peer.ID]*foundPeer)
+	}
+	fp, ok := m.peers[pi.ID]
+	if !ok {
+		fp = new(foundPeer)
+		m.peers[pi.ID] = fp
+	}
+	fp.lastSeen = now
+	switch {
+	case !ok || !fp.addr.Equal(pi.Addrs[0]):
+		// something changed, don't back off querying.
+		m.foundNew = true
+	case m.rediscovery <= 0 || now.Sub(fp.notified) < m.rediscovery:
+		return false
+	}
+	fp.notified = now
+	fp.addr = pi.Addrs[0]
+	return true
+}
+
+// knownPeers returns the peers we found and haven't lost yet, with the address
+// we last notified about.
+func (m *mdnsService) knownPeers() []peer.AddrInfo {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	out := make([]peer.AddrInfo, 0, len(m.peers))
+	for p, fp := range m.peers {
+		out = append(out, peer.AddrInfo{ID: p, Addrs: []ma.Multiaddr{fp.addr}})
+	}
+	return out
+}
+
+// expirePeers forgets the peers we haven't seen within their TTL, notifying
+// the LostNotifees and emitting an EvtPeerLost.
+func (m *mdnsService) expirePeers(now time.Time) {
+	ttl := m.peerTTL()
+
+	var lost []peer.ID
+	defer func() {
+		for _, p := range lost {
+			m.emitters.peerLost(p)
+		}
+	}()
+
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	for p, fp := range m.peers {
+		if now.Sub(fp.lastSeen) <= ttl {
+			continue
+		}
+		delete(m.peers, p)
+		m.foundNew = true
+		lost = append(lost, p)
+		log.Debugw("lost mdns peer", "peer", p, "lastSeen", fp.lastSeen)
+		for _, n := range m.notifees {
+			if ln, ok := n.(LostNotifee); ok {
+				go ln.HandlePeerLost(p)
+			}
+		}
+	}
+}
+
+// reportKnownPeers reports the number of peers we know by the formats they
+// advertise to our metrics tracer, if any.
+func (m *mdnsService) reportKnownPeers() {
+	if m.metrics == nil {
+		return
+	}
+	now, ttl := time.Now(), m.peerTTL()
+	byFormats := make(map[MdnsFormat]int)
+	m.lk.Lock()
+	for _, fp := range m.peers {
+		if f := fp.formats(now, ttl); f != 0 {
+			byFormats[f]++
+		}
+	}
+	m.lk.Unlock()
+	m.metrics.KnownPeers(byFormats)
+}
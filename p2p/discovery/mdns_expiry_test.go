@@ -0,0 +1,115 @@
+package discovery
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/test"
+
+	blhost "github.com/libp2p/go-libp2p-blankhost"
+	swarmt "github.com/libp2p/go-libp2p-swarm/testing"
+
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+	"github.com/whyrusleeping/mdns"
+)
+
+type lostNotifee struct {
+	chanNotifee
+	lost chan peer.ID
+}
+
+func (n lostNotifee) HandlePeerLost(p peer.ID) { n.lost <- p }
+
+func TestPeerTTL(t *testing.T) {
+	require.Equal(t, mdnsRecordTTL, (&mdnsService{interval: time.Second}).peerTTL())
+	require.Equal(t, 2*time.Hour+mdnsQueryTimeout, (&mdnsService{interval: time.Hour}).peerTTL())
+}
+
+func TestPeerLost(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	defer h.Close()
+
+	m := &mdnsService{host: h, tag: ServiceTag, interval: time.Second}
+	n := lostNotifee{chanNotifee: make(chanNotifee, 1), lost: make(chan peer.ID, 1)}
+	m.RegisterNotifee(n)
+	// notifees only told about found peers are fine too.
+	m.RegisterNotifee(make(chanNotifee, 1))
+
+	id, err := test.RandPeerID()
+	require.NoError(t, err)
+	start := time.Now()
+	m.handleEntry(&mdns.ServiceEntry{Name: testEntryName, Info: id.Pretty(), AddrV4: net.IPv4(192, 168, 1, 2), Port: 4001}, nil)
+	select {
+	case <-n.chanNotifee:
+	case <-time.After(time.Second):
+		t.Fatal("expected to find the peer")
+	}
+
+	m.expirePeers(start.Add(m.peerTTL() / 2))
+	select {
+	case p := <-n.lost:
+		t.Fatalf("unexpectedly lost peer %s", p)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	m.expirePeers(start.Add(2 * m.peerTTL()))
+	select {
+	case p := <-n.lost:
+		require.Equal(t, id, p)
+	case <-time.After(time.Second):
+		t.Fatal("expected to lose the peer")
+	}
+
+	// lost only once.
+	m.expirePeers(start.Add(3 * m.peerTTL()))
+	select {
+	case p := <-n.lost:
+		t.Fatalf("lost peer %s again", p)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestRediscovery(t *testing.T) {
+	id, err := test.RandPeerID()
+	require.NoError(t, err)
+	pi := peer.AddrInfo{ID: id, Addrs: []ma.Multiaddr{ma.StringCast("/ip4/192.168.1.2/tcp/4001")}}
+	moved := peer.AddrInfo{ID: id, Addrs: []ma.Multiaddr{ma.StringCast("/ip4/192.168.1.3/tcp/4001")}}
+	start := time.Now()
+
+	m := &mdnsService{}
+	require.True(t, m.peerSeen(pi, start))
+	require.False(t, m.peerSeen(pi, start.Add(time.Hour)))
+	require.True(t, m.peerSeen(moved, start.Add(time.Hour)))
+
+	m = &mdnsService{rediscovery: time.Minute}
+	require.True(t, m.peerSeen(pi, start))
+	require.False(t, m.peerSeen(pi, start.Add(time.Second)))
+	require.True(t, m.peerSeen(pi, start.Add(time.Minute)))
+}
+
+func TestQueryBackoff(t *testing.T) {
+	m := &mdnsService{interval: time.Second}
+	require.Equal(t, time.Second, m.nextQueryInterval(time.Second))
+
+	m = &mdnsService{interval: time.Second, maxInterval: 5 * time.Second}
+	interval := m.nextQueryInterval(time.Second)
+	require.Equal(t, 2*time.Second, interval)
+	interval = m.nextQueryInterval(interval)
+	require.Equal(t, 4*time.Second, interval)
+	interval = m.nextQueryInterval(interval)
+	require.Equal(t, 5*time.Second, interval)
+
+	id, err := test.RandPeerID()
+	require.NoError(t, err)
+	m.peerSeen(peer.AddrInfo{ID: id, Addrs: []ma.Multiaddr{ma.StringCast("/ip4/192.168.1.2/tcp/4001")}}, time.Now())
+	require.Equal(t, time.Second, m.nextQueryInterval(interval))
+	// covers the backed off interval.
+	require.Equal(t, 2*5*time.Minute+mdnsQueryTimeout, (&mdnsService{interval: time.Second, maxInterval: 5 * time.Minute}).peerTTL())
+}
@@ -0,0 +1,151 @@
+package discovery
+
+import (
+	"errors"
+	"net"
+)
+
+// mdnsInterfaces are the network interfaces we advertise and browse on, see
+// InterfaceFilter. A nil *mdnsInterfaces stands for all interfaces.
+type mdnsInterfaces struct {
+	ifaces []net.Interface
+	// nets are the networks of the interfaces, with our address on them.
+	nets []*net.IPNet
+}
+
+// selectInterfaces returns the multicast capable interfaces that are up and
+// pass the filter, or nil if the filter is nil.
+func selectInterfaces(filter func(net.Interface) bool) (*mdnsInterfaces, error) {
+	if filter == nil {
+		return nil, nil
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	sel := new(mdnsInterfaces)
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagMulticast == 0 || !filter(iface) {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			log.Debugw("failed to get interface addresses", "interface", iface.Name, "error", err)
+			continue
+		}
+		sel.ifaces = append(sel.ifaces, iface)
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok {
+				sel.nets = append(sel.nets, ipnet)
+			}
+		}
+	}
+	if len(sel.ifaces) == 0 {
+		return nil, errors.New("no multicast network interface passes the mdns interface filter")
+	}
+	return sel, nil
+}
+
+// list returns the interfaces to run a server or a query on each, a single
+// nil interface standing for all interfaces.
+func (s *mdnsInterfaces) list() []*net.Interface {
+	if s == nil {
+		return []*net.Interface{nil}
+	}
+	out := make([]*net.Interface, len(s.ifaces))
+	for i := range s.ifaces {
+		out[i] = &s.ifaces[i]
+	}
+	return out
+}
+
+// ownIPs returns the IPs that are our addresses on one of the interfaces.
+func (s *mdnsInterfaces) ownIPs(ips []net.IP) []net.IP {
+	if s == nil {
+		return ips
+	}
+	var out []net.IP
+	for _, ip := range ips {
+		for _, n := range s.nets {
+			if n.IP.Equal(ip) {
+				out = append(out, ip)
+				break
+			}
+		}
+	}
+	return out
+}
+
+// reachableIPs returns the IPs that are on the network of one of the
+// interfaces, i.e. that we can reach through them.
+func (s *mdnsInterfaces) reachableIPs(ips []net.IP) []net.IP {
+	if s == nil {
+		return ips
+	}
+	var out []net.IP
+	for _, ip := range ips {
+		for _, n := range s.nets {
+			if n.Contains(ip) {
+				out = append(out, ip)
+				break
+			}
+		}
+	}
+	return out
+}
+
+// equal returns true if both select the same interfaces, with the same
+// networks.
+func (s *mdnsInterfaces) equal(o *mdnsInterfaces) bool {
+	if s == nil || o == nil {
+		return s == o
+	}
+	if len(s.ifaces) != len(o.ifaces) || len(s.nets) != len(o.nets) {
+		return false
+	}
+	for i := range s.ifaces {
+		if s.ifaces[i].Index != o.ifaces[i].Index {
+			return false
+		}
+	}
+	for i := range s.nets {
+		if s.nets[i].String() != o.nets[i].String() {
+			return false
+		}
+	}
+	return true
+}
+
+// linkLocalZone returns the zone to dial link-local IPv6 addresses received on
+// the given interface with: its name or, if unknown, the name of our only
+// interface with a link-local IPv6 address. It returns an empty string if
+// ambiguous.
+func linkLocalZone(iface *net.Interface) string {
+	if iface != nil {
+		return iface.Name
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return ""
+	}
+	var zone string
+	for _, i := range ifaces {
+		if i.Flags&net.FlagUp == 0 || i.Flags&net.FlagMulticast == 0 || i.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := i.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.To4() == nil && ipnet.IP.IsLinkLocalUnicast() {
+				if zone != "" {
+					return ""
+				}
+				zone = i.Name
+				break
+			}
+		}
+	}
+	return zone
+}
@@ -0,0 +1,95 @@
+package discovery
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/test"
+
+	blhost "github.com/libp2p/go-libp2p-blankhost"
+	swarmt "github.com/libp2p/go-libp2p-swarm/testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/whyrusleeping/mdns"
+)
+
+func TestSelectInterfaces(t *testing.T) {
+	sel, err := selectInterfaces(nil)
+	require.NoError(t, err)
+	require.Nil(t, sel)
+	require.Equal(t, []*net.Interface{nil}, sel.list())
+
+	_, err = selectInterfaces(func(net.Interface) bool { return false })
+	require.Error(t, err)
+}
+
+func TestInterfaceEntries(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	defer h.Close()
+
+	lan := &net.IPNet{IP: net.IPv4(192, 168, 1, 1), Mask: net.CIDRMask(24, 32)}
+	ifaces := &mdnsInterfaces{
+		ifaces: []net.Interface{{Name: "eth0"}},
+		nets:   []*net.IPNet{lan},
+	}
+	require.Equal(t, []net.IP{lan.IP}, ifaces.ownIPs([]net.IP{net.IPv4(172, 17, 0, 1), lan.IP}))
+	require.Len(t, ifaces.list(), 1)
+
+	id, err := test.RandPeerID()
+	require.NoError(t, err)
+	m := &mdnsService{host: h, tag: ServiceTag, ifaces: ifaces}
+	found := make(chanNotifee, 1)
+	m.RegisterNotifee(found)
+
+	// a peer on a docker network we don't browse on.
+	m.handleEntry(&mdns.ServiceEntry{Name: testEntryName, Info: id.Pretty(), AddrV4: net.IPv4(172, 17, 0, 2), Port: 4001}, nil)
+	select {
+	case pi := <-found:
+		t.Fatalf("unexpected peer found: %s", pi)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	m.handleEntry(&mdns.ServiceEntry{Name: testEntryName, Info: id.Pretty(), AddrV4: net.IPv4(192, 168, 1, 2), Port: 4001}, nil)
+	select {
+	case pi := <-found:
+		require.Equal(t, []string{"/ip4/192.168.1.2/tcp/4001"}, addrStrings(pi.Addrs))
+	case <-time.After(time.Second):
+		t.Fatal("expected to find the peer")
+	}
+}
+
+func TestLinkLocalEntries(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	defer h.Close()
+
+	id, err := test.RandPeerID()
+	require.NoError(t, err)
+	m := &mdnsService{host: h, tag: ServiceTag}
+	found := make(chanNotifee, 1)
+	m.RegisterNotifee(found)
+
+	m.handleEntry(&mdns.ServiceEntry{Name: testEntryName, Info: id.Pretty(), AddrV6: net.ParseIP("fe80::2"), Port: 4001}, &net.Interface{Name: "wlan0"})
+	select {
+	case pi := <-found:
+		require.Equal(t, []string{"/ip6zone/wlan0/ip6/fe80::2/tcp/4001"}, addrStrings(pi.Addrs))
+	case <-time.After(time.Second):
+		t.Fatal("expected to find the peer")
+	}
+
+	// global addresses don't need a zone.
+	m.handleEntry(&mdns.ServiceEntry{Name: testEntryName, Info: id.Pretty(), AddrV6: net.ParseIP("2001:db8::2"), Port: 4001}, &net.Interface{Name: "wlan0"})
+	select {
+	case pi := <-found:
+		require.Equal(t, []string{"/ip6/2001:db8::2/tcp/4001"}, addrStrings(pi.Addrs))
+	case <-time.After(time.Second):
+		t.Fatal("expected to find the peer")
+	}
+}
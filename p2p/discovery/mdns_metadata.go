@@ -0,0 +1,50 @@
+package discovery
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/whyrusleeping/mdns"
+)
+
+// maxTXTLen is the maximum length of a string of a TXT record.
+const maxTXTLen = 255
+
+// metadataFields returns the TXT record strings carrying the metadata, sorted
+// by key.
+func metadataFields(md map[string]string) ([]string, error) {
+	fields := make([]string, 0, len(md))
+	for k, v := range md {
+		if k == "" || strings.Contains(k, "=") {
+			return nil, fmt.Errorf("invalid mdns metadata key %q", k)
+		}
+		f := k + "=" + v
+		if len(f) > maxTXTLen {
+			return nil, fmt.Errorf("mdns metadata %q exceeds %d bytes", k, maxTXTLen)
+		}
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+	return fields, nil
+}
+
+// entryFields returns the TXT record string carrying the identity of the peer
+// advertised by the entry, always the first one, and its metadata in the
+// others. Strings that aren't key=value pairs are ignored.
+func entryFields(e *mdns.ServiceEntry) (identity string, md map[string]string) {
+	if len(e.InfoFields) == 0 {
+		return e.Info, nil
+	}
+	for _, f := range e.InfoFields[1:] {
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			continue
+		}
+		if md == nil {
+			md = make(map[string]string)
+		}
+		md[kv[0]] = kv[1]
+	}
+	return e.InfoFields[0], md
+}
@@ -0,0 +1,78 @@
+package discovery
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/test"
+
+	blhost "github.com/libp2p/go-libp2p-blankhost"
+	swarmt "github.com/libp2p/go-libp2p-swarm/testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/whyrusleeping/mdns"
+)
+
+func TestMetadataFields(t *testing.T) {
+	fields, err := metadataFields(map[string]string{"room": "xyz", "app": "chat", "empty": ""})
+	require.NoError(t, err)
+	require.Equal(t, []string{"app=chat", "empty=", "room=xyz"}, fields)
+
+	_, err = metadataFields(map[string]string{"": "xyz"})
+	require.Error(t, err)
+	_, err = metadataFields(map[string]string{"a=b": "xyz"})
+	require.Error(t, err)
+	_, err = metadataFields(map[string]string{"room": strings.Repeat("x", maxTXTLen)})
+	require.Error(t, err)
+
+	identity, md := entryFields(&mdns.ServiceEntry{Info: "id", InfoFields: []string{"id", "room=xyz", "invalid", "eq=a=b"}})
+	require.Equal(t, "id", identity)
+	require.Equal(t, map[string]string{"room": "xyz", "eq": "a=b"}, md)
+}
+
+func TestMetadataFilter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	defer h.Close()
+
+	m := &mdnsService{host: h, tag: ServiceTag, metadataFilter: func(md map[string]string) bool {
+		return md["room"] == "xyz"
+	}}
+	found := make(chanNotifee, 1)
+	m.RegisterNotifee(found)
+
+	entry := func(fields ...string) *mdns.ServiceEntry {
+		id, err := test.RandPeerID()
+		require.NoError(t, err)
+		fields = append([]string{id.Pretty()}, fields...)
+		return &mdns.ServiceEntry{
+			Name:       testEntryName,
+			Info:       strings.Join(fields, "|"),
+			InfoFields: fields,
+			AddrV4:     net.IPv4(192, 168, 1, 2),
+			Port:       4001,
+		}
+	}
+	for _, e := range []*mdns.ServiceEntry{entry(), entry("room=abc")} {
+		m.handleEntry(e, nil)
+		select {
+		case pi := <-found:
+			t.Fatalf("unexpected peer found: %s", pi)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	e := entry("app=chat", "room=xyz")
+	m.handleEntry(e, nil)
+	select {
+	case pi := <-found:
+		require.Equal(t, e.InfoFields[0], pi.ID.Pretty())
+	case <-time.After(time.Second):
+		t.Fatal("expected to find the peer")
+	}
+}
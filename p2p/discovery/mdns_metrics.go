@@ -0,0 +1,78 @@
+package discovery
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// MdnsMetricsTracer receives metrics about the formats peers advertise
+// themselves with, to follow the migration to FormatSpec. Wire it with the
+// MdnsMetrics option. Implementations must be safe for concurrent use.
+// NewMdnsPrometheusMetrics exports the metrics to Prometheus.
+type MdnsMetricsTracer interface {
+	// PeerFound is called whenever we notify about a peer, with the format
+	// of the entry we found it in.
+	PeerFound(format MdnsFormat)
+	// KnownPeers is called after every query with the number of peers we
+	// know, by the set of formats we found them in since their records last
+	// expired: FormatLegacy, FormatSpec, or both.
+	KnownPeers(byFormats map[MdnsFormat]int)
+}
+
+// MdnsMetrics reports metrics to the given tracer.
+func MdnsMetrics(t MdnsMetricsTracer) MdnsOption {
+	return func(cfg *mdnsConfig) {
+		cfg.metrics = t
+	}
+}
+
+// MdnsPrometheusMetrics is an MdnsMetricsTracer exporting the metrics to
+// Prometheus.
+type MdnsPrometheusMetrics struct {
+	registerer prometheus.Registerer
+
+	found *prometheus.CounterVec
+	known *prometheus.GaugeVec
+}
+
+var _ MdnsMetricsTracer = (*MdnsPrometheusMetrics)(nil)
+
+// NewMdnsPrometheusMetrics constructs a new MdnsPrometheusMetrics, registering
+// its metrics with the given registerer.
+func NewMdnsPrometheusMetrics(r prometheus.Registerer) (*MdnsPrometheusMetrics, error) {
+	m := &MdnsPrometheusMetrics{
+		registerer: r,
+		found: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "libp2p_mdns_peers_found_total",
+			Help: "Peers found over mDNS, by the format of the entry they were found in",
+		}, []string{"format"}),
+		known: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "libp2p_mdns_known_peers",
+			Help: "Peers known over mDNS, by the formats they advertise",
+		}, []string{"formats"}),
+	}
+	if err := r.Register(m.found); err != nil {
+		return nil, err
+	}
+	if err := r.Register(m.known); err != nil {
+		r.Unregister(m.found)
+		return nil, err
+	}
+	return m, nil
+}
+
+// Close unregisters the metrics.
+func (m *MdnsPrometheusMetrics) Close() error {
+	m.registerer.Unregister(m.found)
+	m.registerer.Unregister(m.known)
+	return nil
+}
+
+func (m *MdnsPrometheusMetrics) PeerFound(format MdnsFormat) {
+	m.found.WithLabelValues(format.String()).Inc()
+}
+
+func (m *MdnsPrometheusMetrics) KnownPeers(byFormats map[MdnsFormat]int) {
+	for _, f := range []MdnsFormat{FormatLegacy, FormatSpec, FormatLegacy | FormatSpec} {
+		m.known.WithLabelValues(f.String()).Set(float64(byFormats[f]))
+	}
+}
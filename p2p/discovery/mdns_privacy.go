@@ -0,0 +1,61 @@
+package discovery
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// sealedPrefix prefixes the TXT record carrying our encrypted peer ID in
+// privacy mode.
+const sealedPrefix = "sealed="
+
+// newPrivacyCipher derives the cipher used to seal peer IDs from the shared
+// privacy mode key.
+func newPrivacyCipher(key []byte) (cipher.AEAD, error) {
+	if len(key) == 0 {
+		return nil, errors.New("empty privacy mode key")
+	}
+	k := sha256.Sum256(append([]byte("libp2p-mdns-privacy:"), key...))
+	block, err := aes.NewCipher(k[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealPeerID encrypts our peer ID with a fresh nonce, so that the result
+// changes on every rotation.
+func sealPeerID(aead cipher.AEAD, id peer.ID) (string, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(id), nil)
+	return sealedPrefix + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// openPeerID decrypts a peer ID sealed with sealPeerID.
+func openPeerID(aead cipher.AEAD, info string) (peer.ID, error) {
+	if !strings.HasPrefix(info, sealedPrefix) {
+		return "", errors.New("entry doesn't contain a sealed peer ID")
+	}
+	b, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(info, sealedPrefix))
+	if err != nil {
+		return "", err
+	}
+	if len(b) < aead.NonceSize() {
+		return "", errors.New("sealed peer ID too short")
+	}
+	id, err := aead.Open(nil, b[:aead.NonceSize()], b[aead.NonceSize():], nil)
+	if err != nil {
+		return "", err
+	}
+	return peer.IDFromBytes(id)
+}
@@ -0,0 +1,85 @@
+package discovery
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/test"
+
+	blhost "github.com/libp2p/go-libp2p-blankhost"
+	swarmt "github.com/libp2p/go-libp2p-swarm/testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/whyrusleeping/mdns"
+)
+
+type chanNotifee chan peer.AddrInfo
+
+func (n chanNotifee) HandlePeerFound(pi peer.AddrInfo) { n <- pi }
+
+func TestSealPeerID(t *testing.T) {
+	id, err := test.RandPeerID()
+	require.NoError(t, err)
+
+	aead, err := newPrivacyCipher([]byte("secret"))
+	require.NoError(t, err)
+	other, err := newPrivacyCipher([]byte("other secret"))
+	require.NoError(t, err)
+
+	sealed1, err := sealPeerID(aead, id)
+	require.NoError(t, err)
+	sealed2, err := sealPeerID(aead, id)
+	require.NoError(t, err)
+	// every rotation looks different to observers.
+	require.NotEqual(t, sealed1, sealed2)
+	require.NotContains(t, sealed1, id.Pretty())
+
+	opened, err := openPeerID(aead, sealed1)
+	require.NoError(t, err)
+	require.Equal(t, id, opened)
+
+	_, err = openPeerID(other, sealed1)
+	require.Error(t, err)
+	_, err = openPeerID(aead, id.Pretty())
+	require.Error(t, err)
+}
+
+func TestPrivacyModeEntries(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	defer h.Close()
+
+	aead, err := newPrivacyCipher([]byte("secret"))
+	require.NoError(t, err)
+	m := &mdnsService{host: h, tag: ServiceTag, privacy: aead}
+	found := make(chanNotifee, 1)
+	m.RegisterNotifee(found)
+
+	id, err := test.RandPeerID()
+	require.NoError(t, err)
+
+	// plaintext entries are ignored in privacy mode.
+	m.handleEntry(&mdns.ServiceEntry{Name: testEntryName, Info: id.Pretty(), AddrV4: net.IPv4(192, 168, 1, 2), Port: 4001}, nil)
+
+	sealed, err := sealPeerID(aead, id)
+	require.NoError(t, err)
+	m.handleEntry(&mdns.ServiceEntry{Name: testEntryName, Info: sealed, AddrV4: net.IPv4(192, 168, 1, 3), Port: 4001}, nil)
+
+	select {
+	case pi := <-found:
+		require.Equal(t, id, pi.ID)
+		require.Equal(t, "/ip4/192.168.1.3/tcp/4001", pi.Addrs[0].String())
+	case <-time.After(time.Second):
+		t.Fatal("expected to find the peer")
+	}
+	select {
+	case pi := <-found:
+		t.Fatalf("unexpected peer found: %s", pi)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,154 @@
+package discovery
+
+import (
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/miekg/dns"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+	"github.com/whyrusleeping/mdns"
+)
+
+// SpecServiceTag is the service of the libp2p mDNS specification, see
+// FormatSpec.
+const SpecServiceTag = "_p2p._udp"
+
+// dnsaddrPrefix prefixes the addresses in the TXT records of the
+// specification format.
+const dnsaddrPrefix = "dnsaddr="
+
+var errMissingDnsaddr = errors.New("mdns entry has no dnsaddr")
+
+// MdnsFormat is a format of the mDNS records peers advertise themselves with,
+// or a set of formats.
+type MdnsFormat int
+
+const (
+	// FormatLegacy is the format of go-libp2p before the libp2p mDNS
+	// specification: instances of the ServiceTag service, or of the service
+	// tag passed to NewMdnsService, whose TXT record starts with the peer ID,
+	// and whose address is in their A/AAAA and SRV records.
+	FormatLegacy MdnsFormat = 1 << iota
+	// FormatSpec is the format of the libp2p mDNS specification: instances
+	// of the SpecServiceTag service with a random name, whose TXT record
+	// lists the addresses of the peer, peer ID included, as
+	// dnsaddr=<multiaddr> strings.
+	FormatSpec
+)
+
+func (f MdnsFormat) String() string {
+	switch f {
+	case FormatLegacy:
+		return "legacy"
+	case FormatSpec:
+		return "spec"
+	case FormatLegacy | FormatSpec:
+		return "legacy+spec"
+	default:
+		return "none"
+	}
+}
+
+// Formats sets the formats we advertise ourselves with, and browse peers in.
+// Defaults to FormatLegacy, see CompatMode to migrate to FormatSpec. Privacy
+// mode only supports FormatLegacy: FormatSpec records carry our peer ID.
+func Formats(f MdnsFormat) MdnsOption {
+	return func(cfg *mdnsConfig) {
+		cfg.formats = f
+	}
+}
+
+// CompatMode advertises ourselves, and browses peers, in both the legacy and
+// the specification formats, so that networks can migrate gradually: first
+// every node in compatibility mode, then every node in FormatSpec only.
+// Peers found in both formats are reported once.
+func CompatMode() MdnsOption {
+	return Formats(FormatLegacy | FormatSpec)
+}
+
+// specFields returns the TXT record strings advertising our addresses in the
+// specification format. Link-local IPv6 addresses are skipped: they're only
+// dialable with a zone, which depends on the receiver.
+func specFields(id peer.ID, ips []net.IP, port int) []string {
+	p2p, err := ma.NewComponent(ma.ProtocolWithCode(ma.P_P2P).Name, id.Pretty())
+	if err != nil {
+		return nil
+	}
+	var fields []string
+	for _, ip := range ips {
+		if ip.To4() == nil && ip.IsLinkLocalUnicast() {
+			continue
+		}
+		addr, err := manet.FromNetAddr(&net.TCPAddr{IP: ip, Port: port})
+		if err != nil {
+			continue
+		}
+		f := dnsaddrPrefix + addr.Encapsulate(p2p).String()
+		if len(f) > maxTXTLen {
+			continue
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+// specEntryFields returns the ID of the peer advertised by an entry in the
+// specification format, the addresses it advertised, without their peer ID,
+// and its metadata, see Metadata. Addresses of other peers are ignored.
+func specEntryFields(e *mdns.ServiceEntry) (peer.ID, []ma.Multiaddr, map[string]string, error) {
+	var (
+		id    peer.ID
+		addrs []ma.Multiaddr
+		md    map[string]string
+	)
+	for _, f := range e.InfoFields {
+		if !strings.HasPrefix(f, dnsaddrPrefix) {
+			kv := strings.SplitN(f, "=", 2)
+			if len(kv) != 2 || kv[0] == "" {
+				continue
+			}
+			if md == nil {
+				md = make(map[string]string)
+			}
+			md[kv[0]] = kv[1]
+			continue
+		}
+		addr, err := ma.NewMultiaddr(strings.TrimPrefix(f, dnsaddrPrefix))
+		if err != nil {
+			log.Debugw("ignoring invalid address in mdns entry", "entry", e.Name, "error", err)
+			continue
+		}
+		pi, err := peer.AddrInfoFromP2pAddr(addr)
+		if err != nil {
+			log.Debugw("ignoring address without peer ID in mdns entry", "entry", e.Name, "addr", addr)
+			continue
+		}
+		if id == "" {
+			id = pi.ID
+		}
+		if pi.ID != id {
+			continue
+		}
+		addrs = append(addrs, pi.Addrs...)
+	}
+	if id == "" {
+		return "", nil, nil, errMissingDnsaddr
+	}
+	return id, addrs, md, nil
+}
+
+// mdnsZones answers the questions with the records of all its zones, so that
+// a single server advertises us in several formats.
+type mdnsZones []mdns.Zone
+
+func (z mdnsZones) Records(q dns.Question) []dns.RR {
+	var rrs []dns.RR
+	for _, zone := range z {
+		rrs = append(rrs, zone.Records(q)...)
+	}
+	return rrs
+}
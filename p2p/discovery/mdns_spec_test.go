@@ -0,0 +1,149 @@
+package discovery
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/test"
+
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	"github.com/whyrusleeping/mdns"
+)
+
+// specEntryName is the name of an instance of the specification service.
+const specEntryName = "instance." + SpecServiceTag + ".local."
+
+type formatsTracer struct {
+	mu    sync.Mutex
+	found map[MdnsFormat]int
+	known map[MdnsFormat]int
+}
+
+func (t *formatsTracer) PeerFound(f MdnsFormat) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.found[f]++
+}
+
+func (t *formatsTracer) KnownPeers(byFormats map[MdnsFormat]int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.known = byFormats
+}
+
+func TestSpecFields(t *testing.T) {
+	id, err := test.RandPeerID()
+	require.NoError(t, err)
+	ips := []net.IP{net.IPv4(192, 168, 1, 2), net.ParseIP("fe80::1"), net.ParseIP("2001:db8::1")}
+	fields := specFields(id, ips, 4001)
+	require.Equal(t, []string{
+		"dnsaddr=/ip4/192.168.1.2/tcp/4001/p2p/" + id.Pretty(),
+		"dnsaddr=/ip6/2001:db8::1/tcp/4001/p2p/" + id.Pretty(),
+	}, fields)
+
+	other, err := test.RandPeerID()
+	require.NoError(t, err)
+	txt := append(fields, "dnsaddr=/ip4/10.0.0.1/tcp/1/p2p/"+other.Pretty(), "dnsaddr=garbage", "room=xyz")
+	got, addrs, md, err := specEntryFields(&mdns.ServiceEntry{Name: specEntryName, InfoFields: txt})
+	require.NoError(t, err)
+	require.Equal(t, id, got)
+	require.Equal(t, []string{"/ip4/192.168.1.2/tcp/4001", "/ip6/2001:db8::1/tcp/4001"}, addrStrings(addrs))
+	require.Equal(t, map[string]string{"room": "xyz"}, md)
+
+	_, _, _, err = specEntryFields(&mdns.ServiceEntry{Name: specEntryName, InfoFields: []string{id.Pretty()}})
+	require.Error(t, err)
+}
+
+func TestCompatMode(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn, err := mocknet.FullMeshLinked(ctx, 1)
+	require.NoError(t, err)
+	h := mn.Hosts()[0]
+
+	tracer := &formatsTracer{found: make(map[MdnsFormat]int)}
+	m := &mdnsService{
+		host:     h,
+		tag:      ServiceTag,
+		formats:  FormatLegacy | FormatSpec,
+		specTag:  SpecServiceTag,
+		metrics:  tracer,
+		interval: time.Second,
+	}
+	found := make(chanNotifee, 10)
+	m.RegisterNotifee(found)
+	expectFound := func(id peer.ID, addrs ...string) {
+		t.Helper()
+		select {
+		case pi := <-found:
+			require.Equal(t, id, pi.ID)
+			require.Equal(t, addrs, addrStrings(pi.Addrs))
+		case <-time.After(time.Second):
+			t.Fatal("expected to find the peer")
+		}
+	}
+	expectNone := func() {
+		t.Helper()
+		select {
+		case pi := <-found:
+			t.Fatalf("unexpected peer found: %s", pi)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	specEntry := func(id peer.ID, ips ...net.IP) *mdns.ServiceEntry {
+		return &mdns.ServiceEntry{Name: specEntryName, InfoFields: specFields(id, ips, 4001), AddrV4: ips[0], Port: 4001}
+	}
+
+	// a peer advertising both formats is reported once.
+	both, err := test.RandPeerID()
+	require.NoError(t, err)
+	m.handleEntry(&mdns.ServiceEntry{Name: testEntryName, Info: both.Pretty(), InfoFields: []string{both.Pretty()}, AddrV4: net.IPv4(192, 168, 1, 2), Port: 4001}, nil)
+	expectFound(both, "/ip4/192.168.1.2/tcp/4001")
+	m.handleEntry(specEntry(both, net.IPv4(192, 168, 1, 2)), nil)
+	expectNone()
+
+	// spec peers are reported with all their addresses, the one of their
+	// A record first.
+	spec, err := test.RandPeerID()
+	require.NoError(t, err)
+	m.handleEntry(specEntry(spec, net.IPv4(192, 168, 1, 3), net.IPv4(10, 0, 0, 3)), nil)
+	expectFound(spec, "/ip4/192.168.1.3/tcp/4001", "/ip4/10.0.0.3/tcp/4001")
+
+	// our own entries are ignored.
+	m.handleEntry(specEntry(h.ID(), net.IPv4(192, 168, 1, 4)), nil)
+	expectNone()
+
+	m.reportKnownPeers()
+	tracer.mu.Lock()
+	require.Equal(t, map[MdnsFormat]int{FormatLegacy: 1, FormatSpec: 1}, tracer.found)
+	require.Equal(t, map[MdnsFormat]int{FormatLegacy | FormatSpec: 1, FormatSpec: 1}, tracer.known)
+	tracer.mu.Unlock()
+
+	// legacy only services ignore spec entries.
+	legacy := &mdnsService{host: h, tag: ServiceTag, specTag: SpecServiceTag}
+	legacy.RegisterNotifee(found)
+	legacy.handleEntry(specEntry(spec, net.IPv4(192, 168, 1, 3)), nil)
+	expectNone()
+}
+
+func TestMdnsZones(t *testing.T) {
+	a, err := mdns.NewMDNSService("instance", ServiceTag, mdnsDomain+".", "", 4001, []net.IP{net.IPv4(192, 168, 1, 2)}, []string{"a"})
+	require.NoError(t, err)
+	b, err := mdns.NewMDNSService("instance", SpecServiceTag, mdnsDomain+".", "", 4001, []net.IP{net.IPv4(192, 168, 1, 2)}, []string{"b"})
+	require.NoError(t, err)
+	zones := mdnsZones{a, b}
+
+	for _, tag := range []string{ServiceTag, SpecServiceTag} {
+		rrs := zones.Records(dns.Question{Name: tag + ".local.", Qtype: dns.TypePTR, Qclass: dns.ClassINET})
+		require.NotEmpty(t, rrs, tag)
+		require.Equal(t, "instance."+tag+".local.", rrs[0].(*dns.PTR).Ptr)
+	}
+}
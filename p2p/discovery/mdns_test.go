@@ -2,14 +2,24 @@ package discovery
 
 import (
 	"context"
+	"crypto/rand"
+	"net"
 	"testing"
 	"time"
 
+	"github.com/libp2p/go-libp2p-core/crypto"
 	"github.com/libp2p/go-libp2p-core/host"
 	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/test"
 
+	blhost "github.com/libp2p/go-libp2p-blankhost"
 	swarmt "github.com/libp2p/go-libp2p-swarm/testing"
 	bhost "github.com/libp2p/go-libp2p/p2p/host/basic"
+	"github.com/libp2p/go-libp2p/p2p/net/addrfamily"
+
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+	"github.com/whyrusleeping/mdns"
 )
 
 type DiscoveryNotifee struct {
@@ -53,3 +63,134 @@ func TestMdnsDiscovery(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestAddrFamilyEntries(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	defer h.Close()
+
+	id, err := test.RandPeerID()
+	require.NoError(t, err)
+	entry := &mdns.ServiceEntry{Name: testEntryName, Info: id.Pretty(), AddrV4: net.IPv4(192, 168, 1, 2), AddrV6: net.ParseIP("fe80::1"), Port: 4001}
+
+	for p, expected := range map[addrfamily.Policy]string{
+		addrfamily.Any:        "/ip4/192.168.1.2/tcp/4001",
+		addrfamily.PreferIPv6: "/ip6zone/eth0/ip6/fe80::1/tcp/4001",
+		addrfamily.IPv4Only:   "/ip4/192.168.1.2/tcp/4001",
+	} {
+		m := &mdnsService{host: h, tag: ServiceTag, family: p}
+		found := make(chanNotifee, 1)
+		m.RegisterNotifee(found)
+		m.handleEntry(entry, &net.Interface{Name: "eth0"})
+		select {
+		case pi := <-found:
+			require.Equal(t, []string{expected}, addrStrings(pi.Addrs), p.String())
+		case <-time.After(time.Second):
+			t.Fatal("expected to find the peer")
+		}
+	}
+
+	// no address left.
+	m := &mdnsService{host: h, tag: ServiceTag, family: addrfamily.IPv6Only}
+	found := make(chanNotifee, 1)
+	m.RegisterNotifee(found)
+	m.handleEntry(&mdns.ServiceEntry{Name: testEntryName, Info: id.Pretty(), AddrV4: net.IPv4(192, 168, 1, 2), Port: 4001}, nil)
+	select {
+	case pi := <-found:
+		t.Fatalf("unexpected peer found: %s", pi)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func addrStrings(addrs []ma.Multiaddr) []string {
+	out := make([]string, 0, len(addrs))
+	for _, a := range addrs {
+		out = append(out, a.String())
+	}
+	return out
+}
+
+// testEntryName is the name of an instance of our default service.
+const testEntryName = "instance." + ServiceTag + ".local."
+
+func TestNamespace(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	defer h.Close()
+
+	require.Equal(t, ServiceTag, serviceName(ServiceTag, ""))
+	tag := serviceName(ServiceTag, "myapp")
+	require.Equal(t, "_myapp._ipfs-discovery._udp", tag)
+	require.Equal(t, tag, serviceName(ServiceTag, "_myapp"))
+
+	id, err := test.RandPeerID()
+	require.NoError(t, err)
+	entry := func(name string) *mdns.ServiceEntry {
+		return &mdns.ServiceEntry{Name: name, Info: id.Pretty(), AddrV4: net.IPv4(192, 168, 1, 2), Port: 4001}
+	}
+	for _, tc := range []struct {
+		tag, name string
+		found     bool
+	}{
+		{tag, "instance._myapp._ipfs-discovery._udp.local.", true},
+		{tag, "INSTANCE._MyApp._ipfs-discovery._udp.local.", true},
+		{tag, "instance._other._ipfs-discovery._udp.local.", false},
+		{tag, testEntryName, false},
+		// instances of namespaced services aren't instances of the plain one.
+		{ServiceTag, "instance._myapp._ipfs-discovery._udp.local.", false},
+		{ServiceTag, "_ipfs-discovery._udp.local.", false},
+		{ServiceTag, "instance._http._tcp.local.", false},
+	} {
+		m := &mdnsService{host: h, tag: tc.tag}
+		found := make(chanNotifee, 1)
+		m.RegisterNotifee(found)
+		m.handleEntry(entry(tc.name), nil)
+		select {
+		case <-found:
+			require.True(t, tc.found, "unexpected peer found in %s browsing %s", tc.name, tc.tag)
+		case <-time.After(50 * time.Millisecond):
+			require.False(t, tc.found, "expected to find peer in %s browsing %s", tc.name, tc.tag)
+		}
+	}
+}
+
+func TestRandomInstanceName(t *testing.T) {
+	a, err := randomInstanceName()
+	require.NoError(t, err)
+	b, err := randomInstanceName()
+	require.NoError(t, err)
+	require.NotEqual(t, a, b)
+	// a single DNS label.
+	require.LessOrEqual(t, len(a), 63)
+	require.NotContains(t, a, ".")
+}
+
+func TestLongPeerIDEntries(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	defer h.Close()
+
+	// identity multihash peer IDs embed the public key.
+	_, pub, err := crypto.GenerateSecp256k1Key(rand.Reader)
+	require.NoError(t, err)
+	id, err := peer.IDFromPublicKey(pub)
+	require.NoError(t, err)
+	require.Greater(t, len(id.String()), 50)
+
+	m := &mdnsService{host: h, tag: ServiceTag}
+	found := make(chanNotifee, 1)
+	m.RegisterNotifee(found)
+	m.handleEntry(&mdns.ServiceEntry{Name: testEntryName, Info: id.Pretty(), AddrV4: net.IPv4(192, 168, 1, 2), Port: 4001}, nil)
+	select {
+	case pi := <-found:
+		require.Equal(t, id, pi.ID)
+	case <-time.After(time.Second):
+		t.Fatal("expected to find the peer")
+	}
+}
@@ -0,0 +1,171 @@
+package rendezvous
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/record"
+
+	pb "github.com/libp2p/go-libp2p/p2p/discovery/rendezvous/pb"
+
+	"github.com/libp2p/go-msgio/protoio"
+)
+
+// RendezvousPoint is a client of a rendezvous point.
+type RendezvousPoint struct {
+	h host.Host
+	p peer.ID
+}
+
+// NewRendezvousPoint returns a client of the rendezvous point p. The host
+// must be able to connect to it, e.g. by knowing its addresses.
+func NewRendezvousPoint(h host.Host, p peer.ID) *RendezvousPoint {
+	return &RendezvousPoint{h: h, p: p}
+}
+
+// Register registers us in the namespace, with a signed peer record of our
+// current addresses. It returns the TTL the rendezvous point accepted, ttl if
+// non-zero, DefaultTTL otherwise.
+func (rp *RendezvousPoint) Register(ctx context.Context, ns string, ttl time.Duration) (time.Duration, error) {
+	if e := checkNamespace(ns, false); e != nil {
+		return 0, e
+	}
+	if ttl < 0 || ttl > MaxTTL {
+		return 0, fmt.Errorf("invalid ttl: %s", ttl)
+	}
+	rec, err := rp.signedRecord()
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := rp.request(ctx, &pb.Message{
+		Type: pb.Message_REGISTER,
+		Register: &pb.Message_Register{
+			Ns:               ns,
+			SignedPeerRecord: rec,
+			Ttl:              uint64(ttl / time.Second),
+		},
+	}, pb.Message_REGISTER_RESPONSE)
+	if err != nil {
+		return 0, err
+	}
+	r := resp.RegisterResponse
+	if r == nil {
+		return 0, errors.New("missing register response")
+	}
+	if r.Status != pb.Message_OK {
+		return 0, &Error{Status: r.Status, Text: r.StatusText}
+	}
+	return time.Duration(r.Ttl) * time.Second, nil
+}
+
+// Unregister removes our registration in the namespace. The rendezvous point
+// doesn't acknowledge it.
+func (rp *RendezvousPoint) Unregister(ctx context.Context, ns string) error {
+	if e := checkNamespace(ns, false); e != nil {
+		return e
+	}
+	s, err := rp.h.NewStream(ctx, rp.p, ProtocolID)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	return protoio.NewDelimitedWriter(s).WriteMsg(&pb.Message{
+		Type:       pb.Message_UNREGISTER,
+		Unregister: &pb.Message_Unregister{Ns: ns, Id: []byte(rp.h.ID())},
+	})
+}
+
+// Discover returns up to limit registrations of the namespace, of all
+// namespaces if empty, and the cookie to get the next ones with. A zero limit
+// asks for as many as the rendezvous point returns at once. Registrations
+// whose signed peer record is invalid are skipped.
+func (rp *RendezvousPoint) Discover(ctx context.Context, ns string, limit int, cookie []byte) ([]Registration, []byte, error) {
+	if e := checkNamespace(ns, true); e != nil {
+		return nil, nil, e
+	}
+	if limit < 0 {
+		limit = 0
+	}
+	resp, err := rp.request(ctx, &pb.Message{
+		Type:     pb.Message_DISCOVER,
+		Discover: &pb.Message_Discover{Ns: ns, Limit: uint64(limit), Cookie: cookie},
+	}, pb.Message_DISCOVER_RESPONSE)
+	if err != nil {
+		return nil, nil, err
+	}
+	r := resp.DiscoverResponse
+	if r == nil {
+		return nil, nil, errors.New("missing discover response")
+	}
+	if r.Status != pb.Message_OK {
+		return nil, nil, &Error{Status: r.Status, Text: r.StatusText}
+	}
+
+	regs := make([]Registration, 0, len(r.Registrations))
+	for _, reg := range r.Registrations {
+		_, rec, err := record.ConsumeEnvelope(reg.SignedPeerRecord, peer.PeerRecordEnvelopeDomain)
+		if err != nil {
+			log.Debugw("ignoring invalid registration", "namespace", reg.Ns, "error", err)
+			continue
+		}
+		prec, ok := rec.(*peer.PeerRecord)
+		if !ok {
+			continue
+		}
+		regs = append(regs, Registration{
+			Peer: peer.AddrInfo{ID: prec.PeerID, Addrs: prec.Addrs},
+			Ns:   reg.Ns,
+			TTL:  time.Duration(reg.Ttl) * time.Second,
+		})
+	}
+	return regs, r.Cookie, nil
+}
+
+// request sends the request to the rendezvous point, and reads its response
+// of the given type.
+func (rp *RendezvousPoint) request(ctx context.Context, req *pb.Message, respType pb.Message_MessageType) (*pb.Message, error) {
+	s, err := rp.h.NewStream(ctx, rp.p, ProtocolID)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = s.SetDeadline(deadline)
+	}
+
+	if err := protoio.NewDelimitedWriter(s).WriteMsg(req); err != nil {
+		s.Reset()
+		return nil, err
+	}
+	var resp pb.Message
+	if err := protoio.NewDelimitedReader(s, maxMessageSize).ReadMsg(&resp); err != nil {
+		s.Reset()
+		return nil, err
+	}
+	if resp.Type != respType {
+		return nil, fmt.Errorf("unexpected response type %s", resp.Type)
+	}
+	return &resp, nil
+}
+
+// signedRecord returns a signed peer record of our current addresses.
+func (rp *RendezvousPoint) signedRecord() ([]byte, error) {
+	sk := rp.h.Peerstore().PrivKey(rp.h.ID())
+	if sk == nil {
+		return nil, errors.New("missing our private key")
+	}
+	addrs := rp.h.Addrs()
+	if len(addrs) == 0 {
+		return nil, errors.New("no addresses to register")
+	}
+	env, err := record.Seal(peer.PeerRecordFromAddrInfo(peer.AddrInfo{ID: rp.h.ID(), Addrs: addrs}), sk)
+	if err != nil {
+		return nil, err
+	}
+	return env.Marshal()
+}
@@ -0,0 +1,87 @@
+package rendezvous
+
+import (
+	"context"
+	"time"
+
+	coredisc "github.com/libp2p/go-libp2p-core/discovery"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// RendezvousDiscovery implements the discovery.Discovery interface with a
+// rendezvous point.
+type RendezvousDiscovery struct {
+	rp *RendezvousPoint
+}
+
+var _ coredisc.Discovery = (*RendezvousDiscovery)(nil)
+
+// NewRendezvousDiscovery returns a discovery.Discovery registering at, and
+// discovering peers through, the rendezvous point p.
+func NewRendezvousDiscovery(h host.Host, p peer.ID) *RendezvousDiscovery {
+	return &RendezvousDiscovery{rp: NewRendezvousPoint(h, p)}
+}
+
+// Advertise registers us in the namespace for the TTL given by the
+// discovery.TTL option, DefaultTTL by default, capped at MaxTTL.
+func (d *RendezvousDiscovery) Advertise(ctx context.Context, ns string, opts ...coredisc.Option) (time.Duration, error) {
+	var options coredisc.Options
+	if err := options.Apply(opts...); err != nil {
+		return 0, err
+	}
+	ttl := options.Ttl
+	if ttl > MaxTTL {
+		ttl = MaxTTL
+	}
+	return d.rp.Register(ctx, ns, ttl)
+}
+
+// FindPeers returns the peers registered in the namespace, up to the number
+// given by the discovery.Limit option. We don't return ourselves.
+func (d *RendezvousDiscovery) FindPeers(ctx context.Context, ns string, opts ...coredisc.Option) (<-chan peer.AddrInfo, error) {
+	var options coredisc.Options
+	if err := options.Apply(opts...); err != nil {
+		return nil, err
+	}
+
+	// fetch the first page synchronously, to return errors.
+	regs, cookie, err := d.rp.Discover(ctx, ns, options.Limit, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan peer.AddrInfo)
+	go func() {
+		defer close(out)
+		found := 0
+		for {
+			for _, reg := range regs {
+				if reg.Peer.ID == d.rp.h.ID() {
+					continue
+				}
+				select {
+				case out <- reg.Peer:
+				case <-ctx.Done():
+					return
+				}
+				if found++; options.Limit > 0 && found >= options.Limit {
+					return
+				}
+			}
+			if len(regs) == 0 {
+				return
+			}
+			limit := 0
+			if options.Limit > 0 {
+				limit = options.Limit - found
+			}
+			regs, cookie, err = d.rp.Discover(ctx, ns, limit, cookie)
+			if err != nil {
+				log.Debugw("failed to discover peers", "namespace", ns, "error", err)
+				return
+			}
+		}
+	}()
+	return out, nil
+}
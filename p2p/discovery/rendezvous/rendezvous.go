@@ -0,0 +1,77 @@
+// Package rendezvous implements the libp2p rendezvous protocol: peers register
+// in namespaces at a rendezvous point, a peer they all know, and discover each
+// other by asking it for the registrations of a namespace. Unlike mDNS, it
+// works across networks, and unlike the DHT, it doesn't need peers to be
+// publicly reachable, so that apps behind NAT can find each other.
+//
+// Service is the rendezvous point, RendezvousPoint the client, and
+// RendezvousDiscovery implements the discovery.Discovery interface with it.
+package rendezvous
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	pb "github.com/libp2p/go-libp2p/p2p/discovery/rendezvous/pb"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+var log = logging.Logger("rendezvous")
+
+// ProtocolID is the protocol rendezvous points serve.
+const ProtocolID = "/rendezvous/1.0.0"
+
+const (
+	// DefaultTTL is the TTL of registrations that don't ask for one.
+	DefaultTTL = 2 * time.Hour
+	// MaxTTL is the maximum TTL of registrations.
+	MaxTTL = 72 * time.Hour
+	// MaxNamespaceLength is the maximum length of namespaces.
+	MaxNamespaceLength = 255
+	// MaxPeerRecordSize is the maximum size of the signed peer records peers
+	// register with.
+	MaxPeerRecordSize = 4 << 10
+	// MaxDiscoverLimit is the maximum number of registrations returned at
+	// once.
+	MaxDiscoverLimit = 1000
+)
+
+// maxMessageSize is the maximum size of the messages we read. Discover
+// responses are the largest ones.
+const maxMessageSize = MaxDiscoverLimit * (MaxPeerRecordSize + MaxNamespaceLength + 16)
+
+// Registration is a peer registered in a namespace.
+type Registration struct {
+	Peer peer.AddrInfo
+	Ns   string
+	// TTL is how long the registration is valid for, as of its discovery.
+	TTL time.Duration
+}
+
+// Error is the error a rendezvous point responds with.
+type Error struct {
+	Status pb.Message_ResponseStatus
+	Text   string
+}
+
+func (e *Error) Error() string {
+	if e.Text == "" {
+		return fmt.Sprintf("rendezvous error: %s", e.Status)
+	}
+	return fmt.Sprintf("rendezvous error: %s: %s", e.Status, e.Text)
+}
+
+// checkNamespace returns an error if the namespace isn't valid. The empty
+// namespace is only valid when discovering, standing for all namespaces.
+func checkNamespace(ns string, discover bool) *Error {
+	if ns == "" && !discover {
+		return &Error{Status: pb.Message_E_INVALID_NAMESPACE, Text: "empty namespace"}
+	}
+	if len(ns) > MaxNamespaceLength {
+		return &Error{Status: pb.Message_E_INVALID_NAMESPACE, Text: "namespace too long"}
+	}
+	return nil
+}
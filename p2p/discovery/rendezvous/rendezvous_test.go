@@ -0,0 +1,111 @@
+package rendezvous
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	ic "github.com/libp2p/go-libp2p-core/crypto"
+	coredisc "github.com/libp2p/go-libp2p-core/discovery"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/test"
+
+	pb "github.com/libp2p/go-libp2p/p2p/discovery/rendezvous/pb"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+// newHosts returns n connected mock hosts. Mock hosts' default keys can't be
+// marshaled, so that they can't sign peer records.
+func newHosts(ctx context.Context, t *testing.T, n int) []host.Host {
+	mn := mocknet.New(ctx)
+	for i := 0; i < n; i++ {
+		sk, _, err := test.RandTestKeyPair(ic.Ed25519, 0)
+		require.NoError(t, err)
+		_, err = mn.AddPeer(sk, ma.StringCast(fmt.Sprintf("/ip4/1.2.3.%d/tcp/4001", i+1)))
+		require.NoError(t, err)
+	}
+	require.NoError(t, mn.LinkAll())
+	require.NoError(t, mn.ConnectAllButSelf())
+	return mn.Hosts()
+}
+
+func TestRendezvous(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := newHosts(ctx, t, 4)
+	svc := NewService(hosts[0])
+	defer svc.Close()
+
+	clients := make([]*RendezvousPoint, len(hosts))
+	for i := 1; i < len(hosts); i++ {
+		clients[i] = NewRendezvousPoint(hosts[i], hosts[0].ID())
+	}
+
+	ttl, err := clients[1].Register(ctx, "ns", 0)
+	require.NoError(t, err)
+	require.Equal(t, DefaultTTL, ttl)
+	ttl, err = clients[2].Register(ctx, "ns", time.Hour)
+	require.NoError(t, err)
+	require.Equal(t, time.Hour, ttl)
+
+	regs, cookie, err := clients[3].Discover(ctx, "ns", 1, nil)
+	require.NoError(t, err)
+	require.Len(t, regs, 1)
+	require.Equal(t, hosts[1].ID(), regs[0].Peer.ID)
+	require.Equal(t, hosts[1].Addrs(), regs[0].Peer.Addrs)
+	require.Equal(t, "ns", regs[0].Ns)
+	regs, cookie, err = clients[3].Discover(ctx, "ns", 0, cookie)
+	require.NoError(t, err)
+	require.Len(t, regs, 1)
+	require.Equal(t, hosts[2].ID(), regs[0].Peer.ID)
+
+	require.NoError(t, clients[1].Unregister(ctx, "ns"))
+	require.Eventually(t, func() bool {
+		regs, _, err := clients[3].Discover(ctx, "ns", 0, nil)
+		return err == nil && len(regs) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	var rerr *Error
+	_, err = clients[1].Register(ctx, "ns", MaxTTL+time.Second)
+	require.Error(t, err)
+	_, _, err = clients[3].Discover(ctx, "other", 0, cookie)
+	require.True(t, errors.As(err, &rerr))
+	require.Equal(t, pb.Message_E_INVALID_COOKIE, rerr.Status)
+}
+
+func TestRendezvousDiscovery(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hosts := newHosts(ctx, t, 4)
+	svc := NewService(hosts[0])
+	defer svc.Close()
+
+	for i := 1; i < len(hosts); i++ {
+		d := NewRendezvousDiscovery(hosts[i], hosts[0].ID())
+		ttl, err := d.Advertise(ctx, "ns", coredisc.TTL(time.Hour))
+		require.NoError(t, err)
+		require.Equal(t, time.Hour, ttl)
+	}
+
+	find := func(opts ...coredisc.Option) []peer.ID {
+		d := NewRendezvousDiscovery(hosts[1], hosts[0].ID())
+		ch, err := d.FindPeers(ctx, "ns", opts...)
+		require.NoError(t, err)
+		var found []peer.ID
+		for pi := range ch {
+			found = append(found, pi.ID)
+		}
+		return found
+	}
+	// we don't find ourselves.
+	require.Equal(t, []peer.ID{hosts[2].ID(), hosts[3].ID()}, find())
+	require.Equal(t, []peer.ID{hosts[2].ID()}, find(coredisc.Limit(1)))
+}
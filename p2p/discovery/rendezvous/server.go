@@ -0,0 +1,202 @@
+package rendezvous
+
+import (
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/record"
+
+	pb "github.com/libp2p/go-libp2p/p2p/discovery/rendezvous/pb"
+
+	"github.com/libp2p/go-msgio/protoio"
+)
+
+// streamTimeout is how long we wait for the next request on a stream.
+const streamTimeout = time.Minute
+
+type config struct {
+	maxRegistrations int
+}
+
+// Option is an option for the Service.
+type Option func(*config)
+
+// MaxRegistrations sets the maximum number of namespaces a peer can be
+// registered in at once. Defaults to 1000, zero meaning no limit.
+func MaxRegistrations(n int) Option {
+	return func(cfg *config) {
+		cfg.maxRegistrations = n
+	}
+}
+
+// Service is a rendezvous point, serving ProtocolID. It keeps the
+// registrations in memory, so that they're lost on restart: peers register
+// again when their registration expires anyway.
+type Service struct {
+	h  host.Host
+	st *storage
+}
+
+// NewService constructs a new rendezvous point for the given host.
+func NewService(h host.Host, opts ...Option) *Service {
+	cfg := config{maxRegistrations: 1000}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	s := &Service{
+		h:  h,
+		st: newStorage(cfg.maxRegistrations),
+	}
+	h.SetStreamHandler(ProtocolID, s.handleStream)
+	return s
+}
+
+// Close stops serving ProtocolID.
+func (s *Service) Close() error {
+	s.h.RemoveStreamHandler(ProtocolID)
+	return nil
+}
+
+func (s *Service) handleStream(str network.Stream) {
+	defer str.Close()
+
+	p := str.Conn().RemotePeer()
+	r := protoio.NewDelimitedReader(str, maxMessageSize)
+	w := protoio.NewDelimitedWriter(str)
+	for {
+		_ = str.SetReadDeadline(time.Now().Add(streamTimeout))
+		var req pb.Message
+		if err := r.ReadMsg(&req); err != nil {
+			return
+		}
+
+		var resp *pb.Message
+		switch req.Type {
+		case pb.Message_REGISTER:
+			resp = s.handleRegister(p, req.Register)
+		case pb.Message_UNREGISTER:
+			s.handleUnregister(p, req.Unregister)
+			continue
+		case pb.Message_DISCOVER:
+			resp = s.handleDiscover(req.Discover)
+		default:
+			log.Debugw("unexpected rendezvous message", "peer", p, "type", req.Type)
+			str.Reset()
+			return
+		}
+		if err := w.WriteMsg(resp); err != nil {
+			log.Debugw("failed to write rendezvous response", "peer", p, "error", err)
+			str.Reset()
+			return
+		}
+	}
+}
+
+func (s *Service) handleRegister(p peer.ID, req *pb.Message_Register) *pb.Message {
+	fail := func(status pb.Message_ResponseStatus, text string) *pb.Message {
+		log.Debugw("rejecting rendezvous registration", "peer", p, "status", status, "reason", text)
+		return &pb.Message{
+			Type:             pb.Message_REGISTER_RESPONSE,
+			RegisterResponse: &pb.Message_RegisterResponse{Status: status, StatusText: text},
+		}
+	}
+	if req == nil {
+		return fail(pb.Message_E_INTERNAL_ERROR, "missing register message")
+	}
+	if e := checkNamespace(req.Ns, false); e != nil {
+		return fail(e.Status, e.Text)
+	}
+
+	ttl := DefaultTTL
+	if req.Ttl > 0 {
+		if req.Ttl > uint64(MaxTTL/time.Second) {
+			return fail(pb.Message_E_INVALID_TTL, "ttl too long")
+		}
+		ttl = time.Duration(req.Ttl) * time.Second
+	}
+
+	if len(req.SignedPeerRecord) > MaxPeerRecordSize {
+		return fail(pb.Message_E_INVALID_SIGNED_PEER_RECORD, "signed peer record too large")
+	}
+	_, rec, err := record.ConsumeEnvelope(req.SignedPeerRecord, peer.PeerRecordEnvelopeDomain)
+	if err != nil {
+		return fail(pb.Message_E_INVALID_SIGNED_PEER_RECORD, err.Error())
+	}
+	prec, ok := rec.(*peer.PeerRecord)
+	if !ok {
+		return fail(pb.Message_E_INVALID_SIGNED_PEER_RECORD, "not a peer record")
+	}
+	if prec.PeerID != p {
+		return fail(pb.Message_E_NOT_AUTHORIZED, "peer record of another peer")
+	}
+	if len(prec.Addrs) == 0 {
+		return fail(pb.Message_E_INVALID_SIGNED_PEER_RECORD, "peer record without addresses")
+	}
+
+	if err := s.st.register(req.Ns, p, req.SignedPeerRecord, ttl); err != nil {
+		return fail(pb.Message_E_NOT_AUTHORIZED, err.Error())
+	}
+	log.Debugw("registered peer", "peer", p, "namespace", req.Ns, "ttl", ttl)
+	return &pb.Message{
+		Type: pb.Message_REGISTER_RESPONSE,
+		RegisterResponse: &pb.Message_RegisterResponse{
+			Status: pb.Message_OK,
+			Ttl:    uint64(ttl / time.Second),
+		},
+	}
+}
+
+func (s *Service) handleUnregister(p peer.ID, req *pb.Message_Unregister) {
+	if req == nil || checkNamespace(req.Ns, false) != nil {
+		return
+	}
+	if len(req.Id) > 0 {
+		id, err := peer.IDFromBytes(req.Id)
+		if err != nil || id != p {
+			log.Debugw("ignoring unregistration of another peer", "peer", p)
+			return
+		}
+	}
+	s.st.unregister(req.Ns, p)
+	log.Debugw("unregistered peer", "peer", p, "namespace", req.Ns)
+}
+
+func (s *Service) handleDiscover(req *pb.Message_Discover) *pb.Message {
+	fail := func(status pb.Message_ResponseStatus, text string) *pb.Message {
+		return &pb.Message{
+			Type:             pb.Message_DISCOVER_RESPONSE,
+			DiscoverResponse: &pb.Message_DiscoverResponse{Status: status, StatusText: text},
+		}
+	}
+	if req == nil {
+		return fail(pb.Message_E_INTERNAL_ERROR, "missing discover message")
+	}
+	if e := checkNamespace(req.Ns, true); e != nil {
+		return fail(e.Status, e.Text)
+	}
+	limit := MaxDiscoverLimit
+	if req.Limit > 0 && req.Limit < MaxDiscoverLimit {
+		limit = int(req.Limit)
+	}
+
+	regs, cookie, err := s.st.discover(req.Ns, limit, req.Cookie)
+	if err != nil {
+		return fail(pb.Message_E_INVALID_COOKIE, err.Error())
+	}
+	now := s.st.now()
+	resp := &pb.Message_DiscoverResponse{
+		Status:        pb.Message_OK,
+		Cookie:        cookie,
+		Registrations: make([]*pb.Message_Register, 0, len(regs)),
+	}
+	for _, r := range regs {
+		resp.Registrations = append(resp.Registrations, &pb.Message_Register{
+			Ns:               r.ns,
+			SignedPeerRecord: r.record,
+			Ttl:              uint64(r.expiry.Sub(now) / time.Second),
+		})
+	}
+	return &pb.Message{Type: pb.Message_DISCOVER_RESPONSE, DiscoverResponse: resp}
+}
@@ -0,0 +1,168 @@
+package rendezvous
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// errTooManyRegistrations is returned when a peer registers in more
+// namespaces than allowed, see MaxRegistrations.
+var errTooManyRegistrations = errors.New("too many registrations")
+
+var errInvalidCookie = errors.New("invalid cookie")
+
+// registration is a registration in the storage of a rendezvous point.
+type registration struct {
+	ns     string
+	peer   peer.ID
+	record []byte
+	expiry time.Time
+	// seq orders the registrations, see storage.discover.
+	seq uint64
+}
+
+// storage keeps the registrations of a rendezvous point in memory.
+//
+// Every registration gets a sequence number higher than all the previous ones,
+// so that discovering peers can page through the registrations: the cookie
+// returned with a page holds the sequence number of its last registration,
+// the next page starts after it. Registering again moves a registration to the
+// end, so that peers already past it see it again.
+type storage struct {
+	maxRegistrations int
+	now              func() time.Time
+
+	mu   sync.Mutex
+	seq  uint64
+	byNs map[string]map[peer.ID]*registration
+	// count is the number of namespaces each peer is registered in.
+	count map[peer.ID]int
+}
+
+func newStorage(maxRegistrations int) *storage {
+	return &storage{
+		maxRegistrations: maxRegistrations,
+		now:              time.Now,
+		byNs:             make(map[string]map[peer.ID]*registration),
+		count:            make(map[peer.ID]int),
+	}
+}
+
+// register registers the peer in the namespace, replacing its previous
+// registration there.
+func (st *storage) register(ns string, p peer.ID, record []byte, ttl time.Duration) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	now := st.now()
+	st.expire(ns, now)
+	regs := st.byNs[ns]
+	if _, ok := regs[p]; !ok {
+		if st.maxRegistrations > 0 && st.count[p] >= st.maxRegistrations {
+			// the peer's registrations elsewhere may have expired.
+			for other := range st.byNs {
+				st.expire(other, now)
+			}
+			if st.count[p] >= st.maxRegistrations {
+				return errTooManyRegistrations
+			}
+		}
+		if regs == nil {
+			regs = make(map[peer.ID]*registration)
+			st.byNs[ns] = regs
+		}
+		st.count[p]++
+	}
+	st.seq++
+	regs[p] = &registration{
+		ns:     ns,
+		peer:   p,
+		record: record,
+		expiry: now.Add(ttl),
+		seq:    st.seq,
+	}
+	return nil
+}
+
+// unregister removes the registration of the peer in the namespace, if any.
+func (st *storage) unregister(ns string, p peer.ID) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if _, ok := st.byNs[ns][p]; ok {
+		st.remove(ns, p)
+	}
+}
+
+// discover returns up to limit registrations of the namespace, of all
+// namespaces if empty, following the ones the cookie was returned with, and
+// the cookie to get the next ones with.
+func (st *storage) discover(ns string, limit int, cookie []byte) ([]*registration, []byte, error) {
+	var after uint64
+	if len(cookie) > 0 {
+		if len(cookie) < 8 || string(cookie[8:]) != ns {
+			return nil, nil, errInvalidCookie
+		}
+		after = binary.BigEndian.Uint64(cookie)
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	now := st.now()
+	var regs []*registration
+	collect := func(ns string) {
+		st.expire(ns, now)
+		for _, r := range st.byNs[ns] {
+			if r.seq > after {
+				regs = append(regs, r)
+			}
+		}
+	}
+	if ns == "" {
+		for ns := range st.byNs {
+			collect(ns)
+		}
+	} else {
+		collect(ns)
+	}
+	sort.Slice(regs, func(i, j int) bool { return regs[i].seq < regs[j].seq })
+	if len(regs) > limit {
+		regs = regs[:limit]
+	}
+
+	if len(regs) > 0 {
+		after = regs[len(regs)-1].seq
+	}
+	next := make([]byte, 8+len(ns))
+	binary.BigEndian.PutUint64(next, after)
+	copy(next[8:], ns)
+	return regs, next, nil
+}
+
+// expire removes the expired registrations of the namespace. st.mu must be
+// held.
+func (st *storage) expire(ns string, now time.Time) {
+	for p, r := range st.byNs[ns] {
+		if !now.Before(r.expiry) {
+			st.remove(ns, p)
+		}
+	}
+}
+
+// remove removes the registration of the peer in the namespace. st.mu must be
+// held.
+func (st *storage) remove(ns string, p peer.ID) {
+	regs := st.byNs[ns]
+	delete(regs, p)
+	if len(regs) == 0 {
+		delete(st.byNs, ns)
+	}
+	if st.count[p]--; st.count[p] <= 0 {
+		delete(st.count, p)
+	}
+}
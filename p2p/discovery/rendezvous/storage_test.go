@@ -0,0 +1,92 @@
+package rendezvous
+
+import (
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/test"
+
+	"github.com/stretchr/testify/require"
+)
+
+func randPeers(t *testing.T, n int) []peer.ID {
+	peers := make([]peer.ID, n)
+	for i := range peers {
+		p, err := test.RandPeerID()
+		require.NoError(t, err)
+		peers[i] = p
+	}
+	return peers
+}
+
+func discoveredPeers(regs []*registration) []peer.ID {
+	peers := make([]peer.ID, len(regs))
+	for i, r := range regs {
+		peers[i] = r.peer
+	}
+	return peers
+}
+
+func TestStoragePagination(t *testing.T) {
+	st := newStorage(0)
+	peers := randPeers(t, 3)
+	for _, p := range peers {
+		require.NoError(t, st.register("ns", p, nil, time.Hour))
+	}
+	require.NoError(t, st.register("other", peers[0], nil, time.Hour))
+
+	regs, cookie, err := st.discover("ns", 2, nil)
+	require.NoError(t, err)
+	require.Equal(t, peers[:2], discoveredPeers(regs))
+	regs, cookie, err = st.discover("ns", 2, cookie)
+	require.NoError(t, err)
+	require.Equal(t, peers[2:], discoveredPeers(regs))
+	regs, cookie, err = st.discover("ns", 2, cookie)
+	require.NoError(t, err)
+	require.Empty(t, regs)
+
+	// registering again moves the registration past the cookie.
+	require.NoError(t, st.register("ns", peers[1], nil, time.Hour))
+	regs, _, err = st.discover("ns", 2, cookie)
+	require.NoError(t, err)
+	require.Equal(t, peers[1:2], discoveredPeers(regs))
+
+	// all namespaces.
+	regs, _, err = st.discover("", 10, nil)
+	require.NoError(t, err)
+	require.Len(t, regs, 4)
+
+	// cookies are bound to their namespace.
+	_, _, err = st.discover("other", 2, cookie)
+	require.Equal(t, errInvalidCookie, err)
+	_, _, err = st.discover("ns", 2, []byte("short"))
+	require.Equal(t, errInvalidCookie, err)
+}
+
+func TestStorageExpiry(t *testing.T) {
+	now := time.Now()
+	st := newStorage(2)
+	st.now = func() time.Time { return now }
+	peers := randPeers(t, 2)
+
+	require.NoError(t, st.register("a", peers[0], nil, time.Minute))
+	require.NoError(t, st.register("b", peers[0], nil, time.Hour))
+	require.Equal(t, errTooManyRegistrations, st.register("c", peers[0], nil, time.Hour))
+	// registering again in a namespace doesn't count.
+	require.NoError(t, st.register("a", peers[0], nil, time.Minute))
+	require.NoError(t, st.register("a", peers[1], nil, time.Hour))
+
+	now = now.Add(2 * time.Minute)
+	regs, _, err := st.discover("a", 10, nil)
+	require.NoError(t, err)
+	require.Equal(t, peers[1:], discoveredPeers(regs))
+	// the expired registration doesn't count anymore.
+	require.NoError(t, st.register("c", peers[0], nil, time.Hour))
+
+	st.unregister("b", peers[0])
+	st.unregister("c", peers[0])
+	st.unregister("a", peers[1])
+	require.Empty(t, st.byNs)
+	require.Empty(t, st.count)
+}
@@ -0,0 +1,289 @@
+// Package static discovers peers from a static set, e.g. the members of a
+// permissioned cluster listed in the configuration, for networks running
+// neither a DHT nor mDNS. The peers are periodically health checked, and only
+// the live ones are returned by FindPeers.
+package static
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	coredisc "github.com/libp2p/go-libp2p-core/discovery"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/libp2p/go-libp2p/p2p/protocol/identify"
+	"github.com/libp2p/go-libp2p/p2p/protocol/ping"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+var log = logging.Logger("discovery-static")
+
+const (
+	// DefaultCheckInterval is how often peers are health checked by default.
+	DefaultCheckInterval = 30 * time.Second
+	// DefaultCheckTimeout is how long a health check may take by default.
+	DefaultCheckTimeout = 10 * time.Second
+	// DefaultMaxFailures is the number of consecutive failed health checks
+	// after which a peer is considered dead by default.
+	DefaultMaxFailures = 2
+)
+
+// HealthCheck checks whether a peer is live, returning an error if it's not.
+type HealthCheck func(ctx context.Context, h host.Host, pi peer.AddrInfo) error
+
+// PingCheck connects to the peer and pings it once. It's the default health
+// check.
+func PingCheck(ctx context.Context, h host.Host, pi peer.AddrInfo) error {
+	if err := h.Connect(ctx, pi); err != nil {
+		return err
+	}
+	select {
+	case res := <-ping.Ping(ctx, h, pi.ID):
+		return res.Error
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// IdentifyCheck connects to the peer and waits for the identify protocol to
+// complete on the connection, for peers that don't run the ping protocol. If
+// the host doesn't expose its identify service, connecting is enough.
+func IdentifyCheck(ctx context.Context, h host.Host, pi peer.AddrInfo) error {
+	if err := h.Connect(ctx, pi); err != nil {
+		return err
+	}
+	ih, ok := h.(interface{ IDService() *identify.IDService })
+	if !ok {
+		return nil
+	}
+	conns := h.Network().ConnsToPeer(pi.ID)
+	if len(conns) == 0 {
+		return errors.New("disconnected")
+	}
+	select {
+	case res := <-ih.IDService().IdentifyWaitResult(conns[0]):
+		return res.Err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type config struct {
+	check       HealthCheck
+	interval    time.Duration
+	timeout     time.Duration
+	maxFailures int
+}
+
+// Option is an option for New.
+type Option func(*config)
+
+// WithHealthCheck sets the health check of the peers. Defaults to PingCheck.
+func WithHealthCheck(check HealthCheck) Option {
+	return func(cfg *config) {
+		cfg.check = check
+	}
+}
+
+// CheckInterval sets how often peers are health checked. Defaults to
+// DefaultCheckInterval.
+func CheckInterval(d time.Duration) Option {
+	return func(cfg *config) {
+		cfg.interval = d
+	}
+}
+
+// CheckTimeout sets how long a health check may take before it fails.
+// Defaults to DefaultCheckTimeout.
+func CheckTimeout(d time.Duration) Option {
+	return func(cfg *config) {
+		cfg.timeout = d
+	}
+}
+
+// MaxFailures sets the number of consecutive failed health checks after which
+// a live peer is considered dead, so that a single lost ping doesn't hide it.
+// Defaults to DefaultMaxFailures.
+func MaxFailures(n int) Option {
+	return func(cfg *config) {
+		cfg.maxFailures = n
+	}
+}
+
+// Discovery health checks a static set of peers, and returns the live ones
+// through FindPeers. Peers are live once a health check succeeded, until
+// MaxFailures consecutive checks fail.
+type Discovery struct {
+	h     host.Host
+	cfg   config
+	peers []peer.AddrInfo
+
+	ctx       context.Context
+	ctxCancel context.CancelFunc
+	refCount  sync.WaitGroup
+	// checked is closed once all peers were checked once.
+	checked chan struct{}
+
+	mu     sync.Mutex
+	states map[peer.ID]*peerState
+}
+
+var _ coredisc.Discoverer = (*Discovery)(nil)
+
+type peerState struct {
+	live     bool
+	failures int
+}
+
+// New constructs a new Discovery of the given peers, and starts health
+// checking them in the background.
+func New(h host.Host, peers []peer.AddrInfo, opts ...Option) (*Discovery, error) {
+	cfg := config{
+		check:       PingCheck,
+		interval:    DefaultCheckInterval,
+		timeout:     DefaultCheckTimeout,
+		maxFailures: DefaultMaxFailures,
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.interval <= 0 || cfg.timeout <= 0 {
+		return nil, errors.New("health check interval and timeout must be positive")
+	}
+	if cfg.maxFailures < 1 {
+		return nil, errors.New("max failures must be at least one")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &Discovery{
+		h:         h,
+		cfg:       cfg,
+		ctx:       ctx,
+		ctxCancel: cancel,
+		checked:   make(chan struct{}),
+		states:    make(map[peer.ID]*peerState),
+	}
+	for _, pi := range peers {
+		if pi.ID == h.ID() {
+			continue
+		}
+		if _, ok := d.states[pi.ID]; ok {
+			continue
+		}
+		d.peers = append(d.peers, pi)
+		d.states[pi.ID] = &peerState{}
+	}
+	d.refCount.Add(1)
+	go d.background()
+	return d, nil
+}
+
+func (d *Discovery) background() {
+	defer d.refCount.Done()
+
+	ticker := time.NewTicker(d.cfg.interval)
+	defer ticker.Stop()
+
+	d.checkAll()
+	close(d.checked)
+	for {
+		select {
+		case <-ticker.C:
+			d.checkAll()
+		case <-d.ctx.Done():
+			return
+		}
+	}
+}
+
+// checkAll health checks all peers concurrently.
+func (d *Discovery) checkAll() {
+	var wg sync.WaitGroup
+	for _, pi := range d.peers {
+		wg.Add(1)
+		go func(pi peer.AddrInfo) {
+			defer wg.Done()
+			d.check(pi)
+		}(pi)
+	}
+	wg.Wait()
+}
+
+func (d *Discovery) check(pi peer.AddrInfo) {
+	ctx, cancel := context.WithTimeout(d.ctx, d.cfg.timeout)
+	defer cancel()
+	err := d.cfg.check(ctx, d.h, pi)
+	if d.ctx.Err() != nil {
+		// closed, the check didn't fail.
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s := d.states[pi.ID]
+	if err == nil {
+		if !s.live {
+			log.Debugw("static peer is live", "peer", pi.ID)
+		}
+		s.live = true
+		s.failures = 0
+		return
+	}
+	s.failures++
+	if s.live && s.failures >= d.cfg.maxFailures {
+		log.Debugw("static peer is dead", "peer", pi.ID, "error", err)
+		s.live = false
+	}
+}
+
+// Live returns the live peers, in the order they were given.
+func (d *Discovery) Live() []peer.AddrInfo {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var live []peer.AddrInfo
+	for _, pi := range d.peers {
+		if d.states[pi.ID].live {
+			live = append(live, pi)
+		}
+	}
+	return live
+}
+
+// FindPeers returns the live peers, up to the number given by the
+// discovery.Limit option. It waits for the first health checks to complete.
+// Static peers aren't namespaced, so that the namespace is ignored.
+func (d *Discovery) FindPeers(ctx context.Context, _ string, opts ...coredisc.Option) (<-chan peer.AddrInfo, error) {
+	var options coredisc.Options
+	if err := options.Apply(opts...); err != nil {
+		return nil, err
+	}
+	select {
+	case <-d.checked:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-d.ctx.Done():
+		return nil, errors.New("static discovery closed")
+	}
+
+	peers := d.Live()
+	if options.Limit > 0 && len(peers) > options.Limit {
+		peers = peers[:options.Limit]
+	}
+	out := make(chan peer.AddrInfo, len(peers))
+	for _, pi := range peers {
+		out <- pi
+	}
+	close(out)
+	return out, nil
+}
+
+// Close stops health checking.
+func (d *Discovery) Close() error {
+	d.ctxCancel()
+	d.refCount.Wait()
+	return nil
+}
@@ -0,0 +1,120 @@
+package static
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	coredisc "github.com/libp2p/go-libp2p-core/discovery"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/test"
+
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/libp2p/go-libp2p/p2p/protocol/ping"
+
+	"github.com/stretchr/testify/require"
+)
+
+func collect(t *testing.T, d *Discovery, opts ...coredisc.Option) []peer.ID {
+	ch, err := d.FindPeers(context.Background(), "ns", opts...)
+	require.NoError(t, err)
+	var found []peer.ID
+	for pi := range ch {
+		found = append(found, pi.ID)
+	}
+	return found
+}
+
+func TestStaticPing(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn, err := mocknet.FullMeshLinked(ctx, 3)
+	require.NoError(t, err)
+	hosts := mn.Hosts()
+	for _, h := range hosts[1:] {
+		ping.NewPingService(h)
+	}
+	dead, err := test.RandPeerID()
+	require.NoError(t, err)
+
+	peers := []peer.AddrInfo{
+		{ID: hosts[1].ID(), Addrs: hosts[1].Addrs()},
+		{ID: dead},
+		{ID: hosts[2].ID(), Addrs: hosts[2].Addrs()},
+		// ourselves, and duplicates, are ignored.
+		{ID: hosts[0].ID(), Addrs: hosts[0].Addrs()},
+		{ID: hosts[1].ID(), Addrs: hosts[1].Addrs()},
+	}
+	d, err := New(hosts[0], peers, CheckInterval(time.Hour), CheckTimeout(time.Second))
+	require.NoError(t, err)
+	defer d.Close()
+
+	require.Equal(t, []peer.ID{hosts[1].ID(), hosts[2].ID()}, collect(t, d))
+	require.Equal(t, []peer.ID{hosts[1].ID()}, collect(t, d, coredisc.Limit(1)))
+}
+
+func TestStaticMaxFailures(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn, err := mocknet.FullMeshLinked(ctx, 2)
+	require.NoError(t, err)
+	hosts := mn.Hosts()
+
+	var (
+		mu      sync.Mutex
+		healthy = true
+		checks  = make(chan struct{}, 10)
+	)
+	check := func(context.Context, host.Host, peer.AddrInfo) error {
+		mu.Lock()
+		defer mu.Unlock()
+		defer func() { checks <- struct{}{} }()
+		if !healthy {
+			return errors.New("unhealthy")
+		}
+		return nil
+	}
+	d, err := New(hosts[0], []peer.AddrInfo{{ID: hosts[1].ID()}},
+		WithHealthCheck(check), CheckInterval(time.Hour), MaxFailures(2))
+	require.NoError(t, err)
+	defer d.Close()
+	require.Equal(t, []peer.ID{hosts[1].ID()}, collect(t, d))
+	<-checks
+
+	mu.Lock()
+	healthy = false
+	mu.Unlock()
+	// a single failure doesn't hide the peer.
+	d.checkAll()
+	<-checks
+	require.Len(t, d.Live(), 1)
+	d.checkAll()
+	<-checks
+	require.Empty(t, d.Live())
+
+	mu.Lock()
+	healthy = true
+	mu.Unlock()
+	d.checkAll()
+	<-checks
+	require.Len(t, d.Live(), 1)
+}
+
+func TestStaticOptions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn, err := mocknet.FullMeshLinked(ctx, 1)
+	require.NoError(t, err)
+	h := mn.Hosts()[0]
+
+	_, err = New(h, nil, CheckInterval(0))
+	require.Error(t, err)
+	_, err = New(h, nil, MaxFailures(0))
+	require.Error(t, err)
+}
@@ -0,0 +1,116 @@
+// Package addrmap translates the internal addresses a host listens on to the
+// external addresses it's reachable at, for hosts running in containers or
+// cloud environments where the mapping is known up front: static port
+// mappings, like hostPort mappings in Kubernetes, or the public IP of a cloud
+// instance, as told by its metadata service.
+//
+// Hosts advertise the external addresses their listen addresses translate to
+// along with them, in identify and in their signed peer records, see the
+// libp2p.AddrTranslator option.
+package addrmap
+
+import (
+	"sync"
+
+	logging "github.com/ipfs/go-log/v2"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+var log = logging.Logger("addrmap")
+
+// Translator maps internal addresses to external ones.
+type Translator interface {
+	// Translate returns the external addresses the given internal address
+	// is reachable at, if any.
+	Translate(internal ma.Multiaddr) []ma.Multiaddr
+	// Changed returns a channel signaled when the translation changed,
+	// for hosts to advertise the new external addresses right away.
+	Changed() <-chan struct{}
+}
+
+// Static translates addresses with mappings set up front, see Map.
+type Static struct {
+	mu sync.RWMutex
+	// internal address -> external addresses
+	mappings map[string][]ma.Multiaddr
+	// internal address without its IP -> external addresses, for
+	// internal addresses with an unspecified IP.
+	anyIP map[string][]ma.Multiaddr
+
+	changed chan struct{}
+}
+
+var _ Translator = (*Static)(nil)
+
+// NewStatic constructs a new Static translator without mappings.
+func NewStatic() *Static {
+	return &Static{
+		mappings: make(map[string][]ma.Multiaddr),
+		anyIP:    make(map[string][]ma.Multiaddr),
+		changed:  make(chan struct{}, 1),
+	}
+}
+
+// Map maps an internal address to an external one, e.g. the container
+// address /ip4/10.0.0.5/tcp/4001 to the node's address
+// /ip4/203.0.113.7/tcp/30001. An internal address with an unspecified IP,
+// like /ip4/0.0.0.0/tcp/4001, matches any address of its IP version with the
+// same transport and port. Internal addresses can be mapped to several
+// external ones.
+func (s *Static) Map(internal, external ma.Multiaddr) {
+	s.mu.Lock()
+	if ip, rest := ma.SplitFirst(internal); ip != nil && rest != nil && isUnspecified(ip) {
+		key := anyIPKey(ip, rest)
+		s.anyIP[key] = append(s.anyIP[key], external)
+	} else {
+		key := string(internal.Bytes())
+		s.mappings[key] = append(s.mappings[key], external)
+	}
+	s.mu.Unlock()
+	log.Debugw("mapped address", "internal", internal, "external", external)
+	signal(s.changed)
+}
+
+// Translate returns the external addresses the given internal address is
+// mapped to.
+func (s *Static) Translate(internal ma.Multiaddr) []ma.Multiaddr {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := append([]ma.Multiaddr(nil), s.mappings[string(internal.Bytes())]...)
+	if ip, rest := ma.SplitFirst(internal); ip != nil && rest != nil {
+		out = append(out, s.anyIP[anyIPKey(ip, rest)]...)
+	}
+	return out
+}
+
+// Changed returns a channel signaled when mappings are added.
+func (s *Static) Changed() <-chan struct{} {
+	return s.changed
+}
+
+func isUnspecified(ip *ma.Component) bool {
+	switch ip.Protocol().Code {
+	case ma.P_IP4, ma.P_IP6:
+		for _, b := range ip.RawValue() {
+			if b != 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// anyIPKey is the key of the addresses of the same IP version as ip, with the
+// given rest.
+func anyIPKey(ip *ma.Component, rest ma.Multiaddr) string {
+	return ip.Protocol().Name + string(rest.Bytes())
+}
+
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
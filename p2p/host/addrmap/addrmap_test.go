@@ -0,0 +1,104 @@
+package addrmap
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	ma "github.com/multiformats/go-multiaddr"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatic(t *testing.T) {
+	s := NewStatic()
+	require.Empty(t, s.Translate(ma.StringCast("/ip4/10.0.0.5/tcp/4001")))
+
+	ext1 := ma.StringCast("/ip4/203.0.113.7/tcp/30001")
+	ext2 := ma.StringCast("/ip4/203.0.113.7/udp/30001/quic")
+	ext3 := ma.StringCast("/ip6/2001:db8::7/tcp/30001")
+	s.Map(ma.StringCast("/ip4/10.0.0.5/tcp/4001"), ext1)
+	s.Map(ma.StringCast("/ip4/0.0.0.0/udp/4001/quic"), ext2)
+	s.Map(ma.StringCast("/ip6/::/tcp/4001"), ext3)
+	select {
+	case <-s.Changed():
+	default:
+		t.Fatal("expected a change")
+	}
+
+	require.Equal(t, []ma.Multiaddr{ext1}, s.Translate(ma.StringCast("/ip4/10.0.0.5/tcp/4001")))
+	require.Empty(t, s.Translate(ma.StringCast("/ip4/10.0.0.6/tcp/4001")))
+	require.Empty(t, s.Translate(ma.StringCast("/ip4/10.0.0.5/tcp/4002")))
+
+	// unspecified IPs match any IP of the same version.
+	require.Equal(t, []ma.Multiaddr{ext2}, s.Translate(ma.StringCast("/ip4/10.0.0.6/udp/4001/quic")))
+	require.Equal(t, []ma.Multiaddr{ext2}, s.Translate(ma.StringCast("/ip4/0.0.0.0/udp/4001/quic")))
+	require.Empty(t, s.Translate(ma.StringCast("/ip6/fd00::6/udp/4001/quic")))
+	require.Equal(t, []ma.Multiaddr{ext3}, s.Translate(ma.StringCast("/ip6/fd00::6/tcp/4001")))
+	require.Empty(t, s.Translate(ma.StringCast("/ip4/10.0.0.6/tcp/4001")))
+}
+
+func TestPublicIP(t *testing.T) {
+	var mu sync.Mutex
+	ip, err := net.ParseIP("203.0.113.7"), error(nil)
+	fetch := func(context.Context) (net.IP, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return ip, err
+	}
+	p := NewPublicIP(fetch, 50*time.Millisecond)
+	defer p.Close()
+
+	select {
+	case <-p.Changed():
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a change")
+	}
+	require.Equal(t,
+		[]ma.Multiaddr{ma.StringCast("/ip4/203.0.113.7/tcp/4001")},
+		p.Translate(ma.StringCast("/ip4/10.0.0.5/tcp/4001")),
+	)
+	// public, loopback, and addresses of an IP version we don't know the
+	// public IP of are left alone.
+	require.Empty(t, p.Translate(ma.StringCast("/ip4/1.2.3.4/tcp/4001")))
+	require.Empty(t, p.Translate(ma.StringCast("/ip4/127.0.0.1/tcp/4001")))
+	require.Empty(t, p.Translate(ma.StringCast("/ip6/fd00::5/tcp/4001")))
+
+	// failing to fetch the IP keeps the last one.
+	mu.Lock()
+	err = errors.New("unavailable")
+	mu.Unlock()
+	time.Sleep(100 * time.Millisecond)
+	require.Len(t, p.Translate(ma.StringCast("/ip4/10.0.0.5/tcp/4001")), 1)
+
+	mu.Lock()
+	ip, err = net.ParseIP("198.51.100.1"), nil
+	mu.Unlock()
+	require.Eventually(t, func() bool {
+		out := p.Translate(ma.StringCast("/ip4/10.0.0.5/udp/4001/quic"))
+		return len(out) == 1 && out[0].Equal(ma.StringCast("/ip4/198.51.100.1/udp/4001/quic"))
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestFetchHTTP(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte("203.0.113.7\n"))
+	}))
+	defer srv.Close()
+
+	ip, err := FetchHTTP(srv.URL, GCPHeader)(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "203.0.113.7", ip.String())
+
+	_, err = FetchHTTP(srv.URL, nil)(context.Background())
+	require.Error(t, err)
+}
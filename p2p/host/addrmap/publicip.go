@@ -0,0 +1,181 @@
+package addrmap
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// The URLs of the metadata services telling the public IPv4 address of AWS EC2
+// and Google Compute Engine instances. Google's requires the GCPHeader.
+const (
+	AWSPublicIPv4URL = "http://169.254.169.254/latest/meta-data/public-ipv4"
+	GCPPublicIPv4URL = "http://metadata.google.internal/computeMetadata/v1/instance/network-interfaces/0/access-configs/0/external-ip"
+)
+
+// GCPHeader is the header requests to Google's metadata service must carry.
+var GCPHeader = http.Header{"Metadata-Flavor": {"Google"}}
+
+// maxResponseSize is the maximum size of a response of a metadata service we
+// read.
+const maxResponseSize = 1 << 10
+
+// FetchFunc fetches the public IP address of the host.
+type FetchFunc func(ctx context.Context) (net.IP, error)
+
+// FetchHTTP returns a FetchFunc requesting the given URL with the given
+// header, which may be nil, from a metadata service responding with the IP
+// address as plain text.
+func FetchHTTP(url string, header http.Header) FetchFunc {
+	return func(ctx context.Context) (net.IP, error) {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("metadata service responded with %s", resp.Status)
+		}
+		body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+		if err != nil {
+			return nil, err
+		}
+		ip := net.ParseIP(strings.TrimSpace(string(body)))
+		if ip == nil {
+			return nil, fmt.Errorf("metadata service responded with an invalid IP address: %q", body)
+		}
+		return ip, nil
+	}
+}
+
+// PublicIP translates private addresses to the public IP of the host, keeping
+// their transports and ports, for cloud instances whose public IP is mapped
+// one to one to their private IP. The public IP is fetched periodically.
+type PublicIP struct {
+	fetch    FetchFunc
+	interval time.Duration
+
+	mu  sync.RWMutex
+	ip4 net.IP
+	ip6 net.IP
+
+	changed chan struct{}
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+var _ Translator = (*PublicIP)(nil)
+
+// NewPublicIP constructs a new PublicIP translator fetching the public IP
+// with the given function right away, and then every interval. Close it to
+// stop fetching.
+func NewPublicIP(fetch FetchFunc, interval time.Duration) *PublicIP {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &PublicIP{
+		fetch:    fetch,
+		interval: interval,
+		changed:  make(chan struct{}, 1),
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+	go p.background(ctx)
+	return p
+}
+
+func (p *PublicIP) background(ctx context.Context) {
+	defer close(p.done)
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		p.refresh(ctx)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (p *PublicIP) refresh(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, p.interval)
+	defer cancel()
+	ip, err := p.fetch(ctx)
+	if err != nil {
+		// keep the last IP we know of.
+		log.Debugw("failed to fetch public IP", "error", err)
+		return
+	}
+
+	p.mu.Lock()
+	current := &p.ip6
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, current = ip4, &p.ip4
+	}
+	changed := !ip.Equal(*current)
+	*current = ip
+	p.mu.Unlock()
+
+	if changed {
+		log.Infow("public IP changed", "ip", ip)
+		signal(p.changed)
+	}
+}
+
+// Translate returns the given address with the public IP of its IP version,
+// if it's a private address and we know the public IP.
+func (p *PublicIP) Translate(internal ma.Multiaddr) []ma.Multiaddr {
+	ip, rest := ma.SplitFirst(internal)
+	if ip == nil || !manet.IsPrivateAddr(internal) || manet.IsIPLoopback(internal) {
+		return nil
+	}
+	p.mu.RLock()
+	var public net.IP
+	switch ip.Protocol().Code {
+	case ma.P_IP4:
+		public = p.ip4
+	case ma.P_IP6:
+		public = p.ip6
+	}
+	p.mu.RUnlock()
+	if public == nil {
+		return nil
+	}
+	external, err := manet.FromIP(public)
+	if err != nil {
+		return nil
+	}
+	if rest != nil {
+		external = ma.Join(external, rest)
+	}
+	return []ma.Multiaddr{external}
+}
+
+// Changed returns a channel signaled when the public IP changed.
+func (p *PublicIP) Changed() <-chan struct{} {
+	return p.changed
+}
+
+// Close stops fetching the public IP.
+func (p *PublicIP) Close() error {
+	p.cancel()
+	<-p.done
+	return nil
+}
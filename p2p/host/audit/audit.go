@@ -0,0 +1,168 @@
+// Package audit records the streams a host opens and serves, for operators
+// who need to account for what their node did: which peer used which
+// protocol, in which direction, how many bytes were exchanged and for how
+// long.
+//
+// An Auditor wraps streams, and passes a Record to its Sink once a wrapped
+// stream is closed or reset. Install it on a host with the libp2p.Audit option
+// or basichost.HostOpts.Auditor to audit the streams of all protocols.
+package audit
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+var log = logging.Logger("audit")
+
+// Record describes a single stream.
+type Record struct {
+	Peer      peer.ID
+	Protocol  protocol.ID
+	Direction network.Direction
+	// BytesIn and BytesOut count the bytes read from and written to the
+	// stream, after protocol negotiation.
+	BytesIn  uint64
+	BytesOut uint64
+	// Opened is when the stream was opened, and Duration how long it was
+	// open.
+	Opened   time.Time
+	Duration time.Duration
+	// Reset is true if the stream was reset rather than closed.
+	Reset bool
+}
+
+type config struct {
+	sampleRate    float64
+	protocolRates map[protocol.ID]float64
+}
+
+// Option is an option for an Auditor.
+type Option func(*config)
+
+// SampleRate only records the given fraction of streams, from 0 to 1.
+// Defaults to 1, recording every stream.
+func SampleRate(rate float64) Option {
+	return func(cfg *config) {
+		cfg.sampleRate = rate
+	}
+}
+
+// ProtocolSampleRate overrides the sample rate for the streams of the given
+// protocol, e.g. to record every stream of a sensitive protocol while
+// sampling the others, or none of a chatty one.
+func ProtocolSampleRate(pid protocol.ID, rate float64) Option {
+	return func(cfg *config) {
+		cfg.protocolRates[pid] = rate
+	}
+}
+
+// Auditor records streams to a Sink.
+type Auditor struct {
+	sink          Sink
+	sampleRate    float64
+	protocolRates map[protocol.ID]float64
+}
+
+// New constructs a new Auditor recording to the given sink.
+func New(sink Sink, opts ...Option) *Auditor {
+	cfg := config{
+		sampleRate:    1,
+		protocolRates: make(map[protocol.ID]float64),
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return &Auditor{
+		sink:          sink,
+		sampleRate:    cfg.sampleRate,
+		protocolRates: cfg.protocolRates,
+	}
+}
+
+func (a *Auditor) sampled(pid protocol.ID) bool {
+	rate, ok := a.protocolRates[pid]
+	if !ok {
+		rate = a.sampleRate
+	}
+	switch {
+	case rate >= 1:
+		return true
+	case rate <= 0:
+		return false
+	default:
+		return rand.Float64() < rate
+	}
+}
+
+// Wrap returns a stream recording the given stream once it's closed or reset,
+// or the stream itself if it isn't sampled. The stream's protocol must be
+// set. Streams that are never closed nor reset aren't recorded.
+func (a *Auditor) Wrap(s network.Stream) network.Stream {
+	if !a.sampled(s.Protocol()) {
+		return s
+	}
+	opened := s.Stat().Opened
+	if opened.IsZero() {
+		opened = time.Now()
+	}
+	return &stream{Stream: s, auditor: a, opened: opened}
+}
+
+type stream struct {
+	network.Stream
+
+	// accessed atomically.
+	bytesIn, bytesOut uint64
+
+	auditor *Auditor
+	opened  time.Time
+	once    sync.Once
+}
+
+func (s *stream) Read(b []byte) (int, error) {
+	n, err := s.Stream.Read(b)
+	atomic.AddUint64(&s.bytesIn, uint64(n))
+	return n, err
+}
+
+func (s *stream) Write(b []byte) (int, error) {
+	n, err := s.Stream.Write(b)
+	atomic.AddUint64(&s.bytesOut, uint64(n))
+	return n, err
+}
+
+func (s *stream) Close() error {
+	err := s.Stream.Close()
+	s.record(false)
+	return err
+}
+
+func (s *stream) Reset() error {
+	err := s.Stream.Reset()
+	s.record(true)
+	return err
+}
+
+func (s *stream) record(reset bool) {
+	s.once.Do(func() {
+		s.auditor.sink.Record(Record{
+			Peer:      s.Conn().RemotePeer(),
+			Protocol:  s.Protocol(),
+			Direction: s.Stat().Direction,
+			BytesIn:   atomic.LoadUint64(&s.bytesIn),
+			BytesOut:  atomic.LoadUint64(&s.bytesOut),
+			Opened:    s.opened,
+			Duration:  time.Since(s.opened),
+			Reset:     reset,
+		})
+	})
+}
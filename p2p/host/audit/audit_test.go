@@ -0,0 +1,148 @@
+package audit_test
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+
+	"github.com/libp2p/go-libp2p/p2p/host/audit"
+	bhost "github.com/libp2p/go-libp2p/p2p/host/basic"
+
+	swarmt "github.com/libp2p/go-libp2p-swarm/testing"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	echoID   protocol.ID = "/test/echo"
+	silentID protocol.ID = "/test/silent"
+)
+
+func echo(s network.Stream) {
+	defer s.Close()
+	io.Copy(s, s)
+}
+
+// nextRecord returns the next record of the given protocol, skipping the
+// records of other protocols, e.g. identify.
+func nextRecord(t *testing.T, records <-chan audit.Record, pid protocol.ID) audit.Record {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case r := <-records:
+			if r.Protocol == pid {
+				return r
+			}
+		case <-timeout:
+			t.Fatalf("expected an audit record for %s", pid)
+			return audit.Record{}
+		}
+	}
+}
+
+func TestAuditHost(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	records := make(chan audit.Record, 16)
+	a := audit.New(audit.SinkFunc(func(r audit.Record) { records <- r }), audit.ProtocolSampleRate(silentID, 0))
+
+	h1, err := bhost.NewHost(ctx, swarmt.GenSwarm(t, ctx), &bhost.HostOpts{Auditor: a})
+	require.NoError(t, err)
+	defer h1.Close()
+	h2 := bhost.New(swarmt.GenSwarm(t, ctx))
+	defer h2.Close()
+	h1.SetStreamHandler(echoID, echo)
+	h2.SetStreamHandler(echoID, echo)
+	h2.SetStreamHandler(silentID, echo)
+	require.NoError(t, h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+
+	// outbound stream.
+	s, err := h1.NewStream(ctx, h2.ID(), echoID)
+	require.NoError(t, err)
+	_, err = s.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, s.CloseWrite())
+	b, err := ioutil.ReadAll(s)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(b))
+	require.NoError(t, s.Close())
+
+	r := nextRecord(t, records, echoID)
+	require.Equal(t, h2.ID(), r.Peer)
+	require.Equal(t, echoID, r.Protocol)
+	require.Equal(t, network.DirOutbound, r.Direction)
+	require.Equal(t, uint64(5), r.BytesOut)
+	require.Equal(t, uint64(5), r.BytesIn)
+	require.False(t, r.Reset)
+	require.False(t, r.Opened.IsZero())
+
+	// inbound stream, reset by the remote peer.
+	s, err = h2.NewStream(ctx, h1.ID(), echoID)
+	require.NoError(t, err)
+	_, err = s.Write([]byte("hey"))
+	require.NoError(t, err)
+	buf := make([]byte, 3)
+	_, err = io.ReadFull(s, buf)
+	require.NoError(t, err)
+	require.NoError(t, s.Reset())
+
+	r = nextRecord(t, records, echoID)
+	require.Equal(t, h2.ID(), r.Peer)
+	require.Equal(t, network.DirInbound, r.Direction)
+	require.Equal(t, uint64(3), r.BytesIn)
+	require.Equal(t, uint64(3), r.BytesOut)
+
+	// streams that aren't sampled aren't recorded.
+	s, err = h1.NewStream(ctx, h2.ID(), silentID)
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+	timeout := time.After(100 * time.Millisecond)
+	for {
+		select {
+		case r := <-records:
+			require.NotEqual(t, silentID, r.Protocol, "unexpected record")
+		case <-timeout:
+			return
+		}
+	}
+}
+
+func TestAuditNegotiateStream(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	records := make(chan audit.Record, 16)
+	a := audit.New(audit.SinkFunc(func(r audit.Record) { records <- r }))
+
+	h1, err := bhost.NewHost(ctx, swarmt.GenSwarm(t, ctx), &bhost.HostOpts{Auditor: a})
+	require.NoError(t, err)
+	defer h1.Close()
+	h2 := bhost.New(swarmt.GenSwarm(t, ctx))
+	defer h2.Close()
+	h2.SetStreamHandler(echoID, echo)
+	require.NoError(t, h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+
+	s, selected, err := h1.NegotiateStream(ctx, h2.ID(), time.Second, echoID)
+	require.NoError(t, err)
+	require.Equal(t, echoID, selected)
+	_, err = s.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, s.CloseWrite())
+	b, err := ioutil.ReadAll(s)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(b))
+	require.NoError(t, s.Close())
+
+	r := nextRecord(t, records, echoID)
+	require.Equal(t, h2.ID(), r.Peer)
+	require.Equal(t, network.DirOutbound, r.Direction)
+	require.Equal(t, uint64(5), r.BytesOut)
+	require.Equal(t, uint64(5), r.BytesIn)
+}
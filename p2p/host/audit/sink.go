@@ -0,0 +1,89 @@
+package audit
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Sink receives the records of an Auditor. Record is called from the
+// goroutine closing or resetting the stream, so it must be safe for
+// concurrent use, and shouldn't block.
+type Sink interface {
+	Record(Record)
+}
+
+// SinkFunc adapts a function to a Sink.
+type SinkFunc func(Record)
+
+// Record calls f(r).
+func (f SinkFunc) Record(r Record) {
+	f(r)
+}
+
+// WriterSink writes records to an io.Writer as JSON, one record per line.
+type WriterSink struct {
+	mu  sync.Mutex
+	w   io.Writer
+	enc *json.Encoder
+}
+
+var _ Sink = (*WriterSink)(nil)
+
+// NewWriterSink constructs a new WriterSink writing to w.
+func NewWriterSink(w io.Writer) *WriterSink {
+	return &WriterSink{w: w, enc: json.NewEncoder(w)}
+}
+
+// OpenFile constructs a new WriterSink appending to the file at the given
+// path, creating it if needed. Close the sink to close the file.
+func OpenFile(path string) (*WriterSink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return NewWriterSink(f), nil
+}
+
+// jsonRecord is the JSON representation of a Record.
+type jsonRecord struct {
+	Peer      string    `json:"peer"`
+	Protocol  string    `json:"protocol"`
+	Direction string    `json:"direction"`
+	BytesIn   uint64    `json:"bytes_in"`
+	BytesOut  uint64    `json:"bytes_out"`
+	Opened    time.Time `json:"opened"`
+	Duration  float64   `json:"duration_seconds"`
+	Reset     bool      `json:"reset"`
+}
+
+// Record writes r. Write errors are logged: auditing must not break streams.
+func (s *WriterSink) Record(r Record) {
+	jr := jsonRecord{
+		Peer:      r.Peer.Pretty(),
+		Protocol:  string(r.Protocol),
+		Direction: r.Direction.String(),
+		BytesIn:   r.BytesIn,
+		BytesOut:  r.BytesOut,
+		Opened:    r.Opened,
+		Duration:  r.Duration.Seconds(),
+		Reset:     r.Reset,
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.enc.Encode(&jr); err != nil {
+		log.Errorw("failed to write audit record", "error", err)
+	}
+}
+
+// Close closes the underlying writer, if it's an io.Closer.
+func (s *WriterSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok := s.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
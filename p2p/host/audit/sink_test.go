@@ -0,0 +1,51 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriterSink(t *testing.T) {
+	var buf bytes.Buffer
+	sink := NewWriterSink(&buf)
+	sink.Record(Record{
+		Protocol:  "/test/echo",
+		Direction: network.DirInbound,
+		BytesIn:   42,
+		Duration:  1500 * time.Millisecond,
+		Reset:     true,
+	})
+	sink.Record(Record{Protocol: "/test/silent", Direction: network.DirOutbound})
+	require.NoError(t, sink.Close())
+
+	dec := json.NewDecoder(&buf)
+	var jr jsonRecord
+	require.NoError(t, dec.Decode(&jr))
+	require.Equal(t, "/test/echo", jr.Protocol)
+	require.Equal(t, "Inbound", jr.Direction)
+	require.Equal(t, uint64(42), jr.BytesIn)
+	require.Equal(t, 1.5, jr.Duration)
+	require.True(t, jr.Reset)
+	require.NoError(t, dec.Decode(&jr))
+	require.Equal(t, "/test/silent", jr.Protocol)
+	require.Equal(t, io.EOF, dec.Decode(&jr))
+}
+
+func TestSampleRate(t *testing.T) {
+	a := New(SinkFunc(func(Record) {}), SampleRate(0.25), ProtocolSampleRate("/test/echo", 1))
+	var sampled int
+	for i := 0; i < 4000; i++ {
+		if a.sampled("/test/silent") {
+			sampled++
+		}
+		require.True(t, a.sampled("/test/echo"))
+	}
+	require.InDelta(t, 1000, sampled, 150)
+}
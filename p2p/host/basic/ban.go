@@ -0,0 +1,179 @@
+package basichost
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/connmgr"
+	"github.com/libp2p/go-libp2p-core/control"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// ErrPeerBanned is returned when connecting to, or opening a stream to, a
+// banned peer.
+var ErrPeerBanned = errors.New("peer is banned")
+
+// Ban is a temporary ban of a peer, see BasicHost.BanPeer.
+type Ban struct {
+	Peer    peer.ID
+	Reason  string
+	Expires time.Time
+}
+
+// BanList is a connection gater denying connections to and from banned peers.
+// Connections it doesn't deny are passed on to the gater it wraps, if any.
+//
+// For bans to be enforced at the network level, the BanList must be
+// installed as the connection gater of the swarm and the upgrader, as done
+// by the libp2p constructor, and passed to the host in HostOpts.BanList.
+// Otherwise the host only disconnects banned peers once connected.
+type BanList struct {
+	inner connmgr.ConnectionGater
+
+	mu   sync.Mutex
+	bans map[peer.ID]Ban
+}
+
+var _ connmgr.ConnectionGater = (*BanList)(nil)
+
+// NewBanList constructs a new BanList wrapping the given gater, which may be
+// nil.
+func NewBanList(inner connmgr.ConnectionGater) *BanList {
+	return &BanList{
+		inner: inner,
+		bans:  make(map[peer.ID]Ban),
+	}
+}
+
+// Ban bans the given peer for the given duration, replacing any existing ban.
+func (bl *BanList) Ban(p peer.ID, d time.Duration, reason string) {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	bl.bans[p] = Ban{Peer: p, Reason: reason, Expires: time.Now().Add(d)}
+}
+
+// Unban lifts the ban of the given peer, if any.
+func (bl *BanList) Unban(p peer.ID) {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	delete(bl.bans, p)
+}
+
+// Get returns the ban of the given peer, if it's banned.
+func (bl *BanList) Get(p peer.ID) (Ban, bool) {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	b, ok := bl.bans[p]
+	if !ok {
+		return Ban{}, false
+	}
+	if !time.Now().Before(b.Expires) {
+		delete(bl.bans, p)
+		return Ban{}, false
+	}
+	return b, true
+}
+
+// IsBanned returns whether the given peer is banned.
+func (bl *BanList) IsBanned(p peer.ID) bool {
+	_, ok := bl.Get(p)
+	return ok
+}
+
+// List returns all current bans, the soonest to expire first.
+func (bl *BanList) List() []Ban {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	now := time.Now()
+	out := make([]Ban, 0, len(bl.bans))
+	for p, b := range bl.bans {
+		if !now.Before(b.Expires) {
+			delete(bl.bans, p)
+			continue
+		}
+		out = append(out, b)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Expires.Before(out[j].Expires) })
+	return out
+}
+
+func (bl *BanList) InterceptPeerDial(p peer.ID) bool {
+	if bl.IsBanned(p) {
+		return false
+	}
+	return bl.inner == nil || bl.inner.InterceptPeerDial(p)
+}
+
+func (bl *BanList) InterceptAddrDial(p peer.ID, a ma.Multiaddr) bool {
+	if bl.IsBanned(p) {
+		return false
+	}
+	return bl.inner == nil || bl.inner.InterceptAddrDial(p, a)
+}
+
+// InterceptAccept is passed on to the wrapped gater: we don't know the remote
+// peer before the connection is secured.
+func (bl *BanList) InterceptAccept(addrs network.ConnMultiaddrs) bool {
+	return bl.inner == nil || bl.inner.InterceptAccept(addrs)
+}
+
+func (bl *BanList) InterceptSecured(dir network.Direction, p peer.ID, addrs network.ConnMultiaddrs) bool {
+	if bl.IsBanned(p) {
+		return false
+	}
+	return bl.inner == nil || bl.inner.InterceptSecured(dir, p, addrs)
+}
+
+func (bl *BanList) InterceptUpgraded(c network.Conn) (bool, control.DisconnectReason) {
+	if bl.inner == nil {
+		return true, 0
+	}
+	return bl.inner.InterceptUpgraded(c)
+}
+
+// BanPeer bans the given peer for the given duration: we close our
+// connections to it, stop dialing it, and refuse its connections until the
+// ban expires or is lifted with UnbanPeer.
+func (h *BasicHost) BanPeer(p peer.ID, d time.Duration, reason string) error {
+	if p == h.ID() {
+		return errors.New("cannot ban self")
+	}
+	if d <= 0 {
+		return errors.New("ban duration must be positive")
+	}
+	h.bans.Ban(p, d, reason)
+	log.Infow("banned peer", "peer", p, "duration", d, "reason", reason)
+	return h.Network().ClosePeer(p)
+}
+
+// UnbanPeer lifts the ban of the given peer, if any.
+func (h *BasicHost) UnbanPeer(p peer.ID) {
+	h.bans.Unban(p)
+}
+
+// IsBanned returns whether the given peer is banned.
+func (h *BasicHost) IsBanned(p peer.ID) bool {
+	return h.bans.IsBanned(p)
+}
+
+// BannedPeers returns the current bans, the soonest to expire first.
+func (h *BasicHost) BannedPeers() []Ban {
+	return h.bans.List()
+}
+
+// closeIfBanned closes connections from banned peers that made it past the
+// network, e.g. when the BanList isn't installed as the network's connection
+// gater.
+func (h *BasicHost) closeIfBanned(_ network.Network, c network.Conn) {
+	if !h.bans.IsBanned(c.RemotePeer()) {
+		return
+	}
+	log.Debugw("closing connection from banned peer", "peer", c.RemotePeer())
+	// closing the connection from within the notification would deadlock.
+	go c.Close()
+}
@@ -23,6 +23,11 @@ import (
 	addrutil "github.com/libp2p/go-addr-util"
 	"github.com/libp2p/go-eventbus"
 	inat "github.com/libp2p/go-libp2p-nat"
+	"github.com/libp2p/go-libp2p/p2p/host/addrmap"
+	"github.com/libp2p/go-libp2p/p2p/host/audit"
+	"github.com/libp2p/go-libp2p/p2p/host/extaddr"
+	"github.com/libp2p/go-libp2p/p2p/host/handlermetrics"
+	"github.com/libp2p/go-libp2p/p2p/host/quota"
 	"github.com/libp2p/go-libp2p/p2p/protocol/identify"
 	"github.com/libp2p/go-libp2p/p2p/protocol/ping"
 	"github.com/libp2p/go-netroute"
@@ -91,6 +96,13 @@ type BasicHost struct {
 	maResolver *madns.Resolver
 	cmgr       connmgr.ConnManager
 	eventbus   event.Bus
+	bans       *BanList
+	auditor    *audit.Auditor
+	quotas     *quota.Manager
+	handlers   *handlermetrics.Tracker
+	extAddrs   *extaddr.Book
+	translator addrmap.Translator
+	streamGate StreamGate
 
 	AddrsFactory AddrsFactory
 
@@ -99,6 +111,7 @@ type BasicHost struct {
 	emitters struct {
 		evtLocalProtocolsUpdated event.Emitter
 		evtLocalAddrsUpdated     event.Emitter
+		evtPortMappingMismatch   event.Emitter
 	}
 
 	addrChangeChan chan struct{}
@@ -150,6 +163,51 @@ type HostOpts struct {
 
 	// DisableSignedPeerRecord disables the generation of Signed Peer Records on this host.
 	DisableSignedPeerRecord bool
+
+	// BanList holds the peers banned with BanPeer. It should also be the
+	// connection gater of the network, see BanList. If omitted, a new BanList
+	// is used.
+	BanList *BanList
+
+	// Auditor, if set, records the streams of all protocols.
+	Auditor *audit.Auditor
+
+	// StreamGate controls whether inbound application streams wait for the
+	// connection to be identified. Defaults to StreamGateNone.
+	StreamGate StreamGate
+
+	// Quotas, if set, limits the streams opened under quota tokens, see the
+	// quota package.
+	Quotas *quota.Manager
+
+	// HandlerMetrics, if set, measures the handlers of inbound streams,
+	// see the handlermetrics package.
+	HandlerMetrics *handlermetrics.Tracker
+
+	// KeyMismatchBan, if positive, bans peers that send us a public key not
+	// matching their peer ID, or the key we have for them, for this long.
+	// See identify.EvtPeerKeyMismatch.
+	KeyMismatchBan time.Duration
+
+	// ExternalAddrs holds the external addresses confirmed by external
+	// sources, advertised along with our observed addresses. If omitted, a
+	// new Book is used.
+	ExternalAddrs *extaddr.Book
+
+	// AddrTranslator, if set, maps our listen addresses to the external
+	// addresses they're reachable at, which we advertise along with them.
+	AddrTranslator addrmap.Translator
+
+	// Insecure tells identify that the network's connections don't
+	// authenticate peers, see identify.InsecureMode.
+	Insecure bool
+
+	// LazyIdentify only identifies connections when we need to know the
+	// remote peer's protocols, see identify.Lazy.
+	LazyIdentify bool
+
+	// IdentifyOpts are further options of the identify service.
+	IdentifyOpts []identify.Option
 }
 
 // NewHost constructs a new *BasicHost and activates it by attaching its stream and connection handlers to the given inet.Network.
@@ -167,6 +225,11 @@ func NewHost(ctx context.Context, n network.Network, opts *HostOpts) (*BasicHost
 		ctx:                     hostCtx,
 		ctxCancel:               cancel,
 		disableSignedPeerRecord: opts.DisableSignedPeerRecord,
+		extAddrs:                opts.ExternalAddrs,
+		translator:              opts.AddrTranslator,
+	}
+	if h.extAddrs == nil {
+		h.extAddrs = extaddr.NewBook()
 	}
 
 	h.updateLocalIpAddr()
@@ -178,6 +241,9 @@ func NewHost(ctx context.Context, n network.Network, opts *HostOpts) (*BasicHost
 	if h.emitters.evtLocalAddrsUpdated, err = h.eventbus.Emitter(&event.EvtLocalAddressesUpdated{}); err != nil {
 		return nil, err
 	}
+	if h.emitters.evtPortMappingMismatch, err = h.eventbus.Emitter(&EvtPortMappingMismatch{}, eventbus.Stateful); err != nil {
+		return nil, err
+	}
 
 	if !h.disableSignedPeerRecord {
 		cab, ok := peerstore.GetCertifiedAddrBook(n.Peerstore())
@@ -210,11 +276,24 @@ func NewHost(ctx context.Context, n network.Network, opts *HostOpts) (*BasicHost
 	}
 
 	// we can't set this as a default above because it depends on the *BasicHost.
+	idOpts := []identify.Option{identify.UserAgent(opts.UserAgent)}
 	if h.disableSignedPeerRecord {
-		h.ids, err = identify.NewIDService(h, identify.UserAgent(opts.UserAgent), identify.DisableSignedPeerRecord())
-	} else {
-		h.ids, err = identify.NewIDService(h, identify.UserAgent(opts.UserAgent))
+		idOpts = append(idOpts, identify.DisableSignedPeerRecord())
 	}
+	if opts.Insecure {
+		idOpts = append(idOpts, identify.InsecureMode())
+	}
+	if opts.LazyIdentify {
+		idOpts = append(idOpts, identify.Lazy())
+	}
+	if d := opts.KeyMismatchBan; d > 0 {
+		idOpts = append(idOpts, identify.KeyMismatchPolicy(func(evt identify.EvtPeerKeyMismatch) identify.KeyMismatchAction {
+			_ = h.BanPeer(evt.Peer, d, "public key mismatch: "+string(evt.Reason))
+			return identify.KeyMismatchDisconnect
+		}))
+	}
+	idOpts = append(idOpts, opts.IdentifyOpts...)
+	h.ids, err = identify.NewIDService(h, idOpts...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create Identify service: %s", err)
 	}
@@ -246,6 +325,15 @@ func NewHost(ctx context.Context, n network.Network, opts *HostOpts) (*BasicHost
 		h.pings = ping.NewPingService(h)
 	}
 
+	h.auditor = opts.Auditor
+	h.quotas = opts.Quotas
+	h.handlers = opts.HandlerMetrics
+	h.streamGate = opts.StreamGate
+	h.bans = opts.BanList
+	if h.bans == nil {
+		h.bans = NewBanList(nil)
+	}
+
 	n.SetStreamHandler(h.newStreamHandler)
 
 	// register to be notified when the network's listen addrs change,
@@ -256,6 +344,7 @@ func NewHost(ctx context.Context, n network.Network, opts *HostOpts) (*BasicHost
 	n.Notify(&network.NotifyBundle{
 		ListenF:      listenHandler,
 		ListenCloseF: listenHandler,
+		ConnectedF:   h.closeIfBanned,
 	})
 
 	return h, nil
@@ -418,6 +507,16 @@ func (h *BasicHost) newStreamHandler(s network.Stream) {
 	s.SetProtocol(protocol.ID(protoID))
 	log.Debugf("protocol negotiation took %s", took)
 
+	if !h.gateStream(s) {
+		return
+	}
+
+	s = h.audit(s)
+
+	if h.handlers != nil {
+		go h.handlers.Handler(func(s network.Stream) { handle(protoID, s) })(s)
+		return
+	}
 	go handle(protoID, s)
 }
 
@@ -478,7 +577,10 @@ func (h *BasicHost) makeSignedPeerRecord(evt *event.EvtLocalAddressesUpdated) (*
 
 func (h *BasicHost) background() {
 	defer h.refCount.Done()
-	var lastAddrs []ma.Multiaddr
+	var (
+		lastAddrs []ma.Multiaddr
+		lastDiffs []PortMappingDiff
+	)
 
 	emitAddrChange := func(currentAddrs []ma.Multiaddr, lastAddrs []ma.Multiaddr) {
 		// nothing to do if both are nil..defensive check
@@ -514,6 +616,12 @@ func (h *BasicHost) background() {
 		}
 	}
 
+	// a nil channel never fires if we don't translate addresses.
+	var translated <-chan struct{}
+	if h.translator != nil {
+		translated = h.translator.Changed()
+	}
+
 	// periodically schedules an IdentifyPush to update our peers for changes
 	// in our address set (if needed)
 	ticker := time.NewTicker(addrChangeTickrInterval)
@@ -528,10 +636,13 @@ func (h *BasicHost) background() {
 		curr := h.Addrs()
 		emitAddrChange(curr, lastAddrs)
 		lastAddrs = curr
+		lastDiffs = h.emitPortMappingDiffs(lastDiffs)
 
 		select {
 		case <-ticker.C:
 		case <-h.addrChangeChan:
+		case <-h.extAddrs.Changed():
+		case <-translated:
 		case <-h.ctx.Done():
 			return
 		}
@@ -609,64 +720,182 @@ func (h *BasicHost) RemoveStreamHandler(pid protocol.ID) {
 // header with given protocol.ID. If there is no connection to p, attempts
 // to create one. If ProtocolID is "", writes no header.
 // (Threadsafe)
+//
+// If the context carries a quota token, see the quota package, the stream is
+// limited by the quotas of the host and counts towards them.
 func (h *BasicHost) NewStream(ctx context.Context, p peer.ID, pids ...protocol.ID) (network.Stream, error) {
-	s, err := h.Network().NewStream(ctx, p)
+	res, err := h.reserveQuota(ctx)
 	if err != nil {
 		return nil, err
 	}
-
-	// Wait for any in-progress identifies on the connection to finish. This
-	// is faster than negotiating.
-	//
-	// If the other side doesn't support identify, that's fine. This will
-	// just be a no-op.
-	select {
-	case <-h.ids.IdentifyWait(s.Conn()):
-	case <-ctx.Done():
-		return nil, ctx.Err()
+	s, err := h.newStream(ctx, p, pids...)
+	if err != nil {
+		res.Release()
+		return nil, err
 	}
+	return res.Wrap(s), nil
+}
 
-	pidStrings := protocol.ConvertToStrings(pids)
+func (h *BasicHost) newStream(ctx context.Context, p peer.ID, pids ...protocol.ID) (network.Stream, error) {
+	if h.bans.IsBanned(p) {
+		return nil, ErrPeerBanned
+	}
 
-	pref, err := h.preferredProtocol(p, pidStrings)
+	s, err := h.Network().NewStream(ctx, p)
 	if err != nil {
-		_ = s.Reset()
 		return nil, err
 	}
 
+	pidStrings := protocol.ConvertToStrings(pids)
+
+	// When identifying lazily, we only identify the connection if we don't
+	// know whether the peer supports one of the protocols yet.
+	var pref protocol.ID
+	if h.ids.Lazy() {
+		if pref, err = h.preferredProtocol(p, pidStrings); err != nil {
+			_ = s.Reset()
+			return nil, err
+		}
+	}
+
+	if pref == "" {
+		// Wait for any in-progress identifies on the connection to finish.
+		// This is faster than negotiating.
+		//
+		// If the other side doesn't support identify, that's fine. This
+		// will just be a no-op.
+		select {
+		case <-h.ids.IdentifyWait(s.Conn()):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		if pref, err = h.preferredProtocol(p, pidStrings); err != nil {
+			_ = s.Reset()
+			return nil, err
+		}
+	}
+
 	if pref != "" {
 		s.SetProtocol(pref)
 		lzcon := msmux.NewMSSelect(s, string(pref))
-		return &streamWrapper{
+		return h.audit(&streamWrapper{
 			Stream: s,
 			rw:     lzcon,
-		}, nil
+		}), nil
+	}
+
+	selected, err := h.selectProtocol(ctx, s, pidStrings)
+	if err != nil {
+		return nil, err
 	}
 
-	// Negotiate the protocol in the background, obeying the context.
+	selpid := protocol.ID(selected)
+	s.SetProtocol(selpid)
+	h.Peerstore().AddProtocols(p, selected)
+	return h.audit(s), nil
+}
+
+// reserveQuota reserves a stream under the quota token of the context, if
+// any. The returned reservation is nil if there's nothing to reserve.
+func (h *BasicHost) reserveQuota(ctx context.Context) (*quota.Reservation, error) {
+	if h.quotas == nil {
+		return nil, nil
+	}
+	return h.quotas.ReserveContext(ctx)
+}
+
+// audit wraps the stream with our auditor, if any.
+func (h *BasicHost) audit(s network.Stream) network.Stream {
+	if h.auditor == nil {
+		return s
+	}
+	return h.auditor.Wrap(s)
+}
+
+// NegotiateStream opens a new stream to peer p and negotiates the first
+// protocol in pids (in order of preference) that the remote peer supports,
+// returning the stream along with the selected protocol.
+//
+// Unlike NewStream, the negotiation is never lazy: when NegotiateStream
+// returns, both sides have agreed on the protocol. The negotiation of all
+// candidate protocols must complete within the given timeout (if positive);
+// the timeout does not include the time spent dialing the peer.
+//
+// Like with NewStream, the stream counts towards the quota of the token the
+// context carries, if any.
+func (h *BasicHost) NegotiateStream(ctx context.Context, p peer.ID, timeout time.Duration, pids ...protocol.ID) (network.Stream, protocol.ID, error) {
+	res, err := h.reserveQuota(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	s, selected, err := h.negotiateStream(ctx, p, timeout, pids...)
+	if err != nil {
+		res.Release()
+		return nil, "", err
+	}
+	return res.Wrap(s), selected, nil
+}
+
+func (h *BasicHost) negotiateStream(ctx context.Context, p peer.ID, timeout time.Duration, pids ...protocol.ID) (network.Stream, protocol.ID, error) {
+	if h.bans.IsBanned(p) {
+		return nil, "", ErrPeerBanned
+	}
+
+	s, err := h.Network().NewStream(ctx, p)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Wait for any in-progress identifies on the connection to finish, see
+	// NewStream.
+	select {
+	case <-h.ids.IdentifyWait(s.Conn()):
+	case <-ctx.Done():
+		_ = s.Reset()
+		return nil, "", ctx.Err()
+	}
+
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	selected, err := h.selectProtocol(ctx, s, protocol.ConvertToStrings(pids))
+	if err != nil {
+		return nil, "", err
+	}
+
+	selpid := protocol.ID(selected)
+	s.SetProtocol(selpid)
+	h.Peerstore().AddProtocols(p, selected)
+	return h.audit(s), selpid, nil
+}
+
+// selectProtocol negotiates one of the given protocols on the stream in the
+// background, obeying the context. The stream is reset on failure.
+func (h *BasicHost) selectProtocol(ctx context.Context, s network.Stream, pids []string) (string, error) {
 	var selected string
+	var err error
 	errCh := make(chan error, 1)
 	go func() {
-		selected, err = msmux.SelectOneOf(pidStrings, s)
+		selected, err = msmux.SelectOneOf(pids, s)
 		errCh <- err
 	}()
 	select {
 	case err = <-errCh:
 		if err != nil {
 			s.Reset()
-			return nil, err
+			return "", err
 		}
 	case <-ctx.Done():
 		s.Reset()
 		// wait for the negotiation to cancel.
 		<-errCh
-		return nil, ctx.Err()
+		return "", ctx.Err()
 	}
-
-	selpid := protocol.ID(selected)
-	s.SetProtocol(selpid)
-	h.Peerstore().AddProtocols(p, selected)
-	return s, nil
+	return selected, nil
 }
 
 func (h *BasicHost) preferredProtocol(p peer.ID, pids []string) (protocol.ID, error) {
@@ -688,6 +917,10 @@ func (h *BasicHost) preferredProtocol(p peer.ID, pids []string) (protocol.ID, er
 // Connect will absorb the addresses in pi into its internal peerstore.
 // It will also resolve any /dns4, /dns6, and /dnsaddr addresses.
 func (h *BasicHost) Connect(ctx context.Context, pi peer.AddrInfo) error {
+	if h.bans.IsBanned(pi.ID) {
+		return ErrPeerBanned
+	}
+
 	// absorb addresses into peerstore
 	h.Peerstore().AddAddrs(pi.ID, pi.Addrs, peerstore.TempAddrTTL)
 
@@ -779,11 +1012,14 @@ func (h *BasicHost) dialPeer(ctx context.Context, p peer.ID) error {
 	// assume that things like the agent version are usually set when this
 	// returns. On the other hand, we don't _really_ need to wait for this.
 	//
-	// This is mostly here to preserve existing behavior.
-	select {
-	case <-h.ids.IdentifyWait(c):
-	case <-ctx.Done():
-		return ctx.Err()
+	// This is mostly here to preserve existing behavior. When identifying
+	// lazily, connections are identified once we open streams instead.
+	if !h.ids.Lazy() {
+		select {
+		case <-h.ids.IdentifyWait(c):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
 
 	log.Debugf("host %s finished dialing %s", h.ID(), p)
@@ -839,6 +1075,15 @@ func (h *BasicHost) AllAddrs() []ma.Multiaddr {
 		finalAddrs = append(finalAddrs, resolved...)
 	}
 
+	// add the external addresses our listen addresses translate to, see
+	// HostOpts.AddrTranslator.
+	if h.translator != nil {
+		listen := finalAddrs
+		for _, a := range listen {
+			finalAddrs = append(finalAddrs, h.translator.Translate(a)...)
+		}
+	}
+
 	// add autonat PublicAddr Consider the following scenario
 	// For example, it is deployed on a cloud server,
 	// it provides an elastic ip accessible to the public network,
@@ -852,6 +1097,9 @@ func (h *BasicHost) AllAddrs() []ma.Multiaddr {
 		}
 	}
 
+	// add the addresses external sources confirmed, see ExternalAddrs.
+	finalAddrs = append(finalAddrs, h.extAddrs.Addrs()...)
+
 	finalAddrs = dedupAddrs(finalAddrs)
 
 	var natMappings []inat.Mapping
@@ -1006,6 +1254,13 @@ func (h *BasicHost) AllAddrs() []ma.Multiaddr {
 	return dedupAddrs(finalAddrs)
 }
 
+// ExternalAddrs returns the book external sources submit the external
+// addresses they confirmed to. The addresses it confirms are advertised along
+// with our observed addresses.
+func (h *BasicHost) ExternalAddrs() *extaddr.Book {
+	return h.extAddrs
+}
+
 // SetAutoNat sets the autonat service for the host.
 func (h *BasicHost) SetAutoNat(a autonat.AutoNAT) {
 	h.addrMu.Lock()
@@ -1038,6 +1293,7 @@ func (h *BasicHost) Close() error {
 
 		_ = h.emitters.evtLocalProtocolsUpdated.Close()
 		_ = h.emitters.evtLocalAddrsUpdated.Close()
+		_ = h.emitters.evtPortMappingMismatch.Close()
 		h.Network().Close()
 
 		if h.Peerstore() != nil {
@@ -3,14 +3,17 @@ package basichost
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"reflect"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/libp2p/go-libp2p-core/crypto"
 	"github.com/libp2p/go-libp2p-core/event"
 	"github.com/libp2p/go-libp2p-core/helpers"
 	"github.com/libp2p/go-libp2p-core/host"
@@ -24,10 +27,17 @@ import (
 	"github.com/libp2p/go-eventbus"
 	autonat "github.com/libp2p/go-libp2p-autonat"
 	swarmt "github.com/libp2p/go-libp2p-swarm/testing"
+	"github.com/libp2p/go-libp2p/p2p/host/addrmap"
+	"github.com/libp2p/go-libp2p/p2p/host/extaddr"
+	"github.com/libp2p/go-libp2p/p2p/host/handlermetrics"
+	"github.com/libp2p/go-libp2p/p2p/host/quota"
 	"github.com/libp2p/go-libp2p/p2p/protocol/identify"
+	pb "github.com/libp2p/go-libp2p/p2p/protocol/identify/pb"
 
+	"github.com/libp2p/go-msgio/protoio"
 	ma "github.com/multiformats/go-multiaddr"
 	madns "github.com/multiformats/go-multiaddr-dns"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/require"
 )
 
@@ -214,6 +224,79 @@ func TestHostAddrsFactory(t *testing.T) {
 	}
 }
 
+func TestHostExternalAddrs(t *testing.T) {
+	ctx := context.Background()
+	book := extaddr.NewBook()
+	h, err := NewHost(ctx, swarmt.GenSwarm(t, ctx), &HostOpts{ExternalAddrs: book})
+	require.NoError(t, err)
+	h.Start()
+	defer h.Close()
+	require.Same(t, book, h.ExternalAddrs())
+
+	sub, err := h.EventBus().Subscribe(&event.EvtLocalAddressesUpdated{})
+	require.NoError(t, err)
+	defer sub.Close()
+
+	ext := ma.StringCast("/ip4/1.2.3.4/tcp/4001")
+	require.NoError(t, book.Submit("cloud", ext, time.Hour, 0.3))
+	require.NotContains(t, h.Addrs(), ext)
+
+	require.NoError(t, book.Submit("stun", ext, time.Hour, 0.9))
+	require.Contains(t, h.Addrs(), ext)
+
+	// the change is advertised without waiting for the next address tick.
+	timeout := time.After(addrChangeTickrInterval / 2)
+	for {
+		select {
+		case e := <-sub.Out():
+			for _, a := range e.(event.EvtLocalAddressesUpdated).Current {
+				if a.Address.Equal(ext) && a.Action == event.Added {
+					return
+				}
+			}
+		case <-timeout:
+			t.Fatal("external address wasn't advertised")
+		}
+	}
+}
+
+func TestHostAddrTranslator(t *testing.T) {
+	ctx := context.Background()
+	static := addrmap.NewStatic()
+	h, err := NewHost(ctx, swarmt.GenSwarm(t, ctx), &HostOpts{AddrTranslator: static})
+	require.NoError(t, err)
+	h.Start()
+	defer h.Close()
+
+	sub, err := h.EventBus().Subscribe(&event.EvtLocalAddressesUpdated{})
+	require.NoError(t, err)
+	defer sub.Close()
+
+	listen := h.Network().ListenAddresses()[0]
+	ext := ma.StringCast("/ip4/1.2.3.4/tcp/30001")
+	static.Map(listen, ext)
+	require.Contains(t, h.Addrs(), ext)
+
+	// the mapped address is advertised right away, in our signed peer
+	// record too.
+	timeout := time.After(addrChangeTickrInterval / 2)
+	for {
+		select {
+		case e := <-sub.Out():
+			evt := e.(event.EvtLocalAddressesUpdated)
+			for _, a := range evt.Current {
+				if a.Address.Equal(ext) && a.Action == event.Added {
+					rec := peerRecordFromEnvelope(t, evt.SignedPeerRecord)
+					require.Contains(t, rec.Addrs, ext)
+					return
+				}
+			}
+		case <-timeout:
+			t.Fatal("mapped address wasn't advertised")
+		}
+	}
+}
+
 func TestLocalIPChangesWhenListenAddrChanges(t *testing.T) {
 	ctx := context.Background()
 
@@ -861,6 +944,48 @@ func TestNegotiationCancel(t *testing.T) {
 	}
 }
 
+func TestNegotiateStream(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1, h2 := getHostPair(ctx, t)
+	defer h1.Close()
+	defer h2.Close()
+
+	h1.SetStreamHandler("/testing/2.0.0", func(s network.Stream) {
+		s.Close()
+	})
+
+	s, selected, err := h2.(*BasicHost).NegotiateStream(ctx, h1.ID(), time.Second, "/testing/3.0.0", "/testing/2.0.0", "/testing/1.0.0")
+	require.NoError(t, err)
+	require.Equal(t, protocol.ID("/testing/2.0.0"), selected)
+	require.Equal(t, selected, s.Protocol())
+	s.Close()
+
+	_, _, err = h2.(*BasicHost).NegotiateStream(ctx, h1.ID(), time.Second, "/testing/3.0.0")
+	require.Error(t, err)
+}
+
+func TestNegotiateStreamTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1, h2 := getHostPair(ctx, t)
+	defer h1.Close()
+	defer h2.Close()
+
+	// pre-negotiation so we can make the negotiation hang.
+	h1.Network().SetStreamHandler(func(s network.Stream) {
+		<-ctx.Done() // wait till the test is done.
+		s.Reset()
+	})
+
+	start := time.Now()
+	_, _, err := h2.(*BasicHost).NegotiateStream(ctx, h1.ID(), 100*time.Millisecond, "/testing/2.0.0", "/testing/1.0.0")
+	require.Equal(t, context.DeadlineExceeded, err)
+	require.Less(t, int64(time.Since(start)), int64(time.Second))
+}
+
 func waitForAddrChangeEvent(ctx context.Context, sub event.Subscription, t *testing.T) event.EvtLocalAddressesUpdated {
 	for {
 		select {
@@ -930,3 +1055,350 @@ func peerRecordFromEnvelope(t *testing.T, ev *record.Envelope) *peer.PeerRecord
 	}
 	return peerRec
 }
+
+func TestSelfTest(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	p, err := test.RandPeerID()
+	require.NoError(t, err)
+	backend := &madns.MockResolver{
+		TXT: map[string][]string{"_dnsaddr.example.com": {
+			"dnsaddr=/ip4/192.0.2.1/tcp/123/p2p/" + p.Pretty(),
+		}},
+	}
+	resolver, err := madns.NewResolver(madns.WithDefaultResolver(backend))
+	require.NoError(t, err)
+
+	h1, err := NewHost(ctx, swarmt.GenSwarm(t, ctx), &HostOpts{MultiaddrResolver: resolver})
+	require.NoError(t, err)
+	defer h1.Close()
+	h2, err := NewHost(ctx, swarmt.GenSwarm(t, ctx), &HostOpts{EnablePing: true})
+	require.NoError(t, err)
+	defer h2.Close()
+
+	report := h1.SelfTest(ctx, SelfTestOpts{
+		Peers:        []peer.AddrInfo{{ID: h2.ID(), Addrs: h2.Addrs()}},
+		DNSAddrs:     []ma.Multiaddr{ma.StringCast("/dnsaddr/example.com"), ma.StringCast("/dnsaddr/missing.example.com")},
+		CheckTimeout: 5 * time.Second,
+	})
+
+	passed := make(map[string]bool)
+	for _, c := range report.Checks {
+		passed[c.Name] = c.Passed()
+	}
+	require.Equal(t, map[string]bool{
+		"listen":                               true,
+		"autonat":                              false, // neither peer runs AutoNAT.
+		"ping/" + h2.ID().Pretty():             true,
+		"resolve//dnsaddr/example.com":         true,
+		"resolve//dnsaddr/missing.example.com": false,
+	}, passed)
+	require.False(t, report.Passed())
+}
+
+func TestBanPeer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := New(swarmt.GenSwarm(t, ctx))
+	h2 := New(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	defer h2.Close()
+
+	h2pi := h2.Peerstore().PeerInfo(h2.ID())
+	require.NoError(t, h1.Connect(ctx, h2pi))
+
+	require.Error(t, h1.BanPeer(h1.ID(), time.Minute, "self"))
+	require.NoError(t, h1.BanPeer(h2.ID(), 500*time.Millisecond, "misbehaving"))
+	require.Equal(t, network.NotConnected, h1.Network().Connectedness(h2.ID()))
+	require.True(t, h1.IsBanned(h2.ID()))
+
+	bans := h1.BannedPeers()
+	require.Len(t, bans, 1)
+	require.Equal(t, h2.ID(), bans[0].Peer)
+	require.Equal(t, "misbehaving", bans[0].Reason)
+
+	require.ErrorIs(t, h1.Connect(ctx, h2pi), ErrPeerBanned)
+	_, err := h1.NewStream(ctx, h2.ID(), "/test")
+	require.ErrorIs(t, err, ErrPeerBanned)
+	_, _, err = h1.NegotiateStream(ctx, h2.ID(), time.Second, "/test")
+	require.ErrorIs(t, err, ErrPeerBanned)
+
+	// connections from the banned peer are closed.
+	require.NoError(t, h2.Connect(ctx, h1.Peerstore().PeerInfo(h1.ID())))
+	require.Eventually(t, func() bool {
+		return h1.Network().Connectedness(h2.ID()) != network.Connected
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// the ban expires.
+	require.Eventually(t, func() bool { return !h1.IsBanned(h2.ID()) }, 2*time.Second, 10*time.Millisecond)
+	require.Empty(t, h1.BannedPeers())
+	require.NoError(t, h1.Connect(ctx, h2pi))
+}
+
+func TestUnbanPeer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := New(swarmt.GenSwarm(t, ctx))
+	h2 := New(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	defer h2.Close()
+
+	h2pi := h2.Peerstore().PeerInfo(h2.ID())
+	require.NoError(t, h1.BanPeer(h2.ID(), time.Hour, "test"))
+	require.ErrorIs(t, h1.Connect(ctx, h2pi), ErrPeerBanned)
+	h1.UnbanPeer(h2.ID())
+	require.False(t, h1.IsBanned(h2.ID()))
+	require.NoError(t, h1.Connect(ctx, h2pi))
+}
+
+func TestStreamGate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for _, gate := range []StreamGate{StreamGateHold, StreamGateReject} {
+		h1, err := NewHost(ctx, swarmt.GenSwarm(t, ctx), &HostOpts{StreamGate: gate})
+		require.NoError(t, err)
+		defer h1.Close()
+		h2 := New(swarmt.GenSwarm(t, ctx))
+		defer h2.Close()
+
+		handled := make(chan struct{}, 1)
+		h1.SetStreamHandler("/test", func(s network.Stream) {
+			handled <- struct{}{}
+			s.Close()
+		})
+		// h2 stalls identify until released.
+		release := make(chan struct{})
+		h2.SetStreamHandler(identify.ID, func(s network.Stream) {
+			<-release
+			s.Reset()
+		})
+
+		require.NoError(t, h2.Connect(ctx, h1.Peerstore().PeerInfo(h1.ID())))
+		s, err := h2.NewStream(ctx, h1.ID(), "/test")
+		require.NoError(t, err)
+		_, err = s.Write([]byte("hello"))
+		require.NoError(t, err)
+
+		if gate == StreamGateReject {
+			_, err = s.Read(make([]byte, 1))
+			require.Error(t, err)
+			require.Empty(t, handled)
+			close(release)
+			continue
+		}
+
+		select {
+		case <-handled:
+			t.Fatal("stream handled before identify completed")
+		case <-time.After(200 * time.Millisecond):
+		}
+		close(release)
+		select {
+		case <-handled:
+		case <-time.After(5 * time.Second):
+			t.Fatal("stream not handled after identify completed")
+		}
+	}
+}
+
+func TestStreamQuotas(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	quotas := quota.NewManager()
+	quotas.SetLimit("sync", quota.Limit{Streams: 1})
+	h1, err := NewHost(ctx, swarmt.GenSwarm(t, ctx), &HostOpts{Quotas: quotas})
+	require.NoError(t, err)
+	defer h1.Close()
+	h2 := New(swarmt.GenSwarm(t, ctx))
+	defer h2.Close()
+	h2.SetStreamHandler("/test", func(s network.Stream) {
+		io.Copy(ioutil.Discard, s)
+		s.Close()
+	})
+	require.NoError(t, h1.Connect(ctx, h2.Peerstore().PeerInfo(h2.ID())))
+
+	syncCtx := quota.WithToken(ctx, "sync")
+	s, err := h1.NewStream(syncCtx, h2.ID(), "/test")
+	require.NoError(t, err)
+	_, err = h1.NewStream(syncCtx, h2.ID(), "/test")
+	require.True(t, errors.Is(err, quota.ErrQuotaExceeded))
+	_, _, err = h1.NegotiateStream(syncCtx, h2.ID(), 0, "/test")
+	require.True(t, errors.Is(err, quota.ErrQuotaExceeded))
+
+	// streams without a token, or under another one, aren't limited.
+	s2, err := h1.NewStream(ctx, h2.ID(), "/test")
+	require.NoError(t, err)
+	defer s2.Close()
+	s3, _, err := h1.NegotiateStream(quota.WithToken(ctx, "gossip"), h2.ID(), 0, "/test")
+	require.NoError(t, err)
+	defer s3.Close()
+
+	_, err = s.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+	require.Equal(t, quota.Usage{BytesOut: 5, Rejected: 2}, quotas.Usage("sync"))
+
+	s, err = h1.NewStream(syncCtx, h2.ID(), "/test")
+	require.NoError(t, err)
+	s.Reset()
+
+	// failing to open a stream doesn't use the quota.
+	require.NoError(t, h1.BanPeer(h2.ID(), time.Minute, "test"))
+	_, err = h1.NewStream(syncCtx, h2.ID(), "/test")
+	require.Equal(t, ErrPeerBanned, err)
+	require.Equal(t, 0, quotas.Usage("sync").Streams)
+}
+
+func TestHandlerMetrics(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	reg := prometheus.NewRegistry()
+	handlers, err := handlermetrics.NewTracker(handlermetrics.Registerer(reg))
+	require.NoError(t, err)
+	defer handlers.Close()
+	h1 := New(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	h2, err := NewHost(ctx, swarmt.GenSwarm(t, ctx), &HostOpts{HandlerMetrics: handlers})
+	require.NoError(t, err)
+	defer h2.Close()
+	done := make(chan struct{})
+	h2.SetStreamHandler("/test", func(s network.Stream) {
+		defer close(done)
+		io.Copy(ioutil.Discard, s)
+		s.Close()
+	})
+	require.NoError(t, h1.Connect(ctx, h2.Peerstore().PeerInfo(h2.ID())))
+
+	s, err := h1.NewStream(ctx, h2.ID(), "/test")
+	require.NoError(t, err)
+	_, err = s.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+	<-done
+	require.Eventually(t, func() bool {
+		// other handlers, e.g. identify's, are measured too.
+		mfs, err := reg.Gather()
+		if err != nil {
+			return false
+		}
+		for _, mf := range mfs {
+			if mf.GetName() != "libp2p_handler_streams_total" {
+				continue
+			}
+			for _, m := range mf.Metric {
+				if len(m.Label) == 2 && m.Label[0].GetValue() == "/test" {
+					return m.Label[1].GetValue() == "ok" && m.Counter.GetValue() == 1
+				}
+			}
+		}
+		return false
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestKeyMismatchBan(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1, err := NewHost(ctx, swarmt.GenSwarm(t, ctx), &HostOpts{KeyMismatchBan: time.Minute})
+	require.NoError(t, err)
+	defer h1.Close()
+	h2 := New(swarmt.GenSwarm(t, ctx))
+	defer h2.Close()
+
+	// h2 claims another peer's key.
+	_, otherKey, err := test.RandTestKeyPair(crypto.Ed25519, 0)
+	require.NoError(t, err)
+	kb, err := crypto.MarshalPublicKey(otherKey)
+	require.NoError(t, err)
+	h2.SetStreamHandler(identify.ID, func(s network.Stream) {
+		_ = protoio.NewDelimitedWriter(s).WriteMsg(&pb.Identify{PublicKey: kb})
+		s.Close()
+	})
+
+	require.NoError(t, h1.Connect(ctx, h2.Peerstore().PeerInfo(h2.ID())))
+	require.Eventually(t, func() bool { return h1.IsBanned(h2.ID()) }, 5*time.Second, 10*time.Millisecond)
+	require.Eventually(t, func() bool {
+		return h1.Network().Connectedness(h2.ID()) != network.Connected
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestLazyIdentify(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1, err := NewHost(ctx, swarmt.GenSwarm(t, ctx), &HostOpts{LazyIdentify: true})
+	require.NoError(t, err)
+	defer h1.Close()
+	h2 := New(swarmt.GenSwarm(t, ctx))
+	defer h2.Close()
+	h2.SetStreamHandler("/test", func(s network.Stream) { s.Close() })
+
+	// connecting doesn't identify the peer.
+	require.NoError(t, h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+	require.Empty(t, h1.IDService().DebugDump().Conns)
+
+	// opening a stream for a protocol we don't know the peer supports does.
+	s, err := h1.NewStream(ctx, h2.ID(), "/test")
+	require.NoError(t, err)
+	s.Close()
+	conns := h1.IDService().DebugDump().Conns
+	require.Len(t, conns, 1)
+	require.Equal(t, identify.IdentifyDone, conns[0].Stage)
+	protos, err := h1.Peerstore().SupportsProtocols(h2.ID(), "/test")
+	require.NoError(t, err)
+	require.Equal(t, []string{"/test"}, protos)
+}
+
+type fakeMapping struct {
+	protocol string
+	internal int
+	external net.Addr
+}
+
+func (m fakeMapping) Protocol() string                { return m.protocol }
+func (m fakeMapping) InternalPort() int               { return m.internal }
+func (m fakeMapping) ExternalAddr() (net.Addr, error) { return m.external, nil }
+
+func TestPortMappingDiffs(t *testing.T) {
+	listen := []ma.Multiaddr{
+		ma.StringCast("/ip4/0.0.0.0/tcp/4001"),
+		ma.StringCast("/ip4/0.0.0.0/udp/4001/quic"),
+		ma.StringCast("/ip4/0.0.0.0/tcp/4002"),
+	}
+	iface := []ma.Multiaddr{ma.StringCast("/ip4/192.168.1.2")}
+	observed := map[string][]ma.Multiaddr{
+		"/ip4/192.168.1.2/tcp/4001":      {ma.StringCast("/ip4/1.2.3.4/tcp/62000")},
+		"/ip4/192.168.1.2/udp/4001/quic": {ma.StringCast("/ip4/1.2.3.4/udp/4001/quic")},
+		"/ip4/192.168.1.2/tcp/4002":      {ma.StringCast("/ip4/1.2.3.4/tcp/5555")},
+	}
+	observedFor := func(a ma.Multiaddr) []ma.Multiaddr { return observed[a.String()] }
+	mappings := []portMapping{
+		// peers observe another port.
+		fakeMapping{"tcp", 4001, &net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 4001}},
+		// peers agree.
+		fakeMapping{"udp", 4001, &net.UDPAddr{IP: net.ParseIP("1.2.3.4"), Port: 4001}},
+		// behind another NAT, the router reports its private IP.
+		fakeMapping{"tcp", 4002, &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 5555}},
+		// nobody observed it.
+		fakeMapping{"tcp", 4003, &net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 4003}},
+	}
+
+	diffs := portMappingDiffs(mappings, listen, iface, observedFor)
+	require.Equal(t, []PortMappingDiff{{
+		Protocol:     "tcp",
+		InternalPort: 4001,
+		Mapped:       ma.StringCast("/ip4/1.2.3.4/tcp/4001"),
+		Observed:     []ma.Multiaddr{ma.StringCast("/ip4/1.2.3.4/tcp/62000")},
+	}}, diffs)
+	require.True(t, samePortMappingDiffs(diffs, portMappingDiffs(mappings, listen, iface, observedFor)))
+
+	observed["/ip4/192.168.1.2/tcp/4001"] = append(observed["/ip4/192.168.1.2/tcp/4001"], ma.StringCast("/ip4/1.2.3.4/tcp/4001"))
+	require.Empty(t, portMappingDiffs(mappings, listen, iface, observedFor))
+	require.False(t, samePortMappingDiffs(diffs, nil))
+}
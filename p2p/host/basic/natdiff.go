@@ -0,0 +1,229 @@
+package basichost
+
+import (
+	"net"
+	"sort"
+	"strings"
+
+	addrutil "github.com/libp2p/go-addr-util"
+	inat "github.com/libp2p/go-libp2p-nat"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// PortMappingDiff is a port mapping of our NAT device that our peers disagree
+// with: they observe us at other external addresses than the one the device
+// reported for the mapping, e.g. the router says it maps port 4001 but peers
+// observe port 62000. The mapping is most probably broken, or we're behind
+// another NAT.
+type PortMappingDiff struct {
+	// Protocol is the protocol of the mapping, "tcp" or "udp", and
+	// InternalPort the port it maps.
+	Protocol     string
+	InternalPort int
+	// Mapped is the external address the NAT device reported.
+	Mapped ma.Multiaddr
+	// Observed are the activated observed addresses of the listen
+	// addresses the mapping maps. None of them matches Mapped.
+	Observed []ma.Multiaddr
+}
+
+// EvtPortMappingMismatch is emitted when the port mappings of our NAT device
+// that our peers disagree with changed, so that the port mapping subsystem
+// can retry or drop broken mappings. See BasicHost.PortMappingDiffs.
+type EvtPortMappingMismatch struct {
+	// Diffs are all the mappings peers currently disagree with, empty once
+	// they agree with all of them.
+	Diffs []PortMappingDiff
+}
+
+// portMapping is the part of a NAT port mapping we compare, see inat.Mapping.
+type portMapping interface {
+	Protocol() string
+	InternalPort() int
+	ExternalAddr() (net.Addr, error)
+}
+
+var _ portMapping = (inat.Mapping)(nil)
+
+// PortMappingDiffs compares the external addresses of the port mappings of our
+// NAT device with the activated addresses peers observe us at, and returns the
+// mappings they disagree with. Mappings nobody observed yet aren't returned.
+// It returns nil if we don't map ports.
+func (h *BasicHost) PortMappingDiffs() []PortMappingDiff {
+	if h.natmgr == nil || h.natmgr.NAT() == nil || h.ids == nil {
+		return nil
+	}
+	natMappings := h.natmgr.NAT().Mappings()
+	mappings := make([]portMapping, 0, len(natMappings))
+	for _, m := range natMappings {
+		mappings = append(mappings, m)
+	}
+
+	h.addrMu.RLock()
+	allIfaceAddrs := h.allInterfaceAddrs
+	h.addrMu.RUnlock()
+
+	return portMappingDiffs(mappings, h.Network().ListenAddresses(), allIfaceAddrs, h.ids.ObservedAddrsFor)
+}
+
+func portMappingDiffs(mappings []portMapping, listenAddrs, ifaceAddrs []ma.Multiaddr, observedFor func(ma.Multiaddr) []ma.Multiaddr) []PortMappingDiff {
+	var diffs []PortMappingDiff
+	for _, m := range mappings {
+		ext, err := m.ExternalAddr()
+		if err != nil {
+			// mapping not ready yet.
+			continue
+		}
+		mapped, err := manet.FromNetAddr(ext)
+		if err != nil {
+			continue
+		}
+
+		var (
+			observed  []ma.Multiaddr
+			confirmed bool
+		)
+		for _, listen := range listenAddrs {
+			if !listensOn(listen, m.Protocol(), m.InternalPort()) {
+				continue
+			}
+			resolved, err := addrutil.ResolveUnspecifiedAddress(listen, ifaceAddrs)
+			if err != nil {
+				continue
+			}
+			for _, addr := range resolved {
+				for _, obs := range observedFor(addr) {
+					match, ok := matchesMapping(obs, mapped)
+					if !ok {
+						continue
+					}
+					if match {
+						confirmed = true
+					} else {
+						observed = append(observed, obs)
+					}
+				}
+			}
+		}
+		if confirmed || len(observed) == 0 {
+			continue
+		}
+		sort.Slice(observed, func(i, j int) bool { return observed[i].String() < observed[j].String() })
+		diffs = append(diffs, PortMappingDiff{
+			Protocol:     m.Protocol(),
+			InternalPort: m.InternalPort(),
+			Mapped:       mapped,
+			Observed:     observed,
+		})
+	}
+	sort.Slice(diffs, func(i, j int) bool {
+		if diffs[i].Protocol != diffs[j].Protocol {
+			return diffs[i].Protocol < diffs[j].Protocol
+		}
+		return diffs[i].InternalPort < diffs[j].InternalPort
+	})
+	return diffs
+}
+
+// listensOn returns true if the listen address is on the given port of the
+// given protocol, "tcp" or "udp".
+func listensOn(listen ma.Multiaddr, protocol string, port int) bool {
+	transport, _ := splitThinWaist(listen)
+	naddr, err := manet.ToNetAddr(transport)
+	if err != nil {
+		return false
+	}
+	switch naddr := naddr.(type) {
+	case *net.TCPAddr:
+		return protocol == "tcp" && naddr.Port == port
+	case *net.UDPAddr:
+		return protocol == "udp" && naddr.Port == port
+	}
+	return false
+}
+
+// matchesMapping returns whether the observed address matches the mapped
+// external address, ok being false if the observation isn't of the mapping's
+// protocol. The IPs are only compared if the mapped one is public: routers
+// behind another NAT report their private address.
+func matchesMapping(observed, mapped ma.Multiaddr) (match bool, ok bool) {
+	transport, _ := splitThinWaist(observed)
+	if len(transport.Protocols()) != 2 || !sameProtocols(transport, mapped) {
+		return false, false
+	}
+	if manet.IsPublicAddr(mapped) {
+		return transport.Equal(mapped), true
+	}
+	_, obsPort := ma.SplitFirst(transport)
+	_, mappedPort := ma.SplitFirst(mapped)
+	return obsPort.Equal(mappedPort), true
+}
+
+func sameProtocols(a, b ma.Multiaddr) bool {
+	pa, pb := a.Protocols(), b.Protocols()
+	if len(pa) != len(pb) {
+		return false
+	}
+	for i := range pa {
+		if pa[i].Code != pb[i].Code {
+			return false
+		}
+	}
+	return true
+}
+
+// splitThinWaist splits the address after its IP and TCP or UDP components.
+func splitThinWaist(a ma.Multiaddr) (transport, rest ma.Multiaddr) {
+	found := false
+	return ma.SplitFunc(a, func(c ma.Component) bool {
+		if found {
+			return true
+		}
+		switch c.Protocol().Code {
+		case ma.P_TCP, ma.P_UDP:
+			found = true
+		}
+		return false
+	})
+}
+
+// samePortMappingDiffs returns true if both sets of diffs are the same.
+func samePortMappingDiffs(a, b []PortMappingDiff) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Protocol != b[i].Protocol || a[i].InternalPort != b[i].InternalPort ||
+			!a[i].Mapped.Equal(b[i].Mapped) || joinAddrs(a[i].Observed) != joinAddrs(b[i].Observed) {
+			return false
+		}
+	}
+	return true
+}
+
+func joinAddrs(addrs []ma.Multiaddr) string {
+	s := make([]string, len(addrs))
+	for i, a := range addrs {
+		s[i] = a.String()
+	}
+	return strings.Join(s, ",")
+}
+
+// emitPortMappingDiffs emits an EvtPortMappingMismatch if the port mappings
+// peers disagree with changed since the last diffs, and returns the current
+// ones.
+func (h *BasicHost) emitPortMappingDiffs(last []PortMappingDiff) []PortMappingDiff {
+	diffs := h.PortMappingDiffs()
+	if samePortMappingDiffs(diffs, last) {
+		return last
+	}
+	for _, d := range diffs {
+		log.Infow("peers disagree with NAT port mapping",
+			"protocol", d.Protocol, "port", d.InternalPort, "mapped", d.Mapped, "observed", d.Observed)
+	}
+	if err := h.emitters.evtPortMappingMismatch.Emit(EvtPortMappingMismatch{Diffs: diffs}); err != nil {
+		log.Warnf("error emitting event for port mapping mismatches: %s", err)
+	}
+	return diffs
+}
@@ -0,0 +1,195 @@
+package basichost
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	autonat "github.com/libp2p/go-libp2p-autonat"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/libp2p/go-libp2p/p2p/protocol/ping"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// DefaultSelfTestCheckTimeout is the default value for
+// SelfTestOpts.CheckTimeout.
+var DefaultSelfTestCheckTimeout = 15 * time.Second
+
+// SelfTestOpts configures the checks run by BasicHost.SelfTest.
+type SelfTestOpts struct {
+	// Peers are pinged, and asked to dial us back if they run the AutoNAT
+	// service. Typically the bootstrap and relay peers of the application.
+	Peers []peer.AddrInfo
+
+	// DNSAddrs are resolved with the host's multiaddr resolver, e.g.
+	// /dnsaddr/bootstrap.libp2p.io.
+	DNSAddrs []ma.Multiaddr
+
+	// CheckTimeout bounds the time spent on each individual check.
+	// If 0 or omitted, it will use DefaultSelfTestCheckTimeout.
+	CheckTimeout time.Duration
+}
+
+// SelfTestCheck is the outcome of a single connectivity check.
+type SelfTestCheck struct {
+	// Name identifies the check, e.g. "listen" or "ping/<peer id>".
+	Name string
+	// Err is nil if the check passed.
+	Err error
+	// Detail is a human readable description of what the check found.
+	Detail   string
+	Duration time.Duration
+}
+
+// Passed returns true if the check passed.
+func (c *SelfTestCheck) Passed() bool {
+	return c.Err == nil
+}
+
+// SelfTestReport is the result of BasicHost.SelfTest.
+type SelfTestReport struct {
+	Checks []SelfTestCheck
+}
+
+// Passed returns true if all the checks passed.
+func (r *SelfTestReport) Passed() bool {
+	for i := range r.Checks {
+		if !r.Checks[i].Passed() {
+			return false
+		}
+	}
+	return true
+}
+
+// SelfTest runs an on-demand connectivity diagnostic and reports the outcome
+// of every check. It checks that we're listening, asks the given peers to
+// dial us back via AutoNAT, pings them, and resolves the given DNS addresses.
+//
+// SelfTest is meant for "connection doctor" style UIs: it doesn't change the
+// host's configuration, though it does connect to the given peers.
+func (h *BasicHost) SelfTest(ctx context.Context, opts SelfTestOpts) *SelfTestReport {
+	timeout := opts.CheckTimeout
+	if timeout == 0 {
+		timeout = DefaultSelfTestCheckTimeout
+	}
+
+	report := new(SelfTestReport)
+	run := func(name string, check func(ctx context.Context) (string, error)) {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+
+		start := time.Now()
+		detail, err := check(ctx)
+		report.Checks = append(report.Checks, SelfTestCheck{
+			Name:     name,
+			Err:      err,
+			Detail:   detail,
+			Duration: time.Since(start),
+		})
+	}
+
+	run("listen", h.checkListen)
+	run("autonat", func(ctx context.Context) (string, error) {
+		return h.checkDialBack(ctx, opts.Peers)
+	})
+	for _, pi := range opts.Peers {
+		pi := pi
+		run("ping/"+pi.ID.Pretty(), func(ctx context.Context) (string, error) {
+			return h.checkPing(ctx, pi)
+		})
+	}
+	for _, addr := range opts.DNSAddrs {
+		addr := addr
+		run("resolve/"+addr.String(), func(ctx context.Context) (string, error) {
+			return h.checkResolve(ctx, addr)
+		})
+	}
+	return report
+}
+
+func (h *BasicHost) checkListen(context.Context) (string, error) {
+	laddrs := h.Network().ListenAddresses()
+	if len(laddrs) == 0 {
+		return "", errors.New("not listening on any address")
+	}
+	addrs := h.Addrs()
+	if len(addrs) == 0 {
+		return "", fmt.Errorf("listening on %s, but not advertising any address", laddrs)
+	}
+	return fmt.Sprintf("listening on %s, advertising %s", laddrs, addrs), nil
+}
+
+// checkDialBack asks the given peers that support AutoNAT to dial us back,
+// stopping at the first one that succeeds. If none of the peers support
+// AutoNAT, it reports the reachability determined by the host's AutoNAT
+// service, if any.
+func (h *BasicHost) checkDialBack(ctx context.Context, peers []peer.AddrInfo) (string, error) {
+	client := autonat.NewAutoNATClient(h, h.AllAddrs)
+
+	var lastErr error
+	for _, pi := range peers {
+		if err := h.Connect(ctx, pi); err != nil {
+			lastErr = err
+			continue
+		}
+		if protos, err := h.Peerstore().SupportsProtocols(pi.ID, autonat.AutoNATProto); err != nil || len(protos) == 0 {
+			continue
+		}
+		addr, err := client.DialBack(ctx, pi.ID)
+		if err != nil {
+			lastErr = fmt.Errorf("dial back from %s failed: %w", pi.ID, err)
+			continue
+		}
+		return fmt.Sprintf("%s dialed us back on %s", pi.ID, addr), nil
+	}
+	if lastErr != nil {
+		return "", lastErr
+	}
+
+	if an := h.GetAutoNat(); an != nil {
+		switch status := an.Status(); status {
+		case network.ReachabilityPublic:
+			addr, _ := an.PublicAddr()
+			return fmt.Sprintf("reachable on %s", addr), nil
+		default:
+			return "", fmt.Errorf("reachability is %s", status)
+		}
+	}
+	return "", errors.New("no AutoNAT peers or service available")
+}
+
+func (h *BasicHost) checkPing(ctx context.Context, pi peer.AddrInfo) (string, error) {
+	if err := h.Connect(ctx, pi); err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	select {
+	case res, ok := <-ping.Ping(ctx, h, pi.ID):
+		if !ok {
+			return "", ctx.Err()
+		}
+		if res.Error != nil {
+			return "", res.Error
+		}
+		return fmt.Sprintf("rtt %s", res.RTT), nil
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+func (h *BasicHost) checkResolve(ctx context.Context, addr ma.Multiaddr) (string, error) {
+	addrs, err := h.maResolver.Resolve(ctx, addr)
+	if err != nil {
+		return "", err
+	}
+	if len(addrs) == 0 {
+		return "", fmt.Errorf("%s resolved to no addresses", addr)
+	}
+	return fmt.Sprintf("resolved to %s", addrs), nil
+}
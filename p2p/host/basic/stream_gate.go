@@ -0,0 +1,54 @@
+package basichost
+
+import (
+	"github.com/libp2p/go-libp2p-core/network"
+)
+
+// StreamGate controls when inbound application streams are passed to their
+// handlers, relative to identifying the connection they were opened on.
+type StreamGate int
+
+const (
+	// StreamGateNone passes streams to their handlers right away. Handlers
+	// may run before we learn the remote peer's protocols and agent version.
+	StreamGateNone StreamGate = iota
+	// StreamGateHold holds streams until the connection is identified, or
+	// identifying it failed, before passing them to their handlers.
+	StreamGateHold
+	// StreamGateReject resets the streams opened before the connection is
+	// identified. The remote peer can retry shortly after.
+	StreamGateReject
+)
+
+// gateStream applies the host's StreamGate to the given inbound stream. It
+// returns false if the stream must not be handled, after resetting it.
+func (h *BasicHost) gateStream(s network.Stream) bool {
+	if h.streamGate == StreamGateNone {
+		return true
+	}
+	// identify protocols are never gated: the remote peer may use them
+	// before we identified it.
+	if h.ids.IsIdentifyProtocol(s.Protocol()) {
+		return true
+	}
+
+	identified := h.ids.IdentifyWait(s.Conn())
+	select {
+	case <-identified:
+		return true
+	default:
+	}
+
+	if h.streamGate == StreamGateReject {
+		log.Debugw("rejecting stream from unidentified connection", "peer", s.Conn().RemotePeer(), "protocol", s.Protocol())
+		s.Reset()
+		return false
+	}
+	select {
+	case <-identified:
+		return true
+	case <-h.ctx.Done():
+		s.Reset()
+		return false
+	}
+}
@@ -0,0 +1,221 @@
+// Package batchdial connects a host to large sets of peers, e.g. for crawlers
+// or to warm up a node after bootstrap, without spawning a goroutine per peer.
+//
+// A Dialer bounds the number of concurrent dials and the rate at which new
+// dials start, across all the batches it dials. Peers are dialed by priority,
+// and results are streamed back as the dials complete.
+package batchdial
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+var log = logging.Logger("batchdial")
+
+// Result is the outcome of dialing a single peer.
+type Result struct {
+	Peer peer.ID
+	// Err is nil if we're connected to the peer.
+	Err error
+	// AlreadyConnected is true if we were connected to the peer before the
+	// batch dialed it.
+	AlreadyConnected bool
+	// Duration is how long the dial took.
+	Duration time.Duration
+}
+
+type config struct {
+	concurrency int
+	rate        float64
+	timeout     time.Duration
+	priority    func(peer.AddrInfo) int
+}
+
+// Option is an option for a Dialer.
+type Option func(*config)
+
+// Concurrency limits the number of concurrent dials. Defaults to 32.
+func Concurrency(n int) Option {
+	return func(cfg *config) {
+		cfg.concurrency = n
+	}
+}
+
+// Rate limits the number of dials started per second. Defaults to no limit.
+func Rate(perSecond float64) Option {
+	return func(cfg *config) {
+		cfg.rate = perSecond
+	}
+}
+
+// Timeout bounds the time spent dialing a single peer. Defaults to 15s.
+func Timeout(d time.Duration) Option {
+	return func(cfg *config) {
+		cfg.timeout = d
+	}
+}
+
+// Priority orders the peers of a batch: peers with a higher priority are
+// dialed first. Peers of equal priority are dialed in the order given. By
+// default, all peers have the same priority.
+func Priority(f func(peer.AddrInfo) int) Option {
+	return func(cfg *config) {
+		cfg.priority = f
+	}
+}
+
+// Dialer dials batches of peers.
+type Dialer struct {
+	host host.Host
+	cfg  config
+
+	// slots for concurrent dials, shared by all batches.
+	slots chan struct{}
+
+	mu sync.Mutex
+	// the earliest time the next dial may start, when rate limiting.
+	next time.Time
+}
+
+// NewDialer constructs a new Dialer connecting the given host.
+func NewDialer(h host.Host, opts ...Option) *Dialer {
+	cfg := config{
+		concurrency: 32,
+		timeout:     15 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.concurrency <= 0 {
+		cfg.concurrency = 1
+	}
+	return &Dialer{
+		host:  h,
+		cfg:   cfg,
+		slots: make(chan struct{}, cfg.concurrency),
+	}
+}
+
+// Dial connects to the given peers, returning a channel with one Result per
+// peer, delivered as dials complete. The channel is buffered for the whole
+// batch, so it's safe to stop reading from it, and is closed once all peers
+// have been dialed.
+//
+// Canceling the context aborts the pending dials: the peers not dialed yet are
+// reported with the context's error.
+func (d *Dialer) Dial(ctx context.Context, peers []peer.AddrInfo) <-chan Result {
+	out := make(chan Result, len(peers))
+
+	ordered := make([]peer.AddrInfo, len(peers))
+	copy(ordered, peers)
+	if d.cfg.priority != nil {
+		prios := make(map[peer.ID]int, len(ordered))
+		for _, pi := range ordered {
+			prios[pi.ID] = d.cfg.priority(pi)
+		}
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return prios[ordered[i].ID] > prios[ordered[j].ID]
+		})
+	}
+
+	go d.dialBatch(ctx, ordered, out)
+	return out
+}
+
+func (d *Dialer) dialBatch(ctx context.Context, peers []peer.AddrInfo, out chan<- Result) {
+	var wg sync.WaitGroup
+	defer func() {
+		wg.Wait()
+		close(out)
+	}()
+
+	for i, pi := range peers {
+		if d.host.Network().Connectedness(pi.ID) == network.Connected {
+			out <- Result{Peer: pi.ID, AlreadyConnected: true}
+			continue
+		}
+
+		if err := d.acquire(ctx); err != nil {
+			for _, pi := range peers[i:] {
+				out <- Result{Peer: pi.ID, Err: err}
+			}
+			return
+		}
+
+		wg.Add(1)
+		go func(pi peer.AddrInfo) {
+			defer wg.Done()
+			defer d.release()
+			out <- d.dial(ctx, pi)
+		}(pi)
+	}
+}
+
+func (d *Dialer) dial(ctx context.Context, pi peer.AddrInfo) Result {
+	ctx, cancel := context.WithTimeout(ctx, d.cfg.timeout)
+	defer cancel()
+
+	start := time.Now()
+	err := d.host.Connect(ctx, pi)
+	if err != nil {
+		log.Debugw("dial failed", "peer", pi.ID, "error", err)
+	}
+	return Result{Peer: pi.ID, Err: err, Duration: time.Since(start)}
+}
+
+// acquire waits for a dial slot, and for our turn under the rate limit.
+func (d *Dialer) acquire(ctx context.Context) error {
+	select {
+	case d.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if err := d.waitTurn(ctx); err != nil {
+		d.release()
+		return err
+	}
+	return nil
+}
+
+func (d *Dialer) release() {
+	<-d.slots
+}
+
+// waitTurn spaces dials evenly to respect the rate limit.
+func (d *Dialer) waitTurn(ctx context.Context) error {
+	if d.cfg.rate <= 0 {
+		return nil
+	}
+	interval := time.Duration(float64(time.Second) / d.cfg.rate)
+
+	d.mu.Lock()
+	now := time.Now()
+	turn := d.next
+	if turn.Before(now) {
+		turn = now
+	}
+	d.next = turn.Add(interval)
+	d.mu.Unlock()
+
+	wait := time.Until(turn)
+	if wait <= 0 {
+		return nil
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
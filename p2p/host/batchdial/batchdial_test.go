@@ -0,0 +1,144 @@
+package batchdial
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/test"
+
+	bhost "github.com/libp2p/go-libp2p/p2p/host/basic"
+
+	swarmt "github.com/libp2p/go-libp2p-swarm/testing"
+	"github.com/stretchr/testify/require"
+)
+
+func makePeers(t *testing.T, ctx context.Context, n int) []host.Host {
+	hosts := make([]host.Host, n)
+	for i := range hosts {
+		hosts[i] = bhost.New(swarmt.GenSwarm(t, ctx))
+	}
+	return hosts
+}
+
+func closeAll(hosts []host.Host) {
+	for _, h := range hosts {
+		h.Close()
+	}
+}
+
+func addrInfos(hosts []host.Host) []peer.AddrInfo {
+	infos := make([]peer.AddrInfo, len(hosts))
+	for i, h := range hosts {
+		infos[i] = peer.AddrInfo{ID: h.ID(), Addrs: h.Addrs()}
+	}
+	return infos
+}
+
+func TestDial(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h := bhost.New(swarmt.GenSwarm(t, ctx))
+	defer h.Close()
+	peers := makePeers(t, ctx, 8)
+	defer closeAll(peers)
+
+	infos := addrInfos(peers)
+	// one peer we're already connected to.
+	require.NoError(t, h.Connect(ctx, infos[0]))
+	// one peer we can't dial.
+	unreachable, err := test.RandPeerID()
+	require.NoError(t, err)
+	infos = append(infos, peer.AddrInfo{ID: unreachable})
+
+	d := NewDialer(h, Concurrency(3), Timeout(time.Second))
+	results := make(map[peer.ID]Result)
+	for res := range d.Dial(ctx, infos) {
+		_, dup := results[res.Peer]
+		require.False(t, dup, "got two results for %s", res.Peer)
+		results[res.Peer] = res
+	}
+	require.Len(t, results, len(infos))
+
+	require.True(t, results[peers[0].ID()].AlreadyConnected)
+	for _, p := range peers {
+		require.NoError(t, results[p.ID()].Err)
+		require.Equal(t, network.Connected, h.Network().Connectedness(p.ID()))
+	}
+	require.Error(t, results[unreachable].Err)
+	require.False(t, results[unreachable].AlreadyConnected)
+}
+
+func TestDialPriority(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h := bhost.New(swarmt.GenSwarm(t, ctx))
+	defer h.Close()
+	peers := makePeers(t, ctx, 4)
+	defer closeAll(peers)
+
+	infos := addrInfos(peers)
+	prios := map[peer.ID]int{
+		infos[0].ID: 1,
+		infos[1].ID: 3,
+		infos[2].ID: 1,
+		infos[3].ID: 2,
+	}
+	d := NewDialer(h, Concurrency(1), Priority(func(pi peer.AddrInfo) int { return prios[pi.ID] }))
+
+	var order []peer.ID
+	for res := range d.Dial(ctx, infos) {
+		require.NoError(t, res.Err)
+		order = append(order, res.Peer)
+	}
+	require.Equal(t, []peer.ID{infos[1].ID, infos[3].ID, infos[0].ID, infos[2].ID}, order)
+}
+
+func TestDialRate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h := bhost.New(swarmt.GenSwarm(t, ctx))
+	defer h.Close()
+	peers := makePeers(t, ctx, 5)
+	defer closeAll(peers)
+
+	// 20 dials per second: the 5th dial can't start before 200ms.
+	d := NewDialer(h, Rate(20))
+	start := time.Now()
+	for res := range d.Dial(ctx, addrInfos(peers)) {
+		require.NoError(t, res.Err)
+	}
+	require.GreaterOrEqual(t, int64(time.Since(start)), int64(200*time.Millisecond))
+}
+
+func TestDialCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h := bhost.New(swarmt.GenSwarm(t, ctx))
+	defer h.Close()
+	peers := makePeers(t, ctx, 3)
+	defer closeAll(peers)
+
+	// one dial per hour: only the first peer is dialed before we cancel.
+	dialCtx, dialCancel := context.WithCancel(ctx)
+	d := NewDialer(h, Rate(1.0/3600))
+	results := d.Dial(dialCtx, addrInfos(peers))
+
+	res := <-results
+	require.NoError(t, res.Err)
+	dialCancel()
+
+	var canceled int
+	for res := range results {
+		require.ErrorIs(t, res.Err, context.Canceled)
+		canceled++
+	}
+	require.Equal(t, 2, canceled)
+}
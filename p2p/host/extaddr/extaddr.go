@@ -0,0 +1,197 @@
+// Package extaddr collects external addresses confirmed by systems outside of
+// libp2p, like an operator's own reachability checker or a cloud metadata
+// service. Each source votes for addresses with a confidence and a TTL, and the
+// addresses enough confidence was expressed in are advertised by the host along
+// with its observed and AutoNAT addresses.
+//
+// Hosts constructed by libp2p have a Book, see BasicHost.ExternalAddrs, or the
+// libp2p.ExternalAddrs option to share one.
+package extaddr
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+var log = logging.Logger("extaddr")
+
+// DefaultThreshold is the confidence addresses need to be confirmed, unless
+// set otherwise with SetThreshold.
+const DefaultThreshold = 0.5
+
+// Book holds the votes of external sources for our external addresses.
+type Book struct {
+	mu        sync.Mutex
+	threshold float64
+	// addr bytes -> votes
+	addrs map[string]*entry
+
+	changed chan struct{}
+
+	now func() time.Time
+}
+
+type entry struct {
+	addr ma.Multiaddr
+	// source -> vote
+	votes map[string]vote
+}
+
+type vote struct {
+	confidence float64
+	expires    time.Time
+}
+
+// NewBook constructs a new, empty, Book.
+func NewBook() *Book {
+	return &Book{
+		threshold: DefaultThreshold,
+		addrs:     make(map[string]*entry),
+		changed:   make(chan struct{}, 1),
+		now:       time.Now,
+	}
+}
+
+// SetThreshold sets the combined confidence addresses need to be confirmed,
+// in (0, 1].
+func (b *Book) SetThreshold(t float64) error {
+	if t <= 0 || t > 1 {
+		return errors.New("threshold must be in (0, 1]")
+	}
+	b.mu.Lock()
+	b.threshold = t
+	b.mu.Unlock()
+	b.signal()
+	return nil
+}
+
+// Submit records the vote of the given source for an external address: the
+// source is confident, from 0 (not at all) to 1 (certain), that we're
+// reachable at the address, for the given TTL. It replaces the previous vote
+// of the source for the address, if any.
+//
+// The votes of distinct sources add up: an address two sources are 50%
+// confident in is confirmed with a confidence of 75%.
+func (b *Book) Submit(source string, a ma.Multiaddr, ttl time.Duration, confidence float64) error {
+	switch {
+	case a == nil:
+		return errors.New("nil address")
+	case ttl <= 0:
+		return errors.New("ttl must be positive")
+	case confidence < 0 || confidence > 1:
+		return errors.New("confidence must be in [0, 1]")
+	}
+
+	b.mu.Lock()
+	key := string(a.Bytes())
+	e, ok := b.addrs[key]
+	if !ok {
+		e = &entry{addr: a, votes: make(map[string]vote)}
+		b.addrs[key] = e
+	}
+	e.votes[source] = vote{confidence: confidence, expires: b.now().Add(ttl)}
+	b.mu.Unlock()
+
+	log.Debugw("external address vote", "source", source, "addr", a, "ttl", ttl, "confidence", confidence)
+	b.signal()
+	return nil
+}
+
+// Retract removes the vote of the given source for an external address.
+func (b *Book) Retract(source string, a ma.Multiaddr) {
+	b.mu.Lock()
+	key := string(a.Bytes())
+	var ok bool
+	if e, found := b.addrs[key]; found {
+		_, ok = e.votes[source]
+		delete(e.votes, source)
+		if len(e.votes) == 0 {
+			delete(b.addrs, key)
+		}
+	}
+	b.mu.Unlock()
+	if ok {
+		b.signal()
+	}
+}
+
+// Confidence returns the combined confidence of the unexpired votes for the
+// given address.
+func (b *Book) Confidence(a ma.Multiaddr) float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e, ok := b.addrs[string(a.Bytes())]
+	if !ok {
+		return 0
+	}
+	return b.confidence(e, b.now())
+}
+
+// confidence combines the unexpired votes of an entry, removing the expired
+// ones. The book's mutex must be held.
+func (b *Book) confidence(e *entry, now time.Time) float64 {
+	doubt := 1.0
+	for source, v := range e.votes {
+		if !now.Before(v.expires) {
+			delete(e.votes, source)
+			continue
+		}
+		doubt *= 1 - v.confidence
+	}
+	return 1 - doubt
+}
+
+// Addrs returns the confirmed addresses, most confident first.
+func (b *Book) Addrs() []ma.Multiaddr {
+	type scored struct {
+		addr       ma.Multiaddr
+		confidence float64
+	}
+
+	b.mu.Lock()
+	now := b.now()
+	var addrs []scored
+	for key, e := range b.addrs {
+		c := b.confidence(e, now)
+		if len(e.votes) == 0 {
+			delete(b.addrs, key)
+			continue
+		}
+		if c >= b.threshold {
+			addrs = append(addrs, scored{e.addr, c})
+		}
+	}
+	b.mu.Unlock()
+
+	sort.Slice(addrs, func(i, j int) bool {
+		if addrs[i].confidence != addrs[j].confidence {
+			return addrs[i].confidence > addrs[j].confidence
+		}
+		return string(addrs[i].addr.Bytes()) < string(addrs[j].addr.Bytes())
+	})
+	out := make([]ma.Multiaddr, 0, len(addrs))
+	for _, s := range addrs {
+		out = append(out, s.addr)
+	}
+	return out
+}
+
+// Changed returns a channel signaled when votes are submitted or retracted,
+// meant for the host the book is used by. Votes expiring aren't signaled: the
+// confirmed addresses should be polled as well.
+func (b *Book) Changed() <-chan struct{} {
+	return b.changed
+}
+
+func (b *Book) signal() {
+	select {
+	case b.changed <- struct{}{}:
+	default:
+	}
+}
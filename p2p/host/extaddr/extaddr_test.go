@@ -0,0 +1,71 @@
+package extaddr
+
+import (
+	"testing"
+	"time"
+
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBook(t *testing.T) {
+	now := time.Now()
+	b := NewBook()
+	b.now = func() time.Time { return now }
+
+	a1 := ma.StringCast("/ip4/1.2.3.4/tcp/4001")
+	a2 := ma.StringCast("/ip4/5.6.7.8/tcp/4001")
+
+	require.Error(t, b.Submit("stun", a1, 0, 1))
+	require.Error(t, b.Submit("stun", a1, time.Minute, 1.5))
+
+	// a single unconfident vote isn't enough.
+	require.NoError(t, b.Submit("stun", a1, time.Minute, 0.3))
+	require.Empty(t, b.Addrs())
+
+	// but it adds up with the votes of other sources.
+	require.NoError(t, b.Submit("cloud", a1, 2*time.Minute, 0.3))
+	require.InDelta(t, 0.51, b.Confidence(a1), 1e-9)
+	require.Equal(t, []ma.Multiaddr{a1}, b.Addrs())
+
+	// votes of a source replace its previous ones.
+	require.NoError(t, b.Submit("stun", a1, time.Minute, 0))
+	require.InDelta(t, 0.3, b.Confidence(a1), 1e-9)
+	require.NoError(t, b.Submit("stun", a1, time.Minute, 0.5))
+
+	// most confident first.
+	require.NoError(t, b.Submit("cloud", a2, time.Hour, 1))
+	require.Equal(t, []ma.Multiaddr{a2, a1}, b.Addrs())
+
+	// the stun vote expires.
+	now = now.Add(time.Minute)
+	require.InDelta(t, 0.3, b.Confidence(a1), 1e-9)
+	require.Equal(t, []ma.Multiaddr{a2}, b.Addrs())
+
+	b.Retract("cloud", a2)
+	require.Empty(t, b.Addrs())
+
+	require.NoError(t, b.SetThreshold(0.2))
+	require.Equal(t, []ma.Multiaddr{a1}, b.Addrs())
+	require.Error(t, b.SetThreshold(0))
+}
+
+func TestBookChanged(t *testing.T) {
+	b := NewBook()
+	a := ma.StringCast("/ip4/1.2.3.4/tcp/4001")
+
+	require.NoError(t, b.Submit("stun", a, time.Minute, 1))
+	select {
+	case <-b.Changed():
+	default:
+		t.Fatal("expected a change")
+	}
+
+	// retracting unknown votes doesn't change anything.
+	b.Retract("cloud", a)
+	select {
+	case <-b.Changed():
+		t.Fatal("unexpected change")
+	default:
+	}
+}
@@ -0,0 +1,173 @@
+// Package handlermetrics measures the stream handlers of a host per protocol:
+// how long they run, how many run at once, and how many of their streams end
+// in an error or a reset, exporting all of them as Prometheus metrics.
+//
+// Hosts measure every inbound stream handler with the libp2p.HandlerMetrics
+// option, sparing protocol authors from instrumenting their handlers
+// individually. Handlers can also be wrapped by hand, see Tracker.Handler.
+package handlermetrics
+
+import (
+	"errors"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Result is how a stream handled by a handler ended.
+type Result string
+
+const (
+	// ResultOK is a stream on which reading and writing succeeded.
+	ResultOK Result = "ok"
+	// ResultError is a stream on which reading or writing failed.
+	ResultError Result = "error"
+	// ResultReset is a stream the handler reset.
+	ResultReset Result = "reset"
+)
+
+type config struct {
+	registerer prometheus.Registerer
+	buckets    []float64
+}
+
+// Option is an option for the Tracker.
+type Option func(*config)
+
+// Registerer registers the Tracker's metrics with the given registerer,
+// instead of prometheus.DefaultRegisterer.
+func Registerer(r prometheus.Registerer) Option {
+	return func(cfg *config) {
+		cfg.registerer = r
+	}
+}
+
+// Buckets sets the buckets of the histogram of handler execution times, in
+// seconds. Defaults to prometheus.DefBuckets.
+func Buckets(buckets []float64) Option {
+	return func(cfg *config) {
+		cfg.buckets = buckets
+	}
+}
+
+// Tracker measures stream handlers.
+type Tracker struct {
+	cfg config
+
+	duration *prometheus.HistogramVec
+	active   *prometheus.GaugeVec
+	streams  *prometheus.CounterVec
+}
+
+// NewTracker constructs a new Tracker, registering its metrics.
+func NewTracker(opts ...Option) (*Tracker, error) {
+	cfg := config{
+		registerer: prometheus.DefaultRegisterer,
+		buckets:    prometheus.DefBuckets,
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	t := &Tracker{
+		cfg: cfg,
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "libp2p_handler_duration_seconds",
+			Help:    "Execution time of libp2p stream handlers",
+			Buckets: cfg.buckets,
+		}, []string{"protocol"}),
+		active: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "libp2p_handler_active",
+			Help: "Running libp2p stream handlers",
+		}, []string{"protocol"}),
+		streams: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "libp2p_handler_streams_total",
+			Help: "Streams handled by libp2p stream handlers, by result",
+		}, []string{"protocol", "result"}),
+	}
+
+	collectors := []prometheus.Collector{t.duration, t.active, t.streams}
+	for i, c := range collectors {
+		if err := cfg.registerer.Register(c); err != nil {
+			for _, c := range collectors[:i] {
+				cfg.registerer.Unregister(c)
+			}
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// Close unregisters the metrics.
+func (t *Tracker) Close() error {
+	t.cfg.registerer.Unregister(t.duration)
+	t.cfg.registerer.Unregister(t.active)
+	t.cfg.registerer.Unregister(t.streams)
+	return nil
+}
+
+// Handler wraps the given handler to measure it under the protocol of the
+// streams it handles, which must be set when it's called.
+//
+// The handler is measured until it returns: a handler handing the stream off
+// to another goroutine only accounts for the stream up to that point.
+func (t *Tracker) Handler(handler network.StreamHandler) network.StreamHandler {
+	return func(s network.Stream) {
+		proto := string(s.Protocol())
+		active := t.active.WithLabelValues(proto)
+		active.Inc()
+		ms := &stream{Stream: s}
+		start := time.Now()
+		defer func() {
+			t.duration.WithLabelValues(proto).Observe(time.Since(start).Seconds())
+			active.Dec()
+			t.streams.WithLabelValues(proto, string(ms.result())).Inc()
+		}()
+		handler(ms)
+	}
+}
+
+// stream records how a stream handled by a handler ended.
+type stream struct {
+	network.Stream
+	reset  int32 // atomic
+	failed int32 // atomic
+}
+
+func (s *stream) Read(b []byte) (int, error) {
+	n, err := s.Stream.Read(b)
+	s.check(err)
+	return n, err
+}
+
+func (s *stream) Write(b []byte) (int, error) {
+	n, err := s.Stream.Write(b)
+	s.check(err)
+	return n, err
+}
+
+func (s *stream) check(err error) {
+	if err != nil && !errors.Is(err, io.EOF) {
+		atomic.StoreInt32(&s.failed, 1)
+	}
+}
+
+func (s *stream) Reset() error {
+	atomic.StoreInt32(&s.reset, 1)
+	return s.Stream.Reset()
+}
+
+func (s *stream) result() Result {
+	switch {
+	case atomic.LoadInt32(&s.reset) == 1:
+		return ResultReset
+	case atomic.LoadInt32(&s.failed) == 1:
+		return ResultError
+	default:
+		return ResultOK
+	}
+}
@@ -0,0 +1,79 @@
+package handlermetrics
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	blhost "github.com/libp2p/go-libp2p-blankhost"
+	swarmt "github.com/libp2p/go-libp2p-swarm/testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandler(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	defer h2.Close()
+
+	reg := prometheus.NewRegistry()
+	tr, err := NewTracker(Registerer(reg))
+	require.NoError(t, err)
+	defer tr.Close()
+
+	// a second tracker can't register the same metrics.
+	_, err = NewTracker(Registerer(reg))
+	require.Error(t, err)
+
+	release := make(chan struct{})
+	done := make(chan struct{}, 3)
+	h2.SetStreamHandler("/ok", tr.Handler(func(s network.Stream) {
+		defer func() { done <- struct{}{} }()
+		<-release
+		ioutil.ReadAll(s)
+		s.Close()
+	}))
+	h2.SetStreamHandler("/reset", tr.Handler(func(s network.Stream) {
+		defer func() { done <- struct{}{} }()
+		s.Reset()
+	}))
+	require.NoError(t, h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+
+	s, err := h1.NewStream(ctx, h2.ID(), "/ok")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(tr.active.WithLabelValues("/ok")) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	s.Close()
+	close(release)
+	<-done
+	require.Zero(t, testutil.ToFloat64(tr.active.WithLabelValues("/ok")))
+	require.Equal(t, 1.0, testutil.ToFloat64(tr.streams.WithLabelValues("/ok", "ok")))
+
+	// the handler may reset the stream before we're done negotiating it.
+	if s, err := h1.NewStream(ctx, h2.ID(), "/reset"); err == nil {
+		defer s.Reset()
+	}
+	<-done
+	require.Equal(t, 1.0, testutil.ToFloat64(tr.streams.WithLabelValues("/reset", "reset")))
+	require.Equal(t, 2, testutil.CollectAndCount(tr.duration))
+}
+
+func TestResult(t *testing.T) {
+	s := &stream{}
+	require.Equal(t, ResultOK, s.result())
+	s.check(nil)
+	require.Equal(t, ResultOK, s.result())
+	s.check(errors.New("stream reset"))
+	require.Equal(t, ResultError, s.result())
+}
@@ -0,0 +1,227 @@
+// Package hashring maintains a consistent hash ring over the peers a host is
+// connected to, for applications sharding work across peers: keys map to
+// peers, and connecting or disconnecting a peer only moves the keys of that
+// peer.
+//
+// Every peer is placed at several points of the ring, its replicas, to spread
+// keys evenly. A key belongs to the first peer placed after the key's hash,
+// see Ring.Locate.
+package hashring
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+type config struct {
+	replicas    int
+	filter      func(peer.ID) bool
+	includeSelf bool
+}
+
+// Option is an option for the Ring.
+type Option func(*config)
+
+// Replicas sets the number of points every peer is placed at on the ring.
+// More replicas spread keys more evenly, at the cost of memory and slower
+// updates. Defaults to 100.
+func Replicas(n int) Option {
+	return func(cfg *config) {
+		cfg.replicas = n
+	}
+}
+
+// Filter only places the peers for which the given function returns true on
+// the ring. It's called when we connect to a peer, so it can't depend on what
+// we learn about the peer later on, e.g. through identify.
+func Filter(f func(peer.ID) bool) Option {
+	return func(cfg *config) {
+		cfg.filter = f
+	}
+}
+
+// IncludeSelf places the host itself on the ring, for hosts sharing the work
+// with their peers.
+func IncludeSelf() Option {
+	return func(cfg *config) {
+		cfg.includeSelf = true
+	}
+}
+
+// point is a replica of a peer on the ring.
+type point struct {
+	hash uint64
+	peer peer.ID
+}
+
+// Ring is a consistent hash ring over the peers a host is connected to. It's
+// kept up to date with network notifications.
+type Ring struct {
+	h   host.Host
+	cfg config
+
+	mu     sync.RWMutex
+	points []point // sorted by hash
+	peers  map[peer.ID]struct{}
+}
+
+// NewRing constructs a new Ring over the peers the given host is connected to.
+// Close it to stop following the host's connections.
+func NewRing(h host.Host, opts ...Option) *Ring {
+	cfg := config{replicas: 100}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.replicas < 1 {
+		cfg.replicas = 1
+	}
+	r := &Ring{
+		h:     h,
+		cfg:   cfg,
+		peers: make(map[peer.ID]struct{}),
+	}
+	if cfg.includeSelf {
+		r.add(h.ID())
+	}
+	h.Network().Notify((*notifiee)(r))
+	for _, p := range h.Network().Peers() {
+		r.update(p)
+	}
+	return r
+}
+
+// Close stops following the host's connections.
+func (r *Ring) Close() error {
+	r.h.Network().StopNotify((*notifiee)(r))
+	return nil
+}
+
+func hash(b []byte) uint64 {
+	sum := sha256.Sum256(b)
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// update places the peer on the ring or removes it, depending on whether
+// we're connected to it. Checking under the lock keeps the ring consistent
+// even when notifications of a peer are delivered out of order.
+func (r *Ring) update(p peer.ID) {
+	if p == r.h.ID() {
+		return
+	}
+	if r.cfg.filter != nil && !r.cfg.filter(p) {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.h.Network().Connectedness(p) == network.Connected {
+		r.addLocked(p)
+	} else {
+		r.removeLocked(p)
+	}
+}
+
+func (r *Ring) add(p peer.ID) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.addLocked(p)
+}
+
+func (r *Ring) addLocked(p peer.ID) {
+	if _, ok := r.peers[p]; ok {
+		return
+	}
+	r.peers[p] = struct{}{}
+	for i := 0; i < r.cfg.replicas; i++ {
+		pt := point{hash: hash([]byte(string(p) + strconv.Itoa(i))), peer: p}
+		idx := sort.Search(len(r.points), func(j int) bool { return r.points[j].hash >= pt.hash })
+		r.points = append(r.points, point{})
+		copy(r.points[idx+1:], r.points[idx:])
+		r.points[idx] = pt
+	}
+}
+
+func (r *Ring) removeLocked(p peer.ID) {
+	if _, ok := r.peers[p]; !ok {
+		return
+	}
+	delete(r.peers, p)
+	points := r.points[:0]
+	for _, pt := range r.points {
+		if pt.peer != p {
+			points = append(points, pt)
+		}
+	}
+	r.points = points
+}
+
+// Locate returns the peer the given key belongs to, or false if the ring is
+// empty.
+func (r *Ring) Locate(key []byte) (peer.ID, bool) {
+	peers := r.LocateN(key, 1)
+	if len(peers) == 0 {
+		return "", false
+	}
+	return peers[0], true
+}
+
+// LocateN returns up to n distinct peers for the given key, in order: the
+// peer it belongs to, followed by the next peers on the ring, e.g. to
+// replicate the key or to fall back on when the first peer fails.
+func (r *Ring) LocateN(key []byte, n int) []peer.ID {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if n > len(r.peers) {
+		n = len(r.peers)
+	}
+	if n <= 0 {
+		return nil
+	}
+	h := hash(key)
+	start := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	out := make([]peer.ID, 0, n)
+	seen := make(map[peer.ID]struct{}, n)
+	for i := 0; len(out) < n; i++ {
+		p := r.points[(start+i)%len(r.points)].peer
+		if _, ok := seen[p]; ok {
+			continue
+		}
+		seen[p] = struct{}{}
+		out = append(out, p)
+	}
+	return out
+}
+
+// Peers returns the peers on the ring.
+func (r *Ring) Peers() []peer.ID {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	out := make([]peer.ID, 0, len(r.peers))
+	for p := range r.peers {
+		out = append(out, p)
+	}
+	return out
+}
+
+type notifiee Ring
+
+func (n *notifiee) Connected(_ network.Network, c network.Conn) {
+	(*Ring)(n).update(c.RemotePeer())
+}
+
+func (n *notifiee) Disconnected(_ network.Network, c network.Conn) {
+	(*Ring)(n).update(c.RemotePeer())
+}
+
+func (n *notifiee) Listen(network.Network, ma.Multiaddr)         {}
+func (n *notifiee) ListenClose(network.Network, ma.Multiaddr)    {}
+func (n *notifiee) OpenedStream(network.Network, network.Stream) {}
+func (n *notifiee) ClosedStream(network.Network, network.Stream) {}
@@ -0,0 +1,95 @@
+package hashring
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	blhost "github.com/libp2p/go-libp2p-blankhost"
+	swarmt "github.com/libp2p/go-libp2p-swarm/testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRing(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	defer h.Close()
+	var peers []host.Host
+	for i := 0; i < 4; i++ {
+		p := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+		defer p.Close()
+		peers = append(peers, p)
+	}
+	connect := func(p host.Host) {
+		require.NoError(t, h.Connect(ctx, peer.AddrInfo{ID: p.ID(), Addrs: p.Addrs()}))
+	}
+	// peers connected before the ring is constructed are placed too.
+	connect(peers[0])
+
+	r := NewRing(h, Replicas(50))
+	defer r.Close()
+	_, ok := r.Locate([]byte("key"))
+	require.True(t, ok)
+	for _, p := range peers[1:] {
+		connect(p)
+	}
+	require.Eventually(t, func() bool { return len(r.Peers()) == len(peers) }, 5*time.Second, 10*time.Millisecond)
+
+	keys := make(map[string]peer.ID)
+	counts := make(map[peer.ID]int)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		p, ok := r.Locate([]byte(key))
+		require.True(t, ok)
+		keys[key] = p
+		counts[p]++
+	}
+	require.Len(t, counts, len(peers), "keys are spread across all peers")
+
+	ps := r.LocateN([]byte("key0"), 10)
+	require.Len(t, ps, len(peers))
+	require.Equal(t, keys["key0"], ps[0])
+
+	// disconnecting a peer only moves its keys.
+	gone := peers[1].ID()
+	require.NoError(t, h.Network().ClosePeer(gone))
+	require.Eventually(t, func() bool { return len(r.Peers()) == len(peers)-1 }, 5*time.Second, 10*time.Millisecond)
+	for key, p := range keys {
+		now, _ := r.Locate([]byte(key))
+		if p == gone {
+			require.NotEqual(t, gone, now)
+		} else {
+			require.Equal(t, p, now, key)
+		}
+	}
+}
+
+func TestRingOptions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	defer h.Close()
+	p1 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	defer p1.Close()
+	p2 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	defer p2.Close()
+
+	r := NewRing(h, IncludeSelf(), Filter(func(p peer.ID) bool { return p != p2.ID() }))
+	defer r.Close()
+	require.Equal(t, []peer.ID{h.ID()}, r.Peers())
+	p, ok := r.Locate([]byte("key"))
+	require.True(t, ok)
+	require.Equal(t, h.ID(), p)
+
+	for _, p := range []host.Host{p1, p2} {
+		require.NoError(t, h.Connect(ctx, peer.AddrInfo{ID: p.ID(), Addrs: p.Addrs()}))
+	}
+	require.Eventually(t, func() bool { return len(r.Peers()) == 2 }, 5*time.Second, 10*time.Millisecond)
+	require.ElementsMatch(t, []peer.ID{h.ID(), p1.ID()}, r.Peers())
+}
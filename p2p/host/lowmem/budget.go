@@ -0,0 +1,9 @@
+//go:build !lowmem
+// +build !lowmem
+
+package lowmem
+
+// DefaultBudget is the memory budget hosts are bounded to unless given one
+// with the libp2p.MemoryBudget option, in bytes. Build with the lowmem build
+// tag to bound hosts to 64 MiB by default; hosts are unbounded otherwise.
+const DefaultBudget = 0
@@ -0,0 +1,9 @@
+//go:build lowmem
+// +build lowmem
+
+package lowmem
+
+// DefaultBudget is the memory budget hosts are bounded to unless given one
+// with the libp2p.MemoryBudget option, in bytes. Built with the lowmem build
+// tag, hosts are bounded to 64 MiB by default.
+const DefaultBudget = 64 << 20
@@ -0,0 +1,174 @@
+// Package lowmem bounds the memory used by a host to fit a total budget, for
+// routers and IoT devices with little RAM. The budget is split into limits on
+// the host's connections, stream muxer buffers, identify state and observed
+// address tracking, see ForBudget.
+//
+// Use the libp2p.MemoryBudget option to bound a host at runtime, or build with
+// the lowmem build tag to bound every host to DefaultBudget unless told
+// otherwise. The event bus buffers a bounded number of events per
+// subscription already, and the peerstore is bounded through the limits on
+// connections and the addresses stored per peer.
+package lowmem
+
+import (
+	"sync/atomic"
+
+	"github.com/libp2p/go-libp2p-core/connmgr"
+	"github.com/libp2p/go-libp2p-core/control"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/libp2p/go-libp2p/p2p/protocol/identify"
+
+	logging "github.com/ipfs/go-log/v2"
+
+	yamux "github.com/libp2p/go-libp2p-yamux"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+var log = logging.Logger("lowmem")
+
+// MinBudget is the smallest budget hosts can be bounded to.
+const MinBudget = 8 << 20
+
+// Limits are the limits a host is bounded by.
+type Limits struct {
+	// MaxConns is the number of connections beyond which inbound
+	// connections are refused. We can still dial peers.
+	MaxConns int
+	// StreamWindow is the largest receive window of yamux streams, i.e.
+	// how much data is buffered for each stream. yamux requires at least
+	// 256 KiB.
+	StreamWindow uint32
+	// AcceptBacklog is how many inbound yamux streams of a connection may
+	// wait to be handled.
+	AcceptBacklog int
+	// IdentifyMessageSize is the largest identify message we accept.
+	IdentifyMessageSize int
+	// IdentifyConcurrency is how many connections are identified at once.
+	IdentifyConcurrency int
+	// PeerAddrs is how many addresses of each peer identify stores.
+	PeerAddrs int
+	// ObservedAddrs is how many addresses peers observed us at we track.
+	ObservedAddrs int
+}
+
+// minStreamWindow is the smallest receive window yamux supports.
+const minStreamWindow = 256 << 10
+
+// connCost is what we expect a connection to cost: two streams using their
+// full receive window, and the buffers of the secure channel and the muxer.
+const connCost = 2*minStreamWindow + 64<<10
+
+// ForBudget returns the limits bounding a host to the given budget, in bytes,
+// at least MinBudget. Connections get half of the budget, the rest is left to
+// the application and the Go runtime.
+func ForBudget(budget int64) Limits {
+	if budget < MinBudget {
+		budget = MinBudget
+	}
+	maxConns := int(budget / 2 / connCost)
+	identifyConcurrency := maxConns / 8
+	if identifyConcurrency < 1 {
+		identifyConcurrency = 1
+	}
+	return Limits{
+		MaxConns:            maxConns,
+		StreamWindow:        minStreamWindow,
+		AcceptBacklog:       32,
+		IdentifyMessageSize: 8 << 10,
+		IdentifyConcurrency: identifyConcurrency,
+		PeerAddrs:           16,
+		ObservedAddrs:       64,
+	}
+}
+
+// BoundYamux returns a copy of the given yamux transport, bounded by the
+// limits.
+func (l Limits) BoundYamux(t *yamux.Transport) *yamux.Transport {
+	cfg := *t.Config()
+	if cfg.MaxStreamWindowSize > l.StreamWindow {
+		cfg.MaxStreamWindowSize = l.StreamWindow
+	}
+	if cfg.AcceptBacklog > l.AcceptBacklog {
+		cfg.AcceptBacklog = l.AcceptBacklog
+	}
+	return (*yamux.Transport)(&cfg)
+}
+
+// IdentifyOptions returns the options bounding the identify service by the
+// limits.
+func (l Limits) IdentifyOptions() []identify.Option {
+	return []identify.Option{
+		identify.MaxMessageSize(l.IdentifyMessageSize),
+		identify.MaxConcurrentIdentify(l.IdentifyConcurrency),
+		identify.PeerstoreLimits(l.PeerAddrs, 0),
+		identify.MaxObservedAddrs(l.ObservedAddrs),
+	}
+}
+
+// ConnLimiter is a connection gater refusing inbound connections once the
+// host has too many connections. Connections it doesn't refuse are passed on
+// to the gater it wraps, if any. It counts the host's connections as a
+// network notifiee: register it with the host's network.
+type ConnLimiter struct {
+	max   int64
+	conns int64 // atomic
+	inner connmgr.ConnectionGater
+}
+
+var (
+	_ connmgr.ConnectionGater = (*ConnLimiter)(nil)
+	_ network.Notifiee        = (*ConnLimiter)(nil)
+)
+
+// NewConnLimiter constructs a new ConnLimiter allowing up to max connections,
+// wrapping the given gater, which may be nil.
+func NewConnLimiter(max int, inner connmgr.ConnectionGater) *ConnLimiter {
+	return &ConnLimiter{max: int64(max), inner: inner}
+}
+
+// Conns returns the number of connections of the host.
+func (l *ConnLimiter) Conns() int {
+	return int(atomic.LoadInt64(&l.conns))
+}
+
+func (l *ConnLimiter) InterceptPeerDial(p peer.ID) bool {
+	return l.inner == nil || l.inner.InterceptPeerDial(p)
+}
+
+func (l *ConnLimiter) InterceptAddrDial(p peer.ID, a ma.Multiaddr) bool {
+	return l.inner == nil || l.inner.InterceptAddrDial(p, a)
+}
+
+func (l *ConnLimiter) InterceptAccept(addrs network.ConnMultiaddrs) bool {
+	if atomic.LoadInt64(&l.conns) >= l.max {
+		log.Debugw("refusing inbound connection, too many connections", "addr", addrs.RemoteMultiaddr())
+		return false
+	}
+	return l.inner == nil || l.inner.InterceptAccept(addrs)
+}
+
+func (l *ConnLimiter) InterceptSecured(dir network.Direction, p peer.ID, addrs network.ConnMultiaddrs) bool {
+	return l.inner == nil || l.inner.InterceptSecured(dir, p, addrs)
+}
+
+func (l *ConnLimiter) InterceptUpgraded(c network.Conn) (bool, control.DisconnectReason) {
+	if l.inner == nil {
+		return true, 0
+	}
+	return l.inner.InterceptUpgraded(c)
+}
+
+func (l *ConnLimiter) Connected(network.Network, network.Conn) {
+	atomic.AddInt64(&l.conns, 1)
+}
+
+func (l *ConnLimiter) Disconnected(network.Network, network.Conn) {
+	atomic.AddInt64(&l.conns, -1)
+}
+
+func (l *ConnLimiter) Listen(network.Network, ma.Multiaddr)         {}
+func (l *ConnLimiter) ListenClose(network.Network, ma.Multiaddr)    {}
+func (l *ConnLimiter) OpenedStream(network.Network, network.Stream) {}
+func (l *ConnLimiter) ClosedStream(network.Network, network.Stream) {}
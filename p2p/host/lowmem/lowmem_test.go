@@ -0,0 +1,61 @@
+package lowmem
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	swarmt "github.com/libp2p/go-libp2p-swarm/testing"
+	yamux "github.com/libp2p/go-libp2p-yamux"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestForBudget(t *testing.T) {
+	l := ForBudget(64 << 20)
+	require.Equal(t, 56, l.MaxConns)
+	require.Equal(t, 7, l.IdentifyConcurrency)
+	require.Equal(t, ForBudget(MinBudget), ForBudget(1<<20), "budgets are at least MinBudget")
+	require.Less(t, ForBudget(MinBudget).MaxConns, l.MaxConns)
+}
+
+func TestBoundYamux(t *testing.T) {
+	y := ForBudget(64 << 20).BoundYamux(yamux.DefaultTransport)
+	require.Equal(t, uint32(256<<10), y.Config().MaxStreamWindowSize)
+	require.Equal(t, 32, y.Config().AcceptBacklog)
+	require.Equal(t, uint32(16<<20), yamux.DefaultTransport.Config().MaxStreamWindowSize, "the transport is copied")
+}
+
+func TestConnLimiter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	l := NewConnLimiter(1, nil)
+	s := swarmt.GenSwarm(t, ctx, swarmt.OptConnGater(l))
+	defer s.Close()
+	s.Notify(l)
+
+	dial := func() error {
+		other := swarmt.GenSwarm(t, ctx)
+		t.Cleanup(func() { other.Close() })
+		other.Peerstore().AddAddrs(s.LocalPeer(), s.ListenAddresses(), time.Hour)
+		_, err := other.DialPeer(ctx, s.LocalPeer())
+		return err
+	}
+	require.NoError(t, dial())
+	require.Eventually(t, func() bool { return l.Conns() == 1 }, time.Second, 10*time.Millisecond)
+	require.Error(t, dial(), "too many connections")
+
+	// we can still dial out.
+	other := swarmt.GenSwarm(t, ctx)
+	defer other.Close()
+	s.Peerstore().AddAddrs(other.LocalPeer(), other.ListenAddresses(), time.Hour)
+	_, err := s.DialPeer(ctx, other.LocalPeer())
+	require.NoError(t, err)
+
+	for _, c := range s.Conns() {
+		c.Close()
+	}
+	require.Eventually(t, func() bool { return l.Conns() == 0 }, time.Second, 10*time.Millisecond)
+	require.NoError(t, dial())
+}
@@ -0,0 +1,355 @@
+// Package migrate helps moving a node to a new identity, e.g. to rotate its
+// key or move it to another machine, without losing the peers that know it by
+// its old peer ID.
+//
+// Ahead of a planned migration, the node loads its next identity as a warm
+// standby, and pre-publishes a migration record, signed by both identities,
+// announcing the new peer ID, its addresses, and when the migration takes
+// place. Peers learn about it through identify, or by asking over ProtocolID,
+// see Lookup, and can store the new identity's addresses right away, see
+// Apply. Once migrated, a host running the old identity keeps serving the
+// record, forwarding the peers still connecting to it to the new identity,
+// until the end of a grace window.
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/libp2p/go-libp2p-core/record"
+
+	pb "github.com/libp2p/go-libp2p/p2p/host/migrate/pb"
+	"github.com/libp2p/go-libp2p/p2p/net/halfclose"
+	"github.com/libp2p/go-libp2p/p2p/protocol/identify"
+
+	logging "github.com/ipfs/go-log/v2"
+
+	"github.com/gogo/protobuf/proto"
+	ma "github.com/multiformats/go-multiaddr"
+	msmux "github.com/multiformats/go-multistream"
+)
+
+var log = logging.Logger("migrate")
+
+// ProtocolID is the protocol the migration record of a peer is served on.
+const ProtocolID = "/libp2p/migrate/1.0.0"
+
+// MetadataKey is the identify metadata key the migration record is published
+// under, see identify.IDService.SetMetadata.
+const MetadataKey = "libp2p/migration"
+
+// RecordEnvelopeDomain is the domain of the envelopes of migration records.
+const RecordEnvelopeDomain = "libp2p-migration-record"
+
+// RecordEnvelopePayloadType is the payload type of the envelopes of migration
+// records.
+var RecordEnvelopePayloadType = []byte("/libp2p/migration-record")
+
+// maxRecordSize is the maximum size of a migration record we read.
+const maxRecordSize = 16 << 10
+
+// ErrNoMigration is returned by Lookup for peers that don't announce a
+// migration.
+var ErrNoMigration = errors.New("peer doesn't announce a migration")
+
+func init() {
+	record.RegisterType(&Record{})
+}
+
+// Record announces that a peer is migrating to a new identity. It's signed by
+// the old identity, and carries the signed peer record of the new one.
+type Record struct {
+	// From is the peer ID migrating away, To the one migrated to.
+	From peer.ID
+	To   peer.ID
+	// Addrs are the addresses the new identity is reachable at.
+	Addrs []ma.Multiaddr
+	// At is when the migration takes place, Until when the old identity
+	// stops forwarding peers to the new one.
+	At    time.Time
+	Until time.Time
+	// PeerRecord is the signed peer record of the new identity, proving it
+	// controls its key.
+	PeerRecord *record.Envelope
+}
+
+var _ record.Record = (*Record)(nil)
+
+// Domain is used when signing and validating records contained in envelopes.
+func (r *Record) Domain() string {
+	return RecordEnvelopeDomain
+}
+
+// Codec is a binary identifier for the Record type.
+func (r *Record) Codec() []byte {
+	return RecordEnvelopePayloadType
+}
+
+// MarshalRecord serializes the record to protobuf.
+func (r *Record) MarshalRecord() ([]byte, error) {
+	from, err := r.From.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	to, err := r.To.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	if r.PeerRecord == nil {
+		return nil, errors.New("missing peer record")
+	}
+	prec, err := r.PeerRecord.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	msg := &pb.MigrationRecord{
+		From:       from,
+		To:         to,
+		At:         r.At.UnixNano(),
+		Until:      r.Until.UnixNano(),
+		PeerRecord: prec,
+	}
+	for _, a := range r.Addrs {
+		msg.Addrs = append(msg.Addrs, a.Bytes())
+	}
+	return proto.Marshal(msg)
+}
+
+// UnmarshalRecord parses a record from protobuf, verifying the signature of
+// the new identity's peer record.
+func (r *Record) UnmarshalRecord(data []byte) error {
+	var msg pb.MigrationRecord
+	if err := proto.Unmarshal(data, &msg); err != nil {
+		return err
+	}
+	from, err := peer.IDFromBytes(msg.From)
+	if err != nil {
+		return err
+	}
+	to, err := peer.IDFromBytes(msg.To)
+	if err != nil {
+		return err
+	}
+	addrs := make([]ma.Multiaddr, 0, len(msg.Addrs))
+	for _, b := range msg.Addrs {
+		a, err := ma.NewMultiaddrBytes(b)
+		if err != nil {
+			return err
+		}
+		addrs = append(addrs, a)
+	}
+	var prec peer.PeerRecord
+	env, err := record.ConsumeTypedEnvelope(msg.PeerRecord, &prec)
+	if err != nil {
+		return fmt.Errorf("invalid peer record: %w", err)
+	}
+	if prec.PeerID != to {
+		return fmt.Errorf("peer record is for %s, not %s", prec.PeerID, to)
+	}
+
+	*r = Record{
+		From:       from,
+		To:         to,
+		Addrs:      addrs,
+		At:         time.Unix(0, msg.At),
+		Until:      time.Unix(0, msg.Until),
+		PeerRecord: env,
+	}
+	return nil
+}
+
+// Consume verifies a migration record sealed by Standby.Announce, and returns
+// it.
+func Consume(data []byte) (*Record, error) {
+	var rec Record
+	env, err := record.ConsumeTypedEnvelope(data, &rec)
+	if err != nil {
+		return nil, err
+	}
+	if !rec.From.MatchesPublicKey(env.PublicKey) {
+		return nil, fmt.Errorf("migration record isn't signed by %s", rec.From)
+	}
+	if rec.Until.Before(rec.At) {
+		return nil, errors.New("migration record ends before the migration")
+	}
+	return &rec, nil
+}
+
+// Standby is the identity a node migrates to.
+type Standby struct {
+	key crypto.PrivKey
+	id  peer.ID
+}
+
+// NewStandby loads the given key as the identity to migrate to. Construct the
+// host of the new identity with it, e.g. with the libp2p.Identity option.
+func NewStandby(key crypto.PrivKey) (*Standby, error) {
+	id, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return &Standby{key: key, id: id}, nil
+}
+
+// ID returns the peer ID of the standby identity.
+func (s *Standby) ID() peer.ID {
+	return s.id
+}
+
+// PrivKey returns the private key of the standby identity.
+func (s *Standby) PrivKey() crypto.PrivKey {
+	return s.key
+}
+
+// Announce seals a migration record from the identity of the given key to the
+// standby identity, reachable at the given addresses from the given time on.
+// The old identity forwards peers to the new one for the given grace window
+// after that.
+func (s *Standby) Announce(from crypto.PrivKey, addrs []ma.Multiaddr, at time.Time, grace time.Duration) (*record.Envelope, error) {
+	fromID, err := peer.IDFromPrivateKey(from)
+	if err != nil {
+		return nil, err
+	}
+	if fromID == s.id {
+		return nil, errors.New("cannot migrate to the same identity")
+	}
+	if grace < 0 {
+		return nil, errors.New("grace window must not be negative")
+	}
+	prec, err := record.Seal(peer.PeerRecordFromAddrInfo(peer.AddrInfo{ID: s.id, Addrs: addrs}), s.key)
+	if err != nil {
+		return nil, err
+	}
+	return record.Seal(&Record{
+		From:       fromID,
+		To:         s.id,
+		Addrs:      addrs,
+		At:         at,
+		Until:      at.Add(grace),
+		PeerRecord: prec,
+	}, from)
+}
+
+// Publisher publishes a migration record, see Publish.
+type Publisher struct {
+	h    host.Host
+	ids  *identify.IDService
+	data []byte
+
+	closeOnce sync.Once
+	timer     *time.Timer
+}
+
+// Publish publishes the given migration record, signed by the host's identity,
+// to the host's peers: it's sent in the host's identify messages, if an
+// identify service is given, and served on ProtocolID. The record is published
+// until the end of its grace window, or until the publisher is closed.
+func Publish(h host.Host, ids *identify.IDService, env *record.Envelope) (*Publisher, error) {
+	data, err := env.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	rec, err := Consume(data)
+	if err != nil {
+		return nil, err
+	}
+	if rec.From != h.ID() {
+		return nil, fmt.Errorf("migration record is for %s, not %s", rec.From, h.ID())
+	}
+	remaining := time.Until(rec.Until)
+	if remaining <= 0 {
+		return nil, errors.New("migration record's grace window is over")
+	}
+
+	p := &Publisher{h: h, ids: ids, data: data}
+	if ids != nil {
+		ids.SetMetadata(MetadataKey, data)
+	}
+	h.SetStreamHandler(ProtocolID, halfclose.Handler(1, p.serve))
+	p.timer = time.AfterFunc(remaining, func() {
+		log.Infow("migration grace window is over, no longer forwarding peers", "to", rec.To)
+		p.Close()
+	})
+	log.Infow("publishing migration", "to", rec.To, "at", rec.At, "until", rec.Until)
+	return p, nil
+}
+
+func (p *Publisher) serve(s network.Stream, _ []byte) ([]byte, error) {
+	log.Debugw("forwarding peer to new identity", "peer", s.Conn().RemotePeer())
+	return p.data, nil
+}
+
+// Close stops publishing the migration record.
+func (p *Publisher) Close() error {
+	p.closeOnce.Do(func() {
+		p.timer.Stop()
+		p.h.RemoveStreamHandler(ProtocolID)
+		if p.ids != nil {
+			p.ids.DeleteMetadata(MetadataKey)
+		}
+	})
+	return nil
+}
+
+// Lookup returns the migration record published by the given peer. It's taken
+// from the identify metadata the peer sent us, if an identify service is
+// given, and requested over ProtocolID otherwise. It returns ErrNoMigration if
+// the peer doesn't publish a record.
+func Lookup(ctx context.Context, h host.Host, ids *identify.IDService, p peer.ID) (*Record, error) {
+	var data []byte
+	if ids != nil {
+		data = ids.PeerMetadata(p)[MetadataKey]
+	}
+	if data == nil {
+		var err error
+		data, err = halfclose.RoundTrip(ctx, h, p, nil, maxRecordSize, ProtocolID)
+		if errors.Is(err, msmux.ErrNotSupported) {
+			return nil, ErrNoMigration
+		}
+		if err != nil {
+			return nil, err
+		}
+		// when the protocol is negotiated lazily, a peer not speaking it
+		// just closes the stream.
+		if len(data) == 0 {
+			return nil, ErrNoMigration
+		}
+	}
+	rec, err := Consume(data)
+	if err != nil {
+		return nil, err
+	}
+	if rec.From != p {
+		return nil, fmt.Errorf("migration record is for %s, not %s", rec.From, p)
+	}
+	return rec, nil
+}
+
+// Apply pre-publishes the new identity of a migration record to the given
+// peerstore: its public key, and its addresses until the end of the grace
+// window, also as a signed peer record if the peerstore supports them.
+func Apply(ps peerstore.Peerstore, rec *Record) error {
+	ttl := time.Until(rec.Until)
+	if ttl <= 0 {
+		return errors.New("migration record's grace window is over")
+	}
+	if err := ps.AddPubKey(rec.To, rec.PeerRecord.PublicKey); err != nil {
+		return err
+	}
+	if cab, ok := peerstore.GetCertifiedAddrBook(ps); ok {
+		if _, err := cab.ConsumePeerRecord(rec.PeerRecord, ttl); err != nil {
+			return err
+		}
+		return nil
+	}
+	ps.AddAddrs(rec.To, rec.Addrs, ttl)
+	return nil
+}
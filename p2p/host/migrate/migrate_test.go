@@ -0,0 +1,120 @@
+package migrate
+
+import (
+	"context"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/record"
+
+	swarmt "github.com/libp2p/go-libp2p-swarm/testing"
+	bhost "github.com/libp2p/go-libp2p/p2p/host/basic"
+
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+func genKey(t *testing.T) crypto.PrivKey {
+	t.Helper()
+	k, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+	return k
+}
+
+func newStandby(t *testing.T) *Standby {
+	t.Helper()
+	s, err := NewStandby(genKey(t))
+	require.NoError(t, err)
+	return s
+}
+
+func TestAnnounceConsume(t *testing.T) {
+	from := genKey(t)
+	fromID, err := peer.IDFromPrivateKey(from)
+	require.NoError(t, err)
+	s := newStandby(t)
+	addrs := []ma.Multiaddr{ma.StringCast("/ip4/1.2.3.4/tcp/4001")}
+	at := time.Now().Add(time.Hour)
+
+	env, err := s.Announce(from, addrs, at, 10*time.Minute)
+	require.NoError(t, err)
+	data, err := env.Marshal()
+	require.NoError(t, err)
+	rec, err := Consume(data)
+	require.NoError(t, err)
+	require.Equal(t, fromID, rec.From)
+	require.Equal(t, s.ID(), rec.To)
+	require.Equal(t, addrs, rec.Addrs)
+	require.True(t, rec.At.Equal(at))
+	require.True(t, rec.Until.Equal(at.Add(10*time.Minute)))
+
+	_, err = s.Announce(s.PrivKey(), addrs, at, time.Minute)
+	require.Error(t, err, "migrating to the same identity")
+
+	// a record for another identity than the one signing it.
+	env, err = record.Seal(rec, genKey(t))
+	require.NoError(t, err)
+	data, err = env.Marshal()
+	require.NoError(t, err)
+	_, err = Consume(data)
+	require.Error(t, err)
+
+	// a peer record that isn't the new identity's.
+	rec.PeerRecord, err = record.Seal(peer.PeerRecordFromAddrInfo(peer.AddrInfo{ID: fromID, Addrs: addrs}), from)
+	require.NoError(t, err)
+	env, err = record.Seal(rec, from)
+	require.NoError(t, err)
+	data, err = env.Marshal()
+	require.NoError(t, err)
+	_, err = Consume(data)
+	require.Error(t, err)
+}
+
+func TestPublishLookup(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := bhost.New(swarmt.GenSwarm(t, ctx))
+	h2 := bhost.New(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	defer h2.Close()
+
+	s := newStandby(t)
+	addrs := []ma.Multiaddr{ma.StringCast("/ip4/1.2.3.4/tcp/4001")}
+	env, err := s.Announce(h1.Peerstore().PrivKey(h1.ID()), addrs, time.Now(), time.Minute)
+	require.NoError(t, err)
+	pub, err := Publish(h1, h1.IDService(), env)
+	require.NoError(t, err)
+
+	// a record signed by another identity is refused.
+	other, err := newStandby(t).Announce(genKey(t), addrs, time.Now(), time.Minute)
+	require.NoError(t, err)
+	_, err = Publish(h1, nil, other)
+	require.Error(t, err)
+
+	require.NoError(t, h2.Connect(ctx, peer.AddrInfo{ID: h1.ID(), Addrs: h1.Addrs()}))
+	<-h2.IDService().IdentifyWait(h2.Network().ConnsToPeer(h1.ID())[0])
+
+	// through identify.
+	rec, err := Lookup(ctx, h2, h2.IDService(), h1.ID())
+	require.NoError(t, err)
+	require.Equal(t, s.ID(), rec.To)
+
+	// over the migration protocol.
+	rec, err = Lookup(ctx, h2, nil, h1.ID())
+	require.NoError(t, err)
+	require.Equal(t, s.ID(), rec.To)
+
+	require.NoError(t, Apply(h2.Peerstore(), rec))
+	require.Equal(t, addrs, h2.Peerstore().Addrs(s.ID()))
+	require.True(t, s.PrivKey().GetPublic().Equals(h2.Peerstore().PubKey(s.ID())))
+
+	require.NoError(t, pub.Close())
+	_, err = Lookup(ctx, h2, nil, h1.ID())
+	require.Equal(t, ErrNoMigration, err)
+	_, err = Lookup(ctx, h1, h1.IDService(), h2.ID())
+	require.Equal(t, ErrNoMigration, err)
+}
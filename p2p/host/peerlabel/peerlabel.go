@@ -0,0 +1,37 @@
+// Package peerlabel attaches human-readable labels, like "bootstrap-eu-1", to
+// peer IDs. Labels are stored in the peerstore, so the logging, metrics and
+// introspection facilities with access to it can show them alongside the raw
+// peer IDs, easing the debugging of fixed infrastructure peers.
+package peerlabel
+
+import (
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+)
+
+// metadataKey is the peerstore metadata key labels are stored under.
+const metadataKey = "PeerLabel"
+
+// Set labels the given peer. An empty label removes the peer's label.
+func Set(ps peerstore.PeerMetadata, p peer.ID, label string) error {
+	return ps.Put(p, metadataKey, label)
+}
+
+// Get returns the label of the given peer, "" if it has none.
+func Get(ps peerstore.PeerMetadata, p peer.ID) string {
+	v, err := ps.Get(p, metadataKey)
+	if err != nil {
+		return ""
+	}
+	label, _ := v.(string)
+	return label
+}
+
+// Format returns the peer ID, prefixed with its label if it has one, e.g.
+// "bootstrap-eu-1/QmPeer...".
+func Format(ps peerstore.PeerMetadata, p peer.ID) string {
+	if label := Get(ps, p); label != "" {
+		return label + "/" + p.Pretty()
+	}
+	return p.Pretty()
+}
@@ -0,0 +1,28 @@
+package peerlabel
+
+import (
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/test"
+	"github.com/libp2p/go-libp2p-peerstore/pstoremem"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLabels(t *testing.T) {
+	ps := pstoremem.NewPeerstore()
+	defer ps.Close()
+
+	p, err := test.RandPeerID()
+	require.NoError(t, err)
+
+	require.Equal(t, "", Get(ps, p))
+	require.Equal(t, p.Pretty(), Format(ps, p))
+
+	require.NoError(t, Set(ps, p, "bootstrap-eu-1"))
+	require.Equal(t, "bootstrap-eu-1", Get(ps, p))
+	require.Equal(t, "bootstrap-eu-1/"+p.Pretty(), Format(ps, p))
+
+	require.NoError(t, Set(ps, p, ""))
+	require.Equal(t, p.Pretty(), Format(ps, p))
+}
@@ -0,0 +1,373 @@
+// Package quota caps the streams applications open under named tokens, like
+// "sync" or "gossip", so that one component of a node can't exhaust the
+// stream budget of the others. Each token may limit how many streams are open
+// at once under it, and the combined bandwidth of those streams.
+//
+// Streams are opened under a token by passing a context carrying it, see
+// WithToken, to the NewStream method of a host with a Manager, see the
+// libp2p.StreamQuotas option or basichost.HostOpts.Quotas. Streams opened
+// without a token aren't limited.
+package quota
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/mux"
+	"github.com/libp2p/go-libp2p-core/network"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+var log = logging.Logger("quota")
+
+// ErrQuotaExceeded is returned when opening a stream under a token that
+// already has the maximum number of streams open.
+var ErrQuotaExceeded = errors.New("stream quota exceeded")
+
+// Limit caps the streams opened under a token.
+type Limit struct {
+	// Streams is the maximum number of streams open at once, 0 for no
+	// limit.
+	Streams int
+	// BytesPerSecond caps the combined bandwidth of the streams, in both
+	// directions, 0 for no limit. Reads and writes block as needed, until
+	// the deadline of the stream at most, or until it is closed or reset.
+	BytesPerSecond int
+}
+
+// Usage is what the streams of a token currently use.
+type Usage struct {
+	// Streams is the number of streams open.
+	Streams int
+	// BytesIn and BytesOut count the bytes read and written by all the
+	// streams ever opened under the token.
+	BytesIn, BytesOut uint64
+	// Rejected counts the streams refused with ErrQuotaExceeded.
+	Rejected uint64
+}
+
+type tokenKey struct{}
+
+// WithToken returns a context opening streams under the given token.
+func WithToken(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, tokenKey{}, token)
+}
+
+// Token returns the token set on the context with WithToken, "" if none.
+func Token(ctx context.Context) string {
+	token, _ := ctx.Value(tokenKey{}).(string)
+	return token
+}
+
+// Manager enforces the limits of tokens.
+type Manager struct {
+	mu     sync.Mutex
+	tokens map[string]*tokenState
+}
+
+// tokenState tracks the streams of a token.
+type tokenState struct {
+	// accessed atomically, kept first for 64-bit alignment on 32-bit
+	// platforms.
+	bytesIn, bytesOut, rejected uint64
+
+	// protected by the manager's mutex.
+	limit   Limit
+	streams int
+	bucket  *bucket
+}
+
+// NewManager constructs a new Manager. Tokens without a limit aren't limited.
+func NewManager() *Manager {
+	return &Manager{tokens: make(map[string]*tokenState)}
+}
+
+// SetLimit sets the limit of the given token. A lower stream limit doesn't
+// close streams already open, but new ones are refused until enough of them
+// are closed.
+func (m *Manager) SetLimit(token string, l Limit) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t := m.token(token)
+	t.limit = l
+	if l.BytesPerSecond > 0 {
+		t.bucket = newBucket(l.BytesPerSecond)
+	} else {
+		t.bucket = nil
+	}
+}
+
+// Usage returns what the streams of the given token currently use.
+func (m *Manager) Usage(token string) Usage {
+	m.mu.Lock()
+	t, ok := m.tokens[token]
+	var streams int
+	if ok {
+		streams = t.streams
+	}
+	m.mu.Unlock()
+	if !ok {
+		return Usage{}
+	}
+	return Usage{
+		Streams:  streams,
+		BytesIn:  atomic.LoadUint64(&t.bytesIn),
+		BytesOut: atomic.LoadUint64(&t.bytesOut),
+		Rejected: atomic.LoadUint64(&t.rejected),
+	}
+}
+
+// token returns the state of the given token, creating it if needed. The
+// manager's mutex must be held.
+func (m *Manager) token(token string) *tokenState {
+	t, ok := m.tokens[token]
+	if !ok {
+		t = &tokenState{}
+		m.tokens[token] = t
+	}
+	return t
+}
+
+// Reserve reserves a stream under the given token, returning ErrQuotaExceeded
+// if the token has the maximum number of streams open. The caller must
+// either release the reservation, or wrap the stream it opened with it.
+func (m *Manager) Reserve(token string) (*Reservation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t := m.token(token)
+	if t.limit.Streams > 0 && t.streams >= t.limit.Streams {
+		atomic.AddUint64(&t.rejected, 1)
+		log.Debugw("stream quota exceeded", "token", token, "streams", t.streams)
+		return nil, fmt.Errorf("%w for token %q: %d streams open", ErrQuotaExceeded, token, t.streams)
+	}
+	t.streams++
+	return &Reservation{m: m, t: t}, nil
+}
+
+// ReserveContext is Reserve for the token of the given context. It returns a
+// nil reservation, which can be used like any other, if the context carries no
+// token.
+func (m *Manager) ReserveContext(ctx context.Context) (*Reservation, error) {
+	token := Token(ctx)
+	if token == "" {
+		return nil, nil
+	}
+	return m.Reserve(token)
+}
+
+func (m *Manager) release(t *tokenState) {
+	m.mu.Lock()
+	t.streams--
+	m.mu.Unlock()
+}
+
+func (m *Manager) bucket(t *tokenState) *bucket {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return t.bucket
+}
+
+// Reservation is a stream reserved under a token. A nil reservation is valid,
+// and doesn't limit anything.
+type Reservation struct {
+	m    *Manager
+	t    *tokenState
+	once sync.Once
+}
+
+// Release gives the reserved stream back. It's a no-op after the first call,
+// or once the stream wrapped with the reservation is closed.
+func (r *Reservation) Release() {
+	if r == nil {
+		return
+	}
+	r.once.Do(func() { r.m.release(r.t) })
+}
+
+// Wrap returns the given stream, limited by the token of the reservation. The
+// reservation is released once the stream is closed or reset.
+func (r *Reservation) Wrap(s network.Stream) network.Stream {
+	if r == nil {
+		return s
+	}
+	return &stream{Stream: s, r: r, closed: make(chan struct{})}
+}
+
+// maxChunk is the largest write we throttle at once: larger writes are split,
+// so that they're sent at a steady pace, not in bursts.
+const maxChunk = 16 << 10
+
+type stream struct {
+	network.Stream
+	r *Reservation
+
+	mu                          sync.Mutex
+	readDeadline, writeDeadline time.Time
+	// closed once the stream is closed or reset, interrupting throttled
+	// reads and writes.
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (s *stream) Read(b []byte) (int, error) {
+	n, err := s.Stream.Read(b)
+	if n > 0 {
+		atomic.AddUint64(&s.r.t.bytesIn, uint64(n))
+		// reads are throttled after the fact: the bytes were read, we
+		// return them even if the wait is interrupted.
+		if bk := s.r.m.bucket(s.r.t); bk != nil {
+			s.mu.Lock()
+			deadline := s.readDeadline
+			s.mu.Unlock()
+			_ = s.wait(bk.take(n), deadline)
+		}
+	}
+	return n, err
+}
+
+func (s *stream) Write(b []byte) (int, error) {
+	var written int
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > maxChunk {
+			chunk = chunk[:maxChunk]
+		}
+		n, err := s.write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// write throttles and writes a chunk. Only the bytes actually written are
+// charged to the token.
+func (s *stream) write(chunk []byte) (int, error) {
+	bk := s.r.m.bucket(s.r.t)
+	if bk != nil {
+		s.mu.Lock()
+		deadline := s.writeDeadline
+		s.mu.Unlock()
+		if err := s.wait(bk.take(len(chunk)), deadline); err != nil {
+			bk.refund(len(chunk))
+			return 0, err
+		}
+	}
+	n, err := s.Stream.Write(chunk)
+	atomic.AddUint64(&s.r.t.bytesOut, uint64(n))
+	if bk != nil && n < len(chunk) {
+		bk.refund(len(chunk) - n)
+	}
+	return n, err
+}
+
+// wait waits for d, failing if the deadline passes or the stream is closed in
+// the meantime.
+func (s *stream) wait(d time.Duration, deadline time.Time) error {
+	if d <= 0 {
+		return nil
+	}
+	var err error
+	if !deadline.IsZero() {
+		if until := time.Until(deadline); until < d {
+			d, err = until, os.ErrDeadlineExceeded
+		}
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return err
+	case <-s.closed:
+		return mux.ErrReset
+	}
+}
+
+func (s *stream) close() {
+	s.closeOnce.Do(func() { close(s.closed) })
+}
+
+func (s *stream) Close() error {
+	defer s.r.Release()
+	s.close()
+	return s.Stream.Close()
+}
+
+func (s *stream) Reset() error {
+	defer s.r.Release()
+	s.close()
+	return s.Stream.Reset()
+}
+
+func (s *stream) SetDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.readDeadline, s.writeDeadline = t, t
+	s.mu.Unlock()
+	return s.Stream.SetDeadline(t)
+}
+
+func (s *stream) SetReadDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.readDeadline = t
+	s.mu.Unlock()
+	return s.Stream.SetReadDeadline(t)
+}
+
+func (s *stream) SetWriteDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.writeDeadline = t
+	s.mu.Unlock()
+	return s.Stream.SetWriteDeadline(t)
+}
+
+// bucket is a token bucket holding up to a second worth of bytes.
+type bucket struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(bytesPerSecond int) *bucket {
+	return &bucket{
+		rate:   float64(bytesPerSecond),
+		tokens: float64(bytesPerSecond),
+		last:   time.Now(),
+	}
+}
+
+// take takes n bytes from the bucket, and returns how long to wait before
+// transferring them. The bucket may go into debt, delaying later transfers.
+func (b *bucket) take(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// refund gives back n bytes taken but not transferred.
+func (b *bucket) refund(n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens += float64(n)
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+}
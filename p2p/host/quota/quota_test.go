@@ -0,0 +1,169 @@
+package quota
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeStream is a stream reading zeroes and discarding what it's written. It
+// fails writes once reset, or once writeErr is set.
+type fakeStream struct {
+	network.Stream
+	closed, reset bool
+	writeErr      error
+}
+
+func (s *fakeStream) Read(b []byte) (int, error) { return len(b), nil }
+func (s *fakeStream) Close() error               { s.closed = true; return nil }
+func (s *fakeStream) Reset() error               { s.reset = true; return nil }
+
+func (s *fakeStream) Write(b []byte) (int, error) {
+	if s.reset {
+		return 0, errors.New("stream reset")
+	}
+	if s.writeErr != nil {
+		return len(b) / 2, s.writeErr
+	}
+	return len(b), nil
+}
+
+func (s *fakeStream) SetDeadline(time.Time) error      { return nil }
+func (s *fakeStream) SetReadDeadline(time.Time) error  { return nil }
+func (s *fakeStream) SetWriteDeadline(time.Time) error { return nil }
+
+func TestToken(t *testing.T) {
+	ctx := context.Background()
+	require.Equal(t, "", Token(ctx))
+	require.Equal(t, "sync", Token(WithToken(ctx, "sync")))
+
+	m := NewManager()
+	res, err := m.ReserveContext(ctx)
+	require.NoError(t, err)
+	require.Nil(t, res)
+	s := &fakeStream{}
+	require.Equal(t, s, res.Wrap(s))
+	res.Release()
+}
+
+func TestStreamLimit(t *testing.T) {
+	m := NewManager()
+	m.SetLimit("sync", Limit{Streams: 2})
+
+	r1, err := m.Reserve("sync")
+	require.NoError(t, err)
+	r2, err := m.Reserve("sync")
+	require.NoError(t, err)
+	_, err = m.Reserve("sync")
+	require.True(t, errors.Is(err, ErrQuotaExceeded))
+
+	// other tokens aren't affected.
+	_, err = m.Reserve("gossip")
+	require.NoError(t, err)
+
+	s1 := r1.Wrap(&fakeStream{})
+	_, err = s1.Write([]byte("hello"))
+	require.NoError(t, err)
+	_, err = s1.Read(make([]byte, 3))
+	require.NoError(t, err)
+	require.Equal(t, Usage{Streams: 2, BytesIn: 3, BytesOut: 5, Rejected: 1}, m.Usage("sync"))
+
+	// closing the stream, or releasing the reservation, frees a slot, once.
+	require.NoError(t, s1.Close())
+	require.NoError(t, s1.Reset())
+	r2.Release()
+	r2.Release()
+	require.Equal(t, 0, m.Usage("sync").Streams)
+
+	_, err = m.Reserve("sync")
+	require.NoError(t, err)
+	require.Equal(t, Usage{}, m.Usage("unknown"))
+}
+
+func TestBandwidthLimit(t *testing.T) {
+	m := NewManager()
+	m.SetLimit("bulk", Limit{BytesPerSecond: 10000})
+
+	res, err := m.Reserve("bulk")
+	require.NoError(t, err)
+	s := res.Wrap(&fakeStream{})
+
+	// the first second worth of bytes is free, the next 5000 take half a
+	// second.
+	start := time.Now()
+	_, err = s.Write(make([]byte, 10000))
+	require.NoError(t, err)
+	_, err = s.Write(make([]byte, 2500))
+	require.NoError(t, err)
+	_, err = s.Read(make([]byte, 2500))
+	require.NoError(t, err)
+	// reads are throttled after the fact.
+	elapsed := time.Since(start)
+	require.GreaterOrEqual(t, int64(elapsed), int64(400*time.Millisecond))
+	require.Less(t, int64(elapsed), int64(2*time.Second))
+}
+
+func TestThrottledWriteInterrupted(t *testing.T) {
+	m := NewManager()
+	m.SetLimit("bulk", Limit{BytesPerSecond: 10000})
+
+	res, err := m.Reserve("bulk")
+	require.NoError(t, err)
+	s := res.Wrap(&fakeStream{})
+	// use up the first second worth of bytes.
+	_, err = s.Write(make([]byte, 10000))
+	require.NoError(t, err)
+
+	// the write would take 100s, the deadline interrupts it.
+	require.NoError(t, s.SetWriteDeadline(time.Now().Add(100*time.Millisecond)))
+	start := time.Now()
+	n, err := s.Write(make([]byte, 1<<20))
+	require.True(t, errors.Is(err, os.ErrDeadlineExceeded))
+	require.Less(t, int64(time.Since(start)), int64(time.Second))
+	require.Less(t, n, 1<<20)
+
+	// so does resetting the stream.
+	require.NoError(t, s.SetDeadline(time.Time{}))
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := s.Write(make([]byte, 1<<20))
+		errCh <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, s.Reset())
+	select {
+	case err := <-errCh:
+		require.Error(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("write not interrupted by reset")
+	}
+	_, err = s.Write([]byte("hello"))
+	require.Error(t, err)
+}
+
+func TestThrottleChargesWrittenBytes(t *testing.T) {
+	m := NewManager()
+	m.SetLimit("bulk", Limit{BytesPerSecond: 10000})
+
+	res, err := m.Reserve("bulk")
+	require.NoError(t, err)
+	fs := &fakeStream{writeErr: errors.New("write failed")}
+	s := res.Wrap(fs)
+
+	// only half of the write goes through.
+	n, err := s.Write(make([]byte, 8000))
+	require.Error(t, err)
+	require.Equal(t, 4000, n)
+	require.Equal(t, uint64(4000), m.Usage("bulk").BytesOut)
+
+	b := m.bucket(res.t)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	require.InDelta(t, 6000, b.tokens, 100)
+}
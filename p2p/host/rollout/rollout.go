@@ -0,0 +1,302 @@
+// Package rollout splits the streams of a protocol between two handlers, the
+// stable one and a canary, so that a new handler implementation can be rolled
+// out to a fraction of peers and compared with the stable one before the full
+// cutover.
+//
+// Peers are assigned to a handler by a Selector. The built-in selectors assign
+// every peer deterministically, so a peer is served by the same handler for
+// all of its streams, and consistently across restarts.
+package rollout
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+
+	logging "github.com/ipfs/go-log/v2"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var log = logging.Logger("rollout")
+
+// Variant identifies one of the two handlers of a Split.
+type Variant string
+
+const (
+	// Stable is the handler serving the peers not selected for the canary.
+	Stable Variant = "stable"
+	// Canary is the handler being rolled out.
+	Canary Variant = "canary"
+)
+
+// Selector returns true for the peers to be served by the canary handler.
+type Selector func(peer.ID) bool
+
+// Percent selects the given percentage of peers, from 0 to 100. Raising the
+// percentage keeps the peers already selected.
+func Percent(pct float64) Selector {
+	// compare in basis points, to support fractional percentages.
+	threshold := uint64(pct * 100)
+	return func(p peer.ID) bool {
+		h := sha256.Sum256([]byte(p))
+		return binary.BigEndian.Uint64(h[:8])%10000 < threshold
+	}
+}
+
+// Peers selects the given peers.
+func Peers(ps ...peer.ID) Selector {
+	set := make(map[peer.ID]struct{}, len(ps))
+	for _, p := range ps {
+		set[p] = struct{}{}
+	}
+	return func(p peer.ID) bool {
+		_, ok := set[p]
+		return ok
+	}
+}
+
+// Stats counts the streams handled by one of the handlers of a Split.
+type Stats struct {
+	// Streams is the number of streams passed to the handler.
+	Streams uint64
+	// Resets is the number of those streams the handler reset.
+	Resets uint64
+	// HandlerTime is the total time spent in the handler.
+	HandlerTime time.Duration
+}
+
+type config struct {
+	registerer prometheus.Registerer
+}
+
+// Option is an option for a Split.
+type Option func(*config)
+
+// Registerer exports the Split's statistics as Prometheus metrics, labeled
+// with the protocol and the variant, registering them with the given
+// registerer. Splits of different protocols may share a registerer.
+func Registerer(r prometheus.Registerer) Option {
+	return func(cfg *config) {
+		cfg.registerer = r
+	}
+}
+
+var (
+	metricsMu sync.Mutex
+	// metrics shared by the Splits using the same registerer, as a metric
+	// can only be registered once.
+	registered = make(map[prometheus.Registerer]*metrics)
+)
+
+type metrics struct {
+	refs     int
+	streams  *prometheus.CounterVec
+	resets   *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+}
+
+func getMetrics(r prometheus.Registerer) (*metrics, error) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	if m, ok := registered[r]; ok {
+		m.refs++
+		return m, nil
+	}
+
+	labels := []string{"protocol", "variant"}
+	m := &metrics{
+		refs: 1,
+		streams: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "libp2p_rollout_streams_total",
+			Help: "Streams passed to the handlers of a protocol being rolled out",
+		}, labels),
+		resets: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "libp2p_rollout_stream_resets_total",
+			Help: "Streams reset by the handlers of a protocol being rolled out",
+		}, labels),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "libp2p_rollout_handler_duration_seconds",
+			Help:    "Time spent in the handlers of a protocol being rolled out",
+			Buckets: prometheus.ExponentialBuckets(0.001, 2, 16), // 1ms to ~30s
+		}, labels),
+	}
+	collectors := []prometheus.Collector{m.streams, m.resets, m.duration}
+	for i, c := range collectors {
+		if err := r.Register(c); err != nil {
+			for _, c := range collectors[:i] {
+				r.Unregister(c)
+			}
+			return nil, err
+		}
+	}
+	registered[r] = m
+	return m, nil
+}
+
+func releaseMetrics(r prometheus.Registerer, m *metrics, pid protocol.ID) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	for _, v := range []Variant{Stable, Canary} {
+		m.streams.DeleteLabelValues(string(pid), string(v))
+		m.resets.DeleteLabelValues(string(pid), string(v))
+		m.duration.DeleteLabelValues(string(pid), string(v))
+	}
+	m.refs--
+	if m.refs > 0 {
+		return
+	}
+	r.Unregister(m.streams)
+	r.Unregister(m.resets)
+	r.Unregister(m.duration)
+	delete(registered, r)
+}
+
+type variantStats struct {
+	streams, resets, nanos uint64
+}
+
+// Split is a stream handler passing the streams of a protocol to either the
+// stable or the canary handler, as chosen by its Selector.
+type Split struct {
+	// accessed atomically, kept first for 64-bit alignment on 32-bit platforms.
+	stats [2]variantStats
+
+	pid    protocol.ID
+	stable network.StreamHandler
+	canary network.StreamHandler
+
+	mu       sync.RWMutex
+	selector Selector
+
+	registerer prometheus.Registerer
+	metrics    *metrics
+	closeOnce  sync.Once
+}
+
+// New constructs a new Split of the streams of the given protocol between the
+// stable and the canary handler. A nil selector selects no peer.
+func New(pid protocol.ID, stable, canary network.StreamHandler, sel Selector, opts ...Option) (*Split, error) {
+	var cfg config
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	s := &Split{
+		pid:        pid,
+		stable:     stable,
+		canary:     canary,
+		selector:   sel,
+		registerer: cfg.registerer,
+	}
+	if cfg.registerer != nil {
+		m, err := getMetrics(cfg.registerer)
+		if err != nil {
+			return nil, err
+		}
+		s.metrics = m
+	}
+	return s, nil
+}
+
+// SetStreamHandler splits the streams of the given protocol on the given
+// host, see New. Close the Split once the handler is removed.
+func SetStreamHandler(h host.Host, pid protocol.ID, stable, canary network.StreamHandler, sel Selector, opts ...Option) (*Split, error) {
+	s, err := New(pid, stable, canary, sel, opts...)
+	if err != nil {
+		return nil, err
+	}
+	h.SetStreamHandler(pid, s.Handle)
+	return s, nil
+}
+
+// SetSelector changes the peers served by the canary handler, e.g. to widen
+// the rollout. It applies to new streams only.
+func (s *Split) SetSelector(sel Selector) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.selector = sel
+}
+
+// Select returns the variant serving the given peer.
+func (s *Split) Select(p peer.ID) Variant {
+	s.mu.RLock()
+	sel := s.selector
+	s.mu.RUnlock()
+	if sel != nil && sel(p) {
+		return Canary
+	}
+	return Stable
+}
+
+// Handle passes the stream to the handler serving its remote peer.
+func (s *Split) Handle(str network.Stream) {
+	v := s.Select(str.Conn().RemotePeer())
+	handler, vs := s.stable, &s.stats[0]
+	if v == Canary {
+		handler, vs = s.canary, &s.stats[1]
+	}
+
+	atomic.AddUint64(&vs.streams, 1)
+	if s.metrics != nil {
+		s.metrics.streams.WithLabelValues(string(s.pid), string(v)).Inc()
+	}
+
+	start := time.Now()
+	handler(&stream{Stream: str, split: s, variant: v, stats: vs})
+	elapsed := time.Since(start)
+
+	atomic.AddUint64(&vs.nanos, uint64(elapsed))
+	if s.metrics != nil {
+		s.metrics.duration.WithLabelValues(string(s.pid), string(v)).Observe(elapsed.Seconds())
+	}
+}
+
+// Stats returns the statistics of the given variant.
+func (s *Split) Stats(v Variant) Stats {
+	vs := &s.stats[0]
+	if v == Canary {
+		vs = &s.stats[1]
+	}
+	return Stats{
+		Streams:     atomic.LoadUint64(&vs.streams),
+		Resets:      atomic.LoadUint64(&vs.resets),
+		HandlerTime: time.Duration(atomic.LoadUint64(&vs.nanos)),
+	}
+}
+
+// Close unregisters the Split's metrics. It doesn't remove the stream
+// handler from the host.
+func (s *Split) Close() error {
+	if s.metrics != nil {
+		s.closeOnce.Do(func() { releaseMetrics(s.registerer, s.metrics, s.pid) })
+	}
+	return nil
+}
+
+// stream counts the resets of the streams passed to a handler.
+type stream struct {
+	network.Stream
+	split   *Split
+	variant Variant
+	stats   *variantStats
+	reset   uint32
+}
+
+func (s *stream) Reset() error {
+	if atomic.CompareAndSwapUint32(&s.reset, 0, 1) {
+		atomic.AddUint64(&s.stats.resets, 1)
+		if m := s.split.metrics; m != nil {
+			m.resets.WithLabelValues(string(s.split.pid), string(s.variant)).Inc()
+		}
+		log.Debugw("handler reset stream", "protocol", s.split.pid, "variant", s.variant, "peer", s.Conn().RemotePeer())
+	}
+	return s.Stream.Reset()
+}
@@ -0,0 +1,102 @@
+package rollout
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/test"
+
+	bhost "github.com/libp2p/go-libp2p/p2p/host/basic"
+
+	swarmt "github.com/libp2p/go-libp2p-swarm/testing"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPercent(t *testing.T) {
+	var selected10, selected50 int
+	sel10, sel50 := Percent(10), Percent(50)
+	for i := 0; i < 2000; i++ {
+		p, err := test.RandPeerID()
+		require.NoError(t, err)
+		if sel10(p) {
+			selected10++
+			require.True(t, sel50(p), "widening the rollout must keep selected peers")
+		}
+		if sel50(p) {
+			selected50++
+		}
+		require.Equal(t, sel10(p), Percent(10)(p), "selection must be deterministic")
+	}
+	require.InDelta(t, 200, selected10, 60)
+	require.InDelta(t, 1000, selected50, 120)
+
+	p, err := test.RandPeerID()
+	require.NoError(t, err)
+	require.False(t, Percent(0)(p))
+	require.True(t, Percent(100)(p))
+}
+
+func TestSplit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h := bhost.New(swarmt.GenSwarm(t, ctx))
+	defer h.Close()
+	canaryPeer := bhost.New(swarmt.GenSwarm(t, ctx))
+	defer canaryPeer.Close()
+	stablePeer := bhost.New(swarmt.GenSwarm(t, ctx))
+	defer stablePeer.Close()
+
+	handler := func(reply string, reset bool) network.StreamHandler {
+		return func(s network.Stream) {
+			if reset {
+				s.Reset()
+				return
+			}
+			s.Write([]byte(reply))
+			s.Close()
+		}
+	}
+
+	reg := prometheus.NewRegistry()
+	split, err := SetStreamHandler(h, "/test", handler("stable", false), handler("canary", true), Peers(canaryPeer.ID()), Registerer(reg))
+	require.NoError(t, err)
+	defer split.Close()
+
+	request := func(from *bhost.BasicHost) (string, error) {
+		require.NoError(t, from.Connect(ctx, peer.AddrInfo{ID: h.ID(), Addrs: h.Addrs()}))
+		s, err := from.NewStream(ctx, h.ID(), "/test")
+		require.NoError(t, err)
+		b, err := ioutil.ReadAll(s)
+		return string(b), err
+	}
+
+	reply, err := request(stablePeer)
+	require.NoError(t, err)
+	require.Equal(t, "stable", reply)
+	_, err = request(canaryPeer)
+	require.Error(t, err)
+
+	require.Equal(t, uint64(1), split.Stats(Stable).Streams)
+	require.Zero(t, split.Stats(Stable).Resets)
+	require.Equal(t, uint64(1), split.Stats(Canary).Streams)
+	require.Equal(t, uint64(1), split.Stats(Canary).Resets)
+	require.Equal(t, 1.0, testutil.ToFloat64(split.metrics.resets.WithLabelValues("/test", "canary")))
+	require.Equal(t, 1.0, testutil.ToFloat64(split.metrics.streams.WithLabelValues("/test", "stable")))
+
+	// complete the rollout.
+	split.SetSelector(Percent(100))
+	_, err = request(stablePeer)
+	require.Error(t, err)
+	require.Equal(t, uint64(2), split.Stats(Canary).Streams)
+
+	// splits of other protocols share the registerer.
+	other, err := New("/other", handler("", false), handler("", false), nil, Registerer(reg))
+	require.NoError(t, err)
+	require.NoError(t, other.Close())
+}
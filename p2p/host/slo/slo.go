@@ -0,0 +1,444 @@
+// Package slo tracks how long connecting to peers and opening streams take
+// against service level objectives, like "99% of connections are established
+// within 2s", so that operators get alerted on objectives being missed rather
+// than having to read raw latency histograms.
+//
+// The Tracker measures the Connect and NewStream calls made through the host
+// it wraps, see Tracker.Host, and latencies measured elsewhere can be recorded
+// with Tracker.Observe. For every target, it exports the burn rate of its
+// error budget over a sliding window as a Prometheus metric, and emits an
+// EvtViolated on the host's event bus when the budget burns faster than it
+// should.
+package slo
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/event"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+
+	logging "github.com/ipfs/go-log/v2"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var log = logging.Logger("slo")
+
+// Kind is the kind of operation an objective is about.
+type Kind string
+
+const (
+	// Connect is the time to connected: how long connecting to a peer we're
+	// not connected to takes.
+	Connect Kind = "connect"
+	// FirstStream is the time to first stream: how long opening a stream
+	// takes, from the NewStream call until it returns, including connecting
+	// to the peer if needed.
+	FirstStream Kind = "first_stream"
+)
+
+// Target is an objective: the given quantile of the operations of the given
+// kind complete within the threshold. Operations failing are counted as
+// exceeding the threshold.
+type Target struct {
+	Kind      Kind
+	Quantile  float64
+	Threshold time.Duration
+}
+
+func (t Target) String() string {
+	return fmt.Sprintf("%s p%g < %s", t.Kind, t.Quantile*100, t.Threshold)
+}
+
+// budget is the fraction of operations allowed to exceed the threshold.
+func (t Target) budget() float64 {
+	return 1 - t.Quantile
+}
+
+// DefaultTargets are the targets tracked unless others are given.
+var DefaultTargets = []Target{
+	{Kind: Connect, Quantile: 0.5, Threshold: 500 * time.Millisecond},
+	{Kind: Connect, Quantile: 0.95, Threshold: 2 * time.Second},
+	{Kind: Connect, Quantile: 0.99, Threshold: 5 * time.Second},
+	{Kind: FirstStream, Quantile: 0.5, Threshold: 250 * time.Millisecond},
+	{Kind: FirstStream, Quantile: 0.95, Threshold: time.Second},
+	{Kind: FirstStream, Quantile: 0.99, Threshold: 3 * time.Second},
+}
+
+// EvtViolated is emitted on the host's event bus when a target is violated:
+// the burn rate of its error budget went above 1 over the window.
+type EvtViolated struct {
+	Target Target
+	// Observed is the estimated latency at the target's quantile.
+	Observed time.Duration
+	BurnRate float64
+	// Events is the number of operations in the window.
+	Events uint64
+}
+
+// Status is the state of a target over the current window.
+type Status struct {
+	Target Target
+	// Observed is the estimated latency at the target's quantile of the
+	// operations that succeeded, within a factor of 2.
+	Observed time.Duration
+	// BurnRate is how fast the error budget burns: the fraction of
+	// operations exceeding the threshold, divided by the fraction allowed
+	// to. Above 1, the target is missed.
+	BurnRate float64
+	Events   uint64
+	Violated bool
+}
+
+type config struct {
+	targets    []Target
+	window     time.Duration
+	minEvents  uint64
+	registerer prometheus.Registerer
+}
+
+// Option is an option for the Tracker.
+type Option func(*config) error
+
+// Targets sets the targets to track, instead of DefaultTargets.
+func Targets(targets ...Target) Option {
+	return func(cfg *config) error {
+		for _, t := range targets {
+			if t.Kind != Connect && t.Kind != FirstStream {
+				return fmt.Errorf("unknown kind %q", t.Kind)
+			}
+			if t.Quantile <= 0 || t.Quantile >= 1 {
+				return fmt.Errorf("quantile of %s must be between 0 and 1", t)
+			}
+		}
+		cfg.targets = targets
+		return nil
+	}
+}
+
+// Window sets the sliding window burn rates are computed over. Defaults to an
+// hour.
+func Window(d time.Duration) Option {
+	return func(cfg *config) error {
+		if d < time.Minute {
+			return fmt.Errorf("window of %s is shorter than a minute", d)
+		}
+		cfg.window = d
+		return nil
+	}
+}
+
+// MinEvents sets the number of operations needed in the window before
+// targets are considered violated, so that a few slow operations on a quiet
+// node don't raise alerts. Defaults to 20.
+func MinEvents(n uint64) Option {
+	return func(cfg *config) error {
+		cfg.minEvents = n
+		return nil
+	}
+}
+
+// Registerer registers the Tracker's metrics with the given registerer,
+// instead of prometheus.DefaultRegisterer.
+func Registerer(r prometheus.Registerer) Option {
+	return func(cfg *config) error {
+		cfg.registerer = r
+		return nil
+	}
+}
+
+// numSlots is the number of slots the window is divided into. Operations
+// expire from the window one slot at a time.
+const numSlots = 60
+
+// numBuckets is the number of buckets of the latency histograms latencies at
+// quantiles are estimated from. Bucket i holds latencies up to 1ms << i, the
+// last one anything longer.
+const numBuckets = 24
+
+func bucket(d time.Duration) int {
+	for i := 0; i < numBuckets-1; i++ {
+		if d <= time.Millisecond<<i {
+			return i
+		}
+	}
+	return numBuckets - 1
+}
+
+// slot counts the operations of a kind started in a slot of the window.
+type slot struct {
+	start time.Time
+	total uint64
+	// bad counts the operations exceeding the threshold of each target of
+	// the kind, failures included.
+	bad  []uint64
+	hist [numBuckets]uint64
+}
+
+type series struct {
+	targets []Target
+	slots   [numSlots]slot
+}
+
+// Tracker tracks the latency of connecting and opening streams against
+// targets.
+type Tracker struct {
+	host host.Host
+	cfg  config
+	now  func() time.Time
+
+	burnRate   *prometheus.GaugeVec
+	latency    *prometheus.GaugeVec
+	violations *prometheus.CounterVec
+
+	emitter event.Emitter
+
+	mu       sync.Mutex
+	series   map[Kind]*series
+	violated map[Target]bool
+}
+
+// NewTracker constructs a new Tracker for the given host, registering its
+// metrics.
+func NewTracker(h host.Host, opts ...Option) (*Tracker, error) {
+	cfg := config{
+		targets:    DefaultTargets,
+		window:     time.Hour,
+		minEvents:  20,
+		registerer: prometheus.DefaultRegisterer,
+	}
+	for _, opt := range opts {
+		if err := opt(&cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	t := &Tracker{
+		host: h,
+		cfg:  cfg,
+		now:  time.Now,
+		burnRate: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "libp2p_slo_burn_rate",
+			Help: "Burn rate of the error budget of libp2p latency objectives",
+		}, []string{"kind", "quantile"}),
+		latency: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "libp2p_slo_latency_seconds",
+			Help: "Estimated latency at the quantile of libp2p latency objectives",
+		}, []string{"kind", "quantile"}),
+		violations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "libp2p_slo_violations_total",
+			Help: "Violations of libp2p latency objectives",
+		}, []string{"kind", "quantile"}),
+		series:   make(map[Kind]*series),
+		violated: make(map[Target]bool),
+	}
+	for _, target := range cfg.targets {
+		s, ok := t.series[target.Kind]
+		if !ok {
+			s = &series{}
+			t.series[target.Kind] = s
+		}
+		s.targets = append(s.targets, target)
+	}
+
+	collectors := []prometheus.Collector{t.burnRate, t.latency, t.violations}
+	for i, c := range collectors {
+		if err := cfg.registerer.Register(c); err != nil {
+			for _, c := range collectors[:i] {
+				cfg.registerer.Unregister(c)
+			}
+			return nil, err
+		}
+	}
+
+	var err error
+	t.emitter, err = h.EventBus().Emitter(new(EvtViolated))
+	if err != nil {
+		log.Warnf("not emitting objective violations; err: %s", err)
+	}
+	return t, nil
+}
+
+// Close unregisters the metrics.
+func (t *Tracker) Close() error {
+	t.cfg.registerer.Unregister(t.burnRate)
+	t.cfg.registerer.Unregister(t.latency)
+	t.cfg.registerer.Unregister(t.violations)
+	if t.emitter != nil {
+		t.emitter.Close()
+	}
+	return nil
+}
+
+// Observe records an operation of the given kind that took d, and failed if
+// err isn't nil.
+func (t *Tracker) Observe(kind Kind, d time.Duration, err error) {
+	var violations []EvtViolated
+
+	t.mu.Lock()
+	s, ok := t.series[kind]
+	if !ok {
+		t.mu.Unlock()
+		return
+	}
+	now := t.now()
+	sl := t.slot(s, now)
+	sl.total++
+	if err == nil {
+		sl.hist[bucket(d)]++
+	}
+	for i, target := range s.targets {
+		if err != nil || d > target.Threshold {
+			sl.bad[i]++
+		}
+	}
+	for _, st := range t.evaluate(s, now) {
+		if st.Violated == t.violated[st.Target] {
+			continue
+		}
+		t.violated[st.Target] = st.Violated
+		if !st.Violated {
+			log.Infow("objective met again", "target", st.Target, "burn_rate", st.BurnRate)
+			continue
+		}
+		violations = append(violations, EvtViolated{
+			Target:   st.Target,
+			Observed: st.Observed,
+			BurnRate: st.BurnRate,
+			Events:   st.Events,
+		})
+	}
+	t.mu.Unlock()
+
+	for _, evt := range violations {
+		log.Warnw("objective violated", "target", evt.Target, "observed", evt.Observed, "burn_rate", evt.BurnRate)
+		t.violations.WithLabelValues(labels(evt.Target)...).Inc()
+		if t.emitter != nil {
+			t.emitter.Emit(evt)
+		}
+	}
+}
+
+func labels(target Target) []string {
+	return []string{string(target.Kind), fmt.Sprint(target.Quantile)}
+}
+
+// slot returns the slot of the window the given time falls in, resetting it
+// if it last held an older slot.
+func (t *Tracker) slot(s *series, now time.Time) *slot {
+	slotLen := t.cfg.window / numSlots
+	start := now.Truncate(slotLen)
+	sl := &s.slots[int(start.UnixNano()/int64(slotLen))%numSlots]
+	if !sl.start.Equal(start) {
+		*sl = slot{start: start, bad: make([]uint64, len(s.targets))}
+	}
+	return sl
+}
+
+// evaluate computes the status of the targets of the series, and updates the
+// metrics. t.mu must be held.
+func (t *Tracker) evaluate(s *series, now time.Time) []Status {
+	var (
+		total uint64
+		bad   = make([]uint64, len(s.targets))
+		hist  [numBuckets]uint64
+	)
+	since := now.Add(-t.cfg.window)
+	for i := range s.slots {
+		sl := &s.slots[i]
+		if sl.total == 0 || !sl.start.After(since) {
+			continue
+		}
+		total += sl.total
+		for j := range bad {
+			bad[j] += sl.bad[j]
+		}
+		for j := range hist {
+			hist[j] += sl.hist[j]
+		}
+	}
+
+	out := make([]Status, 0, len(s.targets))
+	for i, target := range s.targets {
+		st := Status{Target: target, Events: total}
+		if total > 0 {
+			st.BurnRate = float64(bad[i]) / float64(total) / target.budget()
+			st.Observed = quantile(&hist, target.Quantile)
+		}
+		st.Violated = total >= t.cfg.minEvents && st.BurnRate > 1
+		t.burnRate.WithLabelValues(labels(target)...).Set(st.BurnRate)
+		t.latency.WithLabelValues(labels(target)...).Set(st.Observed.Seconds())
+		out = append(out, st)
+	}
+	return out
+}
+
+// quantile estimates the latency at the given quantile as the upper bound of
+// the bucket it falls in.
+func quantile(hist *[numBuckets]uint64, q float64) time.Duration {
+	var total uint64
+	for _, n := range hist {
+		total += n
+	}
+	if total == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(q * float64(total)))
+	var seen uint64
+	for i, n := range hist {
+		seen += n
+		if seen >= rank {
+			return time.Millisecond << i
+		}
+	}
+	return time.Millisecond << (numBuckets - 1)
+}
+
+// Status returns the status of every target over the current window.
+func (t *Tracker) Status() []Status {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	var out []Status
+	for _, kind := range []Kind{Connect, FirstStream} {
+		if s, ok := t.series[kind]; ok {
+			out = append(out, t.evaluate(s, now)...)
+		}
+	}
+	return out
+}
+
+// Host returns the tracked host, wrapped to measure the Connect and NewStream
+// calls made through it.
+func (t *Tracker) Host() host.Host {
+	return &trackedHost{Host: t.host, t: t}
+}
+
+type trackedHost struct {
+	host.Host
+	t *Tracker
+}
+
+func (h *trackedHost) Connect(ctx context.Context, pi peer.AddrInfo) error {
+	if h.Network().Connectedness(pi.ID) == network.Connected {
+		return h.Host.Connect(ctx, pi)
+	}
+	start := time.Now()
+	err := h.Host.Connect(ctx, pi)
+	h.t.Observe(Connect, time.Since(start), err)
+	return err
+}
+
+func (h *trackedHost) NewStream(ctx context.Context, p peer.ID, pids ...protocol.ID) (network.Stream, error) {
+	start := time.Now()
+	s, err := h.Host.NewStream(ctx, p, pids...)
+	h.t.Observe(FirstStream, time.Since(start), err)
+	return s, err
+}
@@ -0,0 +1,133 @@
+package slo
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	blhost "github.com/libp2p/go-libp2p-blankhost"
+	swarmt "github.com/libp2p/go-libp2p-swarm/testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuantile(t *testing.T) {
+	var hist [numBuckets]uint64
+	require.Zero(t, quantile(&hist, 0.5))
+	hist[bucket(3*time.Millisecond)] = 9
+	hist[bucket(time.Second)] = 1
+	require.Equal(t, 4*time.Millisecond, quantile(&hist, 0.5))
+	require.Equal(t, 4*time.Millisecond, quantile(&hist, 0.9))
+	require.Equal(t, 1024*time.Millisecond, quantile(&hist, 0.99))
+	require.Equal(t, numBuckets-1, bucket(3*time.Hour))
+}
+
+func TestTracker(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	defer h.Close()
+
+	target := Target{Kind: Connect, Quantile: 0.5, Threshold: 100 * time.Millisecond}
+	tr, err := NewTracker(h, Registerer(prometheus.NewRegistry()), Targets(target), MinEvents(4), Window(time.Minute))
+	require.NoError(t, err)
+	defer tr.Close()
+	now := time.Now()
+	tr.now = func() time.Time { return now }
+
+	sub, err := h.EventBus().Subscribe(new(EvtViolated))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	// kinds without targets are ignored.
+	tr.Observe(FirstStream, time.Hour, nil)
+
+	tr.Observe(Connect, 10*time.Millisecond, nil)
+	tr.Observe(Connect, time.Second, nil)
+	tr.Observe(Connect, 10*time.Millisecond, errors.New("failed"))
+	st := tr.Status()
+	require.Len(t, st, 1)
+	require.Equal(t, uint64(3), st[0].Events)
+	require.InDelta(t, 4.0/3, st[0].BurnRate, 0.001)
+	require.False(t, st[0].Violated, "too few events")
+
+	tr.Observe(Connect, 10*time.Millisecond, nil)
+	st = tr.Status()
+	require.Equal(t, 1.0, st[0].BurnRate)
+	require.False(t, st[0].Violated)
+
+	tr.Observe(Connect, 200*time.Millisecond, nil)
+	st = tr.Status()
+	require.True(t, st[0].Violated)
+	require.Equal(t, 16*time.Millisecond, st[0].Observed)
+	select {
+	case e := <-sub.Out():
+		evt := e.(EvtViolated)
+		require.Equal(t, target, evt.Target)
+		require.Equal(t, uint64(5), evt.Events)
+		require.InDelta(t, 1.2, evt.BurnRate, 0.001)
+	case <-time.After(time.Second):
+		t.Fatal("expected a violation event")
+	}
+	require.Equal(t, 1.0, testutil.ToFloat64(tr.violations.WithLabelValues("connect", "0.5")))
+	require.InDelta(t, 1.2, testutil.ToFloat64(tr.burnRate.WithLabelValues("connect", "0.5")), 0.001)
+
+	// a violation is only reported once.
+	tr.Observe(Connect, time.Second, nil)
+	require.Equal(t, 1.0, testutil.ToFloat64(tr.violations.WithLabelValues("connect", "0.5")))
+
+	// operations expire from the window.
+	now = now.Add(time.Minute)
+	tr.Observe(Connect, 10*time.Millisecond, nil)
+	st = tr.Status()
+	require.Equal(t, uint64(1), st[0].Events)
+	require.False(t, st[0].Violated)
+}
+
+func TestTrackedHost(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	defer h2.Close()
+	h2.SetStreamHandler("/test", func(s network.Stream) { s.Close() })
+
+	tr, err := NewTracker(h1, Registerer(prometheus.NewRegistry()))
+	require.NoError(t, err)
+	defer tr.Close()
+	h := tr.Host()
+
+	events := func() map[Kind]uint64 {
+		out := make(map[Kind]uint64)
+		for _, st := range tr.Status() {
+			out[st.Target.Kind] = st.Events
+		}
+		return out
+	}
+
+	ai := peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}
+	require.NoError(t, h.Connect(ctx, ai))
+	// we're already connected.
+	require.NoError(t, h.Connect(ctx, ai))
+	require.Equal(t, map[Kind]uint64{Connect: 1, FirstStream: 0}, events())
+
+	s, err := h.NewStream(ctx, h2.ID(), "/test")
+	require.NoError(t, err)
+	s.Close()
+	_, err = h.NewStream(ctx, h2.ID(), "/unknown")
+	require.Error(t, err)
+	st := tr.Status()
+	require.Equal(t, map[Kind]uint64{Connect: 1, FirstStream: 2}, events())
+	for _, s := range st {
+		if s.Target.Kind == FirstStream && s.Target.Quantile == 0.5 {
+			require.Equal(t, 1.0, s.BurnRate, "the failed stream counts")
+		}
+	}
+}
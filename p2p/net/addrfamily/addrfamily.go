@@ -0,0 +1,254 @@
+// Package addrfamily implements host-wide address family policies: preferring
+// IPv6 or IPv4 addresses, or excluding one of the families altogether, when
+// dialing peers and advertising our own addresses.
+package addrfamily
+
+import (
+	"net"
+	"sort"
+
+	"github.com/libp2p/go-libp2p-core/connmgr"
+	"github.com/libp2p/go-libp2p-core/control"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// Family is the IP address family of an address.
+type Family int
+
+const (
+	// Unknown is the family of addresses that aren't tied to a family, e.g.
+	// /dns or /dnsaddr addresses.
+	Unknown Family = iota
+	IPv4
+	IPv6
+)
+
+// Of returns the family of the given address, as given by its first component.
+func Of(a ma.Multiaddr) Family {
+	var f Family
+	ma.ForEach(a, func(c ma.Component) bool {
+		switch c.Protocol().Code {
+		case ma.P_IP4, ma.P_DNS4:
+			f = IPv4
+		case ma.P_IP6, ma.P_DNS6:
+			f = IPv6
+		}
+		return false
+	})
+	return f
+}
+
+// OfIP returns the family of the given IP address.
+func OfIP(ip net.IP) Family {
+	switch {
+	case ip == nil:
+		return Unknown
+	case ip.To4() != nil:
+		return IPv4
+	default:
+		return IPv6
+	}
+}
+
+// Policy is an address family policy.
+type Policy int
+
+const (
+	// Any uses addresses of both families, without preference.
+	Any Policy = iota
+	// PreferIPv6 uses addresses of both families, IPv6 ones first.
+	PreferIPv6
+	// PreferIPv4 uses addresses of both families, IPv4 ones first.
+	PreferIPv4
+	// IPv4Only excludes IPv6 addresses.
+	IPv4Only
+	// IPv6Only excludes IPv4 addresses.
+	IPv6Only
+)
+
+func (p Policy) String() string {
+	switch p {
+	case Any:
+		return "any"
+	case PreferIPv6:
+		return "prefer-ipv6"
+	case PreferIPv4:
+		return "prefer-ipv4"
+	case IPv4Only:
+		return "ipv4-only"
+	case IPv6Only:
+		return "ipv6-only"
+	default:
+		return "unknown"
+	}
+}
+
+// Allows returns false for the families the policy excludes. Addresses of an
+// unknown family are always allowed.
+func (p Policy) Allows(f Family) bool {
+	switch p {
+	case IPv4Only:
+		return f != IPv6
+	case IPv6Only:
+		return f != IPv4
+	default:
+		return true
+	}
+}
+
+// rank orders families, lower first.
+func (p Policy) rank(f Family) int {
+	switch {
+	case p == PreferIPv6 && f == IPv4, p == PreferIPv4 && f == IPv6:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// Filter removes the addresses of excluded families, and orders the remaining
+// addresses with the preferred family first, keeping their relative order
+// otherwise. It doesn't modify the given slice.
+func (p Policy) Filter(addrs []ma.Multiaddr) []ma.Multiaddr {
+	if p == Any {
+		return addrs
+	}
+	out := make([]ma.Multiaddr, 0, len(addrs))
+	for _, a := range addrs {
+		if p.Allows(Of(a)) {
+			out = append(out, a)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		return p.rank(Of(out[i])) < p.rank(Of(out[j]))
+	})
+	return out
+}
+
+// Sort orders the addresses with the preferred family first, keeping their
+// relative order otherwise. Unlike Filter, it doesn't remove the addresses of
+// excluded families. It doesn't modify the given slice.
+func (p Policy) Sort(addrs []ma.Multiaddr) []ma.Multiaddr {
+	if p != PreferIPv6 && p != PreferIPv4 {
+		return addrs
+	}
+	out := make([]ma.Multiaddr, len(addrs))
+	copy(out, addrs)
+	sort.SliceStable(out, func(i, j int) bool {
+		return p.rank(Of(out[i])) < p.rank(Of(out[j]))
+	})
+	return out
+}
+
+// FilterIPs is Filter for IP addresses.
+func (p Policy) FilterIPs(ips []net.IP) []net.IP {
+	if p == Any {
+		return ips
+	}
+	out := make([]net.IP, 0, len(ips))
+	for _, ip := range ips {
+		if p.Allows(OfIP(ip)) {
+			out = append(out, ip)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		return p.rank(OfIP(out[i])) < p.rank(OfIP(out[j]))
+	})
+	return out
+}
+
+// AddrsFactory returns an address factory applying the policy to the
+// addresses returned by the given factory, which may be nil.
+func (p Policy) AddrsFactory(next func([]ma.Multiaddr) []ma.Multiaddr) func([]ma.Multiaddr) []ma.Multiaddr {
+	return func(addrs []ma.Multiaddr) []ma.Multiaddr {
+		if next != nil {
+			addrs = next(addrs)
+		}
+		return p.Filter(addrs)
+	}
+}
+
+// Gater is a connection gater refusing to dial addresses of the families
+// excluded by a policy. Connections it doesn't refuse are passed on to the
+// gater it wraps, if any.
+//
+// A gater can't make the swarm dial preferred addresses first, see
+// Policy.Peerstore.
+type Gater struct {
+	policy Policy
+	inner  connmgr.ConnectionGater
+}
+
+var _ connmgr.ConnectionGater = (*Gater)(nil)
+
+// NewGater constructs a new Gater enforcing the given policy, wrapping the
+// given gater, which may be nil.
+func NewGater(p Policy, inner connmgr.ConnectionGater) *Gater {
+	return &Gater{policy: p, inner: inner}
+}
+
+func (g *Gater) InterceptPeerDial(p peer.ID) bool {
+	return g.inner == nil || g.inner.InterceptPeerDial(p)
+}
+
+func (g *Gater) InterceptAddrDial(p peer.ID, a ma.Multiaddr) bool {
+	if !g.policy.Allows(Of(a)) {
+		return false
+	}
+	return g.inner == nil || g.inner.InterceptAddrDial(p, a)
+}
+
+func (g *Gater) InterceptAccept(addrs network.ConnMultiaddrs) bool {
+	return g.inner == nil || g.inner.InterceptAccept(addrs)
+}
+
+func (g *Gater) InterceptSecured(dir network.Direction, p peer.ID, addrs network.ConnMultiaddrs) bool {
+	return g.inner == nil || g.inner.InterceptSecured(dir, p, addrs)
+}
+
+func (g *Gater) InterceptUpgraded(c network.Conn) (bool, control.DisconnectReason) {
+	if g.inner == nil {
+		return true, 0
+	}
+	return g.inner.InterceptUpgraded(c)
+}
+
+// Peerstore returns a peerstore returning the addresses of peers with the
+// preferred family of the policy first, backed by the given peerstore. The
+// swarm starts dialing the addresses of a peer in the order the peerstore
+// returns them, within the tiers it ranks them in by transport, e.g. QUIC
+// before TCP, so that it dials addresses of the preferred family first. The
+// peerstore is returned as is if the policy doesn't prefer a family.
+func (p Policy) Peerstore(ps peerstore.Peerstore) peerstore.Peerstore {
+	if p != PreferIPv6 && p != PreferIPv4 {
+		return ps
+	}
+	ops := &orderedPeerstore{Peerstore: ps, policy: p}
+	// keep signed peer records working.
+	if cab, ok := peerstore.GetCertifiedAddrBook(ps); ok {
+		return &certifiedPeerstore{orderedPeerstore: ops, CertifiedAddrBook: cab}
+	}
+	return ops
+}
+
+type orderedPeerstore struct {
+	peerstore.Peerstore
+	policy Policy
+}
+
+func (ps *orderedPeerstore) Addrs(p peer.ID) []ma.Multiaddr {
+	return ps.policy.Sort(ps.Peerstore.Addrs(p))
+}
+
+func (ps *orderedPeerstore) PeerInfo(p peer.ID) peer.AddrInfo {
+	return peer.AddrInfo{ID: p, Addrs: ps.Addrs(p)}
+}
+
+type certifiedPeerstore struct {
+	*orderedPeerstore
+	peerstore.CertifiedAddrBook
+}
@@ -0,0 +1,120 @@
+package addrfamily
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/libp2p/go-libp2p-core/test"
+	"github.com/libp2p/go-libp2p-peerstore/pstoremem"
+
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+func addrs(t *testing.T, ss ...string) []ma.Multiaddr {
+	out := make([]ma.Multiaddr, 0, len(ss))
+	for _, s := range ss {
+		a, err := ma.NewMultiaddr(s)
+		require.NoError(t, err)
+		out = append(out, a)
+	}
+	return out
+}
+
+func TestOf(t *testing.T) {
+	for s, f := range map[string]Family{
+		"/ip4/1.2.3.4/tcp/1":                     IPv4,
+		"/dns4/example.com/tcp/1":                IPv4,
+		"/ip6/::1/udp/1/quic":                    IPv6,
+		"/dns6/example.com/tcp/1":                IPv6,
+		"/dns/example.com/tcp/1":                 Unknown,
+		"/dnsaddr/example.com":                   Unknown,
+		"/ip6/::1/tcp/1/p2p-circuit/ip4/1.2.3.4": IPv6,
+	} {
+		require.Equal(t, f, Of(addrs(t, s)[0]), s)
+	}
+	require.Equal(t, IPv4, OfIP(net.IPv4(1, 2, 3, 4)))
+	require.Equal(t, IPv6, OfIP(net.IPv6loopback))
+	require.Equal(t, Unknown, OfIP(nil))
+}
+
+func TestFilter(t *testing.T) {
+	in := addrs(t,
+		"/ip4/1.2.3.4/tcp/1",
+		"/ip6/::1/tcp/1",
+		"/dns/example.com/tcp/1",
+		"/ip4/1.2.3.4/udp/1/quic",
+		"/ip6/::1/udp/1/quic",
+	)
+	for p, expected := range map[Policy][]ma.Multiaddr{
+		Any:        in,
+		PreferIPv6: {in[1], in[2], in[4], in[0], in[3]},
+		PreferIPv4: {in[0], in[2], in[3], in[1], in[4]},
+		IPv4Only:   {in[0], in[2], in[3]},
+		IPv6Only:   {in[1], in[2], in[4]},
+	} {
+		require.Equal(t, expected, p.Filter(in), p.String())
+	}
+	// the input is left alone.
+	require.Equal(t, "/ip4/1.2.3.4/tcp/1", in[0].String())
+
+	ips := []net.IP{net.IPv4(1, 2, 3, 4), net.IPv6loopback}
+	require.Equal(t, []net.IP{ips[1], ips[0]}, PreferIPv6.FilterIPs(ips))
+	require.Equal(t, []net.IP{ips[0]}, IPv4Only.FilterIPs(ips))
+}
+
+func TestAddrsFactory(t *testing.T) {
+	in := addrs(t, "/ip4/1.2.3.4/tcp/1", "/ip6/::1/tcp/1")
+	require.Equal(t, in[1:], IPv6Only.AddrsFactory(nil)(in))
+
+	f := IPv4Only.AddrsFactory(func(addrs []ma.Multiaddr) []ma.Multiaddr {
+		return append(addrs, addrs[0].Encapsulate(ma.StringCast("/p2p-circuit")))
+	})
+	require.Equal(t, []ma.Multiaddr{in[0], in[0].Encapsulate(ma.StringCast("/p2p-circuit"))}, f(in))
+}
+
+type denyGater struct{ *Gater }
+
+func (denyGater) InterceptAddrDial(peer.ID, ma.Multiaddr) bool { return false }
+
+func TestGater(t *testing.T) {
+	p, err := test.RandPeerID()
+	require.NoError(t, err)
+	in := addrs(t, "/ip4/1.2.3.4/tcp/1", "/ip6/::1/tcp/1")
+
+	g := NewGater(IPv6Only, nil)
+	require.True(t, g.InterceptPeerDial(p))
+	require.False(t, g.InterceptAddrDial(p, in[0]))
+	require.True(t, g.InterceptAddrDial(p, in[1]))
+	ok, _ := g.InterceptUpgraded(nil)
+	require.True(t, ok)
+
+	g = NewGater(Any, denyGater{NewGater(Any, nil)})
+	require.False(t, g.InterceptAddrDial(p, in[1]))
+}
+
+func TestPeerstore(t *testing.T) {
+	p, err := test.RandPeerID()
+	require.NoError(t, err)
+	in := addrs(t, "/ip4/1.2.3.4/tcp/1", "/ip6/::1/tcp/1", "/ip4/1.2.3.4/udp/1/quic")
+
+	ps := pstoremem.NewPeerstore()
+	require.Equal(t, ps, IPv6Only.Peerstore(ps))
+
+	ops := PreferIPv6.Peerstore(ps)
+	ops.AddAddrs(p, in, time.Hour)
+	for i := 0; i < 10; i++ {
+		// the addresses of the preferred family come first, but nothing is
+		// excluded.
+		got := ops.Addrs(p)
+		require.Len(t, got, 3)
+		require.Equal(t, in[1], got[0])
+		require.Equal(t, in[1], ops.PeerInfo(p).Addrs[0])
+	}
+	// signed peer records keep working.
+	_, ok := peerstore.GetCertifiedAddrBook(ops)
+	require.True(t, ok)
+}
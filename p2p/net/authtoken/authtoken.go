@@ -0,0 +1,174 @@
+// Package authtoken admits connections based on an application-provided token,
+// like an API key, sent by the dialer right after the security handshake. The
+// listener validates the token before the connection is upgraded further, and
+// closes the connection if it rejects it. The dialer doesn't wait for an
+// answer, so admission doesn't cost an extra round trip.
+//
+// Both sides of a connection must use it: wrap the security muxer of the
+// upgrader with Wrap, or use the libp2p.ConnAuthToken option.
+package authtoken
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/sec"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+var log = logging.Logger("net/authtoken")
+
+// MaxTokenSize is the maximum size of a token.
+const MaxTokenSize = 1024
+
+// ReadTimeout is the time the listener waits for the dialer's token, if the
+// upgrade's context has no deadline.
+var ReadTimeout = 10 * time.Second
+
+// ErrTokenTooLarge is returned when sending or receiving a token larger than
+// MaxTokenSize.
+var ErrTokenTooLarge = errors.New("auth token too large")
+
+// ErrRejected is returned when the validator rejects a connection's token.
+var ErrRejected = errors.New("auth token rejected")
+
+// TokenFunc returns the token to send when connecting to the given peer.
+type TokenFunc func(p peer.ID) []byte
+
+// Validator returns an error if the token a peer sent us isn't valid, and the
+// connection must be rejected. The token is empty if the peer sent none.
+type Validator func(p peer.ID, token []byte) error
+
+// StaticToken returns a TokenFunc sending the same token to all peers.
+func StaticToken(token []byte) TokenFunc {
+	return func(peer.ID) []byte { return token }
+}
+
+// AllowTokens returns a Validator accepting the given tokens only.
+func AllowTokens(tokens ...[]byte) Validator {
+	return func(_ peer.ID, token []byte) error {
+		for _, t := range tokens {
+			if subtle.ConstantTimeCompare(t, token) == 1 {
+				return nil
+			}
+		}
+		return errors.New("unknown token")
+	}
+}
+
+type secureMuxer struct {
+	sec.SecureMuxer
+
+	token    TokenFunc
+	validate Validator
+}
+
+// Wrap wraps a security muxer so that dialers send the token returned by the
+// given function, and listeners validate it with the given validator. Nil
+// token functions send empty tokens, nil validators accept all tokens.
+//
+// The side acting as the client of the connection, normally the dialer, sends
+// the token, and the one acting as the server validates it. Both roles may be
+// taken on outbound connections, on simultaneous open.
+func Wrap(m sec.SecureMuxer, token TokenFunc, validate Validator) sec.SecureMuxer {
+	return &secureMuxer{SecureMuxer: m, token: token, validate: validate}
+}
+
+func (m *secureMuxer) SecureInbound(ctx context.Context, insecure net.Conn) (sec.SecureConn, bool, error) {
+	c, server, err := m.SecureMuxer.SecureInbound(ctx, insecure)
+	if err != nil {
+		return nil, false, err
+	}
+	return m.exchange(ctx, c, server)
+}
+
+func (m *secureMuxer) SecureOutbound(ctx context.Context, insecure net.Conn, p peer.ID) (sec.SecureConn, bool, error) {
+	c, server, err := m.SecureMuxer.SecureOutbound(ctx, insecure, p)
+	if err != nil {
+		return nil, false, err
+	}
+	return m.exchange(ctx, c, server)
+}
+
+// exchange sends our token as the client, or receives and validates the
+// remote peer's as the server, closing the connection on error.
+func (m *secureMuxer) exchange(ctx context.Context, c sec.SecureConn, server bool) (sec.SecureConn, bool, error) {
+	var err error
+	if server {
+		err = m.receive(ctx, c)
+	} else {
+		err = m.send(c)
+	}
+	if err != nil {
+		_ = c.Close()
+		return nil, false, err
+	}
+	return c, server, nil
+}
+
+func (m *secureMuxer) send(c sec.SecureConn) error {
+	var token []byte
+	if m.token != nil {
+		token = m.token(c.RemotePeer())
+	}
+	if len(token) > MaxTokenSize {
+		return ErrTokenTooLarge
+	}
+	buf := make([]byte, binary.MaxVarintLen64+len(token))
+	n := binary.PutUvarint(buf, uint64(len(token)))
+	n += copy(buf[n:], token)
+	_, err := c.Write(buf[:n])
+	return err
+}
+
+func (m *secureMuxer) receive(ctx context.Context, c sec.SecureConn) error {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(ReadTimeout)
+	}
+	if err := c.SetReadDeadline(deadline); err != nil {
+		return err
+	}
+	defer c.SetReadDeadline(time.Time{})
+
+	// read byte by byte, not to consume what the dialer sent after the
+	// token.
+	size, err := binary.ReadUvarint(byteReader{c})
+	if err != nil {
+		return fmt.Errorf("failed to read auth token: %w", err)
+	}
+	if size > MaxTokenSize {
+		return ErrTokenTooLarge
+	}
+	token := make([]byte, size)
+	if _, err := io.ReadFull(c, token); err != nil {
+		return fmt.Errorf("failed to read auth token: %w", err)
+	}
+
+	if m.validate == nil {
+		return nil
+	}
+	if err := m.validate(c.RemotePeer(), token); err != nil {
+		log.Debugw("rejecting connection", "peer", c.RemotePeer(), "addr", c.RemoteAddr(), "error", err)
+		return fmt.Errorf("%w: %s", ErrRejected, err)
+	}
+	return nil
+}
+
+type byteReader struct {
+	io.Reader
+}
+
+func (r byteReader) ReadByte() (byte, error) {
+	var b [1]byte
+	_, err := io.ReadFull(r.Reader, b[:])
+	return b[0], err
+}
@@ -0,0 +1,102 @@
+package authtoken
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	ic "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/sec"
+	"github.com/libp2p/go-libp2p-core/sec/insecure"
+	"github.com/libp2p/go-libp2p-core/test"
+
+	csms "github.com/libp2p/go-conn-security-multistream"
+	"github.com/stretchr/testify/require"
+)
+
+func newSecureMuxer(t *testing.T) (sec.SecureMuxer, peer.ID) {
+	priv, _, err := test.RandTestKeyPair(ic.Ed25519, 256)
+	require.NoError(t, err)
+	id, err := peer.IDFromPrivateKey(priv)
+	require.NoError(t, err)
+	m := new(csms.SSMuxer)
+	m.AddTransport(insecure.ID, insecure.NewWithIdentity(id, priv))
+	return m, id
+}
+
+// pipe returns both ends of a TCP connection: unlike net.Pipe, writes don't
+// block until the other end reads, as the handshakes require.
+func pipe(t *testing.T) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := l.Accept()
+		accepted <- c
+	}()
+	a, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	b := <-accepted
+	require.NotNil(t, b)
+	return a, b
+}
+
+// connect secures a pipe between a dialer and a listener, returning their
+// connections, or the listener's error. The dialer must succeed.
+func connect(t *testing.T, dialer, listener sec.SecureMuxer, listenerID peer.ID) (sec.SecureConn, sec.SecureConn, error) {
+	a, b := pipe(t)
+	type result struct {
+		c   sec.SecureConn
+		err error
+	}
+	inbound := make(chan result, 1)
+	go func() {
+		c, _, err := listener.SecureInbound(context.Background(), b)
+		if err != nil {
+			b.Close()
+		}
+		inbound <- result{c, err}
+	}()
+	out, _, err := dialer.SecureOutbound(context.Background(), a, listenerID)
+	require.NoError(t, err)
+	in := <-inbound
+	return out, in.c, in.err
+}
+
+func TestAuthToken(t *testing.T) {
+	dialer, _ := newSecureMuxer(t)
+	listener, listenerID := newSecureMuxer(t)
+	listener = Wrap(listener, nil, AllowTokens([]byte("secret")))
+
+	out, in, err := connect(t, Wrap(dialer, StaticToken([]byte("secret")), nil), listener, listenerID)
+	require.NoError(t, err)
+	defer out.Close()
+	defer in.Close()
+
+	// what the dialer sends after the token goes through.
+	go out.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(in, buf)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buf))
+
+	out, _, err = connect(t, Wrap(dialer, StaticToken([]byte("guess")), nil), listener, listenerID)
+	require.True(t, errors.Is(err, ErrRejected))
+	out.Close()
+
+	// no token at all.
+	out, _, err = connect(t, Wrap(dialer, nil, nil), listener, listenerID)
+	require.True(t, errors.Is(err, ErrRejected))
+	out.Close()
+
+	// dialers don't send tokens larger than listeners accept.
+	a, b := pipe(t)
+	defer b.Close()
+	go listener.SecureInbound(context.Background(), b)
+	_, _, err = Wrap(dialer, StaticToken(make([]byte, MaxTokenSize+1)), nil).SecureOutbound(context.Background(), a, listenerID)
+	require.ErrorIs(t, err, ErrTokenTooLarge)
+}
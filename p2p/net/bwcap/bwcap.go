@@ -0,0 +1,456 @@
+// Package bwcap caps the bandwidth we send to individual peers, on top of any
+// global limit, e.g. so that untrusted, newly discovered, peers get 100 KB/s
+// until they earn our trust. Caps are set for connections, peers, or peers
+// carrying a tag, and enforced by the stream muxer: writes exceeding a cap are
+// delayed until the bandwidth is available.
+//
+// Wrap the stream muxer of the upgrader with Limiter.Wrap, or use the
+// libp2p.BandwidthCaps option.
+package bwcap
+
+import (
+	"context"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/connmgr"
+	"github.com/libp2p/go-libp2p-core/mux"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+var log = logging.Logger("net/bwcap")
+
+// maxChunk is the largest write we throttle at once: larger writes are split,
+// so that they're sent at a steady pace, not in bursts.
+const maxChunk = 16 << 10
+
+// resolveInterval is how often the caps of peers are resolved again, to follow
+// changes of their tags.
+const resolveInterval = time.Second
+
+// Stats counts the writes delayed by caps.
+type Stats struct {
+	// ThrottledBytes is the number of bytes of the writes that were delayed.
+	ThrottledBytes uint64
+	// ThrottledWrites is the number of writes that were delayed, counting
+	// each chunk of large writes separately.
+	ThrottledWrites uint64
+	// Delay is the total time writes were delayed by.
+	Delay time.Duration
+}
+
+func (s *Stats) add(n int, wait time.Duration) {
+	s.ThrottledBytes += uint64(n)
+	s.ThrottledWrites++
+	s.Delay += wait
+}
+
+// Limiter holds the bandwidth caps, in bytes per second, and the state of the
+// connections they're enforced on.
+type Limiter struct {
+	mu sync.Mutex
+
+	connLimit  int
+	peerLimits map[peer.ID]int
+	tagLimits  map[string]int
+	tags       func(peer.ID) []string
+
+	// the peers we're connected to.
+	peers map[peer.ID]*peerState
+	stats Stats
+
+	now func() time.Time
+}
+
+type peerState struct {
+	bucket
+	conns    int
+	resolved time.Time
+	stats    Stats
+}
+
+// NewLimiter constructs a new Limiter, without any caps. The tags of peers,
+// used for tag caps, are returned by the given function, e.g. ConnManagerTags.
+// It may be nil if tag caps aren't used.
+func NewLimiter(tags func(peer.ID) []string) *Limiter {
+	return &Limiter{
+		peerLimits: make(map[peer.ID]int),
+		tagLimits:  make(map[string]int),
+		tags:       tags,
+		peers:      make(map[peer.ID]*peerState),
+		now:        time.Now,
+	}
+}
+
+// ConnManagerTags returns the tags of peers in the given connection manager.
+func ConnManagerTags(cm connmgr.ConnManager) func(peer.ID) []string {
+	return func(p peer.ID) []string {
+		info := cm.GetTagInfo(p)
+		if info == nil {
+			return nil
+		}
+		tags := make([]string, 0, len(info.Tags))
+		for t := range info.Tags {
+			tags = append(tags, t)
+		}
+		return tags
+	}
+}
+
+// SetConnLimit caps the bandwidth of every connection, 0 to remove the cap.
+func (l *Limiter) SetConnLimit(bytesPerSec int) {
+	l.mu.Lock()
+	l.connLimit = bytesPerSec
+	l.mu.Unlock()
+}
+
+// SetPeerLimit caps the bandwidth of the given peer, over all of its
+// connections, 0 for no cap. A peer's own cap takes precedence over the caps of
+// its tags, e.g. to lift the cap of a newly discovered peer once it earned our
+// trust.
+func (l *Limiter) SetPeerLimit(p peer.ID, bytesPerSec int) {
+	l.mu.Lock()
+	l.peerLimits[p] = bytesPerSec
+	l.resolveLocked(p)
+	l.mu.Unlock()
+}
+
+// RemovePeerLimit removes the cap of the given peer, which falls back to the
+// caps of its tags.
+func (l *Limiter) RemovePeerLimit(p peer.ID) {
+	l.mu.Lock()
+	delete(l.peerLimits, p)
+	l.resolveLocked(p)
+	l.mu.Unlock()
+}
+
+// SetTagLimit caps the bandwidth of each peer carrying the given tag, over all
+// of its connections, 0 to remove the cap. Peers carrying several capped tags
+// get the lowest cap.
+func (l *Limiter) SetTagLimit(tag string, bytesPerSec int) {
+	l.mu.Lock()
+	if bytesPerSec > 0 {
+		l.tagLimits[tag] = bytesPerSec
+	} else {
+		delete(l.tagLimits, tag)
+	}
+	for p := range l.peers {
+		l.resolveLocked(p)
+	}
+	l.mu.Unlock()
+}
+
+// Stats returns the writes delayed by all caps.
+func (l *Limiter) Stats() Stats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.stats
+}
+
+// PeerStats returns the writes to the given peer delayed by caps, since we
+// connected to it.
+func (l *Limiter) PeerStats(p peer.ID) Stats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if ps, ok := l.peers[p]; ok {
+		return ps.stats
+	}
+	return Stats{}
+}
+
+// peerLimit returns the cap of the given peer, 0 if none. Must be called with
+// the mutex held.
+func (l *Limiter) peerLimit(p peer.ID) int {
+	if limit, ok := l.peerLimits[p]; ok {
+		return limit
+	}
+	if len(l.tagLimits) == 0 || l.tags == nil {
+		return 0
+	}
+	var limit int
+	for _, t := range l.tags(p) {
+		if tl, ok := l.tagLimits[t]; ok && (limit == 0 || tl < limit) {
+			limit = tl
+		}
+	}
+	return limit
+}
+
+// resolveLocked updates the cap of the given peer, if we're connected to it.
+func (l *Limiter) resolveLocked(p peer.ID) {
+	ps, ok := l.peers[p]
+	if !ok {
+		return
+	}
+	now := l.now()
+	ps.setRate(l.peerLimit(p), now)
+	ps.resolved = now
+}
+
+// reserve reserves n bytes of bandwidth on the given connection to p, and
+// returns how long to wait before sending them.
+func (l *Limiter) reserve(c *bucket, p peer.ID, n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	c.setRate(l.connLimit, now)
+	wait := c.take(n, now)
+	// the connection may be closed already, with its streams still writing.
+	ps, ok := l.peers[p]
+	if ok {
+		if now.Sub(ps.resolved) >= resolveInterval {
+			ps.setRate(l.peerLimit(p), now)
+			ps.resolved = now
+		}
+		if w := ps.take(n, now); w > wait {
+			wait = w
+		}
+	}
+	if wait > 0 {
+		l.stats.add(n, wait)
+		if ok {
+			ps.stats.add(n, wait)
+		}
+	}
+	return wait
+}
+
+func (l *Limiter) addConn(p peer.ID) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ps, ok := l.peers[p]
+	if !ok {
+		ps = &peerState{}
+		l.peers[p] = ps
+		l.resolveLocked(p)
+	}
+	ps.conns++
+}
+
+func (l *Limiter) removeConn(p peer.ID) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if ps, ok := l.peers[p]; ok {
+		ps.conns--
+		if ps.conns <= 0 {
+			delete(l.peers, p)
+		}
+	}
+}
+
+// Wrap wraps a stream muxer so that the streams of the connections it creates
+// are subject to our caps.
+func (l *Limiter) Wrap(m mux.Multiplexer) mux.Multiplexer {
+	return &multiplexer{Multiplexer: m, l: l}
+}
+
+type multiplexer struct {
+	mux.Multiplexer
+	l *Limiter
+}
+
+func (m *multiplexer) NewConn(c net.Conn, isServer bool) (mux.MuxedConn, error) {
+	mc, err := m.Multiplexer.NewConn(c, isServer)
+	if err != nil {
+		return nil, err
+	}
+	// the upgrader passes secure connections, which know their peer.
+	sc, ok := c.(interface{ RemotePeer() peer.ID })
+	if !ok {
+		log.Warnw("not capping the bandwidth of a connection of unknown peer", "addr", c.RemoteAddr())
+		return mc, nil
+	}
+	p := sc.RemotePeer()
+	m.l.addConn(p)
+	return &muxedConn{MuxedConn: mc, l: m.l, p: p}, nil
+}
+
+type muxedConn struct {
+	mux.MuxedConn
+	l *Limiter
+	p peer.ID
+
+	// guarded by the limiter's mutex.
+	bucket bucket
+
+	closeOnce sync.Once
+}
+
+func (c *muxedConn) Close() error {
+	c.closeOnce.Do(func() { c.l.removeConn(c.p) })
+	return c.MuxedConn.Close()
+}
+
+func (c *muxedConn) OpenStream(ctx context.Context) (mux.MuxedStream, error) {
+	s, err := c.MuxedConn.OpenStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return newStream(s, c), nil
+}
+
+func (c *muxedConn) AcceptStream() (mux.MuxedStream, error) {
+	s, err := c.MuxedConn.AcceptStream()
+	if err != nil {
+		return nil, err
+	}
+	return newStream(s, c), nil
+}
+
+type stream struct {
+	mux.MuxedStream
+	c *muxedConn
+
+	mu       sync.Mutex
+	deadline time.Time
+	// closed once the stream is closed for writing or reset, interrupting
+	// throttled writes.
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newStream(s mux.MuxedStream, c *muxedConn) *stream {
+	return &stream{MuxedStream: s, c: c, closed: make(chan struct{})}
+}
+
+func (s *stream) Write(b []byte) (int, error) {
+	var written int
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > maxChunk {
+			chunk = chunk[:maxChunk]
+		}
+		if err := s.throttle(len(chunk)); err != nil {
+			return written, err
+		}
+		n, err := s.MuxedStream.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// throttle waits until n bytes may be sent, failing if the write deadline
+// passes or the stream is closed in the meantime.
+func (s *stream) throttle(n int) error {
+	wait := s.c.l.reserve(&s.c.bucket, s.c.p, n)
+	if wait <= 0 {
+		return nil
+	}
+
+	var err error
+	s.mu.Lock()
+	deadline := s.deadline
+	s.mu.Unlock()
+	if !deadline.IsZero() {
+		if until := time.Until(deadline); until < wait {
+			wait, err = until, os.ErrDeadlineExceeded
+		}
+	}
+
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return err
+	case <-s.closed:
+		return mux.ErrReset
+	}
+}
+
+func (s *stream) close() {
+	s.closeOnce.Do(func() { close(s.closed) })
+}
+
+func (s *stream) Close() error {
+	s.close()
+	return s.MuxedStream.Close()
+}
+
+func (s *stream) CloseWrite() error {
+	s.close()
+	return s.MuxedStream.CloseWrite()
+}
+
+func (s *stream) Reset() error {
+	s.close()
+	return s.MuxedStream.Reset()
+}
+
+func (s *stream) SetDeadline(t time.Time) error {
+	s.setWriteDeadline(t)
+	return s.MuxedStream.SetDeadline(t)
+}
+
+func (s *stream) SetWriteDeadline(t time.Time) error {
+	s.setWriteDeadline(t)
+	return s.MuxedStream.SetWriteDeadline(t)
+}
+
+func (s *stream) setWriteDeadline(t time.Time) {
+	s.mu.Lock()
+	s.deadline = t
+	s.mu.Unlock()
+}
+
+// bucket is a token bucket refilled at a given rate, in bytes per second, up to
+// a burst of one second worth of bytes. Its tokens may go negative, when
+// reserving more than available: the bytes are sent once the bucket refilled.
+type bucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// setRate changes the rate of the bucket, 0 for no limit.
+func (b *bucket) setRate(bytesPerSec int, now time.Time) {
+	rate := float64(bytesPerSec)
+	if bytesPerSec <= 0 {
+		rate = 0
+	}
+	if rate == b.rate {
+		return
+	}
+	b.refill(now)
+	if b.rate == 0 {
+		// start with a full burst, as if we weren't sending anything.
+		b.tokens = rate
+	}
+	b.rate = rate
+	if b.tokens > rate {
+		b.tokens = rate
+	}
+}
+
+func (b *bucket) refill(now time.Time) {
+	if b.rate > 0 {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.rate {
+			b.tokens = b.rate
+		}
+	}
+	b.last = now
+}
+
+// take takes n tokens, and returns how long to wait for the bucket to be back
+// to 0 tokens.
+func (b *bucket) take(n int, now time.Time) time.Duration {
+	if b.rate == 0 {
+		b.last = now
+		return 0
+	}
+	b.refill(now)
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
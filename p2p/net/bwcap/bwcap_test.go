@@ -0,0 +1,143 @@
+package bwcap
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/mux"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/stretchr/testify/require"
+)
+
+// discardStream is a stream discarding what's written to it.
+type discardStream struct {
+	mux.MuxedStream
+}
+
+func (discardStream) Write(b []byte) (int, error)      { return ioutil.Discard.Write(b) }
+func (discardStream) Close() error                     { return nil }
+func (discardStream) Reset() error                     { return nil }
+func (discardStream) SetWriteDeadline(time.Time) error { return nil }
+
+type discardConn struct {
+	mux.MuxedConn
+}
+
+func (discardConn) Close() error { return nil }
+func (discardConn) OpenStream(context.Context) (mux.MuxedStream, error) {
+	return discardStream{}, nil
+}
+
+type discardMuxer struct{}
+
+func (discardMuxer) NewConn(net.Conn, bool) (mux.MuxedConn, error) { return discardConn{}, nil }
+
+// peerConn is a secure connection to a peer, as far as the muxer is concerned.
+type peerConn struct {
+	net.Conn
+	p peer.ID
+}
+
+func (c peerConn) RemotePeer() peer.ID { return c.p }
+
+func openStream(t *testing.T, l *Limiter, p peer.ID) (mux.MuxedConn, mux.MuxedStream) {
+	t.Helper()
+	c, err := l.Wrap(discardMuxer{}).NewConn(peerConn{p: p}, false)
+	require.NoError(t, err)
+	s, err := c.OpenStream(context.Background())
+	require.NoError(t, err)
+	return c, s
+}
+
+func TestBucket(t *testing.T) {
+	now := time.Now()
+	var b bucket
+	require.Zero(t, b.take(1<<20, now), "no limit")
+
+	b.setRate(1000, now)
+	require.Zero(t, b.take(1000, now), "full burst")
+	require.Equal(t, 500*time.Millisecond, b.take(500, now))
+	now = now.Add(time.Second)
+	require.Zero(t, b.take(500, now))
+
+	// the burst is capped at a second worth of bytes.
+	now = now.Add(time.Hour)
+	require.Equal(t, time.Second, b.take(2000, now))
+}
+
+func TestLimiterCaps(t *testing.T) {
+	const p = peer.ID("peer")
+	tags := map[peer.ID][]string{p: {"new", "other"}}
+	l := NewLimiter(func(p peer.ID) []string { return tags[p] })
+	now := time.Now()
+	l.now = func() time.Time { return now }
+
+	c, _ := openStream(t, l, p)
+	var conn bucket
+	require.Zero(t, l.reserve(&conn, p, 1<<20))
+
+	// the lowest cap of the peer's tags applies.
+	l.SetTagLimit("new", 1000)
+	l.SetTagLimit("other", 2000)
+	require.Zero(t, l.reserve(&conn, p, 1000))
+	require.Equal(t, time.Second, l.reserve(&conn, p, 1000))
+
+	// tag changes apply once the peer's cap is resolved again.
+	tags[p] = []string{"other"}
+	now = now.Add(resolveInterval)
+	require.Equal(t, 500*time.Millisecond, l.reserve(&conn, p, 1000))
+
+	// the peer's own cap takes precedence.
+	l.SetPeerLimit(p, 0)
+	require.Zero(t, l.reserve(&conn, p, 1<<20))
+	l.RemovePeerLimit(p)
+	require.NotZero(t, l.reserve(&conn, p, 1<<20))
+
+	// connection caps apply on top of peer caps.
+	l.SetPeerLimit(p, 0)
+	l.SetConnLimit(100)
+	require.Zero(t, l.reserve(&conn, p, 100))
+	require.Equal(t, time.Second, l.reserve(&conn, p, 100))
+
+	st := l.Stats()
+	require.Equal(t, uint64(4), st.ThrottledWrites)
+	require.Equal(t, st, l.PeerStats(p))
+
+	require.NoError(t, c.Close())
+	require.Empty(t, l.peers)
+}
+
+func TestStreamThrottled(t *testing.T) {
+	const p = peer.ID("peer")
+	l := NewLimiter(nil)
+	l.SetPeerLimit(p, 64<<10)
+	c, s := openStream(t, l, p)
+	defer c.Close()
+
+	start := time.Now()
+	n, err := s.Write(make([]byte, 96<<10))
+	require.NoError(t, err)
+	require.Equal(t, 96<<10, n)
+	require.GreaterOrEqual(t, int64(time.Since(start)), int64(400*time.Millisecond))
+	require.Equal(t, uint64(2), l.PeerStats(p).ThrottledWrites)
+
+	// throttled writes fail past the write deadline.
+	require.NoError(t, s.SetWriteDeadline(time.Now().Add(50*time.Millisecond)))
+	_, err = s.Write(make([]byte, 64<<10))
+	require.True(t, errors.Is(err, os.ErrDeadlineExceeded))
+	require.NoError(t, s.SetWriteDeadline(time.Time{}))
+
+	// and are interrupted by resets.
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		s.Reset()
+	}()
+	_, err = s.Write(make([]byte, 64<<10))
+	require.Equal(t, mux.ErrReset, err)
+}
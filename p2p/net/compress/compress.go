@@ -0,0 +1,176 @@
+// Package compress implements opt-in, negotiated compression for libp2p
+// streams.
+//
+// Compression is negotiated per protocol: a handler registered with
+// SetStreamHandler also listens on one "compressed" variant of the protocol ID
+// per configured Compressor (e.g. /my/proto/1.0.0/gzip). NewStream offers the
+// compressed variants first and falls back to the plain protocol ID when the
+// remote peer doesn't support any of them.
+//
+// Gzip and Zstd are built in. Other algorithms can be plugged in by
+// implementing Compressor.
+package compress
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+)
+
+// Compressor is a stream compression algorithm.
+type Compressor interface {
+	// Name identifies the algorithm. It's appended to the protocol ID to form
+	// the protocol ID of the compressed variant, so it must not contain
+	// slashes.
+	Name() string
+	// NewWriter returns a compressing writer wrapping w.
+	NewWriter(w io.Writer) (Writer, error)
+	// NewReader returns a decompressing reader wrapping r.
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+// Writer is a compressing writer. Flush must push all pending data to the
+// underlying writer so that the remote side can decompress it without waiting
+// for further writes.
+type Writer interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// Gzip is a gzip Compressor using the default compression level.
+var Gzip Compressor = GzipLevel(gzip.DefaultCompression)
+
+// GzipLevel returns a gzip Compressor using the given compression level.
+func GzipLevel(level int) Compressor {
+	return gzipCompressor{level: level}
+}
+
+type gzipCompressor struct {
+	level int
+}
+
+func (gzipCompressor) Name() string {
+	return "gzip"
+}
+
+// gzip writers are expensive to allocate, hundreds of KiB each, so we reuse
+// them, and the readers, across streams. Writers are pooled per level.
+var (
+	gzipWriters [gzip.BestCompression - gzip.HuffmanOnly + 1]sync.Pool
+	gzipReaders sync.Pool
+)
+
+func (c gzipCompressor) NewWriter(w io.Writer) (Writer, error) {
+	if c.level < gzip.HuffmanOnly || c.level > gzip.BestCompression {
+		return nil, fmt.Errorf("gzip: invalid compression level: %d", c.level)
+	}
+	p := &gzipWriters[c.level-gzip.HuffmanOnly]
+	gw, ok := p.Get().(*gzip.Writer)
+	if ok {
+		gw.Reset(w)
+	} else {
+		var err error
+		if gw, err = gzip.NewWriterLevel(w, c.level); err != nil {
+			return nil, err
+		}
+	}
+	return &pooledWriter{w: gw, put: func() {
+		// don't keep the stream alive while pooled.
+		gw.Reset(nil)
+		p.Put(gw)
+	}}, nil
+}
+
+func (gzipCompressor) NewReader(r io.Reader) (io.ReadCloser, error) {
+	gr, ok := gzipReaders.Get().(*gzip.Reader)
+	if !ok {
+		var err error
+		if gr, err = gzip.NewReader(r); err != nil {
+			return nil, err
+		}
+	} else if err := gr.Reset(r); err != nil {
+		gzipReaders.Put(gr)
+		return nil, err
+	}
+	return &pooledReader{r: gr, put: func() {
+		// don't keep the stream alive while pooled.
+		gr.Reset(eofReader{})
+		gzipReaders.Put(gr)
+	}}, nil
+}
+
+// eofReader is an empty reader. Resetting a gzip.Reader with it releases the
+// previous reader.
+type eofReader struct{}
+
+func (eofReader) Read([]byte) (int, error) { return 0, io.EOF }
+
+// ProtocolID returns the protocol ID of the variant of pid compressed with c.
+func ProtocolID(pid protocol.ID, c Compressor) protocol.ID {
+	return protocol.ID(strings.TrimSuffix(string(pid), "/") + "/" + c.Name())
+}
+
+// SetStreamHandler sets handler for the protocol pid on h, along with one
+// compressed variant of pid per given compressor. Streams negotiated on a
+// compressed variant are transparently decompressed/compressed before being
+// passed to handler.
+func SetStreamHandler(h host.Host, pid protocol.ID, handler network.StreamHandler, cs ...Compressor) {
+	for _, c := range cs {
+		c := c
+		h.SetStreamHandler(ProtocolID(pid, c), func(s network.Stream) {
+			cs, err := Wrap(s, c)
+			if err != nil {
+				log.Debugw("failed to set up stream compression", "protocol", s.Protocol(), "error", err)
+				s.Reset()
+				return
+			}
+			handler(cs)
+		})
+	}
+	h.SetStreamHandler(pid, handler)
+}
+
+// RemoveStreamHandler removes the handlers set by SetStreamHandler.
+func RemoveStreamHandler(h host.Host, pid protocol.ID, cs ...Compressor) {
+	for _, c := range cs {
+		h.RemoveStreamHandler(ProtocolID(pid, c))
+	}
+	h.RemoveStreamHandler(pid)
+}
+
+// NewStream opens a stream to p for the protocol pid, preferring the
+// compressed variants of pid in the order the compressors are given. If the
+// remote peer supports none of them, the stream is opened on pid without
+// compression.
+func NewStream(ctx context.Context, h host.Host, p peer.ID, pid protocol.ID, cs ...Compressor) (network.Stream, error) {
+	pids := make([]protocol.ID, 0, len(cs)+1)
+	for _, c := range cs {
+		pids = append(pids, ProtocolID(pid, c))
+	}
+	pids = append(pids, pid)
+
+	s, err := h.NewStream(ctx, p, pids...)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, c := range cs {
+		if s.Protocol() == ProtocolID(pid, c) {
+			cs, err := Wrap(s, c)
+			if err != nil {
+				s.Reset()
+				return nil, err
+			}
+			return cs, nil
+		}
+	}
+	return s, nil
+}
@@ -0,0 +1,291 @@
+package compress_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+
+	swarmt "github.com/libp2p/go-libp2p-swarm/testing"
+	bhost "github.com/libp2p/go-libp2p/p2p/host/basic"
+	"github.com/libp2p/go-libp2p/p2p/net/compress"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testProto = protocol.ID("/test/echo/1.0.0")
+
+func echo(s network.Stream) {
+	defer s.Close()
+	io.Copy(s, s)
+}
+
+func roundTrip(t *testing.T, s network.Stream, msg []byte) {
+	t.Helper()
+	_, err := s.Write(msg)
+	require.NoError(t, err)
+	require.NoError(t, s.CloseWrite())
+	resp, err := ioutil.ReadAll(s)
+	require.NoError(t, err)
+	require.Equal(t, msg, resp)
+}
+
+var compressors = []compress.Compressor{compress.Gzip, compress.Zstd}
+
+// forEachCompressor runs test as a subtest for each built in compressor.
+func forEachCompressor(t *testing.T, test func(t *testing.T, c compress.Compressor)) {
+	for _, c := range compressors {
+		c := c
+		t.Run(c.Name(), func(t *testing.T) { test(t, c) })
+	}
+}
+
+func TestCompressedStream(t *testing.T) {
+	forEachCompressor(t, func(t *testing.T, c compress.Compressor) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		h1 := bhost.New(swarmt.GenSwarm(t, ctx))
+		h2 := bhost.New(swarmt.GenSwarm(t, ctx))
+		defer h1.Close()
+		defer h2.Close()
+
+		compress.SetStreamHandler(h2, testProto, echo, c)
+		require.NoError(t, h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+
+		s, err := compress.NewStream(ctx, h1, h2.ID(), testProto, c)
+		require.NoError(t, err)
+		require.Equal(t, compress.ProtocolID(testProto, c), s.Protocol())
+
+		roundTrip(t, s, bytes.Repeat([]byte(`{"key": "value"}`), 1000))
+	})
+}
+
+func TestCompressorPreference(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := bhost.New(swarmt.GenSwarm(t, ctx))
+	h2 := bhost.New(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	defer h2.Close()
+
+	// the remote side only supports gzip.
+	compress.SetStreamHandler(h2, testProto, echo, compress.Gzip)
+	require.NoError(t, h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+
+	s, err := compress.NewStream(ctx, h1, h2.ID(), testProto, compress.Zstd, compress.Gzip)
+	require.NoError(t, err)
+	require.Equal(t, compress.ProtocolID(testProto, compress.Gzip), s.Protocol())
+
+	roundTrip(t, s, []byte("hello"))
+}
+
+func TestCompressionFallback(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := bhost.New(swarmt.GenSwarm(t, ctx))
+	h2 := bhost.New(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	defer h2.Close()
+
+	// the remote side doesn't support compression.
+	compress.SetStreamHandler(h2, testProto, echo)
+	require.NoError(t, h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+
+	s, err := compress.NewStream(ctx, h1, h2.ID(), testProto, compress.Gzip)
+	require.NoError(t, err)
+	require.Equal(t, testProto, s.Protocol())
+
+	roundTrip(t, s, []byte("hello"))
+}
+
+func TestCompressedStreamsReuseCompressors(t *testing.T) {
+	forEachCompressor(t, func(t *testing.T, c compress.Compressor) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		h1 := bhost.New(swarmt.GenSwarm(t, ctx))
+		h2 := bhost.New(swarmt.GenSwarm(t, ctx))
+		defer h1.Close()
+		defer h2.Close()
+
+		compress.SetStreamHandler(h2, testProto, echo, c)
+		require.NoError(t, h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+
+		// pooled compressors must not carry state over from previous streams.
+		for i := 0; i < 5; i++ {
+			s, err := compress.NewStream(ctx, h1, h2.ID(), testProto, c)
+			require.NoError(t, err)
+			roundTrip(t, s, bytes.Repeat([]byte{byte(i)}, 1000*(i+1)))
+			require.NoError(t, s.Close())
+		}
+	})
+}
+
+func TestCompressedStreamCloseRead(t *testing.T) {
+	forEachCompressor(t, func(t *testing.T, c compress.Compressor) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		h1 := bhost.New(swarmt.GenSwarm(t, ctx))
+		h2 := bhost.New(swarmt.GenSwarm(t, ctx))
+		defer h1.Close()
+		defer h2.Close()
+
+		received := make(chan []byte, 1)
+		compress.SetStreamHandler(h2, testProto, func(s network.Stream) {
+			defer s.Close()
+			b, _ := ioutil.ReadAll(s)
+			received <- b
+		}, c)
+		require.NoError(t, h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+
+		s, err := compress.NewStream(ctx, h1, h2.ID(), testProto, c)
+		require.NoError(t, err)
+		defer s.Close()
+
+		// we can still write after closing the stream for reading.
+		require.NoError(t, s.CloseRead())
+		_, err = s.Write([]byte("hello"))
+		require.NoError(t, err)
+		require.NoError(t, s.CloseWrite())
+		require.Equal(t, []byte("hello"), <-received)
+		_, err = s.Read(make([]byte, 1))
+		require.Error(t, err)
+	})
+}
+
+// compressed compresses msg with c.
+func compressed(t *testing.T, c compress.Compressor, msg []byte) *bytes.Buffer {
+	t.Helper()
+	var b bytes.Buffer
+	w, err := c.NewWriter(&b)
+	require.NoError(t, err)
+	_, err = w.Write(msg)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return &b
+}
+
+// checkCompressors checks that pooled compressors work, to catch state
+// handed to the pool while still in use.
+func checkCompressors(t *testing.T, c compress.Compressor) {
+	t.Helper()
+	for i := 0; i < 10; i++ {
+		msg := bytes.Repeat([]byte{byte(i)}, 100)
+		r, err := c.NewReader(compressed(t, c, msg))
+		require.NoError(t, err)
+		out, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		require.Equal(t, msg, out)
+		require.NoError(t, r.Close())
+	}
+}
+
+func TestReaderConcurrentClose(t *testing.T) {
+	forEachCompressor(t, func(t *testing.T, c compress.Compressor) {
+		pr, pw := io.Pipe()
+		w, err := c.NewWriter(pw)
+		require.NoError(t, err)
+		go func() {
+			w.Write([]byte("hello"))
+			w.Flush()
+		}()
+
+		r, err := c.NewReader(pr)
+		require.NoError(t, err)
+		buf := make([]byte, 5)
+		_, err = io.ReadFull(r, buf)
+		require.NoError(t, err)
+
+		// closing the reader while a read is blocked must not hand its state
+		// to other streams.
+		readErr := make(chan error, 1)
+		go func() {
+			_, err := r.Read(buf)
+			readErr <- err
+		}()
+		require.NoError(t, r.Close())
+		checkCompressors(t, c)
+
+		pw.CloseWithError(io.ErrUnexpectedEOF)
+		require.Error(t, <-readErr)
+		_, err = r.Read(buf)
+		require.Error(t, err)
+	})
+}
+
+func TestWriterConcurrentClose(t *testing.T) {
+	forEachCompressor(t, func(t *testing.T, c compress.Compressor) {
+		pr, pw := io.Pipe()
+		w, err := c.NewWriter(pw)
+		require.NoError(t, err)
+
+		// nobody reads the pipe: the write blocks.
+		writeErr := make(chan error, 1)
+		go func() {
+			_, err := w.Write([]byte("hello"))
+			if err == nil {
+				err = w.Flush()
+			}
+			writeErr <- err
+		}()
+		time.Sleep(10 * time.Millisecond)
+
+		// closing the writer while a write is blocked must not hand its state
+		// to other streams.
+		require.Error(t, w.Close())
+		checkCompressors(t, c)
+
+		pr.CloseWithError(io.ErrUnexpectedEOF)
+		require.Error(t, <-writeErr)
+		_, err = w.Write([]byte("hello"))
+		require.Equal(t, io.ErrClosedPipe, err)
+		require.Equal(t, io.ErrClosedPipe, w.Flush())
+		require.NoError(t, w.Close())
+	})
+}
+
+func BenchmarkGzip(b *testing.B) {
+	msg := bytes.Repeat([]byte(`{"key": "value"}`), 64)
+	var buf bytes.Buffer
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		w, err := compress.Gzip.NewWriter(&buf)
+		require.NoError(b, err)
+		w.Write(msg)
+		require.NoError(b, w.Close())
+
+		r, err := compress.Gzip.NewReader(&buf)
+		require.NoError(b, err)
+		io.Copy(ioutil.Discard, r)
+		require.NoError(b, r.Close())
+	}
+}
+
+func BenchmarkZstd(b *testing.B) {
+	msg := bytes.Repeat([]byte(`{"key": "value"}`), 64)
+	var buf bytes.Buffer
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		w, err := compress.Zstd.NewWriter(&buf)
+		require.NoError(b, err)
+		w.Write(msg)
+		require.NoError(b, w.Close())
+
+		r, err := compress.Zstd.NewReader(&buf)
+		require.NoError(b, err)
+		io.Copy(ioutil.Discard, r)
+		require.NoError(b, r.Close())
+	}
+}
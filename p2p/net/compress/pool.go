@@ -0,0 +1,162 @@
+package compress
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+var errClosed = errors.New("compressor closed")
+
+// errWriteInProgress is returned by Close when a Write or Flush is still in
+// progress: the compressed stream can't be terminated cleanly.
+var errWriteInProgress = errors.New("compressor closed during a write")
+
+// pooledWriter hands its Writer back to its pool when closed. Streams may be
+// closed while a write is blocked on the network, so the Writer is only
+// pooled once no Write or Flush is using it anymore.
+type pooledWriter struct {
+	// put resets the Writer and returns it to its pool.
+	put func()
+
+	mu sync.Mutex
+	w  Writer
+	// inflight counts the Write and Flush calls using w.
+	inflight int
+	closed   bool
+}
+
+// acquire returns the Writer for a Write or Flush, which must call release
+// once done with it.
+func (pw *pooledWriter) acquire() (Writer, error) {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	if pw.closed {
+		return nil, io.ErrClosedPipe
+	}
+	pw.inflight++
+	return pw.w, nil
+}
+
+func (pw *pooledWriter) release() {
+	pw.mu.Lock()
+	pw.inflight--
+	done := pw.closed && pw.inflight == 0 && pw.w != nil
+	if done {
+		pw.w = nil
+	}
+	pw.mu.Unlock()
+	if done {
+		pw.put()
+	}
+}
+
+func (pw *pooledWriter) Write(b []byte) (int, error) {
+	w, err := pw.acquire()
+	if err != nil {
+		return 0, err
+	}
+	defer pw.release()
+	return w.Write(b)
+}
+
+func (pw *pooledWriter) Flush() error {
+	w, err := pw.acquire()
+	if err != nil {
+		return err
+	}
+	defer pw.release()
+	return w.Flush()
+}
+
+func (pw *pooledWriter) Close() error {
+	pw.mu.Lock()
+	if pw.closed {
+		pw.mu.Unlock()
+		return nil
+	}
+	pw.closed = true
+	if pw.inflight > 0 {
+		// the last Write or Flush pools the writer.
+		pw.mu.Unlock()
+		return errWriteInProgress
+	}
+	w := pw.w
+	pw.w = nil
+	pw.mu.Unlock()
+
+	err := w.Close()
+	pw.put()
+	return err
+}
+
+// pooledReader hands its reader back to its pool once it read it to the end.
+// Streams are often closed to unblock a pending read, so Close may run
+// concurrently with Read: a reader closed before the end is never pooled, it
+// is dropped once no Read is using it anymore.
+type pooledReader struct {
+	// put resets the reader and returns it to its pool.
+	put func()
+	// drop, if set, releases the resources of a reader that won't be pooled.
+	drop func()
+
+	mu sync.Mutex
+	r  io.Reader
+	// inflight counts the Read calls using r.
+	inflight int
+	closed   bool
+}
+
+func (pr *pooledReader) Read(b []byte) (int, error) {
+	pr.mu.Lock()
+	if pr.closed {
+		pr.mu.Unlock()
+		return 0, errClosed
+	}
+	r := pr.r
+	if r == nil {
+		pr.mu.Unlock()
+		return 0, io.EOF
+	}
+	pr.inflight++
+	pr.mu.Unlock()
+
+	n, err := r.Read(b)
+
+	pr.mu.Lock()
+	pr.inflight--
+	var release func()
+	if pr.r != nil {
+		if err == io.EOF {
+			release = pr.put
+		} else if pr.closed && pr.inflight == 0 {
+			release = pr.drop
+		}
+	}
+	if release != nil {
+		pr.r = nil
+	}
+	pr.mu.Unlock()
+	if release != nil {
+		release()
+	}
+	return n, err
+}
+
+func (pr *pooledReader) Close() error {
+	pr.mu.Lock()
+	pr.closed = true
+	release := pr.drop
+	if pr.inflight > 0 || pr.r == nil {
+		// the last Read drops the reader.
+		release = nil
+	}
+	if release != nil {
+		pr.r = nil
+	}
+	pr.mu.Unlock()
+	if release != nil {
+		release()
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package compress
+
+import (
+	"io"
+	"sync"
+
+	"github.com/libp2p/go-libp2p-core/network"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+var log = logging.Logger("net/compress")
+
+// stream compresses everything written to the underlying stream and
+// decompresses everything read from it.
+type stream struct {
+	network.Stream
+
+	c Compressor
+	w Writer
+
+	// the reader is created lazily on the first read as constructing it
+	// blocks until the remote side has written the compression header. rmu
+	// guards r and rerr, as the stream may be closed concurrently with a
+	// read.
+	rmu  sync.Mutex
+	r    io.ReadCloser
+	rerr error
+}
+
+// Wrap wraps s so that all data written to it is compressed with c, and all
+// data read from it is decompressed with c. Both sides of the stream must
+// wrap it with the same compressor.
+func Wrap(s network.Stream, c Compressor) (network.Stream, error) {
+	w, err := c.NewWriter(s)
+	if err != nil {
+		return nil, err
+	}
+	return &stream{Stream: s, c: c, w: w}, nil
+}
+
+func (s *stream) Read(b []byte) (int, error) {
+	r, err := s.reader()
+	if err != nil {
+		return 0, err
+	}
+	return r.Read(b)
+}
+
+// reader returns the decompressing reader, creating it if needed.
+func (s *stream) reader() (io.ReadCloser, error) {
+	s.rmu.Lock()
+	r, err := s.r, s.rerr
+	s.rmu.Unlock()
+	if r != nil || err != nil {
+		return r, err
+	}
+	// don't hold the lock while blocked on the header.
+	r, err = s.c.NewReader(s.Stream)
+	s.rmu.Lock()
+	defer s.rmu.Unlock()
+	s.r, s.rerr = r, err
+	return r, err
+}
+
+// closeReader closes the decompressing reader, if created.
+func (s *stream) closeReader() {
+	s.rmu.Lock()
+	r := s.r
+	s.rmu.Unlock()
+	if r != nil {
+		_ = r.Close()
+	}
+}
+
+// Write compresses b and flushes it to the underlying stream, so that every
+// write can be decompressed by the remote side on its own.
+func (s *stream) Write(b []byte) (int, error) {
+	n, err := s.w.Write(b)
+	if err != nil {
+		return n, err
+	}
+	return n, s.w.Flush()
+}
+
+func (s *stream) CloseWrite() error {
+	if err := s.w.Close(); err != nil {
+		s.Stream.Reset()
+		return err
+	}
+	return s.Stream.CloseWrite()
+}
+
+func (s *stream) CloseRead() error {
+	s.closeReader()
+	return s.Stream.CloseRead()
+}
+
+func (s *stream) Close() error {
+	if err := s.w.Close(); err != nil {
+		s.Stream.Reset()
+		return err
+	}
+	s.closeReader()
+	return s.Stream.Close()
+}
@@ -0,0 +1,110 @@
+package compress
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Zstd is a zstd Compressor using the default compression level.
+var Zstd Compressor = ZstdLevel(zstd.SpeedDefault)
+
+// ZstdLevel returns a zstd Compressor using the given compression level.
+func ZstdLevel(level zstd.EncoderLevel) Compressor {
+	return zstdCompressor{level: level}
+}
+
+type zstdCompressor struct {
+	level zstd.EncoderLevel
+}
+
+func (zstdCompressor) Name() string {
+	return "zstd"
+}
+
+const (
+	// zstdWindowSize is the window size of our encoders. Streams carry small
+	// messages, a larger window costs memory without compressing better.
+	zstdWindowSize = 1 << 20
+	// zstdMaxWindowSize is the largest window size we accept from remote
+	// encoders, the one the zstd specification recommends decoders support.
+	zstdMaxWindowSize = 8 << 20
+	// zstdMaxIdleDecoders bounds the number of pooled decoders.
+	zstdMaxIdleDecoders = 16
+)
+
+// zstd encoders are pooled per level, like gzip writers. Decoders keep a
+// goroutine running until closed, which a sync.Pool would leak: we keep a
+// bounded number of idle ones and close the others.
+var (
+	zstdEncoders [zstd.SpeedBestCompression + 1]sync.Pool
+	zstdDecoders = make(chan *zstd.Decoder, zstdMaxIdleDecoders)
+)
+
+func (c zstdCompressor) NewWriter(w io.Writer) (Writer, error) {
+	if c.level < zstd.SpeedFastest || c.level > zstd.SpeedBestCompression {
+		return nil, fmt.Errorf("zstd: invalid compression level: %d", c.level)
+	}
+	p := &zstdEncoders[c.level]
+	enc, ok := p.Get().(*zstd.Encoder)
+	if ok {
+		enc.Reset(w)
+	} else {
+		var err error
+		enc, err = zstd.NewWriter(w,
+			zstd.WithEncoderLevel(c.level),
+			zstd.WithEncoderConcurrency(1),
+			zstd.WithWindowSize(zstdWindowSize),
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &pooledWriter{w: enc, put: func() {
+		// don't keep the stream alive while pooled.
+		enc.Reset(nil)
+		p.Put(enc)
+	}}, nil
+}
+
+func (zstdCompressor) NewReader(r io.Reader) (io.ReadCloser, error) {
+	var dec *zstd.Decoder
+	select {
+	case dec = <-zstdDecoders:
+		if err := dec.Reset(r); err != nil {
+			putZstdDecoder(dec)
+			return nil, err
+		}
+	default:
+		var err error
+		dec, err = zstd.NewReader(r,
+			zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderMaxWindow(zstdMaxWindowSize),
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &pooledReader{
+		r:   dec,
+		put: func() { putZstdDecoder(dec) },
+		// the decoder may be blocked reading the stream, and so Close until
+		// the stream is closed.
+		drop: func() { go dec.Close() },
+	}, nil
+}
+
+func putZstdDecoder(dec *zstd.Decoder) {
+	// don't keep the stream alive while pooled.
+	if err := dec.Reset(nil); err != nil {
+		dec.Close()
+		return
+	}
+	select {
+	case zstdDecoders <- dec:
+	default:
+		dec.Close()
+	}
+}
@@ -0,0 +1,83 @@
+package connmetrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// EvtRemoteAddrChanged is emitted on the host's event bus when the remote
+// address of a live connection changes, e.g. after a QUIC connection migrated
+// or a NAT rebound the remote peer's port. Subscribe to it to keep per-IP
+// accounting accurate over connection lifetimes. See DetectAddrChanges.
+type EvtRemoteAddrChanged struct {
+	Peer peer.ID
+	Conn network.Conn
+	// Old is the remote address we knew the connection by, and New its
+	// current remote address.
+	Old, New ma.Multiaddr
+}
+
+// DetectAddrChanges checks the remote addresses of the open connections at
+// the given interval, updating ConnInfo.RemoteAddr and emitting an
+// EvtRemoteAddrChanged for every change. Transports don't signal changes, so
+// we can only notice them when checking. By default, remote addresses are only
+// checked when calling Tracker.CheckAddrs.
+func DetectAddrChanges(interval time.Duration) Option {
+	return func(cfg *config) {
+		cfg.addrCheckInterval = interval
+	}
+}
+
+// CheckAddrs checks the remote addresses of the open connections for changes
+// right away, see DetectAddrChanges. It returns the number of changes.
+func (t *Tracker) CheckAddrs() int {
+	type change struct {
+		evt       EvtRemoteAddrChanged
+		direction network.Direction
+	}
+	var changes []change
+
+	t.mu.Lock()
+	for c, ci := range t.open {
+		addr := c.RemoteMultiaddr()
+		if addr == nil || (ci.RemoteAddr != nil && ci.RemoteAddr.Equal(addr)) {
+			continue
+		}
+		changes = append(changes, change{
+			evt:       EvtRemoteAddrChanged{Peer: ci.Peer, Conn: c, Old: ci.RemoteAddr, New: addr},
+			direction: ci.Direction,
+		})
+		ci.RemoteAddr = addr
+		ci.AddrChanges++
+	}
+	t.mu.Unlock()
+
+	for _, ch := range changes {
+		log.Debugw("connection remote address changed", "peer", ch.evt.Peer, "old", ch.evt.Old, "new", ch.evt.New)
+		t.addrChanges.WithLabelValues(ch.direction.String()).Inc()
+		if t.emitter != nil {
+			t.emitter.Emit(ch.evt)
+		}
+	}
+	return len(changes)
+}
+
+func (t *Tracker) checkAddrsLoop(ctx context.Context, interval time.Duration) {
+	defer t.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.CheckAddrs()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
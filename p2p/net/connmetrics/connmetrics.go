@@ -0,0 +1,352 @@
+// Package connmetrics tracks how long connections live and why they closed,
+// exporting both as Prometheus metrics and, for individual connections, through
+// an introspection API.
+package connmetrics
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/event"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/libp2p/go-libp2p/p2p/host/peerlabel"
+
+	logging "github.com/ipfs/go-log/v2"
+
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var log = logging.Logger("net/connmetrics")
+
+// CloseReason is the reason a connection closed.
+type CloseReason string
+
+const (
+	// ReasonLocal is a connection we closed.
+	ReasonLocal CloseReason = "local"
+	// ReasonRemote is a connection the remote peer closed.
+	ReasonRemote CloseReason = "remote"
+	// ReasonReset is a connection that was reset, e.g. by a middlebox.
+	ReasonReset CloseReason = "reset"
+	// ReasonConnMgr is a connection trimmed by the connection manager.
+	ReasonConnMgr CloseReason = "connmgr"
+	// ReasonResourceLimit is a connection closed for exceeding a resource
+	// limit.
+	ReasonResourceLimit CloseReason = "resource_limit"
+	// ReasonError is a connection closed after an error. The error is
+	// classified further, see ErrorClass.
+	ReasonError CloseReason = "error"
+	// ReasonUnknown is a connection closed without a known reason.
+	ReasonUnknown CloseReason = "unknown"
+)
+
+// ErrorClass returns a coarse class of err, suitable as a metrics label:
+// "timeout", "canceled", "eof", "conn_reset", or "other". It returns "" for a
+// nil error.
+func ErrorClass(err error) string {
+	var ne net.Error
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &ne) && ne.Timeout():
+		return "timeout"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "eof"
+	case errors.Is(err, syscall.ECONNRESET):
+		return "conn_reset"
+	default:
+		return "other"
+	}
+}
+
+// ConnInfo describes a connection tracked by the Tracker.
+type ConnInfo struct {
+	Peer       peer.ID
+	RemoteAddr ma.Multiaddr
+	Direction  network.Direction
+	Opened     time.Time
+	// Label is the peer's label, see the peerlabel package.
+	Label string
+
+	// AddrChanges is the number of times RemoteAddr changed while the
+	// connection was open, see DetectAddrChanges.
+	AddrChanges int
+	// Closed is the zero time while the connection is open.
+	Closed time.Time
+	// Reason is the reason the connection closed, or is about to close if
+	// one was recorded with SetCloseReason.
+	Reason CloseReason
+	// Err is the error that caused the connection to close, if any.
+	Err error
+}
+
+// Lifetime returns how long the connection has been, or was, open.
+func (ci ConnInfo) Lifetime() time.Duration {
+	if ci.Closed.IsZero() {
+		return time.Since(ci.Opened)
+	}
+	return ci.Closed.Sub(ci.Opened)
+}
+
+type config struct {
+	registerer     prometheus.Registerer
+	recentlyClosed int
+	labelPeers     bool
+
+	addrCheckInterval time.Duration
+}
+
+// Option is an option for the Tracker.
+type Option func(*config)
+
+// Registerer registers the Tracker's metrics with the given registerer,
+// instead of prometheus.DefaultRegisterer.
+func Registerer(r prometheus.Registerer) Option {
+	return func(cfg *config) {
+		cfg.registerer = r
+	}
+}
+
+// RecentlyClosed sets the number of closed connections kept for
+// introspection. Defaults to 128.
+func RecentlyClosed(n int) Option {
+	return func(cfg *config) {
+		cfg.recentlyClosed = n
+	}
+}
+
+// LabelPeers adds a "peer" label to the metrics, set to the label of the
+// remote peer, see the peerlabel package. Unlabeled peers share the empty
+// label, so this is safe as long as only a bounded set of peers is labeled.
+func LabelPeers() Option {
+	return func(cfg *config) {
+		cfg.labelPeers = true
+	}
+}
+
+// Tracker tracks the lifetime of a host's connections.
+//
+// The network doesn't tell us why a connection closed, so code closing
+// connections should record the reason with SetCloseReason, or close them
+// with CloseConn. Connections closed while the network shuts down are recorded as
+// ReasonLocal, any other connection without a recorded reason as
+// ReasonUnknown.
+type Tracker struct {
+	host host.Host
+	cfg  config
+
+	lifetimes   *prometheus.HistogramVec
+	closed      *prometheus.CounterVec
+	addrChanges *prometheus.CounterVec
+
+	emitter event.Emitter
+
+	mu     sync.Mutex
+	open   map[network.Conn]*ConnInfo
+	recent []ConnInfo
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewTracker constructs a new Tracker for the connections of the given host,
+// registering its metrics. Connections opened before the tracker was created
+// aren't tracked.
+func NewTracker(h host.Host, opts ...Option) (*Tracker, error) {
+	cfg := config{
+		registerer:     prometheus.DefaultRegisterer,
+		recentlyClosed: 128,
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	lifetimeLabels := []string{"direction", "reason"}
+	closedLabels := []string{"direction", "reason", "error_class"}
+	if cfg.labelPeers {
+		lifetimeLabels = append(lifetimeLabels, "peer")
+		closedLabels = append(closedLabels, "peer")
+	}
+
+	t := &Tracker{
+		host: h,
+		cfg:  cfg,
+		lifetimes: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "libp2p_connection_lifetime_seconds",
+			Help:    "libp2p connection lifetimes",
+			Buckets: prometheus.ExponentialBuckets(0.1, 2, 24), // 100ms to ~10 days
+		}, lifetimeLabels),
+		closed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "libp2p_connections_closed_total",
+			Help: "libp2p connections closed",
+		}, closedLabels),
+		addrChanges: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "libp2p_connection_remote_addr_changes_total",
+			Help: "Remote address changes of live libp2p connections",
+		}, []string{"direction"}),
+		open: make(map[network.Conn]*ConnInfo),
+	}
+	collectors := []prometheus.Collector{t.lifetimes, t.closed, t.addrChanges}
+	for i, c := range collectors {
+		if err := cfg.registerer.Register(c); err != nil {
+			for _, c := range collectors[:i] {
+				cfg.registerer.Unregister(c)
+			}
+			return nil, err
+		}
+	}
+
+	var err error
+	t.emitter, err = h.EventBus().Emitter(&EvtRemoteAddrChanged{})
+	if err != nil {
+		log.Warnf("not emitting remote address changes; err: %s", err)
+	}
+
+	h.Network().Notify((*notifiee)(t))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.cancel = cancel
+	if cfg.addrCheckInterval > 0 {
+		t.wg.Add(1)
+		go t.checkAddrsLoop(ctx, cfg.addrCheckInterval)
+	}
+	return t, nil
+}
+
+// Close stops tracking connections and unregisters the metrics.
+func (t *Tracker) Close() error {
+	t.cancel()
+	t.wg.Wait()
+	t.host.Network().StopNotify((*notifiee)(t))
+	t.cfg.registerer.Unregister(t.lifetimes)
+	t.cfg.registerer.Unregister(t.closed)
+	t.cfg.registerer.Unregister(t.addrChanges)
+	if t.emitter != nil {
+		t.emitter.Close()
+	}
+	return nil
+}
+
+// SetCloseReason records why the given connection is about to be closed. Call
+// it before closing the connection. err may be nil.
+func (t *Tracker) SetCloseReason(c network.Conn, reason CloseReason, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if ci, ok := t.open[c]; ok {
+		ci.Reason = reason
+		ci.Err = err
+	}
+}
+
+// CloseConn records the reason and closes the given connection.
+func (t *Tracker) CloseConn(c network.Conn, reason CloseReason, err error) error {
+	t.SetCloseReason(c, reason, err)
+	return c.Close()
+}
+
+// Conn returns information about the given open connection.
+func (t *Tracker) Conn(c network.Conn) (ConnInfo, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ci, ok := t.open[c]
+	if !ok {
+		return ConnInfo{}, false
+	}
+	return *ci, true
+}
+
+// Conns returns information about all open connections.
+func (t *Tracker) Conns() []ConnInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make([]ConnInfo, 0, len(t.open))
+	for _, ci := range t.open {
+		out = append(out, *ci)
+	}
+	return out
+}
+
+// RecentlyClosed returns information about the most recently closed
+// connections, oldest first.
+func (t *Tracker) RecentlyClosed() []ConnInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]ConnInfo(nil), t.recent...)
+}
+
+func (t *Tracker) connected(c network.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.open[c] = &ConnInfo{
+		Peer:       c.RemotePeer(),
+		Label:      peerlabel.Get(t.host.Peerstore(), c.RemotePeer()),
+		RemoteAddr: c.RemoteMultiaddr(),
+		Direction:  c.Stat().Direction,
+		Opened:     time.Now(),
+	}
+}
+
+func (t *Tracker) disconnected(n network.Network, c network.Conn) {
+	t.mu.Lock()
+	ci, ok := t.open[c]
+	if !ok {
+		t.mu.Unlock()
+		return
+	}
+	delete(t.open, c)
+	ci.Closed = time.Now()
+	// the label may have been set after the peer connected.
+	ci.Label = peerlabel.Get(t.host.Peerstore(), ci.Peer)
+	if ci.Reason == "" {
+		ci.Reason = ReasonUnknown
+		// connections are closed when the network shuts down.
+		if nc, ok := n.(interface{ Context() context.Context }); ok && nc.Context().Err() != nil {
+			ci.Reason = ReasonLocal
+		}
+	}
+	if t.cfg.recentlyClosed > 0 {
+		if len(t.recent) >= t.cfg.recentlyClosed {
+			t.recent = append(t.recent[:0], t.recent[1:]...)
+		}
+		t.recent = append(t.recent, *ci)
+	}
+	t.mu.Unlock()
+
+	lifetimeLabels := []string{ci.Direction.String(), string(ci.Reason)}
+	closedLabels := []string{ci.Direction.String(), string(ci.Reason), ErrorClass(ci.Err)}
+	if t.cfg.labelPeers {
+		lifetimeLabels = append(lifetimeLabels, ci.Label)
+		closedLabels = append(closedLabels, ci.Label)
+	}
+	t.lifetimes.WithLabelValues(lifetimeLabels...).Observe(ci.Lifetime().Seconds())
+	t.closed.WithLabelValues(closedLabels...).Inc()
+	log.Debugw("connection closed", "peer", ci.Peer, "label", ci.Label, "addr", ci.RemoteAddr, "reason", ci.Reason, "lifetime", ci.Lifetime())
+}
+
+type notifiee Tracker
+
+var _ network.Notifiee = (*notifiee)(nil)
+
+func (n *notifiee) Connected(_ network.Network, c network.Conn) {
+	(*Tracker)(n).connected(c)
+}
+
+func (n *notifiee) Disconnected(nw network.Network, c network.Conn) {
+	(*Tracker)(n).disconnected(nw, c)
+}
+
+func (n *notifiee) OpenedStream(network.Network, network.Stream) {}
+func (n *notifiee) ClosedStream(network.Network, network.Stream) {}
+func (n *notifiee) Listen(network.Network, ma.Multiaddr)         {}
+func (n *notifiee) ListenClose(network.Network, ma.Multiaddr)    {}
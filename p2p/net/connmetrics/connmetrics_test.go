@@ -0,0 +1,179 @@
+package connmetrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/libp2p/go-libp2p/p2p/host/peerlabel"
+
+	blhost "github.com/libp2p/go-libp2p-blankhost"
+	swarmt "github.com/libp2p/go-libp2p-swarm/testing"
+
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestErrorClass(t *testing.T) {
+	require.Equal(t, "", ErrorClass(nil))
+	require.Equal(t, "timeout", ErrorClass(fmt.Errorf("read: %w", context.DeadlineExceeded)))
+	require.Equal(t, "canceled", ErrorClass(context.Canceled))
+	require.Equal(t, "eof", ErrorClass(io.ErrUnexpectedEOF))
+	require.Equal(t, "other", ErrorClass(errors.New("boom")))
+}
+
+func TestTracker(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	defer h2.Close()
+
+	reg := prometheus.NewRegistry()
+	tr, err := NewTracker(h1, Registerer(reg), RecentlyClosed(1))
+	require.NoError(t, err)
+	defer tr.Close()
+
+	// registering twice fails.
+	_, err = NewTracker(h1, Registerer(reg))
+	require.Error(t, err)
+
+	connect := func() network.Conn {
+		require.NoError(t, h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+		c := h1.Network().ConnsToPeer(h2.ID())[0]
+		ci, ok := tr.Conn(c)
+		require.True(t, ok)
+		require.Equal(t, h2.ID(), ci.Peer)
+		require.Equal(t, network.DirOutbound, ci.Direction)
+		require.True(t, ci.Closed.IsZero())
+		require.Len(t, tr.Conns(), 1)
+		return c
+	}
+	waitClosed := func() {
+		require.Eventually(t, func() bool { return len(tr.Conns()) == 0 }, 5*time.Second, 10*time.Millisecond)
+	}
+
+	timeoutErr := fmt.Errorf("ping: %w", context.DeadlineExceeded)
+	require.NoError(t, tr.CloseConn(connect(), ReasonError, timeoutErr))
+	waitClosed()
+	require.Equal(t, 1.0, testutil.ToFloat64(tr.closed.WithLabelValues("Outbound", "error", "timeout")))
+
+	c := connect()
+	tr.SetCloseReason(c, ReasonConnMgr, nil)
+	require.NoError(t, c.Close())
+	waitClosed()
+	require.Equal(t, 1.0, testutil.ToFloat64(tr.closed.WithLabelValues("Outbound", "connmgr", "")))
+
+	// only the most recently closed connection is kept.
+	recent := tr.RecentlyClosed()
+	require.Len(t, recent, 1)
+	require.Equal(t, ReasonConnMgr, recent[0].Reason)
+	require.False(t, recent[0].Closed.IsZero())
+	require.Equal(t, recent[0].Closed.Sub(recent[0].Opened), recent[0].Lifetime())
+
+	// closed by the remote peer, we don't know why.
+	connect()
+	require.NoError(t, h2.Network().ClosePeer(h1.ID()))
+	waitClosed()
+	require.Equal(t, ReasonUnknown, tr.RecentlyClosed()[0].Reason)
+
+	require.Equal(t, 3, testutil.CollectAndCount(tr.lifetimes))
+}
+
+func TestTrackerLabelPeers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	defer h2.Close()
+
+	tr, err := NewTracker(h1, Registerer(prometheus.NewRegistry()), LabelPeers())
+	require.NoError(t, err)
+	defer tr.Close()
+
+	require.NoError(t, h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+	require.NoError(t, peerlabel.Set(h1.Peerstore(), h2.ID(), "bootstrap-eu-1"))
+	require.NoError(t, tr.CloseConn(h1.Network().ConnsToPeer(h2.ID())[0], ReasonLocal, nil))
+	require.Eventually(t, func() bool { return len(tr.Conns()) == 0 }, 5*time.Second, 10*time.Millisecond)
+
+	require.Equal(t, "bootstrap-eu-1", tr.RecentlyClosed()[0].Label)
+	require.Equal(t, 1.0, testutil.ToFloat64(tr.closed.WithLabelValues("Outbound", "local", "", "bootstrap-eu-1")))
+}
+
+// migratingConn is a connection whose remote address can change.
+type migratingConn struct {
+	network.Conn
+	mu   sync.Mutex
+	addr ma.Multiaddr
+}
+
+func (c *migratingConn) RemoteMultiaddr() ma.Multiaddr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.addr
+}
+
+func (c *migratingConn) migrate(addr ma.Multiaddr) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.addr = addr
+}
+
+func TestTrackerAddrChanges(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	defer h2.Close()
+
+	tr, err := NewTracker(h1, Registerer(prometheus.NewRegistry()), DetectAddrChanges(10*time.Millisecond))
+	require.NoError(t, err)
+	defer tr.Close()
+
+	sub, err := h1.EventBus().Subscribe(new(EvtRemoteAddrChanged))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	require.NoError(t, h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+	c := &migratingConn{Conn: h1.Network().ConnsToPeer(h2.ID())[0]}
+	c.migrate(c.Conn.RemoteMultiaddr())
+	(*notifiee)(tr).Connected(h1.Network(), c)
+	require.Zero(t, tr.CheckAddrs())
+
+	old := c.RemoteMultiaddr()
+	migrated := ma.StringCast("/ip4/192.0.2.1/udp/4001/quic")
+	c.migrate(migrated)
+
+	select {
+	case e := <-sub.Out():
+		evt := e.(EvtRemoteAddrChanged)
+		require.Equal(t, h2.ID(), evt.Peer)
+		require.Equal(t, c, evt.Conn)
+		require.True(t, evt.Old.Equal(old))
+		require.True(t, evt.New.Equal(migrated))
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a remote address change event")
+	}
+
+	ci, ok := tr.Conn(c)
+	require.True(t, ok)
+	require.True(t, ci.RemoteAddr.Equal(migrated))
+	require.Equal(t, 1, ci.AddrChanges)
+	require.Equal(t, 1.0, testutil.ToFloat64(tr.addrChanges.WithLabelValues("Outbound")))
+	require.Zero(t, tr.CheckAddrs())
+}
@@ -0,0 +1,193 @@
+// Package halfclose implements request/response exchanges over streams with
+// half-close semantics: the requester writes its request and closes the stream
+// for writing, the responder reads the request until EOF, writes its response
+// and closes the stream, and the requester reads the response until EOF.
+//
+// Closing a stream doesn't wait for the remote side to read what we wrote, nor
+// for it to close its side. Protocols waiting for the remote side to close the
+// stream before closing theirs, as the deprecated helpers.FullClose does,
+// deadlock when both sides wait on each other. Closing the stream for writing
+// once done writing, and reading until EOF, avoids it.
+package halfclose
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+var log = logging.Logger("net/halfclose")
+
+// ErrTooLarge is returned when reading a request or response larger than
+// allowed.
+var ErrTooLarge = errors.New("message too large")
+
+// ErrUnexpectedData is returned by CloseAndAwaitEOF when the remote side writes
+// to the stream instead of closing it.
+var ErrUnexpectedData = errors.New("unexpected data while awaiting EOF")
+
+// Request sends a request on the given stream, closes it for writing, and
+// reads the response until the remote side closes the stream, up to max bytes,
+// 0 for no limit. The stream is closed once the response is read, and reset on
+// error. Cancelling the context aborts the exchange.
+func Request(ctx context.Context, s network.Stream, req []byte, max int) ([]byte, error) {
+	stop := watch(ctx, s)
+	resp, err := request(s, req, max)
+	if !stop() {
+		return nil, ctx.Err()
+	}
+	return resp, err
+}
+
+func request(s network.Stream, req []byte, max int) ([]byte, error) {
+	if _, err := s.Write(req); err != nil {
+		_ = s.Reset()
+		return nil, err
+	}
+	if err := s.CloseWrite(); err != nil {
+		_ = s.Reset()
+		return nil, err
+	}
+	resp, err := readAll(s, max)
+	if err != nil {
+		_ = s.Reset()
+		return nil, err
+	}
+	return resp, s.Close()
+}
+
+// RoundTrip opens a stream to the given peer, on the first of the given
+// protocols it supports, and sends a request on it, see Request.
+func RoundTrip(ctx context.Context, h host.Host, p peer.ID, req []byte, max int, pids ...protocol.ID) ([]byte, error) {
+	s, err := h.NewStream(ctx, p, pids...)
+	if err != nil {
+		return nil, err
+	}
+	return Request(ctx, s, req, max)
+}
+
+// ReadRequest reads a request from the given stream until the remote side
+// closes it for writing, up to max bytes, 0 for no limit. The stream is reset
+// on error.
+func ReadRequest(s network.Stream, max int) ([]byte, error) {
+	req, err := readAll(s, max)
+	if err != nil {
+		_ = s.Reset()
+		return nil, err
+	}
+	return req, nil
+}
+
+// Respond writes the response to a request and closes the stream, resetting
+// it on error.
+func Respond(s network.Stream, resp []byte) error {
+	if _, err := s.Write(resp); err != nil {
+		_ = s.Reset()
+		return err
+	}
+	return s.Close()
+}
+
+// Handler returns a stream handler serving requests with the given function:
+// it reads requests of up to maxReq bytes, 0 for no limit, and responds with
+// what f returns. Streams are reset if reading the request or f fails.
+func Handler(maxReq int, f func(s network.Stream, req []byte) ([]byte, error)) network.StreamHandler {
+	return func(s network.Stream) {
+		req, err := ReadRequest(s, maxReq)
+		if err != nil {
+			log.Debugw("failed to read request", "protocol", s.Protocol(), "peer", s.Conn().RemotePeer(), "error", err)
+			return
+		}
+		resp, err := f(s, req)
+		if err != nil {
+			log.Debugw("failed to handle request", "protocol", s.Protocol(), "peer", s.Conn().RemotePeer(), "error", err)
+			_ = s.Reset()
+			return
+		}
+		if err := Respond(s, resp); err != nil {
+			log.Debugw("failed to respond", "protocol", s.Protocol(), "peer", s.Conn().RemotePeer(), "error", err)
+		}
+	}
+}
+
+// CloseAndAwaitEOF closes the stream for writing, and waits up to the given
+// timeout for the remote side to close it as well, to know it received
+// everything we wrote. It's for protocols where the remote side acknowledges
+// our messages by closing the stream, and doesn't write anything more: the
+// stream is reset if it does, or if it doesn't close the stream in time.
+func CloseAndAwaitEOF(s network.Stream, timeout time.Duration) error {
+	if err := s.CloseWrite(); err != nil {
+		_ = s.Reset()
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	stop := watch(ctx, s)
+	var (
+		n   int
+		err error
+	)
+	for n == 0 && err == nil {
+		n, err = s.Read([]byte{0})
+	}
+	if !stop() {
+		return ctx.Err()
+	}
+	switch {
+	case n > 0:
+		_ = s.Reset()
+		return ErrUnexpectedData
+	case err == io.EOF:
+		return s.Close()
+	default:
+		_ = s.Reset()
+		return err
+	}
+}
+
+// readAll reads r until EOF, up to max bytes, 0 for no limit.
+func readAll(r io.Reader, max int) ([]byte, error) {
+	if max <= 0 {
+		return ioutil.ReadAll(r)
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(r, int64(max)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > max {
+		return nil, ErrTooLarge
+	}
+	return b, nil
+}
+
+// watch resets the stream if the context is done before the returned
+// function is called. The function returns false if the stream was reset.
+func watch(ctx context.Context, s network.Stream) (stop func() bool) {
+	if ctx.Done() == nil {
+		return func() bool { return true }
+	}
+	done := make(chan struct{})
+	reset := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = s.Reset()
+			reset <- true
+		case <-done:
+			reset <- false
+		}
+	}()
+	return func() bool {
+		close(done)
+		return !<-reset
+	}
+}
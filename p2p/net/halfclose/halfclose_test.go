@@ -0,0 +1,116 @@
+package halfclose_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+
+	swarmt "github.com/libp2p/go-libp2p-swarm/testing"
+	bhost "github.com/libp2p/go-libp2p/p2p/host/basic"
+	"github.com/libp2p/go-libp2p/p2p/net/halfclose"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testProto = protocol.ID("/test/upper/1.0.0")
+
+func newHosts(t *testing.T, ctx context.Context) (*bhost.BasicHost, *bhost.BasicHost) {
+	h1 := bhost.New(swarmt.GenSwarm(t, ctx))
+	h2 := bhost.New(swarmt.GenSwarm(t, ctx))
+	t.Cleanup(func() {
+		h1.Close()
+		h2.Close()
+	})
+	require.NoError(t, h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+	return h1, h2
+}
+
+func TestRoundTrip(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h1, h2 := newHosts(t, ctx)
+
+	h2.SetStreamHandler(testProto, halfclose.Handler(16, func(s network.Stream, req []byte) ([]byte, error) {
+		if len(req) == 0 {
+			return nil, errors.New("empty request")
+		}
+		return bytes.ToUpper(req), nil
+	}))
+
+	resp, err := halfclose.RoundTrip(ctx, h1, h2.ID(), []byte("hello"), 16, testProto)
+	require.NoError(t, err)
+	require.Equal(t, []byte("HELLO"), resp)
+
+	// the handler refuses large requests.
+	_, err = halfclose.RoundTrip(ctx, h1, h2.ID(), bytes.Repeat([]byte("a"), 17), 16, testProto)
+	require.Error(t, err)
+	// and resets the stream if it fails.
+	_, err = halfclose.RoundTrip(ctx, h1, h2.ID(), nil, 16, testProto)
+	require.Error(t, err)
+	// we refuse large responses.
+	_, err = halfclose.RoundTrip(ctx, h1, h2.ID(), []byte("hello"), 4, testProto)
+	require.ErrorIs(t, err, halfclose.ErrTooLarge)
+}
+
+func TestRequestCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h1, h2 := newHosts(t, ctx)
+
+	// never responds.
+	h2.SetStreamHandler(testProto, func(s network.Stream) {
+		<-ctx.Done()
+		s.Reset()
+	})
+
+	reqCtx, reqCancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer reqCancel()
+	_, err := halfclose.RoundTrip(reqCtx, h1, h2.ID(), []byte("hello"), 0, testProto)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestCloseAndAwaitEOF(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h1, h2 := newHosts(t, ctx)
+
+	received := make(chan []byte, 1)
+	// acknowledges by closing the stream.
+	h2.SetStreamHandler(testProto, func(s network.Stream) {
+		b, _ := ioutil.ReadAll(s)
+		received <- b
+		s.Close()
+	})
+	// writes instead of closing it.
+	h2.SetStreamHandler("/test/chatty", func(s network.Stream) {
+		s.Write([]byte("nope"))
+		s.Close()
+	})
+	// doesn't close it.
+	h2.SetStreamHandler("/test/silent", func(s network.Stream) {
+		<-ctx.Done()
+		s.Reset()
+	})
+
+	s, err := h1.NewStream(ctx, h2.ID(), testProto)
+	require.NoError(t, err)
+	_, err = s.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, halfclose.CloseAndAwaitEOF(s, 5*time.Second))
+	require.Equal(t, []byte("hello"), <-received)
+
+	s, err = h1.NewStream(ctx, h2.ID(), "/test/chatty")
+	require.NoError(t, err)
+	require.ErrorIs(t, halfclose.CloseAndAwaitEOF(s, 5*time.Second), halfclose.ErrUnexpectedData)
+
+	s, err = h1.NewStream(ctx, h2.ID(), "/test/silent")
+	require.NoError(t, err)
+	require.ErrorIs(t, halfclose.CloseAndAwaitEOF(s, 100*time.Millisecond), context.DeadlineExceeded)
+}
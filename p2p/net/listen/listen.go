@@ -0,0 +1,216 @@
+// Package listen reports the outcome of listening on each address of a
+// network individually, and tracks the health of the resulting listeners.
+package listen
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/event"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+
+	logging "github.com/ipfs/go-log/v2"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+var log = logging.Logger("net/listen")
+
+// Result is the outcome of listening on a single address.
+type Result struct {
+	// Addr is the address we were asked to listen on.
+	Addr ma.Multiaddr
+	// Bound are the addresses the listener actually bound to, e.g. with the
+	// port filled in for /tcp/0.
+	Bound []ma.Multiaddr
+	// Err is nil if we're listening on Addr.
+	Err error
+}
+
+// Results are the outcomes of listening on a set of addresses.
+type Results []Result
+
+// Err returns an error if listening on every address failed.
+func (rs Results) Err() error {
+	var errs []error
+	for _, r := range rs {
+		if r.Err == nil {
+			return nil
+		}
+		errs = append(errs, r.Err)
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("failed to listen on any addresses: %s", errs)
+}
+
+// Failed returns the results of the addresses we failed to listen on.
+func (rs Results) Failed() Results {
+	var failed Results
+	for _, r := range rs {
+		if r.Err != nil {
+			failed = append(failed, r)
+		}
+	}
+	return failed
+}
+
+// addListenAddrer is implemented by networks that can listen on a single
+// address at a time, like the swarm.
+type addListenAddrer interface {
+	AddListenAddr(ma.Multiaddr) error
+}
+
+// Listen tells the network to listen on each of the given addresses, returning
+// the outcome for each address. Unlike network.Network.Listen, it doesn't stop
+// at, or hide, individual failures.
+func Listen(n network.Network, addrs ...ma.Multiaddr) Results {
+	results := make(Results, 0, len(addrs))
+	for _, a := range addrs {
+		before := n.ListenAddresses()
+
+		var err error
+		if al, ok := n.(addListenAddrer); ok {
+			err = al.AddListenAddr(a)
+		} else {
+			err = n.Listen(a)
+		}
+		if err != nil {
+			log.Debugw("listening failed", "on", a, "error", err)
+			results = append(results, Result{Addr: a, Err: err})
+			continue
+		}
+		results = append(results, Result{Addr: a, Bound: newAddrs(before, n.ListenAddresses())})
+	}
+	return results
+}
+
+func newAddrs(before, after []ma.Multiaddr) []ma.Multiaddr {
+	var added []ma.Multiaddr
+outer:
+	for _, a := range after {
+		for _, b := range before {
+			if a.Equal(b) {
+				continue outer
+			}
+		}
+		added = append(added, a)
+	}
+	return added
+}
+
+// EvtListenerClosed is emitted when a listener closes while the network is
+// still running, i.e. the listener died.
+type EvtListenerClosed struct {
+	Addr ma.Multiaddr
+}
+
+// Status is the health of a single listen address.
+type Status struct {
+	Addr ma.Multiaddr
+	// Listening is true if the listener is up.
+	Listening bool
+	// Err is the reason we failed to listen on the address, if known.
+	Err error
+	// Since is when the address entered its current state.
+	Since time.Time
+}
+
+// ErrListenerClosed is the Status error of listeners that closed unexpectedly.
+var ErrListenerClosed = errors.New("listener closed")
+
+// Monitor tracks the health of a host's listeners, and emits an
+// EvtListenerClosed when a listener dies.
+type Monitor struct {
+	host    host.Host
+	emitter event.Emitter
+	notifee *network.NotifyBundle
+
+	mu     sync.Mutex
+	status map[string]*Status
+}
+
+// NewMonitor constructs a new Monitor tracking the listeners of the given host.
+func NewMonitor(h host.Host) (*Monitor, error) {
+	emitter, err := h.EventBus().Emitter(new(EvtListenerClosed))
+	if err != nil {
+		return nil, err
+	}
+	m := &Monitor{
+		host:    h,
+		emitter: emitter,
+		status:  make(map[string]*Status),
+	}
+	m.notifee = &network.NotifyBundle{
+		ListenF:      m.listen,
+		ListenCloseF: m.listenClose,
+	}
+	h.Network().Notify(m.notifee)
+
+	now := time.Now()
+	m.mu.Lock()
+	for _, a := range h.Network().ListenAddresses() {
+		m.status[string(a.Bytes())] = &Status{Addr: a, Listening: true, Since: now}
+	}
+	m.mu.Unlock()
+	return m, nil
+}
+
+// Listen listens on the given addresses like the package level Listen,
+// additionally recording the failures in the health report.
+func (m *Monitor) Listen(addrs ...ma.Multiaddr) Results {
+	results := Listen(m.host.Network(), addrs...)
+
+	now := time.Now()
+	m.mu.Lock()
+	for _, r := range results.Failed() {
+		m.status[string(r.Addr.Bytes())] = &Status{Addr: r.Addr, Err: r.Err, Since: now}
+	}
+	m.mu.Unlock()
+	return results
+}
+
+// Health returns the status of all the listen addresses we know about.
+func (m *Monitor) Health() []Status {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	out := make([]Status, 0, len(m.status))
+	for _, s := range m.status {
+		out = append(out, *s)
+	}
+	return out
+}
+
+// Close stops the monitor.
+func (m *Monitor) Close() error {
+	m.host.Network().StopNotify(m.notifee)
+	return m.emitter.Close()
+}
+
+func (m *Monitor) listen(_ network.Network, a ma.Multiaddr) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.status[string(a.Bytes())] = &Status{Addr: a, Listening: true, Since: time.Now()}
+}
+
+func (m *Monitor) listenClose(n network.Network, a ma.Multiaddr) {
+	// listeners are closed when the network shuts down, that's expected.
+	if c, ok := n.(interface{ Context() context.Context }); ok && c.Context().Err() != nil {
+		return
+	}
+
+	log.Warnw("listener closed", "addr", a)
+	m.mu.Lock()
+	m.status[string(a.Bytes())] = &Status{Addr: a, Err: ErrListenerClosed, Since: time.Now()}
+	m.mu.Unlock()
+
+	if err := m.emitter.Emit(EvtListenerClosed{Addr: a}); err != nil {
+		log.Debugw("failed to emit listener closed event", "error", err)
+	}
+}
@@ -0,0 +1,91 @@
+package listen
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	blhost "github.com/libp2p/go-libp2p-blankhost"
+	swarmt "github.com/libp2p/go-libp2p-swarm/testing"
+
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenResults(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx, swarmt.OptDialOnly))
+	defer h.Close()
+
+	m, err := NewMonitor(h)
+	require.NoError(t, err)
+	defer m.Close()
+
+	good := ma.StringCast("/ip4/127.0.0.1/tcp/0")
+	bad := ma.StringCast("/ip4/127.0.0.1/udp/0/utp")
+	results := m.Listen(good, bad)
+	require.NoError(t, results.Err())
+	require.Len(t, results, 2)
+
+	require.Equal(t, good, results[0].Addr)
+	require.NoError(t, results[0].Err)
+	require.Len(t, results[0].Bound, 1)
+	require.NotEqual(t, good, results[0].Bound[0])
+
+	require.Error(t, results[1].Err)
+	require.Equal(t, Results{results[1]}, results.Failed())
+
+	require.Error(t, Listen(h.Network(), bad).Err())
+
+	health := make(map[string]Status)
+	for _, s := range m.Health() {
+		health[s.Addr.String()] = s
+	}
+	require.Len(t, health, 2)
+	require.True(t, health[results[0].Bound[0].String()].Listening)
+	require.False(t, health[bad.String()].Listening)
+	require.Equal(t, results[1].Err, health[bad.String()].Err)
+}
+
+func TestListenerClosedEvent(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	defer h.Close()
+
+	m, err := NewMonitor(h)
+	require.NoError(t, err)
+	defer m.Close()
+
+	sub, err := h.EventBus().Subscribe(new(EvtListenerClosed))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	// simulate a listener dying while the network is running.
+	addr := h.Network().ListenAddresses()[0]
+	m.listenClose(h.Network(), addr)
+
+	select {
+	case evt := <-sub.Out():
+		require.Equal(t, addr, evt.(EvtListenerClosed).Addr)
+	case <-time.After(time.Second):
+		t.Fatal("expected a listener closed event")
+	}
+	for _, s := range m.Health() {
+		if s.Addr.Equal(addr) {
+			require.False(t, s.Listening)
+			require.Equal(t, ErrListenerClosed, s.Err)
+		}
+	}
+
+	// closing the network doesn't emit any events.
+	require.NoError(t, h.Network().Close())
+	select {
+	case evt := <-sub.Out():
+		t.Fatalf("unexpected event: %v", evt)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,378 @@
+// Package nat64 lets nodes on IPv6-only networks, like many mobile carrier
+// networks, reach IPv4-only peers through the network's NAT64 gateway.
+//
+// The Detector discovers the NAT64 prefixes of the network as described in
+// RFC 7050, by resolving the AAAA records of ipv4only.arpa through the
+// network's DNS64 resolver. When it found a prefix and the node has no IPv4
+// address of its own, Transport dials IPv4 addresses through the gateway, at
+// the IPv6 address synthesized from the prefix (RFC 6052). Nodes running a
+// CLAT (RFC 6877), e.g. on Android, have an IPv4 address and dial IPv4
+// addresses as usual, the CLAT translating their packets.
+//
+// Connections going through a translator are told apart with Detector.Label.
+// Use the libp2p.NAT64 option to set it all up.
+package nat64
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+
+	logging "github.com/ipfs/go-log/v2"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+var log = logging.Logger("net/nat64")
+
+// WellKnownName is the name resolved to discover the NAT64 prefixes, see RFC
+// 7050.
+const WellKnownName = "ipv4only.arpa"
+
+// wellKnownAddrs are the IPv4 addresses WellKnownName resolves to.
+var wellKnownAddrs = []net.IP{
+	net.IPv4(192, 0, 0, 170).To4(),
+	net.IPv4(192, 0, 0, 171).To4(),
+}
+
+// clatNet is the IPv4 range CLATs assign the host, see RFC 7335.
+var clatNet = &net.IPNet{IP: net.IPv4(192, 0, 0, 0).To4(), Mask: net.CIDRMask(29, 32)}
+
+// refreshInterval is how long discovered prefixes are used before discovering
+// them again, following changes of the network we're on.
+const refreshInterval = 10 * time.Minute
+
+// prefixLens are the valid lengths of NAT64 prefixes, see RFC 6052.
+var prefixLens = []int{96, 64, 56, 48, 40, 32}
+
+// ErrInvalidPrefix is returned for prefixes of lengths RFC 6052 doesn't allow.
+var ErrInvalidPrefix = errors.New("invalid NAT64 prefix")
+
+// Prefix is a NAT64 prefix, e.g. the well-known prefix 64:ff9b::/96.
+type Prefix struct {
+	net.IPNet
+}
+
+// WellKnownPrefix is the well-known NAT64 prefix, see RFC 6052.
+var WellKnownPrefix = Prefix{net.IPNet{
+	IP:   net.ParseIP("64:ff9b::"),
+	Mask: net.CIDRMask(96, 128),
+}}
+
+// ParsePrefix parses a prefix in CIDR notation, e.g. "64:ff9b::/96".
+func ParsePrefix(s string) (Prefix, error) {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		return Prefix{}, err
+	}
+	p := Prefix{*n}
+	if !p.valid() {
+		return Prefix{}, ErrInvalidPrefix
+	}
+	return p, nil
+}
+
+func (p Prefix) len() int {
+	ones, bits := p.Mask.Size()
+	if bits != 128 {
+		return 0
+	}
+	return ones
+}
+
+func (p Prefix) valid() bool {
+	l := p.len()
+	for _, v := range prefixLens {
+		if l == v {
+			return true
+		}
+	}
+	return false
+}
+
+// positions returns the indexes of the bytes of the IPv6 address the bytes of
+// an IPv4 address are embedded at with the prefix. Byte 8, bits 64 to 71, is
+// always left zero, see RFC 6052, section 2.2.
+func (p Prefix) positions() [4]int {
+	var pos [4]int
+	i := p.len() / 8
+	for j := range pos {
+		if i == 8 {
+			i++
+		}
+		pos[j] = i
+		i++
+	}
+	return pos
+}
+
+// Synthesize returns the IPv6 address the given IPv4 address is reached at
+// through the translator of the prefix.
+func (p Prefix) Synthesize(ip4 net.IP) net.IP {
+	ip4 = ip4.To4()
+	if ip4 == nil || !p.valid() {
+		return nil
+	}
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, p.IP.Mask(p.Mask))
+	for j, i := range p.positions() {
+		ip[i] = ip4[j]
+	}
+	return ip
+}
+
+// Extract returns the IPv4 address embedded in the given IPv6 address by the
+// prefix, or nil if the address isn't in the prefix.
+func (p Prefix) Extract(ip6 net.IP) net.IP {
+	if !p.valid() || ip6.To4() != nil || !p.Contains(ip6) {
+		return nil
+	}
+	ip4 := make(net.IP, net.IPv4len)
+	for j, i := range p.positions() {
+		ip4[j] = ip6[i]
+	}
+	return ip4
+}
+
+// PrefixesFrom finds the NAT64 prefixes in the given IPv6 addresses that
+// WellKnownName resolves to, looking for the embedded well-known IPv4
+// addresses at each valid prefix length, see RFC 7050, section 3.
+func PrefixesFrom(ips []net.IP) []Prefix {
+	var out []Prefix
+	for _, ip := range ips {
+		if ip.To4() != nil || len(ip) != net.IPv6len {
+			continue
+		}
+		if p, ok := prefixFrom(ip); ok && !containsPrefix(out, p) {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+func prefixFrom(ip net.IP) (Prefix, bool) {
+	for _, l := range prefixLens {
+		p := Prefix{net.IPNet{Mask: net.CIDRMask(l, 128)}}
+		p.IP = ip.Mask(p.Mask)
+		for _, wka := range wellKnownAddrs {
+			if p.Synthesize(wka).Equal(ip) {
+				return p, true
+			}
+		}
+	}
+	return Prefix{}, false
+}
+
+func containsPrefix(ps []Prefix, p Prefix) bool {
+	for _, q := range ps {
+		if q.String() == p.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// Label tells how a connection reaches its remote peer.
+type Label int
+
+const (
+	// Native connections reach the peer without translation.
+	Native Label = iota
+	// NAT64 connections reach an IPv4 peer through the network's NAT64
+	// gateway, at a synthesized IPv6 address.
+	NAT64
+	// CLAT connections are sent from the IPv4 address of a CLAT, and
+	// translated to IPv6, then back to IPv4 by the network's gateway.
+	CLAT
+)
+
+func (l Label) String() string {
+	switch l {
+	case Native:
+		return "native"
+	case NAT64:
+		return "nat64"
+	case CLAT:
+		return "clat"
+	default:
+		return "unknown"
+	}
+}
+
+// Detector discovers the NAT64 prefixes of the network we're on.
+type Detector struct {
+	resolver *net.Resolver
+
+	// for tests.
+	lookup  func(ctx context.Context) ([]net.IP, error)
+	hasIPv4 func() bool
+	now     func() time.Time
+
+	refreshMx sync.Mutex // serializes discoveries
+
+	mx         sync.RWMutex
+	prefixes   []Prefix
+	ipv4       bool
+	discovered time.Time
+}
+
+// NewDetector constructs a new detector, resolving WellKnownName with the
+// given resolver, or net.DefaultResolver if nil.
+func NewDetector(r *net.Resolver) *Detector {
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	d := &Detector{resolver: r, hasIPv4: hasIPv4, now: time.Now}
+	d.lookup = d.lookupWellKnown
+	return d
+}
+
+func (d *Detector) lookupWellKnown(ctx context.Context) ([]net.IP, error) {
+	return d.resolver.LookupIP(ctx, "ip6", WellKnownName)
+}
+
+// hasIPv4 returns true if one of our interfaces has a non-loopback IPv4
+// address, including a CLAT's.
+func hasIPv4() bool {
+	addrs, err := manet.InterfaceMultiaddrs()
+	if err != nil {
+		log.Debugw("failed to list interface addresses", "error", err)
+		return true
+	}
+	for _, a := range addrs {
+		ip, err := manet.ToIP(a)
+		if err == nil && ip.To4() != nil && !ip.IsLoopback() && !ip.IsLinkLocalUnicast() {
+			return true
+		}
+	}
+	return false
+}
+
+// Refresh discovers the prefixes of the network again. Call it when the node
+// moves to another network; prefixes are otherwise discovered again every 10
+// minutes.
+func (d *Detector) Refresh(ctx context.Context) error {
+	d.refreshMx.Lock()
+	defer d.refreshMx.Unlock()
+	return d.refresh(ctx)
+}
+
+func (d *Detector) refresh(ctx context.Context) error {
+	ipv4 := d.hasIPv4()
+	ips, err := d.lookup(ctx)
+	var prefixes []Prefix
+	if err == nil {
+		prefixes = PrefixesFrom(ips)
+	} else if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+		// no DNS64, no NAT64.
+		err = nil
+	}
+
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	d.discovered = d.now()
+	d.ipv4 = ipv4
+	if err != nil {
+		// keep the prefixes we knew, and try again next time.
+		return err
+	}
+	if len(prefixes) > 0 {
+		log.Debugw("discovered NAT64 prefixes", "prefixes", prefixes, "ipv4", ipv4)
+	}
+	d.prefixes = prefixes
+	return nil
+}
+
+// ensure discovers the prefixes if they were never discovered, or too long
+// ago.
+func (d *Detector) ensure(ctx context.Context) {
+	d.mx.RLock()
+	fresh := !d.discovered.IsZero() && d.now().Sub(d.discovered) < refreshInterval
+	d.mx.RUnlock()
+	if fresh {
+		return
+	}
+
+	d.refreshMx.Lock()
+	defer d.refreshMx.Unlock()
+	d.mx.RLock()
+	fresh = !d.discovered.IsZero() && d.now().Sub(d.discovered) < refreshInterval
+	d.mx.RUnlock()
+	if fresh {
+		return
+	}
+	if err := d.refresh(ctx); err != nil {
+		log.Debugw("failed to discover NAT64 prefixes", "error", err)
+	}
+}
+
+// Prefixes returns the NAT64 prefixes of the network we're on, as last
+// discovered.
+func (d *Detector) Prefixes() []Prefix {
+	d.mx.RLock()
+	defer d.mx.RUnlock()
+	return append([]Prefix(nil), d.prefixes...)
+}
+
+// synthesizing returns the prefix to synthesize IPv4 addresses with, if we
+// have no IPv4 address of our own and the network has a NAT64 gateway.
+func (d *Detector) synthesizing() (Prefix, bool) {
+	d.mx.RLock()
+	defer d.mx.RUnlock()
+	if d.ipv4 || len(d.prefixes) == 0 {
+		return Prefix{}, false
+	}
+	return d.prefixes[0], true
+}
+
+// Synthesize returns the address the given IPv4 address is reached at through
+// the network's NAT64 gateway: the IPv4 component is replaced with the
+// address synthesized with the network's first prefix. It returns nil if the
+// address isn't an IPv4 address, or no prefix was discovered.
+func (d *Detector) Synthesize(a ma.Multiaddr) ma.Multiaddr {
+	prefixes := d.Prefixes()
+	if len(prefixes) == 0 {
+		return nil
+	}
+	return synthesize(prefixes[0], a)
+}
+
+func synthesize(p Prefix, a ma.Multiaddr) ma.Multiaddr {
+	first, rest := ma.SplitFirst(a)
+	if first == nil || first.Protocol().Code != ma.P_IP4 {
+		return nil
+	}
+	ip6 := p.Synthesize(net.IP(first.RawValue()))
+	if ip6 == nil {
+		return nil
+	}
+	c, err := ma.NewComponent("ip6", ip6.String())
+	if err != nil {
+		return nil
+	}
+	if rest == nil {
+		return c
+	}
+	return c.Encapsulate(rest)
+}
+
+// Label tells how the given connection reaches its remote peer: through the
+// network's NAT64 gateway if the remote address is in one of the network's
+// prefixes, through a CLAT if the local address is a CLAT's.
+func (d *Detector) Label(c network.ConnMultiaddrs) Label {
+	if ip, err := manet.ToIP(c.RemoteMultiaddr()); err == nil && ip.To4() == nil {
+		for _, p := range d.Prefixes() {
+			if p.Contains(ip) {
+				return NAT64
+			}
+		}
+	}
+	if ip, err := manet.ToIP(c.LocalMultiaddr()); err == nil && clatNet.Contains(ip) {
+		return CLAT
+	}
+	return Native
+}
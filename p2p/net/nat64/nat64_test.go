@@ -0,0 +1,140 @@
+package nat64
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/transport"
+
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrefix(t *testing.T) {
+	// the examples of RFC 6052, section 2.4.
+	ip4 := net.ParseIP("192.0.2.33")
+	for prefix, expected := range map[string]string{
+		"2001:db8::/32":         "2001:db8:c000:221::",
+		"2001:db8:100::/40":     "2001:db8:1c0:2:21::",
+		"2001:db8:122::/48":     "2001:db8:122:c000:2:2100::",
+		"2001:db8:122:300::/56": "2001:db8:122:3c0:0:221::",
+		"2001:db8:122:344::/64": "2001:db8:122:344:c0:2:2100:0",
+		"2001:db8:122:344::/96": "2001:db8:122:344::192.0.2.33",
+		"64:ff9b::/96":          "64:ff9b::192.0.2.33",
+	} {
+		p, err := ParsePrefix(prefix)
+		require.NoError(t, err)
+		ip6 := p.Synthesize(ip4)
+		require.Equal(t, net.ParseIP(expected), ip6, prefix)
+		require.Equal(t, ip4.To4(), p.Extract(ip6), prefix)
+	}
+	require.Equal(t, WellKnownPrefix.String(), "64:ff9b::/96")
+
+	_, err := ParsePrefix("2001:db8::/80")
+	require.Equal(t, ErrInvalidPrefix, err)
+	require.Nil(t, WellKnownPrefix.Extract(net.ParseIP("2001:db8::1")))
+	require.Nil(t, WellKnownPrefix.Synthesize(net.ParseIP("2001:db8::1")))
+}
+
+func TestPrefixesFrom(t *testing.T) {
+	ips := []net.IP{
+		net.ParseIP("64:ff9b::192.0.0.170"),
+		net.ParseIP("64:ff9b::192.0.0.171"),
+		net.ParseIP("2001:db8:122:3c0:0:aa::"),
+		net.ParseIP("2001:db8::1"),
+		net.ParseIP("192.0.0.170"),
+	}
+	prefixes := PrefixesFrom(ips)
+	require.Len(t, prefixes, 2)
+	require.Equal(t, "64:ff9b::/96", prefixes[0].String())
+	require.Equal(t, "2001:db8:122:300::/56", prefixes[1].String())
+}
+
+func newDetector(ipv4 bool, ips ...string) *Detector {
+	d := NewDetector(nil)
+	d.hasIPv4 = func() bool { return ipv4 }
+	d.lookup = func(context.Context) ([]net.IP, error) {
+		out := make([]net.IP, 0, len(ips))
+		for _, s := range ips {
+			out = append(out, net.ParseIP(s))
+		}
+		return out, nil
+	}
+	return d
+}
+
+func TestDetector(t *testing.T) {
+	d := newDetector(false, "64:ff9b::c000:aa")
+	require.Nil(t, d.Synthesize(ma.StringCast("/ip4/1.2.3.4/tcp/1")), "not discovered yet")
+	require.NoError(t, d.Refresh(context.Background()))
+	require.Equal(t, []Prefix{WellKnownPrefix}, d.Prefixes())
+
+	require.Equal(t, ma.StringCast("/ip6/64:ff9b::102:304/tcp/1"), d.Synthesize(ma.StringCast("/ip4/1.2.3.4/tcp/1")))
+	require.Nil(t, d.Synthesize(ma.StringCast("/ip6/::1/tcp/1")))
+	require.Nil(t, d.Synthesize(ma.StringCast("/dns4/example.com/tcp/1")))
+
+	// prefixes are discovered again once stale.
+	now := time.Now().Add(refreshInterval)
+	d.now = func() time.Time { return now }
+	d.lookup = func(context.Context) ([]net.IP, error) { return nil, &net.DNSError{IsNotFound: true} }
+	d.ensure(context.Background())
+	require.Empty(t, d.Prefixes())
+}
+
+type conn struct {
+	local, remote ma.Multiaddr
+}
+
+func (c conn) LocalMultiaddr() ma.Multiaddr  { return c.local }
+func (c conn) RemoteMultiaddr() ma.Multiaddr { return c.remote }
+
+func TestLabel(t *testing.T) {
+	d := newDetector(false, "64:ff9b::c000:aa")
+	require.NoError(t, d.Refresh(context.Background()))
+	for expected, c := range map[Label]conn{
+		Native: {ma.StringCast("/ip6/2001:db8::1/tcp/1"), ma.StringCast("/ip6/2001:db8::2/tcp/1")},
+		NAT64:  {ma.StringCast("/ip6/2001:db8::1/tcp/1"), ma.StringCast("/ip6/64:ff9b::102:304/tcp/1")},
+		CLAT:   {ma.StringCast("/ip4/192.0.0.2/tcp/1"), ma.StringCast("/ip4/1.2.3.4/tcp/1")},
+	} {
+		require.Equal(t, expected, d.Label(c), expected.String())
+	}
+}
+
+// dialer is a transport recording the addresses it dials.
+type dialer struct {
+	transport.Transport
+	dialed []ma.Multiaddr
+}
+
+func (t *dialer) CanDial(ma.Multiaddr) bool { return true }
+func (t *dialer) Dial(_ context.Context, a ma.Multiaddr, _ peer.ID) (transport.CapableConn, error) {
+	t.dialed = append(t.dialed, a)
+	return nil, nil
+}
+
+func TestTransport(t *testing.T) {
+	ip4 := ma.StringCast("/ip4/1.2.3.4/tcp/1")
+	ip6 := ma.StringCast("/ip6/2001:db8::1/tcp/1")
+
+	// IPv6-only network.
+	inner := &dialer{}
+	tpt := WrapTransport(inner, newDetector(false, "64:ff9b::c000:aa"))
+	tpt.Dial(context.Background(), ip4, "peer")
+	tpt.Dial(context.Background(), ip6, "peer")
+	require.Equal(t, []ma.Multiaddr{ma.StringCast("/ip6/64:ff9b::102:304/tcp/1"), ip6}, inner.dialed)
+
+	// we have an IPv4 address, e.g. a CLAT's.
+	inner = &dialer{}
+	tpt = WrapTransport(inner, newDetector(true, "64:ff9b::c000:aa"))
+	tpt.Dial(context.Background(), ip4, "peer")
+	require.Equal(t, []ma.Multiaddr{ip4}, inner.dialed)
+
+	// no NAT64.
+	inner = &dialer{}
+	tpt = WrapTransport(inner, newDetector(false))
+	tpt.Dial(context.Background(), ip4, "peer")
+	require.Equal(t, []ma.Multiaddr{ip4}, inner.dialed)
+}
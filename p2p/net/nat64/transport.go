@@ -0,0 +1,39 @@
+package nat64
+
+import (
+	"context"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/transport"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// Transport wraps a transport, dialing IPv4 addresses through the network's
+// NAT64 gateway when we have no IPv4 address of our own. The remote address
+// of these connections is the synthesized IPv6 address.
+type Transport struct {
+	transport.Transport
+	d *Detector
+}
+
+// WrapTransport wraps the given transport, dialing IPv4 addresses through the
+// NAT64 gateway discovered by the detector when needed.
+func WrapTransport(t transport.Transport, d *Detector) *Transport {
+	return &Transport{Transport: t, d: d}
+}
+
+// Dial dials the given address, at the synthesized address if it's an IPv4
+// address and we can't dial it otherwise.
+func (t *Transport) Dial(ctx context.Context, raddr ma.Multiaddr, p peer.ID) (transport.CapableConn, error) {
+	if first, _ := ma.SplitFirst(raddr); first != nil && first.Protocol().Code == ma.P_IP4 {
+		t.d.ensure(ctx)
+		if prefix, ok := t.d.synthesizing(); ok {
+			if a := synthesize(prefix, raddr); a != nil && t.Transport.CanDial(a) {
+				log.Debugw("dialing through NAT64", "peer", p, "addr", raddr, "synthesized", a)
+				return t.Transport.Dial(ctx, a, p)
+			}
+		}
+	}
+	return t.Transport.Dial(ctx, raddr, p)
+}
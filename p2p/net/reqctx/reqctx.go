@@ -0,0 +1,218 @@
+// Package reqctx propagates request contexts across peers. The opener of a
+// stream writes a small header carrying the request's deadline and trace ID,
+// and the handler decodes it into a context, so cross-peer cancellation and
+// tracing work without every protocol inventing its own header format.
+//
+// Both sides of a protocol must agree on using the header.
+package reqctx
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+var log = logging.Logger("net/reqctx")
+
+const (
+	// headerVersion is the version of the header format.
+	headerVersion = 1
+
+	// MaxTraceIDSize is the maximum size of a trace ID.
+	MaxTraceIDSize = 64
+
+	// maxHeaderSize is the maximum encoded size of a header.
+	maxHeaderSize = 1 + binary.MaxVarintLen64 + binary.MaxVarintLen64 + MaxTraceIDSize
+)
+
+// HeaderReadTimeout is the time StreamHandler waits for the header of a new
+// stream.
+var HeaderReadTimeout = 10 * time.Second
+
+// ErrHeaderTooLarge is returned when decoding a header larger than we accept.
+var ErrHeaderTooLarge = errors.New("request context header too large")
+
+type traceIDKey struct{}
+
+// WithTraceID returns a context carrying the given trace ID.
+func WithTraceID(ctx context.Context, id []byte) context.Context {
+	return context.WithValue(ctx, traceIDKey{}, id)
+}
+
+// TraceID returns the trace ID carried by the context, if any.
+func TraceID(ctx context.Context) []byte {
+	id, _ := ctx.Value(traceIDKey{}).([]byte)
+	return id
+}
+
+// Header is the request context sent at the start of a stream.
+type Header struct {
+	// Timeout is the time left until the request's deadline when the header
+	// was written, 0 if the request has no deadline. Sending the remaining
+	// time rather than the deadline itself makes the header immune to clock
+	// skew between peers.
+	Timeout time.Duration
+	// TraceID identifies the request in distributed traces.
+	TraceID []byte
+}
+
+// HeaderFromContext returns the header describing the given context.
+func HeaderFromContext(ctx context.Context) Header {
+	var h Header
+	if deadline, ok := ctx.Deadline(); ok {
+		h.Timeout = time.Until(deadline)
+		if h.Timeout <= 0 {
+			// round up, 0 means no deadline.
+			h.Timeout = time.Millisecond
+		}
+	}
+	h.TraceID = TraceID(ctx)
+	return h
+}
+
+// Context derives a context with the header's deadline and trace ID from
+// parent.
+func (h Header) Context(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx := parent
+	if h.TraceID != nil {
+		ctx = WithTraceID(ctx, h.TraceID)
+	}
+	if h.Timeout > 0 {
+		return context.WithTimeout(ctx, h.Timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// WriteHeader writes the header to w.
+func WriteHeader(w io.Writer, h Header) error {
+	if len(h.TraceID) > MaxTraceIDSize {
+		return fmt.Errorf("trace ID longer than %d bytes", MaxTraceIDSize)
+	}
+	var timeoutMs uint64
+	if h.Timeout > 0 {
+		// round up, 0 means no deadline.
+		timeoutMs = uint64((h.Timeout + time.Millisecond - 1) / time.Millisecond)
+	}
+
+	body := make([]byte, 0, maxHeaderSize)
+	body = append(body, headerVersion)
+	body = appendUvarint(body, timeoutMs)
+	body = appendUvarint(body, uint64(len(h.TraceID)))
+	body = append(body, h.TraceID...)
+
+	buf := appendUvarint(make([]byte, 0, binary.MaxVarintLen64+len(body)), uint64(len(body)))
+	_, err := w.Write(append(buf, body...))
+	return err
+}
+
+// ReadHeader reads a header written by WriteHeader from r. It never reads past
+// the end of the header.
+func ReadHeader(r io.Reader) (Header, error) {
+	br := &byteReader{r: r}
+	size, err := binary.ReadUvarint(br)
+	if err != nil {
+		return Header{}, err
+	}
+	if size > maxHeaderSize {
+		return Header{}, ErrHeaderTooLarge
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return Header{}, err
+	}
+	return decodeHeader(body)
+}
+
+func decodeHeader(body []byte) (Header, error) {
+	if len(body) == 0 || body[0] != headerVersion {
+		return Header{}, errors.New("unknown request context header version")
+	}
+	body = body[1:]
+
+	timeoutMs, n := binary.Uvarint(body)
+	if n <= 0 {
+		return Header{}, errors.New("malformed request context header")
+	}
+	body = body[n:]
+
+	idLen, n := binary.Uvarint(body)
+	if n <= 0 || idLen > uint64(len(body)-n) || idLen > MaxTraceIDSize {
+		return Header{}, errors.New("malformed request context header")
+	}
+	body = body[n:]
+
+	var h Header
+	if timeoutMs > 0 {
+		h.Timeout = time.Duration(timeoutMs) * time.Millisecond
+	}
+	if idLen > 0 {
+		h.TraceID = append([]byte(nil), body[:idLen]...)
+	}
+	return h, nil
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+// byteReader reads one byte at a time so that we don't consume anything past
+// the header.
+type byteReader struct {
+	r   io.Reader
+	buf [1]byte
+}
+
+func (br *byteReader) ReadByte() (byte, error) {
+	if _, err := io.ReadFull(br.r, br.buf[:]); err != nil {
+		return 0, err
+	}
+	return br.buf[0], nil
+}
+
+// NewStream opens a new stream to the given peer and writes the header
+// describing ctx to it.
+func NewStream(ctx context.Context, h host.Host, p peer.ID, pids ...protocol.ID) (network.Stream, error) {
+	s, err := h.NewStream(ctx, p, pids...)
+	if err != nil {
+		return nil, err
+	}
+	if err := WriteHeader(s, HeaderFromContext(ctx)); err != nil {
+		s.Reset()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Handler is a stream handler receiving the request context decoded from the
+// stream's header.
+type Handler func(ctx context.Context, s network.Stream)
+
+// StreamHandler returns a network.StreamHandler decoding the header of every
+// stream and calling handler with the resulting context. The context is
+// canceled once the handler returns. Streams with an invalid header are reset.
+func StreamHandler(handler Handler) network.StreamHandler {
+	return func(s network.Stream) {
+		_ = s.SetReadDeadline(time.Now().Add(HeaderReadTimeout))
+		h, err := ReadHeader(s)
+		_ = s.SetReadDeadline(time.Time{})
+		if err != nil {
+			log.Debugw("failed to read request context header", "peer", s.Conn().RemotePeer(), "error", err)
+			s.Reset()
+			return
+		}
+		ctx, cancel := h.Context(context.Background())
+		defer cancel()
+		handler(ctx, s)
+	}
+}
@@ -0,0 +1,93 @@
+package reqctx
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	bhost "github.com/libp2p/go-libp2p/p2p/host/basic"
+
+	swarmt "github.com/libp2p/go-libp2p-swarm/testing"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHeaderRoundTrip(t *testing.T) {
+	for _, h := range []Header{
+		{},
+		{Timeout: 1500 * time.Millisecond},
+		{TraceID: []byte("trace")},
+		{Timeout: time.Hour, TraceID: bytes.Repeat([]byte{'x'}, MaxTraceIDSize)},
+	} {
+		var buf bytes.Buffer
+		require.NoError(t, WriteHeader(&buf, h))
+		buf.WriteString("payload")
+
+		got, err := ReadHeader(&buf)
+		require.NoError(t, err)
+		require.Equal(t, h, got)
+		// the payload following the header is left untouched.
+		require.Equal(t, "payload", buf.String())
+	}
+
+	require.Error(t, WriteHeader(ioutil.Discard, Header{TraceID: make([]byte, MaxTraceIDSize+1)}))
+}
+
+func TestReadHeaderInvalid(t *testing.T) {
+	_, err := ReadHeader(bytes.NewReader([]byte{200, 1}))
+	require.Equal(t, ErrHeaderTooLarge, err)
+
+	_, err = ReadHeader(bytes.NewReader([]byte{1, 2}))
+	require.Error(t, err)
+
+	// trace ID length exceeds the header.
+	_, err = ReadHeader(bytes.NewReader([]byte{3, 1, 0, 5}))
+	require.Error(t, err)
+}
+
+func TestStreamPropagation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := bhost.New(swarmt.GenSwarm(t, ctx))
+	h2 := bhost.New(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	defer h2.Close()
+
+	type result struct {
+		deadline time.Time
+		traceID  []byte
+		payload  []byte
+	}
+	results := make(chan result, 1)
+	h2.SetStreamHandler("/test", StreamHandler(func(ctx context.Context, s network.Stream) {
+		defer s.Close()
+		deadline, _ := ctx.Deadline()
+		payload, _ := ioutil.ReadAll(s)
+		results <- result{deadline: deadline, traceID: TraceID(ctx), payload: payload}
+	}))
+
+	require.NoError(t, h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+
+	reqCtx, reqCancel := context.WithTimeout(WithTraceID(ctx, []byte("abc")), 5*time.Second)
+	defer reqCancel()
+	s, err := NewStream(reqCtx, h1, h2.ID(), "/test")
+	require.NoError(t, err)
+	_, err = s.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, s.CloseWrite())
+
+	select {
+	case res := <-results:
+		require.Equal(t, []byte("abc"), res.traceID)
+		require.Equal(t, []byte("hello"), res.payload)
+		expected, _ := reqCtx.Deadline()
+		require.WithinDuration(t, expected, res.deadline, time.Second)
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler wasn't called")
+	}
+}
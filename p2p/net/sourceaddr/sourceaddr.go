@@ -0,0 +1,131 @@
+// Package sourceaddr provides a TCP transport that lets applications choose
+// the local (source) IP address outbound connections are dialed from.
+//
+// On multi-homed hosts the OS picks the source address based on the default
+// route, which is often the wrong interface for VPN or dual-WAN setups.
+package sourceaddr
+
+import (
+	"context"
+	"net"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/transport"
+
+	tptu "github.com/libp2p/go-libp2p-transport-upgrader"
+	tcp "github.com/libp2p/go-tcp-transport"
+
+	logging "github.com/ipfs/go-log/v2"
+
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+var log = logging.Logger("sourceaddr")
+
+// Policy returns the local IP address to dial the given remote address from.
+// Returning nil lets the OS pick.
+type Policy func(raddr ma.Multiaddr) net.IP
+
+// Static returns a Policy dialing all addresses of the same IP family as ip
+// from ip.
+func Static(ip net.IP) Policy {
+	return func(raddr ma.Multiaddr) net.IP {
+		return ip
+	}
+}
+
+// Class is a class of destination addresses.
+type Class int
+
+const (
+	// Loopback addresses, e.g. 127.0.0.1.
+	Loopback Class = iota
+	// Private addresses, e.g. 192.168.0.0/16 or link-local addresses.
+	Private
+	// Public addresses.
+	Public
+)
+
+// ClassOf returns the class of the given address.
+func ClassOf(addr ma.Multiaddr) Class {
+	switch {
+	case manet.IsIPLoopback(addr):
+		return Loopback
+	case manet.IsPublicAddr(addr):
+		return Public
+	default:
+		return Private
+	}
+}
+
+// ByClass returns a Policy selecting the source address based on the class of
+// the destination address. Classes missing from the map are left to the OS.
+func ByClass(sources map[Class]net.IP) Policy {
+	return func(raddr ma.Multiaddr) net.IP {
+		return sources[ClassOf(raddr)]
+	}
+}
+
+// Transport is a TCP transport dialing from the source address selected by
+// its Policy. Listening is left to the underlying TCP transport.
+type Transport struct {
+	*tcp.TcpTransport
+	policy Policy
+}
+
+var _ transport.Transport = (*Transport)(nil)
+
+// NewTCPTransport returns a constructor for a TCP transport dialing from the
+// source addresses selected by policy, for use with the libp2p.Transport
+// option.
+func NewTCPTransport(policy Policy) func(*tptu.Upgrader) *Transport {
+	return func(upgrader *tptu.Upgrader) *Transport {
+		return &Transport{
+			TcpTransport: tcp.NewTCPTransport(upgrader),
+			policy:       policy,
+		}
+	}
+}
+
+// sourceAddr returns the local address to dial raddr from, or nil if the
+// policy doesn't pick one applicable to raddr.
+func (t *Transport) sourceAddr(raddr ma.Multiaddr) *net.TCPAddr {
+	ip := t.policy(raddr)
+	if ip == nil {
+		return nil
+	}
+	rip, err := manet.ToIP(raddr)
+	if err != nil {
+		return nil
+	}
+	// the source address must be of the same family as the destination.
+	if (ip.To4() == nil) != (rip.To4() == nil) {
+		return nil
+	}
+	return &net.TCPAddr{IP: ip}
+}
+
+// Dial dials the peer at the remote address, from the source address selected
+// by the policy.
+func (t *Transport) Dial(ctx context.Context, raddr ma.Multiaddr, p peer.ID) (transport.CapableConn, error) {
+	laddr := t.sourceAddr(raddr)
+	if laddr == nil {
+		return t.TcpTransport.Dial(ctx, raddr, p)
+	}
+
+	dialCtx := ctx
+	if t.ConnectTimeout > 0 {
+		var cancel context.CancelFunc
+		dialCtx, cancel = context.WithTimeout(ctx, t.ConnectTimeout)
+		defer cancel()
+	}
+
+	log.Debugw("dialing with source address", "remote", raddr, "source", laddr)
+	d := manet.Dialer{Dialer: net.Dialer{LocalAddr: laddr}}
+	conn, err := d.DialContext(dialCtx, raddr)
+	if err != nil {
+		return nil, err
+	}
+	return t.Upgrader.UpgradeOutbound(ctx, t, conn, p)
+}
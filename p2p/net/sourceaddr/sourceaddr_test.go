@@ -0,0 +1,60 @@
+package sourceaddr
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+	"github.com/stretchr/testify/require"
+)
+
+func TestByClass(t *testing.T) {
+	lan := net.ParseIP("192.168.1.10")
+	wan := net.ParseIP("203.0.113.5")
+	policy := ByClass(map[Class]net.IP{Private: lan, Public: wan})
+
+	require.Equal(t, lan, policy(ma.StringCast("/ip4/192.168.1.20/tcp/4001")))
+	require.Equal(t, wan, policy(ma.StringCast("/ip4/1.2.3.4/tcp/4001")))
+	require.Nil(t, policy(ma.StringCast("/ip4/127.0.0.1/tcp/4001")))
+}
+
+func TestSourceAddrFamily(t *testing.T) {
+	tpt := NewTCPTransport(Static(net.ParseIP("192.168.1.10")))(nil)
+	require.NotNil(t, tpt.sourceAddr(ma.StringCast("/ip4/1.2.3.4/tcp/4001")))
+	require.Nil(t, tpt.sourceAddr(ma.StringCast("/ip6/::1/tcp/4001")))
+}
+
+func TestDialFromSourceAddr(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the whole 127.0.0.0/8 range is routed to the loopback interface.
+	src := net.ParseIP("127.0.0.2")
+	if l, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: src}); err != nil {
+		t.Skipf("can't bind to %s: %s", src, err)
+	} else {
+		l.Close()
+	}
+
+	h1, err := libp2p.New(ctx,
+		libp2p.Transport(NewTCPTransport(Static(src))),
+		libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"),
+	)
+	require.NoError(t, err)
+	defer h1.Close()
+	h2, err := libp2p.New(ctx, libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	require.NoError(t, err)
+	defer h2.Close()
+
+	require.NoError(t, h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+	conns := h1.Network().ConnsToPeer(h2.ID())
+	require.Len(t, conns, 1)
+	ip, err := manet.ToIP(conns[0].LocalMultiaddr())
+	require.NoError(t, err)
+	require.True(t, ip.Equal(src))
+}
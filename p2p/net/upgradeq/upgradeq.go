@@ -0,0 +1,330 @@
+// Package upgradeq queues the inbound connections awaiting their security
+// handshake, prioritized by the reputation of their source IP address. Sources
+// whose connections completed handshakes before, with peers we think well of,
+// are served first, and unknown or misbehaving sources are shed when the queue
+// is full. A flood of connections thus degrades service for the flooding
+// sources before our regular peers.
+//
+// Wrap the security muxer of the upgrader with Queue.Wrap, or use the
+// libp2p.InboundUpgradeQueue option.
+package upgradeq
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/libp2p/go-libp2p-core/connmgr"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/sec"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+var log = logging.Logger("net/upgradeq")
+
+// DefaultMaxConcurrent and DefaultMaxWaiting are the default number of inbound
+// handshakes run concurrently, and of inbound connections waiting for theirs.
+const (
+	DefaultMaxConcurrent = 32
+	DefaultMaxWaiting    = 256
+)
+
+// maxSources is the number of source IP addresses we remember the history of.
+var maxSources = 4096
+
+// maxHistory bounds the reputation a source earns, or loses, from its own
+// handshakes, so that a long history doesn't outweigh the score of its peers.
+const maxHistory = 16
+
+// maxSourcePeers is the number of peers we remember for each source.
+const maxSourcePeers = 4
+
+// ErrShed is returned for inbound connections shed from a full queue.
+var ErrShed = errors.New("inbound upgrade queue full")
+
+// Stats are statistics of a Queue.
+type Stats struct {
+	// Active is the number of handshakes running, and Waiting the number of
+	// connections waiting for theirs.
+	Active  int
+	Waiting int
+	// Shed is the number of connections shed from the full queue.
+	Shed uint64
+}
+
+// Queue runs the handshakes of inbound connections, a limited number at a
+// time, by priority of their source.
+type Queue struct {
+	mu sync.Mutex
+
+	maxConcurrent int
+	maxWaiting    int
+	score         func(peer.ID) int
+
+	active  int
+	waiting []*waiter
+	seq     uint64
+	shed    uint64
+
+	// source IP -> element of lru holding its *source, most recently seen
+	// at the front.
+	sources map[string]*list.Element
+	lru     *list.List
+}
+
+type source struct {
+	ip string
+	// history is the number of successful handshakes minus the number of
+	// failed ones, within ±maxHistory.
+	history int
+	peers   []peer.ID
+}
+
+type waiter struct {
+	priority int
+	seq      uint64
+	// ready receives nil once the handshake may run, ErrShed if the
+	// connection was shed.
+	ready chan error
+}
+
+// before returns true if w is served before o.
+func (w *waiter) before(o *waiter) bool {
+	if w.priority != o.priority {
+		return w.priority > o.priority
+	}
+	return w.seq < o.seq
+}
+
+// NewQueue constructs a new Queue running up to maxConcurrent handshakes at a
+// time, with up to maxWaiting connections waiting for theirs. Zero values use
+// DefaultMaxConcurrent and DefaultMaxWaiting. The score of the peers seen
+// connecting from a source is returned by the given function, e.g.
+// ConnManagerScore. It may be nil, in which case sources are prioritized by
+// their own history only.
+func NewQueue(maxConcurrent, maxWaiting int, score func(peer.ID) int) *Queue {
+	if maxConcurrent <= 0 {
+		maxConcurrent = DefaultMaxConcurrent
+	}
+	if maxWaiting <= 0 {
+		maxWaiting = DefaultMaxWaiting
+	}
+	return &Queue{
+		maxConcurrent: maxConcurrent,
+		maxWaiting:    maxWaiting,
+		score:         score,
+		sources:       make(map[string]*list.Element),
+		lru:           list.New(),
+	}
+}
+
+// ConnManagerScore returns the score of peers in the given connection manager,
+// the total value of their tags.
+func ConnManagerScore(cm connmgr.ConnManager) func(peer.ID) int {
+	return func(p peer.ID) int {
+		info := cm.GetTagInfo(p)
+		if info == nil {
+			return 0
+		}
+		return info.Value
+	}
+}
+
+// Wrap wraps a security muxer so that its inbound handshakes go through the
+// queue. Outbound handshakes aren't queued.
+func (q *Queue) Wrap(m sec.SecureMuxer) sec.SecureMuxer {
+	return &secureMuxer{SecureMuxer: m, q: q}
+}
+
+type secureMuxer struct {
+	sec.SecureMuxer
+	q *Queue
+}
+
+func (m *secureMuxer) SecureInbound(ctx context.Context, insecure net.Conn) (sec.SecureConn, bool, error) {
+	ip := remoteIP(insecure.RemoteAddr())
+	if err := m.q.acquire(ctx, ip); err != nil {
+		log.Debugw("not upgrading inbound connection", "addr", insecure.RemoteAddr(), "error", err)
+		return nil, false, err
+	}
+	c, server, err := m.SecureMuxer.SecureInbound(ctx, insecure)
+	m.q.release()
+	if err != nil {
+		m.q.record(ip, "")
+		return nil, false, err
+	}
+	m.q.record(ip, c.RemotePeer())
+	return c, server, nil
+}
+
+func remoteIP(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return string(a.IP.To16())
+	case *net.UDPAddr:
+		return string(a.IP.To16())
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return string(ip.To16())
+	}
+	return host
+}
+
+// acquire waits until a handshake for a connection from the given source may
+// run, and returns ErrShed if it was shed instead.
+func (q *Queue) acquire(ctx context.Context, ip string) error {
+	q.mu.Lock()
+	if q.active < q.maxConcurrent && len(q.waiting) == 0 {
+		q.active++
+		q.mu.Unlock()
+		return nil
+	}
+
+	q.seq++
+	w := &waiter{priority: q.priority(ip), seq: q.seq, ready: make(chan error, 1)}
+	if len(q.waiting) >= q.maxWaiting {
+		// shed whoever comes last, the newcomer if it ties.
+		last := 0
+		for i, o := range q.waiting {
+			if q.waiting[last].before(o) {
+				last = i
+			}
+		}
+		victim := q.waiting[last]
+		if !w.before(victim) {
+			q.shed++
+			q.mu.Unlock()
+			return ErrShed
+		}
+		q.remove(last)
+		q.shed++
+		victim.ready <- ErrShed
+	}
+	q.waiting = append(q.waiting, w)
+	q.mu.Unlock()
+
+	select {
+	case err := <-w.ready:
+		return err
+	case <-ctx.Done():
+	}
+
+	q.mu.Lock()
+	for i, o := range q.waiting {
+		if o == w {
+			q.remove(i)
+			q.mu.Unlock()
+			return ctx.Err()
+		}
+	}
+	q.mu.Unlock()
+	// we were served, or shed, in the meantime.
+	if err := <-w.ready; err == nil {
+		q.release()
+	}
+	return ctx.Err()
+}
+
+// release hands the slot of a finished handshake over to the first waiting
+// connection.
+func (q *Queue) release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.waiting) == 0 {
+		q.active--
+		return
+	}
+	first := 0
+	for i, o := range q.waiting {
+		if o.before(q.waiting[first]) {
+			first = i
+		}
+	}
+	w := q.waiting[first]
+	q.remove(first)
+	w.ready <- nil
+}
+
+// remove removes the i-th waiting connection. q.mu must be held.
+func (q *Queue) remove(i int) {
+	q.waiting[i] = q.waiting[len(q.waiting)-1]
+	q.waiting[len(q.waiting)-1] = nil
+	q.waiting = q.waiting[:len(q.waiting)-1]
+}
+
+// priority returns the priority of connections from the given source: its
+// history, plus the best score of the peers seen connecting from it. Unknown
+// sources get zero, below those with good history and above misbehaving
+// ones. q.mu must be held.
+func (q *Queue) priority(ip string) int {
+	e, ok := q.sources[ip]
+	if !ok {
+		return 0
+	}
+	s := e.Value.(*source)
+	if q.score == nil || len(s.peers) == 0 {
+		return s.history
+	}
+	best := q.score(s.peers[0])
+	for _, p := range s.peers[1:] {
+		if score := q.score(p); score > best {
+			best = score
+		}
+	}
+	return s.history + best
+}
+
+// record records the outcome of a handshake of a connection from the given
+// source, with the given peer if it succeeded.
+func (q *Queue) record(ip string, p peer.ID) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var s *source
+	if e, ok := q.sources[ip]; ok {
+		s = e.Value.(*source)
+		q.lru.MoveToFront(e)
+	} else {
+		if q.lru.Len() >= maxSources {
+			oldest := q.lru.Back()
+			q.lru.Remove(oldest)
+			delete(q.sources, oldest.Value.(*source).ip)
+		}
+		s = &source{ip: ip}
+		q.sources[ip] = q.lru.PushFront(s)
+	}
+
+	if p == "" {
+		if s.history > -maxHistory {
+			s.history--
+		}
+		return
+	}
+	if s.history < maxHistory {
+		s.history++
+	}
+	for _, known := range s.peers {
+		if known == p {
+			return
+		}
+	}
+	if len(s.peers) >= maxSourcePeers {
+		copy(s.peers, s.peers[1:])
+		s.peers = s.peers[:len(s.peers)-1]
+	}
+	s.peers = append(s.peers, p)
+}
+
+// Stats returns statistics of the queue.
+func (q *Queue) Stats() Stats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return Stats{Active: q.active, Waiting: len(q.waiting), Shed: q.shed}
+}
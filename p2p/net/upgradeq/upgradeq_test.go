@@ -0,0 +1,133 @@
+package upgradeq
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	ic "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/sec"
+	"github.com/libp2p/go-libp2p-core/sec/insecure"
+	"github.com/libp2p/go-libp2p-core/test"
+
+	csms "github.com/libp2p/go-conn-security-multistream"
+	"github.com/stretchr/testify/require"
+)
+
+// waitFor starts acquiring a slot for the given source, and returns the
+// channel the result is sent on.
+func waitFor(q *Queue, ip string) <-chan error {
+	ch := make(chan error, 1)
+	go func() { ch <- q.acquire(context.Background(), ip) }()
+	return ch
+}
+
+func waiting(t *testing.T, q *Queue, n int) {
+	t.Helper()
+	require.Eventually(t, func() bool { return q.Stats().Waiting == n }, time.Second, time.Millisecond)
+}
+
+func TestQueuePriority(t *testing.T) {
+	good := peer.ID("good")
+	scores := map[peer.ID]int{good: 10}
+	q := NewQueue(1, 2, func(p peer.ID) int { return scores[p] })
+	q.record("good", good)
+	q.record("bad", "")
+
+	require.NoError(t, q.acquire(context.Background(), "a"))
+
+	unknown := waitFor(q, "unknown")
+	waiting(t, q, 1)
+	misbehaving := waitFor(q, "bad")
+	waiting(t, q, 2)
+
+	// the good source displaces the misbehaving one from the full queue.
+	known := waitFor(q, "good")
+	require.Equal(t, ErrShed, <-misbehaving)
+	waiting(t, q, 2)
+
+	// unknown sources don't displace each other.
+	require.Equal(t, ErrShed, q.acquire(context.Background(), "unknown2"))
+
+	// the good source is served first, though it came last.
+	q.release()
+	require.NoError(t, <-known)
+	q.release()
+	require.NoError(t, <-unknown)
+	q.release()
+
+	require.Equal(t, Stats{Shed: 2}, q.Stats())
+}
+
+func TestQueueCancel(t *testing.T) {
+	q := NewQueue(1, 1, nil)
+	require.NoError(t, q.acquire(context.Background(), "a"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := make(chan error, 1)
+	go func() { ch <- q.acquire(ctx, "b") }()
+	waiting(t, q, 1)
+	cancel()
+	require.Equal(t, context.Canceled, <-ch)
+	require.Equal(t, Stats{Active: 1}, q.Stats())
+
+	q.release()
+	require.Equal(t, Stats{}, q.Stats())
+}
+
+func TestQueueHistory(t *testing.T) {
+	q := NewQueue(1, 1, nil)
+	for i := 0; i < 2*maxHistory; i++ {
+		q.record("a", peer.ID("p"))
+	}
+	require.Equal(t, maxHistory, q.priority("a"))
+	require.Len(t, q.sources["a"].Value.(*source).peers, 1)
+
+	defer func(n int) { maxSources = n }(maxSources)
+	maxSources = 2
+	q.record("b", "")
+	q.record("c", "")
+	require.Zero(t, q.priority("a"))
+	require.Equal(t, -1, q.priority("b"))
+}
+
+func newSecureMuxer(t *testing.T) (sec.SecureMuxer, peer.ID) {
+	priv, _, err := test.RandTestKeyPair(ic.Ed25519, 256)
+	require.NoError(t, err)
+	id, err := peer.IDFromPrivateKey(priv)
+	require.NoError(t, err)
+	m := new(csms.SSMuxer)
+	m.AddTransport(insecure.ID, insecure.NewWithIdentity(id, priv))
+	return m, id
+}
+
+func TestWrap(t *testing.T) {
+	dialer, dialerID := newSecureMuxer(t)
+	listener, listenerID := newSecureMuxer(t)
+	q := NewQueue(0, 0, nil)
+	listener = q.Wrap(listener)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return
+		}
+		if _, _, err := dialer.SecureOutbound(context.Background(), c, listenerID); err != nil {
+			c.Close()
+		}
+	}()
+	c, err := l.Accept()
+	require.NoError(t, err)
+	sc, _, err := listener.SecureInbound(context.Background(), c)
+	require.NoError(t, err)
+	defer sc.Close()
+	require.Equal(t, dialerID, sc.RemotePeer())
+
+	require.Equal(t, Stats{}, q.Stats())
+	require.Equal(t, 1, q.priority(string(net.ParseIP("127.0.0.1").To16())))
+}
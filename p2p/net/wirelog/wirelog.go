@@ -0,0 +1,327 @@
+// Package wirelog implements an opt-in, verbose log of the connections,
+// streams and identify exchanges with selected peers, for capturing hard to
+// reproduce interop bugs in production.
+//
+// Logging is rate limited and size capped, and can be toggled at runtime for
+// individual peers.
+package wirelog
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/event"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/libp2p/go-libp2p/p2p/host/peerlabel"
+
+	logging "github.com/ipfs/go-log/v2"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+var log = logging.Logger("net/wirelog")
+
+type config struct {
+	maxBytes      int64
+	linesPerSec   int
+	maxFieldSize  int
+	sampleStreams int
+}
+
+// Option is an option for the wire logger.
+type Option func(*config)
+
+// MaxBytes caps the total number of bytes written. Once reached, we stop
+// logging. Defaults to 64MiB.
+func MaxBytes(n int64) Option {
+	return func(cfg *config) {
+		cfg.maxBytes = n
+	}
+}
+
+// RateLimit caps the number of lines written per second. Lines exceeding the
+// limit are dropped, and the number of dropped lines is logged once logging
+// resumes. Defaults to 100.
+func RateLimit(linesPerSec int) Option {
+	return func(cfg *config) {
+		cfg.linesPerSec = linesPerSec
+	}
+}
+
+// MaxFieldSize truncates logged values, e.g. long protocol lists, to the given
+// number of bytes. Defaults to 512.
+func MaxFieldSize(n int) Option {
+	return func(cfg *config) {
+		cfg.maxFieldSize = n
+	}
+}
+
+// SampleStreams only logs one in every n streams. Connections and identify
+// exchanges are always logged. Defaults to logging every stream.
+func SampleStreams(n int) Option {
+	return func(cfg *config) {
+		cfg.sampleStreams = n
+	}
+}
+
+// Logger writes a line to its writer for every connection, stream and
+// identify exchange with the peers it's enabled for.
+type Logger struct {
+	host host.Host
+	cfg  config
+	sub  event.Subscription
+
+	mu       sync.Mutex
+	w        io.Writer
+	written  int64
+	capped   bool
+	peers    map[peer.ID]struct{}
+	all      bool
+	window   time.Time
+	lines    int
+	dropped  int
+	streams  int
+	openedAt map[network.Stream]time.Time
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// New constructs a new wire logger writing to w, typically a file. Logging is
+// disabled for all peers until enabled with Enable or EnableAll.
+func New(h host.Host, w io.Writer, opts ...Option) (*Logger, error) {
+	cfg := config{
+		maxBytes:     64 << 20,
+		linesPerSec:  100,
+		maxFieldSize: 512,
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	sub, err := h.EventBus().Subscribe([]interface{}{
+		new(event.EvtPeerIdentificationCompleted),
+		new(event.EvtPeerIdentificationFailed),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Logger{
+		host:     h,
+		cfg:      cfg,
+		sub:      sub,
+		w:        w,
+		peers:    make(map[peer.ID]struct{}),
+		openedAt: make(map[network.Stream]time.Time),
+		done:     make(chan struct{}),
+	}
+	h.Network().Notify((*notifiee)(l))
+	go l.background()
+	return l, nil
+}
+
+// Enable enables logging for the given peer.
+func (l *Logger) Enable(p peer.ID) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.peers[p] = struct{}{}
+}
+
+// Disable disables logging for the given peer.
+func (l *Logger) Disable(p peer.ID) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.peers, p)
+}
+
+// EnableAll enables or disables logging for all peers, regardless of the
+// peers enabled individually.
+func (l *Logger) EnableAll(enabled bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.all = enabled
+}
+
+// Close stops logging. It doesn't close the writer.
+func (l *Logger) Close() error {
+	l.closeOnce.Do(func() {
+		l.host.Network().StopNotify((*notifiee)(l))
+		l.sub.Close()
+		<-l.done
+	})
+	return nil
+}
+
+func (l *Logger) background() {
+	defer close(l.done)
+	for e := range l.sub.Out() {
+		switch evt := e.(type) {
+		case event.EvtPeerIdentificationCompleted:
+			if !l.enabled(evt.Peer) {
+				continue
+			}
+			l.logIdentify(evt.Peer)
+		case event.EvtPeerIdentificationFailed:
+			l.log(evt.Peer, "identify-failed", "error", evt.Reason)
+		}
+	}
+}
+
+func (l *Logger) logIdentify(p peer.ID) {
+	ps := l.host.Peerstore()
+	av, _ := ps.Get(p, "AgentVersion")
+	pv, _ := ps.Get(p, "ProtocolVersion")
+	protos, _ := ps.GetProtocols(p)
+	l.log(p, "identify",
+		"agent", av,
+		"version", pv,
+		"addrs", ps.Addrs(p),
+		"protocols", protos,
+	)
+}
+
+func (l *Logger) enabled(p peer.ID) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.all {
+		return true
+	}
+	_, ok := l.peers[p]
+	return ok
+}
+
+// log writes a line for the given peer, if logging is enabled for it and
+// we're within our limits. kvs are alternating keys and values.
+func (l *Logger) log(p peer.ID, evt string, kvs ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.peers[p]; !ok && !l.all {
+		return
+	}
+	if l.capped {
+		return
+	}
+
+	now := time.Now()
+	if now.Sub(l.window) >= time.Second {
+		l.window = now
+		l.lines = 0
+		if l.dropped > 0 {
+			l.writeLine(fmt.Sprintf("%s - rate-limited dropped=%d\n", now.Format(time.RFC3339Nano), l.dropped))
+			l.dropped = 0
+		}
+	}
+	if l.cfg.linesPerSec > 0 && l.lines >= l.cfg.linesPerSec {
+		l.dropped++
+		return
+	}
+	l.lines++
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s %s", now.Format(time.RFC3339Nano), peerlabel.Format(l.host.Peerstore(), p), evt)
+	for i := 0; i+1 < len(kvs); i += 2 {
+		fmt.Fprintf(&b, " %s=%s", kvs[i], l.truncate(fmt.Sprint(kvs[i+1])))
+	}
+	b.WriteByte('\n')
+	l.writeLine(b.String())
+}
+
+func (l *Logger) truncate(s string) string {
+	if l.cfg.maxFieldSize <= 0 || len(s) <= l.cfg.maxFieldSize {
+		return s
+	}
+	return s[:l.cfg.maxFieldSize] + "...(truncated)"
+}
+
+// writeLine writes a line, capping the total size of the log. Must be called
+// with the lock held.
+func (l *Logger) writeLine(line string) {
+	if l.cfg.maxBytes > 0 && l.written+int64(len(line)) > l.cfg.maxBytes {
+		l.capped = true
+		log.Warnw("wire log size limit reached, logging stopped", "limit", l.cfg.maxBytes)
+		return
+	}
+	n, err := io.WriteString(l.w, line)
+	l.written += int64(n)
+	if err != nil {
+		log.Warnw("failed to write wire log, logging stopped", "error", err)
+		l.capped = true
+	}
+}
+
+type notifiee Logger
+
+var _ network.Notifiee = (*notifiee)(nil)
+
+func (n *notifiee) logger() *Logger {
+	return (*Logger)(n)
+}
+
+func (n *notifiee) Connected(_ network.Network, c network.Conn) {
+	n.logger().log(c.RemotePeer(), "connected",
+		"dir", c.Stat().Direction,
+		"local", c.LocalMultiaddr(),
+		"remote", c.RemoteMultiaddr(),
+	)
+}
+
+func (n *notifiee) Disconnected(_ network.Network, c network.Conn) {
+	n.logger().log(c.RemotePeer(), "disconnected",
+		"local", c.LocalMultiaddr(),
+		"remote", c.RemoteMultiaddr(),
+	)
+}
+
+func (n *notifiee) OpenedStream(_ network.Network, s network.Stream) {
+	l := n.logger()
+	p := s.Conn().RemotePeer()
+	if !l.enabled(p) {
+		return
+	}
+	l.mu.Lock()
+	l.streams++
+	sampled := l.cfg.sampleStreams <= 1 || l.streams%l.cfg.sampleStreams == 0
+	if sampled {
+		l.openedAt[s] = time.Now()
+	}
+	l.mu.Unlock()
+	if !sampled {
+		return
+	}
+	l.log(p, "stream-opened", "dir", s.Stat().Direction, "remote", s.Conn().RemoteMultiaddr())
+}
+
+// ClosedStream logs the protocol negotiated on the stream with multistream,
+// along with how long the stream was open.
+func (n *notifiee) ClosedStream(_ network.Network, s network.Stream) {
+	l := n.logger()
+	l.mu.Lock()
+	opened, ok := l.openedAt[s]
+	delete(l.openedAt, s)
+	l.mu.Unlock()
+	if !ok {
+		// opened before logging was enabled, or not sampled.
+		return
+	}
+
+	proto := string(s.Protocol())
+	if proto == "" {
+		proto = "<not negotiated>"
+	}
+	l.log(s.Conn().RemotePeer(), "stream-closed",
+		"dir", s.Stat().Direction,
+		"protocol", proto,
+		"duration", time.Since(opened),
+	)
+}
+
+func (n *notifiee) Listen(network.Network, ma.Multiaddr)      {}
+func (n *notifiee) ListenClose(network.Network, ma.Multiaddr) {}
@@ -0,0 +1,121 @@
+package wirelog
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/event"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	blhost "github.com/libp2p/go-libp2p-blankhost"
+	swarmt "github.com/libp2p/go-libp2p-swarm/testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestWireLog(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	defer h2.Close()
+	h2.SetStreamHandler("/test", func(s network.Stream) { s.Close() })
+
+	var buf syncBuffer
+	l, err := New(h1, &buf)
+	require.NoError(t, err)
+	defer l.Close()
+
+	// nothing is logged until we enable logging for the peer.
+	require.NoError(t, h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+	require.Empty(t, buf.String())
+
+	l.Enable(h2.ID())
+	s, err := h1.NewStream(ctx, h2.ID(), "/test")
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	em, err := h1.EventBus().Emitter(new(event.EvtPeerIdentificationCompleted))
+	require.NoError(t, err)
+	defer em.Close()
+	require.NoError(t, em.Emit(event.EvtPeerIdentificationCompleted{Peer: h2.ID()}))
+
+	require.Eventually(t, func() bool {
+		out := buf.String()
+		return strings.Contains(out, "stream-opened") &&
+			strings.Contains(out, "stream-closed dir=Outbound protocol=/test") &&
+			strings.Contains(out, h2.ID().Pretty()+" identify")
+	}, 5*time.Second, 10*time.Millisecond, buf.String())
+
+	l.Disable(h2.ID())
+	before := buf.String()
+	s, err = h1.NewStream(ctx, h2.ID(), "/test")
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, before, buf.String())
+}
+
+func TestWireLogLimits(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	defer h.Close()
+	p := peer.ID("peer")
+
+	var buf syncBuffer
+	l, err := New(h, &buf, RateLimit(2), MaxFieldSize(4))
+	require.NoError(t, err)
+	defer l.Close()
+	l.EnableAll(true)
+
+	for i := 0; i < 5; i++ {
+		l.log(p, "test", "field", "0123456789")
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 2)
+	require.True(t, strings.HasSuffix(lines[0], "field=0123...(truncated)"), lines[0])
+
+	// the number of dropped lines is reported once we're allowed to log
+	// again.
+	l.mu.Lock()
+	l.window = time.Time{}
+	l.mu.Unlock()
+	l.log(p, "test")
+	require.Contains(t, buf.String(), "rate-limited dropped=3")
+
+	// once the size cap is hit, we stop logging.
+	l.mu.Lock()
+	l.cfg.linesPerSec = 0
+	l.cfg.maxBytes = int64(len(buf.buf.String())) + 10
+	l.mu.Unlock()
+	before := buf.String()
+	l.log(p, "test", "field", "0123456789")
+	l.log(p, "t")
+	require.Equal(t, before, buf.String())
+}
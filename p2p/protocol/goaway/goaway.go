@@ -0,0 +1,250 @@
+// Package goaway implements a protocol for peers to announce that they're
+// shutting down, e.g. during rolling deploys of server fleets.
+//
+// A peer about to shut down tells its peers how long it keeps running, see
+// Service.Announce. Peers receiving the announcement emit an EvtPeerGoingAway,
+// so that applications can move their streams to other peers ahead of time,
+// and lower the peer's value in the connection manager, so that it's trimmed
+// first, without counting the shutdown as a failure. They don't dial the peer
+// again through Service.Host until the redial backoff elapsed after the
+// shutdown.
+package goaway
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/event"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+
+	"github.com/libp2p/go-libp2p/p2p/net/halfclose"
+	pb "github.com/libp2p/go-libp2p/p2p/protocol/goaway/pb"
+
+	logging "github.com/ipfs/go-log/v2"
+
+	"github.com/gogo/protobuf/proto"
+)
+
+var log = logging.Logger("goaway")
+
+// ProtocolID is the protocol peers announce their shutdown on.
+const ProtocolID = "/libp2p/goaway/1.0.0"
+
+// Tag is the connection manager tag of peers going away.
+const Tag = "goaway"
+
+// maxMessageSize is the maximum size of an announcement we read.
+const maxMessageSize = 1 << 10
+
+// ack acknowledges an announcement. When the protocol is negotiated lazily,
+// peers not speaking it just close the stream, so we can't take an empty
+// response as an acknowledgement.
+var ack = []byte{1}
+
+// ErrGoingAway is returned by Service.Host when connecting to a peer that
+// announced its shutdown, until the redial backoff elapsed.
+var ErrGoingAway = errors.New("peer is going away")
+
+// EvtPeerGoingAway is emitted when a peer announces that it's shutting down.
+type EvtPeerGoingAway struct {
+	Peer peer.ID
+	// Deadline is when the peer shuts down.
+	Deadline time.Time
+	// Reason is the reason the peer gave, if any.
+	Reason string
+}
+
+type config struct {
+	redialBackoff time.Duration
+	tagValue      int
+}
+
+// Option is an option for the Service.
+type Option func(*config)
+
+// RedialBackoff sets how long after their shutdown we refuse to dial peers
+// through Service.Host. Defaults to 30s.
+func RedialBackoff(d time.Duration) Option {
+	return func(cfg *config) {
+		cfg.redialBackoff = d
+	}
+}
+
+// TagValue sets the value peers going away are tagged with in the connection
+// manager, see Tag. It should be negative, to have them trimmed first.
+// Defaults to -100.
+func TagValue(v int) Option {
+	return func(cfg *config) {
+		cfg.tagValue = v
+	}
+}
+
+// Service serves ProtocolID, tracking the peers going away, and announces our
+// own shutdown.
+type Service struct {
+	h   host.Host
+	cfg config
+
+	emitter event.Emitter
+
+	mu    sync.Mutex
+	peers map[peer.ID]*goingAway
+}
+
+type goingAway struct {
+	deadline time.Time
+	timer    *time.Timer
+}
+
+// NewService constructs a new Service for the given host, handling the
+// announcements of its peers.
+func NewService(h host.Host, opts ...Option) (*Service, error) {
+	cfg := config{
+		redialBackoff: 30 * time.Second,
+		tagValue:      -100,
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	emitter, err := h.EventBus().Emitter(new(EvtPeerGoingAway))
+	if err != nil {
+		return nil, err
+	}
+	s := &Service{
+		h:       h,
+		cfg:     cfg,
+		emitter: emitter,
+		peers:   make(map[peer.ID]*goingAway),
+	}
+	h.SetStreamHandler(ProtocolID, halfclose.Handler(maxMessageSize, s.handle))
+	return s, nil
+}
+
+// Close stops serving ProtocolID.
+func (s *Service) Close() error {
+	s.h.RemoveStreamHandler(ProtocolID)
+	s.mu.Lock()
+	for _, ga := range s.peers {
+		ga.timer.Stop()
+	}
+	s.peers = make(map[peer.ID]*goingAway)
+	s.mu.Unlock()
+	return s.emitter.Close()
+}
+
+func (s *Service) handle(str network.Stream, req []byte) ([]byte, error) {
+	var msg pb.GoAway
+	if err := proto.Unmarshal(req, &msg); err != nil {
+		return nil, err
+	}
+	p := str.Conn().RemotePeer()
+	deadline := time.Now().Add(time.Duration(msg.DelayMs) * time.Millisecond)
+	log.Debugw("peer is going away", "peer", p, "deadline", deadline, "reason", msg.Reason)
+
+	s.mu.Lock()
+	if old, ok := s.peers[p]; ok {
+		old.timer.Stop()
+	}
+	ga := &goingAway{deadline: deadline}
+	ga.timer = time.AfterFunc(time.Until(deadline)+s.cfg.redialBackoff, func() { s.forget(p, ga) })
+	s.peers[p] = ga
+	s.mu.Unlock()
+
+	s.h.ConnManager().TagPeer(p, Tag, s.cfg.tagValue)
+	s.emitter.Emit(EvtPeerGoingAway{Peer: p, Deadline: deadline, Reason: msg.Reason})
+	return ack, nil
+}
+
+// forget stops tracking a peer once the redial backoff elapsed.
+func (s *Service) forget(p peer.ID, ga *goingAway) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.peers[p] != ga {
+		return
+	}
+	delete(s.peers, p)
+	s.h.ConnManager().UntagPeer(p, Tag)
+}
+
+// GoingAway returns when the given peer shuts down, if it announced its
+// shutdown and the redial backoff didn't elapse yet.
+func (s *Service) GoingAway(p peer.ID) (deadline time.Time, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ga, ok := s.peers[p]
+	if !ok {
+		return time.Time{}, false
+	}
+	return ga.deadline, true
+}
+
+// Announce tells all our peers that we shut down after the given delay, for
+// the given reason, which may be empty. It returns once every peer was told,
+// or the context is done, and the number of peers told.
+func (s *Service) Announce(ctx context.Context, delay time.Duration, reason string) (int, error) {
+	req, err := proto.Marshal(&pb.GoAway{DelayMs: uint64(delay / time.Millisecond), Reason: reason})
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		told int
+	)
+	for _, p := range s.h.Network().Peers() {
+		wg.Add(1)
+		go func(p peer.ID) {
+			defer wg.Done()
+			resp, err := halfclose.RoundTrip(ctx, s.h, p, req, len(ack), ProtocolID)
+			if err != nil || len(resp) == 0 {
+				log.Debugw("failed to announce shutdown", "peer", p, "error", err)
+				return
+			}
+			mu.Lock()
+			told++
+			mu.Unlock()
+		}(p)
+	}
+	wg.Wait()
+	return told, ctx.Err()
+}
+
+// Host returns the service's host, wrapped to refuse connecting to peers going
+// away, see ErrGoingAway. Streams can still be opened to them as long as we're
+// connected.
+func (s *Service) Host() host.Host {
+	return &goAwayHost{Host: s.h, s: s}
+}
+
+type goAwayHost struct {
+	host.Host
+	s *Service
+}
+
+func (h *goAwayHost) refuse(p peer.ID) bool {
+	if h.Network().Connectedness(p) == network.Connected {
+		return false
+	}
+	_, ok := h.s.GoingAway(p)
+	return ok
+}
+
+func (h *goAwayHost) Connect(ctx context.Context, pi peer.AddrInfo) error {
+	if h.refuse(pi.ID) {
+		return ErrGoingAway
+	}
+	return h.Host.Connect(ctx, pi)
+}
+
+func (h *goAwayHost) NewStream(ctx context.Context, p peer.ID, pids ...protocol.ID) (network.Stream, error) {
+	if h.refuse(p) {
+		return nil, ErrGoingAway
+	}
+	return h.Host.NewStream(ctx, p, pids...)
+}
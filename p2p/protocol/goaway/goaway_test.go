@@ -0,0 +1,78 @@
+package goaway
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/host"
+
+	swarmt "github.com/libp2p/go-libp2p-swarm/testing"
+	bhost "github.com/libp2p/go-libp2p/p2p/host/basic"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGoAway(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var hosts []host.Host
+	var services []*Service
+	for i := 0; i < 3; i++ {
+		h := bhost.New(swarmt.GenSwarm(t, ctx))
+		defer h.Close()
+		s, err := NewService(h, RedialBackoff(200*time.Millisecond))
+		require.NoError(t, err)
+		defer s.Close()
+		hosts = append(hosts, h)
+		services = append(services, s)
+	}
+	// a peer not speaking the protocol.
+	other := bhost.New(swarmt.GenSwarm(t, ctx))
+	defer other.Close()
+	for _, h := range append(hosts[1:], other) {
+		require.NoError(t, hosts[0].Connect(ctx, h.Peerstore().PeerInfo(h.ID())))
+	}
+
+	sub, err := hosts[1].EventBus().Subscribe(new(EvtPeerGoingAway))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	start := time.Now()
+	told, err := services[0].Announce(ctx, 100*time.Millisecond, "deploy")
+	require.NoError(t, err)
+	require.Equal(t, 2, told)
+
+	select {
+	case e := <-sub.Out():
+		evt := e.(EvtPeerGoingAway)
+		require.Equal(t, hosts[0].ID(), evt.Peer)
+		require.Equal(t, "deploy", evt.Reason)
+		require.WithinDuration(t, start.Add(100*time.Millisecond), evt.Deadline, 100*time.Millisecond)
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected an event")
+	}
+	for _, s := range services[1:] {
+		_, ok := s.GoingAway(hosts[0].ID())
+		require.True(t, ok)
+	}
+	_, ok := services[0].GoingAway(hosts[1].ID())
+	require.False(t, ok)
+
+	// we can still open streams while connected, but don't redial the peer.
+	h := services[1].Host()
+	pi := hosts[0].Peerstore().PeerInfo(hosts[0].ID())
+	require.NoError(t, h.Connect(ctx, pi))
+	require.NoError(t, h.Network().ClosePeer(pi.ID))
+	require.Equal(t, ErrGoingAway, h.Connect(ctx, pi))
+	_, err = h.NewStream(ctx, pi.ID, ProtocolID)
+	require.Equal(t, ErrGoingAway, err)
+
+	// until the redial backoff elapsed.
+	require.Eventually(t, func() bool {
+		_, ok := services[1].GoingAway(pi.ID)
+		return !ok
+	}, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, h.Connect(ctx, pi))
+}
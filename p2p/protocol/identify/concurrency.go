@@ -0,0 +1,73 @@
+package identify
+
+import (
+	"sync/atomic"
+)
+
+// IdentifyQueueStats describes the outbound identify requests waiting for,
+// and holding, one of the slots allowed by the MaxConcurrentIdentify option.
+type IdentifyQueueStats struct {
+	// Active is the number of identify requests currently running.
+	Active int64
+	// Queued is the number of identify requests currently waiting for a
+	// slot.
+	Queued int64
+	// MaxQueued is the largest number of requests that waited at once.
+	MaxQueued int64
+	// Waited is the total number of requests that had to wait for a slot.
+	Waited uint64
+}
+
+// IdentifyQueueStats returns the current state of the outbound identify
+// queue. Everything but Active is zero if concurrency isn't limited.
+func (ids *IDService) IdentifyQueueStats() IdentifyQueueStats {
+	return IdentifyQueueStats{
+		Active:    atomic.LoadInt64(&ids.queueStats.active),
+		Queued:    atomic.LoadInt64(&ids.queueStats.queued),
+		MaxQueued: atomic.LoadInt64(&ids.queueStats.maxQueued),
+		Waited:    atomic.LoadUint64(&ids.queueStats.waited),
+	}
+}
+
+// acquireIdentifySlot waits until we may run another outbound identify
+// request. It fails if the service is closed in the meantime. Every
+// successful call must be paired with a call to releaseIdentifySlot.
+func (ids *IDService) acquireIdentifySlot() error {
+	if ids.identifySlots != nil {
+		select {
+		case ids.identifySlots <- struct{}{}:
+		default:
+			if err := ids.waitIdentifySlot(); err != nil {
+				return err
+			}
+		}
+	}
+	atomic.AddInt64(&ids.queueStats.active, 1)
+	return nil
+}
+
+func (ids *IDService) waitIdentifySlot() error {
+	atomic.AddUint64(&ids.queueStats.waited, 1)
+	queued := atomic.AddInt64(&ids.queueStats.queued, 1)
+	defer atomic.AddInt64(&ids.queueStats.queued, -1)
+	for {
+		max := atomic.LoadInt64(&ids.queueStats.maxQueued)
+		if queued <= max || atomic.CompareAndSwapInt64(&ids.queueStats.maxQueued, max, queued) {
+			break
+		}
+	}
+
+	select {
+	case ids.identifySlots <- struct{}{}:
+		return nil
+	case <-ids.ctx.Done():
+		return ids.ctx.Err()
+	}
+}
+
+func (ids *IDService) releaseIdentifySlot() {
+	atomic.AddInt64(&ids.queueStats.active, -1)
+	if ids.identifySlots != nil {
+		<-ids.identifySlots
+	}
+}
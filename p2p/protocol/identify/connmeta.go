@@ -0,0 +1,50 @@
+package identify
+
+import (
+	"github.com/libp2p/go-libp2p-core/network"
+
+	pb "github.com/libp2p/go-libp2p/p2p/protocol/identify/pb"
+)
+
+// ConnMetadata returns the per-connection metadata the remote peer sent us in
+// its last Identify message on the given connection, or nil if it didn't send
+// any. See the ConnMetadata option. The returned map must not be modified.
+//
+// The metadata is available once the connection is identified: stream
+// handlers can wait for it with IdentifyWait, or rely on the host holding
+// streams until then. Connections identified by reusing the result of another
+// connection, see the DedupIdentify option, carry no metadata.
+func (ids *IDService) ConnMetadata(c network.Conn) map[string][]byte {
+	ids.connMetadataMu.RLock()
+	defer ids.connMetadataMu.RUnlock()
+	return ids.connMetadata[c]
+}
+
+// consumeConnMetadata stores the per-connection metadata of an Identify
+// message. Identify messages carry the full state, so this replaces whatever
+// the peer sent us previously on the connection.
+func (ids *IDService) consumeConnMetadata(c network.Conn, entries []*pb.MetadataEntry) {
+	ids.connMetadataMu.Lock()
+	defer ids.connMetadataMu.Unlock()
+
+	// don't resurrect the metadata of a connection that closed meanwhile.
+	ids.connsMu.RLock()
+	_, tracked := ids.conns[c]
+	ids.connsMu.RUnlock()
+	if len(entries) == 0 || !tracked {
+		delete(ids.connMetadata, c)
+		return
+	}
+	md := make(map[string][]byte, len(entries))
+	for _, e := range entries {
+		md[e.GetKey()] = e.GetValue()
+	}
+	ids.connMetadata[c] = md
+}
+
+// forgetConnMetadata drops the metadata of a closed connection.
+func (ids *IDService) forgetConnMetadata(c network.Conn) {
+	ids.connMetadataMu.Lock()
+	delete(ids.connMetadata, c)
+	ids.connMetadataMu.Unlock()
+}
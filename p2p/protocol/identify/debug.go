@@ -0,0 +1,208 @@
+package identify
+
+import (
+	"bytes"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// IdentifyStage is the stage an identify run on a connection is at.
+type IdentifyStage int32
+
+const (
+	// IdentifyStarting runs haven't started yet, or are waiting for another
+	// run with the same peer, see the DedupIdentify option.
+	IdentifyStarting IdentifyStage = iota
+	// IdentifyQueued runs wait for a slot, see the MaxConcurrentIdentify
+	// option.
+	IdentifyQueued
+	// IdentifyOpening runs are opening a stream to the peer.
+	IdentifyOpening
+	// IdentifyNegotiating runs are negotiating the identify protocol.
+	IdentifyNegotiating
+	// IdentifyReading runs wait for the peer's response.
+	IdentifyReading
+	// IdentifyDone runs are complete, with their result set.
+	IdentifyDone
+)
+
+func (s IdentifyStage) String() string {
+	switch s {
+	case IdentifyStarting:
+		return "starting"
+	case IdentifyQueued:
+		return "queued"
+	case IdentifyOpening:
+		return "opening"
+	case IdentifyNegotiating:
+		return "negotiating"
+	case IdentifyReading:
+		return "reading"
+	case IdentifyDone:
+		return "done"
+	default:
+		return "unknown"
+	}
+}
+
+// DebugState is a snapshot of the internal state of the service, see
+// DebugDump.
+type DebugState struct {
+	// Conns are the identify runs of the connections we track, oldest first.
+	Conns []ConnDebugState
+	// Handlers are the per-peer handlers sending Identify Push and Delta
+	// updates. There are none if both are disabled.
+	Handlers []HandlerDebugState
+	// Errors are the last errors of the peers we're connected to.
+	Errors map[peer.ID]PeerError
+	// Queue is the state of the outbound identify queue.
+	Queue IdentifyQueueStats
+}
+
+// ConnDebugState is the state of the identify run of a connection.
+type ConnDebugState struct {
+	Peer       peer.ID
+	RemoteAddr ma.Multiaddr
+	Stage      IdentifyStage
+	// Started is when the run was requested.
+	Started time.Time
+	// Refresh is true for runs requested with Refresh.
+	Refresh bool
+	// Result is the outcome of the run, once done.
+	Result IdentifyResult
+}
+
+// HandlerDebugState is the state of the handler sending updates to a peer.
+type HandlerDebugState struct {
+	Peer peer.ID
+	// Running is false for handlers being stopped, after the peer
+	// disconnected.
+	Running bool
+	// PendingPush, PendingDelta and PendingRefresh are true if a push, a
+	// delta or a record refresh is waiting to be sent.
+	PendingPush    bool
+	PendingDelta   bool
+	PendingRefresh bool
+	// SnapshotSeq is the sequence number of the last snapshot of our state
+	// sent to the peer.
+	SnapshotSeq uint64
+}
+
+// PeerError is the last error of a peer.
+type PeerError struct {
+	// Op is what failed: "identify", "push", "delta" or "refresh".
+	Op   string
+	Err  error
+	Time time.Time
+}
+
+// DebugDump returns the internal state of the service, to diagnose stuck
+// identify runs and updates. It's meant for debugging only: the format of the
+// state may change at any time.
+func (ids *IDService) DebugDump() DebugState {
+	st := DebugState{
+		Conns:    ids.connsDebugState(),
+		Handlers: ids.handlersDebugState(),
+		Errors:   make(map[peer.ID]PeerError),
+		Queue:    ids.IdentifyQueueStats(),
+	}
+	ids.peerErrsMu.Lock()
+	for p, e := range ids.peerErrs {
+		st.Errors[p] = e
+	}
+	ids.peerErrsMu.Unlock()
+	return st
+}
+
+func (ids *IDService) connsDebugState() []ConnDebugState {
+	ids.connsMu.RLock()
+	out := make([]ConnDebugState, 0, len(ids.conns))
+	for c, wait := range ids.conns {
+		st := ConnDebugState{
+			Peer:       c.RemotePeer(),
+			RemoteAddr: c.RemoteMultiaddr(),
+			Stage:      wait.getStage(),
+			Started:    wait.started,
+			Refresh:    wait.refresh,
+		}
+		select {
+		case <-wait.done:
+			st.Result = wait.result
+		default:
+		}
+		out = append(out, st)
+	}
+	ids.connsMu.RUnlock()
+
+	sort.Slice(out, func(i, j int) bool { return out[i].Started.Before(out[j].Started) })
+	return out
+}
+
+func (ids *IDService) handlersDebugState() []HandlerDebugState {
+	if !ids.trackPeers() {
+		return nil
+	}
+	resp := make(chan []HandlerDebugState, 1)
+	select {
+	case ids.debugCh <- resp:
+	case <-ids.ctx.Done():
+		return nil
+	}
+	var out []HandlerDebugState
+	select {
+	case out = <-resp:
+	case <-ids.ctx.Done():
+		return nil
+	}
+	sort.Slice(out, func(i, j int) bool { return bytes.Compare([]byte(out[i].Peer), []byte(out[j].Peer)) < 0 })
+	return out
+}
+
+// debugState returns the state of the handler. It must be called from the
+// service's loop, which starts and stops handlers.
+func (ph *peerHandler) debugState() HandlerDebugState {
+	ph.snapshotMu.RLock()
+	seq := ph.snapshot.seq
+	ph.snapshotMu.RUnlock()
+	return HandlerDebugState{
+		Peer:           ph.pid,
+		Running:        ph.cancel != nil,
+		PendingPush:    len(ph.pushCh) > 0,
+		PendingDelta:   len(ph.deltaCh) > 0,
+		PendingRefresh: len(ph.refreshCh) > 0,
+		SnapshotSeq:    seq,
+	}
+}
+
+func (w *identifyWait) setStage(s IdentifyStage) {
+	atomic.StoreInt32(&w.stage, int32(s))
+}
+
+func (w *identifyWait) getStage() IdentifyStage {
+	return IdentifyStage(atomic.LoadInt32(&w.stage))
+}
+
+// peerError records the last error of a peer. Nil errors, and those of peers
+// we're no longer connected to, are ignored.
+func (ids *IDService) peerError(p peer.ID, op string, err error) {
+	if err == nil || ids.Host.Network().Connectedness(p) != network.Connected {
+		return
+	}
+	ids.peerErrsMu.Lock()
+	ids.peerErrs[p] = PeerError{Op: op, Err: err, Time: time.Now()}
+	ids.peerErrsMu.Unlock()
+}
+
+// forgetPeerError drops the last error of the given peer, once we're
+// disconnected from it.
+func (ids *IDService) forgetPeerError(p peer.ID) {
+	ids.peerErrsMu.Lock()
+	delete(ids.peerErrs, p)
+	ids.peerErrsMu.Unlock()
+}
@@ -0,0 +1,103 @@
+package identify
+
+import (
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/event"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	pb "github.com/libp2p/go-libp2p/p2p/protocol/identify/pb"
+)
+
+// peerIdentify is the latest identify run with a peer, see the DedupIdentify
+// option.
+type peerIdentify struct {
+	wait *identifyWait
+	mes  *pb.Identify
+	// completed is zero while the run is in progress.
+	completed time.Time
+}
+
+// startPeerIdentify registers the identify run on c as the latest one with
+// its remote peer, unless another run can be reused instead. It returns false
+// if that's the case, after completing wait with the result of that run.
+//
+// When another run is in progress, we wait for it: if it fails, we take over.
+// Runs requested with Refresh never reuse other runs.
+func (ids *IDService) startPeerIdentify(c network.Conn, wait *identifyWait) bool {
+	if ids.dedupWindow <= 0 {
+		return true
+	}
+	p := c.RemotePeer()
+	for {
+		ids.dedupMu.Lock()
+		last, ok := ids.peerIdentifies[p]
+		if !ok || wait.refresh || !last.reusable(ids.dedupWindow) {
+			ids.peerIdentifies[p] = &peerIdentify{wait: wait}
+			ids.dedupMu.Unlock()
+			return true
+		}
+		if !last.completed.IsZero() {
+			ids.dedupMu.Unlock()
+			ids.reusePeerIdentify(c, wait, last)
+			return false
+		}
+		ids.dedupMu.Unlock()
+
+		select {
+		case <-last.wait.done:
+		case <-ids.ctx.Done():
+			return true
+		}
+	}
+}
+
+// reusable returns true if the run is in progress, or succeeded within the
+// given window.
+func (pi *peerIdentify) reusable(window time.Duration) bool {
+	if pi.completed.IsZero() {
+		return true
+	}
+	return pi.wait.result.Err == nil && time.Since(pi.completed) < window
+}
+
+// finishPeerIdentify records the outcome of the identify run on c.
+func (ids *IDService) finishPeerIdentify(c network.Conn, wait *identifyWait, mes *pb.Identify) {
+	if ids.dedupWindow <= 0 {
+		return
+	}
+	ids.dedupMu.Lock()
+	defer ids.dedupMu.Unlock()
+	if last, ok := ids.peerIdentifies[c.RemotePeer()]; ok && last.wait == wait {
+		last.mes = mes
+		last.completed = time.Now()
+	}
+}
+
+func (ids *IDService) reusePeerIdentify(c network.Conn, wait *identifyWait, last *peerIdentify) {
+	p := c.RemotePeer()
+	log.Debugw("reusing recent identify result", "peer", p, "age", time.Since(last.completed))
+
+	wait.result = last.wait.result
+	wait.result.Reused = true
+	wait.setStage(IdentifyDone)
+	close(wait.done)
+
+	evt := ids.newEvtPeerIdentified(c, last.mes)
+	// the peer observed us on another connection.
+	evt.ObservedAddr = nil
+	ids.emitters.evtPeerIdentified.Emit(evt)
+	ids.emitters.evtPeerIdentificationCompleted.Emit(event.EvtPeerIdentificationCompleted{Peer: p})
+}
+
+// forgetPeerIdentify drops the latest identify run with the given peer, once
+// we're disconnected from it.
+func (ids *IDService) forgetPeerIdentify(p peer.ID) {
+	if ids.dedupWindow <= 0 {
+		return
+	}
+	ids.dedupMu.Lock()
+	delete(ids.peerIdentifies, p)
+	ids.dedupMu.Unlock()
+}
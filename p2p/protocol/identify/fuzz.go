@@ -0,0 +1,52 @@
+package identify
+
+import (
+	"bytes"
+
+	"github.com/libp2p/go-libp2p-core/network"
+
+	pb "github.com/libp2p/go-libp2p/p2p/protocol/identify/pb"
+
+	"github.com/libp2p/go-msgio/protoio"
+)
+
+// The Fuzz methods feed untrusted bytes to the decoders peers reach, going
+// through the same validation and peerstore updates as messages read from
+// streams, so that fuzzers exercise them with the service's configuration.
+// The fuzz targets of this package, run with e.g.
+//
+//	go test -run '^$' -fuzz FuzzIdentifyResponse ./p2p/protocol/identify
+//
+// use a default configuration; downstream users can call these methods from
+// their own targets to fuzz theirs. The given connection must be open, its
+// remote peer plays the sender of the data.
+
+// FuzzIdentifyResponse processes data as the content of an Identify or
+// Identify Push stream sent by the remote peer of c: one or more
+// length-delimited messages, merged into one.
+func (ids *IDService) FuzzIdentifyResponse(c network.Conn, data []byte) error {
+	r := protoio.NewDelimitedReader(bytes.NewReader(data), ids.maxMessageSize)
+	mes := &pb.Identify{}
+	if err := readAllIDMessages(r, mes); err != nil {
+		return err
+	}
+	if err := ids.checkMessage(mes, c); err != nil {
+		return err
+	}
+	ids.consumeMessage(mes, c, 0)
+	return nil
+}
+
+// FuzzDelta processes data as the content of an Identify Delta stream sent by
+// the remote peer of c: a single length-delimited message.
+func (ids *IDService) FuzzDelta(c network.Conn, data []byte) error {
+	r := protoio.NewDelimitedReader(bytes.NewReader(data), ids.maxMessageSize)
+	mes := &pb.Identify{}
+	if err := r.ReadMsg(mes); err != nil {
+		return err
+	}
+	if delta := mes.GetDelta(); delta != nil {
+		return ids.consumeDelta(c, delta)
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+//go:build go1.18
+// +build go1.18
+
+package identify_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+
+	ic "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/record"
+	"github.com/libp2p/go-libp2p-core/test"
+
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/libp2p/go-libp2p/p2p/protocol/identify"
+	pb "github.com/libp2p/go-libp2p/p2p/protocol/identify/pb"
+
+	"github.com/libp2p/go-msgio/protoio"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+// fuzzSetup connects two hosts running identify, and returns h1's service, its
+// connection to h2, and h2's raw Identify response and signed peer record.
+func fuzzSetup(f *testing.F) (ids *identify.IDService, c network.Conn, response, signedRecord []byte) {
+	ctx, cancel := context.WithCancel(context.Background())
+	f.Cleanup(cancel)
+
+	// swarm test helpers need a *testing.T, use mock hosts instead.
+	mn := mocknet.New(ctx)
+	newHost := func(addr string) host.Host {
+		sk, _, err := test.RandTestKeyPair(ic.Ed25519, 0)
+		require.NoError(f, err)
+		h, err := mn.AddPeer(sk, ma.StringCast(addr))
+		require.NoError(f, err)
+		return h
+	}
+	h1 := newHost("/ip4/1.2.3.4/tcp/4001")
+	h2 := newHost("/ip4/1.2.3.5/tcp/4001")
+	require.NoError(f, mn.LinkAll())
+	require.NoError(f, h1.Connect(ctx, peer.AddrInfo{ID: h2.ID()}))
+
+	ids = h1.(interface{ IDService() *identify.IDService }).IDService()
+	c = h1.Network().ConnsToPeer(h2.ID())[0]
+	ids.IdentifyConn(c)
+
+	s, err := h1.NewStream(ctx, h2.ID(), identify.ID)
+	require.NoError(f, err)
+	response, err = ioutil.ReadAll(s)
+	require.NoError(f, err)
+
+	env, err := record.Seal(peer.PeerRecordFromAddrInfo(peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}), h2.Peerstore().PrivKey(h2.ID()))
+	require.NoError(f, err)
+	signedRecord, err = env.Marshal()
+	require.NoError(f, err)
+	return ids, c, response, signedRecord
+}
+
+func delimited(f *testing.F, mes *pb.Identify) []byte {
+	var buf bytes.Buffer
+	require.NoError(f, protoio.NewDelimitedWriter(&buf).WriteMsg(mes))
+	return buf.Bytes()
+}
+
+func FuzzIdentifyResponse(f *testing.F) {
+	ids, c, response, signedRecord := fuzzSetup(f)
+
+	f.Add(response)
+	f.Add(delimited(f, &pb.Identify{SignedPeerRecord: signedRecord}))
+	f.Add(delimited(f, &pb.Identify{
+		ListenAddrs:  [][]byte{c.RemoteMultiaddr().Bytes(), {0x04, 0x7f}},
+		ObservedAddr: []byte{0x29, 0x00},
+		Protocols:    []string{"/test"},
+	}))
+	f.Add([]byte{})
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, 0x0f})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_ = ids.FuzzIdentifyResponse(c, data)
+	})
+}
+
+func FuzzDelta(f *testing.F) {
+	ids, c, _, signedRecord := fuzzSetup(f)
+
+	f.Add(delimited(f, &pb.Identify{Delta: &pb.Delta{
+		AddedProtocols: []string{"/added"},
+		RmProtocols:    []string{"/removed"},
+	}}))
+	f.Add(delimited(f, &pb.Identify{Delta: &pb.Delta{
+		AddedAddrs:       [][]byte{c.RemoteMultiaddr().Bytes()},
+		RmAddrs:          [][]byte{{0x04, 0x7f}},
+		SignedPeerRecord: signedRecord,
+	}}))
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_ = ids.FuzzDelta(c, data)
+	})
+}
+
+func FuzzSignedPeerRecord(f *testing.F) {
+	_, _, _, signedRecord := fuzzSetup(f)
+
+	f.Add(signedRecord)
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		env, rec, err := record.ConsumeEnvelope(data, peer.PeerRecordEnvelopeDomain)
+		if err != nil {
+			return
+		}
+		if _, ok := rec.(*peer.PeerRecord); !ok {
+			return
+		}
+		// accepted envelopes must survive a round trip.
+		b, err := env.Marshal()
+		require.NoError(t, err)
+		_, _, err = record.ConsumeEnvelope(b, peer.PeerRecordEnvelopeDomain)
+		require.NoError(t, err)
+	})
+}
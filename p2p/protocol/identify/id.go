@@ -2,10 +2,13 @@ package identify
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"runtime/debug"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	ic "github.com/libp2p/go-libp2p-core/crypto"
@@ -14,6 +17,7 @@ import (
 	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/libp2p/go-libp2p-core/protocol"
 	"github.com/libp2p/go-libp2p-core/record"
 
 	"github.com/libp2p/go-eventbus"
@@ -49,6 +53,30 @@ var ClientVersion = "github.com/libp2p/go-libp2p"
 // StreamReadTimeout is the read timeout on all incoming Identify family streams.
 var StreamReadTimeout = 60 * time.Second
 
+// DefaultMaxMessageSize is the default maximum size of a single Identify
+// family message we accept. See the MaxMessageSize option.
+const DefaultMaxMessageSize = 32 * 1024
+
+// ErrTimeout is returned when identifying a peer takes longer than the
+// configured timeout. See the Timeout option.
+var ErrTimeout = errors.New("identify timed out")
+
+// ErrNotConnected is returned by Refresh for peers we aren't connected to.
+var ErrNotConnected = errors.New("not connected to peer")
+
+// ErrMessageTooLarge is returned when a peer sends us an Identify family message
+// larger than we accept.
+var ErrMessageTooLarge = errors.New("identify message too large")
+
+// EvtMessageTooLarge is emitted when we reject an Identify family message for
+// exceeding the configured size limit.
+type EvtMessageTooLarge struct {
+	Peer     peer.ID
+	Protocol protocol.ID
+	// Limit is the maximum message size we accept.
+	Limit int
+}
+
 var (
 	legacyIDSize = 2 * 1024 // 2k Bytes
 	signedIDSize = 8 * 1024 // 8K
@@ -86,6 +114,21 @@ type rmPeerHandlerReq struct {
 //  * Our IPFS Agent Version
 //  * Our public Listen Addresses
 type IDService struct {
+	// accessed atomically, kept first for 64-bit alignment on 32-bit platforms.
+	updateStats struct {
+		coalesced, failed, retried uint64
+	}
+	limitStats struct {
+		addrsTruncated, recordsDropped, updatesDropped uint64
+	}
+	refreshStats struct {
+		scheduled, succeeded, failed uint64
+	}
+	queueStats struct {
+		active, queued, maxQueued int64
+		waited                    uint64
+	}
+
 	Host      host.Host
 	UserAgent string
 
@@ -97,30 +140,146 @@ type IDService struct {
 	refCount sync.WaitGroup
 
 	disableSignedPeerRecord bool
+	disablePush             bool
+	disableDelta            bool
+
+	// reject malformed identify messages, see the StrictValidation option.
+	strictValidation  bool
+	disconnectInvalid bool
+	validationStats   validationStats
+
+	// running over insecure transports, see the InsecureMode option.
+	insecure bool
+
+	// decides what to do with peers sending mismatching keys, nil to ignore
+	// them. See the KeyMismatchPolicy option.
+	keyMismatchPolicy func(EvtPeerKeyMismatch) KeyMismatchAction
+
+	// the protocol IDs we serve and dial, most preferred first. See the
+	// WithProtocolIDs option.
+	protocols []ProtocolIDs
+
+	// rejects peers with an unexpected protocol version, nil to accept all.
+	protocolVersionCheck func(string) bool
 
 	// Identified connections (finished and in progress).
 	connsMu sync.RWMutex
-	conns   map[network.Conn]chan struct{}
+	conns   map[network.Conn]*identifyWait
 
 	addrMu sync.Mutex
 
+	// application-defined metadata sent with our identify messages.
+	metadataMu sync.RWMutex
+	metadata   map[string][]byte
+
+	// per-connection metadata we send, nil if we don't send any, and the
+	// metadata peers sent us, by connection. See the ConnMetadata option.
+	connMetadataFunc func(network.Conn) map[string][]byte
+	connMetadataMu   sync.RWMutex
+	connMetadata     map[network.Conn]map[string][]byte
+
 	// our own observed addresses.
 	observedAddrs *ObservedAddrManager
 
+	// transforms the addresses we advertise, nil if we advertise Host.Addrs().
+	addrsFactory func([]ma.Multiaddr) []ma.Multiaddr
+	// signed peer record for the addresses returned by the addrsFactory.
+	recordMu    sync.Mutex
+	record      *record.Envelope
+	recordAddrs []ma.Multiaddr
+
+	// retry failed push/delta updates, see the RetryUpdates option.
+	retryInterval    time.Duration
+	retryMaxAttempts int
+
+	// don't record observations made over relayed connections at all.
+	ignoreRelayed bool
+
+	// coalesces address updates into a single push, see the PushDebounce
+	// option.
+	pushDebounce time.Duration
+
+	// filters the protocols we advertise, nil if we advertise all of them.
+	protocolFilter func(protocol.ID) bool
+
+	// timeout of Identify family exchanges, StreamReadTimeout if 0.
+	timeout time.Duration
+
+	// only identify connections on demand, see the Lazy option.
+	lazy bool
+
+	// maximum size of a single message we read.
+	maxMessageSize int
+
+	// multiplex exchanges over a single stream per peer, see the
+	// ReuseStream option.
+	reuseStream bool
+	muxMu       sync.Mutex
+	muxStreams  map[peer.ID]*muxStream
+
+	// limits inbound requests, nil if rate limiting is disabled.
+	rateLimiter *rateLimiter
+
+	// limits what a peer's messages write to the peerstore, see the
+	// PeerstoreLimits option.
+	maxPeerAddrs int
+	writeLimiter *rateLimiter
+
+	// re-push stale signed peer records to reconnecting peers, see the
+	// RefreshSignedRecord option.
+	refreshRecord bool
+	sentSeqMu     sync.Mutex
+
+	// send address changes as deltas, see the AddrDeltas option.
+	addrDeltas bool
+
+	// what to do when the host hasn't published its signed peer record yet,
+	// see the SignMissingRecord and WaitForRecord options.
+	signMissingRecord bool
+	recordWait        time.Duration
+
+	// receives our metrics, nil if we don't report any.
+	metrics MetricsTracer
+
+	// slots for outbound identify requests, nil if their concurrency isn't
+	// limited. See the MaxConcurrentIdentify option.
+	identifySlots chan struct{}
+
+	// reuse recent identify results across connections to a peer, see the
+	// DedupIdentify option.
+	dedupWindow    time.Duration
+	dedupMu        sync.Mutex
+	peerIdentifies map[peer.ID]*peerIdentify
+
+	// the sequence number of our latest snapshot, and those of the latest
+	// snapshots peers sent us. See acceptSnapshot.
+	snapshotSeqMu sync.Mutex
+	snapshotSeq   uint64
+	peerSeqMu     sync.Mutex
+	peerSeqs      map[peer.ID]peerSnapshotSeq
+
+	// the last error of each peer, see DebugDump.
+	peerErrsMu sync.Mutex
+	peerErrs   map[peer.ID]PeerError
+
 	emitters struct {
 		evtPeerProtocolsUpdated        event.Emitter
 		evtPeerIdentificationCompleted event.Emitter
+		evtPeerIdentified              event.Emitter
 		evtPeerIdentificationFailed    event.Emitter
+		evtMessageTooLarge             event.Emitter
+		evtPeerKeyMismatch             event.Emitter
 	}
 
 	addPeerHandlerCh chan addPeerHandlerReq
 	rmPeerHandlerCh  chan rmPeerHandlerReq
+	debugCh          chan chan []HandlerDebugState
 }
 
 // NewIDService constructs a new *IDService and activates it by
 // attaching its stream handler to the given host.Host.
 func NewIDService(h host.Host, opts ...Option) (*IDService, error) {
-	var cfg config
+	cfg := config{maxMessageSize: DefaultMaxMessageSize}
 	for _, opt := range opts {
 		opt(&cfg)
 	}
@@ -137,25 +296,83 @@ func NewIDService(h host.Host, opts ...Option) (*IDService, error) {
 
 		ctx:       hostCtx,
 		ctxCancel: cancel,
-		conns:     make(map[network.Conn]chan struct{}),
+		conns:     make(map[network.Conn]*identifyWait),
 
 		disableSignedPeerRecord: cfg.disableSignedPeerRecord,
+		disablePush:             cfg.disablePush,
+		disableDelta:            cfg.disableDelta,
+		strictValidation:        cfg.strictValidation,
+		disconnectInvalid:       cfg.disconnectInvalid,
+		protocolVersionCheck:    cfg.protocolVersionCheck,
+		metadata:                make(map[string][]byte, len(cfg.metadata)),
+		maxMessageSize:          cfg.maxMessageSize,
+		protocolFilter:          cfg.protocolFilter,
+		addrsFactory:            cfg.addrsFactory,
+		retryInterval:           cfg.retryInterval,
+		timeout:                 cfg.timeout,
+		retryMaxAttempts:        cfg.retryMaxAttempts,
+		reuseStream:             cfg.reuseStream,
+		lazy:                    cfg.lazy,
+		pushDebounce:            cfg.pushDebounce,
+		ignoreRelayed:           cfg.ignoreRelayed,
+		maxPeerAddrs:            cfg.maxPeerAddrs,
+		writeLimiter:            newWriteLimiter(cfg.peerWritesPerMinute),
+		refreshRecord:           cfg.refreshRecord && !cfg.disablePush && !cfg.disableSignedPeerRecord,
+		addrDeltas:              cfg.addrDeltas && !cfg.disablePush && !cfg.disableDelta,
+		muxStreams:              make(map[peer.ID]*muxStream),
+		dedupWindow:             cfg.dedupWindow,
+		signMissingRecord:       cfg.signMissingRecord,
+		recordWait:              cfg.recordWait,
+		metrics:                 cfg.metricsTracer,
+		connMetadataFunc:        cfg.connMetadata,
+		insecure:                cfg.insecure,
+		keyMismatchPolicy:       cfg.keyMismatchPolicy,
+		connMetadata:            make(map[network.Conn]map[string][]byte),
+		peerIdentifies:          make(map[peer.ID]*peerIdentify),
+		peerSeqs:                make(map[peer.ID]peerSnapshotSeq),
+		peerErrs:                make(map[peer.ID]PeerError),
 
 		addPeerHandlerCh: make(chan addPeerHandlerReq),
 		rmPeerHandlerCh:  make(chan rmPeerHandlerReq),
+		debugCh:          make(chan chan []HandlerDebugState),
+	}
+
+	for k, v := range cfg.metadata {
+		s.metadata[k] = v
+	}
+
+	s.protocols = []ProtocolIDs{DefaultProtocolIDs}
+	if cfg.protocolIDs != nil {
+		s.protocols = []ProtocolIDs{*cfg.protocolIDs}
+		if cfg.keepDefaultProtos {
+			s.protocols = append(s.protocols, DefaultProtocolIDs)
+		}
+	}
+
+	if cfg.maxConcurrentIdentify > 0 {
+		s.identifySlots = make(chan struct{}, cfg.maxConcurrentIdentify)
+	}
+
+	if cfg.rateLimitInterval > 0 && (cfg.rateLimitGlobal > 0 || cfg.rateLimitPeer > 0) {
+		s.rateLimiter = newRateLimiter(cfg.rateLimitGlobal, cfg.rateLimitPeer, cfg.rateLimitInterval)
 	}
 
 	// handle local protocol handler updates, and push deltas to peers.
 	var err error
 
-	observedAddrs, err := NewObservedAddrManager(hostCtx, h)
+	observedAddrs, err := NewObservedAddrManagerWithOptions(hostCtx, h, cfg.observedAddrOpts)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create observed address manager: %s", err)
 	}
 	s.observedAddrs = observedAddrs
+	if cfg.maxObservedAddrs > 0 {
+		observedAddrs.SetMaxAddrs(cfg.maxObservedAddrs)
+	}
 
-	s.refCount.Add(1)
-	go s.loop()
+	if s.trackPeers() {
+		s.refCount.Add(1)
+		go s.loop()
+	}
 
 	s.emitters.evtPeerProtocolsUpdated, err = h.EventBus().Emitter(&event.EvtPeerProtocolsUpdated{})
 	if err != nil {
@@ -165,26 +382,57 @@ func NewIDService(h host.Host, opts ...Option) (*IDService, error) {
 	if err != nil {
 		log.Warnf("identify service not emitting identification completed events; err: %s", err)
 	}
+	s.emitters.evtPeerIdentified, err = h.EventBus().Emitter(&EvtPeerIdentified{})
+	if err != nil {
+		log.Warnf("identify service not emitting peer identified events; err: %s", err)
+	}
 	s.emitters.evtPeerIdentificationFailed, err = h.EventBus().Emitter(&event.EvtPeerIdentificationFailed{})
 	if err != nil {
 		log.Warnf("identify service not emitting identification failed events; err: %s", err)
 	}
+	s.emitters.evtMessageTooLarge, err = h.EventBus().Emitter(&EvtMessageTooLarge{})
+	if err != nil {
+		log.Warnf("identify service not emitting message too large events; err: %s", err)
+	}
+	s.emitters.evtPeerKeyMismatch, err = h.EventBus().Emitter(&EvtPeerKeyMismatch{})
+	if err != nil {
+		log.Warnf("identify service not emitting key mismatch events; err: %s", err)
+	}
 
 	// register protocols that do not depend on peer records.
-	h.SetStreamHandler(IDDelta, s.deltaHandler)
-	h.SetStreamHandler(ID, s.sendIdentifyResp)
-	h.SetStreamHandler(IDPush, s.pushHandler)
+	for _, p := range s.protocols {
+		if !s.disableDelta {
+			h.SetStreamHandler(p.Delta, s.deltaHandler)
+			h.SetStreamHandler(p.DeltaAddrs, s.deltaHandler)
+		}
+		h.SetStreamHandler(p.ID, s.sendIdentifyResp)
+		if s.reuseStream {
+			h.SetStreamHandler(p.Mux, s.muxHandler)
+		}
+		if !s.disablePush {
+			h.SetStreamHandler(p.Push, s.pushHandler)
+		}
+	}
 
 	h.Network().Notify((*netNotifiee)(s))
 	return s, nil
 }
 
+// trackPeers returns true if we need to track per-peer state to send Identify
+// Push or Delta updates.
+func (ids *IDService) trackPeers() bool {
+	return !ids.disablePush || !ids.disableDelta
+}
+
 func (ids *IDService) loop() {
 	defer ids.refCount.Done()
 
 	phs := make(map[peer.ID]*peerHandler)
-	sub, err := ids.Host.EventBus().Subscribe([]interface{}{&event.EvtLocalProtocolsUpdated{},
-		&event.EvtLocalAddressesUpdated{}}, eventbus.BufSize(256))
+	evts := []interface{}{&event.EvtLocalProtocolsUpdated{}}
+	if !ids.disablePush {
+		evts = append(evts, &event.EvtLocalAddressesUpdated{})
+	}
+	sub, err := ids.Host.EventBus().Subscribe(evts, eventbus.BufSize(256))
 	if err != nil {
 		log.Errorf("failed to subscribe to events on the bus, err=%s", err)
 		return
@@ -207,6 +455,27 @@ func (ids *IDService) loop() {
 	handlerCtx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	pushAll := func() {
+		for pid := range phs {
+			select {
+			case phs[pid].pushCh <- struct{}{}:
+			default:
+				atomic.AddUint64(&ids.updateStats.coalesced, 1)
+				log.Debugf("coalescing addr updated message for %s with pending update", pid.Pretty())
+			}
+		}
+	}
+
+	// address updates received within the debounce window are coalesced
+	// into a single push, sent once the window closes.
+	var debounceTimer *time.Timer
+	var debounceC <-chan time.Time
+	defer func() {
+		if debounceTimer != nil {
+			debounceTimer.Stop()
+		}
+	}()
+
 	for {
 		select {
 		case addReq := <-ids.addPeerHandlerCh:
@@ -248,26 +517,50 @@ func (ids *IDService) loop() {
 				delete(phs, rp)
 			}
 
+		case resp := <-ids.debugCh:
+			st := make([]HandlerDebugState, 0, len(phs))
+			for _, ph := range phs {
+				st = append(st, ph.debugState())
+			}
+			resp <- st
+
+		case <-debounceC:
+			debounceC = nil
+			pushAll()
+
 		case e, more := <-sub.Out():
 			if !more {
 				return
 			}
 			switch e.(type) {
 			case event.EvtLocalAddressesUpdated:
-				for pid := range phs {
-					select {
-					case phs[pid].pushCh <- struct{}{}:
-					default:
-						log.Debugf("dropping addr updated message for %s as buffer full", pid.Pretty())
-					}
+				if ids.pushDebounce <= 0 {
+					pushAll()
+					continue
+				}
+				if debounceC != nil {
+					atomic.AddUint64(&ids.updateStats.coalesced, uint64(len(phs)))
+					continue
 				}
+				if debounceTimer == nil {
+					debounceTimer = time.NewTimer(ids.pushDebounce)
+				} else {
+					debounceTimer.Reset(ids.pushDebounce)
+				}
+				debounceC = debounceTimer.C
 
 			case event.EvtLocalProtocolsUpdated:
 				for pid := range phs {
+					// without delta, send the full state instead.
+					ch := phs[pid].deltaCh
+					if ids.disableDelta {
+						ch = phs[pid].pushCh
+					}
 					select {
-					case phs[pid].deltaCh <- struct{}{}:
+					case ch <- struct{}{}:
 					default:
-						log.Debugf("dropping protocol updated message for %s as buffer full", pid.Pretty())
+						atomic.AddUint64(&ids.updateStats.coalesced, 1)
+						log.Debugf("coalescing protocol updated message for %s with pending update", pid.Pretty())
 					}
 				}
 			}
@@ -278,16 +571,48 @@ func (ids *IDService) loop() {
 	}
 }
 
+// UpdateStats counts what happened to the Identify Push and Delta updates we
+// send to peers.
+type UpdateStats struct {
+	// Coalesced is the number of updates that were merged into an update
+	// already pending for the peer. These updates aren't lost: the pending
+	// update sends our latest state.
+	Coalesced uint64
+	// Failed is the number of updates we failed to send.
+	Failed uint64
+	// Retried is the number of retries of failed updates, see the
+	// RetryUpdates option.
+	Retried uint64
+}
+
+// UpdateStats returns statistics about the Identify Push and Delta updates sent
+// to peers.
+func (ids *IDService) UpdateStats() UpdateStats {
+	return UpdateStats{
+		Coalesced: atomic.LoadUint64(&ids.updateStats.coalesced),
+		Failed:    atomic.LoadUint64(&ids.updateStats.failed),
+		Retried:   atomic.LoadUint64(&ids.updateStats.retried),
+	}
+}
+
 // Close shuts down the IDService
 func (ids *IDService) Close() error {
 	ids.closeSync.Do(func() {
 		ids.ctxCancel()
 		ids.refCount.Wait()
+		ids.closeMuxStreams()
 	})
 	return nil
 }
 
-// OwnObservedAddrs returns the addresses peers have reported we've dialed from
+// Lazy returns true if connections are only identified on demand, see the
+// Lazy option.
+func (ids *IDService) Lazy() bool {
+	return ids.lazy
+}
+
+// OwnObservedAddrs returns the addresses peers have reported we've dialed from.
+// Changes are announced with EvtObservedAddrChanged on the host's event bus.
 func (ids *IDService) OwnObservedAddrs() []ma.Multiaddr {
 	return ids.observedAddrs.Addrs()
 }
@@ -296,6 +621,93 @@ func (ids *IDService) ObservedAddrsFor(local ma.Multiaddr) []ma.Multiaddr {
 	return ids.observedAddrs.AddrsFor(local)
 }
 
+// ObservedAddrStats returns statistics of the tracking of the addresses peers
+// observe us at, see ObservedAddrManager.Stats.
+func (ids *IDService) ObservedAddrStats() ObservedAddrStats {
+	return ids.observedAddrs.Stats()
+}
+
+// ObserverDiversity returns how diverse the observers of each address peers
+// observe us at are, see ObservedAddrManager.ObserverDiversity.
+func (ids *IDService) ObserverDiversity() []ObserverDiversity {
+	return ids.observedAddrs.ObserverDiversity()
+}
+
+// ObservationLatency returns how far, in round trip time, the observers of each
+// address peers observe us at are, see ObservedAddrManager.ObservationLatency.
+func (ids *IDService) ObservationLatency() []ObservationLatency {
+	return ids.observedAddrs.ObservationLatency()
+}
+
+// NATDeviceType returns the type of our NAT for the given transport protocol,
+// as inferred from the addresses peers observe us at, see
+// ObservedAddrManager.NATDeviceType.
+func (ids *IDService) NATDeviceType(proto network.NATTransportProtocol) network.NATDeviceType {
+	return ids.observedAddrs.NATDeviceType(proto)
+}
+
+// SetMetadata attaches the given application-defined key/value pair to our
+// outgoing Identify messages, replacing any previous value for the key. Peers
+// that already identified us learn about the change the next time we push an
+// Identify update to them.
+func (ids *IDService) SetMetadata(key string, value []byte) {
+	ids.metadataMu.Lock()
+	ids.metadata[key] = value
+	ids.metadataMu.Unlock()
+}
+
+// DeleteMetadata removes the given key from our outgoing Identify messages.
+func (ids *IDService) DeleteMetadata(key string) {
+	ids.metadataMu.Lock()
+	delete(ids.metadata, key)
+	ids.metadataMu.Unlock()
+}
+
+// PeerMetadata returns the metadata the given peer sent us in its last
+// Identify message, or nil if we haven't received any.
+func (ids *IDService) PeerMetadata(p peer.ID) map[string][]byte {
+	v, err := ids.Host.Peerstore().Get(p, "IdentifyMetadata")
+	if err != nil {
+		return nil
+	}
+	md, _ := v.(map[string][]byte)
+	return md
+}
+
+// IdentifyResult is the outcome of identifying a connection.
+type IdentifyResult struct {
+	// Err is nil if the peer was identified successfully.
+	Err error
+	// Protocol is the identify protocol negotiated with the peer, if we got
+	// that far.
+	Protocol protocol.ID
+	// ProtocolVersion and AgentVersion are the versions the peer identified
+	// itself with.
+	ProtocolVersion string
+	AgentVersion    string
+	// Reused is true if we reused the result of identifying another
+	// connection to the peer, see the DedupIdentify option.
+	Reused bool
+}
+
+// identifyWait tracks an identify run on a connection. result is set before
+// done is closed.
+type identifyWait struct {
+	done   chan struct{}
+	result IdentifyResult
+	// refresh is true for runs requested with Refresh, which must not reuse
+	// earlier results.
+	refresh bool
+	// when the run was requested, and the IdentifyStage it's at, accessed
+	// atomically.
+	started time.Time
+	stage   int32
+}
+
+func newIdentifyWait(refresh bool) *identifyWait {
+	return &identifyWait{done: make(chan struct{}), refresh: refresh, started: time.Now()}
+}
+
 // IdentifyConn synchronously triggers an identify request on the connection and
 // waits for it to complete. If the connection is being identified by another
 // caller, this call will wait. If the connection has already been identified,
@@ -308,6 +720,28 @@ func (ids *IDService) IdentifyConn(c network.Conn) {
 // identified) and returns a channel that is closed when the identify protocol
 // completes.
 func (ids *IDService) IdentifyWait(c network.Conn) <-chan struct{} {
+	return ids.getIdentifyWait(c).done
+}
+
+// IdentifyWaitResult is like IdentifyWait, but the returned channel delivers
+// the outcome of the identify protocol once it completes, allowing callers to
+// tell a successful identify from a failed one.
+func (ids *IDService) IdentifyWaitResult(c network.Conn) <-chan IdentifyResult {
+	wait := ids.getIdentifyWait(c)
+	resCh := make(chan IdentifyResult, 1)
+	select {
+	case <-wait.done:
+		resCh <- wait.result
+	default:
+		go func() {
+			<-wait.done
+			resCh <- wait.result
+		}()
+	}
+	return resCh
+}
+
+func (ids *IDService) getIdentifyWait(c network.Conn) *identifyWait {
 	ids.connsMu.RLock()
 	wait, found := ids.conns[c]
 	ids.connsMu.RUnlock()
@@ -322,7 +756,7 @@ func (ids *IDService) IdentifyWait(c network.Conn) <-chan struct{} {
 	wait, found = ids.conns[c]
 
 	if !found {
-		wait = make(chan struct{})
+		wait = newIdentifyWait(false)
 		ids.conns[c] = wait
 
 		// Spawn an identify. The connection may actually be closed
@@ -334,30 +768,131 @@ func (ids *IDService) IdentifyWait(c network.Conn) <-chan struct{} {
 	return wait
 }
 
+// Refresh identifies the given peer again on an existing connection, and
+// updates the peerstore with the result, e.g. to get an up-to-date list of
+// its protocols after it rejected one we expected it to support. It returns
+// once identify completes, with the error of the exchange, if any. If an
+// exchange with the peer is already in progress, we wait for that one
+// instead.
+//
+// Refresh returns ErrNotConnected if we aren't connected to the peer.
+func (ids *IDService) Refresh(ctx context.Context, p peer.ID) error {
+	conns := ids.Host.Network().ConnsToPeer(p)
+	if len(conns) == 0 {
+		return ErrNotConnected
+	}
+	c := conns[0]
+
+	ids.connsMu.Lock()
+	wait, found := ids.conns[c]
+	if found {
+		select {
+		case <-wait.done:
+			found = false
+		default:
+		}
+	}
+	if !found {
+		wait = newIdentifyWait(true)
+		ids.conns[c] = wait
+		go ids.identifyConn(c, wait)
+	}
+	ids.connsMu.Unlock()
+
+	select {
+	case <-wait.done:
+		return wait.result.Err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func (ids *IDService) removeConn(c network.Conn) {
 	ids.connsMu.Lock()
 	delete(ids.conns, c)
 	ids.connsMu.Unlock()
 }
 
-func (ids *IDService) identifyConn(c network.Conn, signal chan struct{}) {
+func (ids *IDService) identifyConn(c network.Conn, wait *identifyWait) {
+	if !ids.startPeerIdentify(c, wait) {
+		return
+	}
+
 	var (
-		s   network.Stream
-		err error
+		s     network.Stream
+		mes   *pb.Identify
+		err   error
+		start time.Time
 	)
 
 	defer func() {
-		close(signal)
+		if ids.metrics != nil {
+			var rtt time.Duration
+			if !start.IsZero() {
+				rtt = time.Since(start)
+			}
+			ids.metrics.Identified(rtt, err)
+		}
+		wait.result = IdentifyResult{Err: err}
+		if s != nil {
+			wait.result.Protocol = s.Protocol()
+		}
+		if mes != nil && wait.result.Protocol == "" {
+			wait.result.Protocol = IDMux
+		}
+		if mes != nil {
+			wait.result.ProtocolVersion = mes.GetProtocolVersion()
+			wait.result.AgentVersion = mes.GetAgentVersion()
+		}
+		ids.finishPeerIdentify(c, wait, mes)
+		ids.peerError(c.RemotePeer(), "identify", err)
+		wait.setStage(IdentifyDone)
+		close(wait.done)
 
 		// emit the appropriate event.
 		if p := c.RemotePeer(); err == nil {
+			ids.emitters.evtPeerIdentified.Emit(ids.newEvtPeerIdentified(c, mes))
 			ids.emitters.evtPeerIdentificationCompleted.Emit(event.EvtPeerIdentificationCompleted{Peer: p})
+			ids.maybeRefreshRecord(p)
 		} else {
 			ids.emitters.evtPeerIdentificationFailed.Emit(event.EvtPeerIdentificationFailed{Peer: p, Reason: err})
 		}
 	}()
 
-	s, err = c.NewStream(network.WithUseTransient(context.TODO(), "identify"))
+	// wait for our turn before starting the timeout, so that queueing
+	// doesn't count against it.
+	wait.setStage(IdentifyQueued)
+	if err = ids.acquireIdentifySlot(); err != nil {
+		return
+	}
+	defer ids.releaseIdentifySlot()
+	start = time.Now()
+
+	// a single deadline bounds the whole exchange: opening and negotiating
+	// the stream, and reading the response.
+	timeout := ids.streamTimeout()
+	deadline := start.Add(timeout)
+	defer func() {
+		if isTimeout(err) {
+			err = fmt.Errorf("%w after %s: %s", ErrTimeout, timeout, err)
+		}
+	}()
+
+	// reuse our stream to the peer, if we have one.
+	if ms := ids.muxStreamTo(c.RemotePeer()); ms != nil {
+		wait.setStage(IdentifyReading)
+		if mes, err = ids.muxRequest(ms, deadline); err == nil {
+			return
+		}
+		log.Debugw("identify over existing stream failed, opening a new one", "peer", c.RemotePeer(), "error", err)
+		mes = nil
+	}
+
+	ctx, cancel := context.WithDeadline(ids.ctx, deadline)
+	defer cancel()
+
+	wait.setStage(IdentifyOpening)
+	s, err = c.NewStream(network.WithUseTransient(ctx, "identify"))
 	if err != nil {
 		log.Debugw("error opening identify stream", "error", err)
 		// the connection is probably already closed if we hit this.
@@ -369,10 +904,22 @@ func (ids *IDService) identifyConn(c network.Conn, signal chan struct{}) {
 		ids.removeConn(c)
 		return
 	}
-	s.SetProtocol(ID)
+	s.SetProtocol(ids.protocols[0].ID)
+	// bound the whole exchange, so a stalled peer can't hold us forever.
+	_ = s.SetDeadline(deadline)
 
 	// ok give the response to our handler.
-	if err = msmux.SelectProtoOrFail(ID, s); err != nil {
+	var protos []string
+	if ids.reuseStream {
+		protos = ids.muxProtocols()
+	}
+	protos = append(protos, ids.idProtocols()...)
+	wait.setStage(IdentifyNegotiating)
+	// the exchange takes a single round trip from here on, unless the peer
+	// doesn't support the first protocol we propose.
+	sent := time.Now()
+	var selected string
+	if selected, err = msmux.SelectOneOf(protos, s); err != nil {
 		log.Infow("failed negotiate identify protocol with peer",
 			"peer", c.RemotePeer(),
 			"error", err,
@@ -380,67 +927,166 @@ func (ids *IDService) identifyConn(c network.Conn, signal chan struct{}) {
 		s.Reset()
 		return
 	}
+	s.SetProtocol(protocol.ID(selected))
+	wait.setStage(IdentifyReading)
+
+	if containsString(ids.muxProtocols(), string(s.Protocol())) {
+		ms := newMuxStream(s, ids.maxMessageSize)
+		if mes, err = ids.muxRequest(ms, deadline); err == nil && !ids.addMuxStream(c.RemotePeer(), ms) {
+			// we opened another stream concurrently, keep that one.
+			_ = s.Close()
+		}
+		return
+	}
 
-	err = ids.handleIdentifyResponse(s)
+	mes, err = ids.handleIdentifyResponse(s, sent)
 }
 
-func (ids *IDService) sendIdentifyResp(s network.Stream) {
-	var ph *peerHandler
+// allowRequest returns false, and resets the stream, if the inbound request on
+// the given stream exceeds our rate limits.
+func (ids *IDService) allowRequest(s network.Stream) bool {
+	if ids.rateLimiter == nil || ids.rateLimiter.allow(s.Conn().RemotePeer()) {
+		return true
+	}
+	log.Debugw("rate limiting identify request", "protocol", s.Protocol(), "peer", s.Conn().RemotePeer())
+	_ = s.Reset()
+	return false
+}
 
-	defer func() {
-		_ = s.Close()
-		if ph != nil {
-			ph.snapshotMu.RUnlock()
-		}
-	}()
+func (ids *IDService) sendIdentifyResp(s network.Stream) {
+	if !ids.allowRequest(s) {
+		return
+	}
 
 	c := s.Conn()
+	_ = s.SetWriteDeadline(time.Now().Add(ids.streamTimeout()))
+
+	err := ids.withSnapshot(c, func(snapshot *identifySnapshot) error {
+		return ids.writeChunkedIdentifyMsg(c, snapshot, s)
+	})
+	if err != nil {
+		log.Debugw("failed to send identify response", "peer", c.RemotePeer(), "error", err)
+		_ = s.Reset()
+		return
+	}
+	_ = s.Close()
+	log.Debugf("%s sent message to %s %s", ID, c.RemotePeer(), c.RemoteMultiaddr())
+}
+
+var errPeerDisconnected = errors.New("peer disconnected")
+
+// withSnapshot calls f with the snapshot of our state to send to the remote
+// peer of c. When tracking peers, this is the snapshot of the peer's handler,
+// which must not change while we're sending it.
+func (ids *IDService) withSnapshot(c network.Conn, f func(*identifySnapshot) error) error {
+	ids.waitForRecord()
+
+	if !ids.trackPeers() {
+		return f(ids.getSnapshot())
+	}
 
+	ph, err := ids.peerHandler(c.RemotePeer())
+	if err != nil {
+		return err
+	}
+
+	ph.snapshotMu.RLock()
+	defer ph.snapshotMu.RUnlock()
+	if err := f(ph.snapshot); err != nil {
+		return err
+	}
+	ids.recordSent(c.RemotePeer(), ph.snapshot)
+	return nil
+}
+
+// peerHandler returns the handler of the given peer, starting it if needed.
+func (ids *IDService) peerHandler(p peer.ID) (*peerHandler, error) {
 	phCh := make(chan *peerHandler, 1)
 	select {
-	case ids.addPeerHandlerCh <- addPeerHandlerReq{c.RemotePeer(), phCh}:
+	case ids.addPeerHandlerCh <- addPeerHandlerReq{p, phCh}:
 	case <-ids.ctx.Done():
-		return
+		return nil, ids.ctx.Err()
 	}
 
+	var ph *peerHandler
 	select {
 	case ph = <-phCh:
 	case <-ids.ctx.Done():
-		return
+		return nil, ids.ctx.Err()
 	}
 
 	if ph == nil {
-		// Peer disconnected, abort.
-		s.Reset()
-		return
+		return nil, errPeerDisconnected
 	}
+	return ph, nil
+}
 
-	ph.snapshotMu.RLock()
-	ids.writeChunkedIdentifyMsg(c, ph.snapshot, s)
-	log.Debugf("%s sent message to %s %s", ID, c.RemotePeer(), c.RemoteMultiaddr())
+// streamTimeout returns the timeout of Identify family exchanges.
+func (ids *IDService) streamTimeout() time.Duration {
+	if ids.timeout > 0 {
+		return ids.timeout
+	}
+	return StreamReadTimeout
 }
 
-func (ids *IDService) handleIdentifyResponse(s network.Stream) error {
-	_ = s.SetReadDeadline(time.Now().Add(StreamReadTimeout))
+// isTimeout returns true if err was caused by a deadline or timeout.
+func isTimeout(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var te interface{ Timeout() bool }
+	return errors.As(err, &te) && te.Timeout()
+}
 
+// handleIdentifyResponse reads and consumes the identify message sent on the
+// stream, in response to our request sent at the given time, or zero if
+// pushed. The caller sets the read deadline.
+func (ids *IDService) handleIdentifyResponse(s network.Stream, sent time.Time) (*pb.Identify, error) {
 	c := s.Conn()
 
-	r := protoio.NewDelimitedReader(s, signedIDSize)
+	r := protoio.NewDelimitedReader(s, ids.maxMessageSize)
 	mes := &pb.Identify{}
 
 	if err := readAllIDMessages(r, mes); err != nil {
 		log.Warn("error reading identify message: ", err)
 		s.Reset()
-		return err
+		return nil, ids.checkReadErr(s, err)
+	}
+	var rtt time.Duration
+	if !sent.IsZero() {
+		rtt = time.Since(sent)
+	}
+	ids.messageReceived(s.Protocol(), mes)
+
+	if err := ids.checkMessage(mes, c); err != nil {
+		s.Reset()
+		return nil, err
 	}
 
 	defer s.Close()
 
 	log.Debugf("%s received message from %s %s", s.Protocol(), c.RemotePeer(), c.RemoteMultiaddr())
 
-	ids.consumeMessage(mes, c)
+	ids.consumeMessage(mes, c, rtt)
 
-	return nil
+	return mes, nil
+}
+
+// checkReadErr translates errors caused by a message exceeding our size limit
+// into ErrMessageTooLarge, and emits an EvtMessageTooLarge for them.
+func (ids *IDService) checkReadErr(s network.Stream, err error) error {
+	if err != io.ErrShortBuffer {
+		return err
+	}
+	ids.emitters.evtMessageTooLarge.Emit(EvtMessageTooLarge{
+		Peer:     s.Conn().RemotePeer(),
+		Protocol: s.Protocol(),
+		Limit:    ids.maxMessageSize,
+	})
+	return fmt.Errorf("%w: limit is %d bytes", ErrMessageTooLarge, ids.maxMessageSize)
 }
 
 func readAllIDMessages(r protoio.Reader, finalMsg proto.Message) error {
@@ -459,18 +1105,88 @@ func readAllIDMessages(r protoio.Reader, finalMsg proto.Message) error {
 	return fmt.Errorf("too many parts")
 }
 
+// localProtocols returns the protocols we advertise to peers.
+func (ids *IDService) localProtocols() []string {
+	protos := ids.Host.Mux().Protocols()
+	if ids.protocolFilter == nil {
+		return protos
+	}
+	filtered := protos[:0]
+	for _, p := range protos {
+		if ids.protocolFilter(protocol.ID(p)) {
+			filtered = append(filtered, p)
+		}
+	}
+	return filtered
+}
+
 func (ids *IDService) getSnapshot() *identifySnapshot {
+	ids.snapshotSeqMu.Lock()
+	defer ids.snapshotSeqMu.Unlock()
+
 	snapshot := new(identifySnapshot)
+	snapshot.seq = ids.newSnapshotSeq()
+	snapshot.addrs = ids.Host.Addrs()
+	if ids.addrsFactory != nil {
+		snapshot.addrs = ids.addrsFactory(snapshot.addrs)
+	}
 	if !ids.disableSignedPeerRecord {
-		if cab, ok := peerstore.GetCertifiedAddrBook(ids.Host.Peerstore()); ok {
-			snapshot.record = cab.GetPeerRecord(ids.Host.ID())
+		if ids.addrsFactory != nil {
+			// the host's record contains all of its addresses.
+			snapshot.record = ids.signedRecordFor(snapshot.addrs)
+		} else if cab, ok := peerstore.GetCertifiedAddrBook(ids.Host.Peerstore()); ok {
+			snapshot.record = ids.hostRecord(cab, snapshot)
 		}
 	}
-	snapshot.addrs = ids.Host.Addrs()
-	snapshot.protocols = ids.Host.Mux().Protocols()
+	snapshot.protocols = ids.localProtocols()
+
+	ids.metadataMu.RLock()
+	snapshot.metadata = make(map[string][]byte, len(ids.metadata))
+	for k, v := range ids.metadata {
+		snapshot.metadata[k] = v
+	}
+	ids.metadataMu.RUnlock()
 	return snapshot
 }
 
+// signedRecordFor returns a signed peer record containing the given addresses,
+// re-using the last record we signed if the addresses didn't change.
+func (ids *IDService) signedRecordFor(addrs []ma.Multiaddr) *record.Envelope {
+	ids.recordMu.Lock()
+	defer ids.recordMu.Unlock()
+
+	if ids.record != nil && sameAddrs(ids.recordAddrs, addrs) {
+		return ids.record
+	}
+
+	sk := ids.Host.Peerstore().PrivKey(ids.Host.ID())
+	if sk == nil {
+		log.Errorf("did not have own private key in Peerstore")
+		return nil
+	}
+	rec := peer.PeerRecordFromAddrInfo(peer.AddrInfo{ID: ids.Host.ID(), Addrs: addrs})
+	env, err := record.Seal(rec, sk)
+	if err != nil {
+		log.Errorw("failed to sign peer record", "err", err)
+		return nil
+	}
+	ids.record = env
+	ids.recordAddrs = addrs
+	return env
+}
+
+func sameAddrs(a, b []ma.Multiaddr) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
 func (ids *IDService) writeChunkedIdentifyMsg(c network.Conn, snapshot *identifySnapshot, s network.Stream) error {
 	mes := ids.createBaseIdentifyResponse(c, snapshot)
 	sr := ids.getSignedRecord(snapshot)
@@ -478,7 +1194,11 @@ func (ids *IDService) writeChunkedIdentifyMsg(c network.Conn, snapshot *identify
 	writer := protoio.NewDelimitedWriter(s)
 
 	if sr == nil || proto.Size(mes) <= legacyIDSize {
-		return writer.WriteMsg(mes)
+		if err := writer.WriteMsg(mes); err != nil {
+			return err
+		}
+		ids.messageSent(s.Protocol(), mes)
+		return nil
 	}
 	mes.SignedPeerRecord = nil
 	if err := writer.WriteMsg(mes); err != nil {
@@ -487,9 +1207,12 @@ func (ids *IDService) writeChunkedIdentifyMsg(c network.Conn, snapshot *identify
 
 	// then write just the signed record
 	m := &pb.Identify{SignedPeerRecord: sr}
-	err := writer.WriteMsg(m)
-	return err
-
+	if err := writer.WriteMsg(m); err != nil {
+		return err
+	}
+	mes.SignedPeerRecord = sr
+	ids.messageSent(s.Protocol(), mes)
+	return nil
 }
 
 func (ids *IDService) createBaseIdentifyResponse(
@@ -499,7 +1222,6 @@ func (ids *IDService) createBaseIdentifyResponse(
 	mes := &pb.Identify{}
 
 	remoteAddr := conn.RemoteMultiaddr()
-	localAddr := conn.LocalMultiaddr()
 
 	// set protocols this node is currently handling
 	mes.Protocols = snapshot.protocols
@@ -510,33 +1232,29 @@ func (ids *IDService) createBaseIdentifyResponse(
 
 	// populate unsigned addresses.
 	// peers that do not yet support signed addresses will need this.
-	// Note: LocalMultiaddr is sometimes 0.0.0.0
-	viaLoopback := manet.IsIPLoopback(localAddr) || manet.IsIPLoopback(remoteAddr)
-	mes.ListenAddrs = make([][]byte, 0, len(snapshot.addrs))
-	for _, addr := range snapshot.addrs {
-		if !viaLoopback && manet.IsIPLoopback(addr) {
-			continue
-		}
-		mes.ListenAddrs = append(mes.ListenAddrs, addr.Bytes())
-	}
-	// set our public key
-	ownKey := ids.Host.Peerstore().PubKey(ids.Host.ID())
-
-	// check if we even have a public key.
-	if ownKey == nil {
-		// public key is nil. We are either using insecure transport or something erratic happened.
-		// check if we're even operating in "secure mode"
-		if ids.Host.Peerstore().PrivKey(ids.Host.ID()) != nil {
-			// private key is present. But NO public key. Something bad happened.
-			log.Errorf("did not have own public key in Peerstore")
-		}
-		// if neither of the key is present it is safe to assume that we are using an insecure transport.
-	} else {
-		// public key is present. Safe to proceed.
-		if kb, err := ownKey.Bytes(); err != nil {
-			log.Errorf("failed to convert key to bytes")
+	mes.ListenAddrs = advertisedAddrs(conn, snapshot.addrs)
+
+	// set our public key, unless we're running over insecure transports, which
+	// wouldn't authenticate it.
+	if !ids.insecure {
+		ownKey := ids.Host.Peerstore().PubKey(ids.Host.ID())
+
+		// check if we even have a public key.
+		if ownKey == nil {
+			// public key is nil. We are either using insecure transport or something erratic happened.
+			// check if we're even operating in "secure mode"
+			if ids.Host.Peerstore().PrivKey(ids.Host.ID()) != nil {
+				// private key is present. But NO public key. Something bad happened.
+				log.Errorf("did not have own public key in Peerstore")
+			}
+			// if neither of the key is present it is safe to assume that we are using an insecure transport.
 		} else {
-			mes.PublicKey = kb
+			// public key is present. Safe to proceed.
+			if kb, err := ownKey.Bytes(); err != nil {
+				log.Errorf("failed to convert key to bytes")
+			} else {
+				mes.PublicKey = kb
+			}
 		}
 	}
 
@@ -546,9 +1264,48 @@ func (ids *IDService) createBaseIdentifyResponse(
 	mes.ProtocolVersion = &pv
 	mes.AgentVersion = &av
 
+	// set application metadata.
+	mes.Metadata = metadataEntries(snapshot.metadata)
+	mes.Seq = &snapshot.seq
+	if ids.connMetadataFunc != nil {
+		mes.ConnMetadata = metadataEntries(ids.connMetadataFunc(conn))
+	}
+
 	return mes
 }
 
+// metadataEntries returns the given metadata as message entries, sorted by
+// key so the message is deterministic.
+func metadataEntries(md map[string][]byte) []*pb.MetadataEntry {
+	keys := make([]string, 0, len(md))
+	for k := range md {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	entries := make([]*pb.MetadataEntry, 0, len(keys))
+	for _, k := range keys {
+		k := k
+		entries = append(entries, &pb.MetadataEntry{Key: &k, Value: md[k]})
+	}
+	return entries
+}
+
+// advertisedAddrs returns the given listen addresses to send to the remote
+// peer of conn, skipping loopback addresses unless we're connected over a
+// loopback address.
+func advertisedAddrs(conn network.Conn, addrs []ma.Multiaddr) [][]byte {
+	// Note: LocalMultiaddr is sometimes 0.0.0.0
+	viaLoopback := manet.IsIPLoopback(conn.LocalMultiaddr()) || manet.IsIPLoopback(conn.RemoteMultiaddr())
+	out := make([][]byte, 0, len(addrs))
+	for _, addr := range addrs {
+		if !viaLoopback && manet.IsIPLoopback(addr) {
+			continue
+		}
+		out = append(out, addr.Bytes())
+	}
+	return out
+}
+
 func (ids *IDService) getSignedRecord(snapshot *identifySnapshot) []byte {
 	if ids.disableSignedPeerRecord || snapshot.record == nil {
 		return nil
@@ -563,14 +1320,26 @@ func (ids *IDService) getSignedRecord(snapshot *identifySnapshot) []byte {
 	return recBytes
 }
 
-func (ids *IDService) consumeMessage(mes *pb.Identify, c network.Conn) {
+// consumeMessage consumes an identify message received on c, in an exchange
+// that took the given round trip time, zero if unknown.
+func (ids *IDService) consumeMessage(mes *pb.Identify, c network.Conn, rtt time.Duration) {
 	p := c.RemotePeer()
 
+	// don't let a message delivered out of order revert the newer state of
+	// the peer. What it tells us about the connection is still current.
+	if !ids.acceptSnapshot(p, mes.GetSeq(), true) {
+		log.Debugw("discarding stale identify message", "peer", p, "seq", mes.GetSeq())
+		ids.consumeObservedAddress(mes.GetObservedAddr(), c, rtt)
+		ids.consumeConnMetadata(c, mes.GetConnMetadata())
+		ids.consumeReceivedPubKey(c, mes.PublicKey)
+		return
+	}
+
 	// mes.Protocols
 	ids.Host.Peerstore().SetProtocols(p, mes.Protocols...)
 
 	// mes.ObservedAddr
-	ids.consumeObservedAddress(mes.GetObservedAddr(), c)
+	ids.consumeObservedAddress(mes.GetObservedAddr(), c, rtt)
 
 	// mes.ListenAddrs
 	laddrs := mes.GetListenAddrs()
@@ -584,6 +1353,7 @@ func (ids *IDService) consumeMessage(mes *pb.Identify, c network.Conn) {
 		}
 		lmaddrs = append(lmaddrs, maddr)
 	}
+	lmaddrs = ids.limitAddrs(c, lmaddrs)
 
 	// NOTE: Do not add `c.RemoteMultiaddr()` to the peerstore if the remote
 	// peer doesn't tell us to do so. Otherwise, we'll advertise it.
@@ -599,7 +1369,9 @@ func (ids *IDService) consumeMessage(mes *pb.Identify, c network.Conn) {
 	signedPeerRecord, err := signedPeerRecordFromMessage(mes)
 	if err != nil {
 		log.Errorf("error getting peer record from Identify message: %v", err)
+		ids.signedRecordError(err)
 	}
+	signedPeerRecord = ids.limitRecord(c, signedPeerRecord)
 
 	// Extend the TTLs on the known (probably) good addresses.
 	// Taking the lock ensures that we don't concurrently process a disconnect.
@@ -623,6 +1395,7 @@ func (ids *IDService) consumeMessage(mes *pb.Identify, c network.Conn) {
 		_, addErr := cab.ConsumePeerRecord(signedPeerRecord, ttl)
 		if addErr != nil {
 			log.Debugf("error adding signed addrs to peerstore: %v", addErr)
+			ids.signedRecordError(addErr)
 		}
 	} else {
 		ids.Host.Peerstore().AddAddrs(p, lmaddrs, ttl)
@@ -640,6 +1413,18 @@ func (ids *IDService) consumeMessage(mes *pb.Identify, c network.Conn) {
 
 	ids.Host.Peerstore().Put(p, "ProtocolVersion", pv)
 	ids.Host.Peerstore().Put(p, "AgentVersion", av)
+	ids.Host.Peerstore().Put(p, "IdentifyAuthenticated", ids.authenticated(c))
+
+	// get application metadata. Identify messages carry the full state, so
+	// this replaces whatever the peer sent us previously.
+	if md := mes.GetMetadata(); len(md) > 0 || ids.PeerMetadata(p) != nil {
+		peerMD := make(map[string][]byte, len(md))
+		for _, e := range md {
+			peerMD[e.GetKey()] = e.GetValue()
+		}
+		ids.Host.Peerstore().Put(p, "IdentifyMetadata", peerMD)
+	}
+	ids.consumeConnMetadata(c, mes.GetConnMetadata())
 
 	// get the key from the other side. we may not have it (no-auth transport)
 	ids.consumeReceivedPubKey(c, mes.PublicKey)
@@ -649,6 +1434,13 @@ func (ids *IDService) consumeReceivedPubKey(c network.Conn, kb []byte) {
 	lp := c.LocalPeer()
 	rp := c.RemotePeer()
 
+	// keys aren't authenticated by insecure transports, mismatches are
+	// expected there.
+	logf := log.Errorf
+	if ids.insecure {
+		logf = log.Debugf
+	}
+
 	if kb == nil {
 		log.Debugf("%s did not receive public key for remote peer: %s", lp, rp)
 		return
@@ -656,7 +1448,7 @@ func (ids *IDService) consumeReceivedPubKey(c network.Conn, kb []byte) {
 
 	newKey, err := ic.UnmarshalPublicKey(kb)
 	if err != nil {
-		log.Warnf("%s cannot unmarshal key from remote peer: %s, %s", lp, rp, err)
+		logf("%s cannot unmarshal key from remote peer: %s, %s", lp, rp, err)
 		return
 	}
 
@@ -679,7 +1471,8 @@ func (ids *IDService) consumeReceivedPubKey(c network.Conn, kb []byte) {
 
 		} else {
 			// we have a local peer.ID and it does not match the sent key... error.
-			log.Errorf("%s received key for remote peer %s mismatch: %s", lp, rp, np)
+			logf("%s received key for remote peer %s mismatch: %s", lp, rp, np)
+			ids.keyMismatch(c, newKey, KeyPeerIDMismatch)
 		}
 		return
 	}
@@ -702,21 +1495,22 @@ func (ids *IDService) consumeReceivedPubKey(c network.Conn, kb []byte) {
 	// weird, got a different key... but the different key MATCHES the peer.ID.
 	// this odd. let's log error and investigate. this should basically never happen
 	// and it means we have something funky going on and possibly a bug.
-	log.Errorf("%s identify got a different key for: %s", lp, rp)
+	logf("%s identify got a different key for: %s", lp, rp)
+	ids.keyMismatch(c, newKey, KeyChanged)
 
 	// okay... does ours NOT match the remote peer.ID?
 	cp, err := peer.IDFromPublicKey(currKey)
 	if err != nil {
-		log.Errorf("%s cannot get peer.ID from local key of remote peer: %s, %s", lp, rp, err)
+		logf("%s cannot get peer.ID from local key of remote peer: %s, %s", lp, rp, err)
 		return
 	}
 	if cp != rp {
-		log.Errorf("%s local key for remote peer %s yields different peer.ID: %s", lp, rp, cp)
+		logf("%s local key for remote peer %s yields different peer.ID: %s", lp, rp, cp)
 		return
 	}
 
 	// okay... curr key DOES NOT match new key. both match peer.ID. wat?
-	log.Errorf("%s local key and received key for %s do not match, but match peer.ID", lp, rp)
+	logf("%s local key and received key for %s do not match, but match peer.ID", lp, rp)
 }
 
 // HasConsistentTransport returns true if the address 'a' shares a
@@ -748,7 +1542,7 @@ func HasConsistentTransport(a ma.Multiaddr, green []ma.Multiaddr) bool {
 	return false
 }
 
-func (ids *IDService) consumeObservedAddress(observed []byte, c network.Conn) {
+func (ids *IDService) consumeObservedAddress(observed []byte, c network.Conn, rtt time.Duration) {
 	if observed == nil {
 		return
 	}
@@ -759,7 +1553,11 @@ func (ids *IDService) consumeObservedAddress(observed []byte, c network.Conn) {
 		return
 	}
 
-	ids.observedAddrs.Record(c, maddr)
+	ids.Host.Peerstore().Put(c.RemotePeer(), "IdentifyObservedAddr", maddr)
+	if ids.ignoreRelayed && isRelayedConn(c) {
+		return
+	}
+	ids.observedAddrs.RecordWithRTT(c, maddr, rtt)
 }
 
 func addrInAddrs(a ma.Multiaddr, as []ma.Multiaddr) bool {
@@ -787,7 +1585,9 @@ func (nn *netNotifiee) IDService() *IDService {
 }
 
 func (nn *netNotifiee) Connected(n network.Network, v network.Conn) {
-	nn.IDService().IdentifyWait(v)
+	if ids := nn.IDService(); !ids.lazy {
+		ids.IdentifyWait(v)
+	}
 }
 
 func (nn *netNotifiee) Disconnected(n network.Network, v network.Conn) {
@@ -795,6 +1595,7 @@ func (nn *netNotifiee) Disconnected(n network.Network, v network.Conn) {
 
 	// Stop tracking the connection.
 	ids.removeConn(v)
+	ids.forgetConnMetadata(v)
 
 	// undo the setting of addresses to peer.ConnectedAddrTTL we did
 	ids.addrMu.Lock()
@@ -802,12 +1603,22 @@ func (nn *netNotifiee) Disconnected(n network.Network, v network.Conn) {
 
 	if ids.Host.Network().Connectedness(v.RemotePeer()) != network.Connected {
 		// consider removing the peer handler for this
-		select {
-		case ids.rmPeerHandlerCh <- rmPeerHandlerReq{v.RemotePeer()}:
-		case <-ids.ctx.Done():
-			return
+		if ids.trackPeers() {
+			select {
+			case ids.rmPeerHandlerCh <- rmPeerHandlerReq{v.RemotePeer()}:
+			case <-ids.ctx.Done():
+				return
+			}
 		}
 
+		ids.muxMu.Lock()
+		delete(ids.muxStreams, v.RemotePeer())
+		ids.muxMu.Unlock()
+
+		ids.forgetPeerIdentify(v.RemotePeer())
+		ids.forgetSnapshotSeq(v.RemotePeer())
+		ids.forgetPeerError(v.RemotePeer())
+
 		// Last disconnect.
 		ps := ids.Host.Peerstore()
 		ps.UpdateAddrs(v.RemotePeer(), peerstore.ConnectedAddrTTL, peerstore.RecentlyConnectedAddrTTL)
@@ -1,32 +1,56 @@
 package identify
 
 import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
 	"github.com/libp2p/go-libp2p-core/event"
 	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
 	"github.com/libp2p/go-libp2p-core/protocol"
-	"time"
+	"github.com/libp2p/go-libp2p-core/record"
 
 	pb "github.com/libp2p/go-libp2p/p2p/protocol/identify/pb"
 
 	"github.com/libp2p/go-msgio/protoio"
+	ma "github.com/multiformats/go-multiaddr"
 )
 
 const IDDelta = "/p2p/id/delta/1.0.0"
 
+// IDDeltaAddrs is the protocol.ID of the Identify Delta protocol extended with
+// listen address changes. Its messages may carry added and removed listen
+// addresses, and our new signed peer record, on top of protocol changes. Peers
+// only supporting IDDelta would silently drop these, so address changes are
+// only sent as deltas to peers supporting IDDeltaAddrs. See the AddrDeltas
+// option.
+const IDDeltaAddrs = "/p2p/id/delta/1.1.0"
+
 // deltaHandler handles incoming delta updates from peers.
 func (ids *IDService) deltaHandler(s network.Stream) {
-	_ = s.SetReadDeadline(time.Now().Add(StreamReadTimeout))
+	if !ids.allowRequest(s) {
+		return
+	}
+	if !ids.allowUpdate(s.Conn().RemotePeer()) {
+		_ = s.Reset()
+		return
+	}
+
+	_ = s.SetReadDeadline(time.Now().Add(ids.streamTimeout()))
 
 	c := s.Conn()
 
-	r := protoio.NewDelimitedReader(s, 2048)
+	r := protoio.NewDelimitedReader(s, ids.maxMessageSize)
 	mes := pb.Identify{}
 	if err := r.ReadMsg(&mes); err != nil {
-		log.Warn("error reading identify message: ", err)
+		log.Warn("error reading identify message: ", ids.checkReadErr(s, err))
 		_ = s.Reset()
 		return
 	}
+	ids.messageReceived(s.Protocol(), &mes)
 
 	defer s.Close()
 
@@ -38,15 +62,21 @@ func (ids *IDService) deltaHandler(s network.Stream) {
 	}
 
 	p := s.Conn().RemotePeer()
-	if err := ids.consumeDelta(p, delta); err != nil {
+	if err := ids.consumeDelta(c, delta); err != nil {
 		_ = s.Reset()
 		log.Warnf("delta update from peer %s failed: %s", p, err)
 	}
 }
 
-// consumeDelta processes an incoming delta from a peer, updating the peerstore
-// and emitting the appropriate events.
-func (ids *IDService) consumeDelta(id peer.ID, delta *pb.Delta) error {
+// consumeDelta processes an incoming delta from the remote peer of c, updating
+// the peerstore and emitting the appropriate events.
+func (ids *IDService) consumeDelta(c network.Conn, delta *pb.Delta) error {
+	id := c.RemotePeer()
+	if !ids.acceptSnapshot(id, delta.GetSeq(), false) {
+		log.Debugw("discarding stale identify delta", "peer", id, "seq", delta.GetSeq())
+		return nil
+	}
+
 	err := ids.Host.Peerstore().AddProtocols(id, delta.GetAddedProtocols()...)
 	if err != nil {
 		return err
@@ -57,6 +87,10 @@ func (ids *IDService) consumeDelta(id peer.ID, delta *pb.Delta) error {
 		return err
 	}
 
+	if err := ids.consumeAddrsDelta(c, delta); err != nil {
+		return err
+	}
+
 	evt := event.EvtPeerProtocolsUpdated{
 		Peer:    id,
 		Added:   protocol.ConvertFromStrings(delta.GetAddedProtocols()),
@@ -65,3 +99,85 @@ func (ids *IDService) consumeDelta(id peer.ID, delta *pb.Delta) error {
 	ids.emitters.evtPeerProtocolsUpdated.Emit(evt)
 	return nil
 }
+
+// consumeAddrsDelta applies the listen address changes of a delta. As with full
+// Identify messages, the signed peer record takes precedence over the unsigned
+// addresses.
+func (ids *IDService) consumeAddrsDelta(c network.Conn, delta *pb.Delta) error {
+	if len(delta.GetAddedAddrs()) == 0 && len(delta.GetRmAddrs()) == 0 && len(delta.GetSignedPeerRecord()) == 0 {
+		return nil
+	}
+	p := c.RemotePeer()
+	ps := ids.Host.Peerstore()
+
+	var env *record.Envelope
+	if len(delta.GetSignedPeerRecord()) > 0 {
+		var rec record.Record
+		var err error
+		env, rec, err = record.ConsumeEnvelope(delta.GetSignedPeerRecord(), peer.PeerRecordEnvelopeDomain)
+		if err != nil {
+			ids.signedRecordError(err)
+			return fmt.Errorf("invalid signed peer record: %w", err)
+		}
+		if pr, ok := rec.(*peer.PeerRecord); !ok || pr.PeerID != p {
+			err := errors.New("signed peer record is not for the sending peer")
+			ids.signedRecordError(err)
+			return err
+		}
+		env = ids.limitRecord(c, env)
+	}
+
+	added := parseAddrs(delta.GetAddedAddrs())
+	removed := parseAddrs(delta.GetRmAddrs())
+
+	// Taking the lock ensures that we don't concurrently process a disconnect.
+	ids.addrMu.Lock()
+	defer ids.addrMu.Unlock()
+	ttl := peerstore.RecentlyConnectedAddrTTL
+	if ids.Host.Network().Connectedness(p) == network.Connected {
+		ttl = peerstore.ConnectedAddrTTL
+	}
+
+	if cab, ok := peerstore.GetCertifiedAddrBook(ps); ok && env != nil {
+		// the record replaces the addresses we know, see consumeMessage.
+		ps.UpdateAddrs(p, peerstore.RecentlyConnectedAddrTTL, peerstore.TempAddrTTL)
+		ps.UpdateAddrs(p, peerstore.ConnectedAddrTTL, peerstore.TempAddrTTL)
+		accepted, err := cab.ConsumePeerRecord(env, ttl)
+		if err != nil {
+			log.Debugf("error adding signed addrs to peerstore: %v", err)
+		}
+		if !accepted {
+			// keep the addresses of the newer record we already have.
+			ps.UpdateAddrs(p, peerstore.TempAddrTTL, ttl)
+			return nil
+		}
+		ps.UpdateAddrs(p, peerstore.TempAddrTTL, 0)
+		return nil
+	}
+
+	ps.SetAddrs(p, removed, 0)
+	if ids.maxPeerAddrs > 0 {
+		if room := ids.maxPeerAddrs - len(ps.Addrs(p)); len(added) > room {
+			atomic.AddUint64(&ids.limitStats.addrsTruncated, 1)
+			log.Debugw("truncating added listen addrs", "peer", p, "addrs", len(added), "limit", ids.maxPeerAddrs)
+			if room < 0 {
+				room = 0
+			}
+			added = added[:room]
+		}
+	}
+	ps.AddAddrs(p, added, ttl)
+	return nil
+}
+
+func parseAddrs(bs [][]byte) []ma.Multiaddr {
+	addrs := make([]ma.Multiaddr, 0, len(bs))
+	for _, b := range bs {
+		a, err := ma.NewMultiaddrBytes(b)
+		if err != nil {
+			continue
+		}
+		addrs = append(addrs, a)
+	}
+	return addrs
+}
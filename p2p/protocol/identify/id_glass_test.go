@@ -2,15 +2,23 @@ package identify
 
 import (
 	"context"
+	"sync"
 	"testing"
 	"time"
 
+	ic "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/host"
 	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/libp2p/go-libp2p-core/protocol"
 	"github.com/stretchr/testify/require"
 
 	blhost "github.com/libp2p/go-libp2p-blankhost"
 	swarmt "github.com/libp2p/go-libp2p-swarm/testing"
+	pb "github.com/libp2p/go-libp2p/p2p/protocol/identify/pb"
+
+	ma "github.com/multiformats/go-multiaddr"
 )
 
 func TestFastDisconnect(t *testing.T) {
@@ -81,3 +89,288 @@ func TestFastDisconnect(t *testing.T) {
 		t.Fatal(ctx.Err())
 	}
 }
+
+func TestValidateMessage(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	h3 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	defer h2.Close()
+	defer h3.Close()
+
+	require.NoError(t, h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+	c := h1.Network().ConnsToPeer(h2.ID())[0]
+
+	key := func(h host.Host) []byte {
+		b, err := ic.MarshalPublicKey(h.Peerstore().PubKey(h.ID()))
+		require.NoError(t, err)
+		return b
+	}
+	signedRecord := func(h host.Host) []byte {
+		cab, ok := peerstore.GetCertifiedAddrBook(h.Peerstore())
+		require.True(t, ok)
+		env := cab.GetPeerRecord(h.ID())
+		require.NotNil(t, env)
+		b, err := env.Marshal()
+		require.NoError(t, err)
+		return b
+	}
+
+	require.NoError(t, validateMessage(&pb.Identify{
+		ListenAddrs:      [][]byte{h2.Addrs()[0].Bytes()},
+		ObservedAddr:     c.LocalMultiaddr().Bytes(),
+		PublicKey:        key(h2),
+		SignedPeerRecord: signedRecord(h2),
+	}, c))
+
+	for reason, mes := range map[ValidationFailure]*pb.Identify{
+		InvalidListenAddr:   {ListenAddrs: [][]byte{{0xff}}},
+		InvalidObservedAddr: {ObservedAddr: []byte{0xff}},
+		InvalidPublicKey:    {PublicKey: []byte("foo")},
+		PeerIDMismatch:      {PublicKey: key(h3)},
+		InvalidSignedRecord: {SignedPeerRecord: signedRecord(h3)},
+	} {
+		err := validateMessage(mes, c)
+		require.Error(t, err, reason)
+		require.Equal(t, reason, err.(*ValidationError).Reason)
+	}
+
+	// keys aren't held against peers in insecure mode.
+	ids := &IDService{strictValidation: true, insecure: true}
+	require.NoError(t, ids.checkMessage(&pb.Identify{PublicKey: key(h3)}, c))
+	require.Error(t, ids.checkMessage(&pb.Identify{PublicKey: key(h3), ObservedAddr: []byte{0xff}}, c))
+}
+
+type relayedConn struct {
+	network.Conn
+}
+
+func (c relayedConn) Stat() network.Stat {
+	st := c.Conn.Stat()
+	st.Transient = true
+	return st
+}
+
+func TestIgnoreRelayedObservations(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for _, ignore := range []bool{false, true} {
+		h1 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+		h2 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+		defer h1.Close()
+		defer h2.Close()
+
+		var opts []Option
+		if ignore {
+			opts = append(opts, IgnoreRelayedObservations())
+		}
+		ids, err := NewIDService(h1, opts...)
+		require.NoError(t, err)
+		defer ids.Close()
+
+		require.NoError(t, h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+		c := relayedConn{h1.Network().ConnsToPeer(h2.ID())[0]}
+		require.True(t, isRelayedConn(c))
+
+		observed := ma.StringCast("/ip4/1.2.3.4/tcp/1234")
+		ids.consumeObservedAddress(observed.Bytes(), c, 0)
+		time.Sleep(100 * time.Millisecond) // let the worker run
+		if ignore {
+			require.Empty(t, ids.observedAddrs.RelayedAddrs())
+		} else {
+			require.Len(t, ids.observedAddrs.RelayedAddrs(), 1)
+		}
+		require.Empty(t, ids.OwnObservedAddrs())
+	}
+}
+
+func TestRefreshSignedRecord(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	defer h2.Close()
+
+	var addrsMu sync.Mutex
+	addrs := h1.Addrs()
+	ids1, err := NewIDService(h1, RefreshSignedRecord(), AddrsFactory(func([]ma.Multiaddr) []ma.Multiaddr {
+		addrsMu.Lock()
+		defer addrsMu.Unlock()
+		return addrs
+	}))
+	require.NoError(t, err)
+	defer ids1.Close()
+	ids2, err := NewIDService(h2)
+	require.NoError(t, err)
+	defer ids2.Close()
+	// only identify h1 when told to, so that h1 doesn't learn about our
+	// record by us identifying it on reconnection.
+	h2.Network().StopNotify((*netNotifiee)(ids2))
+
+	h2pi := peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}
+	require.NoError(t, h1.Connect(ctx, h2pi))
+	<-ids1.IdentifyWait(h1.Network().ConnsToPeer(h2.ID())[0])
+	<-ids2.IdentifyWait(h2.Network().ConnsToPeer(h1.ID())[0])
+	sent, ok := ids1.sentRecordSeq(h2.ID())
+	require.True(t, ok)
+
+	// nothing to refresh while our addresses don't change.
+	require.NoError(t, h1.Network().ClosePeer(h2.ID()))
+	require.NoError(t, h1.Connect(ctx, h2pi))
+	<-ids1.IdentifyWait(h1.Network().ConnsToPeer(h2.ID())[0])
+	require.Zero(t, ids1.RecordRefreshStats().Scheduled)
+
+	require.NoError(t, h1.Network().ClosePeer(h2.ID()))
+	addrsMu.Lock()
+	addrs = []ma.Multiaddr{ma.StringCast("/ip4/1.2.3.4/tcp/1234")}
+	addrsMu.Unlock()
+	require.NoError(t, h1.Connect(ctx, h2pi))
+
+	require.Eventually(t, func() bool {
+		return ids1.RecordRefreshStats().Succeeded == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, uint64(1), ids1.RecordRefreshStats().Scheduled)
+	require.Zero(t, ids1.RecordRefreshStats().Failed)
+
+	curr, ok := ids1.sentRecordSeq(h2.ID())
+	require.True(t, ok)
+	require.Greater(t, curr, sent)
+	require.Eventually(t, func() bool {
+		cab, _ := peerstore.GetCertifiedAddrBook(h2.Peerstore())
+		seq, ok := recordSeq(cab.GetPeerRecord(h1.ID()))
+		return ok && seq == curr
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+// discardStream is a stream discarding everything written to it.
+type discardStream struct {
+	network.Stream
+}
+
+func (discardStream) Write(b []byte) (int, error) { return len(b), nil }
+
+func BenchmarkMuxWriteFrame(b *testing.B) {
+	pv, av := LibP2PVersion, ClientVersion
+	mes := &pb.Identify{
+		ProtocolVersion: &pv,
+		AgentVersion:    &av,
+		Protocols:       []string{ID, IDPush, IDDelta, IDMux},
+		ListenAddrs:     [][]byte{ma.StringCast("/ip4/1.2.3.4/tcp/4001").Bytes()},
+	}
+	ms := &muxStream{s: discardStream{}}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := ms.writeFrame(framePush, mes); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestSnapshotSeq(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	defer h2.Close()
+
+	ids1, err := NewIDService(h1)
+	require.NoError(t, err)
+	defer ids1.Close()
+	ids2, err := NewIDService(h2)
+	require.NoError(t, err)
+	defer ids2.Close()
+
+	require.NoError(t, h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+	c := h1.Network().ConnsToPeer(h2.ID())[0]
+	require.NoError(t, (<-ids1.IdentifyWaitResult(c)).Err)
+	initial := ids1.peerSnapshotSeq(h2.ID())
+	require.NotZero(t, initial)
+
+	// h2 sends us its new protocol in a newer snapshot.
+	h2.SetStreamHandler("/test/new", func(network.Stream) {})
+	require.Eventually(t, func() bool {
+		return ids1.peerSnapshotSeq(h2.ID()) > initial
+	}, 5*time.Second, 10*time.Millisecond)
+	info, err := ids1.PeerInfo(h2.ID())
+	require.NoError(t, err)
+	require.Contains(t, info.Protocols, protocol.ID("/test/new"))
+	require.Equal(t, ids1.peerSnapshotSeq(h2.ID()), info.Seq)
+
+	// a response built from the initial snapshot, delivered late, doesn't
+	// revert it.
+	ids1.consumeMessage(&pb.Identify{Protocols: []string{ID}, Seq: &initial}, c, 0)
+	protos, err := h1.Peerstore().GetProtocols(h2.ID())
+	require.NoError(t, err)
+	require.Contains(t, protos, "/test/new")
+
+	// messages of peers not numbering their snapshots always apply.
+	ids1.consumeMessage(&pb.Identify{Protocols: []string{ID}}, c, 0)
+	protos, err = h1.Peerstore().GetProtocols(h2.ID())
+	require.NoError(t, err)
+	require.Equal(t, []string{ID}, protos)
+
+	// we forget the sequence numbers of the peers we disconnect from.
+	require.NoError(t, h1.Network().ClosePeer(h2.ID()))
+	require.Eventually(t, func() bool {
+		return ids1.peerSnapshotSeq(h2.ID()) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestAcceptSnapshot(t *testing.T) {
+	ids := &IDService{peerSeqs: make(map[peer.ID]peerSnapshotSeq)}
+	p := peer.ID("peer")
+
+	require.True(t, ids.acceptSnapshot(p, 5, true))
+	// the same snapshot sent over another connection.
+	require.True(t, ids.acceptSnapshot(p, 5, true))
+	// deltas may arrive out of order among themselves.
+	require.True(t, ids.acceptSnapshot(p, 8, false))
+	require.True(t, ids.acceptSnapshot(p, 7, false))
+	// but a full message older than them would revert them.
+	require.False(t, ids.acceptSnapshot(p, 6, true))
+	require.True(t, ids.acceptSnapshot(p, 9, true))
+	// a full message includes the changes of older deltas.
+	require.False(t, ids.acceptSnapshot(p, 8, false))
+	require.Equal(t, uint64(9), ids.peerSnapshotSeq(p))
+	// unnumbered messages are never stale.
+	require.True(t, ids.acceptSnapshot(p, 0, true))
+}
+
+func TestRateLimiterBoundsPeers(t *testing.T) {
+	rl := newRateLimiter(0, 2, time.Hour)
+	rl.maxPeers = 3
+
+	peers := make([]peer.ID, 5)
+	for i := range peers {
+		peers[i] = peer.ID(string(rune('a' + i)))
+	}
+	require.True(t, rl.allow(peers[0]))
+	require.True(t, rl.allow(peers[0]))
+	require.False(t, rl.allow(peers[0]))
+
+	// a flood of fresh peers doesn't grow the limiter beyond its bound.
+	for _, p := range peers[1:] {
+		require.True(t, rl.allow(p))
+	}
+	require.Len(t, rl.reqs, 3)
+	require.Equal(t, 3, rl.lru.Len())
+	// the peer seen the longest ago was forgotten.
+	require.NotContains(t, rl.reqs, peers[0])
+	require.True(t, rl.allow(peers[4]))
+	require.False(t, rl.allow(peers[4]))
+
+	// only the global limit: no peer is tracked.
+	rl = newRateLimiter(10, 0, time.Hour)
+	for _, p := range peers {
+		require.True(t, rl.allow(p))
+	}
+	require.Empty(t, rl.reqs)
+}
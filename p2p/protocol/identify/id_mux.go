@@ -0,0 +1,245 @@
+package identify
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	pb "github.com/libp2p/go-libp2p/p2p/protocol/identify/pb"
+
+	pool "github.com/libp2p/go-buffer-pool"
+	"github.com/libp2p/go-msgio/protoio"
+)
+
+// IDMux is the protocol.ID of the multiplexed Identify protocol. It carries
+// Identify requests and responses, Identify Push and Identify Delta messages
+// over a single long-lived stream per peer, saving a stream negotiation for
+// every exchange. See the ReuseStream option.
+//
+// Every message on the stream is a frame: a single byte giving the frame type,
+// followed by a varint-delimited Identify message. Only request frames are
+// answered, with a response frame.
+const IDMux = "/p2p/id/mux/1.0.0"
+
+type frameType byte
+
+const (
+	frameRequest frameType = iota + 1
+	frameResponse
+	framePush
+	frameDelta
+)
+
+// muxStream is our end of an IDMux stream we opened to a peer.
+type muxStream struct {
+	// serializes exchanges, as responses aren't tagged with the request
+	// they answer.
+	mu sync.Mutex
+
+	s  network.Stream
+	br *bufio.Reader
+	r  protoio.Reader
+}
+
+func newMuxStream(s network.Stream, maxMessageSize int) *muxStream {
+	br := bufio.NewReader(s)
+	return &muxStream{
+		s:  s,
+		br: br,
+		// NewDelimitedReader reuses br rather than wrapping it in another
+		// buffered reader, so we can read the frame type from br directly.
+		r: protoio.NewDelimitedReader(br, maxMessageSize),
+	}
+}
+
+// writeFrame writes a frame with a single write, marshalling it into a pooled
+// buffer.
+func (ms *muxStream) writeFrame(t frameType, mes *pb.Identify) error {
+	size := mes.Size()
+	buf := pool.Get(1 + binary.MaxVarintLen64 + size)
+	defer pool.Put(buf)
+
+	buf[0] = byte(t)
+	n := 1 + binary.PutUvarint(buf[1:], uint64(size))
+	if _, err := mes.MarshalToSizedBuffer(buf[n : n+size]); err != nil {
+		return err
+	}
+	_, err := ms.s.Write(buf[:n+size])
+	return err
+}
+
+func (ms *muxStream) readFrame(mes *pb.Identify) (frameType, error) {
+	t, err := ms.br.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	if err := ms.r.ReadMsg(mes); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	return frameType(t), nil
+}
+
+// muxStreamTo returns our IDMux stream to the given peer, nil if we don't
+// have one.
+func (ids *IDService) muxStreamTo(p peer.ID) *muxStream {
+	ids.muxMu.Lock()
+	defer ids.muxMu.Unlock()
+	return ids.muxStreams[p]
+}
+
+// addMuxStream records ms as our IDMux stream to the given peer, returning
+// false if we already have one.
+func (ids *IDService) addMuxStream(p peer.ID, ms *muxStream) bool {
+	ids.muxMu.Lock()
+	defer ids.muxMu.Unlock()
+	if _, ok := ids.muxStreams[p]; ok {
+		return false
+	}
+	ids.muxStreams[p] = ms
+	return true
+}
+
+// dropMuxStream resets a broken IDMux stream, and forgets it so that the next
+// exchange with the peer opens a new stream.
+func (ids *IDService) dropMuxStream(p peer.ID, ms *muxStream) {
+	_ = ms.s.Reset()
+	ids.muxMu.Lock()
+	defer ids.muxMu.Unlock()
+	if ids.muxStreams[p] == ms {
+		delete(ids.muxStreams, p)
+	}
+}
+
+// muxRequest identifies the remote peer over an IDMux stream before the given
+// deadline, consuming the response. The response is consumed as received on
+// the stream's connection, which may not be the connection being identified.
+func (ids *IDService) muxRequest(ms *muxStream, deadline time.Time) (*pb.Identify, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	c := ms.s.Conn()
+	_ = ms.s.SetDeadline(deadline)
+	sent := time.Now()
+	if err := ms.writeFrame(frameRequest, new(pb.Identify)); err != nil {
+		ids.dropMuxStream(c.RemotePeer(), ms)
+		return nil, err
+	}
+	mes := new(pb.Identify)
+	t, err := ms.readFrame(mes)
+	if err == nil && t != frameResponse {
+		err = fmt.Errorf("expected response frame, got frame type %d", t)
+	}
+	if err != nil {
+		ids.dropMuxStream(c.RemotePeer(), ms)
+		return nil, ids.checkReadErr(ms.s, err)
+	}
+	rtt := time.Since(sent)
+	_ = ms.s.SetDeadline(time.Time{})
+
+	ids.messageReceived(ID, mes)
+
+	if err := ids.checkMessage(mes, c); err != nil {
+		ids.dropMuxStream(c.RemotePeer(), ms)
+		return nil, err
+	}
+
+	log.Debugf("%s received message from %s %s", IDMux, c.RemotePeer(), c.RemoteMultiaddr())
+	ids.consumeMessage(mes, c, rtt)
+	return mes, nil
+}
+
+// muxSend sends a push or delta frame over an IDMux stream.
+func (ids *IDService) muxSend(ms *muxStream, t frameType, mes *pb.Identify) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	_ = ms.s.SetWriteDeadline(time.Now().Add(ids.streamTimeout()))
+	if err := ms.writeFrame(t, mes); err != nil {
+		ids.dropMuxStream(ms.s.Conn().RemotePeer(), ms)
+		return err
+	}
+	_ = ms.s.SetWriteDeadline(time.Time{})
+	ids.messageSent(t.protocol(), mes)
+	return nil
+}
+
+// closeMuxStreams closes all our IDMux streams.
+func (ids *IDService) closeMuxStreams() {
+	ids.muxMu.Lock()
+	defer ids.muxMu.Unlock()
+	for p, ms := range ids.muxStreams {
+		_ = ms.s.Close()
+		delete(ids.muxStreams, p)
+	}
+}
+
+// muxHandler serves the frames peers send us on their IDMux streams, until
+// they close the stream.
+func (ids *IDService) muxHandler(s network.Stream) {
+	c := s.Conn()
+	ms := newMuxStream(s, ids.maxMessageSize)
+	for {
+		mes := new(pb.Identify)
+		t, err := ms.readFrame(mes)
+		if err == io.EOF {
+			_ = s.Close()
+			return
+		}
+		if err != nil {
+			log.Debugw("error reading identify frame", "peer", c.RemotePeer(), "error", ids.checkReadErr(s, err))
+			_ = s.Reset()
+			return
+		}
+		if !ids.allowRequest(s) {
+			return
+		}
+		if t != frameRequest {
+			ids.messageReceived(t.protocol(), mes)
+		}
+
+		switch t {
+		case frameRequest:
+			err = ids.withSnapshot(c, func(snapshot *identifySnapshot) error {
+				resp := ids.createBaseIdentifyResponse(c, snapshot)
+				resp.SignedPeerRecord = ids.getSignedRecord(snapshot)
+				_ = s.SetWriteDeadline(time.Now().Add(ids.streamTimeout()))
+				if err := ms.writeFrame(frameResponse, resp); err != nil {
+					return err
+				}
+				ids.messageSent(ID, resp)
+				return nil
+			})
+			_ = s.SetWriteDeadline(time.Time{})
+		case framePush:
+			if ids.disablePush || !ids.allowUpdate(c.RemotePeer()) {
+				continue
+			}
+			if err = ids.checkMessage(mes, c); err == nil {
+				ids.consumeMessage(mes, c, 0)
+			}
+		case frameDelta:
+			if ids.disableDelta || !ids.allowUpdate(c.RemotePeer()) {
+				continue
+			}
+			if delta := mes.GetDelta(); delta != nil {
+				err = ids.consumeDelta(c, delta)
+			}
+		default:
+			err = fmt.Errorf("unknown frame type %d", t)
+		}
+		if err != nil {
+			log.Debugw("error handling identify frame", "peer", c.RemotePeer(), "frame", t, "error", err)
+			_ = s.Reset()
+			return
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package identify
 
 import (
+	"time"
+
 	"github.com/libp2p/go-libp2p-core/network"
 )
 
@@ -13,5 +15,13 @@ const IDPush = "/ipfs/id/push/1.0.0"
 
 // pushHandler handles incoming identify push streams. The behaviour is identical to the ordinary identify protocol.
 func (ids *IDService) pushHandler(s network.Stream) {
-	ids.handleIdentifyResponse(s)
+	if !ids.allowRequest(s) {
+		return
+	}
+	if !ids.allowUpdate(s.Conn().RemotePeer()) {
+		_ = s.Reset()
+		return
+	}
+	_ = s.SetReadDeadline(time.Now().Add(ids.streamTimeout()))
+	ids.handleIdentifyResponse(s, time.Time{})
 }
@@ -2,10 +2,14 @@ package identify_test
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"reflect"
 	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -25,9 +29,11 @@ import (
 	blhost "github.com/libp2p/go-libp2p-blankhost"
 	"github.com/libp2p/go-libp2p-peerstore/pstoremem"
 	swarmt "github.com/libp2p/go-libp2p-swarm/testing"
+	"github.com/libp2p/go-libp2p/p2p/host/peerlabel"
 	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
 	"github.com/libp2p/go-libp2p/p2p/protocol/identify"
 	pb "github.com/libp2p/go-libp2p/p2p/protocol/identify/pb"
+	"github.com/libp2p/go-libp2p/p2p/protocol/identify/useragent"
 
 	"github.com/libp2p/go-msgio/protoio"
 	ma "github.com/multiformats/go-multiaddr"
@@ -1106,3 +1112,1210 @@ func TestIncomingIDStreamsTimeout(t *testing.T) {
 		}, 1*time.Second, 200*time.Millisecond)
 	}
 }
+
+func TestIdentifyMetadata(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	defer h2.Close()
+
+	ids1, err := identify.NewIDService(h1)
+	require.NoError(t, err)
+	defer ids1.Close()
+
+	ids2, err := identify.NewIDService(h2, identify.Metadata(map[string][]byte{"rack": []byte("r1")}))
+	require.NoError(t, err)
+	defer ids2.Close()
+	ids2.SetMetadata("shard", []byte("42"))
+
+	require.Nil(t, ids1.PeerMetadata(h2.ID()))
+
+	require.NoError(t, h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+	conns := h1.Network().ConnsToPeer(h2.ID())
+	require.NotEmpty(t, conns)
+	ids1.IdentifyConn(conns[0])
+
+	require.Equal(t, map[string][]byte{
+		"rack":  []byte("r1"),
+		"shard": []byte("42"),
+	}, ids1.PeerMetadata(h2.ID()))
+}
+
+func TestIdentifyConnMetadata(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	defer h2.Close()
+
+	ids1, err := identify.NewIDService(h1)
+	require.NoError(t, err)
+	defer ids1.Close()
+
+	ids2, err := identify.NewIDService(h2, identify.ConnMetadata(func(c network.Conn) map[string][]byte {
+		return map[string][]byte{"session": []byte(c.RemotePeer())}
+	}))
+	require.NoError(t, err)
+	defer ids2.Close()
+
+	require.NoError(t, h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+	c1 := h1.Network().ConnsToPeer(h2.ID())[0]
+	ids1.IdentifyConn(c1)
+	require.Equal(t, map[string][]byte{"session": []byte(h1.ID())}, ids1.ConnMetadata(c1))
+
+	// h1 doesn't send any.
+	c2 := h2.Network().ConnsToPeer(h1.ID())[0]
+	ids2.IdentifyConn(c2)
+	require.Nil(t, ids2.ConnMetadata(c2))
+
+	// forgotten once the connection closes.
+	require.NoError(t, c1.Close())
+	require.Eventually(t, func() bool {
+		return ids1.ConnMetadata(c1) == nil
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestIdentifyRateLimit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	defer h2.Close()
+
+	ids1, err := identify.NewIDService(h1)
+	require.NoError(t, err)
+	defer ids1.Close()
+
+	// allow a single request per peer.
+	ids2, err := identify.NewIDService(h2, identify.RateLimit(0, 1, time.Hour))
+	require.NoError(t, err)
+	defer ids2.Close()
+
+	require.NoError(t, h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+	conns := h1.Network().ConnsToPeer(h2.ID())
+	require.NotEmpty(t, conns)
+	ids1.IdentifyConn(conns[0])
+	testHasProtocolVersions(t, h1, h2.ID())
+
+	// the second request should be rejected. Depending on timing, the reset
+	// may already be observed during protocol negotiation.
+	s, err := h1.NewStream(ctx, h2.ID(), identify.ID)
+	if err == nil {
+		_, err = ioutil.ReadAll(s)
+	}
+	require.Error(t, err)
+}
+
+func TestIdentifyDisablePushAndDelta(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	defer h2.Close()
+
+	ids1, err := identify.NewIDService(h1, identify.DisablePush(), identify.DisableDelta())
+	require.NoError(t, err)
+	defer ids1.Close()
+
+	ids2, err := identify.NewIDService(h2)
+	require.NoError(t, err)
+	defer ids2.Close()
+
+	require.Contains(t, h1.Mux().Protocols(), identify.ID)
+	require.NotContains(t, h1.Mux().Protocols(), identify.IDPush)
+	require.NotContains(t, h1.Mux().Protocols(), identify.IDDelta)
+
+	require.NoError(t, h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+
+	// identify still works in both directions.
+	c := h1.Network().ConnsToPeer(h2.ID())
+	require.NotEmpty(t, c)
+	ids1.IdentifyConn(c[0])
+	testHasProtocolVersions(t, h1, h2.ID())
+
+	c = h2.Network().ConnsToPeer(h1.ID())
+	require.NotEmpty(t, c)
+	ids2.IdentifyConn(c[0])
+	testHasProtocolVersions(t, h2, h1.ID())
+
+	protos, err := h2.Peerstore().GetProtocols(h1.ID())
+	require.NoError(t, err)
+	require.NotContains(t, protos, identify.IDPush)
+
+	// disconnecting must not block on the (non-existent) peer handlers.
+	require.NoError(t, h1.Network().ClosePeer(h2.ID()))
+}
+
+func TestIdentifyStrictValidation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	defer h2.Close()
+
+	ids1, err := identify.NewIDService(h1, identify.StrictValidation(true))
+	require.NoError(t, err)
+	defer ids1.Close()
+
+	// h2 sends an identify message containing a garbage listen address.
+	h2.SetStreamHandler(identify.ID, func(s network.Stream) {
+		defer s.Close()
+		w := protoio.NewDelimitedWriter(s)
+		w.WriteMsg(&pb.Identify{
+			Protocols:   []string{"/foo/1.0.0"},
+			ListenAddrs: [][]byte{[]byte("not a multiaddr")},
+		})
+	})
+
+	sub, err := h1.EventBus().Subscribe(new(event.EvtPeerIdentificationFailed))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	require.NoError(t, h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+	conns := h1.Network().ConnsToPeer(h2.ID())
+	require.NotEmpty(t, conns)
+	<-ids1.IdentifyWait(conns[0])
+
+	select {
+	case evt := <-sub.Out():
+		var verr *identify.ValidationError
+		require.ErrorAs(t, evt.(event.EvtPeerIdentificationFailed).Reason, &verr)
+		require.Equal(t, identify.InvalidListenAddr, verr.Reason)
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected identification to fail")
+	}
+
+	// nothing from the invalid message made it into the peerstore.
+	protos, err := h1.Peerstore().GetProtocols(h2.ID())
+	require.NoError(t, err)
+	require.NotContains(t, protos, "/foo/1.0.0")
+
+	require.Eventually(t, func() bool {
+		return h1.Network().Connectedness(h2.ID()) != network.Connected
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, map[identify.ValidationFailure]uint64{identify.InvalidListenAddr: 1}, ids1.ValidationFailures())
+}
+
+func TestIdentifyWaitResult(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	h3 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	defer h2.Close()
+	defer h3.Close()
+
+	ids1, err := identify.NewIDService(h1)
+	require.NoError(t, err)
+	defer ids1.Close()
+	ids2, err := identify.NewIDService(h2, identify.UserAgent("test/1.0"))
+	require.NoError(t, err)
+	defer ids2.Close()
+
+	// h2 runs identify.
+	require.NoError(t, h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+	c := h1.Network().ConnsToPeer(h2.ID())[0]
+	res := <-ids1.IdentifyWaitResult(c)
+	require.NoError(t, res.Err)
+	require.Equal(t, protocol.ID(identify.ID), res.Protocol)
+	require.Equal(t, identify.LibP2PVersion, res.ProtocolVersion)
+	require.Equal(t, "test/1.0", res.AgentVersion)
+
+	// asking again returns the same result immediately.
+	require.Equal(t, res, <-ids1.IdentifyWaitResult(c))
+
+	// h3 doesn't speak identify.
+	require.NoError(t, h1.Connect(ctx, peer.AddrInfo{ID: h3.ID(), Addrs: h3.Addrs()}))
+	c = h1.Network().ConnsToPeer(h3.ID())[0]
+	res = <-ids1.IdentifyWaitResult(c)
+	require.Error(t, res.Err)
+	require.Empty(t, res.ProtocolVersion)
+}
+
+func TestIdentifyMaxMessageSize(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	defer h2.Close()
+
+	ids1, err := identify.NewIDService(h1, identify.MaxMessageSize(512))
+	require.NoError(t, err)
+	defer ids1.Close()
+	ids2, err := identify.NewIDService(h2)
+	require.NoError(t, err)
+	defer ids2.Close()
+
+	for i := 0; i < 50; i++ {
+		h2.SetStreamHandler(protocol.ID(fmt.Sprintf("/some/long/protocol/name/%d", i)), func(network.Stream) {})
+	}
+
+	sub, err := h1.EventBus().Subscribe(new(identify.EvtMessageTooLarge))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	require.NoError(t, h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+	res := <-ids1.IdentifyWaitResult(h1.Network().ConnsToPeer(h2.ID())[0])
+	require.ErrorIs(t, res.Err, identify.ErrMessageTooLarge)
+
+	select {
+	case e := <-sub.Out():
+		evt := e.(identify.EvtMessageTooLarge)
+		require.Equal(t, h2.ID(), evt.Peer)
+		require.Equal(t, protocol.ID(identify.ID), evt.Protocol)
+		require.Equal(t, 512, evt.Limit)
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a message too large event")
+	}
+}
+
+func TestIdentifyProtocolFilter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	defer h2.Close()
+
+	ids1, err := identify.NewIDService(h1)
+	require.NoError(t, err)
+	defer ids1.Close()
+	ids2, err := identify.NewIDService(h2, identify.ProtocolFilter(func(p protocol.ID) bool {
+		return !strings.HasPrefix(string(p), "/private/")
+	}))
+	require.NoError(t, err)
+	defer ids2.Close()
+
+	h2.SetStreamHandler("/private/admin/1.0.0", func(network.Stream) {})
+	h2.SetStreamHandler("/public/1.0.0", func(network.Stream) {})
+
+	require.NoError(t, h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+	ids1.IdentifyConn(h1.Network().ConnsToPeer(h2.ID())[0])
+
+	protos, err := h1.Peerstore().GetProtocols(h2.ID())
+	require.NoError(t, err)
+	require.Contains(t, protos, "/public/1.0.0")
+	require.NotContains(t, protos, "/private/admin/1.0.0")
+
+	// protocols added later are filtered from deltas too.
+	h2.SetStreamHandler("/private/debug/1.0.0", func(network.Stream) {})
+	h2.SetStreamHandler("/public/2.0.0", func(network.Stream) {})
+	require.Eventually(t, func() bool {
+		protos, err := h1.Peerstore().SupportsProtocols(h2.ID(), "/public/2.0.0")
+		return err == nil && len(protos) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	protos, err = h1.Peerstore().GetProtocols(h2.ID())
+	require.NoError(t, err)
+	require.NotContains(t, protos, "/private/debug/1.0.0")
+}
+
+func TestIdentifyAddrsFactory(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	defer h2.Close()
+
+	public := ma.StringCast("/ip4/1.2.3.4/tcp/4001")
+	ids1, err := identify.NewIDService(h1)
+	require.NoError(t, err)
+	defer ids1.Close()
+	ids2, err := identify.NewIDService(h2, identify.AddrsFactory(func([]ma.Multiaddr) []ma.Multiaddr {
+		return []ma.Multiaddr{public}
+	}))
+	require.NoError(t, err)
+	defer ids2.Close()
+
+	require.NoError(t, h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+	ids1.IdentifyConn(h1.Network().ConnsToPeer(h2.ID())[0])
+
+	require.Equal(t, []ma.Multiaddr{public}, h1.Peerstore().Addrs(h2.ID()))
+
+	// the signed record only contains the advertised address.
+	cab, ok := peerstore.GetCertifiedAddrBook(h1.Peerstore())
+	require.True(t, ok)
+	env := cab.GetPeerRecord(h2.ID())
+	require.NotNil(t, env)
+	rec, err := env.Record()
+	require.NoError(t, err)
+	require.Equal(t, []ma.Multiaddr{public}, rec.(*peer.PeerRecord).Addrs)
+
+	// h2 still knows its own addresses.
+	require.NotContains(t, h2.Addrs(), public)
+}
+
+func TestIdentifyTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for _, stallNegotiation := range []bool{false, true} {
+		h1 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+		h2 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+		defer h1.Close()
+		defer h2.Close()
+
+		ids1, err := identify.NewIDService(h1, identify.Timeout(200*time.Millisecond))
+		require.NoError(t, err)
+		defer ids1.Close()
+
+		stall := func(s network.Stream) {
+			select {
+			case <-ctx.Done():
+			case <-time.After(10 * time.Second):
+			}
+			s.Reset()
+		}
+		if stallNegotiation {
+			h2.Network().SetStreamHandler(stall)
+		} else {
+			h2.SetStreamHandler(identify.ID, stall)
+		}
+
+		sub, err := h1.EventBus().Subscribe(new(event.EvtPeerIdentificationFailed), eventbus.BufSize(16))
+		require.NoError(t, err)
+		defer sub.Close()
+
+		require.NoError(t, h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+		start := time.Now()
+		res := <-ids1.IdentifyWaitResult(h1.Network().ConnsToPeer(h2.ID())[0])
+		require.ErrorIs(t, res.Err, identify.ErrTimeout)
+		require.Less(t, int64(time.Since(start)), int64(5*time.Second))
+
+		select {
+		case ev := <-sub.Out():
+			require.ErrorIs(t, ev.(event.EvtPeerIdentificationFailed).Reason, identify.ErrTimeout)
+		case <-time.After(5 * time.Second):
+			t.Fatal("did not receive identify failure event")
+		}
+	}
+}
+
+func TestIdentifyTimeoutBoundsNegotiation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	defer h2.Close()
+
+	const timeout = time.Second
+	ids1, err := identify.NewIDService(h1, identify.Timeout(timeout))
+	require.NoError(t, err)
+	defer ids1.Close()
+
+	// h2 is slow to negotiate, then stalls: the time spent negotiating
+	// counts against the timeout.
+	h2.Network().SetStreamHandler(func(s network.Stream) {
+		time.Sleep(700 * time.Millisecond)
+		_ = h2.Mux().Handle(s)
+	})
+	h2.SetStreamHandler(identify.ID, func(s network.Stream) {
+		select {
+		case <-ctx.Done():
+		case <-time.After(10 * time.Second):
+		}
+		s.Reset()
+	})
+
+	require.NoError(t, h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+	start := time.Now()
+	res := <-ids1.IdentifyWaitResult(h1.Network().ConnsToPeer(h2.ID())[0])
+	require.ErrorIs(t, res.Err, identify.ErrTimeout)
+	require.Less(t, int64(time.Since(start)), int64(timeout+400*time.Millisecond))
+}
+
+func TestIdentifyPeerInfo(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	defer h2.Close()
+
+	ids1, err := identify.NewIDService(h1)
+	require.NoError(t, err)
+	defer ids1.Close()
+	ids2, err := identify.NewIDService(h2, identify.UserAgent("peer/2"),
+		identify.Metadata(map[string][]byte{"k": []byte("v")}))
+	require.NoError(t, err)
+	defer ids2.Close()
+
+	_, err = ids1.PeerInfo(h2.ID())
+	require.Equal(t, identify.ErrNotIdentified, err)
+
+	require.NoError(t, h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+	c := h1.Network().ConnsToPeer(h2.ID())[0]
+	ids1.IdentifyConn(c)
+
+	info, err := ids1.PeerInfo(h2.ID())
+	require.NoError(t, err)
+	require.Equal(t, "peer/2", info.AgentVersion)
+	require.Equal(t, identify.LibP2PVersion, info.ProtocolVersion)
+	require.Contains(t, info.Protocols, protocol.ID(identify.ID))
+	require.ElementsMatch(t, h2.Addrs(), info.ListenAddrs)
+	require.NotNil(t, info.SignedPeerRecord)
+	require.Equal(t, c.LocalMultiaddr(), info.ObservedAddr)
+	require.Equal(t, map[string][]byte{"k": []byte("v")}, info.Metadata)
+}
+
+func TestIdentifyKeyMismatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	defer h2.Close()
+
+	var policyCalls int32
+	ids1, err := identify.NewIDService(h1, identify.KeyMismatchPolicy(func(evt identify.EvtPeerKeyMismatch) identify.KeyMismatchAction {
+		atomic.AddInt32(&policyCalls, 1)
+		return identify.KeyMismatchDisconnect
+	}))
+	require.NoError(t, err)
+	defer ids1.Close()
+	sub, err := h1.EventBus().Subscribe(new(identify.EvtPeerKeyMismatch))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	// h2 claims another peer's key.
+	_, otherKey, err := coretest.RandTestKeyPair(ic.Ed25519, 0)
+	require.NoError(t, err)
+	kb, err := ic.MarshalPublicKey(otherKey)
+	require.NoError(t, err)
+	h2.SetStreamHandler(identify.ID, func(s network.Stream) {
+		_ = protoio.NewDelimitedWriter(s).WriteMsg(&pb.Identify{PublicKey: kb})
+		s.Close()
+	})
+
+	require.NoError(t, h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+	ids1.IdentifyConn(h1.Network().ConnsToPeer(h2.ID())[0])
+
+	select {
+	case e := <-sub.Out():
+		evt := e.(identify.EvtPeerKeyMismatch)
+		require.Equal(t, h2.ID(), evt.Peer)
+		require.Equal(t, identify.KeyPeerIDMismatch, evt.Reason)
+		require.True(t, otherKey.Equals(evt.Key))
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a key mismatch event")
+	}
+	require.Equal(t, int32(1), atomic.LoadInt32(&policyCalls))
+	require.Eventually(t, func() bool {
+		return h1.Network().Connectedness(h2.ID()) != network.Connected
+	}, 5*time.Second, 10*time.Millisecond)
+	require.False(t, otherKey.Equals(h1.Peerstore().PubKey(h2.ID())))
+}
+
+func TestIdentifyInsecureMode(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	defer h2.Close()
+
+	ids1, err := identify.NewIDService(h1)
+	require.NoError(t, err)
+	defer ids1.Close()
+	ids2, err := identify.NewIDService(h2, identify.InsecureMode())
+	require.NoError(t, err)
+	defer ids2.Close()
+
+	require.NoError(t, h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+	ids1.IdentifyConn(h1.Network().ConnsToPeer(h2.ID())[0])
+	ids2.IdentifyConn(h2.Network().ConnsToPeer(h1.ID())[0])
+
+	info, err := ids1.PeerInfo(h2.ID())
+	require.NoError(t, err)
+	require.True(t, info.Authenticated)
+	info, err = ids2.PeerInfo(h1.ID())
+	require.NoError(t, err)
+	require.False(t, info.Authenticated)
+
+	// h2 doesn't send its key.
+	s, err := h1.NewStream(ctx, h2.ID(), identify.ID)
+	require.NoError(t, err)
+	defer s.Close()
+	var mes pb.Identify
+	require.NoError(t, protoio.NewDelimitedReader(s, identify.DefaultMaxMessageSize).ReadMsg(&mes))
+	require.Nil(t, mes.PublicKey)
+	require.NotEmpty(t, mes.ListenAddrs)
+}
+
+func TestIdentifyPeersByAgent(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	ids1, err := identify.NewIDService(h1)
+	require.NoError(t, err)
+	defer ids1.Close()
+
+	agents := []string{"rust-libp2p/0.30.0", "rust-libp2p/0.30.1", "go-ipfs/0.8.0/48f94e2"}
+	peers := make([]peer.ID, 0, len(agents))
+	for _, agent := range agents {
+		h := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+		defer h.Close()
+		ids, err := identify.NewIDService(h, identify.UserAgent(agent))
+		require.NoError(t, err)
+		defer ids.Close()
+
+		require.NoError(t, h1.Connect(ctx, peer.AddrInfo{ID: h.ID(), Addrs: h.Addrs()}))
+		ids1.IdentifyConn(h1.Network().ConnsToPeer(h.ID())[0])
+		peers = append(peers, h.ID())
+	}
+
+	classes := ids1.PeersByAgent()
+	require.Len(t, classes, 2)
+	require.ElementsMatch(t, peers[:2], classes[useragent.Class{Implementation: "rust-libp2p", Version: "0.30"}])
+	require.Equal(t, peers[2:], classes[useragent.Class{Implementation: "go-ipfs", Version: "0.8"}])
+}
+
+func TestIdentifyReuseStream(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	defer h2.Close()
+
+	ids1, err := identify.NewIDService(h1, identify.ReuseStream())
+	require.NoError(t, err)
+	defer ids1.Close()
+	ids2, err := identify.NewIDService(h2, identify.ReuseStream())
+	require.NoError(t, err)
+	defer ids2.Close()
+
+	countStreams := func(h host.Host, proto protocol.ID) (n int) {
+		for _, c := range h.Network().Conns() {
+			for _, s := range c.GetStreams() {
+				if s.Protocol() == proto {
+					n++
+				}
+			}
+		}
+		return n
+	}
+
+	require.NoError(t, h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+	res := <-ids1.IdentifyWaitResult(h1.Network().ConnsToPeer(h2.ID())[0])
+	require.NoError(t, res.Err)
+	require.Equal(t, protocol.ID(identify.IDMux), res.Protocol)
+	res = <-ids2.IdentifyWaitResult(h2.Network().ConnsToPeer(h1.ID())[0])
+	require.NoError(t, res.Err)
+	require.Equal(t, protocol.ID(identify.IDMux), res.Protocol)
+	testKnowsAddrs(t, h1, h2.ID(), h2.Peerstore().Addrs(h2.ID()))
+
+	// deltas and pushes are sent over the same streams.
+	h2.SetStreamHandler("/foo/bar/1.0.0", func(network.Stream) {})
+	require.Eventually(t, func() bool {
+		sup, err := h1.Peerstore().SupportsProtocols(h2.ID(), "/foo/bar/1.0.0")
+		return err == nil && len(sup) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	lad := ma.StringCast("/ip4/127.0.0.1/tcp/0")
+	require.NoError(t, h2.Network().Listen(lad))
+	emitAddrChangeEvt(t, h2)
+	require.Eventually(t, func() bool {
+		return len(h1.Peerstore().Addrs(h2.ID())) == len(h2.Addrs())
+	}, 5*time.Second, 10*time.Millisecond)
+
+	require.Equal(t, 0, countStreams(h1, identify.IDDelta)+countStreams(h1, identify.IDPush))
+	// one stream opened by each peer.
+	require.Equal(t, 2, countStreams(h1, identify.IDMux))
+
+	// peers that don't support IDMux are identified over the regular
+	// protocol.
+	h3 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	defer h3.Close()
+	ids3, err := identify.NewIDService(h3)
+	require.NoError(t, err)
+	defer ids3.Close()
+
+	require.NoError(t, h1.Connect(ctx, peer.AddrInfo{ID: h3.ID(), Addrs: h3.Addrs()}))
+	res = <-ids1.IdentifyWaitResult(h1.Network().ConnsToPeer(h3.ID())[0])
+	require.NoError(t, res.Err)
+	require.Equal(t, protocol.ID(identify.ID), res.Protocol)
+}
+
+func TestIdentifyEvtPeerIdentified(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	defer h2.Close()
+	h2.SetStreamHandler("/foo/bar/1.0.0", func(network.Stream) {})
+
+	sub, err := h1.EventBus().Subscribe(new(identify.EvtPeerIdentified))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	ids1, err := identify.NewIDService(h1)
+	require.NoError(t, err)
+	defer ids1.Close()
+	ids2, err := identify.NewIDService(h2, identify.UserAgent("peer/2"))
+	require.NoError(t, err)
+	defer ids2.Close()
+
+	require.NoError(t, peerlabel.Set(h1.Peerstore(), h2.ID(), "peer-2"))
+	require.NoError(t, h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+
+	var evt identify.EvtPeerIdentified
+	select {
+	case e := <-sub.Out():
+		evt = e.(identify.EvtPeerIdentified)
+	case <-time.After(5 * time.Second):
+		t.Fatal("did not receive peer identified event")
+	}
+	require.Equal(t, h2.ID(), evt.Peer)
+	require.Equal(t, "peer-2", evt.Label)
+	require.Equal(t, h1.Network().ConnsToPeer(h2.ID())[0], evt.Conn)
+	require.Equal(t, "peer/2", evt.AgentVersion)
+	require.Equal(t, identify.LibP2PVersion, evt.ProtocolVersion)
+	require.Contains(t, evt.Protocols, protocol.ID("/foo/bar/1.0.0"))
+	require.ElementsMatch(t, h2.Addrs(), evt.ListenAddrs)
+	require.NotNil(t, evt.SignedPeerRecord)
+	require.NotNil(t, evt.ObservedAddr)
+}
+
+func TestIdentifyPushDebounce(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	defer h2.Close()
+
+	ids1, err := identify.NewIDService(h1, identify.PushDebounce(300*time.Millisecond))
+	require.NoError(t, err)
+	defer ids1.Close()
+	ids2, err := identify.NewIDService(h2)
+	require.NoError(t, err)
+	defer ids2.Close()
+
+	require.NoError(t, h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+	<-ids1.IdentifyWait(h1.Network().ConnsToPeer(h2.ID())[0])
+	<-ids2.IdentifyWait(h2.Network().ConnsToPeer(h1.ID())[0])
+
+	var mu sync.Mutex
+	var pushes int
+	h2.SetStreamHandler(identify.IDPush, func(s network.Stream) {
+		mu.Lock()
+		pushes++
+		mu.Unlock()
+		s.Close()
+	})
+	numPushes := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return pushes
+	}
+
+	for i := 0; i < 5; i++ {
+		emitAddrChangeEvt(t, h1)
+	}
+	require.Eventually(t, func() bool { return numPushes() == 1 }, 5*time.Second, 10*time.Millisecond)
+	time.Sleep(500 * time.Millisecond)
+	require.Equal(t, 1, numPushes())
+	require.Equal(t, uint64(4), ids1.UpdateStats().Coalesced)
+}
+
+func TestIdentifyPeerstoreLimits(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	defer h2.Close()
+	require.NoError(t, h2.Network().Listen(ma.StringCast("/ip4/127.0.0.1/tcp/0")))
+	require.Len(t, h2.Addrs(), 2)
+
+	ids1, err := identify.NewIDService(h1, identify.PeerstoreLimits(1, 1))
+	require.NoError(t, err)
+	defer ids1.Close()
+	// sign a record with all our addresses.
+	ids2, err := identify.NewIDService(h2, identify.AddrsFactory(func(addrs []ma.Multiaddr) []ma.Multiaddr { return addrs }))
+	require.NoError(t, err)
+	defer ids2.Close()
+
+	require.NoError(t, h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()[:1]}))
+	ids1.IdentifyConn(h1.Network().ConnsToPeer(h2.ID())[0])
+	require.Len(t, h1.Peerstore().Addrs(h2.ID()), 1)
+	require.Nil(t, getSignedRecord(t, h1, h2.ID()))
+	stats := ids1.PeerstoreLimitStats()
+	require.Equal(t, uint64(1), stats.AddrsTruncated)
+	require.Equal(t, uint64(1), stats.RecordsDropped)
+
+	// the first push is applied, further pushes within the minute are
+	// dropped.
+	ids2.IdentifyConn(h2.Network().ConnsToPeer(h1.ID())[0])
+	for i := 0; i < 3; i++ {
+		emitAddrChangeEvt(t, h2)
+		time.Sleep(100 * time.Millisecond)
+	}
+	require.Eventually(t, func() bool {
+		return ids1.PeerstoreLimitStats().UpdatesDropped > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Len(t, h1.Peerstore().Addrs(h2.ID()), 1)
+}
+
+func TestIdentifyAddrDeltas(t *testing.T) {
+	for _, signed := range []bool{true, false} {
+		t.Run(fmt.Sprintf("signed=%t", signed), func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			h1 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+			h2 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+			defer h1.Close()
+			defer h2.Close()
+
+			var addrsMu sync.Mutex
+			addrs := h1.Addrs()
+			opts := []identify.Option{identify.AddrDeltas(), identify.AddrsFactory(func([]ma.Multiaddr) []ma.Multiaddr {
+				addrsMu.Lock()
+				defer addrsMu.Unlock()
+				return addrs
+			})}
+			if !signed {
+				opts = append(opts, identify.DisableSignedPeerRecord())
+			}
+			ids1, err := identify.NewIDService(h1, opts...)
+			require.NoError(t, err)
+			defer ids1.Close()
+			ids2, err := identify.NewIDService(h2)
+			require.NoError(t, err)
+			defer ids2.Close()
+
+			require.NoError(t, h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+			<-ids1.IdentifyWait(h1.Network().ConnsToPeer(h2.ID())[0])
+			<-ids2.IdentifyWait(h2.Network().ConnsToPeer(h1.ID())[0])
+
+			// address changes must not be pushed.
+			h2.SetStreamHandler(identify.IDPush, func(s network.Stream) {
+				t.Error("unexpected push")
+				s.Reset()
+			})
+
+			added := ma.StringCast("/ip4/1.2.3.4/tcp/1234")
+			addrsMu.Lock()
+			removed := addrs[0]
+			addrs = append([]ma.Multiaddr{added}, addrs[1:]...)
+			want := addrs
+			addrsMu.Unlock()
+			emitAddrChangeEvt(t, h1)
+
+			require.Eventually(t, func() bool {
+				return reflect.DeepEqual(sortedAddrs(want), sortedAddrs(h2.Peerstore().Addrs(h1.ID())))
+			}, 5*time.Second, 10*time.Millisecond)
+			require.NotContains(t, h2.Peerstore().Addrs(h1.ID()), removed)
+
+			cab, ok := peerstore.GetCertifiedAddrBook(h2.Peerstore())
+			require.True(t, ok)
+			if signed {
+				rec, err := cab.GetPeerRecord(h1.ID()).Record()
+				require.NoError(t, err)
+				require.Equal(t, sortedAddrs(want), sortedAddrs(rec.(*peer.PeerRecord).Addrs))
+			} else {
+				require.Nil(t, cab.GetPeerRecord(h1.ID()))
+			}
+		})
+	}
+}
+
+func sortedAddrs(addrs []ma.Multiaddr) []string {
+	out := make([]string, 0, len(addrs))
+	for _, a := range addrs {
+		out = append(out, a.String())
+	}
+	sort.Strings(out)
+	return out
+}
+
+func TestIdentifyRequireProtocolVersion(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	h3 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	defer h2.Close()
+	defer h3.Close()
+
+	ids1, err := identify.NewIDService(h1, identify.RequireProtocolVersion(func(v string) bool {
+		return v == identify.LibP2PVersion
+	}))
+	require.NoError(t, err)
+	defer ids1.Close()
+	ids2, err := identify.NewIDService(h2)
+	require.NoError(t, err)
+	defer ids2.Close()
+	// h3 runs a different protocol version.
+	h3.SetStreamHandler(identify.ID, func(s network.Stream) {
+		pv := "private/1.0.0"
+		protoio.NewDelimitedWriter(s).WriteMsg(&pb.Identify{ProtocolVersion: &pv})
+		s.Close()
+	})
+
+	sub, err := h1.EventBus().Subscribe(new(event.EvtPeerIdentificationFailed))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	require.NoError(t, h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+	<-ids1.IdentifyWait(h1.Network().ConnsToPeer(h2.ID())[0])
+	require.Equal(t, network.Connected, h1.Network().Connectedness(h2.ID()))
+
+	require.NoError(t, h1.Connect(ctx, peer.AddrInfo{ID: h3.ID(), Addrs: h3.Addrs()}))
+	res := <-ids1.IdentifyWaitResult(h1.Network().ConnsToPeer(h3.ID())[0])
+	var verr *identify.ValidationError
+	require.True(t, errors.As(res.Err, &verr))
+	require.Equal(t, identify.RejectedProtocolVersion, verr.Reason)
+
+	select {
+	case e := <-sub.Out():
+		evt := e.(event.EvtPeerIdentificationFailed)
+		require.Equal(t, h3.ID(), evt.Peer)
+		require.True(t, errors.As(evt.Reason, &verr))
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected an identification failed event")
+	}
+	require.Eventually(t, func() bool {
+		return h1.Network().Connectedness(h3.ID()) != network.Connected
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, uint64(1), ids1.ValidationFailures()[identify.RejectedProtocolVersion])
+}
+
+func TestIdentifyMaxConcurrent(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	ids1, err := identify.NewIDService(h1, identify.MaxConcurrentIdentify(1))
+	require.NoError(t, err)
+	defer ids1.Close()
+
+	// peers stalling identify until released.
+	release := make(chan struct{})
+	var peers []host.Host
+	for i := 0; i < 3; i++ {
+		h := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+		defer h.Close()
+		h.SetStreamHandler(identify.ID, func(s network.Stream) {
+			<-release
+			s.Reset()
+		})
+		peers = append(peers, h)
+	}
+
+	var waits []<-chan struct{}
+	for _, h := range peers {
+		require.NoError(t, h1.Connect(ctx, peer.AddrInfo{ID: h.ID(), Addrs: h.Addrs()}))
+		waits = append(waits, ids1.IdentifyWait(h1.Network().ConnsToPeer(h.ID())[0]))
+	}
+	require.Eventually(t, func() bool {
+		st := ids1.IdentifyQueueStats()
+		return st.Active == 1 && st.Queued == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	close(release)
+	for _, w := range waits {
+		select {
+		case <-w:
+		case <-time.After(5 * time.Second):
+			t.Fatal("identify did not complete")
+		}
+	}
+	st := ids1.IdentifyQueueStats()
+	require.Zero(t, st.Active)
+	require.Zero(t, st.Queued)
+	require.Equal(t, int64(2), st.MaxQueued)
+	require.Equal(t, uint64(2), st.Waited)
+}
+
+// sameConn is another connection to the same peer, as far as identify is
+// concerned.
+type sameConn struct {
+	network.Conn
+}
+
+func TestIdentifyDedup(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	defer h2.Close()
+
+	ids1, err := identify.NewIDService(h1, identify.DedupIdentify(500*time.Millisecond))
+	require.NoError(t, err)
+	defer ids1.Close()
+	ids2, err := identify.NewIDService(h2)
+	require.NoError(t, err)
+	defer ids2.Close()
+
+	require.NoError(t, h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+	conn := h1.Network().ConnsToPeer(h2.ID())[0]
+	res := <-ids1.IdentifyWaitResult(conn)
+	require.NoError(t, res.Err)
+	require.False(t, res.Reused)
+
+	// a second connection reuses the result of the first one.
+	res2 := <-ids1.IdentifyWaitResult(&sameConn{conn})
+	require.NoError(t, res2.Err)
+	require.True(t, res2.Reused)
+	require.Equal(t, res.AgentVersion, res2.AgentVersion)
+
+	// until the result is stale.
+	time.Sleep(500 * time.Millisecond)
+	res3 := <-ids1.IdentifyWaitResult(&sameConn{conn})
+	require.NoError(t, res3.Err)
+	require.False(t, res3.Reused)
+
+	// concurrent connections wait for the first one.
+	c1, c2 := &sameConn{conn}, &sameConn{conn}
+	time.Sleep(500 * time.Millisecond)
+	wait1, wait2 := ids1.IdentifyWaitResult(c1), ids1.IdentifyWaitResult(c2)
+	res, res2 = <-wait1, <-wait2
+	require.NoError(t, res.Err)
+	require.NoError(t, res2.Err)
+	require.True(t, res.Reused != res2.Reused, "exactly one connection must be identified")
+}
+
+func TestIdentifyRefresh(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	defer h2.Close()
+
+	ids1, err := identify.NewIDService(h1, identify.DedupIdentify(time.Hour))
+	require.NoError(t, err)
+	defer ids1.Close()
+	// h2 doesn't tell us about its protocol updates.
+	ids2, err := identify.NewIDService(h2, identify.DisablePush(), identify.DisableDelta())
+	require.NoError(t, err)
+	defer ids2.Close()
+
+	require.ErrorIs(t, ids1.Refresh(ctx, h2.ID()), identify.ErrNotConnected)
+
+	require.NoError(t, h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+	ids1.IdentifyConn(h1.Network().ConnsToPeer(h2.ID())[0])
+
+	h2.SetStreamHandler("/test/new", func(s network.Stream) { s.Close() })
+	protos, err := h1.Peerstore().SupportsProtocols(h2.ID(), "/test/new")
+	require.NoError(t, err)
+	require.Empty(t, protos)
+
+	require.NoError(t, ids1.Refresh(ctx, h2.ID()))
+	protos, err = h1.Peerstore().SupportsProtocols(h2.ID(), "/test/new")
+	require.NoError(t, err)
+	require.Equal(t, []string{"/test/new"}, protos)
+
+	res := <-ids1.IdentifyWaitResult(h1.Network().ConnsToPeer(h2.ID())[0])
+	require.NoError(t, res.Err)
+	require.False(t, res.Reused)
+}
+
+func TestIdentifyMissingRecord(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	publish := func(h host.Host) {
+		rec := peer.PeerRecordFromAddrInfo(peer.AddrInfo{ID: h.ID(), Addrs: h.Addrs()})
+		env, err := record.Seal(rec, h.Peerstore().PrivKey(h.ID()))
+		require.NoError(t, err)
+		cab, _ := peerstore.GetCertifiedAddrBook(h.Peerstore())
+		_, err = cab.ConsumePeerRecord(env, peerstore.PermanentAddrTTL)
+		require.NoError(t, err)
+	}
+
+	for _, tc := range []struct {
+		name       string
+		opts       []identify.Option
+		publishing bool
+		hasRecord  bool
+	}{
+		{name: "default"},
+		{name: "sign", opts: []identify.Option{identify.SignMissingRecord()}, hasRecord: true},
+		{name: "wait", opts: []identify.Option{identify.WaitForRecord(5 * time.Second)}, publishing: true, hasRecord: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h1 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+			h2 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+			defer h1.Close()
+			defer h2.Close()
+			// h1 didn't publish its record yet.
+			h1.Peerstore().ClearAddrs(h1.ID())
+
+			ids1, err := identify.NewIDService(h1, tc.opts...)
+			require.NoError(t, err)
+			defer ids1.Close()
+			ids2, err := identify.NewIDService(h2)
+			require.NoError(t, err)
+			defer ids2.Close()
+
+			if tc.publishing {
+				go func() {
+					time.Sleep(200 * time.Millisecond)
+					publish(h1)
+				}()
+			}
+
+			require.NoError(t, h2.Connect(ctx, peer.AddrInfo{ID: h1.ID(), Addrs: h1.Addrs()}))
+			res := <-ids2.IdentifyWaitResult(h2.Network().ConnsToPeer(h1.ID())[0])
+			require.NoError(t, res.Err)
+
+			cab, _ := peerstore.GetCertifiedAddrBook(h2.Peerstore())
+			require.Equal(t, tc.hasRecord, cab.GetPeerRecord(h1.ID()) != nil)
+		})
+	}
+}
+
+func TestIdentifyCustomProtocolIDs(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mynet := identify.ProtocolIDs{
+		ID:    "/mynet/id/1.0.0",
+		Push:  "/mynet/id/push/1.0.0",
+		Delta: "/mynet/id/delta/1.0.0",
+	}
+
+	// h1 only speaks the custom protocols, h2 both, and h3 the default ones.
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	h3 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	defer h2.Close()
+	defer h3.Close()
+
+	ids1, err := identify.NewIDService(h1, identify.WithProtocolIDs(mynet, false))
+	require.NoError(t, err)
+	defer ids1.Close()
+	ids2, err := identify.NewIDService(h2, identify.WithProtocolIDs(mynet, true))
+	require.NoError(t, err)
+	defer ids2.Close()
+	ids3, err := identify.NewIDService(h3)
+	require.NoError(t, err)
+	defer ids3.Close()
+
+	require.Contains(t, h1.Mux().Protocols(), "/mynet/id/1.0.0")
+	require.NotContains(t, h1.Mux().Protocols(), identify.ID)
+	// unset IDs keep their default.
+	require.Contains(t, h1.Mux().Protocols(), identify.IDDeltaAddrs)
+	require.True(t, ids1.IsIdentifyProtocol("/mynet/id/push/1.0.0"))
+	require.False(t, ids1.IsIdentifyProtocol(identify.IDPush))
+	require.True(t, ids2.IsIdentifyProtocol(identify.IDPush))
+
+	identifyConn := func(from, to host.Host, ids *identify.IDService) identify.IdentifyResult {
+		require.NoError(t, from.Connect(ctx, peer.AddrInfo{ID: to.ID(), Addrs: to.Addrs()}))
+		return <-ids.IdentifyWaitResult(from.Network().ConnsToPeer(to.ID())[0])
+	}
+
+	res := identifyConn(h1, h2, ids1)
+	require.NoError(t, res.Err)
+	require.Equal(t, protocol.ID("/mynet/id/1.0.0"), res.Protocol)
+	res = identifyConn(h3, h2, ids3)
+	require.NoError(t, res.Err)
+	require.Equal(t, protocol.ID(identify.ID), res.Protocol)
+	require.Error(t, identifyConn(h1, h3, ids1).Err)
+
+	// updates are sent over the custom protocols too.
+	h2.SetStreamHandler("/test/new", func(network.Stream) {})
+	require.Eventually(t, func() bool {
+		protos, err := h1.Peerstore().SupportsProtocols(h2.ID(), "/test/new")
+		return err == nil && len(protos) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestIdentifyDebugDump(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	h3 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	defer h2.Close()
+	defer h3.Close()
+
+	ids1, err := identify.NewIDService(h1)
+	require.NoError(t, err)
+	defer ids1.Close()
+	ids2, err := identify.NewIDService(h2)
+	require.NoError(t, err)
+	defer ids2.Close()
+
+	// h3 stalls identify until released.
+	release := make(chan struct{})
+	defer close(release)
+	h3.SetStreamHandler(identify.ID, func(s network.Stream) {
+		<-release
+		s.Reset()
+	})
+
+	require.NoError(t, h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+	ids1.IdentifyConn(h1.Network().ConnsToPeer(h2.ID())[0])
+	require.NoError(t, h1.Connect(ctx, peer.AddrInfo{ID: h3.ID(), Addrs: h3.Addrs()}))
+	ids1.IdentifyWait(h1.Network().ConnsToPeer(h3.ID())[0])
+
+	var st identify.DebugState
+	require.Eventually(t, func() bool {
+		st = ids1.DebugDump()
+		return len(st.Conns) == 2 && len(st.Handlers) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	stages := make(map[peer.ID]identify.IdentifyStage)
+	for _, c := range st.Conns {
+		stages[c.Peer] = c.Stage
+		require.False(t, c.Started.IsZero())
+	}
+	require.Equal(t, identify.IdentifyDone, stages[h2.ID()])
+	require.Equal(t, identify.IdentifyReading, stages[h3.ID()])
+	// h2 identified us, asking for our handler for it.
+	require.Equal(t, h2.ID(), st.Handlers[0].Peer)
+	require.True(t, st.Handlers[0].Running)
+	require.Empty(t, st.Errors)
+
+	release <- struct{}{}
+	require.Eventually(t, func() bool {
+		st = ids1.DebugDump()
+		_, ok := st.Errors[h3.ID()]
+		return ok
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, "identify", st.Errors[h3.ID()].Op)
+	require.Error(t, st.Errors[h3.ID()].Err)
+}
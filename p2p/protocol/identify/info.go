@@ -0,0 +1,162 @@
+package identify
+
+import (
+	"errors"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	"github.com/libp2p/go-libp2p-core/record"
+
+	"github.com/libp2p/go-libp2p/p2p/host/peerlabel"
+	pb "github.com/libp2p/go-libp2p/p2p/protocol/identify/pb"
+	"github.com/libp2p/go-libp2p/p2p/protocol/identify/useragent"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// ErrNotIdentified is returned by PeerInfo for peers we haven't identified.
+var ErrNotIdentified = errors.New("peer has not been identified")
+
+// IdentifySnapshot is what we learned about a peer by identifying it.
+type IdentifySnapshot struct {
+	AgentVersion    string
+	ProtocolVersion string
+	Protocols       []protocol.ID
+	// ListenAddrs are the addresses we know the peer listens on.
+	ListenAddrs []ma.Multiaddr
+	// SignedPeerRecord is nil if the peer didn't send us a signed peer
+	// record, or if the peerstore doesn't support them.
+	SignedPeerRecord *record.Envelope
+	// ObservedAddr is the address the peer last observed us at, if it told
+	// us.
+	ObservedAddr ma.Multiaddr
+	// Metadata is the application metadata the peer sent us, if any.
+	Metadata map[string][]byte
+	// Label is the label we gave the peer, see the peerlabel package.
+	Label string
+	// Authenticated is true if the security channel of the connection we
+	// last identified the peer on authenticated its public key. It's always
+	// false in InsecureMode.
+	Authenticated bool
+	// Seq is the sequence number of the latest state the peer sent us, 0 if
+	// it doesn't number its state. Messages with older state are discarded.
+	Seq uint64
+}
+
+// EvtPeerIdentified is emitted right before
+// event.EvtPeerIdentificationCompleted, carrying what the peer told us in its
+// Identify response, so that subscribers don't need to look it up in the
+// peerstore.
+type EvtPeerIdentified struct {
+	Peer peer.ID
+	// Label is the label we gave the peer, see the peerlabel package.
+	Label string
+	// Conn is the connection we identified.
+	Conn network.Conn
+	// Authenticated is true if the security channel of Conn authenticated
+	// the peer's public key. It's always false in InsecureMode.
+	Authenticated   bool
+	AgentVersion    string
+	ProtocolVersion string
+	Protocols       []protocol.ID
+	// ListenAddrs are the addresses the peer told us it listens on. Invalid
+	// addresses are skipped.
+	ListenAddrs []ma.Multiaddr
+	// SignedPeerRecord is nil if the peer didn't send us a valid signed peer
+	// record.
+	SignedPeerRecord *record.Envelope
+	// ObservedAddr is the address the peer observed us at, nil if it didn't
+	// tell us.
+	ObservedAddr ma.Multiaddr
+}
+
+func (ids *IDService) newEvtPeerIdentified(c network.Conn, mes *pb.Identify) EvtPeerIdentified {
+	evt := EvtPeerIdentified{
+		Peer:            c.RemotePeer(),
+		Label:           peerlabel.Get(ids.Host.Peerstore(), c.RemotePeer()),
+		Conn:            c,
+		Authenticated:   ids.authenticated(c),
+		AgentVersion:    mes.GetAgentVersion(),
+		ProtocolVersion: mes.GetProtocolVersion(),
+		Protocols:       protocol.ConvertFromStrings(mes.GetProtocols()),
+	}
+	for _, b := range mes.GetListenAddrs() {
+		if a, err := ma.NewMultiaddrBytes(b); err == nil {
+			evt.ListenAddrs = append(evt.ListenAddrs, a)
+		}
+	}
+	evt.SignedPeerRecord, _ = signedPeerRecordFromMessage(mes)
+	if b := mes.GetObservedAddr(); len(b) > 0 {
+		evt.ObservedAddr, _ = ma.NewMultiaddrBytes(b)
+	}
+	return evt
+}
+
+// authenticated returns whether the security channel of c authenticated the
+// remote peer's public key.
+func (ids *IDService) authenticated(c network.Conn) bool {
+	if ids.insecure {
+		return false
+	}
+	key := c.RemotePublicKey()
+	return key != nil && c.RemotePeer().MatchesPublicKey(key)
+}
+
+// PeerInfo returns what we learned about the given peer by identifying it, or
+// ErrNotIdentified if we haven't identified it yet.
+func (ids *IDService) PeerInfo(p peer.ID) (IdentifySnapshot, error) {
+	ps := ids.Host.Peerstore()
+
+	var snapshot IdentifySnapshot
+	v, err := ps.Get(p, "AgentVersion")
+	if err == peerstore.ErrNotFound {
+		return snapshot, ErrNotIdentified
+	} else if err != nil {
+		return snapshot, err
+	}
+	snapshot.AgentVersion, _ = v.(string)
+	if v, err := ps.Get(p, "ProtocolVersion"); err == nil {
+		snapshot.ProtocolVersion, _ = v.(string)
+	}
+	if v, err := ps.Get(p, "IdentifyAuthenticated"); err == nil {
+		snapshot.Authenticated, _ = v.(bool)
+	}
+	if v, err := ps.Get(p, "IdentifyObservedAddr"); err == nil {
+		snapshot.ObservedAddr, _ = v.(ma.Multiaddr)
+	}
+
+	protos, err := ps.GetProtocols(p)
+	if err != nil {
+		return snapshot, err
+	}
+	snapshot.Protocols = protocol.ConvertFromStrings(protos)
+	snapshot.ListenAddrs = ps.Addrs(p)
+	if cab, ok := peerstore.GetCertifiedAddrBook(ps); ok {
+		snapshot.SignedPeerRecord = cab.GetPeerRecord(p)
+	}
+	snapshot.Metadata = ids.PeerMetadata(p)
+	snapshot.Label = peerlabel.Get(ps, p)
+	snapshot.Seq = ids.peerSnapshotSeq(p)
+	return snapshot, nil
+}
+
+// PeersByAgent classifies the connected peers we identified by the
+// implementation and major.minor version of their agent version, e.g. to
+// count the rust-libp2p 0.30 peers we're connected to. See the useragent
+// package.
+func (ids *IDService) PeersByAgent() map[useragent.Class][]peer.ID {
+	ps := ids.Host.Peerstore()
+	classes := make(map[useragent.Class][]peer.ID)
+	for _, p := range ids.Host.Network().Peers() {
+		v, err := ps.Get(p, "AgentVersion")
+		if err != nil {
+			continue
+		}
+		av, _ := v.(string)
+		c := useragent.Parse(av).Class()
+		classes[c] = append(classes[c], p)
+	}
+	return classes
+}
@@ -0,0 +1,17 @@
+// Package interop tests the wire compatibility of our Identify, Identify Push
+// and Identify Delta implementations with other libp2p implementations, like
+// js-libp2p and rust-libp2p, running as a daemon. It only holds tests.
+//
+// The tests are skipped unless a daemon is configured, with one of these
+// environment variables:
+//
+//   - LIBP2P_INTEROP_PEER: the address of a running daemon, including its peer
+//     ID, e.g. /ip4/127.0.0.1/tcp/4001/p2p/QmPeer.
+//   - LIBP2P_INTEROP_DAEMON: the command starting a daemon, e.g.
+//     "p2pd -hostAddrs /ip4/127.0.0.1/tcp/0". The tests read the daemon's
+//     peer ID and addresses from the "Peer ID:" line and the address lines
+//     it prints on startup, as p2pd does, and stop it once done.
+//
+// Set LIBP2P_INTEROP_SIGNED_RECORD=1 as well to require the daemon to send
+// signed peer records.
+package interop
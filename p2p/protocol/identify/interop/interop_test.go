@@ -0,0 +1,287 @@
+package interop
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	ic "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	"github.com/libp2p/go-libp2p-core/record"
+
+	"github.com/libp2p/go-libp2p/p2p/protocol/identify"
+	pb "github.com/libp2p/go-libp2p/p2p/protocol/identify/pb"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/libp2p/go-msgio/protoio"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+const testProto = "/interop/test/1.0.0"
+
+// daemon returns the address of the daemon to test against, starting it if
+// needed, and skips the test if none is configured.
+func daemon(t *testing.T) peer.AddrInfo {
+	t.Helper()
+	if addr := os.Getenv("LIBP2P_INTEROP_PEER"); addr != "" {
+		a, err := ma.NewMultiaddr(addr)
+		require.NoError(t, err)
+		ai, err := peer.AddrInfoFromP2pAddr(a)
+		require.NoError(t, err)
+		return *ai
+	}
+	cmdline := strings.Fields(os.Getenv("LIBP2P_INTEROP_DAEMON"))
+	if len(cmdline) == 0 {
+		t.Skip("no daemon configured, see the package documentation")
+	}
+	return startDaemon(t, cmdline)
+}
+
+// startDaemon starts a daemon with the given command line, and reads its peer
+// ID and addresses from its output.
+func startDaemon(t *testing.T, cmdline []string) peer.AddrInfo {
+	t.Helper()
+	cmd := exec.Command(cmdline[0], cmdline[1:]...)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.StdoutPipe()
+	require.NoError(t, err)
+	require.NoError(t, cmd.Start())
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+
+	started := make(chan peer.AddrInfo, 1)
+	go func() {
+		var ai peer.AddrInfo
+		scanner := bufio.NewScanner(out)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			switch {
+			case strings.HasPrefix(line, "Peer ID:"):
+				ai.ID, _ = peer.Decode(strings.TrimSpace(strings.TrimPrefix(line, "Peer ID:")))
+			case strings.HasPrefix(line, "/"):
+				if a, err := ma.NewMultiaddr(line); err == nil {
+					ai.Addrs = append(ai.Addrs, a)
+				}
+			}
+			if ai.ID != "" && len(ai.Addrs) > 0 {
+				started <- ai
+				break
+			}
+		}
+		// don't block the daemon on a full pipe.
+		_, _ = io.Copy(ioutil.Discard, out)
+	}()
+
+	select {
+	case ai := <-started:
+		return ai
+	case <-time.After(10 * time.Second):
+		t.Fatal("daemon didn't print its peer ID and addresses")
+		return peer.AddrInfo{}
+	}
+}
+
+func newHost(t *testing.T) host.Host {
+	t.Helper()
+	h, err := libp2p.New(context.Background(), libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	require.NoError(t, err)
+	t.Cleanup(func() { h.Close() })
+	return h
+}
+
+func idService(t *testing.T, h host.Host) *identify.IDService {
+	t.Helper()
+	ih, ok := h.(interface{ IDService() *identify.IDService })
+	require.True(t, ok, "host doesn't expose its identify service")
+	return ih.IDService()
+}
+
+// connect connects to the daemon, and waits until it's identified.
+func connect(t *testing.T, h host.Host, d peer.AddrInfo) network.Conn {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.NoError(t, h.Connect(ctx, d))
+	c := h.Network().ConnsToPeer(d.ID)[0]
+	res := <-idService(t, h).IdentifyWaitResult(c)
+	require.NoError(t, res.Err)
+	t.Logf("identified daemon: agent %q, protocol version %q", res.AgentVersion, res.ProtocolVersion)
+	return c
+}
+
+// requireSupports skips the test if the daemon doesn't support the protocol.
+func requireSupports(t *testing.T, h host.Host, p peer.ID, proto string) {
+	t.Helper()
+	protos, err := h.Peerstore().SupportsProtocols(p, proto)
+	require.NoError(t, err)
+	if len(protos) == 0 {
+		t.Skipf("daemon doesn't support %s", proto)
+	}
+}
+
+func openStream(t *testing.T, h host.Host, p peer.ID, proto string) network.Stream {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s, err := h.NewStream(ctx, p, protocol.ID(proto))
+	require.NoError(t, err)
+	_ = s.SetDeadline(time.Now().Add(10 * time.Second))
+	return s
+}
+
+// send writes the message on a stream of the given protocol, and waits for the
+// daemon to close the stream, accepting the message.
+func send(t *testing.T, h host.Host, p peer.ID, proto string, mes *pb.Identify) {
+	t.Helper()
+	s := openStream(t, h, p, proto)
+	require.NoError(t, protoio.NewDelimitedWriter(s).WriteMsg(mes))
+	require.NoError(t, s.CloseWrite())
+	_, err := s.Read(make([]byte, 1))
+	require.Equal(t, io.EOF, err, "daemon didn't accept the message")
+	require.NoError(t, s.Close())
+}
+
+// ourMessage returns the identify message describing h, with an additional
+// protocol.
+func ourMessage(t *testing.T, h host.Host, c network.Conn) *pb.Identify {
+	t.Helper()
+	kb, err := ic.MarshalPublicKey(h.Peerstore().PubKey(h.ID()))
+	require.NoError(t, err)
+	mes := &pb.Identify{
+		PublicKey:       kb,
+		ProtocolVersion: proto.String(identify.LibP2PVersion),
+		AgentVersion:    proto.String(identify.ClientVersion),
+		ObservedAddr:    c.RemoteMultiaddr().Bytes(),
+		Protocols:       append(h.Mux().Protocols(), testProto),
+	}
+	for _, a := range h.Addrs() {
+		mes.ListenAddrs = append(mes.ListenAddrs, a.Bytes())
+	}
+	if cab, ok := peerstore.GetCertifiedAddrBook(h.Peerstore()); ok {
+		if env := cab.GetPeerRecord(h.ID()); env != nil {
+			mes.SignedPeerRecord, err = env.Marshal()
+			require.NoError(t, err)
+		}
+	}
+	return mes
+}
+
+func TestIdentify(t *testing.T) {
+	d, h := daemon(t), newHost(t)
+	connect(t, h, d)
+
+	protos, err := h.Peerstore().SupportsProtocols(d.ID, identify.ID)
+	require.NoError(t, err)
+	require.Equal(t, []string{identify.ID}, protos)
+	require.NotNil(t, h.Peerstore().PubKey(d.ID))
+	require.NotEmpty(t, h.Peerstore().Addrs(d.ID))
+}
+
+// TestIdentifyResponse checks every field of the daemon's response.
+func TestIdentifyResponse(t *testing.T) {
+	d, h := daemon(t), newHost(t)
+	c := connect(t, h, d)
+
+	s := openStream(t, h, d.ID, identify.ID)
+	defer s.Close()
+	r := protoio.NewDelimitedReader(s, identify.DefaultMaxMessageSize)
+	mes := new(pb.Identify)
+	// implementations may split the response into several messages.
+	for {
+		var part pb.Identify
+		err := r.ReadMsg(&part)
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		proto.Merge(mes, &part)
+	}
+
+	require.NotEmpty(t, mes.GetProtocolVersion())
+	require.NotEmpty(t, mes.GetAgentVersion())
+	require.Contains(t, mes.GetProtocols(), identify.ID)
+
+	key, err := ic.UnmarshalPublicKey(mes.GetPublicKey())
+	require.NoError(t, err)
+	require.True(t, d.ID.MatchesPublicKey(key), "public key doesn't match the daemon's peer ID")
+
+	require.NotEmpty(t, mes.GetListenAddrs())
+	for _, b := range mes.GetListenAddrs() {
+		_, err := ma.NewMultiaddrBytes(b)
+		require.NoError(t, err)
+	}
+	observed, err := ma.NewMultiaddrBytes(mes.GetObservedAddr())
+	require.NoError(t, err)
+	require.True(t, observed.Equal(c.LocalMultiaddr()), "observed %s, dialed from %s", observed, c.LocalMultiaddr())
+
+	if len(mes.GetSignedPeerRecord()) == 0 {
+		require.Empty(t, os.Getenv("LIBP2P_INTEROP_SIGNED_RECORD"), "daemon didn't send a signed peer record")
+		t.Log("daemon didn't send a signed peer record")
+		return
+	}
+	_, rec, err := record.ConsumeEnvelope(mes.GetSignedPeerRecord(), peer.PeerRecordEnvelopeDomain)
+	require.NoError(t, err)
+	prec, ok := rec.(*peer.PeerRecord)
+	require.True(t, ok)
+	require.Equal(t, d.ID, prec.PeerID)
+	require.NotEmpty(t, prec.Addrs)
+}
+
+func TestIdentifyPush(t *testing.T) {
+	d, h := daemon(t), newHost(t)
+	c := connect(t, h, d)
+	requireSupports(t, h, d.ID, identify.IDPush)
+
+	send(t, h, d.ID, identify.IDPush, ourMessage(t, h, c))
+
+	// the daemon is still happy with us.
+	require.Equal(t, network.Connected, h.Network().Connectedness(d.ID))
+	require.NoError(t, idService(t, h).Refresh(context.Background(), d.ID))
+}
+
+func TestIdentifyDelta(t *testing.T) {
+	d, h := daemon(t), newHost(t)
+	connect(t, h, d)
+	requireSupports(t, h, d.ID, identify.IDDelta)
+
+	send(t, h, d.ID, identify.IDDelta, &pb.Identify{
+		Delta: &pb.Delta{AddedProtocols: []string{testProto}},
+	})
+	send(t, h, d.ID, identify.IDDelta, &pb.Identify{
+		Delta: &pb.Delta{RmProtocols: []string{testProto}},
+	})
+
+	require.Equal(t, network.Connected, h.Network().Connectedness(d.ID))
+	require.NoError(t, idService(t, h).Refresh(context.Background(), d.ID))
+}
+
+// TestIdentifyUpdates checks that the updates our identify service sends when
+// our protocols change reach the daemon.
+func TestIdentifyUpdates(t *testing.T) {
+	d, h := daemon(t), newHost(t)
+	connect(t, h, d)
+
+	ids := idService(t, h)
+	before := ids.UpdateStats()
+	h.SetStreamHandler(testProto, func(s network.Stream) { s.Close() })
+	time.Sleep(time.Second)
+
+	require.Equal(t, before.Failed, ids.UpdateStats().Failed)
+	_, failed := ids.DebugDump().Errors[d.ID]
+	require.False(t, failed, "failed to send update: %v", ids.DebugDump().Errors[d.ID])
+	require.Equal(t, network.Connected, h.Network().Connectedness(d.ID))
+}
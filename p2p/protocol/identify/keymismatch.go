@@ -0,0 +1,67 @@
+package identify
+
+import (
+	ic "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// KeyMismatch is why a peer's public key was rejected.
+type KeyMismatch string
+
+const (
+	// KeyPeerIDMismatch means the peer sent a key that doesn't match its
+	// peer ID.
+	KeyPeerIDMismatch KeyMismatch = "peer-id-mismatch"
+	// KeyChanged means the peer sent a key matching its peer ID, but
+	// different from the key we already had for it.
+	KeyChanged KeyMismatch = "key-changed"
+)
+
+// EvtPeerKeyMismatch is emitted when a peer sends us a public key in an
+// Identify message that doesn't match its peer ID, or the key we already have
+// for it, which may be an attempt to downgrade or substitute its key. It's
+// never emitted in InsecureMode, where such mismatches are expected.
+type EvtPeerKeyMismatch struct {
+	Peer peer.ID
+	// Conn is the connection the key was received on.
+	Conn   network.Conn
+	Reason KeyMismatch
+	// Key is the key the peer sent.
+	Key ic.PubKey
+}
+
+// KeyMismatchAction is what to do with a peer that sent a mismatching key,
+// see the KeyMismatchPolicy option.
+type KeyMismatchAction int
+
+const (
+	// KeyMismatchIgnore logs the mismatch, and keeps the connections to the
+	// peer open. The mismatching key is never stored.
+	KeyMismatchIgnore KeyMismatchAction = iota
+	// KeyMismatchDisconnect closes all our connections to the peer.
+	KeyMismatchDisconnect
+)
+
+// keyMismatch reports a mismatching key received from the remote peer of c,
+// and applies the key mismatch policy.
+func (ids *IDService) keyMismatch(c network.Conn, key ic.PubKey, reason KeyMismatch) {
+	if ids.insecure {
+		return
+	}
+	evt := EvtPeerKeyMismatch{
+		Peer:   c.RemotePeer(),
+		Conn:   c,
+		Reason: reason,
+		Key:    key,
+	}
+	ids.emitters.evtPeerKeyMismatch.Emit(evt)
+
+	if ids.keyMismatchPolicy == nil || ids.keyMismatchPolicy(evt) != KeyMismatchDisconnect {
+		return
+	}
+	log.Warnw("disconnecting peer over mismatching public key", "peer", evt.Peer, "reason", reason)
+	if err := ids.Host.Network().ClosePeer(evt.Peer); err != nil {
+		log.Debugw("failed to disconnect peer", "peer", evt.Peer, "error", err)
+	}
+}
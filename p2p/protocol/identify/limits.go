@@ -0,0 +1,82 @@
+package identify
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/record"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// PeerstoreLimitStats counts the peerstore writes we limited, see the
+// PeerstoreLimits option.
+type PeerstoreLimitStats struct {
+	// AddrsTruncated is the number of messages whose listen addresses we
+	// truncated to the per-peer limit.
+	AddrsTruncated uint64
+	// RecordsDropped is the number of signed peer records we ignored for
+	// containing more addresses than the per-peer limit.
+	RecordsDropped uint64
+	// UpdatesDropped is the number of Identify Push and Delta messages we
+	// ignored for exceeding the per-peer write rate.
+	UpdatesDropped uint64
+}
+
+// PeerstoreLimitStats returns the number of peerstore writes we limited.
+func (ids *IDService) PeerstoreLimitStats() PeerstoreLimitStats {
+	return PeerstoreLimitStats{
+		AddrsTruncated: atomic.LoadUint64(&ids.limitStats.addrsTruncated),
+		RecordsDropped: atomic.LoadUint64(&ids.limitStats.recordsDropped),
+		UpdatesDropped: atomic.LoadUint64(&ids.limitStats.updatesDropped),
+	}
+}
+
+func newWriteLimiter(writesPerMinute int) *rateLimiter {
+	if writesPerMinute <= 0 {
+		return nil
+	}
+	return newRateLimiter(0, writesPerMinute, time.Minute)
+}
+
+// allowUpdate returns false if an Identify Push or Delta message from the
+// given peer exceeds the per-peer write rate, and must be ignored.
+func (ids *IDService) allowUpdate(p peer.ID) bool {
+	if ids.writeLimiter == nil || ids.writeLimiter.allow(p) {
+		return true
+	}
+	atomic.AddUint64(&ids.limitStats.updatesDropped, 1)
+	log.Debugw("ignoring identify update exceeding the peerstore write rate", "peer", p)
+	return false
+}
+
+// limitAddrs truncates the listen addresses sent by the remote peer of c to
+// the per-peer limit.
+func (ids *IDService) limitAddrs(c network.Conn, addrs []ma.Multiaddr) []ma.Multiaddr {
+	if ids.maxPeerAddrs <= 0 || len(addrs) <= ids.maxPeerAddrs {
+		return addrs
+	}
+	atomic.AddUint64(&ids.limitStats.addrsTruncated, 1)
+	log.Debugw("truncating listen addrs", "peer", c.RemotePeer(), "addrs", len(addrs), "limit", ids.maxPeerAddrs)
+	return addrs[:ids.maxPeerAddrs]
+}
+
+// limitRecord returns nil if the signed peer record contains more addresses
+// than the per-peer limit.
+func (ids *IDService) limitRecord(c network.Conn, env *record.Envelope) *record.Envelope {
+	if env == nil || ids.maxPeerAddrs <= 0 {
+		return env
+	}
+	rec, err := env.Record()
+	if err != nil {
+		return env
+	}
+	if pr, ok := rec.(*peer.PeerRecord); ok && len(pr.Addrs) > ids.maxPeerAddrs {
+		atomic.AddUint64(&ids.limitStats.recordsDropped, 1)
+		log.Debugw("ignoring signed peer record with too many addrs", "peer", c.RemotePeer(), "addrs", len(pr.Addrs), "limit", ids.maxPeerAddrs)
+		return nil
+	}
+	return env
+}
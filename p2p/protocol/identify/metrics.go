@@ -0,0 +1,170 @@
+package identify
+
+import (
+	"errors"
+	"io"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/protocol"
+
+	pb "github.com/libp2p/go-libp2p/p2p/protocol/identify/pb"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// MetricsTracer receives metrics about the Identify family protocols. Wire it
+// with the WithMetricsTracer option. Implementations must be safe for
+// concurrent use. NewPrometheusMetrics exports the metrics to Prometheus.
+type MetricsTracer interface {
+	// Identified is called once we finished identifying a connection,
+	// successfully if err is nil, with the round trip time of the exchange.
+	Identified(rtt time.Duration, err error)
+	// MessageSent is called for every Identify (ID), Identify Push (IDPush)
+	// or Identify Delta (IDDelta or IDDeltaAddrs) message we send, with its
+	// size in bytes. Messages sent over IDMux streams are reported under the
+	// protocol they would have been sent with otherwise.
+	MessageSent(proto protocol.ID, size int)
+	// MessageReceived is MessageSent for the messages we receive.
+	MessageReceived(proto protocol.ID, size int)
+	// SignedRecordError is called when we fail to consume a signed peer
+	// record a peer sent us.
+	SignedRecordError(err error)
+}
+
+// FailureReason returns a coarse reason identifying a peer failed with err,
+// suitable as a metrics label: "timeout", "message_too_large", the
+// ValidationFailure for validation errors, "stream_closed", or "other". It
+// returns "" for a nil error.
+func FailureReason(err error) string {
+	var verr *ValidationError
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, ErrTimeout):
+		return "timeout"
+	case errors.Is(err, ErrMessageTooLarge):
+		return "message_too_large"
+	case errors.As(err, &verr):
+		return string(verr.Reason)
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "stream_closed"
+	default:
+		return "other"
+	}
+}
+
+// PrometheusMetrics is a MetricsTracer exporting the metrics to Prometheus.
+type PrometheusMetrics struct {
+	registerer prometheus.Registerer
+
+	identified   *prometheus.CounterVec
+	rtt          prometheus.Histogram
+	messages     *prometheus.CounterVec
+	messageSizes *prometheus.HistogramVec
+	recordErrors prometheus.Counter
+}
+
+var _ MetricsTracer = (*PrometheusMetrics)(nil)
+
+// NewPrometheusMetrics constructs a new PrometheusMetrics, registering its
+// metrics with the given registerer.
+func NewPrometheusMetrics(r prometheus.Registerer) (*PrometheusMetrics, error) {
+	m := &PrometheusMetrics{
+		registerer: r,
+		identified: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "libp2p_identify_total",
+			Help: "Connections identified, by failure reason (empty on success)",
+		}, []string{"failure"}),
+		rtt: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "libp2p_identify_rtt_seconds",
+			Help:    "Round trip time of successful identify exchanges",
+			Buckets: prometheus.ExponentialBuckets(0.001, 2, 15), // 1ms to ~16s
+		}),
+		messages: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "libp2p_identify_messages_total",
+			Help: "Identify family messages sent and received",
+		}, []string{"protocol", "dir"}),
+		messageSizes: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "libp2p_identify_message_size_bytes",
+			Help:    "Size of the identify family messages sent and received",
+			Buckets: prometheus.ExponentialBuckets(64, 2, 10), // 64B to 32KiB
+		}, []string{"protocol", "dir"}),
+		recordErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "libp2p_identify_signed_record_errors_total",
+			Help: "Signed peer records received from peers we failed to consume",
+		}),
+	}
+	collectors := []prometheus.Collector{m.identified, m.rtt, m.messages, m.messageSizes, m.recordErrors}
+	for i, c := range collectors {
+		if err := r.Register(c); err != nil {
+			for _, c := range collectors[:i] {
+				r.Unregister(c)
+			}
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// Close unregisters the metrics.
+func (m *PrometheusMetrics) Close() error {
+	for _, c := range []prometheus.Collector{m.identified, m.rtt, m.messages, m.messageSizes, m.recordErrors} {
+		m.registerer.Unregister(c)
+	}
+	return nil
+}
+
+func (m *PrometheusMetrics) Identified(rtt time.Duration, err error) {
+	m.identified.WithLabelValues(FailureReason(err)).Inc()
+	if err == nil {
+		m.rtt.Observe(rtt.Seconds())
+	}
+}
+
+func (m *PrometheusMetrics) MessageSent(proto protocol.ID, size int) {
+	m.messages.WithLabelValues(string(proto), "sent").Inc()
+	m.messageSizes.WithLabelValues(string(proto), "sent").Observe(float64(size))
+}
+
+func (m *PrometheusMetrics) MessageReceived(proto protocol.ID, size int) {
+	m.messages.WithLabelValues(string(proto), "received").Inc()
+	m.messageSizes.WithLabelValues(string(proto), "received").Observe(float64(size))
+}
+
+func (m *PrometheusMetrics) SignedRecordError(error) {
+	m.recordErrors.Inc()
+}
+
+// messageSent reports a message we sent to our metrics tracer, if any.
+func (ids *IDService) messageSent(proto protocol.ID, mes *pb.Identify) {
+	if ids.metrics != nil {
+		ids.metrics.MessageSent(proto, mes.Size())
+	}
+}
+
+// messageReceived reports a message we received to our metrics tracer, if
+// any.
+func (ids *IDService) messageReceived(proto protocol.ID, mes *pb.Identify) {
+	if ids.metrics != nil {
+		ids.metrics.MessageReceived(proto, mes.Size())
+	}
+}
+
+func (ids *IDService) signedRecordError(err error) {
+	if ids.metrics != nil {
+		ids.metrics.SignedRecordError(err)
+	}
+}
+
+// protocol returns the protocol the messages of IDMux frames of this type are
+// sent with without IDMux.
+func (t frameType) protocol() protocol.ID {
+	switch t {
+	case framePush:
+		return IDPush
+	case frameDelta:
+		return IDDelta
+	default:
+		return ID
+	}
+}
@@ -0,0 +1,103 @@
+package identify_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	blhost "github.com/libp2p/go-libp2p-blankhost"
+	swarmt "github.com/libp2p/go-libp2p-swarm/testing"
+	"github.com/libp2p/go-libp2p/p2p/protocol/identify"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFailureReason(t *testing.T) {
+	require.Equal(t, "", identify.FailureReason(nil))
+	require.Equal(t, "timeout", identify.FailureReason(fmt.Errorf("%w after 1s", identify.ErrTimeout)))
+	require.Equal(t, "message_too_large", identify.FailureReason(identify.ErrMessageTooLarge))
+	require.Equal(t, string(identify.RejectedProtocolVersion),
+		identify.FailureReason(&identify.ValidationError{Reason: identify.RejectedProtocolVersion}))
+	require.Equal(t, "other", identify.FailureReason(errors.New("boom")))
+}
+
+func TestIdentifyPrometheusMetrics(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	h2 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	defer h2.Close()
+
+	reg1, reg2 := prometheus.NewRegistry(), prometheus.NewRegistry()
+	m1, err := identify.NewPrometheusMetrics(reg1)
+	require.NoError(t, err)
+	defer m1.Close()
+	m2, err := identify.NewPrometheusMetrics(reg2)
+	require.NoError(t, err)
+	defer m2.Close()
+	// registering twice fails.
+	_, err = identify.NewPrometheusMetrics(reg1)
+	require.Error(t, err)
+
+	ids1, err := identify.NewIDService(h1, identify.WithMetricsTracer(m1))
+	require.NoError(t, err)
+	defer ids1.Close()
+	ids2, err := identify.NewIDService(h2, identify.WithMetricsTracer(m2))
+	require.NoError(t, err)
+	defer ids2.Close()
+
+	require.NoError(t, h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+	res := <-ids1.IdentifyWaitResult(h1.Network().ConnsToPeer(h2.ID())[0])
+	require.NoError(t, res.Err)
+
+	require.Eventually(t, func() bool {
+		return metricValue(t, reg1, "libp2p_identify_total", map[string]string{"failure": ""}) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, 1.0, metricValue(t, reg1, "libp2p_identify_rtt_seconds", nil))
+	require.Equal(t, 1.0, metricValue(t, reg1, "libp2p_identify_messages_total", map[string]string{"protocol": identify.ID, "dir": "received"}))
+	require.Eventually(t, func() bool {
+		return metricValue(t, reg2, "libp2p_identify_messages_total", map[string]string{"protocol": identify.ID, "dir": "sent"}) >= 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// h2 sends us its protocol updates as deltas.
+	h2.SetStreamHandler("/test/new", func(network.Stream) {})
+	require.Eventually(t, func() bool {
+		return metricValue(t, reg1, "libp2p_identify_messages_total", map[string]string{"protocol": identify.IDDelta, "dir": "received"}) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Eventually(t, func() bool {
+		return metricValue(t, reg2, "libp2p_identify_messages_total", map[string]string{"protocol": identify.IDDelta, "dir": "sent"}) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+// metricValue returns the value of the counter or the sample count of the
+// histogram with the given name and labels, or 0 if there's none.
+func metricValue(t *testing.T, reg *prometheus.Registry, name string, labels map[string]string) float64 {
+	mfs, err := reg.Gather()
+	require.NoError(t, err)
+	for _, mf := range mfs {
+		if mf.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, m := range mf.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if v, ok := labels[l.GetName()]; ok && v != l.GetValue() {
+					continue metrics
+				}
+			}
+			if h := m.GetHistogram(); h != nil {
+				return float64(h.GetSampleCount())
+			}
+			return m.GetCounter().GetValue()
+		}
+	}
+	return 0
+}
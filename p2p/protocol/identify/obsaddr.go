@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/libp2p/go-eventbus"
@@ -24,6 +25,12 @@ import (
 // the GC rounds set by GCInterval.
 var ActivationThresh = 4
 
+// CorroboratedActivationThresh sets how many times an address must be seen to
+// be activated when an address on the same IP but of the other transport
+// protocol (TCP or UDP) is activated already. An IP reachable over TCP is
+// most likely reachable over UDP too, and the other way around.
+var CorroboratedActivationThresh = 2
+
 // GCInterval specicies how often to make a round cleaning seen events and
 // observed addresses. An address will be cleaned if it has not been seen in
 // OwnObservedAddressTTL (10 minutes). A "seen" event will be cleaned up if
@@ -38,6 +45,14 @@ var observedAddrManagerWorkerChannelSize = 16
 // we will return for each (IPx/TCP or UDP) group.
 var maxObservedAddrsPerIPAndTransport = 2
 
+// DefaultMaxObservedAddrs and DefaultMaxObservedAddrsPerLocal are the default
+// bounds on the number of observed addresses tracked in total, and for each of
+// our local addresses, see ObservedAddrOptions.
+const (
+	DefaultMaxObservedAddrs         = 1024
+	DefaultMaxObservedAddrsPerLocal = 128
+)
+
 // observation records an address observation from an "observer" (where every IP
 // address is a unique observer).
 type observation struct {
@@ -47,6 +62,10 @@ type observation struct {
 	// an inbound connection. This remains true even if we an observation
 	// from a subsequent outbound connection.
 	inbound bool
+	// rtt is the round trip time of the identify exchange the observation
+	// was made in, zero if unknown. It's kept when the observation is
+	// refreshed without one.
+	rtt time.Duration
 }
 
 // observedAddr is an entry for an address reported by our peers.
@@ -59,20 +78,67 @@ type observedAddr struct {
 	seenBy     map[string]observation // peer(observer) address -> observation info
 	lastSeen   time.Time
 	numInbound int
+	// active is whether the address was activated when we last checked,
+	// see updateActivation.
+	active bool
 }
 
-func (oa *observedAddr) activated() bool {
+func (oa *observedAddr) activated(thresh int) bool {
 
 	// We only activate if other peers observed the same address
-	// of ours at least 4 times. SeenBy peers are removed by GC if
-	// they say the address more than ttl*ActivationThresh
-	return len(oa.seenBy) >= ActivationThresh
+	// of ours at least thresh (4 by default) times. SeenBy peers are
+	// removed by GC if they say the address more than ttl*thresh
+	return len(oa.seenBy) >= thresh
+}
+
+// corroborated returns true if the address has been observed often enough to
+// be activated given that the other transport protocol is activated on its IP,
+// see CorroboratedActivationThresh.
+func (oa *observedAddr) corroborated(activatedIPs map[string]transportSet) bool {
+	ip, transport := ipAndTransport(oa.addr)
+	if transport == 0 || len(oa.seenBy) < CorroboratedActivationThresh {
+		return false
+	}
+	return activatedIPs[ip]&^transport != 0
+}
+
+// lacksInbound returns true if the address wasn't observed on an inbound
+// connection, though it must be to be activated, see
+// ObservedAddrOptions.RequireInbound.
+func (oas *ObservedAddrManager) lacksInbound(a *observedAddr) bool {
+	return oas.requireInbound && a.numInbound == 0
+}
+
+// transportSet is a set of transport protocols.
+type transportSet uint8
+
+const (
+	transportTCP transportSet = 1 << iota
+	transportUDP
+)
+
+// ipAndTransport returns the IP component of the address and its transport
+// protocol (TCP or UDP), zero if it has none.
+func ipAndTransport(a ma.Multiaddr) (ip string, transport transportSet) {
+	first, rest := ma.SplitFirst(a)
+	if first == nil || rest == nil {
+		return "", 0
+	}
+	next, _ := ma.SplitFirst(rest)
+	switch next.Protocol().Code {
+	case ma.P_TCP:
+		return string(first.Bytes()), transportTCP
+	case ma.P_UDP:
+		return string(first.Bytes()), transportUDP
+	}
+	return "", 0
 }
 
 // GroupKey returns the group in which this observation belongs. Currently, an
-// observed address's group is just the address with all ports set to 0. This
-// means we can advertise the most commonly observed external ports without
-// advertising _every_ observed port.
+// observed address's group is just the address with all ports set to 0, and
+// IPv6 addresses truncated to their /64 prefix. This means we can advertise the
+// most commonly observed external ports without advertising _every_ observed
+// port, nor every temporary address of hosts using IPv6 privacy extensions.
 func (oa *observedAddr) groupKey() string {
 	key := make([]byte, 0, len(oa.addr.Bytes()))
 	ma.ForEach(oa.addr, func(c ma.Component) bool {
@@ -80,6 +146,9 @@ func (oa *observedAddr) groupKey() string {
 		case ma.P_TCP, ma.P_UDP:
 			key = append(key, proto.VCode...)
 			key = append(key, 0, 0) // zero in two bytes
+		case ma.P_IP6:
+			key = append(key, proto.VCode...)
+			key = append(key, c.RawValue()[:ipv6PrefixBytes]...)
 		default:
 			key = append(key, c.Bytes()...)
 		}
@@ -89,13 +158,120 @@ func (oa *observedAddr) groupKey() string {
 	return string(key)
 }
 
+// ObservedAddrReason is the reason an observed address was activated or
+// deactivated.
+type ObservedAddrReason string
+
+const (
+	// ObservedAddrThreshold means enough observers saw the address to
+	// activate it, see ObservedAddrOptions.ActivationThresh.
+	ObservedAddrThreshold ObservedAddrReason = "threshold"
+	// ObservedAddrCorroborated means the address was activated with fewer
+	// observers, as the other transport protocol is activated on its IP,
+	// see CorroboratedActivationThresh.
+	ObservedAddrCorroborated ObservedAddrReason = "corroborated"
+	// ObservedAddrExpired means no peer observed the address within the
+	// TTL.
+	ObservedAddrExpired ObservedAddrReason = "expired"
+	// ObservedAddrTooFewObservers means observations of the address
+	// expired, leaving too few observers to keep it activated.
+	ObservedAddrTooFewObservers ObservedAddrReason = "too-few-observers"
+	// ObservedAddrEvicted means the address was evicted to make room for
+	// another one, see ObservedAddrOptions.MaxAddrs.
+	ObservedAddrEvicted ObservedAddrReason = "evicted"
+)
+
+// EvtObservedAddrChanged is emitted when an address peers observe us at is
+// activated, or deactivated, so that we can react right away instead of
+// polling IDService.OwnObservedAddrs. Activated addresses are candidates for
+// advertisement: we only advertise a couple of the activated addresses
+// sharing an IP and transport.
+type EvtObservedAddrChanged struct {
+	// Addr is the observed address.
+	Addr ma.Multiaddr
+	// Local is the local address the observations were made on.
+	Local     ma.Multiaddr
+	Activated bool
+	Reason    ObservedAddrReason
+}
+
 type newObservation struct {
 	conn     network.Conn
 	observed ma.Multiaddr
+	rtt      time.Duration
+
+	// flush, if set, is closed once the worker processed the observations
+	// before it, instead of recording one, see Flush. tick runs the
+	// periodic work too, see Tick.
+	flush chan struct{}
+	tick  bool
+}
+
+// ObservedAddrOptions configure an ObservedAddrManager, e.g. to activate
+// observed addresses with fewer observers on testnets and small private
+// networks. Zero fields keep their default.
+type ObservedAddrOptions struct {
+	// ActivationThresh is how many observers must see an address before we
+	// advertise it. Defaults to ActivationThresh.
+	ActivationThresh int
+	// TTL is how long an address is kept once it's no longer observed, see
+	// ObservedAddrManager.SetTTL. Defaults to
+	// peerstore.OwnObservedAddrTTL.
+	TTL time.Duration
+	// MaxAddrs bounds the number of observed addresses tracked in total,
+	// and MaxAddrsPerLocal the number tracked for each of our local
+	// addresses, so that peers reporting bogus addresses can't grow our
+	// state unboundedly. Observing a further address evicts the least
+	// recently observed one, preferring addresses that aren't activated.
+	// They default to DefaultMaxObservedAddrs and
+	// DefaultMaxObservedAddrsPerLocal, negative values disable the bounds.
+	MaxAddrs         int
+	MaxAddrsPerLocal int
+	// GCInterval is how often expired observations are cleaned up.
+	// Defaults to GCInterval.
+	GCInterval time.Duration
+
+	// Observations of unroutable addresses, or of private addresses on
+	// connections over a public local address, are rejected as bogus.
+	// AllowPrivateOnPublic accepts the latter, e.g. for hosts with public
+	// addresses on a private network. RejectPublicOnPrivate also rejects
+	// observations of public addresses on connections over a private local
+	// address, for hosts known not to be behind a NAT.
+	AllowPrivateOnPublic  bool
+	RejectPublicOnPrivate bool
+
+	// IPv6StableOnly advertises a single address for each /64 prefix we
+	// are observed at over IPv6: the observed address with its IP replaced
+	// by our longest known interface address in the prefix. Hosts using
+	// privacy extensions rotate their temporary source addresses, this
+	// keeps them from advertising addresses that will soon go away. By
+	// default, observed addresses matching one of our current interface
+	// addresses are merely preferred.
+	IPv6StableOnly bool
+
+	// RequireInbound only activates addresses observed on at least one
+	// inbound connection. Peers that managed to connect to us prove we're
+	// reachable at the address they observe, far more strongly than peers
+	// we connected to, which only tell where our NAT mapped us to.
+	RequireInbound bool
+
+	// ASNResolver resolves the autonomous systems of our observers, to
+	// tell how diverse they are, see ObservedAddrManager.ObserverDiversity.
+	ASNResolver ASNResolver
+
+	// Clock returns the current time, time.Now by default. Tests inject a
+	// fake clock, and call ObservedAddrManager.Tick to simulate the passing
+	// of time.
+	Clock func() time.Time
 }
 
 // ObservedAddrManager keeps track of a ObservedAddrs.
 type ObservedAddrManager struct {
+	// dropped counts the observations dropped when the worker lags
+	// behind, and rejected the bogus ones. Atomic, first for alignment.
+	dropped  uint64
+	rejected uint64
+
 	host host.Host
 
 	// latest observation from active connections
@@ -109,9 +285,40 @@ type ObservedAddrManager struct {
 	addrs        map[string][]*observedAddr
 	ttl          time.Duration
 	refreshTimer *time.Timer
+	// numAddrs is the number of addresses in addrs, bounded by maxAddrs
+	// if positive.
+	numAddrs int
+	maxAddrs int
+	// maxAddrsPerLocal bounds the number of addresses of each local
+	// address in addrs, if positive.
+	maxAddrsPerLocal int
+	// evicted counts the addresses evicted to stay within the bounds.
+	evicted uint64
+
+	activationThresh int
+	gcInterval       time.Duration
+
+	allowPrivateOnPublic  bool
+	rejectPublicOnPrivate bool
+
+	// ifaceAddrs maps our current IPv6 interface addresses to the time we
+	// first saw them, see updateIfaceAddrs.
+	ifaceAddrs     map[string]time.Time
+	ipv6StableOnly bool
+	requireInbound bool
+
+	asnResolver ASNResolver
+
+	// observed address -> observations made over relayed connections. These
+	// are the relay's view of us, we never advertise them.
+	relayed map[string]*observedAddr
+
+	clock func() time.Time
 
 	// this is the worker channel
 	wch chan newObservation
+	// closed is closed once the worker exited.
+	closed chan struct{}
 
 	reachabilitySub event.Subscription
 	reachability    network.Reachability
@@ -119,19 +326,57 @@ type ObservedAddrManager struct {
 	currentUDPNATDeviceType  network.NATDeviceType
 	currentTCPNATDeviceType  network.NATDeviceType
 	emitNATDeviceTypeChanged event.Emitter
+
+	emitObservedAddrChanged event.Emitter
 }
 
 // NewObservedAddrManager returns a new address manager using
 // peerstore.OwnObservedAddressTTL as the TTL.
 func NewObservedAddrManager(ctx context.Context, host host.Host) (*ObservedAddrManager, error) {
+	return NewObservedAddrManagerWithOptions(ctx, host, ObservedAddrOptions{})
+}
+
+// NewObservedAddrManagerWithOptions returns a new address manager configured
+// by the given options.
+func NewObservedAddrManagerWithOptions(ctx context.Context, host host.Host, opts ObservedAddrOptions) (*ObservedAddrManager, error) {
+	if opts.ActivationThresh <= 0 {
+		opts.ActivationThresh = ActivationThresh
+	}
+	if opts.TTL <= 0 {
+		opts.TTL = peerstore.OwnObservedAddrTTL
+	}
+	if opts.GCInterval <= 0 {
+		opts.GCInterval = GCInterval
+	}
+	if opts.MaxAddrs == 0 {
+		opts.MaxAddrs = DefaultMaxObservedAddrs
+	}
+	if opts.MaxAddrsPerLocal == 0 {
+		opts.MaxAddrsPerLocal = DefaultMaxObservedAddrsPerLocal
+	}
 	oas := &ObservedAddrManager{
-		addrs:       make(map[string][]*observedAddr),
-		ttl:         peerstore.OwnObservedAddrTTL,
-		wch:         make(chan newObservation, observedAddrManagerWorkerChannelSize),
-		host:        host,
-		activeConns: make(map[network.Conn]ma.Multiaddr),
+		addrs:            make(map[string][]*observedAddr),
+		relayed:          make(map[string]*observedAddr),
+		ttl:              opts.TTL,
+		maxAddrs:         opts.MaxAddrs,
+		maxAddrsPerLocal: opts.MaxAddrsPerLocal,
+		activationThresh: opts.ActivationThresh,
+		gcInterval:       opts.GCInterval,
+		wch:              make(chan newObservation, observedAddrManagerWorkerChannelSize),
+		host:             host,
+		activeConns:      make(map[network.Conn]ma.Multiaddr),
 		// refresh every ttl/2 so we don't forget observations from connected peers
-		refreshTimer: time.NewTimer(peerstore.OwnObservedAddrTTL / 2),
+		refreshTimer: time.NewTimer(opts.TTL / 2),
+
+		allowPrivateOnPublic:  opts.AllowPrivateOnPublic,
+		rejectPublicOnPrivate: opts.RejectPublicOnPrivate,
+
+		ifaceAddrs:     make(map[string]time.Time),
+		ipv6StableOnly: opts.IPv6StableOnly,
+		requireInbound: opts.RequireInbound,
+		asnResolver:    opts.ASNResolver,
+		clock:          opts.Clock,
+		closed:         make(chan struct{}),
 	}
 
 	reachabilitySub, err := host.EventBus().Subscribe(new(event.EvtLocalReachabilityChanged))
@@ -146,6 +391,11 @@ func NewObservedAddrManager(ctx context.Context, host host.Host) (*ObservedAddrM
 	}
 	oas.emitNATDeviceTypeChanged = emitter
 
+	oas.emitObservedAddrChanged, err = host.EventBus().Emitter(new(EvtObservedAddrChanged))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create emitter for observed addresses: %s", err)
+	}
+
 	oas.host.Network().Notify((*obsAddrNotifiee)(oas))
 	go oas.worker(ctx)
 	return oas, nil
@@ -166,7 +416,7 @@ func (oas *ObservedAddrManager) AddrsFor(addr ma.Multiaddr) (addrs []ma.Multiadd
 		return
 	}
 
-	return oas.filter(observedAddrs)
+	return oas.filter(observedAddrs, oas.activatedIPs())
 }
 
 // Addrs return all activated observed addresses
@@ -182,16 +432,38 @@ func (oas *ObservedAddrManager) Addrs() []ma.Multiaddr {
 	for _, addrs := range oas.addrs {
 		allObserved = append(allObserved, addrs...)
 	}
-	return oas.filter(allObserved)
+	return oas.filter(allObserved, oas.activatedIPs())
+}
+
+// activatedIPs returns the IPs with an activated address, and the transport
+// protocols of these addresses. oas.mu must be held.
+func (oas *ObservedAddrManager) activatedIPs() map[string]transportSet {
+	ips := make(map[string]transportSet)
+	now := oas.now()
+	for _, addrs := range oas.addrs {
+		for _, a := range addrs {
+			if now.Sub(a.lastSeen) > oas.ttl || !a.activated(oas.activationThresh) || oas.lacksInbound(a) {
+				continue
+			}
+			ip, transport := ipAndTransport(a.addr)
+			if transport != 0 {
+				ips[ip] |= transport
+			}
+		}
+	}
+	return ips
 }
 
-func (oas *ObservedAddrManager) filter(observedAddrs []*observedAddr) []ma.Multiaddr {
+// filter returns the addresses to advertise among the given ones: the
+// activated ones, and the ones corroborated by an activated address of the
+// other transport protocol on the same IP.
+func (oas *ObservedAddrManager) filter(observedAddrs []*observedAddr, activatedIPs map[string]transportSet) []ma.Multiaddr {
 	pmap := make(map[string][]*observedAddr)
-	now := time.Now()
+	now := oas.now()
 
 	for i := range observedAddrs {
 		a := observedAddrs[i]
-		if now.Sub(a.lastSeen) <= oas.ttl && a.activated() {
+		if now.Sub(a.lastSeen) <= oas.ttl && !oas.lacksInbound(a) && (a.activated(oas.activationThresh) || a.corroborated(activatedIPs)) {
 			// group addresses by their IPX/Transport Protocol(TCP or UDP) pattern.
 			pat := a.groupKey()
 			pmap[pat] = append(pmap[pat], a)
@@ -203,12 +475,17 @@ func (oas *ObservedAddrManager) filter(observedAddrs []*observedAddr) []ma.Multi
 	for pat := range pmap {
 		s := pmap[pat]
 
-		// We prefer inbound connection observations over outbound.
+		// We prefer observations of our current interface addresses,
+		// as temporary IPv6 addresses we no longer have are of no
+		// use, then inbound connection observations over outbound.
 		// For ties, we prefer the ones with more votes.
 		sort.Slice(s, func(i int, j int) bool {
 			first := s[i]
 			second := s[j]
 
+			if firstIface, secondIface := oas.isIfaceAddr(first.addr), oas.isIfaceAddr(second.addr); firstIface != secondIface {
+				return firstIface
+			}
 			if first.numInbound > second.numInbound {
 				return true
 			}
@@ -216,6 +493,12 @@ func (oas *ObservedAddrManager) filter(observedAddrs []*observedAddr) []ma.Multi
 			return len(first.seenBy) > len(second.seenBy)
 		})
 
+		if _, ok := ipv6Prefix(s[0].addr); ok && oas.ipv6StableOnly {
+			if a := oas.stableAddr(s[0].addr); a != nil {
+				addrs = append(addrs, a)
+			}
+			continue
+		}
 		for i := 0; i < maxObservedAddrsPerIPAndTransport && i < len(s); i++ {
 			addrs = append(addrs, s[i].addr)
 		}
@@ -224,14 +507,65 @@ func (oas *ObservedAddrManager) filter(observedAddrs []*observedAddr) []ma.Multi
 	return addrs
 }
 
-// Record records an address observation, if valid.
+// RelayedAddrs returns the addresses peers observed us at over relayed
+// connections within the TTL. They are kept apart from the addresses returned
+// by Addrs and AddrsFor, and never activated.
+func (oas *ObservedAddrManager) RelayedAddrs() []ma.Multiaddr {
+	oas.mu.RLock()
+	defer oas.mu.RUnlock()
+
+	now := oas.now()
+	var addrs []ma.Multiaddr
+	for _, a := range oas.relayed {
+		if now.Sub(a.lastSeen) <= oas.ttl {
+			addrs = append(addrs, a.addr)
+		}
+	}
+	return addrs
+}
+
+// isRelayedConn returns true if the connection goes through a relay.
+func isRelayedConn(conn network.Conn) bool {
+	if conn.Stat().Transient {
+		return true
+	}
+	_, err := conn.RemoteMultiaddr().ValueForProtocol(ma.P_CIRCUIT)
+	return err == nil
+}
+
+// Record records an address observation, if valid, whose round trip time is
+// unknown. See RecordWithRTT.
 func (oas *ObservedAddrManager) Record(conn network.Conn, observed ma.Multiaddr) {
+	oas.RecordWithRTT(conn, observed, 0)
+}
+
+// RecordWithRTT records an address observation, if valid, made in an identify
+// exchange that took the given round trip time, zero if unknown. See
+// ObservedAddrManager.ObservationLatency.
+//
+// Bogus observations are rejected right away: addresses that aren't IP
+// addresses or aren't routable, and addresses whose scope doesn't match the
+// local address of the connection, see ObservedAddrOptions.
+// Observations of addresses not matching the transports we listen on are
+// rejected when recorded.
+func (oas *ObservedAddrManager) RecordWithRTT(conn network.Conn, observed ma.Multiaddr, rtt time.Duration) {
+	if reason := oas.checkObservation(conn, observed); reason != "" {
+		atomic.AddUint64(&oas.rejected, 1)
+		log.Debugw("rejecting bogus address observation",
+			"from", conn.RemoteMultiaddr(),
+			"observed", observed,
+			"reason", reason,
+		)
+		return
+	}
 	select {
 	case oas.wch <- newObservation{
 		conn:     conn,
 		observed: observed,
+		rtt:      rtt,
 	}:
 	default:
+		atomic.AddUint64(&oas.dropped, 1)
 		log.Debugw("dropping address observation due to full buffer",
 			"from", conn.RemoteMultiaddr(),
 			"observed", observed,
@@ -239,19 +573,93 @@ func (oas *ObservedAddrManager) Record(conn network.Conn, observed ma.Multiaddr)
 	}
 }
 
+// checkObservation returns why the observation is bogus, or an empty string if
+// it isn't.
+func (oas *ObservedAddrManager) checkObservation(conn network.Conn, observed ma.Multiaddr) string {
+	first, _ := ma.SplitFirst(observed)
+	if first == nil {
+		return "empty address"
+	}
+	switch first.Protocol().Code {
+	case ma.P_IP4, ma.P_IP6:
+	default:
+		return "not an IP address"
+	}
+	// loopback addresses are ignored later on.
+	if manet.IsIPLoopback(observed) {
+		return ""
+	}
+	private := manet.IsPrivateAddr(observed)
+	if manet.IsIPUnspecified(observed) || (!private && !manet.IsPublicAddr(observed)) {
+		return "unroutable address"
+	}
+
+	local := conn.LocalMultiaddr()
+	if manet.IsIPLoopback(local) {
+		return ""
+	}
+	switch localPrivate := manet.IsPrivateAddr(local); {
+	case private && !localPrivate && !oas.allowPrivateOnPublic:
+		return "private address observed on public local address"
+	case !private && localPrivate && oas.rejectPublicOnPrivate:
+		return "public address observed on private local address"
+	}
+	return ""
+}
+
+// now returns the current time of the manager's clock.
+func (oas *ObservedAddrManager) now() time.Time {
+	if oas.clock != nil {
+		return oas.clock()
+	}
+	return time.Now()
+}
+
+// Flush blocks until the observations recorded so far were processed, so that
+// their effect is visible, e.g. in Addrs, without waiting for an arbitrary
+// time. It returns right away once the manager stopped.
+func (oas *ObservedAddrManager) Flush() {
+	oas.sync(false)
+}
+
+// Tick refreshes the observations made on connections still open, and cleans
+// up expired ones, as the manager does periodically, and blocks until done. It
+// also flushes the observations recorded so far, see Flush. Along with a fake
+// clock, see ObservedAddrOptions.Clock, it lets tests simulate the expiry of
+// observations without sleeping.
+func (oas *ObservedAddrManager) Tick() {
+	oas.sync(true)
+}
+
+func (oas *ObservedAddrManager) sync(tick bool) {
+	done := make(chan struct{})
+	select {
+	case oas.wch <- newObservation{flush: done, tick: tick}:
+	case <-oas.closed:
+		return
+	}
+	select {
+	case <-done:
+	case <-oas.closed:
+	}
+}
+
 func (oas *ObservedAddrManager) teardown() {
+	defer close(oas.closed)
 	oas.host.Network().StopNotify((*obsAddrNotifiee)(oas))
 	oas.reachabilitySub.Close()
 
 	oas.mu.Lock()
 	oas.refreshTimer.Stop()
 	oas.mu.Unlock()
+
+	oas.emitObservedAddrChanged.Close()
 }
 
 func (oas *ObservedAddrManager) worker(ctx context.Context) {
 	defer oas.teardown()
 
-	ticker := time.NewTicker(GCInterval)
+	ticker := time.NewTicker(oas.gcInterval)
 	defer ticker.Stop()
 
 	hostClosing := oas.host.Network().Process().Closing()
@@ -264,10 +672,21 @@ func (oas *ObservedAddrManager) worker(ctx context.Context) {
 				continue
 			}
 			ev := evt.(event.EvtLocalReachabilityChanged)
+			oas.mu.Lock()
 			oas.reachability = ev.Reachability
+			oas.emitAllNATTypes()
+			oas.mu.Unlock()
 
 		case obs := <-oas.wch:
-			oas.maybeRecordObservation(obs.conn, obs.observed)
+			if obs.flush == nil {
+				oas.maybeRecordObservation(obs.conn, obs.observed, obs.rtt)
+				continue
+			}
+			if obs.tick {
+				oas.refresh()
+				oas.gc()
+			}
+			close(obs.flush)
 
 		case <-ticker.C:
 			oas.gc()
@@ -295,23 +714,32 @@ func (oas *ObservedAddrManager) refresh() {
 	oas.mu.Lock()
 	defer oas.mu.Unlock()
 	for _, obs := range recycledObservations {
-		oas.recordObservationUnlocked(obs.conn, obs.observed)
+		oas.recordObservationUnlocked(obs.conn, obs.observed, 0)
 	}
+	oas.updateActivation()
 	// refresh every ttl/2 so we don't forget observations from connected peers
 	oas.refreshTimer.Reset(oas.ttl / 2)
 }
 
 func (oas *ObservedAddrManager) gc() {
+	ifaceaddrs, err := oas.host.Network().InterfaceListenAddresses()
+	if err != nil {
+		log.Infof("failed to get interface listen addrs", err)
+	}
+
 	oas.mu.Lock()
 	defer oas.mu.Unlock()
+	if err == nil {
+		oas.updateIfaceAddrs(ifaceaddrs)
+	}
 
-	now := time.Now()
+	now := oas.now()
 	for local, observedAddrs := range oas.addrs {
 		filteredAddrs := observedAddrs[:0]
 		for _, a := range observedAddrs {
 			// clean up SeenBy set
 			for k, ob := range a.seenBy {
-				if now.Sub(ob.seenTime) > oas.ttl*time.Duration(ActivationThresh) {
+				if now.Sub(ob.seenTime) > oas.ttl*time.Duration(oas.activationThresh) {
 					delete(a.seenBy, k)
 					if ob.inbound {
 						a.numInbound--
@@ -322,14 +750,28 @@ func (oas *ObservedAddrManager) gc() {
 			// leave only alive observed addresses
 			if now.Sub(a.lastSeen) <= oas.ttl {
 				filteredAddrs = append(filteredAddrs, a)
+			} else if a.active {
+				oas.emitObservedAddrChange(local, a, ObservedAddrExpired)
 			}
 		}
+		oas.numAddrs -= len(observedAddrs) - len(filteredAddrs)
 		if len(filteredAddrs) > 0 {
 			oas.addrs[local] = filteredAddrs
 		} else {
 			delete(oas.addrs, local)
 		}
 	}
+
+	for k, a := range oas.relayed {
+		if now.Sub(a.lastSeen) > oas.ttl {
+			delete(oas.relayed, k)
+		}
+	}
+
+	oas.updateActivation()
+
+	// the observations telling the type of our NAT may have expired.
+	oas.emitAllNATTypes()
 }
 
 func (oas *ObservedAddrManager) addConn(conn network.Conn, observed ma.Multiaddr) {
@@ -362,7 +804,7 @@ func (oas *ObservedAddrManager) removeConn(conn network.Conn) {
 	oas.activeConnsMu.Unlock()
 }
 
-func (oas *ObservedAddrManager) maybeRecordObservation(conn network.Conn, observed ma.Multiaddr) {
+func (oas *ObservedAddrManager) maybeRecordObservation(conn network.Conn, observed ma.Multiaddr, rtt time.Duration) {
 	// First, determine if this observation is even worth keeping...
 
 	// Ignore observations from loopback nodes. We already know our loopback
@@ -371,6 +813,24 @@ func (oas *ObservedAddrManager) maybeRecordObservation(conn network.Conn, observ
 		return
 	}
 
+	// Observations made over relayed connections tell us how the relay sees
+	// us, not how peers could reach us directly. Keep them apart.
+	if isRelayedConn(conn) {
+		log.Debugw("recording observation made over relayed connection", "observed", observed)
+		oas.mu.Lock()
+		defer oas.mu.Unlock()
+		key := string(observed.Bytes())
+		if a, ok := oas.relayed[key]; ok {
+			a.lastSeen = oas.now()
+			return
+		}
+		if oas.maxAddrs > 0 && len(oas.relayed) >= oas.maxAddrs {
+			oas.evictRelayed()
+		}
+		oas.relayed[key] = &observedAddr{addr: observed, lastSeen: oas.now()}
+		return
+	}
+
 	// we should only use ObservedAddr when our connection's LocalAddr is one
 	// of our ListenAddrs. If we Dial out using an ephemeral addr, knowing that
 	// address's external mapping is not very useful because the port will not be
@@ -405,20 +865,64 @@ func (oas *ObservedAddrManager) maybeRecordObservation(conn network.Conn, observ
 
 	oas.mu.Lock()
 	defer oas.mu.Unlock()
-	oas.recordObservationUnlocked(conn, observed)
+	oas.updateIfaceAddrs(ifaceaddrs)
+	oas.recordObservationUnlocked(conn, observed, rtt)
+	oas.updateActivation()
+	oas.emitAllNATTypes()
+}
 
-	if oas.reachability == network.ReachabilityPrivate {
-		oas.emitAllNATTypes()
+// updateActivation emits an EvtObservedAddrChanged for every address that was
+// activated or deactivated since we last checked. oas.mu must be held.
+func (oas *ObservedAddrManager) updateActivation() {
+	activatedIPs := oas.activatedIPs()
+	for local, addrs := range oas.addrs {
+		for _, a := range addrs {
+			var reason ObservedAddrReason
+			switch {
+			case oas.lacksInbound(a):
+			case a.activated(oas.activationThresh):
+				reason = ObservedAddrThreshold
+			case a.corroborated(activatedIPs):
+				reason = ObservedAddrCorroborated
+			}
+			switch {
+			case reason != "" && !a.active:
+				a.active = true
+				oas.emitObservedAddrChange(local, a, reason)
+			case reason == "" && a.active:
+				a.active = false
+				oas.emitObservedAddrChange(local, a, ObservedAddrTooFewObservers)
+			}
+		}
+	}
+}
+
+// emitObservedAddrChange emits an EvtObservedAddrChanged for the address,
+// which was activated unless the reason is one of deactivation.
+func (oas *ObservedAddrManager) emitObservedAddrChange(local string, a *observedAddr, reason ObservedAddrReason) {
+	activated := reason == ObservedAddrThreshold || reason == ObservedAddrCorroborated
+	log.Debugw("observed address changed", "addr", a.addr, "activated", activated, "reason", reason)
+	localAddr, err := ma.NewMultiaddrBytes([]byte(local))
+	if err != nil {
+		log.Errorf("invalid local address: %s", err)
+		return
 	}
+	oas.emitObservedAddrChanged.Emit(EvtObservedAddrChanged{
+		Addr:      a.addr,
+		Local:     localAddr,
+		Activated: activated,
+		Reason:    reason,
+	})
 }
 
-func (oas *ObservedAddrManager) recordObservationUnlocked(conn network.Conn, observed ma.Multiaddr) {
-	now := time.Now()
+func (oas *ObservedAddrManager) recordObservationUnlocked(conn network.Conn, observed ma.Multiaddr, rtt time.Duration) {
+	now := oas.now()
 	observerString := observerGroup(conn.RemoteMultiaddr())
 	localString := string(conn.LocalMultiaddr().Bytes())
 	ob := observation{
 		seenTime: now,
 		inbound:  conn.Stat().Direction == network.DirInbound,
+		rtt:      rtt,
 	}
 
 	// check if observed address seen yet, if so, update it
@@ -433,6 +937,9 @@ func (oas *ObservedAddrManager) recordObservationUnlocked(conn network.Conn, obs
 			if !wasInbound && isInbound {
 				observedAddr.numInbound++
 			}
+			if ob.rtt == 0 {
+				ob.rtt = observedAddr.seenBy[observerString].rtt
+			}
 
 			observedAddr.seenBy[observerString] = ob
 			observedAddr.lastSeen = now
@@ -440,7 +947,13 @@ func (oas *ObservedAddrManager) recordObservationUnlocked(conn network.Conn, obs
 		}
 	}
 
-	// observed address not seen yet, append it
+	// observed address not seen yet, append it, making room for it
+	if oas.maxAddrsPerLocal > 0 && len(oas.addrs[localString]) >= oas.maxAddrsPerLocal {
+		oas.evict(localString)
+	}
+	if oas.maxAddrs > 0 && oas.numAddrs >= oas.maxAddrs {
+		oas.evict("")
+	}
 	oa := &observedAddr{
 		addr: observed,
 		seenBy: map[string]observation{
@@ -452,86 +965,205 @@ func (oas *ObservedAddrManager) recordObservationUnlocked(conn network.Conn, obs
 		oa.numInbound++
 	}
 	oas.addrs[localString] = append(oas.addrs[localString], oa)
+	oas.numAddrs++
 }
 
-// For a given transport Protocol (TCP/UDP):
-//
-// 1. If we have an activated address, we are behind an Cone NAT.
-// With regards to RFC 3489, this could be either a Full Cone NAT, a Restricted Cone NAT or a
-// Port Restricted Cone NAT. However, we do NOT differentiate between them here and simply classify all such NATs as a Cone NAT.
-//
-// 2. If four different peers observe a different address for us on outbound connections, we
-// are MOST probably behind a Symmetric NAT.
+// evict evicts the least recently observed address of the given local
+// address, or of any local address if empty, preferring addresses that aren't
+// activated. oas.mu must be held.
+func (oas *ObservedAddrManager) evict(local string) {
+	var (
+		victimLocal string
+		victimIdx   = -1
+		victim      *observedAddr
+	)
+	consider := func(l string, addrs []*observedAddr) {
+		for i, a := range addrs {
+			if victim == nil ||
+				(victim.active && !a.active) ||
+				(victim.active == a.active && a.lastSeen.Before(victim.lastSeen)) {
+				victimLocal, victimIdx, victim = l, i, a
+			}
+		}
+	}
+	if local != "" {
+		consider(local, oas.addrs[local])
+	} else {
+		for l, addrs := range oas.addrs {
+			consider(l, addrs)
+		}
+	}
+	if victim == nil {
+		return
+	}
+
+	log.Debugw("evicting observed address, tracking too many", "observed", victim.addr)
+	addrs := oas.addrs[victimLocal]
+	addrs = append(addrs[:victimIdx], addrs[victimIdx+1:]...)
+	if len(addrs) > 0 {
+		oas.addrs[victimLocal] = addrs
+	} else {
+		delete(oas.addrs, victimLocal)
+	}
+	oas.numAddrs--
+	oas.evicted++
+	if victim.active {
+		oas.emitObservedAddrChange(victimLocal, victim, ObservedAddrEvicted)
+	}
+}
+
+// evictRelayed evicts the least recently observed address observed over
+// relayed connections. oas.mu must be held.
+func (oas *ObservedAddrManager) evictRelayed() {
+	var (
+		victimKey string
+		victim    *observedAddr
+	)
+	for k, a := range oas.relayed {
+		if victim == nil || a.lastSeen.Before(victim.lastSeen) {
+			victimKey, victim = k, a
+		}
+	}
+	if victim != nil {
+		delete(oas.relayed, victimKey)
+		oas.evicted++
+	}
+}
+
+// ObservedAddrStats are statistics of an ObservedAddrManager.
+type ObservedAddrStats struct {
+	// Addrs is the number of observed addresses tracked, and Relayed the
+	// number of those observed over relayed connections.
+	Addrs   int
+	Relayed int
+	// Evicted is the number of addresses evicted to stay within the
+	// bounds, see ObservedAddrOptions.MaxAddrs.
+	Evicted uint64
+	// Dropped is the number of observations dropped because they came in
+	// faster than we could record them.
+	Dropped uint64
+	// Rejected is the number of bogus observations rejected, see
+	// ObservedAddrManager.Record.
+	Rejected uint64
+}
+
+// Stats returns statistics of the observed address manager.
+func (oas *ObservedAddrManager) Stats() ObservedAddrStats {
+	oas.mu.RLock()
+	defer oas.mu.RUnlock()
+	return ObservedAddrStats{
+		Addrs:    oas.numAddrs,
+		Relayed:  len(oas.relayed),
+		Evicted:  oas.evicted,
+		Dropped:  atomic.LoadUint64(&oas.dropped),
+		Rejected: atomic.LoadUint64(&oas.rejected),
+	}
+}
+
+// emitAllNATTypes infers the type of our NAT for each transport protocol
+// (TCP/UDP), see natType, and emits an EvtNATDeviceTypeChanged when it
+// changed. The type is only inferred while our reachability is private, and
+// unknown otherwise. oas.mu must be held.
 //
 // Please see the documentation on the enumerations for `network.NATDeviceType` for more details about these NAT Device types
 // and how they relate to NAT traversal via Hole Punching.
 func (oas *ObservedAddrManager) emitAllNATTypes() {
-	var allObserved []*observedAddr
-	for _, addrs := range oas.addrs {
-		allObserved = append(allObserved, addrs...)
-	}
+	oas.currentTCPNATDeviceType = oas.emitSpecificNATType(ma.P_TCP, network.NATTransportTCP, oas.currentTCPNATDeviceType)
+	oas.currentUDPNATDeviceType = oas.emitSpecificNATType(ma.P_UDP, network.NATTransportUDP, oas.currentUDPNATDeviceType)
+}
 
-	hasChanged, natType := oas.emitSpecificNATType(allObserved, ma.P_TCP, network.NATTransportTCP, oas.currentTCPNATDeviceType)
-	if hasChanged {
-		oas.currentTCPNATDeviceType = natType
+// emitSpecificNATType emits an EvtNATDeviceTypeChanged if the type of our NAT
+// for the given transport protocol changed, and returns the new type.
+func (oas *ObservedAddrManager) emitSpecificNATType(protoCode int, transportProto network.NATTransportProtocol,
+	currentNATType network.NATDeviceType) network.NATDeviceType {
+	natType := network.NATDeviceTypeUnknown
+	if oas.reachability == network.ReachabilityPrivate {
+		natType = oas.natType(protoCode)
 	}
-
-	hasChanged, natType = oas.emitSpecificNATType(allObserved, ma.P_UDP, network.NATTransportUDP, oas.currentUDPNATDeviceType)
-	if hasChanged {
-		oas.currentUDPNATDeviceType = natType
+	if natType == currentNATType {
+		return currentNATType
 	}
+	log.Debugw("NAT device type changed", "transport", transportProto, "from", currentNATType, "to", natType)
+	oas.emitNATDeviceTypeChanged.Emit(event.EvtNATDeviceTypeChanged{
+		TransportProtocol: transportProto,
+		NatDeviceType:     natType,
+	})
+	return natType
 }
 
-// returns true along with the new NAT device type if the NAT device type for the given protocol has changed.
-// returns false otherwise.
-func (oas *ObservedAddrManager) emitSpecificNATType(addrs []*observedAddr, protoCode int, transportProto network.NATTransportProtocol,
-	currentNATType network.NATDeviceType) (bool, network.NATDeviceType) {
-	now := time.Now()
-	seenBy := make(map[string]struct{})
-	cnt := 0
-
-	for _, oa := range addrs {
-		_, err := oa.addr.ValueForProtocol(protoCode)
-		if err != nil {
-			continue
-		}
+// natType infers the type of our NAT for the given transport protocol from the
+// ports our observers report for each of our local addresses and external IP
+// addresses:
+//
+// 1. If different observers report the same port, and enough of them to
+// activate the address, the NAT maps our address to the same port whoever we
+// talk to: it's a Cone NAT. With regards to RFC 3489, this could be either a
+// Full Cone NAT, a Restricted Cone NAT or a Port Restricted Cone NAT. However,
+// we do NOT differentiate between them here and simply classify all such NATs
+// as a Cone NAT.
+//
+// 2. If four different observers report four different ports for us on
+// outbound connections, the NAT maps our address to a different port for
+// every destination: we are MOST probably behind a Symmetric NAT.
+//
+// The type is unknown until the observations tell either way, or once they
+// expired. oas.mu must be held.
+func (oas *ObservedAddrManager) natType(protoCode int) network.NATDeviceType {
+	type group struct {
+		observers map[string]struct{}
+		ports     map[string]struct{}
+	}
+	groups := make(map[string]*group)
 
-		// if we have an activated addresses, it's a Cone NAT.
-		if now.Sub(oa.lastSeen) <= oas.ttl && oa.activated() {
-			if currentNATType != network.NATDeviceTypeCone {
-				oas.emitNATDeviceTypeChanged.Emit(event.EvtNATDeviceTypeChanged{
-					TransportProtocol: transportProto,
-					NatDeviceType:     network.NATDeviceTypeCone,
-				})
-				return true, network.NATDeviceTypeCone
+	now := oas.now()
+	for local, addrs := range oas.addrs {
+		for _, oa := range addrs {
+			port, err := oa.addr.ValueForProtocol(protoCode)
+			if err != nil || now.Sub(oa.lastSeen) > oas.ttl {
+				continue
+			}
+			if oa.activated(oas.activationThresh) {
+				return network.NATDeviceTypeCone
+			}
+			// observations on inbound connections are of the port
+			// we're reachable at, not of the one mapped for the
+			// observer.
+			if oa.numInbound > 0 {
+				continue
 			}
 
-			// our current NAT Device Type is already CONE, nothing to do here.
-			return false, 0
-		}
-
-		// An observed address on an outbound connection that has ONLY been seen by one peer
-		if now.Sub(oa.lastSeen) <= oas.ttl && oa.numInbound == 0 && len(oa.seenBy) == 1 {
-			cnt++
-			for s := range oa.seenBy {
-				seenBy[s] = struct{}{}
+			ip, _ := ma.SplitFirst(oa.addr)
+			key := local + string(ip.Bytes())
+			g, ok := groups[key]
+			if !ok {
+				g = &group{observers: make(map[string]struct{}), ports: make(map[string]struct{})}
+				groups[key] = g
+			}
+			g.ports[port] = struct{}{}
+			for observer := range oa.seenBy {
+				g.observers[observer] = struct{}{}
 			}
 		}
 	}
 
-	// If four different peers observe a different address for us on each of four outbound connections, we
-	// are MOST probably behind a Symmetric NAT.
-	if cnt >= ActivationThresh && len(seenBy) >= ActivationThresh {
-		if currentNATType != network.NATDeviceTypeSymmetric {
-			oas.emitNATDeviceTypeChanged.Emit(event.EvtNATDeviceTypeChanged{
-				TransportProtocol: transportProto,
-				NatDeviceType:     network.NATDeviceTypeSymmetric,
-			})
-			return true, network.NATDeviceTypeSymmetric
+	for _, g := range groups {
+		if len(g.observers) >= oas.activationThresh && len(g.ports) >= oas.activationThresh {
+			return network.NATDeviceTypeSymmetric
 		}
 	}
+	return network.NATDeviceTypeUnknown
+}
 
-	return false, 0
+// NATDeviceType returns the type of our NAT for the given transport protocol,
+// as inferred from the addresses our peers observe us at. It's only inferred
+// while our reachability is private, and unknown otherwise.
+func (oas *ObservedAddrManager) NATDeviceType(proto network.NATTransportProtocol) network.NATDeviceType {
+	oas.mu.RLock()
+	defer oas.mu.RUnlock()
+	if proto == network.NATTransportUDP {
+		return oas.currentUDPNATDeviceType
+	}
+	return oas.currentTCPNATDeviceType
 }
 
 // observerGroup is a function that determines what part of
@@ -543,10 +1175,14 @@ func (oas *ObservedAddrManager) emitSpecificNATType(addrs []*observedAddr, proto
 // not TCP ports.
 //
 // Here, we use the root multiaddr address. This is mostly
-// IP addresses. In practice, this is what we want.
+// IP addresses. In practice, this is what we want. IPv6
+// addresses are truncated to their /64 prefix, so that a
+// host rotating temporary addresses counts as one observer.
 func observerGroup(m ma.Multiaddr) string {
-	//TODO: If IPv6 rolls out we should mark /64 routing zones as one group
 	first, _ := ma.SplitFirst(m)
+	if first.Protocol().Code == ma.P_IP6 {
+		return string(first.Protocol().VCode) + string(first.RawValue()[:ipv6PrefixBytes])
+	}
 	return string(first.Bytes())
 }
 
@@ -559,6 +1195,18 @@ func (oas *ObservedAddrManager) SetTTL(ttl time.Duration) {
 	oas.refreshTimer.Reset(ttl / 2)
 }
 
+// SetMaxAddrs bounds the number of observed addresses tracked in total, see
+// ObservedAddrOptions.MaxAddrs. Addresses beyond the bound are evicted right
+// away. Zero or a negative value disables the bound.
+func (oas *ObservedAddrManager) SetMaxAddrs(n int) {
+	oas.mu.Lock()
+	defer oas.mu.Unlock()
+	oas.maxAddrs = n
+	for n > 0 && oas.numAddrs > n {
+		oas.evict("")
+	}
+}
+
 // TTL gets the TTL of an observed address manager.
 func (oas *ObservedAddrManager) TTL() time.Duration {
 	oas.mu.RLock()
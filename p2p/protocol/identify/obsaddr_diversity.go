@@ -0,0 +1,112 @@
+package identify
+
+import (
+	"net"
+
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// ASNResolver returns the number of the autonomous system the given IP address
+// belongs to, or zero if unknown. It's called for every observer of our
+// candidate addresses when computing their diversity, see
+// ObservedAddrManager.ObserverDiversity, so it should be fast, e.g. a lookup in
+// an in-memory table.
+type ASNResolver func(ip net.IP) uint32
+
+// ObserverDiversity tells how diverse the observers of a candidate address are.
+// Many observations from few observer groups or ASNs hint that a single entity
+// fakes them, e.g. to eclipse us with an address it controls.
+type ObserverDiversity struct {
+	// Addr is the observed address, and Local the local address the
+	// observations were made on.
+	Addr  ma.Multiaddr
+	Local ma.Multiaddr
+	// Active is whether the address is activated.
+	Active bool
+	// Observers is the number of distinct observer groups that reported the
+	// address: IPv4 addresses, and IPv6 /64 prefixes.
+	Observers int
+	// ASNs is the number of distinct autonomous systems of these observers,
+	// zero without an ASNResolver. Observers whose ASN is unknown aren't
+	// counted.
+	ASNs int
+}
+
+// ObserverDiversity returns the diversity of the observers of every candidate
+// address within the TTL, see ObserverDiversity. ASNs are resolved with the
+// resolver from ObservedAddrOptions, if any.
+func (oas *ObservedAddrManager) ObserverDiversity() []ObserverDiversity {
+	type candidate struct {
+		div       ObserverDiversity
+		observers []net.IP
+	}
+
+	oas.mu.RLock()
+	var candidates []candidate
+	now := oas.now()
+	for local, addrs := range oas.addrs {
+		localAddr, err := ma.NewMultiaddrBytes([]byte(local))
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if now.Sub(a.lastSeen) > oas.ttl {
+				continue
+			}
+			c := candidate{div: ObserverDiversity{
+				Addr:      a.addr,
+				Local:     localAddr,
+				Active:    a.active,
+				Observers: len(a.seenBy),
+			}}
+			if oas.asnResolver != nil {
+				for observer := range a.seenBy {
+					if ip := observerIP(observer); ip != nil {
+						c.observers = append(c.observers, ip)
+					}
+				}
+			}
+			candidates = append(candidates, c)
+		}
+	}
+	resolve := oas.asnResolver
+	oas.mu.RUnlock()
+
+	// resolve outside of the lock, as resolvers may be slow-ish.
+	div := make([]ObserverDiversity, 0, len(candidates))
+	for _, c := range candidates {
+		if resolve != nil {
+			asns := make(map[uint32]struct{})
+			for _, ip := range c.observers {
+				if asn := resolve(ip); asn != 0 {
+					asns[asn] = struct{}{}
+				}
+			}
+			c.div.ASNs = len(asns)
+		}
+		div = append(div, c.div)
+	}
+	return div
+}
+
+// observerIP returns the IP address of an observer group, see observerGroup,
+// the first address of the prefix for IPv6 groups. It returns nil if the group
+// isn't an IP address.
+func observerIP(group string) net.IP {
+	ip6 := ma.ProtocolWithCode(ma.P_IP6).VCode
+	if len(group) == len(ip6)+ipv6PrefixBytes && group[:len(ip6)] == string(ip6) {
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, group[len(ip6):])
+		return ip
+	}
+	addr, err := ma.NewMultiaddrBytes([]byte(group))
+	if err != nil {
+		return nil
+	}
+	ip, err := manet.ToIP(addr)
+	if err != nil {
+		return nil
+	}
+	return ip
+}
@@ -4,7 +4,12 @@ package identify
 // can access internal types.
 
 import (
+	"fmt"
+	"net"
 	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
 
 	ma "github.com/multiformats/go-multiaddr"
 	"github.com/stretchr/testify/require"
@@ -36,3 +41,198 @@ func TestObservedAddrGroupKey(t *testing.T) {
 	require.Equal(t, oa6.groupKey(), oa7.groupKey())
 	require.NotEqual(t, oa7.groupKey(), oa8.groupKey())
 }
+
+func TestObservedAddrCorroboration(t *testing.T) {
+	observed := func(addr string, observers int) *observedAddr {
+		oa := &observedAddr{addr: ma.StringCast(addr), seenBy: make(map[string]observation), lastSeen: time.Now()}
+		for i := 0; i < observers; i++ {
+			oa.seenBy[fmt.Sprintf("observer%d", i)] = observation{}
+		}
+		return oa
+	}
+	tcp := observed("/ip4/1.2.3.4/tcp/1231", ActivationThresh)
+	quic := observed("/ip4/1.2.3.4/udp/1232/quic", CorroboratedActivationThresh)
+	otherIP := observed("/ip4/1.2.3.5/udp/1232/quic", CorroboratedActivationThresh)
+	tooFew := observed("/ip6/::1/udp/1232/quic", CorroboratedActivationThresh-1)
+	tcp2 := observed("/ip4/1.2.3.4/tcp/1233", CorroboratedActivationThresh)
+
+	localTCP := ma.StringCast("/ip4/10.0.0.1/tcp/4001")
+	localQUIC := ma.StringCast("/ip4/10.0.0.1/udp/4001/quic")
+	oas := &ObservedAddrManager{
+		addrs: map[string][]*observedAddr{
+			string(localTCP.Bytes()):  {tcp, tcp2},
+			string(localQUIC.Bytes()): {quic, otherIP, tooFew},
+		},
+		ttl:              time.Minute,
+		activationThresh: ActivationThresh,
+	}
+	ips := oas.activatedIPs()
+	require.Equal(t, map[string]transportSet{string(ma.StringCast("/ip4/1.2.3.4").Bytes()): transportTCP}, ips)
+
+	// the activated TCP address corroborates the QUIC address on its IP.
+	require.True(t, quic.corroborated(ips))
+	require.False(t, otherIP.corroborated(ips))
+	require.False(t, tooFew.corroborated(ips))
+	// but not other TCP addresses.
+	require.False(t, tcp2.corroborated(ips))
+
+	require.ElementsMatch(t, []ma.Multiaddr{tcp.addr, quic.addr}, oas.Addrs())
+	require.ElementsMatch(t, []ma.Multiaddr{quic.addr}, oas.AddrsFor(localQUIC))
+}
+
+// localConn is a connection with the given local address.
+type localConn struct {
+	network.Conn
+	local ma.Multiaddr
+}
+
+func (c localConn) LocalMultiaddr() ma.Multiaddr { return c.local }
+
+func TestCheckObservation(t *testing.T) {
+	public := localConn{local: ma.StringCast("/ip4/1.2.3.4/tcp/4001")}
+	private := localConn{local: ma.StringCast("/ip4/192.168.1.2/tcp/4001")}
+	loopback := localConn{local: ma.StringCast("/ip4/127.0.0.1/tcp/4001")}
+
+	oas := &ObservedAddrManager{}
+	for _, tc := range []struct {
+		conn     network.Conn
+		observed string
+		bogus    bool
+	}{
+		{public, "/ip4/1.2.3.4/tcp/4001", false},
+		{private, "/ip4/1.2.3.4/tcp/4001", false},
+		{private, "/ip4/192.168.1.2/tcp/4001", false},
+		{loopback, "/ip4/10.0.0.1/tcp/4001", false},
+		{public, "/ip4/127.0.0.1/tcp/4001", false},
+		{public, "/ip4/192.168.1.2/tcp/4001", true},
+		{public, "/ip6/fc00::1/tcp/4001", true},
+		{public, "/ip4/0.0.0.0/tcp/4001", true},
+		{public, "/ip6/::/tcp/4001", true},
+		{public, "/ip4/224.0.0.1/udp/4001/quic", true},
+		{public, "/ip4/198.51.100.1/tcp/4001", true},
+		{public, "/dns4/example.com/tcp/4001", true},
+	} {
+		reason := oas.checkObservation(tc.conn, ma.StringCast(tc.observed))
+		require.Equal(t, tc.bogus, reason != "", "%s on %s: %s", tc.observed, tc.conn.LocalMultiaddr(), reason)
+	}
+
+	oas = &ObservedAddrManager{allowPrivateOnPublic: true, rejectPublicOnPrivate: true}
+	require.Empty(t, oas.checkObservation(public, ma.StringCast("/ip4/192.168.1.2/tcp/4001")))
+	require.NotEmpty(t, oas.checkObservation(private, ma.StringCast("/ip4/1.2.3.4/tcp/4001")))
+}
+
+func TestObservedAddrIPv6Prefix(t *testing.T) {
+	tmp1 := &observedAddr{addr: ma.StringCast("/ip6/2001:db8::1234/tcp/4001")}
+	tmp2 := &observedAddr{addr: ma.StringCast("/ip6/2001:db8::5678/tcp/4001")}
+	other := &observedAddr{addr: ma.StringCast("/ip6/2001:db8:0:1::1234/tcp/4001")}
+
+	// temporary addresses in the same /64 => same key
+	require.Equal(t, tmp1.groupKey(), tmp2.groupKey())
+	require.NotEqual(t, tmp1.groupKey(), other.groupKey())
+	require.Equal(t, observerGroup(tmp1.addr), observerGroup(tmp2.addr))
+	require.NotEqual(t, observerGroup(tmp1.addr), observerGroup(other.addr))
+}
+
+func TestObservedAddrIPv6Stable(t *testing.T) {
+	observed := func(addr string, observers int) *observedAddr {
+		oa := &observedAddr{addr: ma.StringCast(addr), seenBy: make(map[string]observation), lastSeen: time.Now()}
+		for i := 0; i < observers; i++ {
+			oa.seenBy[fmt.Sprintf("observer%d", i)] = observation{}
+		}
+		return oa
+	}
+	stale := observed("/ip6/2001:db8::1/tcp/4001", ActivationThresh+2)
+	gone := observed("/ip6/2001:db8::2/tcp/4001", ActivationThresh+1)
+	current := observed("/ip6/2001:db8::3/tcp/4001", ActivationThresh)
+
+	local := ma.StringCast("/ip6/2001:db8::3/tcp/4001")
+	oas := &ObservedAddrManager{
+		addrs:            map[string][]*observedAddr{string(local.Bytes()): {stale, gone, current}},
+		ttl:              time.Minute,
+		activationThresh: ActivationThresh,
+		ifaceAddrs:       make(map[string]time.Time),
+	}
+	oas.updateIfaceAddrs([]ma.Multiaddr{ma.StringCast("/ip6/2001:db8::ff/tcp/4001")})
+	oas.updateIfaceAddrs([]ma.Multiaddr{
+		ma.StringCast("/ip6/2001:db8::ff/tcp/4001"),
+		ma.StringCast("/ip6/2001:db8::3/tcp/4001"),
+	})
+
+	// the observation of our current address is preferred.
+	require.ElementsMatch(t, []ma.Multiaddr{current.addr, stale.addr}, oas.Addrs())
+
+	// only the longest known interface address of the prefix is advertised.
+	oas.ipv6StableOnly = true
+	require.Equal(t, []ma.Multiaddr{ma.StringCast("/ip6/2001:db8::ff/tcp/4001")}, oas.Addrs())
+
+	oas.updateIfaceAddrs(nil)
+	require.Empty(t, oas.Addrs())
+}
+
+func TestObserverDiversity(t *testing.T) {
+	observed := func(addr string, observers ...string) *observedAddr {
+		oa := &observedAddr{addr: ma.StringCast(addr), seenBy: make(map[string]observation), lastSeen: time.Now()}
+		for _, o := range observers {
+			oa.seenBy[observerGroup(ma.StringCast(o))] = observation{}
+		}
+		return oa
+	}
+	diverse := observed("/ip4/1.2.3.4/tcp/4001",
+		"/ip4/10.0.0.1/tcp/1", "/ip4/20.0.0.1/tcp/1", "/ip6/2001:db8::1/tcp/1", "/ip6/2001:db8::2/tcp/1")
+	eclipse := observed("/ip4/6.6.6.6/tcp/4001",
+		"/ip4/30.0.0.1/tcp/1", "/ip4/30.0.0.2/tcp/1", "/ip4/30.0.0.3/tcp/1")
+
+	asns := map[string]uint32{
+		"10.0.0.1":   1,
+		"20.0.0.1":   2,
+		"2001:db8::": 3,
+		"30.0.0.1":   4,
+		"30.0.0.2":   4,
+		"30.0.0.3":   4,
+	}
+	local := ma.StringCast("/ip4/10.0.0.2/tcp/4001")
+	oas := &ObservedAddrManager{
+		addrs:       map[string][]*observedAddr{string(local.Bytes()): {diverse, eclipse}},
+		ttl:         time.Minute,
+		asnResolver: func(ip net.IP) uint32 { return asns[ip.String()] },
+	}
+	require.ElementsMatch(t, []ObserverDiversity{
+		{Addr: diverse.addr, Local: local, Observers: 3, ASNs: 3},
+		{Addr: eclipse.addr, Local: local, Observers: 3, ASNs: 1},
+	}, oas.ObserverDiversity())
+}
+
+// remoteConn is an outbound connection between the given addresses.
+type remoteConn struct {
+	localConn
+	remote ma.Multiaddr
+}
+
+func (c remoteConn) RemoteMultiaddr() ma.Multiaddr { return c.remote }
+func (c remoteConn) Stat() network.Stat            { return network.Stat{Direction: network.DirOutbound} }
+
+func TestObservationLatency(t *testing.T) {
+	local := ma.StringCast("/ip4/10.0.0.2/tcp/4001")
+	oas := &ObservedAddrManager{
+		addrs: make(map[string][]*observedAddr),
+		ttl:   time.Minute,
+	}
+	record := func(observed, observer string, rtt time.Duration) {
+		conn := remoteConn{localConn: localConn{local: local}, remote: ma.StringCast(observer)}
+		oas.recordObservationUnlocked(conn, ma.StringCast(observed), rtt)
+	}
+	record("/ip4/1.2.3.4/tcp/4001", "/ip4/20.0.0.1/tcp/1", 80*time.Millisecond)
+	record("/ip4/1.2.3.4/tcp/4001", "/ip4/20.0.0.2/tcp/1", 20*time.Millisecond)
+	record("/ip4/5.6.7.8/tcp/4001", "/ip4/30.0.0.1/tcp/1", 10*time.Millisecond)
+	record("/ip4/5.6.7.8/tcp/4001", "/ip4/30.0.0.2/tcp/1", 30*time.Millisecond)
+	record("/ip4/5.6.7.8/tcp/4001", "/ip4/30.0.0.3/tcp/1", 60*time.Millisecond)
+	record("/ip4/9.9.9.9/tcp/4001", "/ip4/40.0.0.1/tcp/1", 0)
+	// refreshing an observation keeps its round trip time.
+	record("/ip4/5.6.7.8/tcp/4001", "/ip4/30.0.0.1/tcp/1", 0)
+
+	require.Equal(t, []ObservationLatency{
+		{Addr: ma.StringCast("/ip4/5.6.7.8/tcp/4001"), Local: local, Observers: 3, Min: 10 * time.Millisecond, Median: 30 * time.Millisecond},
+		{Addr: ma.StringCast("/ip4/1.2.3.4/tcp/4001"), Local: local, Observers: 2, Min: 20 * time.Millisecond, Median: 50 * time.Millisecond},
+		{Addr: ma.StringCast("/ip4/9.9.9.9/tcp/4001"), Local: local},
+	}, oas.ObservationLatency())
+}
@@ -0,0 +1,93 @@
+package identify
+
+import (
+	"net"
+	"time"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// ipv6PrefixBytes is the length, in bytes, of the prefix IPv6 hosts pick their
+// interface addresses in. Hosts using privacy extensions (RFC 4941) rotate
+// their temporary addresses within this /64 prefix.
+const ipv6PrefixBytes = 64 / 8
+
+// ipv6Prefix returns the /64 prefix of the address, if it's an IPv6 address.
+func ipv6Prefix(a ma.Multiaddr) (string, bool) {
+	first, _ := ma.SplitFirst(a)
+	if first == nil || first.Protocol().Code != ma.P_IP6 {
+		return "", false
+	}
+	return string(first.RawValue()[:ipv6PrefixBytes]), true
+}
+
+// updateIfaceAddrs records the IPv6 addresses among our current interface
+// addresses, along with when we first saw them, and forgets the ones that
+// went away. oas.mu must be held.
+func (oas *ObservedAddrManager) updateIfaceAddrs(ifaceaddrs []ma.Multiaddr) {
+	now := oas.now()
+	current := make(map[string]struct{}, len(ifaceaddrs))
+	for _, a := range ifaceaddrs {
+		first, _ := ma.SplitFirst(a)
+		if first == nil || first.Protocol().Code != ma.P_IP6 {
+			continue
+		}
+		ip := string(first.RawValue())
+		current[ip] = struct{}{}
+		if _, ok := oas.ifaceAddrs[ip]; !ok {
+			oas.ifaceAddrs[ip] = now
+		}
+	}
+	for ip := range oas.ifaceAddrs {
+		if _, ok := current[ip]; !ok {
+			delete(oas.ifaceAddrs, ip)
+		}
+	}
+}
+
+// isIfaceAddr returns true if the IP of the observed address is one of our
+// current IPv6 interface addresses. oas.mu must be held.
+func (oas *ObservedAddrManager) isIfaceAddr(a ma.Multiaddr) bool {
+	first, _ := ma.SplitFirst(a)
+	if first == nil || first.Protocol().Code != ma.P_IP6 {
+		return false
+	}
+	_, ok := oas.ifaceAddrs[string(first.RawValue())]
+	return ok
+}
+
+// stableAddr returns the observed address with its IP replaced by the
+// prefix-stable one: our interface address in the same /64 prefix that we have
+// known the longest. Temporary addresses come and go, the stable address
+// outlives them. It returns nil if none of our interface addresses is in the
+// prefix. oas.mu must be held.
+func (oas *ObservedAddrManager) stableAddr(observed ma.Multiaddr) ma.Multiaddr {
+	prefix, ok := ipv6Prefix(observed)
+	if !ok {
+		return nil
+	}
+	var (
+		stable    string
+		firstSeen time.Time
+	)
+	for ip, seen := range oas.ifaceAddrs {
+		if ip[:ipv6PrefixBytes] != prefix {
+			continue
+		}
+		if stable == "" || seen.Before(firstSeen) || (seen.Equal(firstSeen) && ip < stable) {
+			stable, firstSeen = ip, seen
+		}
+	}
+	if stable == "" {
+		return nil
+	}
+	c, err := ma.NewComponent("ip6", net.IP(stable).String())
+	if err != nil {
+		return nil
+	}
+	_, rest := ma.SplitFirst(observed)
+	if rest == nil {
+		return c
+	}
+	return c.Encapsulate(rest)
+}
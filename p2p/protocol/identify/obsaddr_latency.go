@@ -0,0 +1,81 @@
+package identify
+
+import (
+	"sort"
+	"time"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// ObservationLatency tells how far, in round trip time, the observers of a
+// candidate address are. Addresses observed over low-latency paths are likely
+// observed by peers of our region, which can usually reach us there best.
+type ObservationLatency struct {
+	// Addr is the observed address, and Local the local address the
+	// observations were made on.
+	Addr  ma.Multiaddr
+	Local ma.Multiaddr
+	// Active is whether the address is activated.
+	Active bool
+	// Observers is the number of observer groups whose round trip time we
+	// know, see ObservedAddrManager.RecordWithRTT. The latencies below are
+	// zero if it's zero.
+	Observers int
+	// Min and Median are the minimum and the median round trip time of
+	// these observers.
+	Min    time.Duration
+	Median time.Duration
+}
+
+// ObservationLatency returns the latency of the observations of every
+// candidate address within the TTL, see ObservationLatency, lowest median
+// first. Addresses without observations of known round trip time come last.
+func (oas *ObservedAddrManager) ObservationLatency() []ObservationLatency {
+	oas.mu.RLock()
+	defer oas.mu.RUnlock()
+
+	var lat []ObservationLatency
+	now := oas.now()
+	for local, addrs := range oas.addrs {
+		localAddr, err := ma.NewMultiaddrBytes([]byte(local))
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if now.Sub(a.lastSeen) > oas.ttl {
+				continue
+			}
+			l := ObservationLatency{
+				Addr:   a.addr,
+				Local:  localAddr,
+				Active: a.active,
+			}
+			rtts := make([]time.Duration, 0, len(a.seenBy))
+			for _, ob := range a.seenBy {
+				if ob.rtt > 0 {
+					rtts = append(rtts, ob.rtt)
+				}
+			}
+			if len(rtts) > 0 {
+				sort.Slice(rtts, func(i, j int) bool { return rtts[i] < rtts[j] })
+				l.Observers = len(rtts)
+				l.Min = rtts[0]
+				l.Median = rtts[len(rtts)/2]
+				if len(rtts)%2 == 0 {
+					l.Median = (rtts[len(rtts)/2-1] + rtts[len(rtts)/2]) / 2
+				}
+			}
+			lat = append(lat, l)
+		}
+	}
+	sort.SliceStable(lat, func(i, j int) bool {
+		if (lat[i].Observers == 0) != (lat[j].Observers == 0) {
+			return lat[j].Observers == 0
+		}
+		if lat[i].Median != lat[j].Median {
+			return lat[i].Median < lat[j].Median
+		}
+		return lat[i].Addr.String() < lat[j].Addr.String()
+	})
+	return lat
+}
@@ -2,6 +2,8 @@ package identify_test
 
 import (
 	"context"
+	"fmt"
+	"sync"
 	"testing"
 	"time"
 
@@ -71,14 +73,14 @@ func (h *harness) connInbound(observer peer.ID) network.Conn {
 func (h *harness) observe(observed ma.Multiaddr, observer peer.ID) network.Conn {
 	c := h.conn(observer)
 	h.oas.Record(c, observed)
-	time.Sleep(50 * time.Millisecond) // let the worker run
+	h.oas.Flush()
 	return c
 }
 
 func (h *harness) observeInbound(observed ma.Multiaddr, observer peer.ID) network.Conn {
 	c := h.connInbound(observer)
 	h.oas.Record(c, observed)
-	time.Sleep(50 * time.Millisecond) // let the worker run
+	h.oas.Flush()
 	return c
 }
 
@@ -435,3 +437,300 @@ func TestEmitNATDeviceTypeCone(t *testing.T) {
 		t.Fatal("did not get Cone NAT event")
 	}
 }
+
+type relayedConn struct {
+	network.Conn
+}
+
+func (c relayedConn) Stat() network.Stat {
+	st := c.Conn.Stat()
+	st.Transient = true
+	return st
+}
+
+func TestObsAddrRelayedConns(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	harness := newHarness(ctx, t)
+
+	observed := ma.StringCast("/ip4/1.2.3.4/tcp/1231")
+	for i := 0; i < identify.ActivationThresh+1; i++ {
+		pi := harness.add(ma.StringCast(fmt.Sprintf("/ip4/1.2.3.%d/tcp/1", i+10)))
+		harness.oas.Record(relayedConn{harness.conn(pi)}, observed)
+	}
+	require.Eventually(t, func() bool {
+		return len(harness.oas.RelayedAddrs()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	require.True(t, harness.oas.RelayedAddrs()[0].Equal(observed))
+	require.Empty(t, harness.oas.Addrs())
+}
+
+func TestNATDeviceTypeFromPorts(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	harness := newHarness(ctx, t)
+	emitter, err := harness.host.EventBus().Emitter(new(event.EvtLocalReachabilityChanged), eventbus.Stateful)
+	require.NoError(t, err)
+	require.NoError(t, emitter.Emit(event.EvtLocalReachabilityChanged{Reachability: network.ReachabilityPrivate}))
+
+	var peers []peer.ID
+	for i := 0; i < 6; i++ {
+		peers = append(peers, harness.add(ma.StringCast(fmt.Sprintf("/ip4/1.2.3.%d/tcp/1", i+10))))
+	}
+	observed := func(port int) ma.Multiaddr {
+		return ma.StringCast(fmt.Sprintf("/ip4/1.2.3.4/tcp/%d", port))
+	}
+
+	// observers agreeing on some ports don't tell us either way.
+	harness.observe(observed(1231), peers[0])
+	harness.observe(observed(1232), peers[1])
+	harness.observe(observed(1232), peers[2])
+	harness.observe(observed(1233), peers[3])
+	require.Equal(t, network.NATDeviceTypeUnknown, harness.oas.NATDeviceType(network.NATTransportTCP))
+
+	// inbound observations are of the port we're reachable at.
+	harness.observeInbound(observed(1234), peers[4])
+	require.Equal(t, network.NATDeviceTypeUnknown, harness.oas.NATDeviceType(network.NATTransportTCP))
+
+	// different observers seeing four different ports.
+	harness.observe(observed(1235), peers[5])
+	require.Eventually(t, func() bool {
+		return harness.oas.NATDeviceType(network.NATTransportTCP) == network.NATDeviceTypeSymmetric
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, network.NATDeviceTypeUnknown, harness.oas.NATDeviceType(network.NATTransportUDP))
+
+	sub, err := harness.host.EventBus().Subscribe(new(event.EvtNATDeviceTypeChanged))
+	require.NoError(t, err)
+	defer sub.Close()
+	<-sub.Out() // the current state.
+
+	// the type is only known while we're private.
+	require.NoError(t, emitter.Emit(event.EvtLocalReachabilityChanged{Reachability: network.ReachabilityPublic}))
+	select {
+	case ev := <-sub.Out():
+		evt := ev.(event.EvtNATDeviceTypeChanged)
+		require.Equal(t, network.NATDeviceTypeUnknown, evt.NatDeviceType)
+		require.Equal(t, network.NATTransportTCP, evt.TransportProtocol)
+	case <-time.After(5 * time.Second):
+		t.Fatal("did not get Unknown NAT event")
+	}
+	require.Equal(t, network.NATDeviceTypeUnknown, harness.oas.NATDeviceType(network.NATTransportTCP))
+}
+
+func TestObsAddrMaxAddrs(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	harness := newHarness(ctx, t)
+	harness.oas.SetMaxAddrs(3)
+
+	var peers []peer.ID
+	for i := 0; i < identify.ActivationThresh; i++ {
+		peers = append(peers, harness.add(ma.StringCast(fmt.Sprintf("/ip4/1.2.3.%d/tcp/1", i+10))))
+	}
+	a1 := ma.StringCast("/ip4/1.2.4.1/tcp/1231")
+	a2 := ma.StringCast("/ip4/1.2.4.2/tcp/1231")
+	for _, p := range peers {
+		harness.observe(a1, p)
+		harness.observe(a2, p)
+	}
+
+	// a peer reporting a bogus address on every connection doesn't evict
+	// the activated addresses.
+	for i := 0; i < 10; i++ {
+		harness.oas.Record(harness.conn(peers[0]), ma.StringCast(fmt.Sprintf("/ip4/1.2.5.%d/tcp/1231", i)))
+	}
+	require.Eventually(t, func() bool {
+		return harness.oas.Stats().Evicted == 9
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, 3, harness.oas.Stats().Addrs)
+	require.ElementsMatch(t, []ma.Multiaddr{a1, a2}, harness.oas.Addrs())
+
+	// lowering the bound evicts addresses right away.
+	harness.oas.SetMaxAddrs(1)
+	require.Equal(t, 1, harness.oas.Stats().Addrs)
+	require.Len(t, harness.oas.Addrs(), 1)
+}
+
+func TestObsAddrOptions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	harness := newHarness(ctx, t)
+	oas, err := identify.NewObservedAddrManagerWithOptions(ctx, harness.host, identify.ObservedAddrOptions{
+		ActivationThresh: 2,
+		TTL:              time.Hour,
+		MaxAddrsPerLocal: 2,
+	})
+	require.NoError(t, err)
+	require.Equal(t, time.Hour, oas.TTL())
+
+	p1 := harness.add(ma.StringCast("/ip4/1.2.3.10/tcp/1"))
+	p2 := harness.add(ma.StringCast("/ip4/1.2.3.11/tcp/1"))
+	a1 := ma.StringCast("/ip4/1.2.4.1/tcp/1231")
+	a2 := ma.StringCast("/ip4/1.2.4.2/tcp/1231")
+	a3 := ma.StringCast("/ip4/1.2.4.3/tcp/1231")
+
+	oas.Record(harness.conn(p1), a1)
+	oas.Flush()
+	require.Empty(t, oas.Addrs())
+
+	// two observers are enough.
+	for _, p := range []peer.ID{p1, p2} {
+		oas.Record(harness.conn(p), a2)
+	}
+	require.Eventually(t, func() bool {
+		addrs := oas.Addrs()
+		return len(addrs) == 1 && addrs[0].Equal(a2)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the third address evicts the one that isn't activated.
+	oas.Record(harness.conn(p1), a3)
+	oas.Record(harness.conn(p2), a3)
+	require.Eventually(t, func() bool {
+		return len(oas.Addrs()) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	require.ElementsMatch(t, []ma.Multiaddr{a2, a3}, oas.Addrs())
+	require.Equal(t, uint64(1), oas.Stats().Evicted)
+}
+
+func TestObsAddrEvents(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	harness := newHarness(ctx, t)
+	oas, err := identify.NewObservedAddrManagerWithOptions(ctx, harness.host, identify.ObservedAddrOptions{
+		TTL:        time.Second,
+		GCInterval: 50 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	sub, err := harness.host.EventBus().Subscribe(new(identify.EvtObservedAddrChanged))
+	require.NoError(t, err)
+	defer sub.Close()
+	next := func() identify.EvtObservedAddrChanged {
+		t.Helper()
+		select {
+		case e := <-sub.Out():
+			return e.(identify.EvtObservedAddrChanged)
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected an event")
+		}
+		return identify.EvtObservedAddrChanged{}
+	}
+
+	observed := ma.StringCast("/ip4/1.2.4.1/tcp/1231")
+	var conns []network.Conn
+	for i := 0; i < identify.ActivationThresh; i++ {
+		p := harness.add(ma.StringCast(fmt.Sprintf("/ip4/1.2.3.%d/tcp/1", i+10)))
+		c := harness.conn(p)
+		conns = append(conns, c)
+		oas.Record(c, observed)
+	}
+	evt := next()
+	require.True(t, evt.Activated)
+	require.Equal(t, identify.ObservedAddrThreshold, evt.Reason)
+	require.True(t, evt.Addr.Equal(observed))
+	require.True(t, evt.Local.Equal(harness.host.Addrs()[0]))
+
+	// the address expires once no peer observed it within the TTL.
+	for _, c := range conns {
+		c.Close()
+	}
+	evt = next()
+	require.False(t, evt.Activated)
+	require.Equal(t, identify.ObservedAddrExpired, evt.Reason)
+	require.Empty(t, oas.Addrs())
+}
+
+func TestObsAddrRejectBogus(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	harness := newHarness(ctx, t)
+	p := harness.add(ma.StringCast("/ip4/1.2.3.10/tcp/1"))
+
+	harness.observe(ma.StringCast("/ip4/0.0.0.0/tcp/1231"), p)
+	harness.observe(ma.StringCast("/dns4/example.com/tcp/1231"), p)
+	harness.observe(ma.StringCast("/ip4/1.2.4.1/tcp/1231"), p)
+	require.Equal(t, uint64(2), harness.oas.Stats().Rejected)
+	require.Equal(t, 1, harness.oas.Stats().Addrs)
+}
+
+func TestObsAddrRequireInbound(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	harness := newHarness(ctx, t)
+	oas, err := identify.NewObservedAddrManagerWithOptions(ctx, harness.host, identify.ObservedAddrOptions{
+		ActivationThresh: 2,
+		RequireInbound:   true,
+	})
+	require.NoError(t, err)
+	harness.oas = oas
+
+	p1 := harness.add(ma.StringCast("/ip4/1.2.3.10/tcp/1"))
+	p2 := harness.add(ma.StringCast("/ip4/1.2.3.11/tcp/1"))
+	p3 := harness.add(ma.StringCast("/ip4/1.2.3.12/tcp/1"))
+	a1 := ma.StringCast("/ip4/1.2.4.1/tcp/1231")
+
+	// enough observers, but all of them on outbound connections.
+	harness.observe(a1, p1)
+	harness.observe(a1, p2)
+	require.Empty(t, oas.Addrs())
+
+	harness.observeInbound(a1, p3)
+	require.Equal(t, []ma.Multiaddr{a1}, oas.Addrs())
+}
+
+func TestObsAddrFakeClock(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	harness := newHarness(ctx, t)
+
+	var (
+		mu  sync.Mutex
+		now = time.Now()
+	)
+	advance := func(d time.Duration) {
+		mu.Lock()
+		now = now.Add(d)
+		mu.Unlock()
+	}
+	oas, err := identify.NewObservedAddrManagerWithOptions(ctx, harness.host, identify.ObservedAddrOptions{
+		ActivationThresh: 2,
+		TTL:              time.Hour,
+		Clock: func() time.Time {
+			mu.Lock()
+			defer mu.Unlock()
+			return now
+		},
+	})
+	require.NoError(t, err)
+	harness.oas = oas
+
+	p1 := harness.add(ma.StringCast("/ip4/1.2.3.10/tcp/1"))
+	p2 := harness.add(ma.StringCast("/ip4/1.2.3.11/tcp/1"))
+	p3 := harness.add(ma.StringCast("/ip4/1.2.3.12/tcp/1"))
+	p4 := harness.add(ma.StringCast("/ip4/1.2.3.13/tcp/1"))
+	a1 := ma.StringCast("/ip4/1.2.4.1/tcp/1231")
+	a2 := ma.StringCast("/ip4/1.2.4.2/tcp/1231")
+
+	harness.observe(a1, p1)
+	harness.observe(a1, p2)
+	harness.observe(a2, p3)
+	harness.observe(a2, p4)
+	require.ElementsMatch(t, []ma.Multiaddr{a1, a2}, oas.Addrs())
+
+	// observations on open connections are refreshed.
+	for i := 0; i < 3; i++ {
+		advance(time.Hour / 2)
+		oas.Tick()
+	}
+	require.ElementsMatch(t, []ma.Multiaddr{a1, a2}, oas.Addrs())
+
+	// the others expire, once we're notified the connections closed.
+	require.NoError(t, harness.host.Network().ClosePeer(p3))
+	require.NoError(t, harness.host.Network().ClosePeer(p4))
+	require.Eventually(t, func() bool {
+		advance(time.Hour + time.Second)
+		oas.Tick()
+		return len(oas.Addrs()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, []ma.Multiaddr{a1}, oas.Addrs())
+	require.Equal(t, 1, oas.Stats().Addrs)
+}
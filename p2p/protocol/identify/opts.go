@@ -1,8 +1,69 @@
 package identify
 
+import (
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/protocol"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
 type config struct {
 	userAgent               string
 	disableSignedPeerRecord bool
+	disablePush             bool
+	disableDelta            bool
+	strictValidation        bool
+	disconnectInvalid       bool
+	protocolVersionCheck    func(string) bool
+	metadata                map[string][]byte
+	maxMessageSize          int
+	protocolFilter          func(protocol.ID) bool
+	ignoreRelayed           bool
+	addrsFactory            func([]ma.Multiaddr) []ma.Multiaddr
+
+	retryInterval    time.Duration
+	retryMaxAttempts int
+
+	pushDebounce time.Duration
+
+	timeout time.Duration
+
+	reuseStream bool
+
+	rateLimitGlobal   int
+	rateLimitPeer     int
+	rateLimitInterval time.Duration
+
+	maxPeerAddrs        int
+	peerWritesPerMinute int
+
+	refreshRecord bool
+	addrDeltas    bool
+
+	maxConcurrentIdentify int
+
+	dedupWindow time.Duration
+
+	signMissingRecord bool
+	recordWait        time.Duration
+
+	metricsTracer MetricsTracer
+
+	connMetadata func(network.Conn) map[string][]byte
+
+	insecure bool
+
+	keyMismatchPolicy func(EvtPeerKeyMismatch) KeyMismatchAction
+
+	protocolIDs       *ProtocolIDs
+	keepDefaultProtos bool
+
+	lazy bool
+
+	maxObservedAddrs int
+	observedAddrOpts ObservedAddrOptions
 }
 
 // Option is an option function for identify.
@@ -22,3 +83,341 @@ func DisableSignedPeerRecord() Option {
 		cfg.disableSignedPeerRecord = true
 	}
 }
+
+// DisablePush disables Identify Push: we neither push our address updates to
+// peers nor accept pushes from them.
+//
+// If both push and delta are disabled, we don't track per-peer state at all,
+// saving resources on nodes with many connections.
+func DisablePush() Option {
+	return func(cfg *config) {
+		cfg.disablePush = true
+	}
+}
+
+// DisableDelta disables Identify Delta: we neither send protocol updates to
+// peers as deltas nor accept deltas from them. Unless push is disabled too,
+// protocol updates are sent as full Identify Push messages instead.
+func DisableDelta() Option {
+	return func(cfg *config) {
+		cfg.disableDelta = true
+	}
+}
+
+// StrictValidation makes us reject Identify and Identify Push messages
+// containing invalid multiaddrs, a public key that doesn't match the remote
+// peer, or a signed peer record we can't verify. By default, we log these
+// problems and use whatever we could make sense of.
+//
+// If disconnect is true, we also close the connection the message was
+// received on. Rejections are counted per reason, see
+// IDService.ValidationFailures.
+func StrictValidation(disconnect bool) Option {
+	return func(cfg *config) {
+		cfg.strictValidation = true
+		cfg.disconnectInvalid = disconnect
+	}
+}
+
+// RequireProtocolVersion rejects peers whose protocol version, as sent in
+// their Identify messages, fails the given check, e.g. hosts of a private
+// network checking for their own version. We close the connection to rejected
+// peers, and identification fails with a ValidationError with the
+// RejectedProtocolVersion reason, emitting an
+// event.EvtPeerIdentificationFailed.
+func RequireProtocolVersion(check func(string) bool) Option {
+	return func(cfg *config) {
+		cfg.protocolVersionCheck = check
+	}
+}
+
+// MaxMessageSize sets the maximum size of a single Identify, Identify Push or
+// Identify Delta message we accept from peers. Larger messages are rejected,
+// emitting an EvtMessageTooLarge. Defaults to DefaultMaxMessageSize.
+//
+// Peers with many protocols or large signed peer records may need a larger
+// limit.
+func MaxMessageSize(size int) Option {
+	return func(cfg *config) {
+		cfg.maxMessageSize = size
+	}
+}
+
+// ProtocolFilter only advertises the protocols for which the given function
+// returns true to peers, in Identify messages as well as in Identify Delta
+// updates. Use it to avoid leaking private or internal protocols to every
+// peer. We still handle streams for protocols that aren't advertised.
+func ProtocolFilter(f func(protocol.ID) bool) Option {
+	return func(cfg *config) {
+		cfg.protocolFilter = f
+	}
+}
+
+// AddrsFactory sets a function transforming or filtering the listen addresses
+// we advertise to peers, independently of Host.Addrs(). This allows, for
+// example, only advertising public addresses to peers while still using
+// private addresses locally.
+//
+// Unless signed peer records are disabled, we sign a peer record containing
+// only the advertised addresses, instead of sending the host's record.
+func AddrsFactory(f func([]ma.Multiaddr) []ma.Multiaddr) Option {
+	return func(cfg *config) {
+		cfg.addrsFactory = f
+	}
+}
+
+// IgnoreRelayedObservations drops the addresses peers observed us at over
+// relayed connections. By default, these are recorded apart from direct
+// observations, see ObservedAddrManager.RelayedAddrs, but never advertised.
+func IgnoreRelayedObservations() Option {
+	return func(cfg *config) {
+		cfg.ignoreRelayed = true
+	}
+}
+
+// RetryUpdates retries Identify Push and Delta updates we failed to send to a
+// connected peer, up to maxAttempts times, waiting interval before the first
+// retry and doubling the wait after every further failure. Updates triggered
+// while a retry is pending are coalesced with it. By default, failed updates
+// aren't retried.
+func RetryUpdates(interval time.Duration, maxAttempts int) Option {
+	return func(cfg *config) {
+		cfg.retryInterval = interval
+		cfg.retryMaxAttempts = maxAttempts
+	}
+}
+
+// PushDebounce coalesces changes of our addresses into a single Identify Push
+// to every peer. The push is sent once the given window has elapsed since the
+// first change, covering all changes in the meantime. This avoids flooding
+// peers with pushes while addresses flap, e.g. on mobile networks, at the cost
+// of delaying every push by the window. By default, we push every change
+// right away.
+func PushDebounce(window time.Duration) Option {
+	return func(cfg *config) {
+		cfg.pushDebounce = window
+	}
+}
+
+// Timeout bounds the time spent on a single Identify family exchange with a
+// peer: opening and negotiating the stream, and reading or writing the
+// messages. Identifying a peer that takes longer fails with ErrTimeout.
+// Defaults to StreamReadTimeout.
+func Timeout(d time.Duration) Option {
+	return func(cfg *config) {
+		cfg.timeout = d
+	}
+}
+
+// ReuseStream multiplexes Identify requests, Identify Push and Identify Delta
+// messages to a peer over a single long-lived stream, using the IDMux
+// protocol, instead of opening a new stream for every exchange. This saves
+// round trips on high latency links, e.g. when identifying further
+// connections to a peer.
+//
+// Both peers must enable this option. Identifying a peer that doesn't support
+// IDMux costs an extra round trip, to fall back to the regular protocols.
+func ReuseStream() Option {
+	return func(cfg *config) {
+		cfg.reuseStream = true
+	}
+}
+
+// Metadata sets the initial application-defined metadata attached to outgoing
+// Identify messages. See IDService.SetMetadata.
+func Metadata(md map[string][]byte) Option {
+	return func(cfg *config) {
+		cfg.metadata = md
+	}
+}
+
+// RateLimit limits the number of inbound Identify, Identify Push and Identify
+// Delta requests served in each interval, both in total (global) and for any
+// single peer (perPeer). Excess streams are reset. A limit of 0 disables the
+// corresponding check. Requests are counted for a bounded number of peers per
+// interval: beyond it, the peer that sent a request the longest ago starts
+// afresh.
+func RateLimit(global, perPeer int, interval time.Duration) Option {
+	return func(cfg *config) {
+		cfg.rateLimitGlobal = global
+		cfg.rateLimitPeer = perPeer
+		cfg.rateLimitInterval = interval
+	}
+}
+
+// PeerstoreLimits protects the peerstore from peers sending us excessive
+// updates. We store at most maxAddrs listen addresses per peer, truncating
+// longer lists and ignoring signed peer records containing more addresses,
+// and apply at most writesPerMinute Identify Push and Delta messages from any
+// single peer per minute, resetting the streams of excess ones. A limit of 0
+// disables the corresponding check. See IDService.PeerstoreLimitStats.
+func PeerstoreLimits(maxAddrs, writesPerMinute int) Option {
+	return func(cfg *config) {
+		cfg.maxPeerAddrs = maxAddrs
+		cfg.peerWritesPerMinute = writesPerMinute
+	}
+}
+
+// RefreshSignedRecord re-pushes our signed peer record to peers reconnecting
+// to us if the last record we sent them is stale, i.e. our addresses changed
+// while we were disconnected. We track the sequence number of the last record
+// sent to every peer in the peerstore. Requires Identify Push. See
+// IDService.RecordRefreshStats.
+func RefreshSignedRecord() Option {
+	return func(cfg *config) {
+		cfg.refreshRecord = true
+	}
+}
+
+// AddrDeltas sends changes of our listen addresses as Identify Delta messages,
+// carrying only the added and removed addresses and our new signed peer
+// record, to peers supporting IDDeltaAddrs, instead of pushing our full state.
+// This saves bandwidth for hosts with large address sets. Other peers still
+// get an Identify Push. Requires both Identify Push and Delta.
+//
+// Application metadata is only sent with full Identify messages, so peers
+// won't learn about metadata changes through address deltas.
+func AddrDeltas() Option {
+	return func(cfg *config) {
+		cfg.addrDeltas = true
+	}
+}
+
+// MaxConcurrentIdentify limits the number of outbound identify requests running
+// at once, e.g. to bound the goroutines and allocations of a bootstrapper
+// accepting thousands of connections at startup. Further connections wait for
+// a free slot, in no particular order, before being identified; the identify
+// timeout only starts once they get one. See IDService.IdentifyQueueStats. By
+// default, concurrency isn't limited.
+func MaxConcurrentIdentify(n int) Option {
+	return func(cfg *config) {
+		cfg.maxConcurrentIdentify = n
+	}
+}
+
+// DedupIdentify identifies peers rather than connections: when we open another
+// connection to a peer, e.g. over a different transport, we reuse the result
+// of identifying it on an earlier connection if that completed successfully
+// within the given freshness window, instead of running identify again and
+// rewriting the peer's entries in the peerstore. If the peer is being
+// identified on another connection, we wait for the result. Reused results
+// are reported with IdentifyResult.Reused set. By default, every connection
+// is identified independently.
+func DedupIdentify(freshness time.Duration) Option {
+	return func(cfg *config) {
+		cfg.dedupWindow = freshness
+	}
+}
+
+// SignMissingRecord signs a peer record for our current addresses on demand
+// when the host hasn't published its signed peer record yet, e.g. while
+// starting up, so that peers never receive Identify messages without one. By
+// default, we send such messages without a signed peer record.
+func SignMissingRecord() Option {
+	return func(cfg *config) {
+		cfg.signMissingRecord = true
+	}
+}
+
+// WaitForRecord delays our Identify responses for at most the given duration
+// until the host publishes its signed peer record, when it hasn't yet. If it
+// still hasn't by then, we respond without a record, or with one signed on
+// demand if SignMissingRecord is also set.
+func WaitForRecord(max time.Duration) Option {
+	return func(cfg *config) {
+		cfg.recordWait = max
+	}
+}
+
+// WithMetricsTracer reports metrics about identify to the given tracer: round
+// trip times and failures of identifying connections, the messages we send and
+// receive, and the signed peer records we fail to consume. See
+// NewPrometheusMetrics.
+func WithMetricsTracer(mt MetricsTracer) Option {
+	return func(cfg *config) {
+		cfg.metricsTracer = mt
+	}
+}
+
+// ConnMetadata attaches the application-defined key/value pairs returned by f
+// to the Identify messages we send on each connection, e.g. to tell the remote
+// peer about capabilities negotiated for that session. f is called every time
+// we send an Identify or Identify Push message on a connection, and may return
+// nil. The remote peer reads the pairs with IDService.ConnMetadata.
+func ConnMetadata(f func(c network.Conn) map[string][]byte) Option {
+	return func(cfg *config) {
+		cfg.connMetadata = f
+	}
+}
+
+// InsecureMode adapts identify to insecure transports, which don't
+// authenticate peers: we don't send our public key, we don't reject messages
+// carrying a public key that doesn't match the peer under strict validation,
+// and key mismatches are logged at debug level instead of as errors. Keys
+// received from peers are still stored when they match their peer IDs, but
+// peers are never reported as authenticated, see IdentifySnapshot.
+func InsecureMode() Option {
+	return func(cfg *config) {
+		cfg.insecure = true
+	}
+}
+
+// KeyMismatchPolicy lets the given function decide what to do with peers that
+// send us a public key not matching their peer ID, or the key we already have
+// for them, e.g. to disconnect them and refuse their connections for a while.
+// By default, mismatches are only logged, and reported with
+// EvtPeerKeyMismatch.
+func KeyMismatchPolicy(f func(EvtPeerKeyMismatch) KeyMismatchAction) Option {
+	return func(cfg *config) {
+		cfg.keyMismatchPolicy = f
+	}
+}
+
+// WithProtocolIDs serves and dials the Identify family protocols under the
+// given protocol IDs, e.g. "/mynet/id/1.0.0", to namespace them in private
+// networks. Unset IDs keep their default, see DefaultProtocolIDs. The messages
+// exchanged don't change.
+//
+// If keepDefaults is set, the default protocol IDs are served as well, and
+// dialed when peers don't support ours, so that we interoperate with peers
+// using them.
+func WithProtocolIDs(p ProtocolIDs, keepDefaults bool) Option {
+	return func(cfg *config) {
+		p = p.withDefaults()
+		cfg.protocolIDs = &p
+		cfg.keepDefaultProtos = keepDefaults
+	}
+}
+
+// Lazy only identifies connections on demand, when IdentifyWait or one of its
+// variants is called, instead of identifying every new connection. This saves
+// hosts with many connections, like relays and bootstrappers, from exchanging
+// identify messages with peers they never open streams to. Peers still
+// identify us as usual.
+//
+// Hosts using this option only identify a connection when opening a stream for
+// protocols the peer isn't known to support, see BasicHost.NewStream.
+func Lazy() Option {
+	return func(cfg *config) {
+		cfg.lazy = true
+	}
+}
+
+// MaxObservedAddrs bounds the number of addresses peers observed us at that
+// we keep track of, e.g. to bound the memory used on constrained devices.
+// Observing a further address evicts the least recently observed one. Defaults
+// to DefaultMaxObservedAddrs.
+func MaxObservedAddrs(n int) Option {
+	return func(cfg *config) {
+		cfg.maxObservedAddrs = n
+	}
+}
+
+// WithObservedAddrOptions configures the tracking of the addresses peers
+// observe us at, e.g. to activate them with fewer observers on testnets and
+// small private networks. See ObservedAddrOptions.
+func WithObservedAddrOptions(opts ObservedAddrOptions) Option {
+	return func(cfg *config) {
+		cfg.observedAddrOpts = opts
+	}
+}
@@ -26,7 +26,18 @@ type Delta struct {
 	// new protocols now serviced by the peer.
 	AddedProtocols []string `protobuf:"bytes,1,rep,name=added_protocols,json=addedProtocols" json:"added_protocols,omitempty"`
 	// protocols dropped by the peer.
-	RmProtocols          []string `protobuf:"bytes,2,rep,name=rm_protocols,json=rmProtocols" json:"rm_protocols,omitempty"`
+	RmProtocols []string `protobuf:"bytes,2,rep,name=rm_protocols,json=rmProtocols" json:"rm_protocols,omitempty"`
+	// new listen addresses of the peer.
+	AddedAddrs [][]byte `protobuf:"bytes,3,rep,name=added_addrs,json=addedAddrs" json:"added_addrs,omitempty"`
+	// listen addresses dropped by the peer.
+	RmAddrs [][]byte `protobuf:"bytes,4,rep,name=rm_addrs,json=rmAddrs" json:"rm_addrs,omitempty"`
+	// signedPeerRecord contains the peer's new signed peer record, with a bumped
+	// seq number, when its addresses changed. Signed records can't be patched,
+	// so this always carries the full record.
+	SignedPeerRecord []byte `protobuf:"bytes,5,opt,name=signedPeerRecord" json:"signedPeerRecord,omitempty"`
+	// seq is the sequence number of the sender's state after applying this delta,
+	// see Identify.seq.
+	Seq                  *uint64  `protobuf:"varint,6,opt,name=seq" json:"seq,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -79,6 +90,89 @@ func (m *Delta) GetRmProtocols() []string {
 	return nil
 }
 
+func (m *Delta) GetAddedAddrs() [][]byte {
+	if m != nil {
+		return m.AddedAddrs
+	}
+	return nil
+}
+
+func (m *Delta) GetRmAddrs() [][]byte {
+	if m != nil {
+		return m.RmAddrs
+	}
+	return nil
+}
+
+func (m *Delta) GetSignedPeerRecord() []byte {
+	if m != nil {
+		return m.SignedPeerRecord
+	}
+	return nil
+}
+
+func (m *Delta) GetSeq() uint64 {
+	if m != nil && m.Seq != nil {
+		return *m.Seq
+	}
+	return 0
+}
+
+type MetadataEntry struct {
+	Key                  *string  `protobuf:"bytes,1,opt,name=key" json:"key,omitempty"`
+	Value                []byte   `protobuf:"bytes,2,opt,name=value" json:"value,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *MetadataEntry) Reset()         { *m = MetadataEntry{} }
+func (m *MetadataEntry) String() string { return proto.CompactTextString(m) }
+func (*MetadataEntry) ProtoMessage()    {}
+func (*MetadataEntry) Descriptor() ([]byte, []int) {
+	return fileDescriptor_83f1e7e6b485409f, []int{1}
+}
+func (m *MetadataEntry) XXX_Unmarshal(b []byte) error {
+	return m.Unmarshal(b)
+}
+func (m *MetadataEntry) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	if deterministic {
+		return xxx_messageInfo_MetadataEntry.Marshal(b, m, deterministic)
+	} else {
+		b = b[:cap(b)]
+		n, err := m.MarshalToSizedBuffer(b)
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+}
+func (m *MetadataEntry) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_MetadataEntry.Merge(m, src)
+}
+func (m *MetadataEntry) XXX_Size() int {
+	return m.Size()
+}
+func (m *MetadataEntry) XXX_DiscardUnknown() {
+	xxx_messageInfo_MetadataEntry.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_MetadataEntry proto.InternalMessageInfo
+
+func (m *MetadataEntry) GetKey() string {
+	if m != nil && m.Key != nil {
+		return *m.Key
+	}
+	return ""
+}
+
+func (m *MetadataEntry) GetValue() []byte {
+	if m != nil {
+		return m.Value
+	}
+	return nil
+}
+
 type Identify struct {
 	// protocolVersion determines compatibility between peers
 	ProtocolVersion *string `protobuf:"bytes,5,opt,name=protocolVersion" json:"protocolVersion,omitempty"`
@@ -104,7 +198,17 @@ type Identify struct {
 	// in a form that lets us share authenticated addrs with other peers.
 	// see github.com/libp2p/go-libp2p-core/record/pb/envelope.proto and
 	// github.com/libp2p/go-libp2p-core/peer/pb/peer_record.proto for message definitions.
-	SignedPeerRecord     []byte   `protobuf:"bytes,8,opt,name=signedPeerRecord" json:"signedPeerRecord,omitempty"`
+	SignedPeerRecord []byte `protobuf:"bytes,8,opt,name=signedPeerRecord" json:"signedPeerRecord,omitempty"`
+	// metadata contains arbitrary application-defined key/value pairs attached by the sender,
+	// e.g. its rack location or shard ID.
+	Metadata []*MetadataEntry `protobuf:"bytes,9,rep,name=metadata" json:"metadata,omitempty"`
+	// connMetadata contains arbitrary application-defined key/value pairs scoped to the connection
+	// the message is sent on, e.g. capabilities negotiated for this session.
+	ConnMetadata []*MetadataEntry `protobuf:"bytes,10,rep,name=connMetadata" json:"connMetadata,omitempty"`
+	// seq numbers the snapshots of the sender's state, increasing with every new snapshot. Messages
+	// may be delivered out of order, receivers use it to discard those older than the state they
+	// already have. Unset by senders that don't number their snapshots.
+	Seq                  *uint64  `protobuf:"varint,11,opt,name=seq" json:"seq,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -114,7 +218,7 @@ func (m *Identify) Reset()         { *m = Identify{} }
 func (m *Identify) String() string { return proto.CompactTextString(m) }
 func (*Identify) ProtoMessage()    {}
 func (*Identify) Descriptor() ([]byte, []int) {
-	return fileDescriptor_83f1e7e6b485409f, []int{1}
+	return fileDescriptor_83f1e7e6b485409f, []int{2}
 }
 func (m *Identify) XXX_Unmarshal(b []byte) error {
 	return m.Unmarshal(b)
@@ -199,32 +303,62 @@ func (m *Identify) GetSignedPeerRecord() []byte {
 	return nil
 }
 
+func (m *Identify) GetMetadata() []*MetadataEntry {
+	if m != nil {
+		return m.Metadata
+	}
+	return nil
+}
+
+func (m *Identify) GetConnMetadata() []*MetadataEntry {
+	if m != nil {
+		return m.ConnMetadata
+	}
+	return nil
+}
+
+func (m *Identify) GetSeq() uint64 {
+	if m != nil && m.Seq != nil {
+		return *m.Seq
+	}
+	return 0
+}
+
 func init() {
 	proto.RegisterType((*Delta)(nil), "identify.pb.Delta")
+	proto.RegisterType((*MetadataEntry)(nil), "identify.pb.MetadataEntry")
 	proto.RegisterType((*Identify)(nil), "identify.pb.Identify")
 }
 
 func init() { proto.RegisterFile("identify.proto", fileDescriptor_83f1e7e6b485409f) }
 
 var fileDescriptor_83f1e7e6b485409f = []byte{
-	// 272 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x64, 0x90, 0x41, 0x4a, 0xc3, 0x40,
-	0x14, 0x86, 0x99, 0xd6, 0x6a, 0xf3, 0x12, 0x5a, 0x99, 0xd5, 0x2c, 0x24, 0xc4, 0x6c, 0x1c, 0x5c,
-	0x64, 0xe1, 0x0d, 0x14, 0x37, 0xe2, 0xa6, 0x8c, 0xe0, 0x56, 0x92, 0xbc, 0x67, 0x19, 0x48, 0x33,
-	0x65, 0x32, 0x0a, 0xbd, 0x95, 0xc7, 0x70, 0xe9, 0x11, 0x24, 0x27, 0x91, 0x4c, 0x4d, 0x93, 0xea,
-	0x72, 0x3e, 0x3e, 0xe6, 0x7f, 0xff, 0x0f, 0x0b, 0x8d, 0x54, 0x3b, 0xfd, 0xba, 0xcb, 0xb6, 0xd6,
-	0x38, 0xc3, 0xc3, 0xe1, 0x5d, 0xa4, 0x4f, 0x30, 0xbb, 0xa7, 0xca, 0xe5, 0xfc, 0x0a, 0x96, 0x39,
-	0x22, 0xe1, 0x8b, 0x97, 0x4a, 0x53, 0x35, 0x82, 0x25, 0x53, 0x19, 0xa8, 0x85, 0xc7, 0xab, 0x9e,
-	0xf2, 0x4b, 0x88, 0xec, 0x66, 0x64, 0x4d, 0xbc, 0x15, 0xda, 0xcd, 0x41, 0x49, 0x3f, 0x26, 0x30,
-	0x7f, 0xf8, 0x0d, 0xe1, 0x12, 0x96, 0xbd, 0xfc, 0x4c, 0xb6, 0xd1, 0xa6, 0x16, 0xb3, 0x84, 0xc9,
-	0x40, 0xfd, 0xc5, 0x3c, 0x85, 0x28, 0x5f, 0x53, 0xed, 0x7a, 0xed, 0xd4, 0x6b, 0x47, 0x8c, 0x5f,
-	0x40, 0xb0, 0x7d, 0x2b, 0x2a, 0x5d, 0x3e, 0xd2, 0x4e, 0xb0, 0x84, 0xc9, 0x48, 0x0d, 0x80, 0x27,
-	0x10, 0x56, 0xba, 0x71, 0x54, 0xdf, 0x22, 0xda, 0xfd, 0x69, 0x91, 0x1a, 0xa3, 0x2e, 0xc3, 0x14,
-	0x0d, 0xd9, 0x77, 0xc2, 0x0e, 0x88, 0x13, 0xff, 0xc5, 0x11, 0xf3, 0x19, 0x87, 0x7a, 0x53, 0x5f,
-	0x6f, 0x00, 0x5c, 0xc2, 0x0c, 0xbb, 0xc5, 0xc4, 0x59, 0xc2, 0x64, 0x78, 0xc3, 0xb3, 0xd1, 0x9c,
-	0x99, 0xdf, 0x52, 0xed, 0x05, 0x7e, 0x0d, 0xe7, 0x8d, 0x5e, 0xd7, 0x84, 0x2b, 0x22, 0xab, 0xa8,
-	0x34, 0x16, 0xc5, 0xdc, 0xe7, 0xfd, 0xe3, 0x77, 0xd1, 0x67, 0x1b, 0xb3, 0xaf, 0x36, 0x66, 0xdf,
-	0x6d, 0xcc, 0x7e, 0x02, 0x00, 0x00, 0xff, 0xff, 0xc0, 0x03, 0xc8, 0x41, 0xb3, 0x01, 0x00, 0x00,
+	// 396 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x84, 0x92, 0xbf, 0xae, 0xd3, 0x30,
+	0x14, 0x87, 0xe5, 0x9b, 0xe6, 0x36, 0x39, 0x31, 0x6d, 0x65, 0x31, 0x18, 0x84, 0x8a, 0xc9, 0x82,
+	0xc5, 0xd0, 0xa1, 0x03, 0x6c, 0x48, 0x20, 0x18, 0x10, 0x42, 0xaa, 0x3c, 0xb0, 0x22, 0x37, 0x36,
+	0x55, 0x44, 0xe2, 0x14, 0xc7, 0xad, 0xd4, 0x57, 0xe3, 0x09, 0x58, 0x90, 0x78, 0x04, 0xd4, 0x27,
+	0x41, 0x71, 0x92, 0xa6, 0xe1, 0x8f, 0xee, 0x66, 0x7f, 0xe7, 0xcb, 0xb1, 0x7d, 0x7e, 0x81, 0x59,
+	0xae, 0xb4, 0x71, 0xf9, 0xe7, 0xd3, 0x6a, 0x6f, 0x2b, 0x57, 0x91, 0x64, 0xd8, 0x6f, 0xd3, 0x1f,
+	0x08, 0xc2, 0x37, 0xba, 0x70, 0x92, 0x3c, 0x85, 0xb9, 0x54, 0x4a, 0xab, 0x4f, 0xde, 0xca, 0xaa,
+	0xa2, 0xa6, 0x88, 0x05, 0x3c, 0x16, 0x33, 0x8f, 0x37, 0x3d, 0x25, 0x4f, 0x00, 0xdb, 0xf2, 0xca,
+	0xba, 0xf1, 0x56, 0x62, 0xcb, 0x41, 0x79, 0x0c, 0x49, 0xdb, 0x4b, 0x2a, 0x65, 0x6b, 0x1a, 0xb0,
+	0x80, 0x63, 0x01, 0x1e, 0xbd, 0x6a, 0x08, 0x79, 0x00, 0x91, 0x2d, 0xbb, 0xea, 0xc4, 0x57, 0xa7,
+	0xb6, 0x6c, 0x4b, 0xcf, 0x60, 0x51, 0xe7, 0x3b, 0xa3, 0xd5, 0x46, 0x6b, 0x2b, 0x74, 0x56, 0x59,
+	0x45, 0x43, 0x86, 0x38, 0x16, 0x7f, 0x71, 0xb2, 0x80, 0xa0, 0xd6, 0x5f, 0xe9, 0x2d, 0x43, 0x7c,
+	0x22, 0x9a, 0x65, 0xfa, 0x02, 0xee, 0x7d, 0xd0, 0x4e, 0x2a, 0xe9, 0xe4, 0x5b, 0xe3, 0xec, 0xa9,
+	0x51, 0xbe, 0xe8, 0x13, 0x45, 0x0c, 0xf1, 0x58, 0x34, 0x4b, 0x72, 0x1f, 0xc2, 0xa3, 0x2c, 0x0e,
+	0x9a, 0xde, 0xf8, 0xae, 0xed, 0x26, 0xfd, 0x16, 0x40, 0xf4, 0xae, 0x1b, 0x0c, 0xe1, 0x30, 0xef,
+	0xdf, 0xf7, 0x51, 0xdb, 0x3a, 0xaf, 0x8c, 0xbf, 0x42, 0x2c, 0xfe, 0xc4, 0x24, 0x05, 0x2c, 0x77,
+	0xda, 0xb8, 0x5e, 0xbb, 0xf5, 0xda, 0x88, 0x91, 0x47, 0x10, 0xef, 0x0f, 0xdb, 0x22, 0xcf, 0xde,
+	0x77, 0x17, 0xc1, 0x62, 0x00, 0x84, 0x41, 0x52, 0xe4, 0xb5, 0xd3, 0xc6, 0x3f, 0xdf, 0x4f, 0x13,
+	0x8b, 0x6b, 0xd4, 0x9c, 0x51, 0x6d, 0x6b, 0x6d, 0x8f, 0xed, 0xf4, 0xe8, 0xc4, 0xb7, 0x18, 0x31,
+	0x7f, 0xc6, 0x25, 0x91, 0xc0, 0x27, 0x32, 0x00, 0xc2, 0x21, 0x54, 0x4d, 0xc8, 0x74, 0xca, 0x10,
+	0x4f, 0xd6, 0x64, 0x75, 0xf5, 0x0b, 0xac, 0x7c, 0xfc, 0xa2, 0x15, 0xfe, 0x39, 0xfd, 0xe8, 0x3f,
+	0xd3, 0x7f, 0x0e, 0x51, 0xd9, 0xcd, 0x9a, 0xc6, 0x2c, 0xe0, 0xc9, 0xfa, 0xe1, 0xa8, 0xf1, 0x28,
+	0x08, 0x71, 0x71, 0xc9, 0x4b, 0xc0, 0x59, 0x65, 0x4c, 0x5f, 0xa6, 0x70, 0xe7, 0xb7, 0x23, 0xbf,
+	0x4f, 0x3d, 0xb9, 0xa4, 0xfe, 0x1a, 0x7f, 0x3f, 0x2f, 0xd1, 0xcf, 0xf3, 0x12, 0xfd, 0x3a, 0x2f,
+	0xd1, 0xef, 0x01, 0x00, 0x48, 0x02, 0x78, 0x6c, 0xf1, 0x02, 0x00, 0x00,
 }
 
 func (m *Delta) Marshal() (dAtA []byte, err error) {
@@ -251,6 +385,36 @@ func (m *Delta) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 		i -= len(m.XXX_unrecognized)
 		copy(dAtA[i:], m.XXX_unrecognized)
 	}
+	if m.Seq != nil {
+		i = encodeVarintIdentify(dAtA, i, uint64(*m.Seq))
+		i--
+		dAtA[i] = 0x30
+	}
+	if m.SignedPeerRecord != nil {
+		i -= len(m.SignedPeerRecord)
+		copy(dAtA[i:], m.SignedPeerRecord)
+		i = encodeVarintIdentify(dAtA, i, uint64(len(m.SignedPeerRecord)))
+		i--
+		dAtA[i] = 0x2a
+	}
+	if len(m.RmAddrs) > 0 {
+		for iNdEx := len(m.RmAddrs) - 1; iNdEx >= 0; iNdEx-- {
+			i -= len(m.RmAddrs[iNdEx])
+			copy(dAtA[i:], m.RmAddrs[iNdEx])
+			i = encodeVarintIdentify(dAtA, i, uint64(len(m.RmAddrs[iNdEx])))
+			i--
+			dAtA[i] = 0x22
+		}
+	}
+	if len(m.AddedAddrs) > 0 {
+		for iNdEx := len(m.AddedAddrs) - 1; iNdEx >= 0; iNdEx-- {
+			i -= len(m.AddedAddrs[iNdEx])
+			copy(dAtA[i:], m.AddedAddrs[iNdEx])
+			i = encodeVarintIdentify(dAtA, i, uint64(len(m.AddedAddrs[iNdEx])))
+			i--
+			dAtA[i] = 0x1a
+		}
+	}
 	if len(m.RmProtocols) > 0 {
 		for iNdEx := len(m.RmProtocols) - 1; iNdEx >= 0; iNdEx-- {
 			i -= len(m.RmProtocols[iNdEx])
@@ -272,6 +436,47 @@ func (m *Delta) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	return len(dAtA) - i, nil
 }
 
+func (m *MetadataEntry) Marshal() (dAtA []byte, err error) {
+	size := m.Size()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalToSizedBuffer(dAtA[:size])
+	if err != nil {
+		return nil, err
+	}
+	return dAtA[:n], nil
+}
+
+func (m *MetadataEntry) MarshalTo(dAtA []byte) (int, error) {
+	size := m.Size()
+	return m.MarshalToSizedBuffer(dAtA[:size])
+}
+
+func (m *MetadataEntry) MarshalToSizedBuffer(dAtA []byte) (int, error) {
+	i := len(dAtA)
+	_ = i
+	var l int
+	_ = l
+	if m.XXX_unrecognized != nil {
+		i -= len(m.XXX_unrecognized)
+		copy(dAtA[i:], m.XXX_unrecognized)
+	}
+	if m.Value != nil {
+		i -= len(m.Value)
+		copy(dAtA[i:], m.Value)
+		i = encodeVarintIdentify(dAtA, i, uint64(len(m.Value)))
+		i--
+		dAtA[i] = 0x12
+	}
+	if m.Key != nil {
+		i -= len(*m.Key)
+		copy(dAtA[i:], *m.Key)
+		i = encodeVarintIdentify(dAtA, i, uint64(len(*m.Key)))
+		i--
+		dAtA[i] = 0xa
+	}
+	return len(dAtA) - i, nil
+}
+
 func (m *Identify) Marshal() (dAtA []byte, err error) {
 	size := m.Size()
 	dAtA = make([]byte, size)
@@ -296,6 +501,39 @@ func (m *Identify) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 		i -= len(m.XXX_unrecognized)
 		copy(dAtA[i:], m.XXX_unrecognized)
 	}
+	if m.Seq != nil {
+		i = encodeVarintIdentify(dAtA, i, uint64(*m.Seq))
+		i--
+		dAtA[i] = 0x58
+	}
+	if len(m.ConnMetadata) > 0 {
+		for iNdEx := len(m.ConnMetadata) - 1; iNdEx >= 0; iNdEx-- {
+			{
+				size, err := m.ConnMetadata[iNdEx].MarshalToSizedBuffer(dAtA[:i])
+				if err != nil {
+					return 0, err
+				}
+				i -= size
+				i = encodeVarintIdentify(dAtA, i, uint64(size))
+			}
+			i--
+			dAtA[i] = 0x52
+		}
+	}
+	if len(m.Metadata) > 0 {
+		for iNdEx := len(m.Metadata) - 1; iNdEx >= 0; iNdEx-- {
+			{
+				size, err := m.Metadata[iNdEx].MarshalToSizedBuffer(dAtA[:i])
+				if err != nil {
+					return 0, err
+				}
+				i -= size
+				i = encodeVarintIdentify(dAtA, i, uint64(size))
+			}
+			i--
+			dAtA[i] = 0x4a
+		}
+	}
 	if m.SignedPeerRecord != nil {
 		i -= len(m.SignedPeerRecord)
 		copy(dAtA[i:], m.SignedPeerRecord)
@@ -393,6 +631,45 @@ func (m *Delta) Size() (n int) {
 			n += 1 + l + sovIdentify(uint64(l))
 		}
 	}
+	if len(m.AddedAddrs) > 0 {
+		for _, b := range m.AddedAddrs {
+			l = len(b)
+			n += 1 + l + sovIdentify(uint64(l))
+		}
+	}
+	if len(m.RmAddrs) > 0 {
+		for _, b := range m.RmAddrs {
+			l = len(b)
+			n += 1 + l + sovIdentify(uint64(l))
+		}
+	}
+	if m.SignedPeerRecord != nil {
+		l = len(m.SignedPeerRecord)
+		n += 1 + l + sovIdentify(uint64(l))
+	}
+	if m.Seq != nil {
+		n += 1 + sovIdentify(uint64(*m.Seq))
+	}
+	if m.XXX_unrecognized != nil {
+		n += len(m.XXX_unrecognized)
+	}
+	return n
+}
+
+func (m *MetadataEntry) Size() (n int) {
+	if m == nil {
+		return 0
+	}
+	var l int
+	_ = l
+	if m.Key != nil {
+		l = len(*m.Key)
+		n += 1 + l + sovIdentify(uint64(l))
+	}
+	if m.Value != nil {
+		l = len(m.Value)
+		n += 1 + l + sovIdentify(uint64(l))
+	}
 	if m.XXX_unrecognized != nil {
 		n += len(m.XXX_unrecognized)
 	}
@@ -441,6 +718,21 @@ func (m *Identify) Size() (n int) {
 		l = len(m.SignedPeerRecord)
 		n += 1 + l + sovIdentify(uint64(l))
 	}
+	if len(m.Metadata) > 0 {
+		for _, e := range m.Metadata {
+			l = e.Size()
+			n += 1 + l + sovIdentify(uint64(l))
+		}
+	}
+	if len(m.ConnMetadata) > 0 {
+		for _, e := range m.ConnMetadata {
+			l = e.Size()
+			n += 1 + l + sovIdentify(uint64(l))
+		}
+	}
+	if m.Seq != nil {
+		n += 1 + sovIdentify(uint64(*m.Seq))
+	}
 	if m.XXX_unrecognized != nil {
 		n += len(m.XXX_unrecognized)
 	}
@@ -546,6 +838,242 @@ func (m *Delta) Unmarshal(dAtA []byte) error {
 			}
 			m.RmProtocols = append(m.RmProtocols, string(dAtA[iNdEx:postIndex]))
 			iNdEx = postIndex
+		case 3:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field AddedAddrs", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowIdentify
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthIdentify
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthIdentify
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.AddedAddrs = append(m.AddedAddrs, make([]byte, postIndex-iNdEx))
+			copy(m.AddedAddrs[len(m.AddedAddrs)-1], dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 4:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field RmAddrs", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowIdentify
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthIdentify
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthIdentify
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.RmAddrs = append(m.RmAddrs, make([]byte, postIndex-iNdEx))
+			copy(m.RmAddrs[len(m.RmAddrs)-1], dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 5:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field SignedPeerRecord", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowIdentify
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthIdentify
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthIdentify
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.SignedPeerRecord = append(m.SignedPeerRecord[:0], dAtA[iNdEx:postIndex]...)
+			if m.SignedPeerRecord == nil {
+				m.SignedPeerRecord = []byte{}
+			}
+			iNdEx = postIndex
+		case 6:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Seq", wireType)
+			}
+			var v uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowIdentify
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				v |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.Seq = &v
+		default:
+			iNdEx = preIndex
+			skippy, err := skipIdentify(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if (skippy < 0) || (iNdEx+skippy) < 0 {
+				return ErrInvalidLengthIdentify
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.XXX_unrecognized = append(m.XXX_unrecognized, dAtA[iNdEx:iNdEx+skippy]...)
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+func (m *MetadataEntry) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowIdentify
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= uint64(b&0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: MetadataEntry: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: MetadataEntry: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Key", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowIdentify
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthIdentify
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthIdentify
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			s := string(dAtA[iNdEx:postIndex])
+			m.Key = &s
+			iNdEx = postIndex
+		case 2:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Value", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowIdentify
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthIdentify
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthIdentify
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Value = append(m.Value[:0], dAtA[iNdEx:postIndex]...)
+			if m.Value == nil {
+				m.Value = []byte{}
+			}
+			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
 			skippy, err := skipIdentify(dAtA[iNdEx:])
@@ -865,6 +1393,94 @@ func (m *Identify) Unmarshal(dAtA []byte) error {
 				m.SignedPeerRecord = []byte{}
 			}
 			iNdEx = postIndex
+		case 9:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Metadata", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowIdentify
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthIdentify
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthIdentify
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Metadata = append(m.Metadata, &MetadataEntry{})
+			if err := m.Metadata[len(m.Metadata)-1].Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		case 10:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field ConnMetadata", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowIdentify
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthIdentify
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthIdentify
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.ConnMetadata = append(m.ConnMetadata, &MetadataEntry{})
+			if err := m.ConnMetadata[len(m.ConnMetadata)-1].Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		case 11:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Seq", wireType)
+			}
+			var v uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowIdentify
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				v |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.Seq = &v
 		default:
 			iNdEx = preIndex
 			skippy, err := skipIdentify(dAtA[iNdEx:])
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/libp2p/go-libp2p-core/network"
@@ -21,9 +22,12 @@ import (
 var errProtocolNotSupported = errors.New("protocol not supported")
 
 type identifySnapshot struct {
+	// seq orders the snapshots, see acceptSnapshot.
+	seq       uint64
 	protocols []string
 	addrs     []ma.Multiaddr
 	record    *record.Envelope
+	metadata  map[string][]byte
 }
 
 type peerHandler struct {
@@ -38,6 +42,9 @@ type peerHandler struct {
 
 	pushCh  chan struct{}
 	deltaCh chan struct{}
+	// re-pushes a stale signed peer record, see the RefreshSignedRecord
+	// option.
+	refreshCh chan struct{}
 }
 
 func newPeerHandler(pid peer.ID, ids *IDService) *peerHandler {
@@ -47,8 +54,9 @@ func newPeerHandler(pid peer.ID, ids *IDService) *peerHandler {
 
 		snapshot: ids.getSnapshot(),
 
-		pushCh:  make(chan struct{}, 1),
-		deltaCh: make(chan struct{}, 1),
+		pushCh:    make(chan struct{}, 1),
+		deltaCh:   make(chan struct{}, 1),
+		refreshCh: make(chan struct{}, 1),
 	}
 
 	return ph
@@ -86,18 +94,89 @@ func (ph *peerHandler) stop() error {
 func (ph *peerHandler) loop(ctx context.Context, onExit func()) {
 	defer onExit()
 
+	// failed updates are retried by re-triggering them on retryCh once the
+	// retry timer fires. Any update triggered in the meantime is coalesced
+	// with the retry, as every update sends our latest state.
+	var (
+		retryTimer *time.Timer
+		retryC     <-chan time.Time
+		retryCh    chan struct{}
+		attempts   int
+	)
+	defer func() {
+		if retryTimer != nil {
+			retryTimer.Stop()
+		}
+	}()
+
+	onResult := func(op string, err error, ch chan struct{}) {
+		ph.ids.peerError(ph.pid, op, err)
+		if err == nil {
+			attempts = 0
+			return
+		}
+		atomic.AddUint64(&ph.ids.updateStats.failed, 1)
+		if ph.ids.retryInterval <= 0 || ctx.Err() != nil {
+			return
+		}
+		if attempts >= ph.ids.retryMaxAttempts {
+			log.Debugw("giving up on sending identify update", "peer", ph.pid, "attempts", attempts)
+			attempts = 0
+			return
+		}
+		// a push sends the full state, so it also covers a pending delta.
+		if retryC != nil {
+			if ch == ph.pushCh {
+				retryCh = ch
+			}
+			return
+		}
+		attempts++
+		retryCh = ch
+		backoff := ph.ids.retryInterval << (attempts - 1)
+		if retryTimer == nil {
+			retryTimer = time.NewTimer(backoff)
+		} else {
+			retryTimer.Reset(backoff)
+		}
+		retryC = retryTimer.C
+	}
+
 	for {
 		select {
 		// our listen addresses have changed, send an IDPush.
 		case <-ph.pushCh:
-			if err := ph.sendPush(ctx); err != nil {
+			err := ph.sendAddrs(ctx)
+			if err != nil {
 				log.Warnw("failed to send Identify Push", "peer", ph.pid, "error", err)
 			}
+			onResult("push", err, ph.pushCh)
+
+		case <-ph.refreshCh:
+			err := ph.sendPush(ctx)
+			if err != nil {
+				atomic.AddUint64(&ph.ids.refreshStats.failed, 1)
+				log.Warnw("failed to refresh signed peer record", "peer", ph.pid, "error", err)
+			} else {
+				atomic.AddUint64(&ph.ids.refreshStats.succeeded, 1)
+			}
+			onResult("refresh", err, ph.pushCh)
 
 		case <-ph.deltaCh:
-			if err := ph.sendDelta(ctx); err != nil {
+			err := ph.sendDelta(ctx)
+			if err != nil {
 				log.Warnw("failed to send Identify Delta", "peer", ph.pid, "error", err)
 			}
+			onResult("delta", err, ph.deltaCh)
+
+		case <-retryC:
+			retryC = nil
+			atomic.AddUint64(&ph.ids.updateStats.retried, 1)
+			select {
+			case retryCh <- struct{}{}:
+			default:
+				// an update is already pending.
+			}
 
 		case <-ctx.Done():
 			return
@@ -107,7 +186,11 @@ func (ph *peerHandler) loop(ctx context.Context, onExit func()) {
 
 func (ph *peerHandler) sendDelta(ctx context.Context) error {
 	// send a push if the peer does not support the Delta protocol.
-	if !ph.peerSupportsProtos(ctx, []string{IDDelta}) {
+	if !ph.peerSupportsProtos(ctx, ph.ids.deltaProtocols()) {
+		if ph.ids.disablePush {
+			log.Debugw("not sending delta as peer does not support it and push is disabled", "peer", ph.pid)
+			return nil
+		}
 		log.Debugw("will send push as peer does not support delta", "peer", ph.pid)
 		if err := ph.sendPush(ctx); err != nil {
 			return fmt.Errorf("failed to send push on delta message: %w", err)
@@ -116,23 +199,93 @@ func (ph *peerHandler) sendDelta(ctx context.Context) error {
 	}
 
 	// extract a delta message, updating the last state.
+	ph.snapshotMu.RLock()
+	prev := ph.snapshot
+	ph.snapshotMu.RUnlock()
 	mes := ph.nextDelta()
 	if mes == nil || (len(mes.AddedProtocols) == 0 && len(mes.RmProtocols) == 0) {
 		return nil
 	}
+	return ph.writeDelta(ctx, ph.ids.deltaProtocols(), prev, mes, nil, nil)
+}
+
+// sendAddrs sends the changes of our addresses to the peer: as a delta if
+// enabled and the peer supports it, see the AddrDeltas option, as a push
+// otherwise.
+func (ph *peerHandler) sendAddrs(ctx context.Context) error {
+	if !ph.ids.addrDeltas || !ph.peerSupportsProtos(ctx, ph.ids.deltaAddrsProtocols()) {
+		return ph.sendPush(ctx)
+	}
+
+	curr := ph.ids.getSnapshot()
+	ph.snapshotMu.Lock()
+	prev := ph.snapshot
+	ph.snapshot = curr
+	ph.snapshotMu.Unlock()
+
+	added, removed := diffStrings(prev.protocols, curr.protocols)
+	mes := &pb.Delta{AddedProtocols: added, RmProtocols: removed, Seq: &curr.seq}
+	addedAddrs, removedAddrs := diffAddrs(prev.addrs, curr.addrs)
+	prevSeq, _ := recordSeq(prev.record)
+	if currSeq, ok := recordSeq(curr.record); ok && currSeq != prevSeq {
+		mes.SignedPeerRecord = ph.ids.getSignedRecord(curr)
+	}
+	if len(added) == 0 && len(removed) == 0 && len(addedAddrs) == 0 && len(removedAddrs) == 0 && mes.SignedPeerRecord == nil {
+		return nil
+	}
+
+	if err := ph.writeDelta(ctx, ph.ids.deltaAddrsProtocols(), prev, mes, addedAddrs, removedAddrs); err != nil {
+		return err
+	}
+	if mes.SignedPeerRecord != nil {
+		ph.ids.recordSent(ph.pid, curr)
+	}
+	return nil
+}
+
+// writeDelta sends a delta message on the first of the given protocols the
+// peer supports, adding the given listen address changes. If we fail to send
+// it, the peer's snapshot is rolled back to prev, the last state the peer knows
+// about, so that the next delta includes these changes.
+func (ph *peerHandler) writeDelta(ctx context.Context, protos []string, prev *identifySnapshot, mes *pb.Delta, added, removed []ma.Multiaddr) error {
+	rollback := func() {
+		ph.snapshotMu.Lock()
+		ph.snapshot = prev
+		ph.snapshotMu.Unlock()
+	}
+	withAddrs := func(c network.Conn) *pb.Identify {
+		if len(added) > 0 || len(removed) > 0 {
+			mes.AddedAddrs = advertisedAddrs(c, added)
+			mes.RmAddrs = advertisedAddrs(c, removed)
+		}
+		return &pb.Identify{Delta: mes}
+	}
+
+	if ms := ph.ids.muxStreamTo(ph.pid); ms != nil {
+		err := ph.ids.muxSend(ms, frameDelta, withAddrs(ms.s.Conn()))
+		if err == nil {
+			return nil
+		}
+		log.Debugw("failed to send delta over existing stream, opening a new one", "peer", ph.pid, "error", err)
+	}
 
-	ds, err := ph.openStream(ctx, []string{IDDelta})
+	ds, err := ph.openStream(ctx, protos)
 	if err != nil {
+		rollback()
 		return fmt.Errorf("failed to open delta stream: %w", err)
 	}
 
 	defer ds.Close()
 
 	c := ds.Conn()
-	if err := protoio.NewDelimitedWriter(ds).WriteMsg(&pb.Identify{Delta: mes}); err != nil {
+	_ = ds.SetWriteDeadline(time.Now().Add(ph.ids.streamTimeout()))
+	dmes := withAddrs(c)
+	if err := protoio.NewDelimitedWriter(ds).WriteMsg(dmes); err != nil {
 		_ = ds.Reset()
+		rollback()
 		return fmt.Errorf("failed to send delta message, %w", err)
 	}
+	ph.ids.messageSent(ds.Protocol(), dmes)
 	log.Debugw("sent identify update", "protocol", ds.Protocol(), "peer", c.RemotePeer(),
 		"peer address", c.RemoteMultiaddr())
 
@@ -140,7 +293,23 @@ func (ph *peerHandler) sendDelta(ctx context.Context) error {
 }
 
 func (ph *peerHandler) sendPush(ctx context.Context) error {
-	dp, err := ph.openStream(ctx, []string{IDPush})
+	if ms := ph.ids.muxStreamTo(ph.pid); ms != nil {
+		snapshot := ph.ids.getSnapshot()
+		ph.snapshotMu.Lock()
+		ph.snapshot = snapshot
+		ph.snapshotMu.Unlock()
+
+		mes := ph.ids.createBaseIdentifyResponse(ms.s.Conn(), snapshot)
+		mes.SignedPeerRecord = ph.ids.getSignedRecord(snapshot)
+		err := ph.ids.muxSend(ms, framePush, mes)
+		if err == nil {
+			ph.ids.recordSent(ph.pid, snapshot)
+			return nil
+		}
+		log.Debugw("failed to send push over existing stream, opening a new one", "peer", ph.pid, "error", err)
+	}
+
+	dp, err := ph.openStream(ctx, ph.ids.pushProtocols())
 	if err == errProtocolNotSupported {
 		log.Debugw("not sending push as peer does not support protocol", "peer", ph.pid)
 		return nil
@@ -149,6 +318,7 @@ func (ph *peerHandler) sendPush(ctx context.Context) error {
 		return fmt.Errorf("failed to open push stream: %w", err)
 	}
 	defer dp.Close()
+	_ = dp.SetWriteDeadline(time.Now().Add(ph.ids.streamTimeout()))
 
 	snapshot := ph.ids.getSnapshot()
 	ph.snapshotMu.Lock()
@@ -158,6 +328,7 @@ func (ph *peerHandler) sendPush(ctx context.Context) error {
 		_ = dp.Reset()
 		return fmt.Errorf("failed to send push message: %w", err)
 	}
+	ph.ids.recordSent(ph.pid, snapshot)
 
 	return nil
 }
@@ -214,7 +385,10 @@ func (ph *peerHandler) peerSupportsProtos(ctx context.Context, protos []string)
 }
 
 func (ph *peerHandler) nextDelta() *pb.Delta {
-	curr := ph.ids.Host.Mux().Protocols()
+	ph.ids.snapshotSeqMu.Lock()
+	curr := ph.ids.localProtocols()
+	seq := ph.ids.newSnapshotSeq()
+	ph.ids.snapshotSeqMu.Unlock()
 
 	// Extract the old protocol list and replace the old snapshot with an
 	// updated one.
@@ -222,39 +396,60 @@ func (ph *peerHandler) nextDelta() *pb.Delta {
 	snapshot := *ph.snapshot
 	old := snapshot.protocols
 	snapshot.protocols = curr
+	snapshot.seq = seq
 	ph.snapshot = &snapshot
 	ph.snapshotMu.Unlock()
 
-	oldProtos := make(map[string]struct{}, len(old))
-	currProtos := make(map[string]struct{}, len(curr))
-
-	for _, proto := range old {
-		oldProtos[proto] = struct{}{}
+	added, removed := diffStrings(old, curr)
+	return &pb.Delta{
+		AddedProtocols: added,
+		RmProtocols:    removed,
+		Seq:            &seq,
 	}
+}
+
+// diffStrings returns the strings of curr missing from old, and those of old
+// missing from curr.
+func diffStrings(old, curr []string) (added, removed []string) {
+	oldSet := make(map[string]struct{}, len(old))
+	currSet := make(map[string]struct{}, len(curr))
 
-	for _, proto := range curr {
-		currProtos[proto] = struct{}{}
+	for _, s := range old {
+		oldSet[s] = struct{}{}
 	}
 
-	var added []string
-	var removed []string
+	for _, s := range curr {
+		currSet[s] = struct{}{}
+	}
 
 	// has it been added ?
-	for p := range currProtos {
-		if _, ok := oldProtos[p]; !ok {
-			added = append(added, p)
+	for s := range currSet {
+		if _, ok := oldSet[s]; !ok {
+			added = append(added, s)
 		}
 	}
 
 	// has it been removed ?
-	for p := range oldProtos {
-		if _, ok := currProtos[p]; !ok {
-			removed = append(removed, p)
+	for s := range oldSet {
+		if _, ok := currSet[s]; !ok {
+			removed = append(removed, s)
 		}
 	}
+	return added, removed
+}
 
-	return &pb.Delta{
-		AddedProtocols: added,
-		RmProtocols:    removed,
+// diffAddrs returns the addresses of curr missing from old, and those of old
+// missing from curr.
+func diffAddrs(old, curr []ma.Multiaddr) (added, removed []ma.Multiaddr) {
+	for _, a := range curr {
+		if !addrInAddrs(a, old) {
+			added = append(added, a)
+		}
+	}
+	for _, a := range old {
+		if !addrInAddrs(a, curr) {
+			removed = append(removed, a)
+		}
 	}
+	return added, removed
 }
@@ -7,6 +7,7 @@ import (
 
 	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/test"
 
 	blhost "github.com/libp2p/go-libp2p-blankhost"
 	swarmt "github.com/libp2p/go-libp2p-swarm/testing"
@@ -108,3 +109,32 @@ func TestPeerSupportsProto(t *testing.T) {
 	require.NoError(t, h1.Peerstore().RemoveProtocols(rp, "test"))
 	require.False(t, ph.peerSupportsProtos(ctx, []string{"test"}))
 }
+
+func TestHandlerRetriesFailedUpdates(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1 := blhost.NewBlankHost(swarmt.GenSwarm(t, ctx))
+	defer h1.Close()
+	ids1, err := NewIDService(h1, RetryUpdates(10*time.Millisecond, 2))
+	require.NoError(t, err)
+	defer ids1.Close()
+
+	// we're not connected to this peer, so sending it anything fails.
+	p, err := test.RandPeerID()
+	require.NoError(t, err)
+	require.NoError(t, h1.Peerstore().AddProtocols(p, IDPush))
+
+	ph := newPeerHandler(p, ids1)
+	ph.start(ctx, func() {})
+	defer ph.stop()
+
+	ph.pushCh <- struct{}{}
+	require.Eventually(t, func() bool {
+		return ids1.UpdateStats() == UpdateStats{Failed: 3, Retried: 2}
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// we give up after the configured number of attempts.
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, UpdateStats{Failed: 3, Retried: 2}, ids1.UpdateStats())
+}
@@ -0,0 +1,99 @@
+package identify
+
+import (
+	"github.com/libp2p/go-libp2p-core/protocol"
+)
+
+// ProtocolIDs are the protocol IDs the Identify family protocols are served
+// and dialed with.
+type ProtocolIDs struct {
+	ID         protocol.ID
+	Push       protocol.ID
+	Delta      protocol.ID
+	DeltaAddrs protocol.ID
+	Mux        protocol.ID
+}
+
+// DefaultProtocolIDs are the protocol IDs used by all libp2p implementations.
+var DefaultProtocolIDs = ProtocolIDs{
+	ID:         ID,
+	Push:       IDPush,
+	Delta:      IDDelta,
+	DeltaAddrs: IDDeltaAddrs,
+	Mux:        IDMux,
+}
+
+// withDefaults returns p with its unset IDs set to their default.
+func (p ProtocolIDs) withDefaults() ProtocolIDs {
+	d := DefaultProtocolIDs
+	if p.ID != "" {
+		d.ID = p.ID
+	}
+	if p.Push != "" {
+		d.Push = p.Push
+	}
+	if p.Delta != "" {
+		d.Delta = p.Delta
+	}
+	if p.DeltaAddrs != "" {
+		d.DeltaAddrs = p.DeltaAddrs
+	}
+	if p.Mux != "" {
+		d.Mux = p.Mux
+	}
+	return d
+}
+
+// protocolIDs returns the IDs of the protocol selected by f in each of our
+// protocol ID sets, most preferred first.
+func (ids *IDService) protocolIDs(f func(ProtocolIDs) protocol.ID) []string {
+	out := make([]string, 0, len(ids.protocols))
+	for _, p := range ids.protocols {
+		id := string(f(p))
+		if !containsString(out, id) {
+			out = append(out, id)
+		}
+	}
+	return out
+}
+
+func (ids *IDService) idProtocols() []string {
+	return ids.protocolIDs(func(p ProtocolIDs) protocol.ID { return p.ID })
+}
+
+func (ids *IDService) pushProtocols() []string {
+	return ids.protocolIDs(func(p ProtocolIDs) protocol.ID { return p.Push })
+}
+
+func (ids *IDService) deltaProtocols() []string {
+	return ids.protocolIDs(func(p ProtocolIDs) protocol.ID { return p.Delta })
+}
+
+func (ids *IDService) deltaAddrsProtocols() []string {
+	return ids.protocolIDs(func(p ProtocolIDs) protocol.ID { return p.DeltaAddrs })
+}
+
+func (ids *IDService) muxProtocols() []string {
+	return ids.protocolIDs(func(p ProtocolIDs) protocol.ID { return p.Mux })
+}
+
+// IsIdentifyProtocol returns true if p is one of the Identify family protocols
+// the service serves, see the WithProtocolIDs option.
+func (ids *IDService) IsIdentifyProtocol(p protocol.ID) bool {
+	for _, set := range ids.protocols {
+		switch p {
+		case set.ID, set.Push, set.Delta, set.DeltaAddrs, set.Mux:
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(ss []string, s string) bool {
+	for _, x := range ss {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
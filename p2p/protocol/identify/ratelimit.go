@@ -0,0 +1,86 @@
+package identify
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// maxRateLimitedPeers bounds the number of peers whose requests we count in
+// each interval, so that a flood of requests from fresh peer IDs can't grow
+// the rate limiter without bound. Beyond it, the peer that sent a request the
+// longest ago is forgotten.
+const maxRateLimitedPeers = 4096
+
+// rateLimiter limits the number of inbound Identify family requests we serve
+// per interval, both globally and per peer.
+type rateLimiter struct {
+	globalLimit int
+	peerLimit   int
+	interval    time.Duration
+	maxPeers    int
+
+	mu          sync.Mutex
+	windowStart time.Time
+	globalReqs  int
+	// reqs indexes the elements of lru, which holds the *peerReqs of the
+	// peers that sent requests in the current interval, most recent first.
+	reqs map[peer.ID]*list.Element
+	lru  *list.List
+}
+
+type peerReqs struct {
+	p peer.ID
+	n int
+}
+
+func newRateLimiter(globalLimit, peerLimit int, interval time.Duration) *rateLimiter {
+	return &rateLimiter{
+		globalLimit: globalLimit,
+		peerLimit:   peerLimit,
+		interval:    interval,
+		maxPeers:    maxRateLimitedPeers,
+		reqs:        make(map[peer.ID]*list.Element),
+		lru:         list.New(),
+	}
+}
+
+// allow records a request from the given peer, returning false if the request
+// exceeds either limit.
+func (rl *rateLimiter) allow(p peer.ID) bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if now := time.Now(); now.Sub(rl.windowStart) >= rl.interval {
+		rl.windowStart = now
+		rl.globalReqs = 0
+		rl.reqs = make(map[peer.ID]*list.Element)
+		rl.lru.Init()
+	}
+
+	if rl.globalLimit > 0 && rl.globalReqs >= rl.globalLimit {
+		return false
+	}
+	if rl.peerLimit > 0 {
+		e, ok := rl.reqs[p]
+		if ok {
+			if e.Value.(*peerReqs).n >= rl.peerLimit {
+				return false
+			}
+			rl.lru.MoveToFront(e)
+		} else {
+			if rl.lru.Len() >= rl.maxPeers {
+				oldest := rl.lru.Back()
+				rl.lru.Remove(oldest)
+				delete(rl.reqs, oldest.Value.(*peerReqs).p)
+			}
+			e = rl.lru.PushFront(&peerReqs{p: p})
+			rl.reqs[p] = e
+		}
+		e.Value.(*peerReqs).n++
+	}
+	rl.globalReqs++
+	return true
+}
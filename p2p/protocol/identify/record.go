@@ -0,0 +1,57 @@
+package identify
+
+import (
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/libp2p/go-libp2p-core/record"
+)
+
+// recordPollInterval is how often we check whether the host published its
+// signed peer record, see the WaitForRecord option.
+const recordPollInterval = 10 * time.Millisecond
+
+// hostRecord returns the host's signed peer record from the peerstore. If the
+// host hasn't published one yet, we sign one on demand when the
+// SignMissingRecord option is set, and return nil otherwise.
+func (ids *IDService) hostRecord(cab peerstore.CertifiedAddrBook, snapshot *identifySnapshot) *record.Envelope {
+	if rec := cab.GetPeerRecord(ids.Host.ID()); rec != nil {
+		return rec
+	}
+	if !ids.signMissingRecord {
+		log.Debugw("sending identify without a signed peer record: none published yet")
+		return nil
+	}
+	log.Debugw("signing a peer record on demand: none published yet")
+	return ids.signedRecordFor(snapshot.addrs)
+}
+
+// waitForRecord waits until the host publishes its signed peer record, for at
+// most the duration set with the WaitForRecord option.
+func (ids *IDService) waitForRecord() {
+	if ids.recordWait <= 0 || ids.disableSignedPeerRecord || ids.addrsFactory != nil {
+		return
+	}
+	cab, ok := peerstore.GetCertifiedAddrBook(ids.Host.Peerstore())
+	if !ok || cab.GetPeerRecord(ids.Host.ID()) != nil {
+		return
+	}
+
+	timeout := time.NewTimer(ids.recordWait)
+	defer timeout.Stop()
+	ticker := time.NewTicker(recordPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if cab.GetPeerRecord(ids.Host.ID()) != nil {
+				return
+			}
+		case <-timeout.C:
+			log.Debugw("host didn't publish its signed peer record in time", "waited", ids.recordWait)
+			return
+		case <-ids.ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package identify
+
+import (
+	"sync/atomic"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/record"
+)
+
+// sentRecordSeqKey is the peerstore metadata key holding the sequence number
+// of the last signed peer record we sent to a peer.
+const sentRecordSeqKey = "IdentifySentRecordSeq"
+
+// RecordRefreshStats counts the pushes of our signed peer record to peers that
+// reconnected with a stale one, see the RefreshSignedRecord option.
+type RecordRefreshStats struct {
+	// Scheduled is the number of peers we found to have a stale record when
+	// they reconnected.
+	Scheduled uint64
+	// Succeeded is the number of refresh pushes we sent.
+	Succeeded uint64
+	// Failed is the number of refresh pushes we failed to send. These are
+	// retried like other pushes, see the RetryUpdates option.
+	Failed uint64
+}
+
+// RecordRefreshStats returns statistics about the refreshes of our signed peer
+// record.
+func (ids *IDService) RecordRefreshStats() RecordRefreshStats {
+	return RecordRefreshStats{
+		Scheduled: atomic.LoadUint64(&ids.refreshStats.scheduled),
+		Succeeded: atomic.LoadUint64(&ids.refreshStats.succeeded),
+		Failed:    atomic.LoadUint64(&ids.refreshStats.failed),
+	}
+}
+
+func recordSeq(env *record.Envelope) (uint64, bool) {
+	if env == nil {
+		return 0, false
+	}
+	rec, err := env.Record()
+	if err != nil {
+		return 0, false
+	}
+	pr, ok := rec.(*peer.PeerRecord)
+	if !ok {
+		return 0, false
+	}
+	return pr.Seq, true
+}
+
+// sentRecordSeq returns the sequence number of the last signed peer record we
+// sent to the given peer.
+func (ids *IDService) sentRecordSeq(p peer.ID) (uint64, bool) {
+	v, err := ids.Host.Peerstore().Get(p, sentRecordSeqKey)
+	if err != nil {
+		return 0, false
+	}
+	seq, ok := v.(uint64)
+	return seq, ok
+}
+
+// recordSent records that we sent the signed peer record of the given snapshot
+// to the given peer.
+func (ids *IDService) recordSent(p peer.ID, snapshot *identifySnapshot) {
+	if !ids.refreshRecord {
+		return
+	}
+	seq, ok := recordSeq(snapshot.record)
+	if !ok {
+		return
+	}
+	ids.sentSeqMu.Lock()
+	defer ids.sentSeqMu.Unlock()
+	// messages may complete out of order, keep the newest record.
+	if prev, ok := ids.sentRecordSeq(p); ok && prev >= seq {
+		return
+	}
+	if err := ids.Host.Peerstore().Put(p, sentRecordSeqKey, seq); err != nil {
+		log.Debugw("failed to store sent record sequence number", "peer", p, "error", err)
+	}
+}
+
+// maybeRefreshRecord pushes our current signed peer record to the given peer,
+// which we just identified, if the last record we sent it is stale. Peers we
+// never sent a record to get our current one when they identify us.
+func (ids *IDService) maybeRefreshRecord(p peer.ID) {
+	if !ids.refreshRecord {
+		return
+	}
+	sent, ok := ids.sentRecordSeq(p)
+	if !ok {
+		return
+	}
+	curr, ok := recordSeq(ids.getSnapshot().record)
+	if !ok || curr <= sent {
+		return
+	}
+	if sup, err := ids.Host.Peerstore().SupportsProtocols(p, ids.pushProtocols()...); err != nil || len(sup) == 0 {
+		return
+	}
+
+	ph, err := ids.peerHandler(p)
+	if err != nil {
+		return
+	}
+	log.Debugw("refreshing stale signed peer record", "peer", p, "sent", sent, "current", curr)
+	select {
+	case ph.refreshCh <- struct{}{}:
+		atomic.AddUint64(&ids.refreshStats.scheduled, 1)
+	default:
+		// a refresh is already pending.
+	}
+}
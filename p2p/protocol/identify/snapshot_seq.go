@@ -0,0 +1,74 @@
+package identify
+
+import (
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// Identify messages carry the sequence number of the snapshot of our state
+// they were built from. Responses, pushes and deltas are sent on distinct
+// streams, and may be delivered out of order: a response built from an old
+// snapshot may arrive after a push built from a newer one. Peers use the
+// sequence numbers to discard the messages older than the state they have.
+
+// peerSnapshotSeq tracks the sequence numbers of the snapshots a peer sent us.
+type peerSnapshotSeq struct {
+	// latest is the highest sequence number we applied, of a full message or
+	// a delta.
+	latest uint64
+	// full is the highest sequence number of a full message we applied.
+	full uint64
+}
+
+// newSnapshotSeq returns the sequence number of a new snapshot of our state.
+// The snapshot's state must be captured with snapshotSeqMu held, so that
+// sequence numbers follow the order the state was captured in.
+func (ids *IDService) newSnapshotSeq() uint64 {
+	ids.snapshotSeq++
+	return ids.snapshotSeq
+}
+
+// acceptSnapshot reports whether a message with the given sequence number,
+// carrying the peer's full state or a delta, is at least as recent as the
+// state we have for the peer, and records it if so.
+//
+// A full message is stale if we applied anything newer, as it would revert
+// it. A delta is only stale if we applied a newer full message, which already
+// includes its changes: deltas may arrive out of order among themselves, and
+// still apply. Messages of peers that don't number their snapshots are never
+// stale.
+func (ids *IDService) acceptSnapshot(p peer.ID, seq uint64, full bool) bool {
+	if seq == 0 {
+		return true
+	}
+	ids.peerSeqMu.Lock()
+	defer ids.peerSeqMu.Unlock()
+	prev := ids.peerSeqs[p]
+	if (full && seq < prev.latest) || (!full && seq < prev.full) {
+		return false
+	}
+	if seq > prev.latest {
+		prev.latest = seq
+	}
+	if full && seq > prev.full {
+		prev.full = seq
+	}
+	ids.peerSeqs[p] = prev
+	return true
+}
+
+// peerSnapshotSeq returns the sequence number of the latest state the peer
+// sent us, 0 if none.
+func (ids *IDService) peerSnapshotSeq(p peer.ID) uint64 {
+	ids.peerSeqMu.Lock()
+	defer ids.peerSeqMu.Unlock()
+	return ids.peerSeqs[p].latest
+}
+
+// forgetSnapshotSeq drops the sequence numbers of the given peer, once we're
+// disconnected from it: it numbers its snapshots from scratch when it
+// restarts.
+func (ids *IDService) forgetSnapshotSeq(p peer.ID) {
+	ids.peerSeqMu.Lock()
+	delete(ids.peerSeqs, p)
+	ids.peerSeqMu.Unlock()
+}
@@ -0,0 +1,149 @@
+// Package useragent parses the agent versions peers identify themselves with,
+// like "go-ipfs/0.8.0/48f94e2" or "rust-libp2p/0.30.0", into the name of their
+// implementation and its semantic version, so that peers can be classified by
+// implementation and release.
+package useragent
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Version is a semantic version. Missing minor and patch numbers are 0.
+type Version struct {
+	Major, Minor, Patch int
+	// Prerelease is the pre-release part of the version, e.g. "rc1" for
+	// 0.9.0-rc1, if any. Build metadata is dropped.
+	Prerelease string
+}
+
+func (v Version) String() string {
+	s := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if v.Prerelease != "" {
+		s += "-" + v.Prerelease
+	}
+	return s
+}
+
+// Less reports whether v precedes w. Pre-releases precede their release, and
+// are otherwise ordered lexically.
+func (v Version) Less(w Version) bool {
+	switch {
+	case v.Major != w.Major:
+		return v.Major < w.Major
+	case v.Minor != w.Minor:
+		return v.Minor < w.Minor
+	case v.Patch != w.Patch:
+		return v.Patch < w.Patch
+	case v.Prerelease == "" || w.Prerelease == "":
+		return v.Prerelease != "" && w.Prerelease == ""
+	default:
+		return v.Prerelease < w.Prerelease
+	}
+}
+
+// ParseVersion parses a semantic version like "1.2.3", "v1.2" or
+// "0.9.0-rc1+build". It returns false if s isn't a version.
+func ParseVersion(s string) (Version, bool) {
+	var v Version
+	s = strings.TrimPrefix(s, "v")
+	if i := strings.IndexByte(s, '+'); i >= 0 {
+		s = s[:i]
+	}
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		s, v.Prerelease = s[:i], s[i+1:]
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) > 3 {
+		return Version{}, false
+	}
+	nums := []*int{&v.Major, &v.Minor, &v.Patch}
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return Version{}, false
+		}
+		*nums[i] = n
+	}
+	return v, true
+}
+
+// UserAgent is a parsed agent version.
+type UserAgent struct {
+	// Raw is the agent version as sent by the peer.
+	Raw string
+	// Implementation is the name of the peer's implementation, e.g.
+	// "go-ipfs", or the whole agent version if we couldn't find a version
+	// in it.
+	Implementation string
+	// Version is the version of the implementation, valid if HasVersion is
+	// set.
+	Version    Version
+	HasVersion bool
+}
+
+// Parse parses an agent version. Only its first word is considered, and within
+// it, the first "/"-separated segment that is a version, e.g. "0.8.0" in
+// "go-ipfs/0.8.0/48f94e2"; the segments before it name the implementation.
+// Agent versions like "lotus-1.10.0" that append the version with a dash are
+// supported too.
+func Parse(agent string) UserAgent {
+	ua := UserAgent{Raw: agent}
+	word := strings.TrimSpace(agent)
+	if i := strings.IndexAny(word, " \t"); i >= 0 {
+		word = word[:i]
+	}
+	ua.Implementation = strings.TrimSuffix(word, "/")
+
+	segments := strings.Split(word, "/")
+	for i, s := range segments {
+		if i == 0 {
+			continue
+		}
+		if v, ok := ParseVersion(s); ok {
+			ua.Implementation = strings.Join(segments[:i], "/")
+			ua.Version, ua.HasVersion = v, true
+			return ua
+		}
+	}
+
+	// name-1.2.3
+	first := segments[0]
+	for i := len(first) - 1; i > 0; i-- {
+		if first[i] != '-' {
+			continue
+		}
+		if v, ok := ParseVersion(first[i+1:]); ok {
+			ua.Implementation = first[:i]
+			ua.Version, ua.HasVersion = v, true
+			return ua
+		}
+	}
+	return ua
+}
+
+// Class is a coarse classification of peers: their implementation and its
+// major and minor version, e.g. rust-libp2p 0.30.
+type Class struct {
+	Implementation string
+	// Version is the "major.minor" version of the implementation, "" if
+	// unknown.
+	Version string
+}
+
+func (c Class) String() string {
+	if c.Version == "" {
+		return c.Implementation
+	}
+	return c.Implementation + " " + c.Version
+}
+
+// Class returns the class of peers with this agent version.
+func (ua UserAgent) Class() Class {
+	c := Class{Implementation: ua.Implementation}
+	if ua.HasVersion {
+		c.Version = fmt.Sprintf("%d.%d", ua.Version.Major, ua.Version.Minor)
+	}
+	return c
+}
@@ -0,0 +1,59 @@
+package useragent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	for agent, expected := range map[string]struct {
+		impl    string
+		version string
+	}{
+		"go-ipfs/0.8.0/48f94e2":               {"go-ipfs", "0.8.0"},
+		"rust-libp2p/0.30.0":                  {"rust-libp2p", "0.30.0"},
+		"js-libp2p/0.30.11 browser/chrome":    {"js-libp2p", "0.30.11"},
+		"kubo/0.18.0-rc1/":                    {"kubo", "0.18.0-rc1"},
+		"lotus-1.10.0+mainnet+git.0fdf4be":    {"lotus", "1.10.0"},
+		"go-ipfs-v0.9.0-rc1":                  {"go-ipfs", "0.9.0-rc1"},
+		"github.com/libp2p/go-libp2p":         {"github.com/libp2p/go-libp2p", ""},
+		"github.com/libp2p/go-libp2p/v0.14.0": {"github.com/libp2p/go-libp2p", "0.14.0"},
+		"nim-libp2p":                          {"nim-libp2p", ""},
+		"":                                    {"", ""},
+	} {
+		ua := Parse(agent)
+		require.Equal(t, agent, ua.Raw)
+		require.Equal(t, expected.impl, ua.Implementation, agent)
+		require.Equal(t, expected.version != "", ua.HasVersion, agent)
+		if ua.HasVersion {
+			require.Equal(t, expected.version, ua.Version.String(), agent)
+		}
+	}
+}
+
+func TestParseVersion(t *testing.T) {
+	v, ok := ParseVersion("v1.2")
+	require.True(t, ok)
+	require.Equal(t, Version{Major: 1, Minor: 2}, v)
+
+	for _, s := range []string{"", "v", "1.2.3.4", "1.x", "-1.0", "48f94e2"} {
+		_, ok := ParseVersion(s)
+		require.False(t, ok, s)
+	}
+
+	ordered := []string{"0.9.0-rc1", "0.9.0-rc2", "0.9.0", "0.10.0", "1.0.0"}
+	for i := 1; i < len(ordered); i++ {
+		a, _ := ParseVersion(ordered[i-1])
+		b, _ := ParseVersion(ordered[i])
+		require.True(t, a.Less(b), "%s < %s", a, b)
+		require.False(t, b.Less(a), "%s < %s", b, a)
+	}
+}
+
+func TestClass(t *testing.T) {
+	require.Equal(t, Class{"rust-libp2p", "0.30"}, Parse("rust-libp2p/0.30.2").Class())
+	require.Equal(t, "rust-libp2p 0.30", Parse("rust-libp2p/0.30.2").Class().String())
+	require.Equal(t, Class{Implementation: "nim-libp2p"}, Parse("nim-libp2p").Class())
+	require.Equal(t, "nim-libp2p", Parse("nim-libp2p").Class().String())
+}
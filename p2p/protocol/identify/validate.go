@@ -0,0 +1,181 @@
+package identify
+
+import (
+	"fmt"
+	"sync"
+
+	ic "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/record"
+
+	pb "github.com/libp2p/go-libp2p/p2p/protocol/identify/pb"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// ValidationFailure is the reason an Identify message was rejected in strict
+// validation mode.
+type ValidationFailure string
+
+const (
+	// InvalidListenAddr means a listen address couldn't be parsed.
+	InvalidListenAddr ValidationFailure = "invalid-listen-addr"
+	// InvalidObservedAddr means the observed address couldn't be parsed.
+	InvalidObservedAddr ValidationFailure = "invalid-observed-addr"
+	// InvalidPublicKey means the public key couldn't be unmarshalled.
+	InvalidPublicKey ValidationFailure = "invalid-public-key"
+	// PeerIDMismatch means the public key doesn't match the peer we're
+	// connected to.
+	PeerIDMismatch ValidationFailure = "peer-id-mismatch"
+	// InvalidSignedRecord means the signed peer record couldn't be verified,
+	// or describes a different peer.
+	InvalidSignedRecord ValidationFailure = "invalid-signed-record"
+	// RejectedProtocolVersion means the protocol version was rejected by the
+	// check set with the RequireProtocolVersion option.
+	RejectedProtocolVersion ValidationFailure = "rejected-protocol-version"
+)
+
+// ValidationError is returned when an Identify message fails strict
+// validation, or its protocol version is rejected, see the
+// RequireProtocolVersion option.
+type ValidationError struct {
+	Reason ValidationFailure
+	Err    error
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid identify message (%s): %s", e.Reason, e.Err)
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// validationStats counts the Identify messages rejected by strict validation,
+// per reason.
+type validationStats struct {
+	mu       sync.Mutex
+	failures map[ValidationFailure]uint64
+}
+
+func (vs *validationStats) record(reason ValidationFailure) {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	if vs.failures == nil {
+		vs.failures = make(map[ValidationFailure]uint64)
+	}
+	vs.failures[reason]++
+}
+
+func (vs *validationStats) snapshot() map[ValidationFailure]uint64 {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	out := make(map[ValidationFailure]uint64, len(vs.failures))
+	for k, v := range vs.failures {
+		out[k] = v
+	}
+	return out
+}
+
+// ValidationFailures returns the number of Identify messages rejected by strict
+// validation so far, per reason. It's always empty unless the service was
+// constructed with the StrictValidation or RequireProtocolVersion option.
+func (ids *IDService) ValidationFailures() map[ValidationFailure]uint64 {
+	return ids.validationStats.snapshot()
+}
+
+// validateMessage checks that every field of the Identify message received over
+// the given connection is well-formed and consistent with the remote peer.
+func validateMessage(mes *pb.Identify, c network.Conn) error {
+	for _, addr := range mes.GetListenAddrs() {
+		if _, err := ma.NewMultiaddrBytes(addr); err != nil {
+			return &ValidationError{Reason: InvalidListenAddr, Err: err}
+		}
+	}
+
+	if observed := mes.GetObservedAddr(); observed != nil {
+		if _, err := ma.NewMultiaddrBytes(observed); err != nil {
+			return &ValidationError{Reason: InvalidObservedAddr, Err: err}
+		}
+	}
+
+	rp := c.RemotePeer()
+	if kb := mes.GetPublicKey(); kb != nil {
+		key, err := ic.UnmarshalPublicKey(kb)
+		if err != nil {
+			return &ValidationError{Reason: InvalidPublicKey, Err: err}
+		}
+		if !rp.MatchesPublicKey(key) {
+			return &ValidationError{
+				Reason: PeerIDMismatch,
+				Err:    fmt.Errorf("public key doesn't match peer %s", rp),
+			}
+		}
+	}
+
+	if len(mes.GetSignedPeerRecord()) > 0 {
+		env, rec, err := record.ConsumeEnvelope(mes.GetSignedPeerRecord(), peer.PeerRecordEnvelopeDomain)
+		if err != nil {
+			return &ValidationError{Reason: InvalidSignedRecord, Err: err}
+		}
+		prec, ok := rec.(*peer.PeerRecord)
+		if !ok {
+			return &ValidationError{
+				Reason: InvalidSignedRecord,
+				Err:    fmt.Errorf("envelope doesn't contain a peer record"),
+			}
+		}
+		if prec.PeerID != rp || !rp.MatchesPublicKey(env.PublicKey) {
+			return &ValidationError{
+				Reason: InvalidSignedRecord,
+				Err:    fmt.Errorf("signed peer record isn't for peer %s", rp),
+			}
+		}
+	}
+	return nil
+}
+
+// checkMessage validates the message if strict validation is enabled. On
+// failure, it records the reason and, if configured to, closes the connection.
+func (ids *IDService) checkMessage(mes *pb.Identify, c network.Conn) error {
+	if err := ids.checkProtocolVersion(mes, c); err != nil {
+		return err
+	}
+	if !ids.strictValidation {
+		return nil
+	}
+	if ids.insecure && mes.PublicKey != nil {
+		// keys aren't authenticated by insecure transports, don't hold
+		// them against the peer.
+		unkeyed := *mes
+		unkeyed.PublicKey = nil
+		mes = &unkeyed
+	}
+	err := validateMessage(mes, c)
+	if err == nil {
+		return nil
+	}
+	ids.validationStats.record(err.(*ValidationError).Reason)
+	log.Warnw("rejecting identify message", "peer", c.RemotePeer(), "error", err)
+	if ids.disconnectInvalid {
+		_ = c.Close()
+	}
+	return err
+}
+
+// checkProtocolVersion rejects the message, and closes the connection, if its
+// protocol version fails the check set with the RequireProtocolVersion option.
+func (ids *IDService) checkProtocolVersion(mes *pb.Identify, c network.Conn) error {
+	if ids.protocolVersionCheck == nil || ids.protocolVersionCheck(mes.GetProtocolVersion()) {
+		return nil
+	}
+	err := &ValidationError{
+		Reason: RejectedProtocolVersion,
+		Err:    fmt.Errorf("unexpected protocol version %q", mes.GetProtocolVersion()),
+	}
+	ids.validationStats.record(err.Reason)
+	log.Warnw("rejecting peer", "peer", c.RemotePeer(), "error", err)
+	_ = c.Close()
+	return err
+}
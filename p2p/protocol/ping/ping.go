@@ -5,10 +5,11 @@ import (
 	"context"
 	"errors"
 	"io"
+	mrand "math/rand"
 	"time"
 
-	u "github.com/ipfs/go-ipfs-util"
 	logging "github.com/ipfs/go-log/v2"
+	pool "github.com/libp2p/go-buffer-pool"
 	"github.com/libp2p/go-libp2p-core/host"
 	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
@@ -33,7 +34,8 @@ func NewPingService(h host.Host) *PingService {
 }
 
 func (p *PingService) PingHandler(s network.Stream) {
-	buf := make([]byte, PingSize)
+	buf := pool.Get(PingSize)
+	defer pool.Put(buf)
 
 	errCh := make(chan error, 1)
 	defer close(errCh)
@@ -99,9 +101,11 @@ func Ping(ctx context.Context, h host.Host, p peer.ID) <-chan Result {
 		defer close(out)
 		defer cancel()
 
+		// seed once, seeding a new source for every ping is expensive.
+		ra := mrand.New(mrand.NewSource(time.Now().UnixNano()))
 		for ctx.Err() == nil {
 			var res Result
-			res.RTT, res.Error = ping(s)
+			res.RTT, res.Error = ping(s, ra)
 
 			// canceled, ignore everything.
 			if ctx.Err() != nil {
@@ -129,9 +133,13 @@ func Ping(ctx context.Context, h host.Host, p peer.ID) <-chan Result {
 	return out
 }
 
-func ping(s network.Stream) (time.Duration, error) {
-	buf := make([]byte, PingSize)
-	u.NewTimeSeededRand().Read(buf)
+func ping(s network.Stream, randReader io.Reader) (time.Duration, error) {
+	buf := pool.Get(PingSize)
+	defer pool.Put(buf)
+
+	if _, err := io.ReadFull(randReader, buf); err != nil {
+		return 0, err
+	}
 
 	before := time.Now()
 	_, err := s.Write(buf)
@@ -139,7 +147,8 @@ func ping(s network.Stream) (time.Duration, error) {
 		return 0, err
 	}
 
-	rbuf := make([]byte, PingSize)
+	rbuf := pool.Get(PingSize)
+	defer pool.Put(rbuf)
 	_, err = io.ReadFull(s, rbuf)
 	if err != nil {
 		return 0, err
@@ -0,0 +1,115 @@
+// Command interop runs the interop matrix against libp2p implementations run
+// from docker images, see the interop package for the contract the images must
+// follow. It prints a line for every case, and exits with a non-zero status if
+// any failed.
+//
+// For example:
+//
+//	interop -impl rust-libp2p=interop/rust-libp2p -impl js-libp2p=interop/js-libp2p -transports tcp
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p/p2p/test/interop"
+)
+
+// implFlags collects the -impl flags.
+type implFlags []interop.Implementation
+
+func (f *implFlags) String() string {
+	names := make([]string, 0, len(*f))
+	for _, impl := range *f {
+		names = append(names, impl.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+func (f *implFlags) Set(v string) error {
+	parts := strings.SplitN(v, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("expected name=image, got %q", v)
+	}
+	*f = append(*f, interop.Docker(parts[0], parts[1]))
+	return nil
+}
+
+func split(s string) []string {
+	var parts []string
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			parts = append(parts, p)
+		}
+	}
+	return parts
+}
+
+func main() {
+	var impls implFlags
+	flag.Var(&impls, "impl", "implementation to test, as name=image, may be repeated")
+	transports := flag.String("transports", "tcp,ws", "comma-separated transports")
+	securities := flag.String("security", "noise,tls", "comma-separated security protocols")
+	muxers := flag.String("muxers", "yamux,mplex", "comma-separated stream muxers")
+	cases := flag.String("cases", "connect,identify,ping,transfer", "comma-separated cases")
+	size := flag.Int("size", interop.DefaultTransferSize, "bytes sent in the transfer case")
+	timeout := flag.Duration("timeout", interop.DefaultTimeout, "timeout of each case")
+	flag.Parse()
+
+	if len(impls) == 0 {
+		fmt.Fprintln(os.Stderr, "no implementation given, see -impl")
+		os.Exit(2)
+	}
+
+	r := &interop.Runner{
+		Implementations: impls,
+		TransferSize:    *size,
+		Timeout:         *timeout,
+	}
+	var (
+		ts []interop.Transport
+		ss []interop.Security
+		ms []interop.Muxer
+	)
+	for _, t := range split(*transports) {
+		ts = append(ts, interop.Transport(t))
+	}
+	for _, s := range split(*securities) {
+		ss = append(ss, interop.Security(s))
+	}
+	for _, m := range split(*muxers) {
+		ms = append(ms, interop.Muxer(m))
+	}
+	r.Combinations = interop.Matrix(ts, ss, ms)
+	for _, c := range r.Combinations {
+		if _, err := c.Options(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
+	for _, c := range split(*cases) {
+		r.Cases = append(r.Cases, interop.Case(c))
+	}
+
+	failed := 0
+	for _, res := range r.Run(context.Background()) {
+		status := "PASS"
+		if res.Err != nil {
+			status = "FAIL"
+			failed++
+		}
+		fmt.Printf("%s\t%s\t%s\t%s\t%s", status, res.Implementation, res.Combination, res.Case, res.Duration.Round(time.Millisecond))
+		if res.Err != nil {
+			fmt.Printf("\t%s", res.Err)
+		}
+		fmt.Println()
+	}
+	if failed > 0 {
+		fmt.Fprintf(os.Stderr, "%d cases failed\n", failed)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,115 @@
+package interop
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// DockerCommand is the command running docker.
+var DockerCommand = "docker"
+
+// Docker returns an implementation run from the given docker image, see the
+// package documentation for the contract the image must follow. The
+// containers share the host's network, and are removed once stopped.
+func Docker(name, image string) Implementation {
+	return Implementation{
+		Name: name,
+		Start: func(ctx context.Context, c Combination) (peer.AddrInfo, func(), error) {
+			return startDocker(ctx, image, c)
+		},
+	}
+}
+
+func startDocker(ctx context.Context, image string, c Combination) (peer.AddrInfo, func(), error) {
+	cmd := exec.Command(DockerCommand, "run", "--rm", "--network", "host",
+		"-e", "TRANSPORT="+string(c.Transport),
+		"-e", "SECURITY="+string(c.Security),
+		"-e", "MUXER="+string(c.Muxer),
+		image,
+	)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return peer.AddrInfo{}, nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return peer.AddrInfo{}, nil, err
+	}
+	stop := func() {
+		// docker forwards the signal to the container, and removes it.
+		_ = cmd.Process.Signal(os.Interrupt)
+		_ = cmd.Wait()
+	}
+
+	started := make(chan peer.AddrInfo, 1)
+	go func() {
+		ai, err := readAddrInfo(out)
+		if err == nil {
+			started <- ai
+		}
+		close(started)
+		// don't block the container on a full pipe.
+		_, _ = io.Copy(ioutil.Discard, out)
+	}()
+
+	select {
+	case ai, ok := <-started:
+		if !ok {
+			stop()
+			return peer.AddrInfo{}, nil, errors.New("container exited without printing its peer ID and addresses")
+		}
+		return ai, stop, nil
+	case <-ctx.Done():
+		stop()
+		return peer.AddrInfo{}, nil, fmt.Errorf("container didn't print its peer ID and addresses: %w", ctx.Err())
+	}
+}
+
+// readAddrInfo reads the peer ID and addresses an implementation prints on
+// startup, until it printed both. Addresses may include the peer ID, in which
+// case the "Peer ID:" line is optional.
+func readAddrInfo(r io.Reader) (peer.AddrInfo, error) {
+	var ai peer.AddrInfo
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "Peer ID:"):
+			id, err := peer.Decode(strings.TrimSpace(strings.TrimPrefix(line, "Peer ID:")))
+			if err != nil {
+				return ai, fmt.Errorf("invalid peer ID: %w", err)
+			}
+			ai.ID = id
+		case strings.HasPrefix(line, "/"):
+			a, err := ma.NewMultiaddr(line)
+			if err != nil {
+				continue
+			}
+			transport, id := peer.SplitAddr(a)
+			if id != "" {
+				ai.ID = id
+			}
+			if transport != nil {
+				ai.Addrs = append(ai.Addrs, transport)
+			}
+		}
+		if ai.ID != "" && len(ai.Addrs) > 0 {
+			return ai, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return ai, err
+	}
+	return ai, io.EOF
+}
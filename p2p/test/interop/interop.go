@@ -0,0 +1,425 @@
+// Package interop runs a matrix of transport, security protocol and stream
+// muxer combinations against other libp2p implementations, like js-libp2p and
+// rust-libp2p, checking that we can connect, identify, ping and transfer large
+// amounts of data with them. It catches regressions in wire compatibility.
+//
+// Implementations are run from docker images, see Docker, which must follow
+// this contract:
+//
+//   - The combination to use is passed in the TRANSPORT ("tcp" or "ws"),
+//     SECURITY ("noise" or "tls") and MUXER ("yamux" or "mplex") environment
+//     variables.
+//   - The implementation listens on 127.0.0.1 with the transport of the
+//     combination, the container sharing the host's network, and prints its
+//     peer ID on a "Peer ID:" line and its addresses on lines of their own,
+//     as p2pd does. Addresses may include the peer ID instead.
+//   - It serves the identify and ping protocols, and echoes back everything
+//     it receives on streams of EchoProtocol, closing them once we close our
+//     end.
+//
+// Run the matrix with Runner.Run, or with the interop command in cmd/interop.
+package interop
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/libp2p/go-libp2p/p2p/protocol/identify"
+	"github.com/libp2p/go-libp2p/p2p/protocol/ping"
+
+	logging "github.com/ipfs/go-log/v2"
+	mplex "github.com/libp2p/go-libp2p-mplex"
+	noise "github.com/libp2p/go-libp2p-noise"
+	tls "github.com/libp2p/go-libp2p-tls"
+	yamux "github.com/libp2p/go-libp2p-yamux"
+	tcp "github.com/libp2p/go-tcp-transport"
+	ws "github.com/libp2p/go-ws-transport"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+var log = logging.Logger("test/interop")
+
+// EchoProtocol is the protocol implementations echo data back on, for the
+// transfer case.
+const EchoProtocol = "/interop/echo/1.0.0"
+
+// DefaultTransferSize is the amount of data sent in the transfer case.
+const DefaultTransferSize = 16 << 20
+
+// DefaultTimeout bounds the time a case may take.
+const DefaultTimeout = 30 * time.Second
+
+// Transport, Security and Muxer are the names of the transports, security
+// protocols and stream muxers of combinations.
+type (
+	Transport string
+	Security  string
+	Muxer     string
+)
+
+const (
+	TCP       Transport = "tcp"
+	WebSocket Transport = "ws"
+
+	Noise Security = "noise"
+	TLS   Security = "tls"
+
+	Yamux Muxer = "yamux"
+	Mplex Muxer = "mplex"
+)
+
+var (
+	transports = map[Transport]libp2p.Option{
+		TCP:       libp2p.Transport(tcp.NewTCPTransport),
+		WebSocket: libp2p.Transport(ws.New),
+	}
+	securities = map[Security]libp2p.Option{
+		Noise: libp2p.Security(noise.ID, noise.New),
+		TLS:   libp2p.Security(tls.ID, tls.New),
+	}
+	muxers = map[Muxer]libp2p.Option{
+		Yamux: libp2p.Muxer("/yamux/1.0.0", yamux.DefaultTransport),
+		Mplex: libp2p.Muxer("/mplex/6.7.0", mplex.DefaultTransport),
+	}
+)
+
+// Combination is a combination of a transport, a security protocol and a
+// stream muxer.
+type Combination struct {
+	Transport Transport
+	Security  Security
+	Muxer     Muxer
+}
+
+func (c Combination) String() string {
+	return fmt.Sprintf("%s/%s/%s", c.Transport, c.Security, c.Muxer)
+}
+
+// Options returns the options of a host using the combination only.
+func (c Combination) Options() ([]libp2p.Option, error) {
+	t, ok := transports[c.Transport]
+	if !ok {
+		return nil, fmt.Errorf("unknown transport %q", c.Transport)
+	}
+	s, ok := securities[c.Security]
+	if !ok {
+		return nil, fmt.Errorf("unknown security protocol %q", c.Security)
+	}
+	m, ok := muxers[c.Muxer]
+	if !ok {
+		return nil, fmt.Errorf("unknown stream muxer %q", c.Muxer)
+	}
+	return []libp2p.Option{t, s, m}, nil
+}
+
+// matches returns true if the address is one of the combination's transport.
+func (c Combination) matches(a ma.Multiaddr) bool {
+	_, err := a.ValueForProtocol(ma.P_WS)
+	isWS := err == nil
+	if c.Transport == WebSocket {
+		return isWS
+	}
+	_, err = a.ValueForProtocol(ma.P_TCP)
+	return err == nil && !isWS
+}
+
+// Matrix returns every combination of the given transports, security protocols
+// and stream muxers.
+func Matrix(ts []Transport, ss []Security, ms []Muxer) []Combination {
+	var combs []Combination
+	for _, t := range ts {
+		for _, s := range ss {
+			for _, m := range ms {
+				combs = append(combs, Combination{t, s, m})
+			}
+		}
+	}
+	return combs
+}
+
+// FullMatrix returns every combination we support.
+func FullMatrix() []Combination {
+	return Matrix([]Transport{TCP, WebSocket}, []Security{Noise, TLS}, []Muxer{Yamux, Mplex})
+}
+
+// Case is a check run against an implementation.
+type Case string
+
+const (
+	// CaseConnect connects to the implementation.
+	CaseConnect Case = "connect"
+	// CaseIdentify identifies the implementation, and checks it supports
+	// the identify and ping protocols.
+	CaseIdentify Case = "identify"
+	// CasePing pings the implementation.
+	CasePing Case = "ping"
+	// CaseTransfer sends data to the implementation on a stream of
+	// EchoProtocol, and checks it gets the same data back.
+	CaseTransfer Case = "transfer"
+)
+
+// AllCases are all the cases, in the order they're run.
+var AllCases = []Case{CaseConnect, CaseIdentify, CasePing, CaseTransfer}
+
+// Implementation is an implementation to run the matrix against.
+type Implementation struct {
+	// Name names the implementation in results, e.g. "rust-libp2p".
+	Name string
+	// Start starts the implementation with the given combination, and
+	// returns its peer ID and addresses, and a function stopping it.
+	Start func(ctx context.Context, c Combination) (peer.AddrInfo, func(), error)
+}
+
+// Result is the result of a case.
+type Result struct {
+	Implementation string
+	Combination    Combination
+	Case           Case
+	// Err is nil if the case passed. Cases that couldn't run, as a
+	// previous case failed, fail with ErrSkipped.
+	Err      error
+	Duration time.Duration
+}
+
+// ErrSkipped is the error of cases skipped as a previous case failed.
+var ErrSkipped = errors.New("skipped")
+
+// Runner runs the matrix.
+type Runner struct {
+	Implementations []Implementation
+	// Combinations default to FullMatrix, and Cases to AllCases.
+	Combinations []Combination
+	Cases        []Case
+	// TransferSize defaults to DefaultTransferSize, and Timeout to
+	// DefaultTimeout.
+	TransferSize int
+	Timeout      time.Duration
+}
+
+// Run runs every case with every combination against every implementation,
+// one at a time, and returns the results.
+func (r *Runner) Run(ctx context.Context) []Result {
+	combs := r.Combinations
+	if len(combs) == 0 {
+		combs = FullMatrix()
+	}
+	cases := r.Cases
+	if len(cases) == 0 {
+		cases = AllCases
+	}
+	var results []Result
+	for _, impl := range r.Implementations {
+		for _, c := range combs {
+			results = append(results, r.runCombination(ctx, impl, c, cases)...)
+		}
+	}
+	return results
+}
+
+func (r *Runner) timeout() time.Duration {
+	if r.Timeout > 0 {
+		return r.Timeout
+	}
+	return DefaultTimeout
+}
+
+func (r *Runner) runCombination(ctx context.Context, impl Implementation, c Combination, cases []Case) []Result {
+	results := make([]Result, 0, len(cases))
+	fail := func(err error) []Result {
+		for _, cs := range cases[len(results):] {
+			results = append(results, Result{Implementation: impl.Name, Combination: c, Case: cs, Err: err})
+			err = ErrSkipped
+		}
+		return results
+	}
+
+	startCtx, cancel := context.WithTimeout(ctx, r.timeout())
+	ai, stop, err := impl.Start(startCtx, c)
+	cancel()
+	if err != nil {
+		return fail(fmt.Errorf("failed to start %s: %w", impl.Name, err))
+	}
+	defer stop()
+
+	var addrs []ma.Multiaddr
+	for _, a := range ai.Addrs {
+		if c.matches(a) {
+			addrs = append(addrs, a)
+		}
+	}
+	if len(addrs) == 0 {
+		return fail(fmt.Errorf("%s has no %s address", impl.Name, c.Transport))
+	}
+	ai.Addrs = addrs
+
+	h, err := newHost(c)
+	if err != nil {
+		return fail(err)
+	}
+	defer h.Close()
+
+	var conn network.Conn
+	for _, cs := range cases {
+		caseCtx, cancel := context.WithTimeout(ctx, r.timeout())
+		start := time.Now()
+		switch cs {
+		case CaseConnect:
+			conn, err = connect(caseCtx, h, ai)
+		default:
+			if conn == nil {
+				conn, err = connect(caseCtx, h, ai)
+			}
+			if err == nil {
+				err = r.run(caseCtx, cs, h, conn)
+			}
+		}
+		cancel()
+		res := Result{
+			Implementation: impl.Name,
+			Combination:    c,
+			Case:           cs,
+			Err:            err,
+			Duration:       time.Since(start),
+		}
+		log.Debugw("interop case done", "implementation", impl.Name, "combination", c, "case", cs, "error", err)
+		results = append(results, res)
+		if err != nil && cs == CaseConnect {
+			return fail(ErrSkipped)
+		}
+	}
+	return results
+}
+
+func newHost(c Combination) (host.Host, error) {
+	opts, err := c.Options()
+	if err != nil {
+		return nil, err
+	}
+	return libp2p.New(context.Background(), append(opts, libp2p.NoListenAddrs)...)
+}
+
+func connect(ctx context.Context, h host.Host, ai peer.AddrInfo) (network.Conn, error) {
+	if err := h.Connect(ctx, ai); err != nil {
+		return nil, err
+	}
+	conns := h.Network().ConnsToPeer(ai.ID)
+	if len(conns) == 0 {
+		return nil, errors.New("connection closed right away")
+	}
+	return conns[0], nil
+}
+
+func (r *Runner) run(ctx context.Context, cs Case, h host.Host, c network.Conn) error {
+	switch cs {
+	case CaseIdentify:
+		return identifyCase(ctx, h, c)
+	case CasePing:
+		return pingCase(ctx, h, c.RemotePeer())
+	case CaseTransfer:
+		size := r.TransferSize
+		if size <= 0 {
+			size = DefaultTransferSize
+		}
+		return transferCase(ctx, h, c.RemotePeer(), size)
+	}
+	return fmt.Errorf("unknown case %q", cs)
+}
+
+func identifyCase(ctx context.Context, h host.Host, c network.Conn) error {
+	ih, ok := h.(interface{ IDService() *identify.IDService })
+	if !ok {
+		return errors.New("host doesn't expose its identify service")
+	}
+	select {
+	case res := <-ih.IDService().IdentifyWaitResult(c):
+		if res.Err != nil {
+			return res.Err
+		}
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	protos, err := h.Peerstore().SupportsProtocols(c.RemotePeer(), identify.ID, ping.ID)
+	if err != nil {
+		return err
+	}
+	if len(protos) != 2 {
+		return fmt.Errorf("peer only supports %v of the identify and ping protocols", protos)
+	}
+	if h.Peerstore().PubKey(c.RemotePeer()) == nil {
+		return errors.New("peer didn't send its public key")
+	}
+	return nil
+}
+
+func pingCase(ctx context.Context, h host.Host, p peer.ID) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	select {
+	case res, ok := <-ping.Ping(ctx, h, p):
+		if !ok {
+			return ctx.Err()
+		}
+		return res.Error
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func transferCase(ctx context.Context, h host.Host, p peer.ID, size int) error {
+	s, err := h.NewStream(ctx, p, EchoProtocol)
+	if err != nil {
+		return err
+	}
+	defer s.Reset()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = s.SetDeadline(deadline)
+	}
+
+	sent := sha256.New()
+	werr := make(chan error, 1)
+	go func() {
+		_, err := io.CopyN(io.MultiWriter(s, sent), rand.Reader, int64(size))
+		if err == nil {
+			err = s.CloseWrite()
+		}
+		werr <- err
+	}()
+
+	received := sha256.New()
+	n, err := io.Copy(received, s)
+	if err != nil {
+		return fmt.Errorf("failed to read echoed data: %w", err)
+	}
+	if err := <-werr; err != nil {
+		return fmt.Errorf("failed to send data: %w", err)
+	}
+	if n != int64(size) {
+		return fmt.Errorf("sent %d bytes, got %d back", size, n)
+	}
+	if !bytes.Equal(sent.Sum(nil), received.Sum(nil)) {
+		return errors.New("echoed data differs from the data sent")
+	}
+	return s.Close()
+}
+
+// ServeEcho makes the host serve EchoProtocol, as implementations must.
+func ServeEcho(h host.Host) {
+	h.SetStreamHandler(EchoProtocol, func(s network.Stream) {
+		if _, err := io.Copy(s, s); err != nil {
+			_ = s.Reset()
+			return
+		}
+		_ = s.Close()
+	})
+}
@@ -0,0 +1,98 @@
+package interop
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/stretchr/testify/require"
+)
+
+// goImplementation runs the matrix against ourselves.
+func goImplementation(echo bool) Implementation {
+	return Implementation{
+		Name: "go-libp2p",
+		Start: func(_ context.Context, c Combination) (peer.AddrInfo, func(), error) {
+			opts, err := c.Options()
+			if err != nil {
+				return peer.AddrInfo{}, nil, err
+			}
+			addr := "/ip4/127.0.0.1/tcp/0"
+			if c.Transport == WebSocket {
+				addr += "/ws"
+			}
+			h, err := libp2p.New(context.Background(), append(opts, libp2p.ListenAddrStrings(addr))...)
+			if err != nil {
+				return peer.AddrInfo{}, nil, err
+			}
+			if echo {
+				ServeEcho(h)
+			}
+			return peer.AddrInfo{ID: h.ID(), Addrs: h.Addrs()}, func() { h.Close() }, nil
+		},
+	}
+}
+
+func TestRunner(t *testing.T) {
+	r := &Runner{
+		Implementations: []Implementation{goImplementation(true)},
+		TransferSize:    1 << 20,
+	}
+	results := r.Run(context.Background())
+	require.Len(t, results, len(FullMatrix())*len(AllCases))
+	for _, res := range results {
+		require.NoError(t, res.Err, "%s %s", res.Combination, res.Case)
+	}
+}
+
+func TestRunnerFailures(t *testing.T) {
+	r := &Runner{
+		Implementations: []Implementation{
+			goImplementation(false),
+			{
+				Name: "broken",
+				Start: func(context.Context, Combination) (peer.AddrInfo, func(), error) {
+					return peer.AddrInfo{}, nil, errors.New("no such image")
+				},
+			},
+		},
+		Combinations: []Combination{{TCP, Noise, Yamux}},
+	}
+	results := r.Run(context.Background())
+	require.Len(t, results, 2*len(AllCases))
+
+	// without an echo handler, only the transfer fails.
+	for _, res := range results[:len(AllCases)] {
+		if res.Case == CaseTransfer {
+			require.Error(t, res.Err)
+		} else {
+			require.NoError(t, res.Err, res.Case)
+		}
+	}
+	// implementations failing to start fail the first case, and skip the
+	// others.
+	require.Contains(t, results[len(AllCases)].Err.Error(), "no such image")
+	for _, res := range results[len(AllCases)+1:] {
+		require.Equal(t, ErrSkipped, res.Err)
+	}
+}
+
+func TestReadAddrInfo(t *testing.T) {
+	const id = "QmcgpsyWgH8Y8ajJz1Cu72KnS5uo2Aa2LpzU7kinSupNKC"
+	ai, err := readAddrInfo(strings.NewReader("starting\nPeer ID: " + id + "\n/ip4/127.0.0.1/tcp/4001\n"))
+	require.NoError(t, err)
+	require.Equal(t, id, ai.ID.Pretty())
+	require.Len(t, ai.Addrs, 1)
+
+	ai, err = readAddrInfo(strings.NewReader("/ip4/127.0.0.1/tcp/4001/ws/p2p/" + id + "\n"))
+	require.NoError(t, err)
+	require.Equal(t, id, ai.ID.Pretty())
+	require.Equal(t, "/ip4/127.0.0.1/tcp/4001/ws", ai.Addrs[0].String())
+
+	_, err = readAddrInfo(strings.NewReader("/ip4/127.0.0.1/tcp/4001\n"))
+	require.Error(t, err)
+}